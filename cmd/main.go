@@ -1,25 +1,50 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	multinetworkscheme "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/client/clientset/versioned/scheme"
 	netdefscheme "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/client/clientset/versioned/scheme"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	nodeutil "k8s.io/component-helpers/node/util"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/apis/v1alpha1"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/config"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/conformance"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/controller"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/cri"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/features"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/flowexport"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftexec"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
 )
 
@@ -32,9 +57,26 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	utilruntime.Must(multinetworkscheme.AddToScheme(scheme))
 	utilruntime.Must(netdefscheme.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "applier" {
+		if err := runApplier(os.Args[2:]); err != nil {
+			setupLog.Error(err, "applier failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "conformance" {
+		if err := runConformance(os.Args[2:]); err != nil {
+			setupLog.Error(err, "conformance failed")
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := run(); err != nil {
 		setupLog.Error(err, "an error occurred")
 		os.Exit(1)
@@ -42,27 +84,10 @@ func main() {
 }
 
 func run() error {
-	var hostnameOverride string
-	var networkPlugins string
-	var criEndpoint string
-	var hostPrefix string
-	var acceptICMP bool
-	var acceptICMPv6 bool
-	var customIPv4IngressRuleFile string
-	var customIPv4EgressRuleFile string
-	var customIPv6IngressRuleFile string
-	var customIPv6EgressRuleFile string
-
-	flag.StringVar(&hostnameOverride, "hostname-override", "", "The hostname to use for the node. If not set, the hostname will be determined by the node controller.")
-	flag.StringVar(&networkPlugins, "network-plugins", "macvlan", "Comma-separated list of network plugins to be considered for network policies.")
-	flag.StringVar(&criEndpoint, "container-runtime-endpoint", "", "Path to cri socket.")
-	flag.StringVar(&hostPrefix, "host-prefix", "", "If non-empty, will use this string as prefix for host filesystem.")
-	flag.BoolVar(&acceptICMP, "accept-icmp", false, "accept all ICMP traffic")
-	flag.BoolVar(&acceptICMPv6, "accept-icmpv6", false, "accept all ICMPv6 traffic")
-	flag.StringVar(&customIPv4IngressRuleFile, "custom-v4-ingress-rule-file", "", "custom rule file for IPv4 ingress")
-	flag.StringVar(&customIPv4EgressRuleFile, "custom-v4-egress-rule-file", "", "custom rule file for IPv4 egress")
-	flag.StringVar(&customIPv6IngressRuleFile, "custom-v6-ingress-rule-file", "", "custom rule file for IPv6 ingress")
-	flag.StringVar(&customIPv6EgressRuleFile, "custom-v6-egress-rule-file", "", "custom rule file for IPv6 egress")
+	var configFile string
+
+	flag.StringVar(&configFile, "config", "", "Path to a YAML configuration file. Flags set on the command line take precedence over the file, which is watched for changes.")
+	config.NewDefault().BindFlags(flag.CommandLine)
 
 	opts := zap.Options{
 		Development: true,
@@ -74,79 +99,437 @@ func run() error {
 
 	setupLog.Info("Starting multi-network-policy-nftables")
 
-	hostname, err := nodeutil.GetHostname(hostnameOverride)
+	cfg, err := config.Load(configFile, flag.CommandLine)
 	if err != nil {
-		return fmt.Errorf("unable to get hostname: %w", err)
+		return fmt.Errorf("unable to load configuration: %w", err)
 	}
-	setupLog.Info("Handling pods for", "node", hostname)
 
-	if criEndpoint == "" {
-		return fmt.Errorf("container-runtime-endpoint must be set")
+	if err = cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	// Process network plugins flag
-	plugins, err := utils.ParseCommaSeparatedList(networkPlugins)
-	if err != nil {
-		return fmt.Errorf("unable to parse network plugins: %w", err)
+	if err = tuneMemory(cfg); err != nil {
+		return fmt.Errorf("unable to tune the memory limit: %w", err)
 	}
 
-	if len(plugins) == 0 {
-		return fmt.Errorf("at least one network plugin must be specified")
+	if err = features.DefaultFeatureGate.SetFromMap(cfg.FeatureGates); err != nil {
+		return fmt.Errorf("unable to set feature gates: %w", err)
 	}
+	setupLog.Info("Feature gates", "features", cfg.FeatureGates)
 
-	setupLog.Info("Valid network plugins", "plugins", plugins)
+	hostname, err := nodeutil.GetHostname(cfg.HostnameOverride)
+	if err != nil {
+		return fmt.Errorf("unable to get hostname: %w", err)
+	}
+	setupLog.Info("Handling pods for", "node", hostname)
+
+	setupLog.Info("Valid network plugins", "plugins", cfg.NetworkPlugins)
 
-	// Get custom nftables rules
-	commonRules, err := getCustomRules(customIPv4IngressRuleFile, customIPv4EgressRuleFile, customIPv6IngressRuleFile, customIPv6EgressRuleFile)
+	// Get common nftables rules
+	commonRules, err := cfg.CommonRules()
 	if err != nil {
 		return fmt.Errorf("unable to get custom nftables rules: %w", err)
 	}
 
-	// Set ICMP acceptance rules
-	commonRules.AcceptICMP = acceptICMP
-	commonRules.AcceptICMPv6 = acceptICMPv6
+	reportDropLogging(commonRules.DropLogging)
 
 	setupLog.Info("Common rules applied to all pods affected by MultiNetworkPolicies", "rules", commonRules)
 
 	ctx := ctrl.SetupSignalHandler()
 
-	criRuntime := cri.New(criEndpoint, hostPrefix)
+	// The nft binary and its extra environment are only set on the nft invocations
+	execOptions := cfg.ExecOptions()
+	if err := execOptions.Validate(); err != nil {
+		return fmt.Errorf("unable to configure nft execution: %w", err)
+	}
+
+	// The nftables operations run in the privileged applier when it is configured
+	var applierClient *applier.Client
+	if cfg.ApplierSocket != "" {
+		applierClient = applier.NewClient(cfg.ApplierSocket)
+		setupLog.Info("Running nftables operations in the applier", "socket", cfg.ApplierSocket)
+	}
+
+	// Check the custom rules before the first apply, a broken rule would otherwise fail every enforcement
+	ruleChecker, err := nftables.NewRuleChecker(execOptions, applierClient)
+	if err != nil {
+		return fmt.Errorf("unable to create nftables rule checker: %w", err)
+	}
+
+	if err := cfg.CheckCustomRuleFiles(ctx, ruleChecker); err != nil {
+		return fmt.Errorf("invalid custom rule files: %w", err)
+	}
+
+	// The traffic the connection tracking cannot track is enforced with stateless rules
+	conntrackSupport := nftables.DetectConntrack(ctx, execOptions, applierClient, setupLog)
+
+	criRuntime := cri.New(cfg.ContainerRuntimeEndpoint, cfg.HostPrefix)
+	// The applier only enters the network namespaces mounted for the pod sandboxes
+	criRuntime.SandboxNetNS = cfg.ApplierSocket != ""
 	if err := criRuntime.Connect(ctx); err != nil {
 		return fmt.Errorf("unable to connect to cri runtime: %w", err)
 	}
 	defer criRuntime.Close()
 
+	ds := &datastore.Datastore{
+		Policies: make(map[types.NamespacedName]*datastore.Policy),
+	}
+
+	// Restore the state applied before a restart, so that only the pods that changed are applied again
+	if path := cfg.DatastorePath(); path != "" {
+		restored, err := datastore.Load(path)
+		if err != nil {
+			setupLog.Error(err, "Unable to restore datastore, applying the policies to every pod")
+			restored = &datastore.Datastore{Policies: ds.Policies, Path: path}
+		}
+
+		setupLog.Info("Datastore restored", "path", path, "policies", len(restored.Policies))
+		ds = restored
+	}
+
+	coverageReporter := &controller.CoverageReporter{
+		DS:           ds,
+		Hostname:     hostname,
+		ValidPlugins: cfg.NetworkPlugins,
+		Interval:     cfg.CoverageReportInterval.Duration,
+	}
+
+	// The policy suggester serves the policies allowing the flows learned by the learn verdict
+	policySuggester := &controller.PolicySuggester{
+		Hostname: hostname,
+	}
+
+	// Only keep the fields of the pods read by the controllers in the cache
+	cacheOptions := cache.Options{
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Pod{}: {Transform: controller.TransformPod},
+		},
+		// List the pods and namespaces in pages to bound the memory spike of the initial sync
+		NewInformer: controller.NewPagedInformer(cfg.InitialListPageSize),
+	}
+
+	// Only cache the common rules ConfigMap, not all the ConfigMaps of the cluster
+	var commonRulesConfigMap types.NamespacedName
+	if cfg.CommonRulesConfigMap != "" {
+		commonRulesConfigMap, err = cfg.CommonRulesConfigMapName()
+		if err != nil {
+			return err
+		}
+
+		cacheOptions.ByObject[&corev1.ConfigMap{}] = cache.ByObject{
+			Namespaces: map[string]cache.Config{commonRulesConfigMap.Namespace: {}},
+			Field:      fields.OneTermEqualSelector("metadata.name", commonRulesConfigMap.Name),
+		}
+	}
+
+	if cfg.WatchList {
+		controller.EnableWatchList()
+	}
+
 	// Create manager
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	restConfig := ctrl.GetConfigOrDie()
+	restConfig.QPS = float32(cfg.KubeAPIQPS)
+	restConfig.Burst = cfg.KubeAPIBurst
+	metrics.InstrumentRESTConfig(restConfig)
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:         scheme,
 		LeaderElection: false,
-		Metrics:        metricsserver.Options{BindAddress: "0"},
+		Cache:          cacheOptions,
+		Metrics: metricsserver.Options{
+			BindAddress: cfg.MetricsBindAddress,
+			ExtraHandlers: map[string]http.Handler{
+				"/coverage":           coverageReporter,
+				"/datastore":          datastore.SnapshotHandler(ds),
+				"/suggested-policies": policySuggester,
+			},
+		},
 	})
 	if err != nil {
 		return fmt.Errorf("unable to start manager: %w", err)
 	}
 
-	ds := &datastore.Datastore{
-		Policies: make(map[types.NamespacedName]*datastore.Policy),
-	}
-
+	rulesetLayout, _ := nftables.ParseRulesetLayout(cfg.RulesetLayout)
 	nft := &nftables.NFTables{
 		Client:      mgr.GetClient(),
 		Hostname:    hostname,
 		CriRuntime:  criRuntime,
 		CommonRules: commonRules,
+		Exec:        execOptions,
+		Applier:     applierClient,
+
+		VerifyRuleset:     cfg.VerifyRuleset,
+		VerifyRetries:     cfg.VerifyRetries,
+		ConntrackZones:    cfg.ConntrackZones,
+		Conntrack:         conntrackSupport,
+		Recorder:          mgr.GetEventRecorderFor("multi-networkpolicy-nftables"),
+		Selectors:         nftables.NewSelectorCache(),
+		MaxSetElements:    cfg.MaxSetElements,
+		MaxInFlight:       cfg.MaxInFlightNetNS,
+		MaxRules:          cfg.MaxRules,
+		MaxPodSetElements: cfg.MaxPodSetElements,
+
+		EnforcementAnnotations:  cfg.EnforcementAnnotations,
+		RecordNetworkStatistics: cfg.NetworkStatistics,
+		PrefetchSandboxes:       cfg.PrefetchSandboxes,
+		InterfaceReadyTimeout:   cfg.InterfaceReadyTimeout.Duration,
+		RulesetLayout:           rulesetLayout,
+		ExcludedPods:            cfg.PodExclusions(),
+	}
+	if ds.Path != "" {
+		nft.State = ds
 	}
+	if cfg.EarlyDefaultDeny {
+		nft.Policies = ds
+	}
+	if features.Enabled(features.WhereaboutsReservations) {
+		nft.Reservations = nftables.NewReservations()
+	}
+
+	policySuggester.Client = mgr.GetClient()
+	policySuggester.Flows = nft
 
-	if err = (&controller.MultiNetworkReconciler{
+	reconciler := &controller.MultiNetworkReconciler{
 		Client:       mgr.GetClient(),
 		Scheme:       mgr.GetScheme(),
 		DS:           ds,
 		NFT:          nft,
-		ValidPlugins: plugins,
-	}).SetupWithManager(mgr); err != nil {
+		ValidPlugins: cfg.NetworkPlugins,
+		Selectors:    nft.Selectors,
+		Reservations: nft.Reservations,
+		Sandboxes:    nft,
+		Recorder:     mgr.GetEventRecorderFor("multi-networkpolicy-nftables"),
+
+		MaxConcurrentReconciles: cfg.MaxConcurrentReconciles,
+		StartupJitter:           cfg.StartupJitter.Duration,
+		PolicyEventQPS:          cfg.PolicyEventQPS,
+		PolicyEventBurst:        cfg.PolicyEventBurst,
+		PrioritizeRevocations:   features.Enabled(features.RevocationPriority),
+	}
+
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		return fmt.Errorf("unable to create controller: %w", err)
 	}
 
+	// Configuration changes resync the MultiNetworkPolicies and the mirrored NetworkPolicies
+	resync := reconciler.Resync
+	enqueue := reconciler.Enqueue
+	if features.Enabled(features.NetworkPolicyMirroring) {
+		networkPolicyReconciler := &controller.NetworkPolicyReconciler{
+			Client:   mgr.GetClient(),
+			Policies: reconciler,
+		}
+
+		if err = networkPolicyReconciler.SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to create network policy controller: %w", err)
+		}
+
+		resync = func(ctx context.Context) error {
+			return errors.Join(reconciler.Resync(ctx), networkPolicyReconciler.Resync(ctx))
+		}
+		enqueue = func(ctx context.Context, policies []types.NamespacedName) error {
+			return errors.Join(reconciler.Enqueue(ctx, policies), networkPolicyReconciler.Enqueue(ctx, policies))
+		}
+	}
+
+	// The policies with external peers of a peer resolver are resynced when the resolver reports that its endpoints changed
+	nftables.OnPeerResolverChange(func(name string) {
+		go func() {
+			if err := reconciler.Enqueue(ctx, ds.PoliciesWithPeerResolver(name)); err != nil {
+				setupLog.Error(err, "Unable to enqueue the policies with external peers", "resolver", name)
+			}
+		}()
+	})
+	if resolvers := nftables.PeerResolvers(); len(resolvers) > 0 {
+		setupLog.Info("Peer resolvers registered", "resolvers", resolvers)
+	}
+
+	if ds.Path != "" {
+		mirroring := features.Enabled(features.NetworkPolicyMirroring)
+		if err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			if err := reconciler.CleanUpStalePolicies(ctx, mirroring); err != nil {
+				setupLog.Error(err, "Unable to clean up the policies deleted while the controller was not running")
+			}
+			return nil
+		})); err != nil {
+			return fmt.Errorf("unable to add stale policy cleanup: %w", err)
+		}
+	}
+
+	if cfg.GCInterval.Duration > 0 {
+		if err = mgr.Add(&controller.GarbageCollector{
+			Reconciler: reconciler,
+			NFT:        nft,
+			Hostname:   hostname,
+			Interval:   cfg.GCInterval.Duration,
+			Mirroring:  features.Enabled(features.NetworkPolicyMirroring),
+		}); err != nil {
+			return fmt.Errorf("unable to add garbage collector: %w", err)
+		}
+	}
+
+	if cfg.CommonRulesConfigMap != "" {
+		if err = (&controller.CommonRulesReconciler{
+			Client:    mgr.GetClient(),
+			ConfigMap: commonRulesConfigMap,
+			NFT:       nft,
+			Resync:    resync,
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to create common rules controller: %w", err)
+		}
+	}
+
+	if cfg.CommonRulesCRD {
+		if err = (&controller.ClusterCommonRulesReconciler{
+			Client: mgr.GetClient(),
+			NFT:    nft,
+			Resync: resync,
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to create cluster common rules controller: %w", err)
+		}
+	}
+
+	if cfg.ExtraRulesCRD {
+		if err = (&controller.ExtraRulesReconciler{
+			Client:  mgr.GetClient(),
+			NFT:     nft,
+			Checker: ruleChecker,
+			DS:      ds,
+			Enqueue: enqueue,
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to create extra rules controller: %w", err)
+		}
+	}
+
+	if cfg.EarlyDefaultDeny {
+		if err = (&controller.EarlyDenyReconciler{
+			Client:   mgr.GetClient(),
+			NFT:      nft,
+			DS:       ds,
+			Hostname: hostname,
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to create early deny controller: %w", err)
+		}
+	}
+
+	if cfg.CoverageReportInterval.Duration > 0 {
+		coverageReporter.Client = mgr.GetClient()
+		if err = mgr.Add(coverageReporter); err != nil {
+			return fmt.Errorf("unable to add coverage reporter: %w", err)
+		}
+	}
+
+	if cfg.EnforcementStatusInterval.Duration > 0 {
+		reporter := &controller.EnforcementStatusReporter{
+			Client:     mgr.GetClient(),
+			Interfaces: nft,
+			Hostname:   hostname,
+			Interval:   cfg.EnforcementStatusInterval.Duration,
+		}
+		if cfg.NetworkStatistics {
+			reporter.Networks = nft
+		}
+		if err = mgr.Add(reporter); err != nil {
+			return fmt.Errorf("unable to add enforcement status reporter: %w", err)
+		}
+	}
+
+	if cfg.FlowExport.Collector != "" {
+		format, _ := flowexport.ParseFormat(cfg.FlowExport.Format)
+		sink, err := flowexport.NewSink(cfg.FlowExport.Collector, format)
+		if err != nil {
+			return err
+		}
+
+		if err = mgr.Add(&flowexport.Exporter{
+			Client:         mgr.GetClient(),
+			Resolver:       criRuntime,
+			Hostname:       hostname,
+			Sink:           sink,
+			ResyncInterval: cfg.FlowExport.ResyncInterval.Duration,
+		}); err != nil {
+			return fmt.Errorf("unable to add flow exporter: %w", err)
+		}
+	}
+
+	// Watch the config file and the custom rule files, which are typically projected from ConfigMaps
+	if configFile != "" || cfg.CustomRuleFiles != (config.CustomRuleFiles{}) {
+		currentRules := commonRules
+		currentPlugins := cfg.NetworkPlugins
+		currentExclusions := cfg.PodExclusions()
+
+		watcher := &config.Watcher{
+			Path:     configFile,
+			FlagSet:  flag.CommandLine,
+			Debounce: time.Second,
+			OnChange: func(ctx context.Context, newCfg *config.Config) {
+				if changes := cfg.RestartRequiredChanges(newCfg); len(changes) > 0 {
+					setupLog.Info("Configuration changes require a restart to be applied", "settings", changes)
+				}
+
+				if err := newCfg.CheckCustomRuleFiles(ctx, ruleChecker); err != nil {
+					setupLog.Error(err, "Invalid custom rule files, keeping the current configuration")
+					return
+				}
+
+				commonRules, err := newCfg.CommonRules()
+				if err != nil {
+					setupLog.Error(err, "Unable to get custom nftables rules, keeping the current configuration")
+					return
+				}
+
+				exclusions := newCfg.PodExclusions()
+				if reflect.DeepEqual(commonRules, currentRules) && slices.Equal(newCfg.NetworkPlugins, currentPlugins) && reflect.DeepEqual(exclusions, currentExclusions) {
+					setupLog.V(1).Info("Configuration reloaded without changes to apply")
+					return
+				}
+
+				currentRules = commonRules
+				currentPlugins = newCfg.NetworkPlugins
+				currentExclusions = exclusions
+
+				nft.SetCommonRules(commonRules)
+				nft.SetExcludedPods(exclusions)
+				reconciler.SetValidPlugins(newCfg.NetworkPlugins)
+				coverageReporter.SetValidPlugins(newCfg.NetworkPlugins)
+				reportDropLogging(commonRules.DropLogging)
+
+				setupLog.Info("Configuration reloaded, resyncing policies", "plugins", newCfg.NetworkPlugins, "rules", commonRules)
+				if err := resync(ctx); err != nil {
+					setupLog.Error(err, "Unable to resync policies")
+				}
+			},
+		}
+
+		if err = mgr.Add(watcher); err != nil {
+			return fmt.Errorf("unable to add config watcher: %w", err)
+		}
+	}
+
+	// The applies interrupted by the restart are taken from the journal before any sync journals new ones, and the
+	// policies recorded as applied are verified while the cache syncs. The policies of both are repaired first, the
+	// interrupted ones ahead of the others.
+	if nft.State != nil {
+		interrupted := nft.RecoverJournal(ds.TakeJournal(), setupLog.WithName("warm-start"))
+		go func() {
+			if err := reconciler.Enqueue(ctx, interrupted); err != nil {
+				setupLog.Error(err, "Unable to enqueue the interrupted policies")
+			}
+
+			if !cfg.WarmStartVerify {
+				return
+			}
+
+			stale, err := nft.VerifyAppliedStates(ctx, setupLog.WithName("warm-start"))
+			if err != nil {
+				setupLog.Error(err, "Unable to verify the applied policies")
+			}
+			if err := reconciler.Enqueue(ctx, stale); err != nil {
+				setupLog.Error(err, "Unable to enqueue the policies to repair")
+			}
+		}()
+	}
+
 	setupLog.Info("starting manager")
 	if err = mgr.Start(ctx); err != nil {
 		return fmt.Errorf("problem running manager: %w", err)
@@ -155,41 +538,179 @@ func run() error {
 	return nil
 }
 
-// getCustomRules reads custom nftables rules from the provided files and returns a CommonRules struct
-func getCustomRules(customIPv4IngressRuleFile, customIPv4EgressRuleFile, customIPv6IngressRuleFile, customIPv6EgressRuleFile string) (*nftables.CommonRules, error) {
-	commonRules := &nftables.CommonRules{}
+// runApplier runs the applier subcommand, the privileged helper running the nftables operations of the controller in
+// the network namespaces of the pods
+func runApplier(args []string) error {
+	fs := flag.NewFlagSet("applier", flag.ExitOnError)
+	socket := fs.String("socket", applier.DefaultSocket, "Unix socket the nftables operations of the controller are served on.")
+	nftPath := fs.String("nft-path", "", "Path to the nft binary. If not set, nft is looked up in PATH.")
+	nftEnv := fs.String("nft-env", "", "Comma-separated list of KEY=VALUE environment variables set for the nft binary.")
+	opts := zap.Options{}
+	opts.BindFlags(fs)
+	_ = fs.Parse(args)
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	if customIPv4IngressRuleFile != "" {
-		rules, err := utils.ReadRulesFromFile(customIPv4IngressRuleFile)
+	nftExec := nftexec.Options{Path: *nftPath}
+	if *nftEnv != "" {
+		env, err := utils.ParseCommaSeparatedList(*nftEnv)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read custom IPv4 ingress rules from file: %w", err)
+			return fmt.Errorf("invalid nft-env: %w", err)
 		}
-		commonRules.CustomIPv4IngressRules = rules
+		nftExec.Env = env
+	}
+	if err := nftExec.Validate(); err != nil {
+		return fmt.Errorf("unable to configure nft execution: %w", err)
 	}
 
-	if customIPv4EgressRuleFile != "" {
-		rules, err := utils.ReadRulesFromFile(customIPv4EgressRuleFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read custom IPv4 egress rules from file: %w", err)
-		}
-		commonRules.CustomIPv4EgressRules = rules
+	server := &applier.Server{
+		Socket:      *socket,
+		Tables:      nftables.Tables,
+		LocalTables: nftables.LocalTables,
+		Exec:        nftExec,
+		Logger:      ctrl.Log.WithName("applier"),
 	}
 
-	if customIPv6IngressRuleFile != "" {
-		rules, err := utils.ReadRulesFromFile(customIPv6IngressRuleFile)
+	return server.Run(ctrl.SetupSignalHandler())
+}
+
+// runConformance runs the conformance subcommand, which validates the connectivity of probe pods on a network against
+// a matrix of policies, or runs the probe server of a probe pod with "conformance probe"
+func runConformance(args []string) error {
+	if len(args) > 0 && args[0] == "probe" {
+		fs := flag.NewFlagSet("conformance probe", flag.ExitOnError)
+		ports := fs.String("ports", "80,81", "Comma-separated ports accepting the connections of the peers.")
+		opts := zap.Options{}
+		opts.BindFlags(fs)
+		_ = fs.Parse(args[1:])
+
+		ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+		server := &conformance.ProbeServer{Logger: ctrl.Log.WithName("probe")}
+		values, err := utils.ParseCommaSeparatedList(*ports)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read custom IPv6 ingress rules from file: %w", err)
+			return fmt.Errorf("invalid ports: %w", err)
 		}
-		commonRules.CustomIPv6IngressRules = rules
+		for _, value := range values {
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid port %q: %w", value, err)
+			}
+			server.Ports = append(server.Ports, port)
+		}
+
+		return server.Run(ctrl.SetupSignalHandler())
+	}
+
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	kubeconfig := fs.String("kubeconfig", "", "Path to the kubeconfig of the cluster, the default kubeconfig when empty.")
+	network := fs.String("network", "", "Network attachment definition of the probe pods, as <namespace>/<name>.")
+	image := fs.String("image", "", "Image of the probe pods, the image of the controller.")
+	namespacePrefix := fs.String("namespace-prefix", "mnp-conformance", "Prefix of the namespaces of the probe pods.")
+	settle := fs.Duration("settle", 5*time.Second, "Time given to the policies of a case to be enforced before they are probed.")
+	timeout := fs.Duration("timeout", 2*time.Minute, "Timeout of the readiness of the probe pods.")
+	keep := fs.Bool("keep", false, "Keep the namespaces of the probe pods after the run.")
+	opts := zap.Options{}
+	opts.BindFlags(fs)
+	_ = fs.Parse(args)
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if namespace, name, found := strings.Cut(*network, "/"); !found || namespace == "" || name == "" {
+		return fmt.Errorf("invalid network %q, expected <namespace>/<name>", *network)
+	}
+	if *image == "" {
+		return errors.New("missing image of the probe pods")
+	}
+
+	var restConfig *rest.Config
+	var err error
+	if *kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	} else {
+		restConfig, err = ctrl.GetConfig()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get kubeconfig: %w", err)
+	}
+
+	clt, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("unable to create client: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create clientset: %w", err)
+	}
+
+	runner := &conformance.Runner{
+		Client:          clt,
+		Clientset:       clientset,
+		Network:         *network,
+		Image:           *image,
+		NamespacePrefix: *namespacePrefix,
+		Settle:          *settle,
+		Timeout:         *timeout,
+		Keep:            *keep,
+		Logger:          ctrl.Log.WithName("conformance"),
 	}
 
-	if customIPv6EgressRuleFile != "" {
-		rules, err := utils.ReadRulesFromFile(customIPv6EgressRuleFile)
+	summary, err := runner.Run(ctrl.SetupSignalHandler(), conformance.Cases())
+	if err != nil {
+		return err
+	}
+
+	summary.Write(os.Stdout)
+	if !summary.Passed() {
+		return errors.New("the connectivity does not match the policies")
+	}
+
+	return nil
+}
+
+// tuneMemory sets the soft memory limit and the garbage collection target of the Go runtime, so that the daemon collects
+// garbage harder when it gets close to the memory limit of its container instead of being OOM killed, which leaves the
+// pods of the node without enforcement until it restarts
+func tuneMemory(cfg *config.Config) error {
+	// The limit is validated with the configuration
+	limit, _ := cfg.MemoryLimitBytes()
+	source := "memory-limit"
+
+	if limit == 0 && os.Getenv("GOMEMLIMIT") == "" && cfg.AutoMemoryLimit {
+		containerLimit, err := utils.CgroupMemoryLimit()
 		if err != nil {
-			return nil, fmt.Errorf("failed to read custom IPv6 egress rules from file: %w", err)
+			return err
 		}
-		commonRules.CustomIPv6EgressRules = rules
+		limit = int64(float64(containerLimit) * cfg.MemoryLimitRatio)
+		source = "container"
+	}
+
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+		setupLog.Info("Set the memory limit", "bytes", limit, "source", source)
+	}
+
+	if cfg.GCPercent != 0 {
+		debug.SetGCPercent(cfg.GCPercent)
+		setupLog.Info("Set the garbage collection target", "percent", cfg.GCPercent)
+	}
+
+	metrics.MemoryLimit.Set(float64(debug.SetMemoryLimit(-1)))
+
+	return nil
+}
+
+// reportDropLogging exposes the configured drop logging sampling in the metrics
+func reportDropLogging(dropLogging *nftables.DropLogging) {
+	if dropLogging == nil {
+		metrics.DropLogEnabled.Set(0)
+		metrics.DropLogRate.Set(0)
+		metrics.DropLogBurst.Set(0)
+		return
 	}
 
-	return commonRules, nil
+	metrics.DropLogEnabled.Set(1)
+	metrics.DropLogRate.Set(dropLogging.RatePerSecond())
+	metrics.DropLogBurst.Set(float64(dropLogging.Burst))
 }
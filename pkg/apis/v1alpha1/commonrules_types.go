@@ -0,0 +1,51 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CommonRulesSpec are the rules applied to all the pods affected by MultiNetworkPolicies
+type CommonRulesSpec struct {
+	// AcceptICMP accepts all the ICMP traffic
+	AcceptICMP bool `json:"acceptICMP,omitempty"`
+	// AcceptICMPv6 accepts all the ICMPv6 traffic
+	AcceptICMPv6 bool `json:"acceptICMPv6,omitempty"`
+	// AcceptIPsec accepts all the ESP, AH and IKE traffic
+	AcceptIPsec bool `json:"acceptIPsec,omitempty"`
+	// DropIPv6ExtensionHeaders drops the IPv6 packets with a type 0 routing header and the fragmented neighbor discovery
+	// messages
+	DropIPv6ExtensionHeaders bool `json:"dropIPv6ExtensionHeaders,omitempty"`
+	// DropInvalidTCPFlags drops the TCP packets with invalid flag combinations
+	DropInvalidTCPFlags bool `json:"dropInvalidTCPFlags,omitempty"`
+	// AcceptSelfTraffic accepts the traffic received by the pods from their own addresses on any of their interfaces
+	AcceptSelfTraffic bool `json:"acceptSelfTraffic,omitempty"`
+	// IPv4Ingress are nft rules added to the common ingress chain for IPv4
+	IPv4Ingress []string `json:"ipv4Ingress,omitempty"`
+	// IPv4Egress are nft rules added to the common egress chain for IPv4
+	IPv4Egress []string `json:"ipv4Egress,omitempty"`
+	// IPv6Ingress are nft rules added to the common ingress chain for IPv6
+	IPv6Ingress []string `json:"ipv6Ingress,omitempty"`
+	// IPv6Egress are nft rules added to the common egress chain for IPv6
+	IPv6Egress []string `json:"ipv6Egress,omitempty"`
+}
+
+// CommonRules are cluster-wide rules applied by every node, in addition to the rules of the node configuration.
+// The rules of all the CommonRules objects are merged in the order of their names.
+type CommonRules struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CommonRulesSpec `json:"spec,omitempty"`
+}
+
+// CommonRulesList is a list of CommonRules
+type CommonRulesList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []CommonRules `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CommonRules{}, &CommonRulesList{})
+}
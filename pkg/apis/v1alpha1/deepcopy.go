@@ -0,0 +1,289 @@
+package v1alpha1
+
+import (
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *CommonRules) DeepCopyInto(out *CommonRules) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy copies the receiver, creating a new CommonRules.
+func (in *CommonRules) DeepCopy() *CommonRules {
+	if in == nil {
+		return nil
+	}
+	out := new(CommonRules)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *CommonRules) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *CommonRulesList) DeepCopyInto(out *CommonRulesList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]CommonRules, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new CommonRulesList.
+func (in *CommonRulesList) DeepCopy() *CommonRulesList {
+	if in == nil {
+		return nil
+	}
+	out := new(CommonRulesList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *CommonRulesList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *CommonRulesSpec) DeepCopyInto(out *CommonRulesSpec) {
+	*out = *in
+	if in.IPv4Ingress != nil {
+		in, out := &in.IPv4Ingress, &out.IPv4Ingress
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IPv4Egress != nil {
+		in, out := &in.IPv4Egress, &out.IPv4Egress
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IPv6Ingress != nil {
+		in, out := &in.IPv6Ingress, &out.IPv6Ingress
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IPv6Egress != nil {
+		in, out := &in.IPv6Egress, &out.IPv6Egress
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy copies the receiver, creating a new CommonRulesSpec.
+func (in *CommonRulesSpec) DeepCopy() *CommonRulesSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(CommonRulesSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *ExtraRules) DeepCopyInto(out *ExtraRules) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy copies the receiver, creating a new ExtraRules.
+func (in *ExtraRules) DeepCopy() *ExtraRules {
+	if in == nil {
+		return nil
+	}
+	out := new(ExtraRules)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *ExtraRules) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *ExtraRulesList) DeepCopyInto(out *ExtraRulesList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ExtraRules, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new ExtraRulesList.
+func (in *ExtraRulesList) DeepCopy() *ExtraRulesList {
+	if in == nil {
+		return nil
+	}
+	out := new(ExtraRulesList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *ExtraRulesList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *ExtraRulesSpec) DeepCopyInto(out *ExtraRulesSpec) {
+	*out = *in
+	in.PodSelector.DeepCopyInto(&out.PodSelector)
+	if in.Interfaces != nil {
+		in, out := &in.Interfaces, &out.Interfaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Ingress != nil {
+		in, out := &in.Ingress, &out.Ingress
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Egress != nil {
+		in, out := &in.Egress, &out.Egress
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy copies the receiver, creating a new ExtraRulesSpec.
+func (in *ExtraRulesSpec) DeepCopy() *ExtraRulesSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ExtraRulesSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *NodeEnforcementStatus) DeepCopyInto(out *NodeEnforcementStatus) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy copies the receiver, creating a new NodeEnforcementStatus.
+func (in *NodeEnforcementStatus) DeepCopy() *NodeEnforcementStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeEnforcementStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *NodeEnforcementStatus) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *NodeEnforcementStatusList) DeepCopyInto(out *NodeEnforcementStatusList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]NodeEnforcementStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy copies the receiver, creating a new NodeEnforcementStatusList.
+func (in *NodeEnforcementStatusList) DeepCopy() *NodeEnforcementStatusList {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeEnforcementStatusList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject copies the receiver, creating a new runtime.Object.
+func (in *NodeEnforcementStatusList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *NetworkEnforcementStatistics) DeepCopyInto(out *NetworkEnforcementStatistics) {
+	*out = *in
+	in.LastSyncTime.DeepCopyInto(&out.LastSyncTime)
+}
+
+// DeepCopy copies the receiver, creating a new NetworkEnforcementStatistics.
+func (in *NetworkEnforcementStatistics) DeepCopy() *NetworkEnforcementStatistics {
+	if in == nil {
+		return nil
+	}
+	out := new(NetworkEnforcementStatistics)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto copies the receiver, writing into out. in must be non-nil.
+func (in *NodeEnforcementStatusStatus) DeepCopyInto(out *NodeEnforcementStatusStatus) {
+	*out = *in
+	if in.UnenforceableInterfaces != nil {
+		in, out := &in.UnenforceableInterfaces, &out.UnenforceableInterfaces
+		*out = make([]UnenforceableInterface, len(*in))
+		copy(*out, *in)
+	}
+	if in.Networks != nil {
+		in, out := &in.Networks, &out.Networks
+		*out = make([]NetworkEnforcementStatistics, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.LastUpdateTime.DeepCopyInto(&out.LastUpdateTime)
+}
+
+// DeepCopy copies the receiver, creating a new NodeEnforcementStatusStatus.
+func (in *NodeEnforcementStatusStatus) DeepCopy() *NodeEnforcementStatusStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeEnforcementStatusStatus)
+	in.DeepCopyInto(out)
+	return out
+}
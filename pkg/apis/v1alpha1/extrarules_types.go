@@ -0,0 +1,39 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExtraRulesSpec are the rules another controller adds for the pods of a namespace
+type ExtraRulesSpec struct {
+	// PodSelector selects the pods of the namespace the rules are added to, an empty selector selects all the pods
+	PodSelector metav1.LabelSelector `json:"podSelector"`
+	// Interfaces restricts the rules to the interfaces of the pods with these names, empty adds them to all the
+	// interfaces of the secondary networks
+	Interfaces []string `json:"interfaces,omitempty"`
+	// Ingress are nft rules matching the traffic received by the interfaces, evaluated before the policies
+	Ingress []string `json:"ingress,omitempty"`
+	// Egress are nft rules matching the traffic sent by the interfaces, evaluated before the policies
+	Egress []string `json:"egress,omitempty"`
+}
+
+// ExtraRules are vetted rules requested by another controller for the pods of a namespace, merged into the table
+// managed by every node. The rules of all the ExtraRules objects selecting a pod are added in the order of their names.
+type ExtraRules struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ExtraRulesSpec `json:"spec,omitempty"`
+}
+
+// ExtraRulesList is a list of ExtraRules
+type ExtraRulesList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []ExtraRules `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ExtraRules{}, &ExtraRulesList{})
+}
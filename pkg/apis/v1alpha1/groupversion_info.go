@@ -0,0 +1,18 @@
+// Package v1alpha1 contains the API of multi-network-policy-nftables, in the multi-networkpolicy-nftables.k8s.cni.cncf.io group
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group version of the API
+	GroupVersion = schema.GroupVersion{Group: "multi-networkpolicy-nftables.k8s.cni.cncf.io", Version: "v1alpha1"}
+
+	// SchemeBuilder adds the types of the API to a scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types of the API to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
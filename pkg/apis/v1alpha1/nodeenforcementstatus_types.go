@@ -0,0 +1,63 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UnenforceableInterface is an interface of a pod selected by the policies whose traffic bypasses the kernel, e.g. a
+// vhost-user socket or a device bound to a userspace driver for DPDK, the policies are not applied to it
+type UnenforceableInterface struct {
+	// Namespace and Pod are the pod of the interface
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	// Interface is the name of the interface in the network status of the pod
+	Interface string `json:"interface"`
+	// Network is the network of the interface, as <namespace>/<name>
+	Network string `json:"network"`
+	// Reason is why the interface cannot be enforced, e.g. VhostUser or UserspaceDriver
+	Reason string `json:"reason"`
+}
+
+// NetworkEnforcementStatistics is the enforcement of the policies on a network for the pods of a node
+type NetworkEnforcementStatistics struct {
+	// Network is the network, as <namespace>/<name>
+	Network string `json:"network"`
+	// Pods is the number of pods of the node with a policy applied to an interface of the network
+	Pods int `json:"pods"`
+	// Rules is the number of rules of the policies applied to the interfaces of the network, the rules of a policy
+	// applied to several networks of a pod are counted for each of them
+	Rules int `json:"rules"`
+	// LastSyncTime is the time a policy was last synced to an interface of the network
+	LastSyncTime metav1.Time `json:"lastSyncTime,omitempty"`
+}
+
+// NodeEnforcementStatusStatus is the enforcement of the policies on the pods of a node
+type NodeEnforcementStatusStatus struct {
+	// UnenforceableInterfaces are the interfaces of the pods of the node the policies are not applied to
+	UnenforceableInterfaces []UnenforceableInterface `json:"unenforceableInterfaces,omitempty"`
+	// Networks are the enforcement statistics of the networks of the pods of the node with a policy applied
+	Networks []NetworkEnforcementStatistics `json:"networks,omitempty"`
+	// LastUpdateTime is the time the status was last written
+	LastUpdateTime metav1.Time `json:"lastUpdateTime,omitempty"`
+}
+
+// NodeEnforcementStatus reports the enforcement of the policies on the pods of a node, written by the controller of
+// the node. It is cluster-scoped and named after the node.
+type NodeEnforcementStatus struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status NodeEnforcementStatusStatus `json:"status,omitempty"`
+}
+
+// NodeEnforcementStatusList is a list of NodeEnforcementStatus
+type NodeEnforcementStatusList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []NodeEnforcementStatus `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&NodeEnforcementStatus{}, &NodeEnforcementStatusList{})
+}
@@ -0,0 +1,417 @@
+package applier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftexec"
+)
+
+// DefaultSocket is the default unix socket of the applier, on a volume shared with the controller
+const DefaultSocket = "/run/multi-networkpolicy-nftables/applier.sock"
+
+// Path is the path of the requests on the socket of the applier
+const Path = "/v1/nft"
+
+// maxRequestSize bounds the size of a request, a rendered ruleset of the largest policies fits well below it
+const maxRequestSize = 64 << 20
+
+// NetNSDirs are the directories of the network namespaces the applier enters, where the container runtimes mount the
+// network namespaces of the pod sandboxes
+var NetNSDirs = []string{"/var/run/netns", "/run/netns"}
+
+// ErrNetNSNotFound is returned when the network namespace of a request cannot be opened, e.g. when the pod is gone
+var ErrNetNSNotFound = errors.New("network namespace not found")
+
+// Operation is an nftables operation run by the applier
+type Operation string
+
+const (
+	// OperationRun runs an nft script, the rendered transaction of the controller
+	OperationRun Operation = "run"
+	// OperationCheck checks an nft script without committing it, as with nft --check
+	OperationCheck Operation = "check"
+	// OperationList lists the names of the objects of a type in the table
+	OperationList Operation = "list"
+	// OperationListRules lists the rules of a chain, or of the table when the chain is empty
+	OperationListRules Operation = "list-rules"
+	// OperationListElements lists the elements of a set or map
+	OperationListElements Operation = "list-elements"
+	// OperationListInterfaces lists the names of the network interfaces of the network namespace
+	OperationListInterfaces Operation = "list-interfaces"
+)
+
+// Request is an nftables operation sent by the controller to the applier
+type Request struct {
+	// NetNS is the path of the network namespace the operation runs in, in one of NetNSDirs. It is empty for the
+	// local tables, whose operations run in the network namespace of the applier.
+	NetNS     string    `json:"netns,omitempty"`
+	Table     string    `json:"table"`
+	Operation Operation `json:"operation"`
+	// Script is the nft script of the run and check operations
+	Script string `json:"script,omitempty"`
+	// ObjectType is the type of the listed objects, e.g. chains, set or map
+	ObjectType string `json:"objectType,omitempty"`
+	// Name is the chain of the listed rules, or the set or map of the listed elements
+	Name string `json:"name,omitempty"`
+}
+
+// Response is the result of an nftables operation
+type Response struct {
+	Error string `json:"error,omitempty"`
+	// NotFound is set when the error is an nftables not found error
+	NotFound bool `json:"notFound,omitempty"`
+	// NetNSNotFound is set when the network namespace cannot be opened
+	NetNSNotFound bool `json:"netnsNotFound,omitempty"`
+
+	Objects  []string             `json:"objects,omitempty"`
+	Rules    []*knftables.Rule    `json:"rules,omitempty"`
+	Elements []*knftables.Element `json:"elements,omitempty"`
+}
+
+// Server is the privileged applier. It runs the nftables operations of the controller in the network namespaces of
+// the pods, which only needs CAP_NET_ADMIN and CAP_SYS_ADMIN, and never talks to the API server. The operations are
+// restricted to the tables of the controller.
+type Server struct {
+	// Socket is the path of the unix socket the requests are served on
+	Socket string
+	// Tables are the tables the operations can read and change in the network namespaces of the pods
+	Tables []string
+	// LocalTables are the tables the operations can read and change in the network namespace of the applier, e.g.
+	// the scratch table validating the rules
+	LocalTables []string
+	// Exec configures the execution of the nft binary
+	Exec nftexec.Options
+
+	Logger logr.Logger
+
+	// runScript, newNFTables and netnsDirs are replaced by the tests
+	runScript   func(ctx context.Context, script string, check bool) error
+	newNFTables func(table string) (knftables.Interface, error)
+	netnsDirs   []string
+}
+
+// Run serves the requests on the socket until the context is done. The socket is only accessible to the user and
+// the group of the applier, the controller must run with one of them.
+func (s *Server) Run(ctx context.Context) error {
+	if err := os.Remove(s.Socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale socket %s: %w", s.Socket, err)
+	}
+
+	listener, err := net.Listen("unix", s.Socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on socket %s: %w", s.Socket, err)
+	}
+	defer listener.Close()
+
+	if err := os.Chmod(s.Socket, 0o660); err != nil {
+		return fmt.Errorf("failed to restrict socket %s: %w", s.Socket, err)
+	}
+
+	server := &http.Server{Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	s.Logger.Info("Serving nftables operations", "socket", s.Socket, "tables", s.Tables, "localTables", s.LocalTables)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve nftables operations: %w", err)
+	}
+
+	return nil
+}
+
+// Handler returns the handler of the requests
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+Path, func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+			writeResponse(w, http.StatusBadRequest, Response{Error: fmt.Sprintf("invalid request: %v", err)})
+			return
+		}
+
+		if err := s.validate(req); err != nil {
+			s.Logger.Info("Refusing nftables operation", "operation", req.Operation, "table", req.Table, "netns", req.NetNS, "error", err.Error())
+			writeResponse(w, http.StatusForbidden, Response{Error: err.Error()})
+			return
+		}
+
+		writeResponse(w, http.StatusOK, s.apply(r.Context(), req))
+	})
+
+	return mux
+}
+
+func writeResponse(w http.ResponseWriter, status int, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// validate refuses the operations on the other tables, the network namespaces outside of the directories of the
+// network namespaces, and the scripts changing anything but the table
+func (s *Server) validate(req Request) error {
+	switch {
+	case slices.Contains(s.Tables, req.Table):
+		if req.NetNS == "" {
+			return fmt.Errorf("table %q needs a network namespace", req.Table)
+		}
+		if !s.inNetNSDirs(filepath.Clean(req.NetNS)) {
+			return fmt.Errorf("network namespace %s is not in %s", req.NetNS, strings.Join(s.dirs(), ", "))
+		}
+	case slices.Contains(s.LocalTables, req.Table):
+		if req.NetNS != "" {
+			return fmt.Errorf("table %q is only managed in the network namespace of the applier", req.Table)
+		}
+	default:
+		return fmt.Errorf("table %q is not managed by the applier", req.Table)
+	}
+
+	switch req.Operation {
+	case OperationRun, OperationCheck:
+		return validateScript(req.Table, req.Script)
+	case OperationList, OperationListRules, OperationListElements, OperationListInterfaces:
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", req.Operation)
+	}
+}
+
+// dirs returns the directories of the network namespaces the applier enters
+func (s *Server) dirs() []string {
+	if s.netnsDirs != nil {
+		return s.netnsDirs
+	}
+	return NetNSDirs
+}
+
+// inNetNSDirs returns whether a path is a network namespace of the directories of the network namespaces
+func (s *Server) inNetNSDirs(path string) bool {
+	return filepath.IsAbs(path) && slices.Contains(s.dirs(), filepath.Dir(path))
+}
+
+// resolveNetNS resolves the symbolic links of the path of a network namespace, the resolved path must still be in the
+// directories of the network namespaces
+func (s *Server) resolveNetNS(netnsPath string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(netnsPath)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNetNSNotFound, err)
+	}
+	if !s.inNetNSDirs(resolved) {
+		return "", fmt.Errorf("network namespace %s resolves to %s, outside of %s", netnsPath, resolved, strings.Join(s.dirs(), ", "))
+	}
+
+	return resolved, nil
+}
+
+// scriptVerbs are the verbs of the commands written by the transactions
+var scriptVerbs = []string{"add", "create", "insert", "replace", "delete", "destroy", "flush"}
+
+// scriptDirectives are the words of the scripts the applier refuses anywhere, they read other files or define the
+// variables substituted in the commands
+var scriptDirectives = []string{"include", "define"}
+
+// validateScript checks that each statement of a script changes an object of the table, the family and the table
+// follow the object type, e.g. "add rule inet <table> ..." or "add ct timeout inet <table> ...". The transactions
+// render one statement per line, so the statements separated by ";", spanning several lines, or with comments are
+// refused.
+func validateScript(table string, script string) error {
+	for i, line := range strings.Split(script, "\n") {
+		fields, err := statementFields(line)
+		if err != nil {
+			return fmt.Errorf("line %d of the script is not a single statement: %w", i+1, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		valid := false
+		if slices.Contains(scriptVerbs, fields[0]) {
+			for j := 1; j < len(fields)-1 && j <= 3; j++ {
+				if fields[j] == string(knftables.InetFamily) {
+					valid = fields[j+1] == table
+					break
+				}
+			}
+		}
+
+		if !valid {
+			return fmt.Errorf("line %d of the script does not change table %s: %q", i+1, table, line)
+		}
+	}
+
+	return nil
+}
+
+// statementFields returns the words of a statement, the quoted strings are single words. It fails when the statement
+// has a ";" or a comment outside of a block, a directive, unbalanced braces or an unterminated string.
+func statementFields(statement string) ([]string, error) {
+	var (
+		fields []string
+		word   strings.Builder
+		depth  int
+		quoted bool
+	)
+
+	endWord := func() error {
+		if word.Len() == 0 {
+			return nil
+		}
+		if slices.Contains(scriptDirectives, word.String()) {
+			return fmt.Errorf("%q is not allowed", word.String())
+		}
+		fields = append(fields, word.String())
+		word.Reset()
+		return nil
+	}
+
+	for _, c := range statement {
+		if quoted {
+			word.WriteRune(c)
+			quoted = c != '"'
+			continue
+		}
+
+		switch {
+		case c == '"':
+			quoted = true
+		case c == '#':
+			return nil, errors.New("comments are not allowed")
+		case c == ';' && depth == 0:
+			return nil, errors.New("statements separated by \";\" are not allowed")
+		case c == '{':
+			depth++
+		case c == '}':
+			if depth--; depth < 0 {
+				return nil, errors.New("unbalanced braces")
+			}
+		}
+
+		if c == ' ' || c == '\t' || c == '\r' {
+			if err := endWord(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		word.WriteRune(c)
+	}
+
+	if err := endWord(); err != nil {
+		return nil, err
+	}
+	if quoted {
+		return nil, errors.New("unterminated string")
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced braces")
+	}
+
+	return fields, nil
+}
+
+// apply runs an operation in its network namespace
+func (s *Server) apply(ctx context.Context, req Request) Response {
+	var response Response
+	err := s.inNetNS(req.NetNS, func() error {
+		switch req.Operation {
+		case OperationRun, OperationCheck:
+			return s.run(ctx, req.Script, req.Operation == OperationCheck)
+		case OperationListInterfaces:
+			var err error
+			response.Objects, err = listInterfaces()
+			return err
+		}
+
+		nft, err := s.nftables(req.Table)
+		if err != nil {
+			return fmt.Errorf("failed to create nftables client: %w", err)
+		}
+
+		switch req.Operation {
+		case OperationList:
+			response.Objects, err = nft.List(ctx, req.ObjectType)
+		case OperationListRules:
+			response.Rules, err = nft.ListRules(ctx, req.Name)
+		case OperationListElements:
+			response.Elements, err = nft.ListElements(ctx, req.ObjectType, req.Name)
+		}
+		return err
+	})
+	if err != nil {
+		return Response{
+			Error:         err.Error(),
+			NotFound:      knftables.IsNotFound(err),
+			NetNSNotFound: errors.Is(err, ErrNetNSNotFound),
+		}
+	}
+
+	return response
+}
+
+// inNetNS runs fn in the network namespace, or in the current one when the path is empty
+func (s *Server) inNetNS(netnsPath string, fn func() error) error {
+	if netnsPath == "" {
+		return fn()
+	}
+
+	resolved, err := s.resolveNetNS(netnsPath)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(resolved)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetNSNotFound, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		return fn()
+	})
+}
+
+// listInterfaces returns the names of the network interfaces of the current network namespace
+func listInterfaces() ([]string, error) {
+	links, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	names := make([]string, 0, len(links))
+	for _, link := range links {
+		names = append(names, link.Name)
+	}
+
+	return names, nil
+}
+
+func (s *Server) run(ctx context.Context, script string, check bool) error {
+	if s.runScript != nil {
+		return s.runScript(ctx, script, check)
+	}
+
+	return s.Exec.RunScript(ctx, script, check)
+}
+
+func (s *Server) nftables(table string) (knftables.Interface, error) {
+	if s.newNFTables != nil {
+		return s.newNFTables(table)
+	}
+
+	return nftexec.New(knftables.InetFamily, table, s.Exec)
+}
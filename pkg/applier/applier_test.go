@@ -0,0 +1,207 @@
+package applier
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftexec"
+)
+
+func TestApplier(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Applier Suite")
+}
+
+var _ = Describe("Applier", func() {
+	const (
+		// table is a local table, in the network namespace of the applier
+		table    = "multi_networkpolicy_check"
+		podTable = "multi_networkpolicy"
+	)
+
+	var (
+		ctx      context.Context
+		cancel   context.CancelFunc
+		fake     *knftables.Fake
+		mu       sync.Mutex
+		scripts  []string
+		client   *Client
+		netnsDir string
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+
+		fake = knftables.NewFake(knftables.InetFamily, table)
+		scripts = nil
+
+		socket := filepath.Join(GinkgoT().TempDir(), "applier.sock")
+		netnsDir = GinkgoT().TempDir()
+		server := &Server{
+			Socket:      socket,
+			Tables:      []string{podTable},
+			LocalTables: []string{table},
+			Logger:      logr.Discard(),
+			netnsDirs:   []string{netnsDir},
+			runScript: func(_ context.Context, script string, check bool) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				if check {
+					script = "# check\n" + script
+				}
+				scripts = append(scripts, script)
+				return nil
+			},
+			newNFTables: func(string) (knftables.Interface, error) {
+				return fake, nil
+			},
+		}
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- server.Run(ctx) }()
+		DeferCleanup(func() {
+			cancel()
+			Eventually(errCh).Should(Receive(BeNil()))
+		})
+
+		client = NewClient(socket)
+		Eventually(func() error {
+			_, err := client.NFTables("", table).List(ctx, "chains")
+			return err
+		}, 5*time.Second, 10*time.Millisecond).Should(Satisfy(knftables.IsNotFound))
+	})
+
+	It("should run and check the rendered transactions", func() {
+		nft := client.NFTables("", table)
+
+		tx := nft.NewTransaction()
+		tx.Add(&knftables.Table{})
+		tx.Add(&knftables.Chain{Name: "input"})
+		Expect(nft.Check(ctx, tx)).To(Succeed())
+		Expect(nft.Run(ctx, tx)).To(Succeed())
+
+		Expect(scripts).To(Equal([]string{"# check\n" + tx.String(), tx.String()}))
+	})
+
+	It("should list the objects of the table", func() {
+		tx := fake.NewTransaction()
+		tx.Add(&knftables.Table{})
+		tx.Add(&knftables.Chain{Name: "input"})
+		tx.Add(&knftables.Set{Name: "peers", Type: "ipv4_addr"})
+		tx.Add(&knftables.Rule{Chain: "input", Rule: "accept", Comment: knftables.PtrTo("ns/policy")})
+		tx.Add(&knftables.Element{Set: "peers", Key: []string{"10.0.0.1"}})
+		Expect(fake.Run(ctx, tx)).To(Succeed())
+
+		nft := client.NFTables("", table)
+
+		chains, err := nft.List(ctx, "chains")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chains).To(ConsistOf("input"))
+
+		rules, err := nft.ListRules(ctx, "input")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(HaveLen(1))
+		Expect(rules[0].Comment).To(HaveValue(Equal("ns/policy")))
+
+		elements, err := nft.ListElements(ctx, "set", "peers")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(elements).To(HaveLen(1))
+		Expect(elements[0].Key).To(Equal([]string{"10.0.0.1"}))
+
+		_, err = nft.ListRules(ctx, "missing")
+		Expect(knftables.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should refuse the operations outside of the table", func() {
+		_, err := client.NFTables("", "filter").List(ctx, "chains")
+		Expect(err).To(MatchError(ContainSubstring(`table "filter" is not managed`)))
+
+		Expect(client.RunScript(ctx, "", table, "flush ruleset\n")).To(MatchError(ContainSubstring("does not change table")))
+		Expect(client.RunScript(ctx, "", table, "add table inet "+table+"\ndelete table ip nat\n")).To(MatchError(ContainSubstring("line 2")))
+		Expect(scripts).To(BeEmpty())
+
+		Expect(client.RunScript(ctx, "", table, "add ct timeout inet "+table+" udp-1h { protocol udp ; policy = { replied: 3600 } ; }\n")).To(Succeed())
+		Expect(scripts).To(HaveLen(1))
+	})
+
+	It("should refuse the scripts with several statements on a line or with directives", func() {
+		for _, script := range []string{
+			"add table inet " + table + " ; flush ruleset\n",
+			"add table inet " + table + ";delete table ip nat\n",
+			"add table inet " + table + " { flags dormant ; } ; flush ruleset\n",
+			"include \"/etc/nftables.conf\"\n",
+			"define nat = ip nat\nadd table inet " + table + "\n",
+			"add rule inet " + table + " input ip saddr $nat accept comment \"define\" include \"/etc/nftables.conf\"\n",
+			"add table inet " + table + " # flush ruleset\n",
+			"add chain inet " + table + " input { type filter hook input priority 0 ;\n}\n",
+			"add rule inet " + table + " input accept comment \"ns/policy\n",
+		} {
+			Expect(client.RunScript(ctx, "", table, script)).To(MatchError(ContainSubstring("is not a single statement")), script)
+		}
+		Expect(scripts).To(BeEmpty())
+
+		Expect(client.RunScript(ctx, "", table, "add chain inet "+table+" input { type filter hook input priority 0 ; }\n"+
+			"add rule inet "+table+" input ip saddr { 10.0.0.1, 10.0.0.2 } accept comment \"ns/policy; include\"\n")).To(Succeed())
+		Expect(scripts).To(HaveLen(1))
+	})
+
+	It("should only run the operations of the tables of the pods in the directories of the network namespaces", func() {
+		_, err := client.NFTables("", podTable).List(ctx, "chains")
+		Expect(err).To(MatchError(ContainSubstring("needs a network namespace")))
+
+		for _, netns := range []string{"/proc/1/ns/net", "/var/run/netns/pod", filepath.Join(netnsDir, "..", "pod"), "pod"} {
+			_, err = client.NFTables(netns, podTable).List(ctx, "chains")
+			Expect(err).To(MatchError(ContainSubstring("is not in")), netns)
+		}
+
+		host := filepath.Join(GinkgoT().TempDir(), "host")
+		Expect(os.WriteFile(host, nil, 0o600)).To(Succeed())
+		Expect(os.Symlink(host, filepath.Join(netnsDir, "host"))).To(Succeed())
+		_, err = client.NFTables(filepath.Join(netnsDir, "host"), podTable).List(ctx, "chains")
+		Expect(err).To(MatchError(ContainSubstring("outside of")))
+
+		_, err = client.NFTables(filepath.Join(netnsDir, "pod"), table).List(ctx, "chains")
+		Expect(err).To(MatchError(ContainSubstring("only managed in the network namespace of the applier")))
+	})
+
+	It("should run nft with the execution options", func() {
+		dir := GinkgoT().TempDir()
+		nft := filepath.Join(dir, "nft")
+		Expect(os.WriteFile(nft, []byte("#!/bin/sh\necho \"$NFT_TEST_ENV $@\" > "+filepath.Join(dir, "args")+"\n"), 0o755)).To(Succeed())
+
+		server := &Server{Exec: nftexec.Options{Path: nft, Env: []string{"NFT_TEST_ENV=value"}}}
+		Expect(server.run(ctx, "add table inet "+table+"\n", true)).To(Succeed())
+		Expect(os.ReadFile(filepath.Join(dir, "args"))).To(Equal([]byte("value --check -f -\n")))
+	})
+
+	It("should list the interfaces of the network namespace", func() {
+		interfaces, err := client.Interfaces(ctx, "", table)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(interfaces).To(ContainElement("lo"))
+	})
+
+	It("should report the missing network namespaces", func() {
+		_, err := client.NFTables(filepath.Join(netnsDir, "missing"), podTable).List(ctx, "chains")
+		Expect(errors.Is(err, ErrNetNSNotFound)).To(BeTrue())
+	})
+
+	It("should not send the transactions with an error", func() {
+		nft := client.NFTables("", table)
+
+		tx := nft.NewTransaction()
+		tx.Add(&knftables.Chain{})
+		Expect(nft.Run(ctx, tx)).NotTo(Succeed())
+		Expect(scripts).To(BeEmpty())
+	})
+})
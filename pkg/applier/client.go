@@ -0,0 +1,164 @@
+package applier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftexec"
+)
+
+// Client sends the nftables operations of the controller to the applier
+type Client struct {
+	client *http.Client
+}
+
+// NewClient returns a client of the applier listening on the socket
+func NewClient(socket string) *Client {
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// NFTables returns an nftables client of the table in the network namespace, empty for the local tables in the
+// network namespace of the applier
+func (c *Client) NFTables(netnsPath string, table string) knftables.Interface {
+	return &remoteNFTables{
+		client: c,
+		netns:  netnsPath,
+		table:  table,
+		fake:   knftables.NewFake(knftables.InetFamily, table),
+	}
+}
+
+// RunScript runs an nft script changing the table in the network namespace, for the objects the transactions do not
+// support
+func (c *Client) RunScript(ctx context.Context, netnsPath string, table string, script string) error {
+	_, err := c.do(ctx, Request{NetNS: netnsPath, Table: table, Operation: OperationRun, Script: script})
+	return err
+}
+
+// Interfaces returns the names of the network interfaces of the network namespace, the table is only checked against
+// the tables of the applier
+func (c *Client) Interfaces(ctx context.Context, netnsPath string, table string) ([]string, error) {
+	response, err := c.do(ctx, Request{NetNS: netnsPath, Table: table, Operation: OperationListInterfaces})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Objects, nil
+}
+
+// do sends a request to the applier, the errors of the operation are returned with the not found errors of
+// knftables and ErrNetNSNotFound preserved
+func (c *Client) do(ctx context.Context, req Request) (*Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://applier"+Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the applier: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid response of the applier (%s): %w", resp.Status, err)
+	}
+
+	switch {
+	case response.NetNSNotFound:
+		return nil, fmt.Errorf("%w: %s", ErrNetNSNotFound, response.Error)
+	case response.NotFound:
+		return nil, nftexec.NotFoundError(response.Error)
+	case response.Error != "":
+		return nil, errors.New(response.Error)
+	}
+
+	return &response, nil
+}
+
+// remoteNFTables is an nftables client running its operations in the applier
+type remoteNFTables struct {
+	client *Client
+	netns  string
+	table  string
+	// fake creates the transactions, which are only rendered
+	fake *knftables.Fake
+}
+
+var _ knftables.Interface = &remoteNFTables{}
+
+func (r *remoteNFTables) NewTransaction() *knftables.Transaction {
+	return r.fake.NewTransaction()
+}
+
+func (r *remoteNFTables) Run(ctx context.Context, tx *knftables.Transaction) error {
+	return r.runTransaction(ctx, tx, OperationRun)
+}
+
+func (r *remoteNFTables) Check(ctx context.Context, tx *knftables.Transaction) error {
+	return r.runTransaction(ctx, tx, OperationCheck)
+}
+
+// transactionErrorPrefix prefixes the pending error of a transaction, rendered as a comment at its end
+const transactionErrorPrefix = "# ERROR: "
+
+func (r *remoteNFTables) runTransaction(ctx context.Context, tx *knftables.Transaction, operation Operation) error {
+	script := tx.String()
+	if _, txErr, found := strings.Cut(script, transactionErrorPrefix); found {
+		return errors.New(strings.TrimSpace(txErr))
+	}
+
+	_, err := r.client.do(ctx, Request{NetNS: r.netns, Table: r.table, Operation: operation, Script: script})
+	return err
+}
+
+func (r *remoteNFTables) List(ctx context.Context, objectType string) ([]string, error) {
+	response, err := r.client.do(ctx, Request{NetNS: r.netns, Table: r.table, Operation: OperationList, ObjectType: objectType})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Objects, nil
+}
+
+func (r *remoteNFTables) ListRules(ctx context.Context, chain string) ([]*knftables.Rule, error) {
+	response, err := r.client.do(ctx, Request{NetNS: r.netns, Table: r.table, Operation: OperationListRules, Name: chain})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Rules, nil
+}
+
+func (r *remoteNFTables) ListElements(ctx context.Context, objectType, name string) ([]*knftables.Element, error) {
+	response, err := r.client.do(ctx, Request{NetNS: r.netns, Table: r.table, Operation: OperationListElements, ObjectType: objectType, Name: name})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Elements, nil
+}
@@ -0,0 +1,44 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+)
+
+// CompatibilityMode aligns the edge cases of the enforcement with another MultiNetworkPolicy implementation,
+// so that the pods behave the same on the nodes of both implementations during a migration
+type CompatibilityMode string
+
+const (
+	// CompatibilityModeNone applies the behavior of this implementation
+	CompatibilityModeNone CompatibilityMode = ""
+	// CompatibilityModeIPTables applies the behavior of multi-networkpolicy-iptables
+	CompatibilityModeIPTables CompatibilityMode = "iptables"
+)
+
+// The iptables implementation accepts the IPv6 traffic from the link-local prefix and to the link-local and multicast
+// prefixes by default (--allow-ipv6-src-prefix and --allow-ipv6-dst-prefix), which keeps neighbor discovery working
+// without accepting all ICMPv6. This implementation only accepts it with --accept-icmpv6 or custom rules.
+var iptablesIPv6Rules = []string{
+	"ip6 saddr fe80::/10 accept",
+	"ip6 daddr { fe80::/10, ff00::/8 } accept",
+}
+
+// validate checks that the compatibility mode is known
+func (m CompatibilityMode) validate() error {
+	switch m {
+	case CompatibilityModeNone, CompatibilityModeIPTables:
+		return nil
+	default:
+		return fmt.Errorf("unknown compatibility mode %q, expected %q", m, CompatibilityModeIPTables)
+	}
+}
+
+// customIPv6Rules returns the IPv6 rules applied before the custom rules in both directions
+func (m CompatibilityMode) customIPv6Rules() []string {
+	if m == CompatibilityModeIPTables {
+		return slices.Clone(iptablesIPv6Rules)
+	}
+
+	return nil
+}
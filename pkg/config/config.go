@@ -0,0 +1,890 @@
+// Package config provides the configuration of multi-network-policy-nftables, loaded from an optional YAML file
+// and overridden by the command-line flags
+package config
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+	"sigs.k8s.io/yaml"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/features"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/flowexport"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// Config is the configuration of the controller
+type Config struct {
+	HostnameOverride          string            `json:"hostnameOverride,omitempty"`
+	NetworkPlugins            []string          `json:"networkPlugins,omitempty"`
+	ContainerRuntimeEndpoint  string            `json:"containerRuntimeEndpoint,omitempty"`
+	HostPrefix                string            `json:"hostPrefix,omitempty"`
+	AcceptICMP                bool              `json:"acceptICMP,omitempty"`
+	AcceptICMPv6              bool              `json:"acceptICMPv6,omitempty"`
+	AcceptIPsec               bool              `json:"acceptIPsec,omitempty"`
+	DropIPv6ExtensionHeaders  bool              `json:"dropIPv6ExtensionHeaders,omitempty"`
+	DropInvalidTCPFlags       bool              `json:"dropInvalidTCPFlags,omitempty"`
+	AcceptSelfTraffic         bool              `json:"acceptSelfTraffic,omitempty"`
+	CustomRuleFiles           CustomRuleFiles   `json:"customRuleFiles,omitempty"`
+	MetricsBindAddress        string            `json:"metricsBindAddress,omitempty"`
+	CoverageReportInterval    metav1.Duration   `json:"coverageReportInterval,omitempty"`
+	VerifyRuleset             bool              `json:"verifyRuleset"`
+	VerifyRetries             int               `json:"verifyRetries"`
+	DropLogging               DropLogging       `json:"dropLogging,omitempty"`
+	SYNRateLimit              SYNRateLimit      `json:"synRateLimit,omitempty"`
+	TrustedCTMark             string            `json:"trustedCTMark,omitempty"`
+	TrustedMark               string            `json:"trustedMark,omitempty"`
+	AcceptedCTMark            string            `json:"acceptedCTMark,omitempty"`
+	AcceptedMark              string            `json:"acceptedMark,omitempty"`
+	MaxConcurrentReconciles   int               `json:"maxConcurrentReconciles,omitempty"`
+	CommonRulesConfigMap      string            `json:"commonRulesConfigMap,omitempty"`
+	CommonRulesCRD            bool              `json:"commonRulesCRD,omitempty"`
+	ExtraRulesCRD             bool              `json:"extraRulesCRD,omitempty"`
+	EarlyDefaultDeny          bool              `json:"earlyDefaultDeny,omitempty"`
+	FeatureGates              map[string]bool   `json:"featureGates,omitempty"`
+	KubeAPIQPS                float64           `json:"kubeAPIQPS,omitempty"`
+	KubeAPIBurst              int               `json:"kubeAPIBurst,omitempty"`
+	NFTPath                   string            `json:"nftPath,omitempty"`
+	NFTEnv                    []string          `json:"nftEnv,omitempty"`
+	NFTTimeout                metav1.Duration   `json:"nftTimeout,omitempty"`
+	ApplierSocket             string            `json:"applierSocket,omitempty"`
+	ConntrackZones            bool              `json:"conntrackZones,omitempty"`
+	DefaultVerdict            string            `json:"defaultVerdict,omitempty"`
+	TerminalChain             TerminalChain     `json:"terminalChain,omitempty"`
+	CompatibilityMode         CompatibilityMode `json:"compatibilityMode,omitempty"`
+	StateDir                  string            `json:"stateDir,omitempty"`
+	StartupJitter             metav1.Duration   `json:"startupJitter,omitempty"`
+	PolicyEventQPS            float64           `json:"policyEventQPS"`
+	PolicyEventBurst          int               `json:"policyEventBurst,omitempty"`
+	InitialListPageSize       int64             `json:"initialListPageSize"`
+	WatchList                 bool              `json:"watchList,omitempty"`
+	MaxSetElements            int               `json:"maxSetElements"`
+	RulesetLayout             string            `json:"rulesetLayout,omitempty"`
+	MaxInFlightNetNS          int               `json:"maxInFlightNetNS"`
+	PrefetchSandboxes         bool              `json:"prefetchSandboxes"`
+	InterfaceReadyTimeout     metav1.Duration   `json:"interfaceReadyTimeout,omitempty"`
+	GCInterval                metav1.Duration   `json:"gcInterval,omitempty"`
+	WarmStartVerify           bool              `json:"warmStartVerify"`
+	MemoryLimit               string            `json:"memoryLimit,omitempty"`
+	AutoMemoryLimit           bool              `json:"autoMemoryLimit"`
+	MemoryLimitRatio          float64           `json:"memoryLimitRatio"`
+	GCPercent                 int               `json:"gcPercent,omitempty"`
+	MaxRules                  int               `json:"maxRules"`
+	MaxPodSetElements         int               `json:"maxPodSetElements"`
+	FlowExport                FlowExport        `json:"flowExport,omitempty"`
+	EnforcementStatusInterval metav1.Duration   `json:"enforcementStatusInterval,omitempty"`
+	EnforcementAnnotations    bool              `json:"enforcementAnnotations,omitempty"`
+	NetworkStatistics         bool              `json:"networkStatistics,omitempty"`
+	ExcludedPods              []PodExclusion    `json:"excludedPods,omitempty"`
+}
+
+// CustomRuleFiles are the paths to the files with the custom rules of the common chains
+type CustomRuleFiles struct {
+	IPv4Ingress string `json:"ipv4Ingress,omitempty"`
+	IPv4Egress  string `json:"ipv4Egress,omitempty"`
+	IPv6Ingress string `json:"ipv6Ingress,omitempty"`
+	IPv6Egress  string `json:"ipv6Egress,omitempty"`
+}
+
+// DropLogging is the configuration of the logging of the dropped packets
+type DropLogging struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Rate    string `json:"rate,omitempty"`
+	Burst   int    `json:"burst,omitempty"`
+}
+
+// SYNRateLimit is the configuration of the rate limit of the TCP SYN packets received by each managed interface
+type SYNRateLimit struct {
+	Enabled bool   `json:"enabled,omitempty"`
+	Rate    string `json:"rate,omitempty"`
+	Burst   int    `json:"burst,omitempty"`
+}
+
+// TerminalChain is the configuration of the user-defined chain the denied packets jump to
+type TerminalChain struct {
+	Name     string `json:"name,omitempty"`
+	RuleFile string `json:"ruleFile,omitempty"`
+}
+
+// FlowExport is the configuration of the export of the flows of the secondary interfaces to a collector
+type FlowExport struct {
+	Collector      string          `json:"collector,omitempty"`
+	Format         string          `json:"format,omitempty"`
+	ResyncInterval metav1.Duration `json:"resyncInterval,omitempty"`
+}
+
+// PodExclusion selects the pods the policies are never applied to, by the labels of their namespace and their own
+// labels. A missing selector selects all the namespaces or all their pods.
+type PodExclusion struct {
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	PodSelector       *metav1.LabelSelector `json:"podSelector,omitempty"`
+}
+
+// NewDefault returns the default configuration
+func NewDefault() *Config {
+	return &Config{
+		NetworkPlugins:          []string{"macvlan"},
+		MetricsBindAddress:      "0",
+		CoverageReportInterval:  metav1.Duration{Duration: time.Minute},
+		VerifyRuleset:           true,
+		VerifyRetries:           2,
+		DropLogging:             DropLogging{Rate: "10/minute", Burst: 5},
+		SYNRateLimit:            SYNRateLimit{Rate: "100/second", Burst: 200},
+		MaxConcurrentReconciles: 1,
+		KubeAPIQPS:              20,
+		KubeAPIBurst:            30,
+		NFTTimeout:              metav1.Duration{Duration: 30 * time.Second},
+		DefaultVerdict:          string(datastore.VerdictDrop),
+		PolicyEventQPS:          5,
+		PolicyEventBurst:        10,
+		InitialListPageSize:     500,
+		MaxSetElements:          65536,
+		RulesetLayout:           string(nftables.RulesetLayoutPerPolicy),
+		MaxInFlightNetNS:        4,
+		PrefetchSandboxes:       true,
+		InterfaceReadyTimeout:   metav1.Duration{Duration: 30 * time.Second},
+		GCInterval:              metav1.Duration{Duration: 10 * time.Minute},
+		WarmStartVerify:         true,
+		AutoMemoryLimit:         true,
+		MemoryLimitRatio:        0.9,
+		MaxRules:                10000,
+		MaxPodSetElements:       1000000,
+		FlowExport:              FlowExport{Format: string(flowexport.FormatJSON), ResyncInterval: metav1.Duration{Duration: 10 * time.Second}},
+	}
+}
+
+// BindFlags registers the command-line flags of the configuration, using the current values as defaults
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.HostnameOverride, "hostname-override", c.HostnameOverride, "The hostname to use for the node. If not set, the hostname will be determined by the node controller.")
+	fs.Var((*stringSliceValue)(&c.NetworkPlugins), "network-plugins", "Comma-separated list of network plugins to be considered for network policies.")
+	fs.StringVar(&c.ContainerRuntimeEndpoint, "container-runtime-endpoint", c.ContainerRuntimeEndpoint, "Path to cri socket.")
+	fs.StringVar(&c.HostPrefix, "host-prefix", c.HostPrefix, "If non-empty, will use this string as prefix for host filesystem.")
+	fs.BoolVar(&c.AcceptICMP, "accept-icmp", c.AcceptICMP, "accept all ICMP traffic")
+	fs.BoolVar(&c.AcceptICMPv6, "accept-icmpv6", c.AcceptICMPv6, "accept all ICMPv6 traffic")
+	fs.BoolVar(&c.AcceptIPsec, "accept-ipsec", c.AcceptIPsec, "accept all IPsec traffic: ESP, AH and IKE on UDP ports 500 and 4500")
+	fs.BoolVar(&c.DropIPv6ExtensionHeaders, "drop-ipv6-extension-headers", c.DropIPv6ExtensionHeaders, "drop the IPv6 packets with a type 0 routing header and the fragmented neighbor discovery messages")
+	fs.BoolVar(&c.DropInvalidTCPFlags, "drop-invalid-tcp-flags", c.DropInvalidTCPFlags, "drop the TCP packets with invalid flag combinations, e.g. NULL, XMAS and SYN-FIN scans, before the connection tracking")
+	fs.BoolVar(&c.AcceptSelfTraffic, "accept-self-traffic", c.AcceptSelfTraffic, "accept the traffic received by the pods from their own addresses on any of their interfaces, e.g. hairpinned by an external switch")
+	fs.StringVar(&c.CustomRuleFiles.IPv4Ingress, "custom-v4-ingress-rule-file", c.CustomRuleFiles.IPv4Ingress, "custom rule file for IPv4 ingress")
+	fs.StringVar(&c.CustomRuleFiles.IPv4Egress, "custom-v4-egress-rule-file", c.CustomRuleFiles.IPv4Egress, "custom rule file for IPv4 egress")
+	fs.StringVar(&c.CustomRuleFiles.IPv6Ingress, "custom-v6-ingress-rule-file", c.CustomRuleFiles.IPv6Ingress, "custom rule file for IPv6 ingress")
+	fs.StringVar(&c.CustomRuleFiles.IPv6Egress, "custom-v6-egress-rule-file", c.CustomRuleFiles.IPv6Egress, "custom rule file for IPv6 egress")
+	fs.StringVar(&c.MetricsBindAddress, "metrics-bind-address", c.MetricsBindAddress, "The address the metrics endpoint binds to. Use 0 to disable the metrics endpoint.")
+	fs.DurationVar(&c.CoverageReportInterval.Duration, "coverage-report-interval", c.CoverageReportInterval.Duration, "Interval between policy coverage reports. Use 0 to disable coverage reporting.")
+	fs.BoolVar(&c.VerifyRuleset, "verify-ruleset", c.VerifyRuleset, "List the applied ruleset back after each apply and compare it against the desired state.")
+	fs.IntVar(&c.VerifyRetries, "verify-retries", c.VerifyRetries, "Number of times a policy is reapplied when the applied ruleset does not match the desired state.")
+	fs.BoolVar(&c.DropLogging.Enabled, "log-drops", c.DropLogging.Enabled, "Log the packets dropped by the policies to the kernel log.")
+	fs.StringVar(&c.DropLogging.Rate, "drop-log-rate", c.DropLogging.Rate, "Rate of dropped packets logged per chain, as <count>/<second|minute|hour|day>.")
+	fs.IntVar(&c.DropLogging.Burst, "drop-log-burst", c.DropLogging.Burst, "Number of dropped packets logged per chain above the rate.")
+	fs.BoolVar(&c.SYNRateLimit.Enabled, "syn-rate-limit", c.SYNRateLimit.Enabled, "Limit the rate of the TCP SYN packets received by each managed interface, the SYN packets above the rate are dropped.")
+	fs.StringVar(&c.SYNRateLimit.Rate, "syn-rate", c.SYNRateLimit.Rate, "Rate of TCP SYN packets accepted per managed interface, as <count>/<second|minute|hour|day>.")
+	fs.IntVar(&c.SYNRateLimit.Burst, "syn-burst", c.SYNRateLimit.Burst, "Number of TCP SYN packets accepted per managed interface above the rate.")
+	fs.StringVar(&c.TrustedCTMark, "trusted-ct-mark", c.TrustedCTMark, "Accept the connections whose conntrack mark, set by a trusted system in the pod network namespaces, matches <value>[/<mask>]. If not set, the conntrack marks are ignored.")
+	fs.StringVar(&c.TrustedMark, "trusted-mark", c.TrustedMark, "Accept the packets whose mark, set by a trusted system in the pod network namespaces, matches <value>[/<mask>]. If not set, the packet marks are ignored.")
+	fs.StringVar(&c.AcceptedCTMark, "accepted-ct-mark", c.AcceptedCTMark, "Set <value>[/<mask>] on the conntrack mark of the connections accepted by the policies, for the node-level tc or routing rules. If not set, the conntrack marks are not changed.")
+	fs.StringVar(&c.AcceptedMark, "accepted-mark", c.AcceptedMark, "Set <value>[/<mask>] on the mark of the packets accepted by the policies, for the node-level tc or routing rules. If not set, the packet marks are not changed.")
+	fs.IntVar(&c.MaxConcurrentReconciles, "max-concurrent-reconciles", c.MaxConcurrentReconciles, "Maximum number of MultiNetworkPolicies reconciled concurrently.")
+	fs.StringVar(&c.CommonRulesConfigMap, "common-rules-configmap", c.CommonRulesConfigMap, "ConfigMap holding common rules applied to all policies, as <namespace>/<name>. If not set, no ConfigMap is watched.")
+	fs.BoolVar(&c.CommonRulesCRD, "common-rules-crd", c.CommonRulesCRD, "Watch the cluster-scoped CommonRules objects holding common rules applied to all policies. Cannot be used with --common-rules-configmap.")
+	fs.BoolVar(&c.ExtraRulesCRD, "extra-rules-crd", c.ExtraRulesCRD, "Watch the namespaced ExtraRules objects holding the rules other controllers add for the pods.")
+	fs.BoolVar(&c.EarlyDefaultDeny, "early-default-deny", c.EarlyDefaultDeny, "Deny the traffic of the interfaces of the pods selected by the policies as soon as their network status is reported, until the policies are applied.")
+	fs.Float64Var(&c.KubeAPIQPS, "kube-api-qps", c.KubeAPIQPS, "Maximum sustained queries per second to the Kubernetes API.")
+	fs.IntVar(&c.KubeAPIBurst, "kube-api-burst", c.KubeAPIBurst, "Maximum burst of queries to the Kubernetes API above the QPS.")
+	fs.StringVar(&c.NFTPath, "nft-path", c.NFTPath, "Path to the nft binary. If not set, nft is looked up in PATH.")
+	fs.Var((*stringSliceValue)(&c.NFTEnv), "nft-env", "Comma-separated list of KEY=VALUE environment variables set for the nft binary.")
+	fs.DurationVar(&c.NFTTimeout.Duration, "nft-timeout", c.NFTTimeout.Duration, "Timeout of each nft invocation, hung invocations are killed. Use 0 to disable the timeout.")
+	fs.StringVar(&c.ApplierSocket, "applier-socket", c.ApplierSocket, "Unix socket of the privileged applier running the nftables operations in the network namespaces of the pods. If not set, the controller enters them and runs nft itself.")
+	fs.BoolVar(&c.ConntrackZones, "conntrack-zones", c.ConntrackZones, "Track the connections of each secondary interface of the pods in a separate conntrack zone.")
+	fs.StringVar(&c.DefaultVerdict, "default-verdict", c.DefaultVerdict, "Verdict of the traffic not allowed by the policies, drop, reject or learn. Policies can override it with the "+datastore.DefaultVerdictAnnotation+" annotation.")
+	fs.StringVar(&c.TerminalChain.Name, "terminal-chain", c.TerminalChain.Name, "Name of a user-defined chain the denied packets jump to before the default verdict. If not set, the denied packets get the default verdict directly.")
+	fs.StringVar(&c.TerminalChain.RuleFile, "terminal-chain-rule-file", c.TerminalChain.RuleFile, "rule file for the terminal chain")
+	fs.StringVar((*string)(&c.CompatibilityMode), "compatibility-mode", string(c.CompatibilityMode), "Align the edge cases of the enforcement with another implementation during a migration. Options are: iptables.")
+	fs.StringVar(&c.StateDir, "state-dir", c.StateDir, "Directory on the host where the applied state is persisted, so that a restart only applies the policies to the pods that changed. If not set, every pod is applied on startup.")
+	fs.DurationVar(&c.StartupJitter.Duration, "startup-jitter", c.StartupJitter.Duration, "Maximum random delay of the initial sync of the policies on startup, so that the nodes of a rolling upgrade do not sync at once. Use 0 to disable.")
+	fs.Float64Var(&c.PolicyEventQPS, "policy-event-qps", c.PolicyEventQPS, "Maximum sustained rate of the pod, namespace and network events enqueueing each policy, the events above it are delayed. Use 0 to disable.")
+	fs.IntVar(&c.PolicyEventBurst, "policy-event-burst", c.PolicyEventBurst, "Maximum burst of the events enqueueing each policy above the rate.")
+	fs.Int64Var(&c.InitialListPageSize, "initial-list-page-size", c.InitialListPageSize, "Number of pods and namespaces per page of the initial list of the cache. Use 0 to list them at once from the watch cache of the API server.")
+	fs.IntVar(&c.MaxSetElements, "max-set-elements", c.MaxSetElements, "Maximum number of elements of the set of the CIDRs or excepts of a rule, larger lists are chunked across multiple sets. Use 0 to disable chunking.")
+	fs.StringVar(&c.RulesetLayout, "ruleset-layout", c.RulesetLayout, "Layout of the chains of the rules of the policies, per-policy renders a chain per policy and merged renders the rules of all the policies in a chain per direction.")
+	fs.IntVar(&c.MaxInFlightNetNS, "max-inflight-netns", c.MaxInFlightNetNS, "Maximum number of pods whose network namespace is looked up in the container runtime or entered concurrently, the others are queued. Use 0 to disable the limit.")
+	fs.BoolVar(&c.PrefetchSandboxes, "prefetch-sandboxes", c.PrefetchSandboxes, "Resolve the network namespace path of each pod of the node from the container runtime as soon as it runs and cache it, so that the syncs of the policies do not query the container runtime.")
+	fs.DurationVar(&c.InterfaceReadyTimeout.Duration, "interface-ready-timeout", c.InterfaceReadyTimeout.Duration, "Time the syncs of the policies are retried while the network status of a pod does not report its secondary interfaces with their addresses, before a warning event is recorded on the pod and the policies are applied to the reported interfaces. Use 0 to apply the policies from the network status as it is.")
+	fs.DurationVar(&c.GCInterval.Duration, "gc-interval", c.GCInterval.Duration, "Interval between the garbage collections of the state of the deleted pods and policies. Use 0 to disable.")
+	fs.BoolVar(&c.WarmStartVerify, "warm-start-verify", c.WarmStartVerify, "Verify on startup, before the cache is synced, that the policies recorded in the state directory are still applied to the pods, and repair the missing ones first.")
+	fs.IntVar(&c.MaxRules, "max-rules", c.MaxRules, "Maximum number of rules of a policy applied to a pod, larger rulesets are not applied and reported with an event. Use 0 to disable the limit.")
+	fs.IntVar(&c.MaxPodSetElements, "max-pod-set-elements", c.MaxPodSetElements, "Maximum number of set elements applied to a pod by all the policies, the rulesets exceeding it are not applied and reported with an event. Use 0 to disable the limit.")
+	fs.StringVar(&c.FlowExport.Collector, "flow-export-collector", c.FlowExport.Collector, "Collector of the flow records of the secondary interfaces of the pods, as udp://<host>:<port> or tcp://<host>:<port>. If not set, the flows are not exported.")
+	fs.StringVar(&c.FlowExport.Format, "flow-export-format", c.FlowExport.Format, "Format of the exported flow records, json or ipfix.")
+	fs.DurationVar(&c.FlowExport.ResyncInterval.Duration, "flow-export-resync-interval", c.FlowExport.ResyncInterval.Duration, "Interval between the lists of the pods of the node whose flows are exported, the flows of a new pod are exported from the next list.")
+	fs.DurationVar(&c.EnforcementStatusInterval.Duration, "enforcement-status-interval", c.EnforcementStatusInterval.Duration, "Interval between the writes of the NodeEnforcementStatus of the node, reporting the interfaces of the pods the policies cannot be applied to. Use 0 to disable.")
+	fs.BoolVar(&c.EnforcementAnnotations, "enforcement-annotations", c.EnforcementAnnotations, "Stamp the pods with an annotation recording the hash of the policies applied to them and when they last changed.")
+	fs.BoolVar(&c.NetworkStatistics, "network-statistics", c.NetworkStatistics, "Report the pods enforced and the rules installed on each network in the NodeEnforcementStatus of the node. Requires enforcement-status-interval.")
+	fs.StringVar(&c.MemoryLimit, "memory-limit", c.MemoryLimit, "Soft memory limit of the Go runtime, as a quantity like 512Mi. Takes precedence over GOMEMLIMIT and the automatic memory limit.")
+	fs.BoolVar(&c.AutoMemoryLimit, "auto-memory-limit", c.AutoMemoryLimit, "Derive the soft memory limit of the Go runtime from the memory limit of the container when neither memory-limit nor GOMEMLIMIT is set.")
+	fs.Float64Var(&c.MemoryLimitRatio, "memory-limit-ratio", c.MemoryLimitRatio, "Ratio of the memory limit of the container used as the automatic soft memory limit, between 0 and 1.")
+	fs.IntVar(&c.GCPercent, "gc-percent", c.GCPercent, "Garbage collection target percentage of the Go runtime, like GOGC. Use 0 to keep the runtime default and -1 to collect only when the memory limit is reached.")
+	fs.BoolVar(&c.WatchList, "watch-list", c.WatchList, "Stream the initial lists of the cache with a watch instead of listing, on API servers supporting it.")
+	fs.Var((*featureGatesValue)(&c.FeatureGates), "feature-gates", "Comma-separated list of <feature>=true|false pairs enabling or disabling features. Options are:\n"+strings.Join(features.DefaultFeatureGate.KnownFeatures(), "\n"))
+}
+
+// Load reads the config file at path, if any, and applies the flags explicitly set on fs on top of it
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+	cfg := NewDefault()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	// Flags set on the command line take precedence over the config file
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	cfg.BindFlags(overrides)
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil || overrides.Lookup(f.Name) == nil {
+			return
+		}
+
+		err = overrides.Set(f.Name, f.Value.String())
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply flags: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration
+func (c *Config) Validate() error {
+	if c.ContainerRuntimeEndpoint == "" {
+		return fmt.Errorf("container-runtime-endpoint must be set")
+	}
+
+	if len(c.NetworkPlugins) == 0 {
+		return fmt.Errorf("at least one network plugin must be specified")
+	}
+
+	if c.VerifyRetries < 0 {
+		return fmt.Errorf("verify-retries must not be negative")
+	}
+
+	if c.MaxConcurrentReconciles < 1 {
+		return fmt.Errorf("max-concurrent-reconciles must be at least 1")
+	}
+
+	if c.CommonRulesConfigMap != "" {
+		if _, err := c.CommonRulesConfigMapName(); err != nil {
+			return err
+		}
+	}
+
+	if c.CommonRulesCRD && c.CommonRulesConfigMap != "" {
+		return fmt.Errorf("common-rules-crd and common-rules-configmap are mutually exclusive")
+	}
+
+	if c.KubeAPIQPS <= 0 {
+		return fmt.Errorf("kube-api-qps must be positive")
+	}
+
+	if c.KubeAPIBurst < 1 {
+		return fmt.Errorf("kube-api-burst must be at least 1")
+	}
+
+	if _, err := datastore.ParseVerdict(c.DefaultVerdict); err != nil {
+		return fmt.Errorf("invalid default-verdict: %w", err)
+	}
+
+	if c.NFTTimeout.Duration < 0 {
+		return fmt.Errorf("nft-timeout must not be negative")
+	}
+
+	if c.ApplierSocket != "" {
+		if !filepath.IsAbs(c.ApplierSocket) {
+			return fmt.Errorf("applier-socket must be an absolute path")
+		}
+
+		// The flows are read from the conntrack tables of the network namespaces of the pods
+		if c.FlowExport.Collector != "" {
+			return fmt.Errorf("flow-export-collector cannot be used with applier-socket")
+		}
+	}
+
+	if c.StartupJitter.Duration < 0 {
+		return fmt.Errorf("startup-jitter must not be negative")
+	}
+
+	if c.PolicyEventQPS < 0 {
+		return fmt.Errorf("policy-event-qps must not be negative")
+	}
+
+	if c.PolicyEventBurst < 1 {
+		return fmt.Errorf("policy-event-burst must be at least 1")
+	}
+
+	if c.InitialListPageSize < 0 {
+		return fmt.Errorf("initial-list-page-size must not be negative")
+	}
+
+	if c.MaxSetElements < 0 {
+		return fmt.Errorf("max-set-elements must not be negative")
+	}
+
+	if _, err := nftables.ParseRulesetLayout(c.RulesetLayout); err != nil {
+		return fmt.Errorf("invalid ruleset-layout: %w", err)
+	}
+
+	for i, exclusion := range c.ExcludedPods {
+		if exclusion.NamespaceSelector == nil && exclusion.PodSelector == nil {
+			return fmt.Errorf("excludedPods[%d] must set a namespaceSelector or a podSelector", i)
+		}
+
+		for _, selector := range []*metav1.LabelSelector{exclusion.NamespaceSelector, exclusion.PodSelector} {
+			if selector == nil {
+				continue
+			}
+			if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+				return fmt.Errorf("invalid excludedPods[%d]: %w", i, err)
+			}
+		}
+	}
+
+	if c.MaxInFlightNetNS < 0 {
+		return fmt.Errorf("max-inflight-netns must not be negative")
+	}
+
+	if c.InterfaceReadyTimeout.Duration < 0 {
+		return fmt.Errorf("interface-ready-timeout must not be negative")
+	}
+
+	if c.GCInterval.Duration < 0 {
+		return fmt.Errorf("gc-interval must not be negative")
+	}
+
+	if c.EnforcementStatusInterval.Duration < 0 {
+		return fmt.Errorf("enforcement-status-interval must not be negative")
+	}
+
+	if c.NetworkStatistics && c.EnforcementStatusInterval.Duration == 0 {
+		return fmt.Errorf("network-statistics requires enforcement-status-interval")
+	}
+
+	if c.MaxRules < 0 {
+		return fmt.Errorf("max-rules must not be negative")
+	}
+
+	if c.MaxPodSetElements < 0 {
+		return fmt.Errorf("max-pod-set-elements must not be negative")
+	}
+
+	if c.FlowExport.Collector != "" {
+		if _, _, err := flowexport.ParseCollector(c.FlowExport.Collector); err != nil {
+			return fmt.Errorf("invalid flow-export-collector: %w", err)
+		}
+
+		if _, err := flowexport.ParseFormat(c.FlowExport.Format); err != nil {
+			return fmt.Errorf("invalid flow-export-format: %w", err)
+		}
+
+		if c.FlowExport.ResyncInterval.Duration <= 0 {
+			return fmt.Errorf("flow-export-resync-interval must be positive")
+		}
+	}
+
+	if _, err := c.MemoryLimitBytes(); err != nil {
+		return err
+	}
+
+	if c.MemoryLimitRatio <= 0 || c.MemoryLimitRatio > 1 {
+		return fmt.Errorf("memory-limit-ratio must be greater than 0 and at most 1")
+	}
+
+	if c.GCPercent < -1 {
+		return fmt.Errorf("gc-percent must be at least -1")
+	}
+
+	for _, env := range c.NFTEnv {
+		if key, _, found := strings.Cut(env, "="); !found || key == "" {
+			return fmt.Errorf("invalid nft-env %q, expected KEY=VALUE", env)
+		}
+	}
+
+	if err := features.Validate(c.FeatureGates); err != nil {
+		return fmt.Errorf("invalid feature-gates: %w", err)
+	}
+
+	if dropLogging := c.nftDropLogging(); dropLogging != nil {
+		if err := dropLogging.Validate(); err != nil {
+			return fmt.Errorf("invalid drop logging configuration: %w", err)
+		}
+	}
+
+	if synRateLimit := c.nftSYNRateLimit(); synRateLimit != nil {
+		if err := synRateLimit.Validate(); err != nil {
+			return fmt.Errorf("invalid SYN rate limit configuration: %w", err)
+		}
+	}
+
+	for _, mark := range []struct{ name, value string }{
+		{"trusted-ct-mark", c.TrustedCTMark},
+		{"trusted-mark", c.TrustedMark},
+		{"accepted-ct-mark", c.AcceptedCTMark},
+		{"accepted-mark", c.AcceptedMark},
+	} {
+		if mark.value == "" {
+			continue
+		}
+
+		if _, err := nftables.ParseMark(mark.value); err != nil {
+			return fmt.Errorf("invalid %s: %w", mark.name, err)
+		}
+	}
+
+	if err := c.CompatibilityMode.validate(); err != nil {
+		return fmt.Errorf("invalid compatibility-mode: %w", err)
+	}
+
+	if c.TerminalChain.Name == "" && c.TerminalChain.RuleFile != "" {
+		return fmt.Errorf("terminal-chain-rule-file requires terminal-chain")
+	}
+
+	if c.TerminalChain.Name != "" {
+		terminalChain := &nftables.TerminalChain{Name: c.TerminalChain.Name}
+		if err := terminalChain.Validate(); err != nil {
+			return fmt.Errorf("invalid terminal-chain: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// CommonRules reads the custom rule files and returns the rules applied to all policies
+func (c *Config) CommonRules() (*nftables.CommonRules, error) {
+	commonRules := &nftables.CommonRules{
+		AcceptICMP:               c.AcceptICMP,
+		AcceptICMPv6:             c.AcceptICMPv6,
+		AcceptIPsec:              c.AcceptIPsec,
+		DropIPv6ExtensionHeaders: c.DropIPv6ExtensionHeaders,
+		DropInvalidTCPFlags:      c.DropInvalidTCPFlags,
+		AcceptSelfTraffic:        c.AcceptSelfTraffic,
+		DropLogging:              c.nftDropLogging(),
+		SYNRateLimit:             c.nftSYNRateLimit(),
+	}
+
+	// The verdict and the marks are validated with the configuration
+	commonRules.DefaultVerdict, _ = datastore.ParseVerdict(c.DefaultVerdict)
+	if c.TrustedCTMark != "" {
+		commonRules.TrustedCTMark, _ = nftables.ParseMark(c.TrustedCTMark)
+	}
+	if c.TrustedMark != "" {
+		commonRules.TrustedMark, _ = nftables.ParseMark(c.TrustedMark)
+	}
+	if c.AcceptedCTMark != "" {
+		commonRules.AcceptedCTMark, _ = nftables.ParseMark(c.AcceptedCTMark)
+	}
+	if c.AcceptedMark != "" {
+		commonRules.AcceptedMark, _ = nftables.ParseMark(c.AcceptedMark)
+	}
+
+	if c.CustomRuleFiles.IPv4Ingress != "" {
+		rules, err := utils.ReadRulesFromFile(c.CustomRuleFiles.IPv4Ingress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read custom IPv4 ingress rules from file: %w", err)
+		}
+		commonRules.CustomIPv4IngressRules = rules
+	}
+
+	if c.CustomRuleFiles.IPv4Egress != "" {
+		rules, err := utils.ReadRulesFromFile(c.CustomRuleFiles.IPv4Egress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read custom IPv4 egress rules from file: %w", err)
+		}
+		commonRules.CustomIPv4EgressRules = rules
+	}
+
+	if c.CustomRuleFiles.IPv6Ingress != "" {
+		rules, err := utils.ReadRulesFromFile(c.CustomRuleFiles.IPv6Ingress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read custom IPv6 ingress rules from file: %w", err)
+		}
+		commonRules.CustomIPv6IngressRules = rules
+	}
+
+	if c.CustomRuleFiles.IPv6Egress != "" {
+		rules, err := utils.ReadRulesFromFile(c.CustomRuleFiles.IPv6Egress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read custom IPv6 egress rules from file: %w", err)
+		}
+		commonRules.CustomIPv6EgressRules = rules
+	}
+
+	// The rules of the compatibility mode come first, so that the custom rules cannot drop the traffic they accept
+	if rules := c.CompatibilityMode.customIPv6Rules(); len(rules) > 0 {
+		commonRules.CustomIPv6IngressRules = slices.Concat(rules, commonRules.CustomIPv6IngressRules)
+		commonRules.CustomIPv6EgressRules = slices.Concat(rules, commonRules.CustomIPv6EgressRules)
+	}
+
+	if c.TerminalChain.Name != "" {
+		commonRules.TerminalChain = &nftables.TerminalChain{Name: c.TerminalChain.Name}
+
+		if c.TerminalChain.RuleFile != "" {
+			rules, err := utils.ReadRulesFromFile(c.TerminalChain.RuleFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read terminal chain rules from file: %w", err)
+			}
+			commonRules.TerminalChain.Rules = rules
+		}
+	}
+
+	if err := commonRules.Validate(); err != nil {
+		return nil, err
+	}
+
+	return commonRules, nil
+}
+
+// CheckCustomRuleFiles checks every rule of the custom rule files and the terminal chain rule file with nft, errors report the file and line of the rule
+func (c *Config) CheckCustomRuleFiles(ctx context.Context, nft knftables.Interface) error {
+	files := []struct {
+		path string
+		ipv6 bool
+	}{
+		{c.CustomRuleFiles.IPv4Ingress, false},
+		{c.CustomRuleFiles.IPv4Egress, false},
+		{c.CustomRuleFiles.IPv6Ingress, true},
+		{c.CustomRuleFiles.IPv6Egress, true},
+		{c.TerminalChain.RuleFile, false},
+	}
+
+	var errs []error
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+
+		rules, err := readRuleLines(file.path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read custom rules from file %s: %w", file.path, err))
+			continue
+		}
+
+		for _, rule := range rules {
+			if err := nftables.CheckCustomRule(ctx, nft, rule.Text, file.ipv6); err != nil {
+				errs = append(errs, fmt.Errorf("%s:%d: %w", file.path, rule.Line, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// readRuleLines reads the rules of a custom rule file with their line numbers
+func readRuleLines(path string) ([]utils.Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return utils.ReadRuleLines(f)
+}
+
+// RestartRequiredChanges returns the settings that changed in other and can only be applied on restart
+func (c *Config) RestartRequiredChanges(other *Config) []string {
+	var changes []string
+
+	if c.HostnameOverride != other.HostnameOverride {
+		changes = append(changes, "hostnameOverride")
+	}
+	if c.ContainerRuntimeEndpoint != other.ContainerRuntimeEndpoint {
+		changes = append(changes, "containerRuntimeEndpoint")
+	}
+	if c.HostPrefix != other.HostPrefix {
+		changes = append(changes, "hostPrefix")
+	}
+	if c.MetricsBindAddress != other.MetricsBindAddress {
+		changes = append(changes, "metricsBindAddress")
+	}
+	if c.CoverageReportInterval != other.CoverageReportInterval {
+		changes = append(changes, "coverageReportInterval")
+	}
+	if c.VerifyRuleset != other.VerifyRuleset {
+		changes = append(changes, "verifyRuleset")
+	}
+	if c.VerifyRetries != other.VerifyRetries {
+		changes = append(changes, "verifyRetries")
+	}
+	if c.MaxConcurrentReconciles != other.MaxConcurrentReconciles {
+		changes = append(changes, "maxConcurrentReconciles")
+	}
+	if c.CommonRulesConfigMap != other.CommonRulesConfigMap {
+		changes = append(changes, "commonRulesConfigMap")
+	}
+	if c.CommonRulesCRD != other.CommonRulesCRD {
+		changes = append(changes, "commonRulesCRD")
+	}
+	if c.ExtraRulesCRD != other.ExtraRulesCRD {
+		changes = append(changes, "extraRulesCRD")
+	}
+	if c.EarlyDefaultDeny != other.EarlyDefaultDeny {
+		changes = append(changes, "earlyDefaultDeny")
+	}
+	if c.KubeAPIQPS != other.KubeAPIQPS {
+		changes = append(changes, "kubeAPIQPS")
+	}
+	if c.KubeAPIBurst != other.KubeAPIBurst {
+		changes = append(changes, "kubeAPIBurst")
+	}
+	if c.NFTPath != other.NFTPath {
+		changes = append(changes, "nftPath")
+	}
+	if !slices.Equal(c.NFTEnv, other.NFTEnv) {
+		changes = append(changes, "nftEnv")
+	}
+	if c.NFTTimeout != other.NFTTimeout {
+		changes = append(changes, "nftTimeout")
+	}
+	if c.ApplierSocket != other.ApplierSocket {
+		changes = append(changes, "applierSocket")
+	}
+	if c.ConntrackZones != other.ConntrackZones {
+		changes = append(changes, "conntrackZones")
+	}
+	if c.StateDir != other.StateDir {
+		changes = append(changes, "stateDir")
+	}
+	if c.StartupJitter != other.StartupJitter {
+		changes = append(changes, "startupJitter")
+	}
+	if c.PolicyEventQPS != other.PolicyEventQPS {
+		changes = append(changes, "policyEventQPS")
+	}
+	if c.PolicyEventBurst != other.PolicyEventBurst {
+		changes = append(changes, "policyEventBurst")
+	}
+	if c.InitialListPageSize != other.InitialListPageSize {
+		changes = append(changes, "initialListPageSize")
+	}
+	if c.WatchList != other.WatchList {
+		changes = append(changes, "watchList")
+	}
+	if c.MaxSetElements != other.MaxSetElements {
+		changes = append(changes, "maxSetElements")
+	}
+	if c.RulesetLayout != other.RulesetLayout {
+		changes = append(changes, "rulesetLayout")
+	}
+	if c.MaxInFlightNetNS != other.MaxInFlightNetNS {
+		changes = append(changes, "maxInFlightNetNS")
+	}
+	if c.PrefetchSandboxes != other.PrefetchSandboxes {
+		changes = append(changes, "prefetchSandboxes")
+	}
+	if c.InterfaceReadyTimeout != other.InterfaceReadyTimeout {
+		changes = append(changes, "interfaceReadyTimeout")
+	}
+	if c.GCInterval != other.GCInterval {
+		changes = append(changes, "gcInterval")
+	}
+	if c.EnforcementStatusInterval != other.EnforcementStatusInterval {
+		changes = append(changes, "enforcementStatusInterval")
+	}
+	if c.EnforcementAnnotations != other.EnforcementAnnotations {
+		changes = append(changes, "enforcementAnnotations")
+	}
+	if c.NetworkStatistics != other.NetworkStatistics {
+		changes = append(changes, "networkStatistics")
+	}
+	if c.WarmStartVerify != other.WarmStartVerify {
+		changes = append(changes, "warmStartVerify")
+	}
+	if c.MemoryLimit != other.MemoryLimit {
+		changes = append(changes, "memoryLimit")
+	}
+	if c.AutoMemoryLimit != other.AutoMemoryLimit {
+		changes = append(changes, "autoMemoryLimit")
+	}
+	if c.MemoryLimitRatio != other.MemoryLimitRatio {
+		changes = append(changes, "memoryLimitRatio")
+	}
+	if c.GCPercent != other.GCPercent {
+		changes = append(changes, "gcPercent")
+	}
+	if c.MaxRules != other.MaxRules {
+		changes = append(changes, "maxRules")
+	}
+	if c.MaxPodSetElements != other.MaxPodSetElements {
+		changes = append(changes, "maxPodSetElements")
+	}
+	if c.FlowExport != other.FlowExport {
+		changes = append(changes, "flowExport")
+	}
+	if !maps.Equal(c.FeatureGates, other.FeatureGates) {
+		changes = append(changes, "featureGates")
+	}
+
+	return changes
+}
+
+// DatastorePath returns the path of the persisted datastore, empty when the state directory is not set
+func (c *Config) DatastorePath() string {
+	if c.StateDir == "" {
+		return ""
+	}
+
+	return filepath.Join(c.StateDir, "datastore.json")
+}
+
+// MemoryLimitBytes returns the soft memory limit of the Go runtime in bytes, 0 when it is not set
+func (c *Config) MemoryLimitBytes() (int64, error) {
+	if c.MemoryLimit == "" {
+		return 0, nil
+	}
+
+	quantity, err := resource.ParseQuantity(c.MemoryLimit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory-limit %q: %w", c.MemoryLimit, err)
+	}
+
+	if quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("memory-limit must be positive")
+	}
+
+	return quantity.Value(), nil
+}
+
+// CommonRulesConfigMapName returns the namespaced name of the common rules ConfigMap
+func (c *Config) CommonRulesConfigMapName() (types.NamespacedName, error) {
+	namespace, name, found := strings.Cut(c.CommonRulesConfigMap, "/")
+	if !found || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return types.NamespacedName{}, fmt.Errorf("invalid common-rules-configmap %q, expected <namespace>/<name>", c.CommonRulesConfigMap)
+	}
+
+	return types.NamespacedName{Namespace: namespace, Name: name}, nil
+}
+
+// nftDropLogging returns the drop logging of the common rules, nil when disabled
+func (c *Config) nftDropLogging() *nftables.DropLogging {
+	if !c.DropLogging.Enabled {
+		return nil
+	}
+
+	return &nftables.DropLogging{
+		Rate:  c.DropLogging.Rate,
+		Burst: c.DropLogging.Burst,
+	}
+}
+
+// nftSYNRateLimit returns the SYN rate limit of the common rules, nil when disabled
+func (c *Config) nftSYNRateLimit() *nftables.SYNRateLimit {
+	if !c.SYNRateLimit.Enabled {
+		return nil
+	}
+
+	return &nftables.SYNRateLimit{
+		Rate:  c.SYNRateLimit.Rate,
+		Burst: c.SYNRateLimit.Burst,
+	}
+}
+
+// stringSliceValue is a flag.Value for a comma-separated list of strings
+type stringSliceValue []string
+
+func (s *stringSliceValue) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringSliceValue) Set(value string) error {
+	elements, err := utils.ParseCommaSeparatedList(value)
+	if err != nil {
+		return err
+	}
+
+	*s = elements
+	return nil
+}
+
+// PodExclusions returns the exclusions of the pods the policies are never applied to
+func (c *Config) PodExclusions() []nftables.PodExclusion {
+	var exclusions []nftables.PodExclusion
+	for _, exclusion := range c.ExcludedPods {
+		exclusions = append(exclusions, nftables.PodExclusion{
+			NamespaceSelector: exclusion.NamespaceSelector,
+			PodSelector:       exclusion.PodSelector,
+		})
+	}
+
+	return exclusions
+}
+
+// ExecOptions returns the options of the execution of the nft binary
+func (c *Config) ExecOptions() nftables.ExecOptions {
+	return nftables.ExecOptions{
+		Path:    c.NFTPath,
+		Env:     c.NFTEnv,
+		Timeout: c.NFTTimeout.Duration,
+	}
+}
+
+// featureGatesValue is a flag.Value for a comma-separated list of <feature>=true|false pairs,
+// the pairs are merged into the features of the config file
+type featureGatesValue map[string]bool
+
+func (f *featureGatesValue) String() string {
+	var pairs []string
+	for _, name := range slices.Sorted(maps.Keys(*f)) {
+		pairs = append(pairs, fmt.Sprintf("%s=%t", name, (*f)[name]))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (f *featureGatesValue) Set(value string) error {
+	features := maps.Clone(*f)
+	if features == nil {
+		features = make(map[string]bool)
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, enabled, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("missing value for feature gate %q, expected <feature>=true|false", pair)
+		}
+
+		parsed, err := strconv.ParseBool(strings.TrimSpace(enabled))
+		if err != nil {
+			return fmt.Errorf("invalid value for feature gate %q: %w", name, err)
+		}
+
+		features[strings.TrimSpace(name)] = parsed
+	}
+
+	*f = features
+	return nil
+}
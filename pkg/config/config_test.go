@@ -0,0 +1,653 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+func TestConfig(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Config Suite")
+}
+
+// rejectingChecker fails the check of the transactions containing the invalid rule
+type rejectingChecker struct {
+	*knftables.Fake
+	invalid string
+	checked []string
+}
+
+func (r *rejectingChecker) Check(ctx context.Context, tx *knftables.Transaction) error {
+	r.checked = append(r.checked, tx.String())
+	if strings.Contains(tx.String(), r.invalid) {
+		return errors.New("syntax error")
+	}
+
+	return r.Fake.Check(ctx, tx)
+}
+
+var _ = Describe("Config", func() {
+	var (
+		dir        string
+		configFile string
+		fs         *flag.FlagSet
+	)
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		configFile = filepath.Join(dir, "config.yaml")
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		NewDefault().BindFlags(fs)
+	})
+
+	writeFile := func(path string, content string) {
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+	}
+
+	Context("Load", func() {
+		It("should return the defaults without a config file", func() {
+			Expect(fs.Parse([]string{})).To(Succeed())
+
+			cfg, err := Load("", fs)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg).To(Equal(NewDefault()))
+		})
+
+		It("should read the config file", func() {
+			writeFile(configFile, `
+networkPlugins: [macvlan, ipvlan]
+containerRuntimeEndpoint: /run/crio/crio.sock
+acceptICMP: true
+customRuleFiles:
+  ipv4Ingress: /etc/rules/v4.txt
+coverageReportInterval: 5m
+verifyRuleset: false
+dropLogging:
+  enabled: true
+  rate: 1/second
+maxConcurrentReconciles: 4
+warmStartVerify: false
+prefetchSandboxes: false
+interfaceReadyTimeout: 1m
+rulesetLayout: merged
+excludedPods:
+- namespaceSelector:
+    matchLabels:
+      kubernetes.io/metadata.name: kube-system
+- podSelector:
+    matchLabels:
+      app: node-exporter
+`)
+			Expect(fs.Parse([]string{})).To(Succeed())
+
+			cfg, err := Load(configFile, fs)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.NetworkPlugins).To(Equal([]string{"macvlan", "ipvlan"}))
+			Expect(cfg.ContainerRuntimeEndpoint).To(Equal("/run/crio/crio.sock"))
+			Expect(cfg.AcceptICMP).To(BeTrue())
+			Expect(cfg.CustomRuleFiles.IPv4Ingress).To(Equal("/etc/rules/v4.txt"))
+			Expect(cfg.CoverageReportInterval.Duration).To(Equal(5 * time.Minute))
+			Expect(cfg.VerifyRuleset).To(BeFalse())
+			Expect(cfg.VerifyRetries).To(Equal(2))
+			Expect(cfg.DropLogging).To(Equal(DropLogging{Enabled: true, Rate: "1/second", Burst: 5}))
+			Expect(cfg.MaxConcurrentReconciles).To(Equal(4))
+			Expect(cfg.WarmStartVerify).To(BeFalse())
+			Expect(cfg.PrefetchSandboxes).To(BeFalse())
+			Expect(cfg.InterfaceReadyTimeout.Duration).To(Equal(time.Minute))
+			Expect(cfg.RulesetLayout).To(Equal("merged"))
+			Expect(cfg.PodExclusions()).To(Equal([]nftables.PodExclusion{
+				{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "kube-system"}}},
+				{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "node-exporter"}}},
+			}))
+		})
+
+		It("should give precedence to the flags set on the command line", func() {
+			writeFile(configFile, `
+networkPlugins: [macvlan]
+acceptICMP: true
+verifyRetries: 5
+`)
+			Expect(fs.Parse([]string{"--network-plugins=ipvlan,bridge", "--accept-icmp=false"})).To(Succeed())
+
+			cfg, err := Load(configFile, fs)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.NetworkPlugins).To(Equal([]string{"ipvlan", "bridge"}))
+			Expect(cfg.AcceptICMP).To(BeFalse())
+			Expect(cfg.VerifyRetries).To(Equal(5))
+		})
+
+		It("should merge the feature gates of the flags into the config file", func() {
+			writeFile(configFile, `
+featureGates:
+  CustomRuleTemplates: true
+  Other: true
+`)
+			Expect(fs.Parse([]string{"--feature-gates=CustomRuleTemplates=false"})).To(Succeed())
+
+			cfg, err := Load(configFile, fs)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.FeatureGates).To(Equal(map[string]bool{"CustomRuleTemplates": false, "Other": true}))
+		})
+
+		It("should reject malformed feature gates", func() {
+			Expect(fs.Parse([]string{"--feature-gates=CustomRuleTemplates"})).NotTo(Succeed())
+		})
+
+		It("should reject unknown fields", func() {
+			writeFile(configFile, "networkPlugin: macvlan\n")
+			Expect(fs.Parse([]string{})).To(Succeed())
+
+			_, err := Load(configFile, fs)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Validate", func() {
+		It("should require the container runtime endpoint", func() {
+			cfg := NewDefault()
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("should reject unknown feature gates", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.FeatureGates = map[string]bool{"CustomRuleTemplates": false}
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.FeatureGates["UnknownFeature"] = true
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should require a positive API QPS and burst", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.KubeAPIQPS = 0
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.KubeAPIQPS = 50
+			cfg.KubeAPIBurst = 0
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.KubeAPIBurst = 100
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("should validate the default verdict", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.DefaultVerdict = "reject"
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.DefaultVerdict = "accept"
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the ruleset layout", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.RulesetLayout = "merged"
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.RulesetLayout = "flat"
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the excluded pods", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.ExcludedPods = []PodExclusion{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "node-exporter"}}}}
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.ExcludedPods = append(cfg.ExcludedPods, PodExclusion{})
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("excludedPods[1] must set a namespaceSelector or a podSelector")))
+
+			cfg.ExcludedPods[1].NamespaceSelector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tier", Operator: "Near"}}}
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("invalid excludedPods[1]")))
+		})
+
+		It("should validate the nft execution options", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.NFTEnv = []string{"LD_LIBRARY_PATH=/opt/nftables/lib"}
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.NFTEnv = []string{"LD_LIBRARY_PATH"}
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.NFTEnv = nil
+			cfg.NFTTimeout.Duration = -time.Second
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the applier socket", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.ApplierSocket = "/run/multi-networkpolicy-nftables/applier.sock"
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.FlowExport.Collector = "udp://flow-collector.monitoring:4739"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.FlowExport.Collector = ""
+			cfg.ApplierSocket = "applier.sock"
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should reject a negative startup jitter", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.StartupJitter.Duration = 30 * time.Second
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.StartupJitter.Duration = -time.Second
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the policy event rate limit", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.PolicyEventQPS = 0
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.PolicyEventQPS = -1
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.PolicyEventQPS = 5
+			cfg.PolicyEventBurst = 0
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should reject a negative initial list page size", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.InitialListPageSize = 0
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.InitialListPageSize = -1
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should reject a negative maximum of set elements", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.MaxSetElements = 0
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.MaxSetElements = -1
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should reject a negative maximum of in-flight network namespaces", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.MaxInFlightNetNS = 0
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.MaxInFlightNetNS = -1
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should reject a negative garbage collection interval", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.GCInterval.Duration = 0
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.GCInterval.Duration = -time.Minute
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should reject a negative enforcement status interval", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.EnforcementStatusInterval.Duration = -time.Minute
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should require the enforcement status interval for the network statistics", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.NetworkStatistics = true
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.EnforcementStatusInterval.Duration = time.Minute
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("should reject negative ruleset size limits", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.MaxRules = 0
+			cfg.MaxPodSetElements = 0
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.MaxRules = -1
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.MaxRules = 0
+			cfg.MaxPodSetElements = -1
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the flow export", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.FlowExport.Collector = "udp://collector.monitoring:4739"
+			cfg.FlowExport.Format = "ipfix"
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.FlowExport.Collector = "http://collector.monitoring:4739"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.FlowExport.Collector = "tcp://collector.monitoring"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.FlowExport.Collector = "tcp://collector.monitoring:4739"
+			cfg.FlowExport.Format = "netflow"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.FlowExport.Format = "json"
+			cfg.FlowExport.ResyncInterval.Duration = 0
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the memory tuning", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.MemoryLimit = "512Mi"
+			cfg.GCPercent = -1
+			Expect(cfg.Validate()).To(Succeed())
+			Expect(cfg.MemoryLimitBytes()).To(Equal(int64(512 << 20)))
+
+			cfg.MemoryLimit = "lots"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.MemoryLimit = "-1Gi"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.MemoryLimit = ""
+			cfg.MemoryLimitRatio = 1.5
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.MemoryLimitRatio = 0.9
+			cfg.GCPercent = -2
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the drop logging only when enabled", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.DropLogging.Rate = "fast"
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.DropLogging.Enabled = true
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+
+		It("should validate the SYN rate limit only when enabled", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.SYNRateLimit.Burst = -1
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.SYNRateLimit.Enabled = true
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.SYNRateLimit.Burst = 50
+			Expect(cfg.Validate()).To(Succeed())
+			commonRules, err := cfg.CommonRules()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(commonRules.SYNRateLimit).To(Equal(&nftables.SYNRateLimit{Rate: "100/second", Burst: 50}))
+		})
+
+		It("should validate the terminal chain", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.TerminalChain.RuleFile = "/etc/terminal.txt"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.TerminalChain.Name = "ingress"
+			Expect(cfg.Validate()).NotTo(Succeed())
+
+			cfg.TerminalChain.Name = "site-deny"
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("should validate the trusted marks", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.TrustedCTMark = "0x100/0xff00"
+			cfg.TrustedMark = "42"
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.AcceptedMark = "0x10000/0xff0000"
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.TrustedMark = "0x1ff/0xff"
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("invalid trusted-mark")))
+		})
+
+		It("should reject both sources of common rules", func() {
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.CommonRulesCRD = true
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg.CommonRulesConfigMap = "kube-system/common-rules"
+			Expect(cfg.Validate()).NotTo(Succeed())
+		})
+	})
+
+	Context("CommonRules", func() {
+		It("should read the custom rule files", func() {
+			rulesFile := filepath.Join(dir, "rules.txt")
+			writeFile(rulesFile, "tcp dport 22 accept\n")
+
+			cfg := NewDefault()
+			cfg.AcceptICMPv6 = true
+			cfg.AcceptIPsec = true
+			cfg.DropIPv6ExtensionHeaders = true
+			cfg.DropInvalidTCPFlags = true
+			cfg.AcceptSelfTraffic = true
+			cfg.CustomRuleFiles.IPv6Egress = rulesFile
+			cfg.DropLogging.Enabled = true
+			cfg.TrustedCTMark = "0x100/0xff00"
+			cfg.AcceptedMark = "0x2"
+
+			commonRules, err := cfg.CommonRules()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(commonRules).To(Equal(&nftables.CommonRules{
+				AcceptICMPv6:             true,
+				AcceptIPsec:              true,
+				DropIPv6ExtensionHeaders: true,
+				DropInvalidTCPFlags:      true,
+				AcceptSelfTraffic:        true,
+				CustomIPv6EgressRules:    []string{"tcp dport 22 accept"},
+				DropLogging:              &nftables.DropLogging{Rate: "10/minute", Burst: 5},
+				DefaultVerdict:           datastore.VerdictDrop,
+				TrustedCTMark:            &nftables.Mark{Value: 0x100, Mask: 0xff00},
+				AcceptedMark:             &nftables.Mark{Value: 0x2, Mask: 0xffffffff},
+			}))
+		})
+
+		It("should accept the IPv6 link-local and multicast traffic in iptables compatibility mode", func() {
+			rulesFile := filepath.Join(dir, "rules.txt")
+			writeFile(rulesFile, "ip6 saddr ::/0 drop\n")
+
+			cfg := NewDefault()
+			cfg.ContainerRuntimeEndpoint = "/run/crio/crio.sock"
+			cfg.CompatibilityMode = CompatibilityModeIPTables
+			cfg.CustomRuleFiles.IPv6Ingress = rulesFile
+			Expect(cfg.Validate()).To(Succeed())
+
+			commonRules, err := cfg.CommonRules()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(commonRules.CustomIPv6IngressRules).To(Equal([]string{
+				"ip6 saddr fe80::/10 accept",
+				"ip6 daddr { fe80::/10, ff00::/8 } accept",
+				"ip6 saddr ::/0 drop",
+			}))
+			Expect(commonRules.CustomIPv6EgressRules).To(HaveLen(2))
+			Expect(commonRules.CustomIPv4IngressRules).To(BeEmpty())
+
+			cfg.CompatibilityMode = "calico"
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("compatibility-mode")))
+		})
+
+		It("should read the terminal chain rule file", func() {
+			rulesFile := filepath.Join(dir, "terminal.txt")
+			writeFile(rulesFile, "# Count the denied packets\ncounter\n")
+
+			cfg := NewDefault()
+			cfg.TerminalChain = TerminalChain{Name: "site-deny", RuleFile: rulesFile}
+
+			commonRules, err := cfg.CommonRules()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(commonRules.TerminalChain).To(Equal(&nftables.TerminalChain{Name: "site-deny", Rules: []string{"counter"}}))
+		})
+	})
+
+	Context("CheckCustomRuleFiles", func() {
+		It("should report the file and line of the invalid rules", func() {
+			v4File := filepath.Join(dir, "v4.txt")
+			writeFile(v4File, "# Allow SSH\ntcp dport 22 accept\n\ntcp dport 80 acept\n")
+			v6File := filepath.Join(dir, "v6.txt")
+			writeFile(v6File, "ip6 daddr {{ .PodIP }} tcp dport 443 accept\n")
+
+			cfg := NewDefault()
+			cfg.CustomRuleFiles.IPv4Ingress = v4File
+			cfg.CustomRuleFiles.IPv6Egress = v6File
+
+			checker := &rejectingChecker{Fake: knftables.NewFake(knftables.InetFamily, "check"), invalid: "acept"}
+
+			err := cfg.CheckCustomRuleFiles(context.Background(), checker)
+			Expect(err).To(MatchError(fmt.Sprintf("%s:4: syntax error", v4File)))
+
+			// Templated rules are checked with a sample IP of the family of the file
+			Expect(checker.checked).To(HaveLen(3))
+			Expect(checker.checked[2]).To(ContainSubstring("ip6 daddr 2001:db8::1 tcp dport 443 accept"))
+		})
+
+		It("should report the files that cannot be read", func() {
+			cfg := NewDefault()
+			cfg.CustomRuleFiles.IPv4Egress = filepath.Join(dir, "missing.txt")
+
+			err := cfg.CheckCustomRuleFiles(context.Background(), knftables.NewFake(knftables.InetFamily, "check"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("RestartRequiredChanges", func() {
+		It("should only report the settings that are not reloaded", func() {
+			cfg := NewDefault()
+			other := NewDefault()
+			other.AcceptICMP = true
+			other.NetworkPlugins = []string{"ipvlan"}
+			other.HostPrefix = "/host"
+			other.KubeAPIQPS = 50
+
+			Expect(cfg.RestartRequiredChanges(other)).To(Equal([]string{"hostPrefix", "kubeAPIQPS"}))
+		})
+	})
+
+	Context("Watcher", func() {
+		It("should reload the config file when it changes", func() {
+			writeFile(configFile, "containerRuntimeEndpoint: /run/crio/crio.sock\n")
+			Expect(fs.Parse([]string{})).To(Succeed())
+
+			reloaded := make(chan *Config, 1)
+			watcher := &Watcher{
+				Path:     configFile,
+				FlagSet:  fs,
+				Debounce: 10 * time.Millisecond,
+				OnChange: func(_ context.Context, cfg *Config) {
+					reloaded <- cfg
+				},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			done := make(chan error)
+			go func() {
+				done <- watcher.Start(ctx)
+			}()
+
+			// Invalid configurations are not reloaded
+			Eventually(func(g Gomega) {
+				writeFile(configFile, "containerRuntimeEndpoint: \"\"\n")
+				g.Consistently(reloaded, 50*time.Millisecond).ShouldNot(Receive())
+
+				writeFile(configFile, "containerRuntimeEndpoint: /run/crio/crio.sock\nacceptICMP: true\n")
+
+				var cfg *Config
+				g.Eventually(reloaded).Should(Receive(&cfg))
+				g.Expect(cfg.AcceptICMP).To(BeTrue())
+			}).Should(Succeed())
+
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("should reload the custom rule files projected from a ConfigMap without a config file", func() {
+			// Reproduce the layout of a ConfigMap volume, the file is a symlink through the ..data symlink
+			Expect(os.Mkdir(filepath.Join(dir, "..v1"), 0o700)).To(Succeed())
+			writeFile(filepath.Join(dir, "..v1", "rules.txt"), "tcp dport 22 accept\n")
+			Expect(os.Symlink("..v1", filepath.Join(dir, "..data"))).To(Succeed())
+			Expect(os.Symlink(filepath.Join("..data", "rules.txt"), filepath.Join(dir, "rules.txt"))).To(Succeed())
+
+			Expect(fs.Parse([]string{"--container-runtime-endpoint=/run/crio/crio.sock", "--custom-v4-ingress-rule-file=" + filepath.Join(dir, "rules.txt")})).To(Succeed())
+
+			reloaded := make(chan *Config, 1)
+			watcher := &Watcher{
+				FlagSet:  fs,
+				Debounce: 10 * time.Millisecond,
+				OnChange: func(_ context.Context, cfg *Config) {
+					reloaded <- cfg
+				},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go func() {
+				_ = watcher.Start(ctx)
+			}()
+
+			// Swap the ..data symlink like the kubelet does
+			Eventually(func(g Gomega) {
+				version := filepath.Join(dir, fmt.Sprintf("..v%d", time.Now().UnixNano()))
+				g.Expect(os.Mkdir(version, 0o700)).To(Succeed())
+				g.Expect(os.WriteFile(filepath.Join(version, "rules.txt"), []byte("tcp dport 443 accept\n"), 0o600)).To(Succeed())
+				g.Expect(os.Symlink(filepath.Base(version), filepath.Join(dir, "..data_tmp"))).To(Succeed())
+				g.Expect(os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))).To(Succeed())
+
+				var cfg *Config
+				g.Eventually(reloaded, 200*time.Millisecond).Should(Receive(&cfg))
+
+				commonRules, err := cfg.CommonRules()
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(commonRules.CustomIPv4IngressRules).To(Equal([]string{"tcp dport 443 accept"}))
+			}).WithTimeout(10 * time.Second).Should(Succeed())
+		})
+	})
+})
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// kubeletDataDir is the symlink swapped by the kubelet when a mounted ConfigMap or Secret is updated
+const kubeletDataDir = "..data"
+
+// Watcher reloads the configuration when the config file or one of the custom rule files changes
+type Watcher struct {
+	// Path is the config file, it can be empty when the configuration only comes from the flags
+	Path    string
+	FlagSet *flag.FlagSet
+	// Debounce coalesces the events of a single update of the files
+	Debounce time.Duration
+	// OnChange is called with every valid reloaded configuration
+	OnChange func(ctx context.Context, cfg *Config)
+
+	// files are the absolute paths of the watched files
+	files map[string]struct{}
+	// dirs are the watched directories
+	dirs map[string]struct{}
+}
+
+// Start watches the config file and the custom rule files until the context is done
+func (w *Watcher) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("config")
+
+	cfg, err := Load(w.Path, w.FlagSet)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	w.files = make(map[string]struct{})
+	w.dirs = make(map[string]struct{})
+	w.watchFiles(watcher, cfg, logger)
+
+	reload := time.NewTimer(0)
+	<-reload.C
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if !w.isWatchedEvent(event) {
+				continue
+			}
+
+			logger.V(1).Info("Watched file changed", "event", event.String())
+			reload.Reset(w.Debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+
+			logger.Error(err, "Config watcher error")
+		case <-reload.C:
+			cfg, err := Load(w.Path, w.FlagSet)
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err != nil {
+				logger.Error(err, "Failed to reload configuration, keeping the current configuration")
+				continue
+			}
+
+			// The reloaded config file can point to other custom rule files
+			w.watchFiles(watcher, cfg, logger)
+
+			logger.Info("Configuration reloaded")
+			w.OnChange(ctx, cfg)
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every node watches its own files
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+// watchFiles watches the config file and the custom rule files of the configuration
+func (w *Watcher) watchFiles(watcher *fsnotify.Watcher, cfg *Config, logger logr.Logger) {
+	paths := []string{
+		w.Path,
+		cfg.CustomRuleFiles.IPv4Ingress,
+		cfg.CustomRuleFiles.IPv4Egress,
+		cfg.CustomRuleFiles.IPv6Ingress,
+		cfg.CustomRuleFiles.IPv6Egress,
+		cfg.TerminalChain.RuleFile,
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+
+		path, err := filepath.Abs(path)
+		if err != nil {
+			logger.Error(err, "Failed to resolve watched file", "path", path)
+			continue
+		}
+		w.files[path] = struct{}{}
+
+		// Watch the directory rather than the file, editors and the kubelet replace the file instead of writing it
+		dir := filepath.Dir(path)
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+
+		if err := watcher.Add(dir); err != nil {
+			logger.Error(err, "Failed to watch directory", "dir", dir)
+			continue
+		}
+		w.dirs[dir] = struct{}{}
+
+		logger.V(1).Info("Watching directory", "dir", dir)
+	}
+}
+
+// isWatchedEvent checks if the event changes the content of a watched file
+func (w *Watcher) isWatchedEvent(event fsnotify.Event) bool {
+	if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) && !event.Has(fsnotify.Remove) {
+		return false
+	}
+
+	if _, ok := w.files[event.Name]; ok {
+		return true
+	}
+
+	// A swap of the kubelet data directory changes every file projected in the directory
+	if filepath.Base(event.Name) == kubeletDataDir {
+		_, ok := w.dirs[filepath.Dir(event.Name)]
+		return ok
+	}
+
+	return false
+}
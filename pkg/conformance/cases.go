@@ -0,0 +1,233 @@
+package conformance
+
+import (
+	"fmt"
+	"net/netip"
+
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// NamespaceLabel is the label of the namespaces of the probe pods, with their group
+	NamespaceLabel = "conformance.multi-networkpolicy-nftables.k8s.cni.cncf.io/namespace"
+	// PodLabel is the label of the probe pods, with their name
+	PodLabel = "conformance.multi-networkpolicy-nftables.k8s.cni.cncf.io/pod"
+)
+
+var (
+	// Groups are the groups of the namespaces of the probe pods
+	Groups = []string{"x", "y"}
+	// PodNames are the names of the probe pods of each namespace
+	PodNames = []string{"a", "b"}
+	// Ports are the ports probed on the probe pods
+	Ports = []int{80, 81}
+)
+
+// Pod is a probe pod and its addresses on the network
+type Pod struct {
+	// Group is the group of the namespace of the pod
+	Group string
+	Name  string
+	IPs   []string
+}
+
+// String returns the pod as <group>/<name>
+func (p Pod) String() string {
+	return fmt.Sprintf("%s/%s", p.Group, p.Name)
+}
+
+// is checks if the pod is the pod of a group with a name
+func (p Pod) is(group string, name string) bool {
+	return p.Group == group && p.Name == name
+}
+
+// Policy is a policy of a case, created in the namespace of its group for the network of the probe pods
+type Policy struct {
+	Group string
+	Name  string
+	Spec  multiv1beta1.MultiNetworkPolicySpec
+}
+
+// Case is a policy matrix case, the policies applied to the probe pods and the traffic they allow
+type Case struct {
+	Name string
+	// Policies returns the policies of the case, from the probe pods
+	Policies func(pods []Pod) []Policy
+	// Allowed returns whether the traffic from a probe pod to a port of another is allowed by the policies
+	Allowed func(from Pod, to Pod, port int) bool
+}
+
+var (
+	ingress = []multiv1beta1.MultiPolicyType{multiv1beta1.PolicyTypeIngress}
+	egress  = []multiv1beta1.MultiPolicyType{multiv1beta1.PolicyTypeEgress}
+)
+
+// selectPod returns a selector of a probe pod
+func selectPod(name string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchLabels: map[string]string{PodLabel: name}}
+}
+
+// selectGroup returns a selector of the namespace of a group
+func selectGroup(group string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchLabels: map[string]string{NamespaceLabel: group}}
+}
+
+// tcpPort returns a TCP port of a rule
+func tcpPort(port int) multiv1beta1.MultiNetworkPolicyPort {
+	protocol := corev1.ProtocolTCP
+	value := intstr.FromInt(port)
+	return multiv1beta1.MultiNetworkPolicyPort{Protocol: &protocol, Port: &value}
+}
+
+// ipBlocks returns the IP blocks of the addresses of a probe pod
+func ipBlocks(pod Pod) []multiv1beta1.MultiNetworkPolicyPeer {
+	var peers []multiv1beta1.MultiNetworkPolicyPeer
+	for _, ip := range pod.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			continue
+		}
+
+		addr = addr.Unmap()
+		peers = append(peers, multiv1beta1.MultiNetworkPolicyPeer{
+			IPBlock: &multiv1beta1.IPBlock{CIDR: netip.PrefixFrom(addr, addr.BitLen()).String()},
+		})
+	}
+
+	return peers
+}
+
+// findPod returns a probe pod of a group with a name
+func findPod(pods []Pod, group string, name string) Pod {
+	for _, pod := range pods {
+		if pod.is(group, name) {
+			return pod
+		}
+	}
+
+	return Pod{Group: group, Name: name}
+}
+
+// static returns the policies of a case that do not depend on the probe pods
+func static(policies ...Policy) func(pods []Pod) []Policy {
+	return func([]Pod) []Policy {
+		return policies
+	}
+}
+
+// Cases returns the cases of the policy matrix, with the semantics of the NetworkPolicies
+func Cases() []Case {
+	return []Case{
+		{
+			Name:     "no policies",
+			Policies: static(),
+			Allowed:  func(Pod, Pod, int) bool { return true },
+		},
+		{
+			Name: "deny all ingress in x",
+			Policies: static(Policy{Group: "x", Name: "deny-ingress", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PolicyTypes: ingress,
+			}}),
+			Allowed: func(_ Pod, to Pod, _ int) bool { return to.Group != "x" },
+		},
+		{
+			Name: "deny all egress in x",
+			Policies: static(Policy{Group: "x", Name: "deny-egress", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PolicyTypes: egress,
+			}}),
+			Allowed: func(from Pod, _ Pod, _ int) bool { return from.Group != "x" },
+		},
+		{
+			Name: "allow ingress from the same namespace",
+			Policies: static(Policy{Group: "x", Name: "same-namespace", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PolicyTypes: ingress,
+				Ingress:     []multiv1beta1.MultiNetworkPolicyIngressRule{{From: []multiv1beta1.MultiNetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{}}}}},
+			}}),
+			Allowed: func(from Pod, to Pod, _ int) bool { return to.Group != "x" || from.Group == "x" },
+		},
+		{
+			Name: "allow ingress from the namespace y",
+			Policies: static(Policy{Group: "x", Name: "from-y", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PolicyTypes: ingress,
+				Ingress:     []multiv1beta1.MultiNetworkPolicyIngressRule{{From: []multiv1beta1.MultiNetworkPolicyPeer{{NamespaceSelector: selectGroup("y")}}}},
+			}}),
+			Allowed: func(from Pod, to Pod, _ int) bool { return to.Group != "x" || from.Group == "y" },
+		},
+		{
+			Name: "allow ingress to x/a from the pods b of all the namespaces",
+			Policies: static(Policy{Group: "x", Name: "a-from-b", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PodSelector: *selectPod("a"),
+				PolicyTypes: ingress,
+				Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{{From: []multiv1beta1.MultiNetworkPolicyPeer{
+					{NamespaceSelector: &metav1.LabelSelector{}, PodSelector: selectPod("b")},
+				}}},
+			}}),
+			Allowed: func(from Pod, to Pod, _ int) bool { return !to.is("x", "a") || from.Name == "b" },
+		},
+		{
+			Name: "allow ingress from the match expressions",
+			Policies: static(Policy{Group: "x", Name: "match-expressions", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PolicyTypes: ingress,
+				Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{{From: []multiv1beta1.MultiNetworkPolicyPeer{{
+					NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: NamespaceLabel, Operator: metav1.LabelSelectorOpIn, Values: []string{"x", "y"}},
+					}},
+					PodSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: PodLabel, Operator: metav1.LabelSelectorOpNotIn, Values: []string{"a"}},
+					}},
+				}}}},
+			}}),
+			Allowed: func(from Pod, to Pod, _ int) bool { return to.Group != "x" || from.Name != "a" },
+		},
+		{
+			Name: "allow ingress on port 80",
+			Policies: static(Policy{Group: "x", Name: "port-80", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PolicyTypes: ingress,
+				Ingress:     []multiv1beta1.MultiNetworkPolicyIngressRule{{Ports: []multiv1beta1.MultiNetworkPolicyPort{tcpPort(80)}}},
+			}}),
+			Allowed: func(_ Pod, to Pod, port int) bool { return to.Group != "x" || port == 80 },
+		},
+		{
+			Name: "allow egress to the namespace y on port 81",
+			Policies: static(Policy{Group: "x", Name: "to-y-81", Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PolicyTypes: egress,
+				Egress: []multiv1beta1.MultiNetworkPolicyEgressRule{{
+					Ports: []multiv1beta1.MultiNetworkPolicyPort{tcpPort(81)},
+					To:    []multiv1beta1.MultiNetworkPolicyPeer{{NamespaceSelector: selectGroup("y")}},
+				}},
+			}}),
+			Allowed: func(from Pod, to Pod, port int) bool { return from.Group != "x" || (to.Group == "y" && port == 81) },
+		},
+		{
+			Name: "allow egress to the IP block of y/a",
+			Policies: func(pods []Pod) []Policy {
+				return []Policy{{Group: "x", Name: "to-ip-block", Spec: multiv1beta1.MultiNetworkPolicySpec{
+					PolicyTypes: egress,
+					Egress:      []multiv1beta1.MultiNetworkPolicyEgressRule{{To: ipBlocks(findPod(pods, "y", "a"))}},
+				}}}
+			},
+			Allowed: func(from Pod, to Pod, _ int) bool { return from.Group != "x" || to.is("y", "a") },
+		},
+		{
+			Name: "allow the union of the stacked policies",
+			Policies: static(
+				Policy{Group: "x", Name: "from-x-a", Spec: multiv1beta1.MultiNetworkPolicySpec{
+					PolicyTypes: ingress,
+					Ingress:     []multiv1beta1.MultiNetworkPolicyIngressRule{{From: []multiv1beta1.MultiNetworkPolicyPeer{{PodSelector: selectPod("a")}}}},
+				}},
+				Policy{Group: "x", Name: "from-y-b", Spec: multiv1beta1.MultiNetworkPolicySpec{
+					PolicyTypes: ingress,
+					Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{{From: []multiv1beta1.MultiNetworkPolicyPeer{
+						{NamespaceSelector: selectGroup("y"), PodSelector: selectPod("b")},
+					}}},
+				}},
+			),
+			Allowed: func(from Pod, to Pod, _ int) bool {
+				return to.Group != "x" || from.is("x", "a") || from.is("y", "b")
+			},
+		},
+	}
+}
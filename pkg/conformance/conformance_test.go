@@ -0,0 +1,199 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/go-logr/logr"
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+func TestConformance(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Conformance Suite")
+}
+
+var _ = Describe("ProbeServer", func() {
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		server = httptest.NewServer((&ProbeServer{Logger: logr.Discard()}).Handler())
+		DeferCleanup(server.Close)
+	})
+
+	// probe requests the probe server to connect to a peer
+	probe := func(query url.Values) (int, ProbeResult) {
+		resp, err := http.Get(server.URL + "/probe?" + query.Encode())
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+
+		result := ProbeResult{}
+		if resp.StatusCode == http.StatusOK {
+			Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+		}
+		return resp.StatusCode, result
+	}
+
+	It("should connect to a listening peer", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		go accept(listener)
+
+		status, result := probe(url.Values{"address": {"127.0.0.1"}, "port": {strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)}})
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(result).To(Equal(ProbeResult{Connected: true}))
+	})
+
+	It("should summary the failed connections", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		port := listener.Addr().(*net.TCPAddr).Port
+		Expect(listener.Close()).To(Succeed())
+
+		status, result := probe(url.Values{"address": {"127.0.0.1"}, "port": {strconv.Itoa(port)}, "timeout": {"100ms"}})
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(result.Connected).To(BeFalse())
+		Expect(result.Error).NotTo(BeEmpty())
+	})
+
+	It("should reject the invalid requests", func() {
+		status, _ := probe(url.Values{"address": {"not-an-ip"}, "port": {"80"}})
+		Expect(status).To(Equal(http.StatusBadRequest))
+
+		status, _ = probe(url.Values{"address": {"127.0.0.1"}, "port": {"70000"}})
+		Expect(status).To(Equal(http.StatusBadRequest))
+	})
+})
+
+var _ = Describe("Cases", func() {
+	pods := []Pod{
+		{Group: "x", Name: "a", IPs: []string{"10.0.0.1", "2001:db8::1"}},
+		{Group: "x", Name: "b", IPs: []string{"10.0.0.2"}},
+		{Group: "y", Name: "a", IPs: []string{"10.0.0.3", "::ffff:10.0.0.4"}},
+		{Group: "y", Name: "b", IPs: []string{"10.0.0.5"}},
+	}
+
+	It("should have unique names and policies", func() {
+		names := map[string]bool{}
+		for _, c := range Cases() {
+			Expect(names).NotTo(HaveKey(c.Name))
+			names[c.Name] = true
+
+			policyNames := map[string]bool{}
+			for _, policy := range c.Policies(pods) {
+				Expect(Groups).To(ContainElement(policy.Group))
+				Expect(policyNames).NotTo(HaveKey(policy.Name))
+				policyNames[policy.Name] = true
+			}
+		}
+	})
+
+	It("should allow the IP block of the addresses of the pod", func() {
+		var c Case
+		for _, candidate := range Cases() {
+			if candidate.Name == "allow egress to the IP block of y/a" {
+				c = candidate
+			}
+		}
+
+		policies := c.Policies(pods)
+		Expect(policies).To(HaveLen(1))
+		Expect(policies[0].Spec.Egress[0].To).To(Equal([]multiv1beta1.MultiNetworkPolicyPeer{
+			{IPBlock: &multiv1beta1.IPBlock{CIDR: "10.0.0.3/32"}},
+			{IPBlock: &multiv1beta1.IPBlock{CIDR: "10.0.0.4/32"}},
+		}))
+
+		Expect(c.Allowed(pods[0], pods[2], 80)).To(BeTrue())
+		Expect(c.Allowed(pods[0], pods[3], 80)).To(BeFalse())
+		Expect(c.Allowed(pods[3], pods[0], 80)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Runner", func() {
+	var (
+		ctx    context.Context
+		clt    client.Client
+		runner *Runner
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(multiv1beta1.AddToScheme(scheme)).To(Succeed())
+		clt = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		runner = &Runner{
+			Client:          clt,
+			Network:         "default/access",
+			Image:           "multi-networkpolicy-nftables:test",
+			NamespacePrefix: "conformance",
+			Logger:          logr.Discard(),
+		}
+	})
+
+	It("should attach the probe pods to the network", func() {
+		pod := runner.probePod("y", "b")
+		Expect(pod.Namespace).To(Equal("conformance-y"))
+		Expect(pod.Labels).To(HaveKeyWithValue(PodLabel, "b"))
+		Expect(pod.Annotations).To(HaveKeyWithValue("k8s.v1.cni.cncf.io/networks", "default/access"))
+		Expect(pod.Spec.Containers[0].Args).To(Equal([]string{"conformance", "probe", "--ports", "80,81"}))
+	})
+
+	It("should create the policies of a case for the network and delete them", func() {
+		policies := []Policy{{Group: "x", Name: "deny-ingress", Spec: multiv1beta1.MultiNetworkPolicySpec{PolicyTypes: ingress}}}
+		Expect(runner.createPolicies(ctx, policies)).To(Succeed())
+
+		instance := &multiv1beta1.MultiNetworkPolicy{}
+		Expect(clt.Get(ctx, types.NamespacedName{Namespace: "conformance-x", Name: "deny-ingress"}, instance)).To(Succeed())
+		Expect(instance.Annotations).To(HaveKeyWithValue(datastore.PolicyForAnnotation, "default/access"))
+		Expect(instance.Spec.PolicyTypes).To(Equal(ingress))
+
+		Expect(runner.deletePolicies(ctx, policies)).To(Succeed())
+		Expect(runner.deletePolicies(ctx, policies)).To(Succeed())
+		Expect(clt.Get(ctx, types.NamespacedName{Namespace: "conformance-x", Name: "deny-ingress"}, instance)).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Summary", func() {
+	It("should summary the mismatches of the failed cases", func() {
+		summary := &Summary{Results: []CaseResult{
+			{Name: "no policies", Probes: 24},
+			{Name: "deny all ingress in x", Probes: 24, Mismatches: []Mismatch{
+				{From: "y/a", To: "x/b", Address: "10.0.0.2:80", Expected: false},
+				{From: "x/a", To: "y/b", Address: "10.0.0.5:81", Expected: true, Error: "i/o timeout"},
+			}},
+		}}
+
+		Expect(summary.Passed()).To(BeFalse())
+
+		out := &bytes.Buffer{}
+		summary.Write(out)
+		Expect(out.String()).To(Equal(`PASS  no policies (24 probes)
+FAIL  deny all ingress in x (24 probes, 2 mismatches)
+      y/a -> x/b 10.0.0.2:80: expected denied, got allowed
+      x/a -> y/b 10.0.0.5:81: expected allowed, got denied (i/o timeout)
+`))
+
+		summary.Results = summary.Results[:1]
+		Expect(summary.Passed()).To(BeTrue())
+	})
+})
@@ -0,0 +1,135 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// ProbeServerPort is the port of the probe server of the probe pods, reached through the API server proxy on their
+	// cluster network, which the policies of the secondary networks do not apply to
+	ProbeServerPort = 8080
+	// probeTimeout is the timeout of a connection of a probe when the request does not set it
+	probeTimeout = time.Second
+)
+
+// ProbeResult is the result of a connection of a probe pod to a peer
+type ProbeResult struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ProbeServer accepts the TCP connections on the probed ports of a probe pod, and connects to its peers on request
+type ProbeServer struct {
+	// Ports are the ports accepting the connections of the peers
+	Ports []int
+	// Addr is the address of the probe server, ":8080" when empty
+	Addr string
+
+	Logger logr.Logger
+}
+
+// Run listens on the probed ports and serves the probe requests until the context is done
+func (s *ProbeServer) Run(ctx context.Context) error {
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}()
+
+	for _, port := range s.Ports {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return fmt.Errorf("failed to listen on port %d: %w", port, err)
+		}
+		listeners = append(listeners, listener)
+
+		go accept(listener)
+	}
+
+	addr := s.Addr
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", ProbeServerPort)
+	}
+
+	server := &http.Server{Addr: addr, Handler: s.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	s.Logger.Info("Serving probes", "addr", addr, "ports", s.Ports)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve probes: %w", err)
+	}
+
+	return nil
+}
+
+// accept accepts and closes the connections of a probed port, a probe only checks that the connection is established
+func accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.Close()
+	}
+}
+
+// Handler returns the handler of the probe requests, /probe?address=<address>&port=<port>[&timeout=<duration>]
+// connects to a peer and returns a ProbeResult, /healthz reports that the probed ports are listening
+func (s *ProbeServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/probe", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		address := net.ParseIP(query.Get("address"))
+		if address == nil {
+			http.Error(w, fmt.Sprintf("invalid address %q", query.Get("address")), http.StatusBadRequest)
+			return
+		}
+
+		port, err := strconv.Atoi(query.Get("port"))
+		if err != nil || port < 1 || port > 65535 {
+			http.Error(w, fmt.Sprintf("invalid port %q", query.Get("port")), http.StatusBadRequest)
+			return
+		}
+
+		timeout := probeTimeout
+		if value := query.Get("timeout"); value != "" {
+			timeout, err = time.ParseDuration(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid timeout %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		result := ProbeResult{Connected: true}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(address.String(), strconv.Itoa(port)), timeout)
+		if err != nil {
+			result = ProbeResult{Error: err.Error()}
+		} else {
+			_ = conn.Close()
+		}
+
+		s.Logger.V(1).Info("Probed peer", "address", address, "port", port, "result", result)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(result)
+	})
+
+	return mux
+}
@@ -0,0 +1,398 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// networksAnnotation is the annotation key of the networks of a pod
+const networksAnnotation = "k8s.v1.cni.cncf.io/networks"
+
+// Runner spins up the probe pods on a network, applies the policies of the cases and validates the connectivity
+// between the probe pods against the traffic the policies allow
+type Runner struct {
+	Client client.Client
+	// Clientset reaches the probe servers of the probe pods through the API server proxy
+	Clientset kubernetes.Interface
+	// Network is the network attachment definition of the probe pods, as <namespace>/<name>
+	Network string
+	// Image is the image of the probe pods, running the probe server of the conformance subcommand
+	Image string
+	// NamespacePrefix is the prefix of the namespaces of the probe pods, followed by their group
+	NamespacePrefix string
+	// Settle is the time given to the policies to be enforced before they are probed
+	Settle time.Duration
+	// Timeout is the timeout of the readiness of the probe pods
+	Timeout time.Duration
+	// Keep keeps the namespaces of the probe pods after the run
+	Keep bool
+
+	Logger logr.Logger
+}
+
+// Summary is the result of the cases of a run
+type Summary struct {
+	Results []CaseResult
+}
+
+// CaseResult is the result of a case, the probes whose connectivity does not match the traffic allowed by its policies
+type CaseResult struct {
+	Name       string
+	Probes     int
+	Mismatches []Mismatch
+}
+
+// Mismatch is a probe whose connectivity does not match the traffic allowed by the policies
+type Mismatch struct {
+	From string
+	To   string
+	// Address is the address and the port of the probed pod
+	Address  string
+	Expected bool
+	Error    string
+}
+
+// Passed checks if the connectivity of all the cases matches the traffic allowed by their policies
+func (s *Summary) Passed() bool {
+	for _, result := range s.Results {
+		if len(result.Mismatches) != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Write writes the result of each case and its mismatches
+func (s *Summary) Write(w io.Writer) {
+	for _, result := range s.Results {
+		if len(result.Mismatches) == 0 {
+			fmt.Fprintf(w, "PASS  %s (%d probes)\n", result.Name, result.Probes)
+			continue
+		}
+
+		fmt.Fprintf(w, "FAIL  %s (%d probes, %d mismatches)\n", result.Name, result.Probes, len(result.Mismatches))
+		for _, mismatch := range result.Mismatches {
+			expected, actual := "allowed", "denied"
+			if !mismatch.Expected {
+				expected, actual = "denied", "allowed"
+			}
+
+			line := fmt.Sprintf("      %s -> %s %s: expected %s, got %s", mismatch.From, mismatch.To, mismatch.Address, expected, actual)
+			if mismatch.Error != "" {
+				line += fmt.Sprintf(" (%s)", mismatch.Error)
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// Run runs the cases against the probe pods, the probe pods are created first and deleted with their namespaces at
+// the end unless they are kept
+func (r *Runner) Run(ctx context.Context, cases []Case) (*Summary, error) {
+	defer func() {
+		if r.Keep {
+			return
+		}
+
+		// The namespaces are deleted even when the run is canceled
+		if err := r.deleteNamespaces(context.WithoutCancel(ctx)); err != nil {
+			r.Logger.Error(err, "Failed to delete the namespaces of the probe pods")
+		}
+	}()
+
+	pods, err := r.createPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{}
+	var previous []Policy
+	for _, c := range cases {
+		r.Logger.Info("Running case", "case", c.Name)
+
+		if err := r.deletePolicies(ctx, previous); err != nil {
+			return nil, err
+		}
+
+		previous = c.Policies(pods)
+		if err := r.createPolicies(ctx, previous); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(r.Settle):
+		}
+
+		result, err := r.probe(ctx, c, pods)
+		if err != nil {
+			return nil, fmt.Errorf("failed to probe case %q: %w", c.Name, err)
+		}
+		summary.Results = append(summary.Results, *result)
+	}
+
+	return summary, nil
+}
+
+// namespace returns the namespace of a group
+func (r *Runner) namespace(group string) string {
+	return fmt.Sprintf("%s-%s", r.NamespacePrefix, group)
+}
+
+// createPods creates the namespaces and the probe pods, and waits for the probe pods to be ready with their addresses
+// on the network
+func (r *Runner) createPods(ctx context.Context) ([]Pod, error) {
+	for _, group := range Groups {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   r.namespace(group),
+			Labels: map[string]string{NamespaceLabel: group},
+		}}
+
+		if err := r.Client.Create(ctx, namespace); err != nil {
+			if errors.IsAlreadyExists(err) {
+				return nil, fmt.Errorf("namespace %s already exists, delete it or use another namespace prefix", namespace.Name)
+			}
+			return nil, fmt.Errorf("failed to create namespace %s: %w", namespace.Name, err)
+		}
+
+		for _, name := range PodNames {
+			if err := r.Client.Create(ctx, r.probePod(group, name)); err != nil {
+				return nil, fmt.Errorf("failed to create probe pod %s/%s: %w", namespace.Name, name, err)
+			}
+		}
+	}
+
+	var pods []Pod
+	for _, group := range Groups {
+		for _, name := range PodNames {
+			pod, err := r.waitPod(ctx, group, name)
+			if err != nil {
+				return nil, err
+			}
+			pods = append(pods, pod)
+		}
+	}
+
+	return pods, nil
+}
+
+// probePod returns a probe pod of a group, attached to the network
+func (r *Runner) probePod(group string, name string) *corev1.Pod {
+	ports := make([]string, 0, len(Ports))
+	for _, port := range Ports {
+		ports = append(ports, strconv.Itoa(port))
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   r.namespace(group),
+			Labels:      map[string]string{PodLabel: name},
+			Annotations: map[string]string{networksAnnotation: r.Network},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "probe",
+				Image: r.Image,
+				Args:  []string{"conformance", "probe", "--ports", strings.Join(ports, ",")},
+				Ports: []corev1.ContainerPort{{Name: "probe", ContainerPort: ProbeServerPort}},
+				ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+					Path: "/healthz",
+					Port: intstr.FromInt(ProbeServerPort),
+				}}},
+			}},
+			TerminationGracePeriodSeconds: new(int64),
+		},
+	}
+}
+
+// waitPod waits for a probe pod to be ready with its addresses on the network
+func (r *Runner) waitPod(ctx context.Context, group string, name string) (Pod, error) {
+	probePod := Pod{Group: group, Name: name}
+	key := types.NamespacedName{Namespace: r.namespace(group), Name: name}
+
+	err := wait.PollUntilContextTimeout(ctx, time.Second, r.Timeout, true, func(ctx context.Context) (bool, error) {
+		pod := &corev1.Pod{}
+		if err := r.Client.Get(ctx, key, pod); err != nil {
+			return false, err
+		}
+
+		if !isReady(pod) {
+			return false, nil
+		}
+
+		probePod.IPs = nil
+		for _, intf := range nftables.GetInterfaces(pod) {
+			if intf.Network == r.Network {
+				probePod.IPs = append(probePod.IPs, intf.IPs...)
+			}
+		}
+
+		return len(probePod.IPs) != 0, nil
+	})
+	if err != nil {
+		return Pod{}, fmt.Errorf("probe pod %s is not ready with addresses on network %s: %w", key, r.Network, err)
+	}
+
+	r.Logger.Info("Probe pod ready", "pod", probePod.String(), "ips", probePod.IPs)
+	return probePod, nil
+}
+
+// isReady checks if a pod is ready
+func isReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// createPolicies creates the policies of a case for the network
+func (r *Runner) createPolicies(ctx context.Context, policies []Policy) error {
+	for _, policy := range policies {
+		instance := &multiv1beta1.MultiNetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        policy.Name,
+				Namespace:   r.namespace(policy.Group),
+				Annotations: map[string]string{datastore.PolicyForAnnotation: r.Network},
+			},
+			Spec: policy.Spec,
+		}
+
+		if err := r.Client.Create(ctx, instance); err != nil {
+			return fmt.Errorf("failed to create policy %s/%s: %w", instance.Namespace, instance.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// deletePolicies deletes the policies of a case
+func (r *Runner) deletePolicies(ctx context.Context, policies []Policy) error {
+	for _, policy := range policies {
+		instance := &multiv1beta1.MultiNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: policy.Name, Namespace: r.namespace(policy.Group)}}
+		if err := r.Client.Delete(ctx, instance); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete policy %s/%s: %w", instance.Namespace, instance.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// deleteNamespaces deletes the namespaces of the probe pods, with their pods and policies
+func (r *Runner) deleteNamespaces(ctx context.Context) error {
+	for _, group := range Groups {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: r.namespace(group)}}
+		if err := r.Client.Delete(ctx, namespace); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete namespace %s: %w", namespace.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// probe probes the ports of every address of every probe pod from the other probe pods, concurrently, and compares
+// their connectivity with the traffic allowed by the policies of the case
+func (r *Runner) probe(ctx context.Context, c Case, pods []Pod) (*CaseResult, error) {
+	result := &CaseResult{Name: c.Name}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		probeErr error
+	)
+	for _, from := range pods {
+		for _, to := range pods {
+			if from.is(to.Group, to.Name) {
+				continue
+			}
+
+			for _, ip := range to.IPs {
+				for _, port := range Ports {
+					result.Probes++
+
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+
+						probeResult, err := r.probeOne(ctx, from, ip, port)
+
+						mu.Lock()
+						defer mu.Unlock()
+
+						if err != nil {
+							probeErr = err
+							return
+						}
+
+						expected := c.Allowed(from, to, port)
+						if probeResult.Connected != expected {
+							result.Mismatches = append(result.Mismatches, Mismatch{
+								From:     from.String(),
+								To:       to.String(),
+								Address:  net.JoinHostPort(ip, strconv.Itoa(port)),
+								Expected: expected,
+								Error:    probeResult.Error,
+							})
+						}
+					}()
+				}
+			}
+		}
+	}
+	wg.Wait()
+
+	if probeErr != nil {
+		return nil, probeErr
+	}
+
+	slices.SortFunc(result.Mismatches, func(a, b Mismatch) int {
+		return strings.Compare(a.From+" "+a.To+" "+a.Address, b.From+" "+b.To+" "+b.Address)
+	})
+
+	return result, nil
+}
+
+// probeOne requests a probe pod to connect to a port of an address through the API server proxy
+func (r *Runner) probeOne(ctx context.Context, from Pod, ip string, port int) (*ProbeResult, error) {
+	body, err := r.Clientset.CoreV1().Pods(r.namespace(from.Group)).ProxyGet(
+		"http", from.Name, strconv.Itoa(ProbeServerPort), "/probe",
+		map[string]string{"address": ip, "port": strconv.Itoa(port)},
+	).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe %s from %s: %w", net.JoinHostPort(ip, strconv.Itoa(port)), from, err)
+	}
+
+	result := &ProbeResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("invalid probe result of %s: %w", from, err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/apis/v1alpha1"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// ClusterCommonRulesReconciler reconciles the CommonRules objects holding the common rules applied to all policies
+type ClusterCommonRulesReconciler struct {
+	client.Client
+	NFT CommonRulesSetter
+	// Resync enqueues all the policies to apply the new common rules
+	Resync func(ctx context.Context) error
+
+	mu      sync.Mutex
+	current *nftables.CommonRules
+}
+
+// Reconcile merges the rules of all the CommonRules objects and resyncs the policies when the rules change.
+// Every object contributes to the same rules, so the request is not used.
+func (c *ClusterCommonRulesReconciler) Reconcile(ctx context.Context, _ ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	list := &v1alpha1.CommonRulesList{}
+	if err := c.Client.List(ctx, list); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	commonRules, err := mergeCommonRulesObjects(list.Items)
+	if err != nil {
+		// Keep the current rules, a new event will come with the fixed object
+		logger.Error(err, "Invalid CommonRules, keeping the current rules")
+		return ctrl.Result{}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if reflect.DeepEqual(commonRules, c.current) {
+		logger.V(1).Info("Common rules unchanged")
+		return ctrl.Result{}, nil
+	}
+
+	c.NFT.SetClusterCommonRules(commonRules)
+	c.current = commonRules
+
+	logger.Info("Common rules changed, resyncing policies", "rules", commonRules)
+	if err := c.Resync(ctx); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to resync policies: %w", err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// mergeCommonRulesObjects merges the rules of the CommonRules objects in the order of their names, nil without objects
+func mergeCommonRulesObjects(objects []v1alpha1.CommonRules) (*nftables.CommonRules, error) {
+	objects = slices.Clone(objects)
+	slices.SortFunc(objects, func(a, b v1alpha1.CommonRules) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	var merged *nftables.CommonRules
+	for _, object := range objects {
+		commonRules := &nftables.CommonRules{
+			AcceptICMP:               object.Spec.AcceptICMP,
+			AcceptICMPv6:             object.Spec.AcceptICMPv6,
+			AcceptIPsec:              object.Spec.AcceptIPsec,
+			DropIPv6ExtensionHeaders: object.Spec.DropIPv6ExtensionHeaders,
+			DropInvalidTCPFlags:      object.Spec.DropInvalidTCPFlags,
+			AcceptSelfTraffic:        object.Spec.AcceptSelfTraffic,
+			CustomIPv4IngressRules:   trimRules(object.Spec.IPv4Ingress),
+			CustomIPv4EgressRules:    trimRules(object.Spec.IPv4Egress),
+			CustomIPv6IngressRules:   trimRules(object.Spec.IPv6Ingress),
+			CustomIPv6EgressRules:    trimRules(object.Spec.IPv6Egress),
+		}
+
+		if err := commonRules.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid CommonRules %s: %w", object.Name, err)
+		}
+
+		merged = merged.Merge(commonRules)
+	}
+
+	return merged, nil
+}
+
+// trimRules returns the rules without the surrounding spaces and the empty rules
+func trimRules(rules []string) []string {
+	var trimmed []string
+	for _, rule := range rules {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			trimmed = append(trimmed, rule)
+		}
+	}
+
+	return trimmed
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (c *ClusterCommonRulesReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("clustercommonrules").
+		For(&v1alpha1.CommonRules{}).
+		Complete(c)
+}
@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/apis/v1alpha1"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+var _ = Describe("ClusterCommonRulesReconciler", func() {
+	var (
+		ctx        context.Context
+		k8sClient  client.Client
+		setter     *fakeCommonRulesSetter
+		resyncs    int
+		reconciler *ClusterCommonRulesReconciler
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+		k8sClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		setter = &fakeCommonRulesSetter{}
+		resyncs = 0
+
+		reconciler = &ClusterCommonRulesReconciler{
+			Client: k8sClient,
+			NFT:    setter,
+			Resync: func(_ context.Context) error {
+				resyncs++
+				return nil
+			},
+		}
+	})
+
+	It("should merge the rules of all the objects in the order of their names", func() {
+		Expect(k8sClient.Create(ctx, &v1alpha1.CommonRules{
+			ObjectMeta: metav1.ObjectMeta{Name: "20-dns"},
+			Spec: v1alpha1.CommonRulesSpec{
+				IPv4Egress: []string{"udp dport 53 accept"},
+			},
+		})).To(Succeed())
+		baseline := &v1alpha1.CommonRules{
+			ObjectMeta: metav1.ObjectMeta{Name: "10-baseline"},
+			Spec: v1alpha1.CommonRulesSpec{
+				AcceptICMP: true,
+				IPv4Egress: []string{" tcp dport 443 accept ", ""},
+			},
+		}
+		Expect(k8sClient.Create(ctx, baseline)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.commonRules).To(Equal(&nftables.CommonRules{
+			AcceptICMP:            true,
+			CustomIPv4EgressRules: []string{"tcp dport 443 accept", "udp dport 53 accept"},
+		}))
+		Expect(resyncs).To(Equal(1))
+
+		// Unchanged rules do not resync the policies
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resyncs).To(Equal(1))
+
+		Expect(k8sClient.Delete(ctx, baseline)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.commonRules).To(Equal(&nftables.CommonRules{
+			CustomIPv4EgressRules: []string{"udp dport 53 accept"},
+		}))
+		Expect(resyncs).To(Equal(2))
+	})
+
+	It("should keep the current rules when an object is invalid", func() {
+		Expect(k8sClient.Create(ctx, &v1alpha1.CommonRules{
+			ObjectMeta: metav1.ObjectMeta{Name: "baseline"},
+			Spec:       v1alpha1.CommonRulesSpec{AcceptICMPv6: true},
+		})).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resyncs).To(Equal(1))
+
+		Expect(k8sClient.Create(ctx, &v1alpha1.CommonRules{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken"},
+			Spec: v1alpha1.CommonRulesSpec{
+				IPv4Ingress: []string{"ip daddr {{ .NodeIP }} accept"},
+			},
+		})).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.commonRules).To(Equal(&nftables.CommonRules{AcceptICMPv6: true}))
+		Expect(resyncs).To(Equal(1))
+	})
+})
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// Keys of the common rules ConfigMap
+const (
+	CommonRulesAcceptICMPKey               = "accept-icmp"
+	CommonRulesAcceptICMPv6Key             = "accept-icmpv6"
+	CommonRulesAcceptIPsecKey              = "accept-ipsec"
+	CommonRulesDropIPv6ExtensionHeadersKey = "drop-ipv6-extension-headers"
+	CommonRulesDropInvalidTCPFlagsKey      = "drop-invalid-tcp-flags"
+	CommonRulesAcceptSelfTrafficKey        = "accept-self-traffic"
+	CommonRulesIPv4IngressKey              = "ipv4-ingress"
+	CommonRulesIPv4EgressKey               = "ipv4-egress"
+	CommonRulesIPv6IngressKey              = "ipv6-ingress"
+	CommonRulesIPv6EgressKey               = "ipv6-egress"
+)
+
+// CommonRulesSetter receives the common rules managed through the API
+type CommonRulesSetter interface {
+	SetClusterCommonRules(commonRules *nftables.CommonRules)
+}
+
+// CommonRulesReconciler reconciles the ConfigMap holding the common rules applied to all policies
+type CommonRulesReconciler struct {
+	client.Client
+	// ConfigMap is the namespaced name of the common rules ConfigMap
+	ConfigMap types.NamespacedName
+	NFT       CommonRulesSetter
+	// Resync enqueues all the policies to apply the new common rules
+	Resync func(ctx context.Context) error
+
+	mu      sync.Mutex
+	current *nftables.CommonRules
+}
+
+// Reconcile parses the common rules ConfigMap and resyncs the policies when the rules change
+func (c *CommonRulesReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var commonRules *nftables.CommonRules
+
+	configMap := &corev1.ConfigMap{}
+	err := c.Client.Get(ctx, req.NamespacedName, configMap)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+
+		logger.Info("Common rules ConfigMap not found, no cluster common rules are applied")
+	} else {
+		commonRules, err = parseCommonRulesConfigMap(configMap)
+		if err != nil {
+			// Keep the current rules, a new event will come with the fixed ConfigMap
+			logger.Error(err, "Invalid common rules ConfigMap, keeping the current rules")
+			return ctrl.Result{}, nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if reflect.DeepEqual(commonRules, c.current) {
+		logger.V(1).Info("Common rules unchanged")
+		return ctrl.Result{}, nil
+	}
+
+	c.NFT.SetClusterCommonRules(commonRules)
+	c.current = commonRules
+
+	logger.Info("Common rules changed, resyncing policies", "rules", commonRules)
+	if err := c.Resync(ctx); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to resync policies: %w", err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// parseCommonRulesConfigMap parses the common rules of the ConfigMap
+func parseCommonRulesConfigMap(configMap *corev1.ConfigMap) (*nftables.CommonRules, error) {
+	commonRules := &nftables.CommonRules{}
+
+	for key, value := range configMap.Data {
+		var err error
+
+		switch key {
+		case CommonRulesAcceptICMPKey:
+			commonRules.AcceptICMP, err = strconv.ParseBool(strings.TrimSpace(value))
+		case CommonRulesAcceptICMPv6Key:
+			commonRules.AcceptICMPv6, err = strconv.ParseBool(strings.TrimSpace(value))
+		case CommonRulesAcceptIPsecKey:
+			commonRules.AcceptIPsec, err = strconv.ParseBool(strings.TrimSpace(value))
+		case CommonRulesDropIPv6ExtensionHeadersKey:
+			commonRules.DropIPv6ExtensionHeaders, err = strconv.ParseBool(strings.TrimSpace(value))
+		case CommonRulesDropInvalidTCPFlagsKey:
+			commonRules.DropInvalidTCPFlags, err = strconv.ParseBool(strings.TrimSpace(value))
+		case CommonRulesAcceptSelfTrafficKey:
+			commonRules.AcceptSelfTraffic, err = strconv.ParseBool(strings.TrimSpace(value))
+		case CommonRulesIPv4IngressKey:
+			commonRules.CustomIPv4IngressRules, err = utils.ReadRules(strings.NewReader(value))
+		case CommonRulesIPv4EgressKey:
+			commonRules.CustomIPv4EgressRules, err = utils.ReadRules(strings.NewReader(value))
+		case CommonRulesIPv6IngressKey:
+			commonRules.CustomIPv6IngressRules, err = utils.ReadRules(strings.NewReader(value))
+		case CommonRulesIPv6EgressKey:
+			commonRules.CustomIPv6EgressRules, err = utils.ReadRules(strings.NewReader(value))
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", key, err)
+		}
+	}
+
+	if err := commonRules.Validate(); err != nil {
+		return nil, err
+	}
+
+	return commonRules, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (c *CommonRulesReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isCommonRulesConfigMap := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == c.ConfigMap.Namespace && obj.GetName() == c.ConfigMap.Name
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("commonrules").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(isCommonRulesConfigMap)).
+		Complete(c)
+}
@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// fakeCommonRulesSetter records the cluster common rules
+type fakeCommonRulesSetter struct {
+	commonRules *nftables.CommonRules
+}
+
+func (f *fakeCommonRulesSetter) SetClusterCommonRules(commonRules *nftables.CommonRules) {
+	f.commonRules = commonRules
+}
+
+var _ = Describe("CommonRulesReconciler", func() {
+	var (
+		ctx        context.Context
+		k8sClient  client.Client
+		setter     *fakeCommonRulesSetter
+		resyncs    int
+		reconciler *CommonRulesReconciler
+		req        ctrl.Request
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		k8sClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		setter = &fakeCommonRulesSetter{}
+		resyncs = 0
+		req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "kube-system", Name: "common-rules"}}
+
+		reconciler = &CommonRulesReconciler{
+			Client:    k8sClient,
+			ConfigMap: req.NamespacedName,
+			NFT:       setter,
+			Resync: func(_ context.Context) error {
+				resyncs++
+				return nil
+			},
+		}
+	})
+
+	It("should apply the rules of the ConfigMap and resync the policies when they change", func() {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "common-rules"},
+			Data: map[string]string{
+				CommonRulesAcceptICMPKey:               "true",
+				CommonRulesAcceptIPsecKey:              "true",
+				CommonRulesDropIPv6ExtensionHeadersKey: "true",
+				CommonRulesDropInvalidTCPFlagsKey:      "true",
+				CommonRulesAcceptSelfTrafficKey:        "true",
+				CommonRulesIPv4IngressKey:              "# Allow SSH\ntcp dport 22 accept\n\nudp dport 53 accept\n",
+				CommonRulesIPv6EgressKey:               "tcp dport 443 accept",
+			},
+		}
+		Expect(k8sClient.Create(ctx, configMap)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.commonRules).To(Equal(&nftables.CommonRules{
+			AcceptICMP:               true,
+			AcceptIPsec:              true,
+			DropIPv6ExtensionHeaders: true,
+			DropInvalidTCPFlags:      true,
+			AcceptSelfTraffic:        true,
+			CustomIPv4IngressRules:   []string{"tcp dport 22 accept", "udp dport 53 accept"},
+			CustomIPv6EgressRules:    []string{"tcp dport 443 accept"},
+		}))
+		Expect(resyncs).To(Equal(1))
+
+		// Unchanged rules do not resync the policies
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resyncs).To(Equal(1))
+
+		Expect(k8sClient.Delete(ctx, configMap)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.commonRules).To(BeNil())
+		Expect(resyncs).To(Equal(2))
+	})
+
+	It("should keep the current rules when the ConfigMap is invalid", func() {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "common-rules"},
+			Data: map[string]string{
+				CommonRulesAcceptICMPKey: "yes please",
+			},
+		}
+		Expect(k8sClient.Create(ctx, configMap)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.commonRules).To(BeNil())
+		Expect(resyncs).To(Equal(0))
+	})
+
+	It("should reject custom rules with invalid templates", func() {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "common-rules"},
+			Data: map[string]string{
+				CommonRulesIPv4IngressKey: "ip daddr {{ .NodeIP }} accept",
+			},
+		}
+
+		_, err := parseCommonRulesConfigMap(configMap)
+		Expect(err).To(HaveOccurred())
+	})
+})
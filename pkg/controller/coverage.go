@@ -0,0 +1,228 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// CoverageReport lists the pods on a node with enforceable secondary interfaces that are not selected by any policy
+type CoverageReport struct {
+	Node            string           `json:"node"`
+	GeneratedAt     time.Time        `json:"generatedAt"`
+	UnprotectedPods []UnprotectedPod `json:"unprotectedPods"`
+}
+
+// UnprotectedPod is a pod with at least one enforceable interface not selected by any policy
+type UnprotectedPod struct {
+	Namespace  string                 `json:"namespace"`
+	Name       string                 `json:"name"`
+	Interfaces []UnprotectedInterface `json:"interfaces"`
+}
+
+// UnprotectedInterface is an enforceable interface not selected by any policy
+type UnprotectedInterface struct {
+	Name    string `json:"name"`
+	Network string `json:"network"`
+}
+
+// CoverageReporter periodically computes the policy coverage of the pods running on this node
+type CoverageReporter struct {
+	client.Client
+	DS           *datastore.Datastore
+	Hostname     string
+	ValidPlugins []string
+	Interval     time.Duration
+
+	// mu guards ValidPlugins which can be replaced on configuration reloads, and the latest report
+	mu     sync.RWMutex
+	report *CoverageReport
+}
+
+// Start runs the coverage reporter until the context is done
+func (c *CoverageReporter) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("coverage")
+
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := c.computeReport(ctx)
+		if err != nil {
+			logger.Error(err, "Failed to compute policy coverage report")
+		} else {
+			c.setReport(report)
+			logger.V(1).Info("Policy coverage report computed", "unprotectedPods", len(report.UnprotectedPods))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every node reports its own coverage
+func (c *CoverageReporter) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP serves the latest coverage report as JSON
+func (c *CoverageReporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	c.mu.RLock()
+	report := c.report
+	c.mu.RUnlock()
+
+	if report == nil {
+		http.Error(w, "coverage report not computed yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// SetValidPlugins replaces the valid plugins, they are used on the next report
+func (c *CoverageReporter) SetValidPlugins(plugins []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ValidPlugins = plugins
+}
+
+// setReport stores the report and updates the coverage metrics
+func (c *CoverageReporter) setReport(report *CoverageReport) {
+	c.mu.Lock()
+	c.report = report
+	c.mu.Unlock()
+
+	perNetwork := make(map[string]int)
+	for _, pod := range report.UnprotectedPods {
+		for _, intf := range pod.Interfaces {
+			perNetwork[intf.Network]++
+		}
+	}
+
+	metrics.UnprotectedPods.WithLabelValues(report.Node).Set(float64(len(report.UnprotectedPods)))
+	metrics.UnprotectedInterfaces.Reset()
+	for network, count := range perNetwork {
+		metrics.UnprotectedInterfaces.WithLabelValues(report.Node, network).Set(float64(count))
+	}
+}
+
+// computeReport lists the eligible pods of this node and checks which enforceable interfaces are not covered by a policy
+func (c *CoverageReporter) computeReport(ctx context.Context) (*CoverageReport, error) {
+	pods := &corev1.PodList{}
+	err := c.Client.List(ctx, pods, client.MatchingFields{
+		nftables.PodHostnameIndex:             c.Hostname,
+		nftables.PodStatusIndex:               string(corev1.PodRunning),
+		nftables.PodHostNetworkIndex:          "false",
+		nftables.PodHasNetworkAnnotationIndex: "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	validPlugins := c.ValidPlugins
+	c.mu.RUnlock()
+
+	policies := c.DS.ListPolicies()
+	enforceable := make(map[string]bool)
+
+	report := &CoverageReport{
+		Node:            c.Hostname,
+		GeneratedAt:     time.Now(),
+		UnprotectedPods: []UnprotectedPod{},
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		var unprotected []UnprotectedInterface
+		for _, intf := range nftables.GetInterfaces(pod) {
+			if _, ok := enforceable[intf.Network]; !ok {
+				enforceable[intf.Network] = c.isEnforceableNetwork(ctx, intf.Network, validPlugins)
+			}
+
+			if !enforceable[intf.Network] || isInterfaceCovered(policies, pod, intf) {
+				continue
+			}
+
+			unprotected = append(unprotected, UnprotectedInterface{Name: intf.Name, Network: intf.Network})
+		}
+
+		if len(unprotected) > 0 {
+			report.UnprotectedPods = append(report.UnprotectedPods, UnprotectedPod{
+				Namespace:  pod.Namespace,
+				Name:       pod.Name,
+				Interfaces: unprotected,
+			})
+		}
+	}
+
+	sort.Slice(report.UnprotectedPods, func(i, j int) bool {
+		if report.UnprotectedPods[i].Namespace != report.UnprotectedPods[j].Namespace {
+			return report.UnprotectedPods[i].Namespace < report.UnprotectedPods[j].Namespace
+		}
+		return report.UnprotectedPods[i].Name < report.UnprotectedPods[j].Name
+	})
+
+	return report, nil
+}
+
+// isEnforceableNetwork checks if the network attachment definition uses one of the valid plugins
+func (c *CoverageReporter) isEnforceableNetwork(ctx context.Context, network string, validPlugins []string) bool {
+	parts := strings.Split(network, "/")
+	if len(parts) != 2 {
+		return false
+	}
+
+	var netAttachDef netdefv1.NetworkAttachmentDefinition
+	if err := c.Client.Get(ctx, types.NamespacedName{Namespace: parts[0], Name: parts[1]}, &netAttachDef); err != nil {
+		return false
+	}
+
+	networkType, err := getNetworkType(&netAttachDef)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(validPlugins, networkType) && !slices.Contains(userspacePlugins, networkType) && checkNetworkTopology(&netAttachDef, networkType) == nil
+}
+
+// isInterfaceCovered checks if any policy selects the pod on the network of the interface
+func isInterfaceCovered(policies []*datastore.Policy, pod *corev1.Pod, intf nftables.Interface) bool {
+	for _, policy := range policies {
+		if policy.Namespace != pod.Namespace {
+			continue
+		}
+
+		if !slices.Contains(policy.Networks, intf.Network) {
+			continue
+		}
+
+		if utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels) {
+			return true
+		}
+	}
+
+	return false
+}
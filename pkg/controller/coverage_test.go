@@ -0,0 +1,130 @@
+package controller
+
+import (
+	"context"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// newIndexedFakeClientBuilder returns a fake client builder with the pod indexes used by the controller
+func newIndexedFakeClientBuilder(scheme *runtime.Scheme) *fake.ClientBuilder {
+	builder := fake.NewClientBuilder().WithScheme(scheme)
+	for field, extractValue := range podIndexes {
+		builder = builder.WithIndex(&corev1.Pod{}, field, extractValue)
+	}
+
+	return builder
+}
+
+func newTestNAD(namespace, name, pluginType string) *netdefv1.NetworkAttachmentDefinition {
+	return &netdefv1.NetworkAttachmentDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: netdefv1.NetworkAttachmentDefinitionSpec{
+			Config: `{"cniVersion": "0.3.1", "type": "` + pluginType + `"}`,
+		},
+	}
+}
+
+func newTestPod(namespace, name, node string, labels map[string]string, networks string, networkStatus string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				"k8s.v1.cni.cncf.io/networks":       networks,
+				"k8s.v1.cni.cncf.io/network-status": networkStatus,
+			},
+		},
+		Spec:   corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+var _ = Describe("CoverageReporter", func() {
+	var (
+		ctx      context.Context
+		scheme   *runtime.Scheme
+		ds       *datastore.Datastore
+		objects  []client.Object
+		reporter *CoverageReporter
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		scheme = runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(netdefv1.AddToScheme(scheme)).To(Succeed())
+
+		ds = &datastore.Datastore{Policies: make(map[types.NamespacedName]*datastore.Policy)}
+
+		objects = []client.Object{
+			newTestNAD("default", "macvlan-net", "macvlan"),
+			newTestNAD("default", "bridge-net", "bridge"),
+			newTestPod("default", "web", "node1", map[string]string{"app": "web"}, "macvlan-net",
+				`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.1"]}]`),
+			newTestPod("default", "db", "node1", map[string]string{"app": "db"}, "macvlan-net,bridge-net",
+				`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.2"]},{"name":"default/bridge-net","interface":"net2","ips":["10.1.0.2"]}]`),
+			newTestPod("default", "remote", "node2", map[string]string{"app": "web"}, "macvlan-net",
+				`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.3"]}]`),
+		}
+	})
+
+	JustBeforeEach(func() {
+		reporter = &CoverageReporter{
+			Client:       newIndexedFakeClientBuilder(scheme).WithObjects(objects...).Build(),
+			DS:           ds,
+			Hostname:     "node1",
+			ValidPlugins: []string{"macvlan"},
+		}
+	})
+
+	It("should report every local pod with enforceable interfaces when there are no policies", func() {
+		report, err := reporter.computeReport(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Node).To(Equal("node1"))
+		Expect(report.UnprotectedPods).To(Equal([]UnprotectedPod{
+			{Namespace: "default", Name: "db", Interfaces: []UnprotectedInterface{{Name: "net1", Network: "default/macvlan-net"}}},
+			{Namespace: "default", Name: "web", Interfaces: []UnprotectedInterface{{Name: "net1", Network: "default/macvlan-net"}}},
+		}))
+	})
+
+	It("should not report pods selected by a policy on the interface network", func() {
+		ds.CreatePolicy(&datastore.Policy{
+			Name:      "web-policy",
+			Namespace: "default",
+			Networks:  []string{"default/macvlan-net"},
+			Spec: datastore.PolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			},
+		})
+
+		report, err := reporter.computeReport(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.UnprotectedPods).To(HaveLen(1))
+		Expect(report.UnprotectedPods[0].Name).To(Equal("db"))
+	})
+
+	It("should report pods selected by a policy for another network", func() {
+		ds.CreatePolicy(&datastore.Policy{
+			Name:      "other-network",
+			Namespace: "default",
+			Networks:  []string{"default/other-net"},
+			Spec:      datastore.PolicySpec{},
+		})
+
+		report, err := reporter.computeReport(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.UnprotectedPods).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// EarlyDenier denies the interfaces of a pod selected by the policies until the policies are applied
+type EarlyDenier interface {
+	EnforceEarlyDeny(ctx context.Context, pod *corev1.Pod, policies []*datastore.Policy, logger logr.Logger) error
+}
+
+// EarlyDenyReconciler denies the traffic of the secondary interfaces of the pods of the node as soon as their network
+// status is reported, which is before the pods are running and the policies are applied to them
+type EarlyDenyReconciler struct {
+	client.Client
+	NFT      EarlyDenier
+	DS       *datastore.Datastore
+	Hostname string
+
+	mu sync.Mutex
+	// denied are the pods the early deny was enforced for, by pod
+	denied map[types.NamespacedName]deniedPod
+}
+
+// deniedPod is a pod the early deny was enforced for, with the labels the policies selected it by
+type deniedPod struct {
+	uid    types.UID
+	labels map[string]string
+}
+
+// Reconcile enforces the early deny once per pod, with the policies of the datastore selecting the pod. It is enforced
+// again when the labels of the pod change, to allow the interfaces no policy selecting the pod applies to anymore.
+func (e *EarlyDenyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	pod := &corev1.Pod{}
+	if err := e.Client.Get(ctx, req.NamespacedName, pod); err != nil {
+		if errors.IsNotFound(err) {
+			e.mu.Lock()
+			delete(e.denied, req.NamespacedName)
+			e.mu.Unlock()
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return ctrl.Result{}, nil
+	}
+
+	e.mu.Lock()
+	denied, ok := e.denied[req.NamespacedName]
+	e.mu.Unlock()
+	if ok && denied.uid == pod.UID && maps.Equal(denied.labels, pod.Labels) {
+		return ctrl.Result{}, nil
+	}
+
+	var policies []*datastore.Policy
+	for _, policy := range e.DS.ListPolicies() {
+		if policy.Namespace == pod.Namespace {
+			policies = append(policies, policy)
+		}
+	}
+
+	if err := e.NFT.EnforceEarlyDeny(ctx, pod, policies, logger); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.denied == nil {
+		e.denied = make(map[types.NamespacedName]deniedPod)
+	}
+	e.denied[req.NamespacedName] = deniedPod{uid: pod.UID, labels: pod.Labels}
+
+	return ctrl.Result{}, nil
+}
+
+// earlyDenyPodPredicate filters the pods of the node with a secondary interface reported in their network status
+func earlyDenyPodPredicate(hostname string) predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Spec.NodeName != hostname {
+			return false
+		}
+
+		return isPodTentativelyEligible(pod)
+	})
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (e *EarlyDenyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("earlydeny").
+		For(&corev1.Pod{}, builder.WithPredicates(earlyDenyPodPredicate(e.Hostname))).
+		Complete(e)
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// fakeEarlyDenier records the policies the early deny of each pod was enforced with
+type fakeEarlyDenier struct {
+	err    error
+	denied map[types.NamespacedName][]*datastore.Policy
+}
+
+func (f *fakeEarlyDenier) EnforceEarlyDeny(_ context.Context, pod *corev1.Pod, policies []*datastore.Policy, _ logr.Logger) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	f.denied[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = policies
+	return nil
+}
+
+var _ = Describe("EarlyDenyReconciler", func() {
+	var (
+		ctx        context.Context
+		k8sClient  client.Client
+		denier     *fakeEarlyDenier
+		ds         *datastore.Datastore
+		reconciler *EarlyDenyReconciler
+		pod        *corev1.Pod
+		key        types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		k8sClient = fake.NewClientBuilder().WithScheme(scheme).Build()
+
+		denier = &fakeEarlyDenier{denied: make(map[types.NamespacedName][]*datastore.Policy)}
+		ds = &datastore.Datastore{Policies: map[types.NamespacedName]*datastore.Policy{}}
+		ds.CreatePolicy(&datastore.Policy{Name: "deny", Namespace: "default", Networks: []string{"default/macvlan"}})
+		ds.CreatePolicy(&datastore.Policy{Name: "other", Namespace: "other", Networks: []string{"default/macvlan"}})
+
+		reconciler = &EarlyDenyReconciler{Client: k8sClient, NFT: denier, DS: ds, Hostname: "node-1"}
+
+		key = types.NamespacedName{Namespace: "default", Name: "pod"}
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   key.Namespace,
+				Name:        key.Name,
+				UID:         "uid-1",
+				Annotations: map[string]string{"k8s.v1.cni.cncf.io/networks": "default/macvlan"},
+			},
+			Spec:   corev1.PodSpec{NodeName: "node-1"},
+			Status: corev1.PodStatus{Phase: corev1.PodPending},
+		}
+	})
+
+	It("should deny a pending pod once with the policies of its namespace", func() {
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denier.denied).To(HaveKey(key))
+		Expect(denier.denied[key]).To(ConsistOf(HaveField("Name", "deny")))
+
+		delete(denier.denied, key)
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denier.denied).To(BeEmpty())
+	})
+
+	It("should enforce the early deny of a pod again when its labels change", func() {
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		delete(denier.denied, key)
+		pod.Labels = map[string]string{"app": "cnf"}
+		Expect(k8sClient.Update(ctx, pod)).To(Succeed())
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denier.denied).To(HaveKey(key))
+	})
+
+	It("should deny a pod again when it is recreated", func() {
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		delete(denier.denied, key)
+		pod.ResourceVersion = ""
+		pod.UID = "uid-2"
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denier.denied).To(HaveKey(key))
+	})
+
+	It("should retry the pods whose early deny failed", func() {
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		denier.err = errors.New("sandbox not ready")
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).To(MatchError("sandbox not ready"))
+
+		denier.err = nil
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denier.denied).To(HaveKey(key))
+	})
+
+	It("should skip the terminated pods", func() {
+		pod.Status.Phase = corev1.PodSucceeded
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(denier.denied).To(BeEmpty())
+	})
+
+	It("should only select the pods of the node with a secondary network", func() {
+		p := earlyDenyPodPredicate("node-1")
+		Expect(p.Generic(event.GenericEvent{Object: pod})).To(BeTrue())
+
+		other := pod.DeepCopy()
+		other.Spec.NodeName = "node-2"
+		Expect(p.Generic(event.GenericEvent{Object: other})).To(BeFalse())
+
+		hostNetwork := pod.DeepCopy()
+		hostNetwork.Spec.HostNetwork = true
+		Expect(p.Generic(event.GenericEvent{Object: hostNetwork})).To(BeFalse())
+
+		plain := pod.DeepCopy()
+		plain.Annotations = nil
+		Expect(p.Generic(event.GenericEvent{Object: plain})).To(BeFalse())
+	})
+})
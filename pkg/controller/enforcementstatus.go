@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/apis/v1alpha1"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// UnenforceableInterfaceLister lists the interfaces of the pods of this node the policies cannot be applied to
+type UnenforceableInterfaceLister interface {
+	UnenforceableInterfaces() []nftables.UnenforceableInterface
+}
+
+// NetworkStatisticsLister lists the enforcement statistics of the networks of the pods of this node
+type NetworkStatisticsLister interface {
+	NetworkStatistics() []nftables.NetworkStatistics
+}
+
+// EnforcementStatusReporter periodically writes the interfaces of the pods of this node the policies cannot be applied
+// to, and the enforcement statistics of their networks when Networks is set, in the NodeEnforcementStatus of the node
+type EnforcementStatusReporter struct {
+	client.Client
+	Interfaces UnenforceableInterfaceLister
+	Networks   NetworkStatisticsLister
+	Hostname   string
+	Interval   time.Duration
+}
+
+// Start runs the status reporter until the context is done
+func (r *EnforcementStatusReporter) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("enforcement-status")
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.report(ctx); err != nil {
+			logger.Error(err, "Failed to report enforcement status")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every node reports its own status
+func (r *EnforcementStatusReporter) NeedLeaderElection() bool {
+	return false
+}
+
+// report writes the status of the node when it changed, the interfaces of the pods that are gone are not reported
+func (r *EnforcementStatusReporter) report(ctx context.Context) error {
+	pods := &corev1.PodList{}
+	if err := r.Client.List(ctx, pods, client.MatchingFields{nftables.PodHostnameIndex: r.Hostname}); err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	uids := make(map[types.NamespacedName]types.UID, len(pods.Items))
+	for _, pod := range pods.Items {
+		uids[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod.UID
+	}
+
+	var interfaces []v1alpha1.UnenforceableInterface
+	for _, intf := range r.Interfaces.UnenforceableInterfaces() {
+		if uid, ok := uids[intf.Pod]; !ok || uid != intf.UID {
+			continue
+		}
+
+		interfaces = append(interfaces, v1alpha1.UnenforceableInterface{
+			Namespace: intf.Pod.Namespace,
+			Pod:       intf.Pod.Name,
+			Interface: intf.Interface,
+			Network:   intf.Network,
+			Reason:    intf.Reason,
+		})
+	}
+
+	var networks []v1alpha1.NetworkEnforcementStatistics
+	if r.Networks != nil {
+		for _, stats := range r.Networks.NetworkStatistics() {
+			networks = append(networks, v1alpha1.NetworkEnforcementStatistics{
+				Network: stats.Network,
+				Pods:    stats.Pods,
+				Rules:   stats.Rules,
+				// The API keeps the times to the second
+				LastSyncTime: metav1.NewTime(stats.LastSync.Truncate(time.Second)),
+			})
+		}
+	}
+
+	status := &v1alpha1.NodeEnforcementStatus{}
+	err := r.Client.Get(ctx, types.NamespacedName{Name: r.Hostname}, status)
+	if errors.IsNotFound(err) {
+		status = &v1alpha1.NodeEnforcementStatus{
+			ObjectMeta: metav1.ObjectMeta{Name: r.Hostname},
+			Status: v1alpha1.NodeEnforcementStatusStatus{
+				UnenforceableInterfaces: interfaces,
+				Networks:                networks,
+				LastUpdateTime:          metav1.Now(),
+			},
+		}
+		if err := r.Client.Create(ctx, status); err != nil {
+			return fmt.Errorf("failed to create enforcement status: %w", err)
+		}
+
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get enforcement status: %w", err)
+	}
+
+	if slices.Equal(status.Status.UnenforceableInterfaces, interfaces) && slices.EqualFunc(status.Status.Networks, networks, equalNetworkStatistics) {
+		return nil
+	}
+
+	status.Status.UnenforceableInterfaces = interfaces
+	status.Status.Networks = networks
+	status.Status.LastUpdateTime = metav1.Now()
+	if err := r.Client.Update(ctx, status); err != nil {
+		return fmt.Errorf("failed to update enforcement status: %w", err)
+	}
+
+	log.FromContext(ctx).WithName("enforcement-status").V(1).Info("Enforcement status updated", "unenforceableInterfaces", len(interfaces), "networks", len(networks))
+
+	return nil
+}
+
+// equalNetworkStatistics returns whether the statistics of a network are the same, the times are compared as instants
+func equalNetworkStatistics(a, b v1alpha1.NetworkEnforcementStatistics) bool {
+	return a.Network == b.Network && a.Pods == b.Pods && a.Rules == b.Rules && a.LastSyncTime.Equal(&b.LastSyncTime)
+}
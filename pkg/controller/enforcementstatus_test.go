@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/apis/v1alpha1"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// fakeUnenforceableInterfaceLister returns fixed unenforceable interfaces
+type fakeUnenforceableInterfaceLister []nftables.UnenforceableInterface
+
+func (f fakeUnenforceableInterfaceLister) UnenforceableInterfaces() []nftables.UnenforceableInterface {
+	return f
+}
+
+// fakeNetworkStatisticsLister returns fixed network statistics
+type fakeNetworkStatisticsLister []nftables.NetworkStatistics
+
+func (f fakeNetworkStatisticsLister) NetworkStatistics() []nftables.NetworkStatistics {
+	return f
+}
+
+var _ = Describe("EnforcementStatusReporter", func() {
+	var (
+		ctx       context.Context
+		k8sClient client.Client
+		reporter  *EnforcementStatusReporter
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		dpdk := newTestPod("default", "dpdk", "node1", nil, "sriov-net", "")
+		dpdk.UID = "dpdk-uid"
+		k8sClient = newIndexedFakeClientBuilder(scheme).WithObjects(dpdk).Build()
+
+		reporter = &EnforcementStatusReporter{
+			Client:   k8sClient,
+			Hostname: "node1",
+		}
+	})
+
+	getStatus := func() *v1alpha1.NodeEnforcementStatus {
+		status := &v1alpha1.NodeEnforcementStatus{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "node1"}, status)).To(Succeed())
+		return status
+	}
+
+	It("should report the unenforceable interfaces of the pods of the node", func() {
+		dpdk := types.NamespacedName{Namespace: "default", Name: "dpdk"}
+		reporter.Interfaces = fakeUnenforceableInterfaceLister{
+			{Pod: dpdk, UID: "dpdk-uid", Interface: "net1", Network: "default/sriov-net", Reason: nftables.UnenforceableReasonUserspaceDriver},
+			// The pods that are gone or were recreated are not reported
+			{Pod: dpdk, UID: "previous-uid", Interface: "net2", Network: "default/sriov-net", Reason: nftables.UnenforceableReasonUserspaceDriver},
+			{Pod: types.NamespacedName{Namespace: "default", Name: "gone"}, UID: "gone-uid", Interface: "net1", Network: "default/vpp-net", Reason: nftables.UnenforceableReasonMemif},
+		}
+
+		Expect(reporter.report(ctx)).To(Succeed())
+		status := getStatus()
+		Expect(status.Status.UnenforceableInterfaces).To(Equal([]v1alpha1.UnenforceableInterface{
+			{Namespace: "default", Pod: "dpdk", Interface: "net1", Network: "default/sriov-net", Reason: "UserspaceDriver"},
+		}))
+
+		// The status is only written when it changes
+		Expect(reporter.report(ctx)).To(Succeed())
+		Expect(getStatus().ResourceVersion).To(Equal(status.ResourceVersion))
+
+		reporter.Interfaces = fakeUnenforceableInterfaceLister{}
+		Expect(reporter.report(ctx)).To(Succeed())
+		Expect(getStatus().Status.UnenforceableInterfaces).To(BeEmpty())
+	})
+
+	It("should report the enforcement statistics of the networks", func() {
+		reporter.Interfaces = fakeUnenforceableInterfaceLister{}
+		lastSync := time.Date(2026, 1, 2, 3, 4, 5, 600, time.UTC)
+		reporter.Networks = fakeNetworkStatisticsLister{
+			{Network: "default/blue", Pods: 2, Rules: 12, LastSync: lastSync},
+		}
+
+		Expect(reporter.report(ctx)).To(Succeed())
+		status := getStatus()
+		Expect(status.Status.Networks).To(HaveLen(1))
+		Expect(status.Status.Networks[0]).To(And(
+			HaveField("Network", "default/blue"),
+			HaveField("Pods", 2),
+			HaveField("Rules", 12),
+		))
+		Expect(status.Status.Networks[0].LastSyncTime.Time).To(BeTemporally("==", lastSync.Truncate(time.Second)))
+
+		// The status is only written when the statistics change, the times are kept to the second
+		Expect(reporter.report(ctx)).To(Succeed())
+		Expect(getStatus().ResourceVersion).To(Equal(status.ResourceVersion))
+
+		reporter.Networks = fakeNetworkStatisticsLister{
+			{Network: "default/blue", Pods: 3, Rules: 18, LastSync: lastSync.Add(time.Minute)},
+		}
+		Expect(reporter.report(ctx)).To(Succeed())
+		Expect(getStatus().Status.Networks[0].Pods).To(Equal(3))
+	})
+})
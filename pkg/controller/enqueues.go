@@ -3,43 +3,77 @@ package controller
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/go-logr/logr"
 	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
 )
 
 // namespaceEnqueue returns a function that enqueues policies affected by a namespace event
-func namespaceEnqueue(clt client.Client) func(ctx context.Context, ns client.Object) []reconcile.Request {
-	return func(ctx context.Context, ns client.Object) []reconcile.Request {
-		logger := log.FromContext(ctx).WithValues("namespace", ns.GetName())
-
-		namespace, ok := ns.(*corev1.Namespace)
-		if !ok {
-			// Should not happen
-			return []reconcile.Request{}
-		}
+func namespaceEnqueue(clt client.Client, ds *datastore.Datastore) handler.MapFunc {
+	return policyEnqueue(clt, func(client.Object) []types.NamespacedName {
+		return ds.PoliciesForNamespace()
+	}, func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, logger logr.Logger) bool {
+		namespace, ok := obj.(*corev1.Namespace)
+		return ok && isPolicyAffectedByNamespace(policy, namespace, logger)
+	})
+}
 
-		var mp multiv1beta1.MultiNetworkPolicyList
-		err := clt.List(ctx, &mp)
-		if err != nil {
-			logger.Error(err, "Failed to list policies")
-			return []reconcile.Request{}
-		}
+// podEnqueue returns a function that enqueues policies affected by a pod event
+func podEnqueue(clt client.Client, ds *datastore.Datastore) handler.MapFunc {
+	return policyEnqueue(clt, func(obj client.Object) []types.NamespacedName {
+		return ds.PoliciesForPod(obj.GetNamespace())
+	}, func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, logger logr.Logger) bool {
+		pod, ok := obj.(*corev1.Pod)
+		return ok && isPolicyAffectedByPod(policy, pod, logger)
+	})
+}
+
+// networkAttachmentDefinitionEnqueue returns a function that enqueues policies affected by a network attachment definition event
+func networkAttachmentDefinitionEnqueue(clt client.Client, ds *datastore.Datastore) handler.MapFunc {
+	return policyEnqueue(clt, func(obj client.Object) []types.NamespacedName {
+		return ds.PoliciesForNetwork(obj.GetNamespace(), obj.GetName())
+	}, func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, _ logr.Logger) bool {
+		return isPolicyAffectedByNetwork(policy, obj.GetNamespace(), obj.GetName())
+	})
+}
+
+// policyEnqueue returns a function that enqueues the MultiNetworkPolicies affected by an event. Only the candidates
+// returned by the reverse index of the datastore are checked, instead of all the policies.
+func policyEnqueue(clt client.Client, candidates func(obj client.Object) []types.NamespacedName, isAffected func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, logger logr.Logger) bool) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		logger := log.FromContext(ctx).WithValues("object", obj.GetName(), "namespace", obj.GetNamespace())
 
-		logger.V(1).Info("Checking policies affected by namespace")
+		logger.V(1).Info("Checking policies affected by object")
 
 		var requests []reconcile.Request
-		for _, policy := range mp.Items {
-			if isPolicyAffectedByNamespace(&policy, namespace, logger) {
-				namespaceName := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
-				logger.Info("Policy is affected by namespace", "policy", namespaceName)
+		for _, namespaceName := range candidates(obj) {
+			// The mirrored NetworkPolicies are enqueued by their own controller
+			if strings.HasPrefix(namespaceName.Name, mirroredPolicyPrefix) {
+				continue
+			}
+
+			policy := &multiv1beta1.MultiNetworkPolicy{}
+			if err := clt.Get(ctx, namespaceName, policy); err != nil {
+				if !errors.IsNotFound(err) {
+					logger.Error(err, "Failed to get policy", "policy", namespaceName)
+				}
+				continue
+			}
+
+			if isAffected(policy, obj, logger) {
+				logger.Info("Policy is affected by object", "policy", namespaceName)
 				requests = append(requests, reconcile.Request{NamespacedName: namespaceName})
 			}
 		}
@@ -48,36 +82,25 @@ func namespaceEnqueue(clt client.Client) func(ctx context.Context, ns client.Obj
 	}
 }
 
-// podEnqueue returns a function that enqueues policies affected by a pod event
-func podEnqueue(clt client.Client) func(ctx context.Context, ns client.Object) []reconcile.Request {
-	return func(ctx context.Context, ns client.Object) []reconcile.Request {
-		logger := log.FromContext(ctx).WithValues("pod", ns.GetName(), "namespace", ns.GetNamespace())
-		pod, ok := ns.(*corev1.Pod)
-		if !ok {
-			// Should not happen
-			return []reconcile.Request{}
-		}
-
-		var mp multiv1beta1.MultiNetworkPolicyList
-		err := clt.List(ctx, &mp)
-		if err != nil {
-			logger.Error(err, "Failed to list policies")
-			return []reconcile.Request{}
-		}
-
-		logger.V(1).Info("Checking policies affected by pod")
+// isPolicyAffectedByNetwork checks if a network of the policy-for annotation of a policy matches a network attachment definition
+func isPolicyAffectedByNetwork(policy *multiv1beta1.MultiNetworkPolicy, namespace string, name string) bool {
+	if policy == nil {
+		return false
+	}
 
-		var requests []reconcile.Request
-		for _, policy := range mp.Items {
-			if isPolicyAffectedByPod(&policy, pod, logger) {
-				namespaceName := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
-				logger.Info("Policy is affected by pod", "policy", namespaceName)
-				requests = append(requests, reconcile.Request{NamespacedName: namespaceName})
-			}
-		}
+	policyForAnnotation, err := getPolicyForAnnotation(policy)
+	if err != nil {
+		return false
+	}
 
-		return requests
+	networks, err := getNetworksInPolicyForAnnotation(policyForAnnotation, policy.Namespace)
+	if err != nil {
+		return false
 	}
+
+	return slices.ContainsFunc(networks, func(network string) bool {
+		return datastore.MatchesNetwork(network, namespace, name)
+	})
 }
 
 // isPolicyAffectedByNamespace checks if a policy is affected by a namespace
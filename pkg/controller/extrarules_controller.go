@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/apis/v1alpha1"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// ExtraRulesSetter receives the extra rules of the pods managed through the API
+type ExtraRulesSetter interface {
+	SetExtraRules(key types.NamespacedName, rules *nftables.ExtraRules)
+}
+
+// ExtraRulesReconciler reconciles the ExtraRules objects holding the rules other controllers add for the pods
+type ExtraRulesReconciler struct {
+	client.Client
+	NFT ExtraRulesSetter
+	// Checker checks each rule with nft before it is applied, nil only validates the rules
+	Checker knftables.Interface
+	// DS is the datastore whose reverse index returns the policies of the namespace of the extra rules
+	DS *datastore.Datastore
+	// Enqueue enqueues the policies to apply the new extra rules
+	Enqueue func(ctx context.Context, policies []types.NamespacedName) error
+
+	mu      sync.Mutex
+	current map[types.NamespacedName]*nftables.ExtraRules
+}
+
+// Reconcile validates the rules of an ExtraRules object and enqueues the policies of the pods it selects when they
+// change
+func (e *ExtraRulesReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var extraRules *nftables.ExtraRules
+
+	object := &v1alpha1.ExtraRules{}
+	err := e.Client.Get(ctx, req.NamespacedName, object)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+
+		logger.V(1).Info("ExtraRules not found, removing its rules")
+	} else {
+		extraRules = &nftables.ExtraRules{
+			Namespace:   object.Namespace,
+			Name:        object.Name,
+			PodSelector: object.Spec.PodSelector,
+			Interfaces:  object.Spec.Interfaces,
+			Ingress:     trimRules(object.Spec.Ingress),
+			Egress:      trimRules(object.Spec.Egress),
+		}
+
+		if err := e.validate(ctx, extraRules); err != nil {
+			// Keep the current rules, a new event will come with the fixed object
+			logger.Error(err, "Invalid ExtraRules, keeping the current rules")
+			return ctrl.Result{}, nil
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if reflect.DeepEqual(extraRules, e.current[req.NamespacedName]) {
+		logger.V(1).Info("Extra rules unchanged")
+		return ctrl.Result{}, nil
+	}
+
+	// The pods selected by the previous rules lose them, the pods selected by the new rules get them
+	var selectors []metav1.LabelSelector
+	if previous := e.current[req.NamespacedName]; previous != nil {
+		selectors = append(selectors, previous.PodSelector)
+	}
+	if extraRules != nil {
+		selectors = append(selectors, extraRules.PodSelector)
+	}
+
+	policies, err := e.affectedPolicies(ctx, req.Namespace, selectors)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	e.NFT.SetExtraRules(req.NamespacedName, extraRules)
+	if e.current == nil {
+		e.current = make(map[types.NamespacedName]*nftables.ExtraRules)
+	}
+	if extraRules == nil {
+		delete(e.current, req.NamespacedName)
+	} else {
+		e.current[req.NamespacedName] = extraRules
+	}
+
+	logger.Info("Extra rules changed, enqueuing the policies of the selected pods", "rules", extraRules, "policies", policies)
+	if err := e.Enqueue(ctx, policies); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to enqueue policies: %w", err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// affectedPolicies returns the policies selecting the pods of a namespace matched by one of the selectors. The
+// candidates are the policies of the namespace in the reverse index of the datastore, the policies not applied yet
+// are always returned.
+func (e *ExtraRulesReconciler) affectedPolicies(ctx context.Context, namespace string, selectors []metav1.LabelSelector) ([]types.NamespacedName, error) {
+	pods := &corev1.PodList{}
+	if err := e.Client.List(ctx, pods, client.InNamespace(namespace)); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var selected []*corev1.Pod
+	for i := range pods.Items {
+		if slices.ContainsFunc(selectors, func(selector metav1.LabelSelector) bool {
+			return utils.MatchesSelector(selector, pods.Items[i].Labels)
+		}) {
+			selected = append(selected, &pods.Items[i])
+		}
+	}
+	if len(selected) == 0 {
+		return nil, nil
+	}
+
+	var policies []types.NamespacedName
+	for _, key := range e.DS.PoliciesForPod(namespace) {
+		if key.Namespace != namespace {
+			continue
+		}
+
+		policy := e.DS.GetPolicy(key)
+		if policy == nil || slices.ContainsFunc(selected, func(pod *corev1.Pod) bool {
+			return utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels)
+		}) {
+			policies = append(policies, key)
+		}
+	}
+
+	return policies, nil
+}
+
+// validate vets the extra rules, and checks them with nft when a checker is set
+func (e *ExtraRulesReconciler) validate(ctx context.Context, extraRules *nftables.ExtraRules) error {
+	if err := extraRules.Validate(); err != nil {
+		return err
+	}
+
+	if e.Checker == nil {
+		return nil
+	}
+
+	for _, rule := range slices.Concat(extraRules.Ingress, extraRules.Egress) {
+		if err := nftables.CheckCustomRule(ctx, e.Checker, rule, false); err != nil {
+			return fmt.Errorf("invalid extra rule %q: %w", rule, err)
+		}
+	}
+
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (e *ExtraRulesReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("extrarules").
+		For(&v1alpha1.ExtraRules{}).
+		Complete(e)
+}
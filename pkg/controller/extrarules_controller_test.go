@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/apis/v1alpha1"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// fakeExtraRulesSetter records the extra rules of each object
+type fakeExtraRulesSetter struct {
+	extraRules map[types.NamespacedName]*nftables.ExtraRules
+}
+
+func (f *fakeExtraRulesSetter) SetExtraRules(key types.NamespacedName, rules *nftables.ExtraRules) {
+	if rules == nil {
+		delete(f.extraRules, key)
+		return
+	}
+
+	f.extraRules[key] = rules
+}
+
+var _ = Describe("ExtraRulesReconciler", func() {
+	var (
+		ctx        context.Context
+		k8sClient  client.Client
+		setter     *fakeExtraRulesSetter
+		enqueued   [][]types.NamespacedName
+		reconciler *ExtraRulesReconciler
+		key        types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(v1alpha1.AddToScheme(scheme)).To(Succeed())
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		k8sClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cnf", Labels: map[string]string{"app": "cnf"}}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", Labels: map[string]string{"app": "web"}}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "cnf", Labels: map[string]string{"app": "cnf"}}},
+		).Build()
+
+		// A policy of each pod, and a policy of another namespace selecting the pods of the same labels
+		ds := &datastore.Datastore{Policies: make(map[types.NamespacedName]*datastore.Policy)}
+		for _, policy := range []*datastore.Policy{
+			{Namespace: "default", Name: "cnf-policy", Spec: datastore.PolicySpec{PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "cnf"}}}},
+			{Namespace: "default", Name: "web-policy", Spec: datastore.PolicySpec{PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}}},
+			{Namespace: "other", Name: "cnf-policy", Spec: datastore.PolicySpec{PodSelector: metav1.LabelSelector{}}},
+		} {
+			key := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+			ds.IndexPolicy(key, nil, &policy.Spec)
+			ds.CreatePolicy(policy)
+		}
+
+		setter = &fakeExtraRulesSetter{extraRules: make(map[types.NamespacedName]*nftables.ExtraRules)}
+		enqueued = nil
+		key = types.NamespacedName{Namespace: "default", Name: "monitoring"}
+
+		reconciler = &ExtraRulesReconciler{
+			Client: k8sClient,
+			NFT:    setter,
+			DS:     ds,
+			Enqueue: func(_ context.Context, policies []types.NamespacedName) error {
+				enqueued = append(enqueued, policies)
+				return nil
+			},
+		}
+	})
+
+	It("should set the rules of the object and remove them when it is deleted", func() {
+		object := &v1alpha1.ExtraRules{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+			Spec: v1alpha1.ExtraRulesSpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "cnf"}},
+				Interfaces:  []string{"net1"},
+				Ingress:     []string{" tcp dport 9100 accept ", ""},
+			},
+		}
+		Expect(k8sClient.Create(ctx, object)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.extraRules).To(HaveKeyWithValue(key, &nftables.ExtraRules{
+			Namespace:   key.Namespace,
+			Name:        key.Name,
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "cnf"}},
+			Interfaces:  []string{"net1"},
+			Ingress:     []string{"tcp dport 9100 accept"},
+		}))
+		Expect(enqueued).To(Equal([][]types.NamespacedName{{{Namespace: "default", Name: "cnf-policy"}}}))
+
+		// Unchanged rules do not enqueue the policies
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enqueued).To(HaveLen(1))
+
+		Expect(k8sClient.Delete(ctx, object)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.extraRules).To(BeEmpty())
+		Expect(enqueued).To(HaveLen(2))
+		Expect(enqueued[1]).To(Equal([]types.NamespacedName{{Namespace: "default", Name: "cnf-policy"}}))
+	})
+
+	It("should enqueue the policies of the pods selected by the previous and the new rules", func() {
+		object := &v1alpha1.ExtraRules{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+			Spec: v1alpha1.ExtraRulesSpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "cnf"}},
+				Ingress:     []string{"tcp dport 9100 accept"},
+			},
+		}
+		Expect(k8sClient.Create(ctx, object)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+
+		object.Spec.PodSelector = metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+		Expect(k8sClient.Update(ctx, object)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enqueued).To(HaveLen(2))
+		Expect(enqueued[1]).To(ConsistOf(
+			types.NamespacedName{Namespace: "default", Name: "cnf-policy"},
+			types.NamespacedName{Namespace: "default", Name: "web-policy"},
+		))
+
+		// No pod is selected, no policy is enqueued
+		object.Spec.PodSelector = metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}
+		Expect(k8sClient.Update(ctx, object)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enqueued[2]).To(ConsistOf(types.NamespacedName{Namespace: "default", Name: "web-policy"}))
+
+		object.Spec.Ingress = []string{"tcp dport 9101 accept"}
+		Expect(k8sClient.Update(ctx, object)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enqueued[3]).To(BeEmpty())
+	})
+
+	It("should keep the current rules when the object is invalid", func() {
+		object := &v1alpha1.ExtraRules{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+			Spec:       v1alpha1.ExtraRulesSpec{Egress: []string{"udp dport 514 accept"}},
+		}
+		Expect(k8sClient.Create(ctx, object)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enqueued).To(HaveLen(1))
+
+		object.Spec.Egress = []string{"udp dport 514 jump input"}
+		Expect(k8sClient.Update(ctx, object)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(setter.extraRules[key].Egress).To(Equal([]string{"udp dport 514 accept"}))
+		Expect(enqueued).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// GarbageCollector periodically collects the state of the pods and the policies that no longer exist, which a missed
+// event would otherwise leave in memory forever on long-lived nodes with heavy churn
+type GarbageCollector struct {
+	Reconciler *MultiNetworkReconciler
+	// NFT is the enforcer whose per-pod state is collected, it can be nil
+	NFT      *nftables.NFTables
+	Hostname string
+	Interval time.Duration
+	// Mirroring keeps the policies mirrored from the NetworkPolicies
+	Mirroring bool
+}
+
+// Start runs the garbage collection until the context is done
+func (g *GarbageCollector) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("gc")
+
+	ticker := time.NewTicker(g.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := g.collect(ctx); err != nil {
+			logger.Error(err, "Failed to collect garbage")
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every node collects its own state
+func (g *GarbageCollector) NeedLeaderElection() bool {
+	return false
+}
+
+// collect collects the state of the deleted policies and pods. The deleted policies are reconciled, which cleans up
+// their rules along with their state, so that they are never cleaned up concurrently with a reconciliation.
+func (g *GarbageCollector) collect(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("gc")
+
+	if g.Reconciler.resync == nil {
+		return fmt.Errorf("controller is not set up")
+	}
+
+	for _, policy := range g.Reconciler.DS.ListPolicies() {
+		exists, err := g.Reconciler.policyExists(ctx, policy, g.Mirroring)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		logger.Info("Collecting deleted policy", "namespace", policy.Namespace, "name", policy.Name)
+		object := &multiv1beta1.MultiNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: policy.Namespace, Name: policy.Name}}
+		select {
+		case g.Reconciler.resync <- event.GenericEvent{Object: object}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		metrics.GarbageCollected.WithLabelValues("policy").Inc()
+	}
+
+	pods := &corev1.PodList{}
+	if err := g.Reconciler.Client.List(ctx, pods, client.MatchingFields{nftables.PodHostnameIndex: g.Hostname}); err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	uids := make(map[types.NamespacedName]types.UID, len(pods.Items))
+	for _, pod := range pods.Items {
+		uids[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = pod.UID
+	}
+
+	// The pods recreated with the same name are collected too, their state is of the previous pod
+	collected := g.Reconciler.DS.CollectAppliedStates(func(pod types.NamespacedName, state datastore.AppliedState) bool {
+		uid, ok := uids[pod]
+		return ok && (state.PodUID == "" || state.PodUID == uid)
+	})
+	metrics.GarbageCollected.WithLabelValues("applied_state").Add(float64(collected))
+
+	forgotten := 0
+	if g.NFT != nil {
+		forgotten = g.NFT.CollectPods(func(pod types.NamespacedName) bool {
+			_, ok := uids[pod]
+			return ok
+		})
+		metrics.GarbageCollected.WithLabelValues("pod").Add(float64(forgotten))
+	}
+
+	logger.V(1).Info("Garbage collected", "appliedStates", collected, "pods", forgotten)
+
+	return nil
+}
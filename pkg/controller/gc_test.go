@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+var _ = Describe("GarbageCollector", func() {
+	It("should collect the state of the deleted policies and pods", func() {
+		ctx := context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(multiv1beta1.AddToScheme(scheme)).To(Succeed())
+		fakeClient := newIndexedFakeClientBuilder(scheme).WithObjects(
+			&multiv1beta1.MultiNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "kept", Namespace: "default"}},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "running", Namespace: "default", UID: "running-uid"},
+				Spec:       corev1.PodSpec{NodeName: "node1"},
+			},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "recreated", Namespace: "default", UID: "new-uid"},
+				Spec:       corev1.PodSpec{NodeName: "node1"},
+			},
+		).Build()
+
+		ds := &datastore.Datastore{Policies: map[types.NamespacedName]*datastore.Policy{}}
+		ds.CreatePolicy(&datastore.Policy{Name: "kept", Namespace: "default"})
+		ds.CreatePolicy(&datastore.Policy{Name: "deleted", Namespace: "default"})
+
+		kept := types.NamespacedName{Namespace: "default", Name: "kept"}
+		running := types.NamespacedName{Namespace: "default", Name: "running"}
+		ds.SetAppliedState(kept, running, datastore.AppliedState{PodUID: "running-uid"})
+		ds.SetAppliedState(kept, types.NamespacedName{Namespace: "default", Name: "recreated"}, datastore.AppliedState{PodUID: "old-uid"})
+		ds.SetAppliedState(kept, types.NamespacedName{Namespace: "default", Name: "gone"}, datastore.AppliedState{PodUID: "gone-uid"})
+
+		resync := make(chan event.GenericEvent, 10)
+		gc := &GarbageCollector{
+			Reconciler: &MultiNetworkReconciler{Client: fakeClient, DS: ds, resync: resync},
+			Hostname:   "node1",
+			Interval:   time.Minute,
+		}
+		Expect(gc.collect(ctx)).To(Succeed())
+
+		// The deleted policy is reconciled to clean up its rules
+		Expect(resync).To(HaveLen(1))
+		Expect((<-resync).Object.GetName()).To(Equal("deleted"))
+
+		Expect(ds.Applied).To(Equal(map[types.NamespacedName]map[types.NamespacedName]datastore.AppliedState{
+			kept: {running: {PodUID: "running-uid"}},
+		}))
+	})
+})
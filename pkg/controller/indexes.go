@@ -12,53 +12,63 @@ import (
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
 )
 
-func setupIndexes(mgr ctrl.Manager) error {
-	// Pod Hostname index
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, nftables.PodHostnameIndex, func(obj client.Object) []string {
-		pod := obj.(*corev1.Pod)
+// podIndexes are the field indexes on pods used to find the pods to enforce
+var podIndexes = map[string]client.IndexerFunc{
+	nftables.PodHostnameIndex:             podHostnameIndex,
+	nftables.PodStatusIndex:               podStatusIndex,
+	nftables.PodHostNetworkIndex:          podHostNetworkIndex,
+	nftables.PodHasNetworkAnnotationIndex: podHasNetworkAnnotationIndex,
+}
 
-		if pod.Spec.NodeName == "" {
-			return nil
+func setupIndexes(mgr ctrl.Manager) error {
+	for field, extractValue := range podIndexes {
+		if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, field, extractValue); err != nil {
+			return err
 		}
-
-		return []string{pod.Spec.NodeName}
-	}); err != nil {
-		return err
 	}
 
-	// Pod Status Phase index
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, nftables.PodStatusIndex, func(obj client.Object) []string {
-		pod := obj.(*corev1.Pod)
-		return []string{string(pod.Status.Phase)}
-	}); err != nil {
-		return err
-	}
+	return nil
+}
+
+// podHostnameIndex indexes pods by the node they are scheduled on
+func podHostnameIndex(obj client.Object) []string {
+	pod := obj.(*corev1.Pod)
 
-	// Pod Host Network index
-	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, nftables.PodHostNetworkIndex, func(obj client.Object) []string {
-		pod := obj.(*corev1.Pod)
-		return []string{strconv.FormatBool(pod.Spec.HostNetwork)}
-	}); err != nil {
-		return err
+	if pod.Spec.NodeName == "" {
+		return nil
 	}
 
-	// Pod Has Network Annotation index
-	return mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, nftables.PodHasNetworkAnnotationIndex, func(obj client.Object) []string {
-		pod := obj.(*corev1.Pod)
+	return []string{pod.Spec.NodeName}
+}
 
-		if pod.GetAnnotations() == nil {
-			return []string{"false"}
-		}
+// podStatusIndex indexes pods by status phase
+func podStatusIndex(obj client.Object) []string {
+	pod := obj.(*corev1.Pod)
+	return []string{string(pod.Status.Phase)}
+}
 
-		networks, err := netdefutils.ParsePodNetworkAnnotation(pod)
-		if err != nil {
-			return []string{"false"}
-		}
+// podHostNetworkIndex indexes pods by host network
+func podHostNetworkIndex(obj client.Object) []string {
+	pod := obj.(*corev1.Pod)
+	return []string{strconv.FormatBool(pod.Spec.HostNetwork)}
+}
 
-		if len(networks) == 0 {
-			return []string{"false"}
-		}
+// podHasNetworkAnnotationIndex indexes pods by the presence of a valid network annotation
+func podHasNetworkAnnotationIndex(obj client.Object) []string {
+	pod := obj.(*corev1.Pod)
+
+	if pod.GetAnnotations() == nil {
+		return []string{"false"}
+	}
+
+	networks, err := netdefutils.ParsePodNetworkAnnotation(pod)
+	if err != nil {
+		return []string{"false"}
+	}
+
+	if len(networks) == 0 {
+		return []string{"false"}
+	}
 
-		return []string{"true"}
-	})
+	return []string{"true"}
 }
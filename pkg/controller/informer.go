@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientfeatures "k8s.io/client-go/features"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+// NewPagedInformer returns a constructor of the informers of the cache listing the pods and the namespaces in pages of
+// pageSize objects, or nil to list them at once when pageSize is 0. The initial list of the reflectors is served from
+// the watch cache of the API server at resource version 0, which ignores the limit and returns all the objects in a
+// single response, so it is listed from the latest resource version instead to bound the memory spike at startup.
+func NewPagedInformer(pageSize int64) func(toolscache.ListerWatcher, runtime.Object, time.Duration, toolscache.Indexers) toolscache.SharedIndexInformer {
+	if pageSize <= 0 {
+		return nil
+	}
+
+	return func(lw toolscache.ListerWatcher, obj runtime.Object, resync time.Duration, indexers toolscache.Indexers) toolscache.SharedIndexInformer {
+		switch obj.(type) {
+		case *corev1.Pod, *corev1.Namespace:
+			lw = pagedListerWatcher(toolscache.ToListerWatcherWithContext(lw), pageSize)
+		}
+
+		return toolscache.NewSharedIndexInformer(lw, obj, resync, indexers)
+	}
+}
+
+// pagedListerWatcher returns a lister watcher listing in pages of pageSize objects
+func pagedListerWatcher(lw toolscache.ListerWatcherWithContext, pageSize int64) *toolscache.ListWatch {
+	return &toolscache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+			if opts.ResourceVersion == "0" {
+				opts.ResourceVersion = ""
+			}
+			// The continuations of the pages keep the limit of the first page
+			if opts.ResourceVersion == "" {
+				opts.Limit = pageSize
+			}
+			return lw.ListWithContext(ctx, opts)
+		},
+		WatchFuncWithContext: lw.WatchWithContext,
+	}
+}
+
+// watchListGates enables the streaming of the initial lists of the reflectors on top of the feature gates of client-go
+type watchListGates struct {
+	clientfeatures.Gates
+}
+
+// Enabled checks if a feature of client-go is enabled
+func (g watchListGates) Enabled(key clientfeatures.Feature) bool {
+	if key == clientfeatures.WatchListClient {
+		return true
+	}
+
+	return g.Gates.Enabled(key)
+}
+
+// EnableWatchList makes the reflectors stream their initial lists with a watch sending the initial events, which are
+// decoded one object at a time instead of in a single list response. The reflectors fall back to listing when the API
+// server does not support it. It must be called before the cache is created.
+func EnableWatchList() {
+	clientfeatures.ReplaceFeatureGates(watchListGates{Gates: clientfeatures.FeatureGates()})
+}
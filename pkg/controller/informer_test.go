@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	clientfeatures "k8s.io/client-go/features"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+var _ = Describe("NewPagedInformer", func() {
+	It("should not override the informers without a page size", func() {
+		Expect(NewPagedInformer(0)).To(BeNil())
+	})
+
+	It("should list in pages instead of from the watch cache", func() {
+		var listed []metav1.ListOptions
+		lw := pagedListerWatcher(&toolscache.ListWatch{
+			ListWithContextFunc: func(_ context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				listed = append(listed, opts)
+				return &corev1.PodList{}, nil
+			},
+			WatchFuncWithContext: func(context.Context, metav1.ListOptions) (watch.Interface, error) {
+				return watch.NewEmptyWatch(), nil
+			},
+		}, 100)
+
+		_, err := lw.ListWithContext(context.Background(), metav1.ListOptions{ResourceVersion: "0", Limit: 500})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = lw.ListWithContext(context.Background(), metav1.ListOptions{Continue: "token", Limit: 500})
+		Expect(err).NotTo(HaveOccurred())
+		// A relist from the last synced resource version is left to the reflector
+		_, err = lw.ListWithContext(context.Background(), metav1.ListOptions{ResourceVersion: "42"})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(listed).To(Equal([]metav1.ListOptions{
+			{Limit: 100},
+			{Continue: "token", Limit: 100},
+			{ResourceVersion: "42"},
+		}))
+	})
+
+	It("should enable the streaming of the initial lists", func() {
+		gates := watchListGates{Gates: clientfeatures.FeatureGates()}
+		Expect(gates.Enabled(clientfeatures.WatchListClient)).To(BeTrue())
+		Expect(gates.Enabled(clientfeatures.InOrderInformers)).To(Equal(clientfeatures.FeatureGates().Enabled(clientfeatures.InOrderInformers)))
+	})
+})
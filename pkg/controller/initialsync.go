@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// initialSyncPriorityDelay delays the policies allowing traffic in the initial sync, so that the deny-all policies are
+// dequeued before them and the pods are isolated first
+const initialSyncPriorityDelay = time.Second
+
+// initialSyncHandler returns a handler enqueuing the policies like handler.EnqueueRequestForObject, except for the
+// policies of the initial list on startup. They are delayed by a random jitter up to startupJitter, the same for all
+// of them, so that the nodes of a rolling upgrade do not all sync at once, and the deny-all policies are enqueued first.
+// The number of policies synced concurrently is bounded by the maximum concurrent reconciles.
+func initialSyncHandler(startupJitter time.Duration) handler.EventHandler {
+	var jitter time.Duration
+	if startupJitter > 0 {
+		jitter = rand.N(startupJitter)
+	}
+
+	enqueue := &handler.EnqueueRequestForObject{}
+
+	return handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.CreateEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			if !e.IsInInitialList || e.Object == nil {
+				enqueue.Create(ctx, e, q)
+				return
+			}
+
+			q.AddAfter(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(e.Object)}, initialSyncDelay(e.Object, jitter))
+		},
+		UpdateFunc:  enqueue.Update,
+		DeleteFunc:  enqueue.Delete,
+		GenericFunc: enqueue.Generic,
+	}
+}
+
+// initialSyncDelay returns the delay of a policy of the initial list
+func initialSyncDelay(obj client.Object, jitter time.Duration) time.Duration {
+	policy, ok := obj.(*multiv1beta1.MultiNetworkPolicy)
+	if ok && deniesAll(datastore.PolicySpecFromV1beta1(&policy.Spec)) {
+		return jitter
+	}
+
+	return jitter + initialSyncPriorityDelay
+}
+
+// deniesAll checks if a policy denies all the traffic of a direction it applies to
+func deniesAll(spec datastore.PolicySpec) bool {
+	// If no policy types are specified, ingress is always set, and egress when there are egress rules
+	ingress := len(spec.PolicyTypes) == 0 || slices.Contains(spec.PolicyTypes, datastore.PolicyTypeIngress)
+	egress := slices.Contains(spec.PolicyTypes, datastore.PolicyTypeEgress)
+
+	return (ingress && len(spec.Ingress) == 0) || (egress && len(spec.Egress) == 0)
+}
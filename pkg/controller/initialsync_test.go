@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("initialSyncHandler", func() {
+	var queue workqueue.TypedRateLimitingInterface[reconcile.Request]
+
+	newPolicy := func(name string, spec multiv1beta1.MultiNetworkPolicySpec) *multiv1beta1.MultiNetworkPolicy {
+		return &multiv1beta1.MultiNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}, Spec: spec}
+	}
+
+	allowAll := multiv1beta1.MultiNetworkPolicySpec{Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{{}}}
+
+	BeforeEach(func() {
+		queue = workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+		DeferCleanup(queue.ShutDown)
+	})
+
+	It("should enqueue the deny-all policies of the initial list first", func() {
+		handler := initialSyncHandler(0)
+		ctx := context.Background()
+
+		handler.Create(ctx, event.CreateEvent{Object: newPolicy("allow", allowAll), IsInInitialList: true}, queue)
+		handler.Create(ctx, event.CreateEvent{Object: newPolicy("deny", multiv1beta1.MultiNetworkPolicySpec{}), IsInInitialList: true}, queue)
+		Expect(queue.Len()).To(Equal(1))
+
+		Eventually(queue.Len).WithTimeout(3 * initialSyncPriorityDelay).Should(Equal(2))
+		first, _ := queue.Get()
+		Expect(first.Name).To(Equal("deny"))
+		second, _ := queue.Get()
+		Expect(second.Name).To(Equal("allow"))
+	})
+
+	It("should enqueue the policies created after the initial list immediately", func() {
+		handler := initialSyncHandler(time.Hour)
+
+		handler.Create(context.Background(), event.CreateEvent{Object: newPolicy("allow", allowAll)}, queue)
+		Expect(queue.Len()).To(Equal(1))
+	})
+
+	It("should detect the policies denying all the traffic of a direction", func() {
+		Expect(initialSyncDelay(newPolicy("deny", multiv1beta1.MultiNetworkPolicySpec{}), 0)).To(BeZero())
+		Expect(initialSyncDelay(newPolicy("allow", allowAll), 0)).To(Equal(initialSyncPriorityDelay))
+
+		egressDeny := allowAll
+		egressDeny.PolicyTypes = []multiv1beta1.MultiPolicyType{multiv1beta1.PolicyTypeIngress, multiv1beta1.PolicyTypeEgress}
+		Expect(initialSyncDelay(newPolicy("egress-deny", egressDeny), 0)).To(BeZero())
+	})
+})
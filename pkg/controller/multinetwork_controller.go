@@ -3,28 +3,40 @@ package controller
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	"github.com/go-logr/logr"
 	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
 	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
-	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
 )
 
 // MultiNetworkReconciler reconciles a MultiNetworkPolicy object
@@ -34,10 +46,89 @@ type MultiNetworkReconciler struct {
 	DS           *datastore.Datastore
 	NFT          nftables.SyncInterface
 	ValidPlugins []string
+	// Selectors is the selector cache of NFT, invalidated by the pod and namespace events, it can be nil
+	Selectors *nftables.SelectorCache
+	// Reservations are the whereabouts reservations of NFT, recorded from the IP pools when it is not nil
+	Reservations *nftables.Reservations
+	// Sandboxes resolves the network namespace paths of the pods of the node when they start running, it can be nil
+	Sandboxes SandboxPrefetcher
+
+	// Recorder records the events related to the validation of the policies, it can be nil
+	Recorder record.EventRecorder
+
+	// MaxConcurrentReconciles is the maximum number of policies reconciled concurrently, defaults to 1
+	MaxConcurrentReconciles int
+	// StartupJitter is the maximum random delay of the initial sync of the policies, 0 syncs them immediately
+	StartupJitter time.Duration
+	// PolicyEventQPS is the maximum rate of the pod, namespace and network events enqueueing each policy, above
+	// PolicyEventBurst, 0 disables the limit
+	PolicyEventQPS   float64
+	PolicyEventBurst int
+	// PrioritizeRevocations reconciles the policies enqueued by the events removing access ahead of the other policies
+	PrioritizeRevocations bool
+
+	// mu guards ValidPlugins which can be replaced on configuration reloads
+	mu sync.RWMutex
+	// resync receives the policies to reconcile again after a configuration change
+	resync chan event.GenericEvent
+	// podNetworks indexes the networks of the pods to filter out the events of the pods without enforceable
+	// interfaces, it is shared with the NetworkPolicy controller
+	podNetworks *podNetworkIndex
+	// staleness tracks the policies enqueued and not reconciled yet, it is shared with the NetworkPolicy controller
+	staleness *stalenessTracker
+}
+
+// SetValidPlugins replaces the valid plugins, they are used on the next reconciliation of each policy
+func (m *MultiNetworkReconciler) SetValidPlugins(plugins []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ValidPlugins = plugins
+}
+
+// getValidPlugins returns the current valid plugins
+func (m *MultiNetworkReconciler) getValidPlugins() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.ValidPlugins
+}
+
+// Resync enqueues all the MultiNetworkPolicies to apply a configuration change
+func (m *MultiNetworkReconciler) Resync(ctx context.Context) error {
+	if m.resync == nil {
+		return fmt.Errorf("controller is not set up")
+	}
+
+	policies := &multiv1beta1.MultiNetworkPolicyList{}
+	if err := m.Client.List(ctx, policies); err != nil {
+		return fmt.Errorf("failed to list policies: %w", err)
+	}
+
+	for i := range policies.Items {
+		select {
+		case m.resync <- event.GenericEvent{Object: &policies.Items[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
 }
 
 // Reconcile handles the reconciliation of MultiNetworkPolicy resources
 func (m *MultiNetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	start := time.Now()
+	result, err := m.reconcile(ctx, req)
+	if err == nil && m.staleness != nil {
+		m.staleness.done("multinetworkpolicy", req, start)
+	}
+
+	return result, err
+}
+
+// reconcile syncs a MultiNetworkPolicy to the pods of the node, or cleans it up when it is gone
+func (m *MultiNetworkReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
 	logger.Info("Starting reconciliation of MultiNetworkPolicy")
@@ -50,6 +141,7 @@ func (m *MultiNetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request
 			return ctrl.Result{}, err
 		}
 
+		m.DS.UnindexPolicy(req.NamespacedName)
 		err = m.cleanUpPolicy(ctx, req.Name, req.Namespace, logger)
 		if err != nil {
 			logger.Error(err, "Failed to clean up policy")
@@ -66,9 +158,12 @@ func (m *MultiNetworkReconciler) Reconcile(ctx context.Context, req ctrl.Request
 
 // processPolicy validates and processes the MultiNetworkPolicy
 func (m *MultiNetworkReconciler) processPolicy(ctx context.Context, instance *multiv1beta1.MultiNetworkPolicy, logger logr.Logger) (ctrl.Result, error) {
+	key := types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}
+
 	policyForAnnotation, err := getPolicyForAnnotation(instance)
 	if err != nil {
 		logger.Info("Failed to validate policy-for annotation", "error", err.Error())
+		m.DS.UnindexPolicy(key)
 		err = m.cleanUpPolicy(ctx, instance.Name, instance.Namespace, logger)
 		if err != nil {
 			logger.Error(err, "Failed to clean up policy")
@@ -81,6 +176,7 @@ func (m *MultiNetworkReconciler) processPolicy(ctx context.Context, instance *mu
 	networks, err := getNetworksInPolicyForAnnotation(policyForAnnotation, instance.Namespace)
 	if err != nil {
 		logger.Info("Failed to get networks from policy-for annotation", "error", err.Error())
+		m.DS.UnindexPolicy(key)
 		err = m.cleanUpPolicy(ctx, instance.Name, instance.Namespace, logger)
 		if err != nil {
 			logger.Error(err, "Failed to clean up policy")
@@ -91,10 +187,53 @@ func (m *MultiNetworkReconciler) processPolicy(ctx context.Context, instance *mu
 
 	logger.Info("Networks found in policy-for annotation", "networks", networks)
 
+	// The policy is indexed before it is applied, so that the events of its pods and networks are not missed meanwhile,
+	// and with all its networks, so that it is reconciled when a network becomes allowed
+	spec := datastore.PolicySpecFromV1beta1(&instance.Spec)
+	m.DS.IndexPolicy(key, networks, &spec)
+
+	// The unknown presets are ignored rather than leaving the pods unprotected
+	var portPresets []string
+	if value, ok := instance.GetAnnotations()[datastore.PortPresetsAnnotation]; ok {
+		portPresets, err = datastore.ParsePortPresets(value)
+		if err != nil {
+			logger.Info("Invalid port-presets annotation, ignoring the unknown presets", "error", err.Error())
+		}
+		datastore.ExpandPortPresets(&spec, portPresets)
+	}
+
+	// The invalid rules are not rendered, they are reported once per generation of the policy
+	previous := m.DS.GetPolicy(key)
+	newGeneration := previous == nil || previous.Generation != instance.Generation || instance.Generation == 0
+	var invalidRules []*nftables.RuleError
+	if newGeneration {
+		invalidRules = nftables.ValidatePolicySpec(&spec)
+		for _, ruleErr := range invalidRules {
+			logger.Info("Invalid policy rule, it is not applied", "error", ruleErr.Error())
+		}
+	}
+
+	// The network attachment definitions are fetched once, the networks and their settings are read from them
+	policyNetworks, err := m.getPolicyNetworks(ctx, networks, logger)
+	if err != nil {
+		logger.Error(err, "Failed to get network attachment definitions, requeuing")
+		return ctrl.Result{}, err
+	}
+
+	// The policies are not applied to the networks whose traffic bypasses the kernel, they are reported once per
+	// generation of the policy rather than silently left unprotected
+	if newGeneration {
+		for _, network := range getUserspaceNetworks(policyNetworks) {
+			logger.Info("Traffic of the network bypasses the kernel, the policy is not applied to it", "network", network)
+			m.recordEvent(instance, corev1.EventTypeWarning, "NetworkNotEnforceable", "Policy is not applied to network %s, its traffic bypasses the kernel", network)
+		}
+	}
+
 	// Verify that the networks are allowed by the valid plugins
-	allowedNetworks, err := m.getAllowedNetworks(ctx, networks, m.ValidPlugins, logger)
+	validPlugins := m.getValidPlugins()
+	allowedNetworks, err := getAllowedNetworks(policyNetworks, validPlugins, logger)
 	if err != nil {
-		logger.Info("Failed to get allowed networks", "valid plugins", m.ValidPlugins, "error", err.Error())
+		logger.Info("Failed to get allowed networks", "valid plugins", validPlugins, "error", err.Error())
 		err = m.cleanUpPolicy(ctx, instance.Name, instance.Namespace, logger)
 		if err != nil {
 			logger.Error(err, "Failed to clean up policy")
@@ -103,13 +242,79 @@ func (m *MultiNetworkReconciler) processPolicy(ctx context.Context, instance *mu
 		return ctrl.Result{}, nil
 	}
 
-	logger.Info("Allowed networks", "allowedNetworks", allowedNetworks)
+	logger.Info("Allowed networks", "allowedNetworks", networkNames(allowedNetworks))
+
+	// The policies cannot prevent the pods of the VFs without spoof checking from spoofing their addresses, the networks
+	// are reported once per generation of the policy
+	var spoofableNetworks []string
+	if newGeneration {
+		spoofableNetworks = getSpoofableNetworks(allowedNetworks)
+		for _, network := range spoofableNetworks {
+			logger.Info("Spoof checking is disabled on the VFs of the network", "network", network)
+		}
+	}
 
 	policy := &datastore.Policy{
-		Name:      instance.Name,
-		Namespace: instance.Namespace,
-		Spec:      instance.Spec,
-		Networks:  allowedNetworks,
+		Name:        instance.Name,
+		Namespace:   instance.Namespace,
+		Spec:        spec,
+		Networks:    networkNames(allowedNetworks),
+		PortPresets: portPresets,
+		Generation:  instance.Generation,
+		UID:         instance.UID,
+	}
+	setNetworkSettings(policy, allowedNetworks, logger)
+	setPolicyAnnotations(policy, instance, logger)
+
+	// The invalid rules and the spoofable networks are only reported by the nodes enforcing the policy on them, rather
+	// than by every node
+	if len(invalidRules) > 0 || len(spoofableNetworks) > 0 {
+		enforcedNetworks, err := m.getEnforcedNetworks(ctx, policy)
+		if err != nil {
+			logger.Error(err, "Failed to get enforced networks, requeuing")
+			return ctrl.Result{}, err
+		}
+
+		if len(enforcedNetworks) > 0 {
+			for _, ruleErr := range invalidRules {
+				m.recordEvent(instance, corev1.EventTypeWarning, "InvalidPolicyRule", "Rule not applied, %v", ruleErr)
+			}
+		}
+
+		for _, network := range spoofableNetworks {
+			if slices.Contains(enforcedNetworks, network) {
+				m.recordEvent(instance, corev1.EventTypeWarning, "SpoofCheckDisabled", "Spoof checking is disabled or the VFs are trusted on network %s, the pods can spoof their addresses", network)
+			}
+		}
+	}
+
+	// The peer addresses on the networks of the policy are only allowed on the interfaces of their network, the peer
+	// addresses on the peer networks on all of them. A peer network overlapping a network of the policy lets in the
+	// pods of that network using the same addresses, it is reported once per generation of the policy.
+	if newGeneration && len(policy.PeerNetworks) > 0 {
+		overlaps, err := m.getOverlappingPeerNetworks(ctx, policy.Networks, policy.PeerNetworks)
+		if err != nil {
+			logger.Error(err, "Failed to get overlapping peer networks, requeuing")
+			return ctrl.Result{}, err
+		}
+
+		for _, overlap := range overlaps {
+			logger.Info("Peer network overlaps a network of the policy", "network", overlap.Network, "peerNetwork", overlap.PeerNetwork)
+			m.recordEvent(instance, corev1.EventTypeWarning, "OverlappingPeerNetwork",
+				"Peer network %s overlaps network %s, its peer addresses also allow the pods of network %s using them", overlap.PeerNetwork, overlap.Network, overlap.Network)
+		}
+	}
+
+	// An invalid dry-run annotation enforces the policy rather than leaving the pods unprotected
+	if value, ok := instance.GetAnnotations()[datastore.DryRunAnnotation]; ok {
+		dryRun, err := datastore.ParseDryRun(value)
+		if err != nil {
+			logger.Info("Invalid dry-run annotation, the policy is enforced", "error", err.Error())
+		}
+
+		if dryRun {
+			return m.dryRunPolicy(ctx, instance, policy, logger)
+		}
 	}
 
 	err = m.NFT.SyncPolicy(ctx, policy, nftables.SyncOperationCreate, logger)
@@ -124,6 +329,80 @@ func (m *MultiNetworkReconciler) processPolicy(ctx context.Context, instance *mu
 	return ctrl.Result{}, nil
 }
 
+// NetworkEnforcer reports the networks of a policy the node enforces it on, the NFT of the reconciler implements it so
+// that the warnings about a policy are only reported by the nodes enforcing it
+type NetworkEnforcer interface {
+	EnforcedNetworks(ctx context.Context, policy *datastore.Policy) ([]string, error)
+}
+
+var _ NetworkEnforcer = &nftables.NFTables{}
+
+// getEnforcedNetworks returns the networks of a policy the node enforces it on, all of them when NFT cannot tell
+func (m *MultiNetworkReconciler) getEnforcedNetworks(ctx context.Context, policy *datastore.Policy) ([]string, error) {
+	enforcer, ok := m.NFT.(NetworkEnforcer)
+	if !ok {
+		return policy.Networks, nil
+	}
+
+	return enforcer.EnforcedNetworks(ctx, policy)
+}
+
+// PolicyDiffer computes the changes of a policy on the pods of the node without applying them, the NFT of the
+// reconciler implements it to report the changes of the dry-run policies
+type PolicyDiffer interface {
+	DiffPolicy(ctx context.Context, policy *datastore.Policy, previous *datastore.Policy, logger logr.Logger) (*nftables.PolicyDiff, error)
+}
+
+var _ PolicyDiffer = &nftables.NFTables{}
+
+// dryRunPolicy reports the changes of a dry-run policy on the pods of the node in an event, without applying them.
+// The version of the policy enforced before, if any, keeps being enforced.
+func (m *MultiNetworkReconciler) dryRunPolicy(ctx context.Context, instance *multiv1beta1.MultiNetworkPolicy, policy *datastore.Policy, logger logr.Logger) (ctrl.Result, error) {
+	key := types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}
+	previous := m.DS.GetPolicy(key)
+
+	differ, ok := m.NFT.(PolicyDiffer)
+	if !ok {
+		logger.Info("Dry run is not supported by the enforcement, the policy is not applied")
+	} else {
+		diff, err := differ.DiffPolicy(ctx, policy, previous, logger)
+		if err != nil {
+			logger.Error(err, "Failed to compute the changes of the dry-run policy, requeuing")
+			return ctrl.Result{}, err
+		}
+
+		logger.Info("Dry run of policy", "pods", diff.Pods, "rulesAdded", diff.RulesAdded, "rulesRemoved", diff.RulesRemoved, "rejected", diff.Rejected)
+		m.recordEvent(instance, corev1.EventTypeNormal, "DryRun", "Policy not applied on node %s: %s", diff.Node, diff)
+	}
+
+	if previous == nil {
+		return ctrl.Result{}, nil
+	}
+
+	// The new pods get the enforced version
+	if err := m.NFT.SyncPolicy(ctx, previous, nftables.SyncOperationCreate, logger); err != nil {
+		logger.Error(err, "Failed to sync the enforced version of the dry-run policy, requeuing")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// recordEvent records an event on a policy if a recorder is configured, the events of a mirrored policy are recorded on
+// its NetworkPolicy
+func (m *MultiNetworkReconciler) recordEvent(instance *multiv1beta1.MultiNetworkPolicy, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if m.Recorder == nil {
+		return
+	}
+
+	var object runtime.Object = instance
+	if name, mirrored := strings.CutPrefix(instance.Name, mirroredPolicyPrefix); mirrored {
+		object = &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: instance.Namespace}}
+	}
+
+	m.Recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
 // cleanUpPolicy cleans up a policy from the datastore
 func (m *MultiNetworkReconciler) cleanUpPolicy(ctx context.Context, name string, namespace string, logger logr.Logger) error {
 	policy := m.DS.GetPolicy(types.NamespacedName{Namespace: namespace, Name: name})
@@ -141,6 +420,82 @@ func (m *MultiNetworkReconciler) cleanUpPolicy(ctx context.Context, name string,
 	return nil
 }
 
+// Enqueue enqueues MultiNetworkPolicies of the datastore, e.g. to repair them ahead of the initial sync. The mirrored
+// NetworkPolicies are not enqueued, they are reconciled by their own controller.
+func (m *MultiNetworkReconciler) Enqueue(ctx context.Context, policies []types.NamespacedName) error {
+	if m.resync == nil {
+		return fmt.Errorf("controller is not set up")
+	}
+
+	for _, key := range policies {
+		if strings.HasPrefix(key.Name, mirroredPolicyPrefix) {
+			continue
+		}
+
+		policy := &multiv1beta1.MultiNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+		select {
+		case m.resync <- event.GenericEvent{Object: policy}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// CleanUpStalePolicies cleans up the policies of a datastore restored on startup that were deleted while the controller
+// was not running, no event would remove them otherwise. The policies that still exist are applied by the reconciliations.
+// The mirrored NetworkPolicies are stale when the mirroring is disabled.
+func (m *MultiNetworkReconciler) CleanUpStalePolicies(ctx context.Context, mirroring bool) error {
+	logger := log.FromContext(ctx)
+
+	var errs []error
+	for _, policy := range m.DS.ListPolicies() {
+		logger := logger.WithValues("namespace", policy.Namespace, "name", policy.Name)
+
+		exists, err := m.policyExists(ctx, policy, mirroring)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if exists {
+			continue
+		}
+
+		logger.Info("Cleaning up policy deleted while the controller was not running")
+		if err := m.cleanUpPolicy(ctx, policy.Name, policy.Namespace, logger); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up policy %s/%s: %w", policy.Namespace, policy.Name, err))
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// policyExists checks if the MultiNetworkPolicy or the mirrored NetworkPolicy of a policy of the datastore still exists.
+// The mirrored NetworkPolicies do not exist when the mirroring is disabled.
+func (m *MultiNetworkReconciler) policyExists(ctx context.Context, policy *datastore.Policy, mirroring bool) (bool, error) {
+	var object client.Object = &multiv1beta1.MultiNetworkPolicy{}
+	name := policy.Name
+	if mirroredName, ok := strings.CutPrefix(policy.Name, mirroredPolicyPrefix); ok {
+		if !mirroring {
+			return false, nil
+		}
+		object = &networkingv1.NetworkPolicy{}
+		name = mirroredName
+	}
+
+	err := m.Client.Get(ctx, types.NamespacedName{Namespace: policy.Namespace, Name: name}, object)
+	if err == nil {
+		return true, nil
+	}
+
+	if !errors.IsNotFound(err) {
+		return false, fmt.Errorf("failed to get policy %s/%s: %w", policy.Namespace, policy.Name, err)
+	}
+
+	return false, nil
+}
+
 // getPolicyForAnnotation gets the policy-for annotation from the MultiNetworkPolicy
 func getPolicyForAnnotation(instance *multiv1beta1.MultiNetworkPolicy) (string, error) {
 	annotations := instance.GetAnnotations()
@@ -162,10 +517,22 @@ func getPolicyForAnnotation(instance *multiv1beta1.MultiNetworkPolicy) (string,
 	return trimmedAnnotation, nil
 }
 
-// getNetworksInPolicyForAnnotation gets the networks from the policy-for annotation
+// getNetworksInPolicyForAnnotation gets the networks from the policy-for annotation.
+// The namespace and the name of a network can have wildcards, e.g. "*" or "prefix-*".
 func getNetworksInPolicyForAnnotation(policyForAnnotation string, namespace string) ([]string, error) {
-	// Split by comma and check for at least one valid network name
-	networkNames := strings.Split(policyForAnnotation, ",")
+	// Check for at least one valid network name
+	networks := parseNetworks(policyForAnnotation, namespace)
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("annotation %s contains no valid network names: %s", datastore.PolicyForAnnotation, policyForAnnotation)
+	}
+
+	return networks, nil
+}
+
+// parseNetworks parses the comma-separated networks of an annotation with the format of the policy-for annotation, as
+// <namespace>/<name>, the networks without namespace are in the namespace. The invalid networks are ignored.
+func parseNetworks(value string, namespace string) []string {
+	networkNames := strings.Split(value, ",")
 
 	networks := []string{}
 	for _, networkName := range networkNames {
@@ -195,19 +562,34 @@ func getNetworksInPolicyForAnnotation(policyForAnnotation string, namespace stri
 			continue
 		}
 
+		// Wildcards must be valid patterns
+		if _, err := path.Match(ns, ""); err != nil {
+			continue
+		}
+		if _, err := path.Match(name, ""); err != nil {
+			continue
+		}
+
 		networks = append(networks, fmt.Sprintf("%s/%s", ns, name))
 	}
 
-	if len(networks) == 0 {
-		return nil, fmt.Errorf("annotation %s contains no valid network names: %s", datastore.PolicyForAnnotation, policyForAnnotation)
-	}
+	return networks
+}
 
-	return networks, nil
+// policyNetwork is a network attachment definition matched by a network of the policy-for annotation
+type policyNetwork struct {
+	// name is the namespace/name of the network attachment definition
+	name string
+	// pattern is set when the network attachment definition is only matched by networks with wildcards
+	pattern      bool
+	netAttachDef *netdefv1.NetworkAttachmentDefinition
 }
 
-// getAllowedNetworks gets the allowed networks from the networks and the valid plugins
-func (m *MultiNetworkReconciler) getAllowedNetworks(ctx context.Context, networks []string, validPlugins []string, logger logr.Logger) ([]string, error) {
-	var allowedNetworks []string
+// getPolicyNetworks gets the network attachment definitions of the networks of the policy-for annotation, the networks
+// with wildcards expanded to the matching ones. Each is fetched once per reconcile, the networks of the policy and
+// their settings are read from them.
+func (m *MultiNetworkReconciler) getPolicyNetworks(ctx context.Context, networks []string, logger logr.Logger) ([]policyNetwork, error) {
+	var policyNetworks []policyNetwork
 	for _, network := range networks {
 		parts := strings.Split(network, "/")
 		if len(parts) != 2 {
@@ -216,29 +598,68 @@ func (m *MultiNetworkReconciler) getAllowedNetworks(ctx context.Context, network
 			continue
 		}
 
-		// Get Network-Attachment-Definition
-		var netAttachDef netdefv1.NetworkAttachmentDefinition
-		err := m.Client.Get(ctx, types.NamespacedName{Namespace: parts[0], Name: parts[1]}, &netAttachDef)
+		netAttachDefs, err := m.getNetworkAttachmentDefinitions(ctx, parts[0], parts[1])
 		if err != nil {
-			if errors.IsNotFound(err) {
-				// Ignore, not found
+			return nil, err
+		}
+
+		for i := range netAttachDefs {
+			name := fmt.Sprintf("%s/%s", netAttachDefs[i].Namespace, netAttachDefs[i].Name)
+			if j := slices.IndexFunc(policyNetworks, func(n policyNetwork) bool { return n.name == name }); j >= 0 {
+				policyNetworks[j].pattern = policyNetworks[j].pattern && isNetworkPattern(network)
 				continue
 			}
 
-			return nil, fmt.Errorf("failed to get network attachment definition: %w", err)
+			policyNetworks = append(policyNetworks, policyNetwork{name: name, pattern: isNetworkPattern(network), netAttachDef: &netAttachDefs[i]})
 		}
+	}
 
-		networkType, err := getNetworkType(&netAttachDef)
+	return policyNetworks, nil
+}
+
+// networkNames returns the namespace/name of the networks
+func networkNames(networks []policyNetwork) []string {
+	names := make([]string, 0, len(networks))
+	for _, network := range networks {
+		names = append(names, network.name)
+	}
+
+	return names
+}
+
+// getAllowedNetworks gets the networks allowed by the valid plugins, with a supported topology and whose traffic does
+// not bypass the kernel
+func getAllowedNetworks(networks []policyNetwork, validPlugins []string, logger logr.Logger) ([]policyNetwork, error) {
+	var allowedNetworks []policyNetwork
+	for _, network := range networks {
+		networkType, err := getNetworkType(network.netAttachDef)
 		if err != nil {
+			if network.pattern {
+				// A single invalid definition must not disable the policy on the other matched networks
+				logger.Info("Failed to get network type, skipping", "network", network.name, "error", err.Error())
+				continue
+			}
+
 			return nil, fmt.Errorf("failed to get network type: %w", err)
 		}
 
-		if slices.Contains(validPlugins, networkType) {
-			logger.Info("Network type is supported", "network", network, "networkType", networkType)
-			allowedNetworks = append(allowedNetworks, network)
-		} else {
-			logger.Info("Network type is not supported", "network", network, "networkType", networkType)
+		if !slices.Contains(validPlugins, networkType) {
+			logger.Info("Network type is not supported", "network", network.name, "networkType", networkType)
+			continue
+		}
+
+		if slices.Contains(userspacePlugins, networkType) {
+			logger.Info("Network traffic bypasses the kernel", "network", network.name, "networkType", networkType)
+			continue
 		}
+
+		if err := checkNetworkTopology(network.netAttachDef, networkType); err != nil {
+			logger.Info("Network topology is not supported", "network", network.name, "networkType", networkType, "error", err.Error())
+			continue
+		}
+
+		logger.Info("Network type is supported", "network", network.name, "networkType", networkType)
+		allowedNetworks = append(allowedNetworks, network)
 	}
 
 	if len(allowedNetworks) == 0 {
@@ -248,36 +669,372 @@ func (m *MultiNetworkReconciler) getAllowedNetworks(ctx context.Context, network
 	return allowedNetworks, nil
 }
 
-// getNetworkType returns the type of a network
-func getNetworkType(netAttachDef *netdefv1.NetworkAttachmentDefinition) (string, error) {
-	if netAttachDef == nil {
-		return "", fmt.Errorf("network attachment definition is nil")
+// setNetworkSettings sets the settings of the networks of a policy from the annotations and the configurations of their
+// network attachment definitions. An invalid annotation is ignored rather than leaving the pods unprotected: the base
+// chains fall back to the input and output chains, the rules match the headers of the tunnels, the fragmented packets
+// are reassembled and the connections keep the default timeouts.
+func setNetworkSettings(policy *datastore.Policy, networks []policyNetwork, logger logr.Logger) {
+	for _, network := range networks {
+		logger := logger.WithValues("network", network.name)
+		annotations := network.netAttachDef.Annotations
+
+		var baseChains datastore.NetworkBaseChains
+		var err error
+		if value, ok := annotations[datastore.IngressHookAnnotation]; ok {
+			baseChains.Ingress, err = datastore.ParseIngressBaseChain(value)
+			if err != nil {
+				logger.Info("Invalid ingress-hook annotation, using the input chain", "error", err.Error())
+			}
+		}
+		if value, ok := annotations[datastore.EgressHookAnnotation]; ok {
+			baseChains.Egress, err = datastore.ParseEgressBaseChain(value)
+			if err != nil {
+				logger.Info("Invalid egress-hook annotation, using the output chain", "error", err.Error())
+			}
+		}
+		if baseChains.Ingress != nil || baseChains.Egress != nil {
+			setNetworkValue(&policy.BaseChains, network.name, baseChains)
+		}
+
+		if value, ok := annotations[datastore.EncapsulationAnnotation]; ok {
+			if encapsulation, err := datastore.ParseEncapsulation(value); err != nil {
+				logger.Info("Invalid encapsulation annotation, matching the headers of the tunnel", "error", err.Error())
+			} else {
+				setNetworkValue(&policy.Encapsulations, network.name, encapsulation)
+			}
+		}
+
+		// The unknown presets are ignored
+		if value, ok := annotations[datastore.ProtocolPresetsAnnotation]; ok {
+			presets, err := datastore.ParseProtocolPresets(value)
+			if err != nil {
+				logger.Info("Invalid protocol-presets annotation, ignoring the unknown presets", "error", err.Error())
+			}
+			if len(presets) > 0 {
+				setNetworkValue(&policy.ProtocolPresets, network.name, presets)
+			}
+		}
+
+		// The invalid addresses of the trusted gateways are ignored
+		if value, ok := annotations[datastore.ICMPHardeningAnnotation]; ok {
+			if enabled, err := strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+				logger.Info("Invalid icmp-hardening annotation, not hardening the network", "error", err.Error())
+			} else if enabled {
+				gateways, err := datastore.ParseTrustedGateways(annotations[datastore.TrustedGatewaysAnnotation])
+				if err != nil {
+					logger.Info("Invalid trusted-gateways annotation, ignoring the invalid addresses", "error", err.Error())
+				}
+				setNetworkValue(&policy.ICMPHardening, network.name, datastore.ICMPHardening{Gateways: gateways})
+			}
+		}
+
+		if value, ok := annotations[datastore.FragmentsAnnotation]; ok {
+			if fragments, err := datastore.ParseFragments(value); err != nil {
+				logger.Info("Invalid fragments annotation, reassembling the fragmented packets", "error", err.Error())
+			} else {
+				setNetworkValue(&policy.Fragments, network.name, fragments)
+			}
+		}
+
+		if value, ok := annotations[datastore.ConntrackTimeoutsAnnotation]; ok {
+			if timeouts, err := datastore.ParseConntrackTimeouts(value); err != nil {
+				logger.Info("Invalid conntrack-timeouts annotation, keeping the default timeouts", "error", err.Error())
+			} else {
+				setNetworkValue(&policy.ConntrackTimeouts, network.name, timeouts)
+			}
+		}
+
+		// The IPv4 peers are only matched at their IPv4 addresses without a NAT64 prefix
+		if value, ok := annotations[datastore.NAT64PrefixAnnotation]; ok {
+			if prefix, err := datastore.ParseNAT64Prefix(value); err != nil {
+				logger.Info("Invalid nat64-prefix annotation, matching the IPv4 peers at their IPv4 addresses only", "error", err.Error())
+			} else {
+				setNetworkValue(&policy.NAT64Prefixes, network.name, prefix)
+			}
+		}
+
+		if value, ok := annotations[datastore.InfrastructureAddressesAnnotation]; ok {
+			if infrastructure := getNetworkInfrastructure(network.netAttachDef, value, logger); len(infrastructure.Addresses) > 0 || len(infrastructure.DNSServers) > 0 {
+				setNetworkValue(&policy.Infrastructure, network.name, infrastructure)
+			}
+		}
+
+		if isIPvlanL3(network.netAttachDef) {
+			policy.L3Networks = append(policy.L3Networks, network.name)
+		}
 	}
+}
 
-	var netType string
+// setNetworkValue sets the value of a network in a map of the settings of the networks, created with the first one
+func setNetworkValue[T any](values *map[string]T, network string, value T) {
+	if *values == nil {
+		*values = make(map[string]T)
+	}
+	(*values)[network] = value
+}
 
-	confBytes, err := netdefutils.GetCNIConfigFromSpec(netAttachDef.Spec.Config, netAttachDef.Name)
+// getNetworkInfrastructure gets the infrastructure of a network set by its infrastructure addresses annotation, the
+// gateway and dns entries add the gateways and the DNS servers of the IPAM configuration. The invalid entries are
+// ignored.
+func getNetworkInfrastructure(netAttachDef *netdefv1.NetworkAttachmentDefinition, value string, logger logr.Logger) datastore.Infrastructure {
+	cidrs, derived, err := datastore.ParseInfrastructureAddresses(value)
 	if err != nil {
-		return "", err
+		logger.Info("Invalid infrastructure-addresses annotation, ignoring the invalid addresses", "error", err.Error())
 	}
 
-	netconfList := &cnitypes.NetConfList{}
-	if err := json.Unmarshal(confBytes, netconfList); err != nil {
-		return "", err
+	infrastructure := datastore.Infrastructure{Addresses: cidrs}
+	if len(derived) == 0 {
+		return infrastructure
 	}
 
-	if len(netconfList.Plugins) == 0 {
-		netconf := &cnitypes.NetConf{}
-		if err := json.Unmarshal(confBytes, netconf); err != nil {
-			return "", err
+	gateways, dnsServers := getIPAMInfrastructure(netAttachDef)
+
+	if slices.Contains(derived, datastore.InfrastructureGateway) {
+		if len(gateways) == 0 {
+			logger.Info("No gateway found in the IPAM configuration of the network")
 		}
 
-		netType = netconf.Type
-	} else {
-		netType = netconfList.Plugins[0].Type
+		for _, gateway := range gateways {
+			if !slices.Contains(infrastructure.Addresses, gateway) {
+				infrastructure.Addresses = append(infrastructure.Addresses, gateway)
+			}
+		}
+	}
+
+	if slices.Contains(derived, datastore.InfrastructureDNS) {
+		if len(dnsServers) == 0 {
+			logger.Info("No DNS server found in the configuration of the network")
+		}
+
+		infrastructure.DNSServers = dnsServers
+	}
+
+	return infrastructure
+}
+
+// setPolicyAnnotations sets the settings of a policy from its own annotations. An invalid annotation is ignored rather
+// than leaving the pods unprotected: the default verdict is used, only the peer addresses on the networks of the policy
+// are allowed, the connections are not limited, and the invalid multicast groups and external peers are ignored.
+func setPolicyAnnotations(policy *datastore.Policy, instance *multiv1beta1.MultiNetworkPolicy, logger logr.Logger) {
+	annotations := instance.GetAnnotations()
+
+	var err error
+	if value, ok := annotations[datastore.DefaultVerdictAnnotation]; ok {
+		policy.Verdict, err = datastore.ParseVerdict(value)
+		if err != nil {
+			logger.Info("Invalid default-verdict annotation, using the default verdict", "error", err.Error())
+		}
+	}
+
+	if value, ok := annotations[datastore.InterfacesAnnotation]; ok {
+		policy.Interfaces = datastore.ParseInterfaces(value)
+	}
+
+	// The peer pods only contribute their addresses on the networks of the policy, unless other networks are included
+	if value, ok := annotations[datastore.PeerNetworksAnnotation]; ok {
+		policy.PeerNetworks = parseNetworks(value, instance.Namespace)
+		if len(policy.PeerNetworks) == 0 && strings.TrimSpace(value) != "" {
+			logger.Info("Invalid peer-networks annotation, only the peer addresses on the networks of the policy are allowed", "value", value)
+		}
+	}
+
+	if value, ok := annotations[datastore.ConnectionLimitAnnotation]; ok {
+		policy.ConnectionLimit, err = datastore.ParseConnectionLimit(value)
+		if err != nil {
+			logger.Info("Invalid connection-limit annotation, the connections are not limited", "error", err.Error())
+		}
+	}
+
+	if value, ok := annotations[datastore.MulticastGroupsAnnotation]; ok {
+		policy.MulticastGroups, err = datastore.ParseMulticastGroups(value)
+		if err != nil {
+			logger.Info("Invalid multicast-groups annotation, ignoring the invalid groups", "error", err.Error())
+		}
+	}
+
+	if value, ok := annotations[datastore.ExternalPeersAnnotation]; ok {
+		policy.ExternalPeers, err = datastore.ParseExternalPeers(value)
+		if err != nil {
+			logger.Info("Invalid external-peers annotation, ignoring the invalid external peers", "error", err.Error())
+		}
+	}
+}
+
+// dnsNetConf is the DNS configuration of a plugin or of its IPAM
+type dnsNetConf struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// ipamNetConf is the configuration of the gateways and the DNS servers of the host-local, static and whereabouts IPAM
+// plugins
+type ipamNetConf struct {
+	DNS  dnsNetConf `json:"dns,omitempty"`
+	IPAM struct {
+		Gateway string `json:"gateway,omitempty"`
+		Routes  []struct {
+			GW string `json:"gw,omitempty"`
+		} `json:"routes,omitempty"`
+		Ranges [][]struct {
+			Gateway string `json:"gateway,omitempty"`
+		} `json:"ranges,omitempty"`
+		Addresses []struct {
+			Gateway string `json:"gateway,omitempty"`
+		} `json:"addresses,omitempty"`
+		DNS dnsNetConf `json:"dns,omitempty"`
+	} `json:"ipam"`
+}
+
+// getIPAMInfrastructure returns the gateways and the DNS servers of the configuration of the first plugin of a network
+// attachment definition and of its IPAM, as normalized CIDRs. An invalid configuration has none.
+func getIPAMInfrastructure(netAttachDef *netdefv1.NetworkAttachmentDefinition) ([]string, []string) {
+	netconf, err := utils.ParseFirstPluginConf[ipamNetConf](netAttachDef)
+	if err != nil {
+		return nil, nil
+	}
+
+	gateways := []string{netconf.IPAM.Gateway}
+	for _, route := range netconf.IPAM.Routes {
+		gateways = append(gateways, route.GW)
+	}
+	for _, rangeSet := range netconf.IPAM.Ranges {
+		for _, r := range rangeSet {
+			gateways = append(gateways, r.Gateway)
+		}
+	}
+	for _, address := range netconf.IPAM.Addresses {
+		gateways = append(gateways, address.Gateway)
+	}
+
+	return addressCIDRs(gateways), addressCIDRs(slices.Concat(netconf.DNS.Nameservers, netconf.IPAM.DNS.Nameservers))
+}
+
+// addressCIDRs returns the unique normalized CIDRs of the addresses, the empty and invalid addresses are skipped
+func addressCIDRs(addresses []string) []string {
+	var cidrs []string
+	for _, address := range addresses {
+		if address == "" {
+			continue
+		}
+
+		cidr, err := datastore.AddressCIDR(address)
+		if err != nil || slices.Contains(cidrs, cidr) {
+			continue
+		}
+		cidrs = append(cidrs, cidr)
+	}
+
+	return cidrs
+}
+
+// getSpoofableNetworks gets the SR-IOV networks whose VFs do not enforce the MAC addresses of the pods, as the VFs without
+// spoof checking or trusted ones can send from any MAC address
+func getSpoofableNetworks(networks []policyNetwork) []string {
+	var spoofableNetworks []string
+	for _, network := range networks {
+		if isSpoofable(network.netAttachDef) {
+			spoofableNetworks = append(spoofableNetworks, network.name)
+		}
+	}
+
+	return spoofableNetworks
+}
+
+// sriovNetConf is the configuration of the VF settings of the sriov plugin, set as "on" or "off"
+type sriovNetConf struct {
+	Type     string `json:"type"`
+	SpoofChk string `json:"spoofchk,omitempty"`
+	Trust    string `json:"trust,omitempty"`
+}
+
+// isSpoofable returns whether the VFs of a network attachment definition of the sriov plugin have spoof checking
+// disabled or are trusted. The VF settings are applied by the plugin, an invalid configuration is not spoofable.
+func isSpoofable(netAttachDef *netdefv1.NetworkAttachmentDefinition) bool {
+	netconf, err := utils.ParseFirstPluginConf[sriovNetConf](netAttachDef)
+	if err != nil {
+		return false
+	}
+
+	return netconf.Type == "sriov" && (netconf.SpoofChk == "off" || netconf.Trust == "on")
+}
+
+// ipvlanNetConf is the configuration of the mode of the ipvlan plugin, l2 when it is not set
+type ipvlanNetConf struct {
+	Type string `json:"type"`
+	Mode string `json:"mode,omitempty"`
+}
+
+// isIPvlanL3 returns whether a network attachment definition of the ipvlan plugin attaches the pods in the l3 or l3s
+// mode, where the interfaces do not resolve their neighbors and share the MAC address of the master. An invalid
+// configuration is in the l2 mode.
+func isIPvlanL3(netAttachDef *netdefv1.NetworkAttachmentDefinition) bool {
+	netconf, err := utils.ParseFirstPluginConf[ipvlanNetConf](netAttachDef)
+	if err != nil {
+		return false
+	}
+
+	return netconf.Type == "ipvlan" && (netconf.Mode == "l3" || netconf.Mode == "l3s")
+}
+
+// getNetworkAttachmentDefinitions gets the network attachment definitions of a network of the policy-for annotation,
+// listing the matching ones when the network has wildcards
+func (m *MultiNetworkReconciler) getNetworkAttachmentDefinitions(ctx context.Context, namespace string, name string) ([]netdefv1.NetworkAttachmentDefinition, error) {
+	if !isNetworkPattern(namespace) && !isNetworkPattern(name) {
+		var netAttachDef netdefv1.NetworkAttachmentDefinition
+		err := m.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, &netAttachDef)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				// Ignore, not found
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("failed to get network attachment definition: %w", err)
+		}
+
+		return []netdefv1.NetworkAttachmentDefinition{netAttachDef}, nil
+	}
+
+	var opts []client.ListOption
+	if !isNetworkPattern(namespace) {
+		opts = append(opts, client.InNamespace(namespace))
+	}
+
+	var netAttachDefList netdefv1.NetworkAttachmentDefinitionList
+	if err := m.Client.List(ctx, &netAttachDefList, opts...); err != nil {
+		return nil, fmt.Errorf("failed to list network attachment definitions: %w", err)
+	}
+
+	var netAttachDefs []netdefv1.NetworkAttachmentDefinition
+	for _, netAttachDef := range netAttachDefList.Items {
+		if datastore.MatchesNetwork(fmt.Sprintf("%s/%s", namespace, name), netAttachDef.Namespace, netAttachDef.Name) {
+			netAttachDefs = append(netAttachDefs, netAttachDef)
+		}
+	}
+
+	// Sort for a stable order of the networks of the policy
+	slices.SortFunc(netAttachDefs, func(a, b netdefv1.NetworkAttachmentDefinition) int {
+		return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+	})
+
+	return netAttachDefs, nil
+}
+
+// isNetworkPattern checks if a network of the policy-for annotation has wildcards
+func isNetworkPattern(network string) bool {
+	return strings.Contains(network, "*")
+}
+
+// getNetworkType returns the type of a network
+func getNetworkType(netAttachDef *netdefv1.NetworkAttachmentDefinition) (string, error) {
+	if netAttachDef == nil {
+		return "", fmt.Errorf("network attachment definition is nil")
 	}
 
-	return netType, nil
+	netconf, err := utils.ParseFirstPluginConf[cnitypes.NetConf](netAttachDef)
+	if err != nil {
+		return "", err
+	}
+
+	return netconf.Type, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -288,9 +1045,28 @@ func (m *MultiNetworkReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return fmt.Errorf("failed to set up indexes: %w", err)
 	}
 
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&multiv1beta1.MultiNetworkPolicy{}).
+	maxConcurrentReconciles := m.MaxConcurrentReconciles
+	if maxConcurrentReconciles < 1 {
+		maxConcurrentReconciles = 1
+	}
+
+	m.resync = make(chan event.GenericEvent)
+	m.podNetworks = newPodNetworkIndex()
+	m.staleness = newStalenessTracker()
+	metrics.SetStaleEnforcementSource(m.staleness.oldest)
+	limiter := newEventRateLimiter(m.PolicyEventQPS, m.PolicyEventBurst)
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("multinetworkpolicy").
+		// The policies of the initial list are jittered and the deny-all policies are synced first
+		Watches(&multiv1beta1.MultiNetworkPolicy{}, revocationHandler(policyRevocations(m.DS), initialSyncHandler(m.StartupJitter))).
 		WithEventFilter(MultiNetworkPolicyPredicate).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: maxConcurrentReconciles,
+			// The events removing access are enqueued with a higher priority, see revocationHandler
+			UsePriorityQueue: ptr.To(m.PrioritizeRevocations),
+			NewQueue:         m.staleness.newQueue(m.PrioritizeRevocations, mgr.GetLogger()),
+		}).
 		WithLogConstructor(func(req *ctrl.Request) logr.Logger {
 			log := mgr.GetLogger()
 			if req != nil {
@@ -301,14 +1077,28 @@ func (m *MultiNetworkReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Watches(
 			&corev1.Namespace{},
 			// We will enqueue policies with selectors that match the namespace
-			handler.EnqueueRequestsFromMapFunc(namespaceEnqueue(m.Client)),
-			builder.WithPredicates(NamespacePredicate),
+			revocationHandler(namespaceRevocations, rateLimitedHandler("multinetworkpolicy", limiter, handler.EnqueueRequestsFromMapFunc(namespaceEnqueue(m.Client, m.DS)))),
+			builder.WithPredicates(namespaceSelectorCacheInvalidator(m.Selectors), NamespacePredicate),
 		).
 		Watches(
 			&corev1.Pod{},
 			// We will enqueue policies with selectors that match the pod
-			handler.EnqueueRequestsFromMapFunc(podEnqueue(m.Client)),
-			builder.WithPredicates(PodPredicate),
+			revocationHandler(podRevocations, rateLimitedHandler("multinetworkpolicy", limiter, handler.EnqueueRequestsFromMapFunc(podEnqueue(m.Client, m.DS)))),
+			builder.WithPredicates(podSelectorCacheInvalidator(m.Selectors), sandboxPrefetcher(m.Sandboxes), enforceablePodPredicate("multinetworkpolicy", m.podNetworks, m.DS), PodPredicate),
 		).
-		Complete(m)
+		Watches(
+			&netdefv1.NetworkAttachmentDefinition{},
+			// We will enqueue policies with policy-for networks that match the network attachment definition
+			rateLimitedHandler("multinetworkpolicy", limiter, handler.EnqueueRequestsFromMapFunc(networkAttachmentDefinitionEnqueue(m.Client, m.DS))),
+			builder.WithPredicates(NetworkAttachmentDefinitionPredicate),
+		).
+		// Policies are resynced on configuration changes
+		WatchesRawSource(source.Channel(m.resync, &handler.EnqueueRequestForObject{}))
+
+	if m.Reservations != nil {
+		// The addresses reserved by whereabouts resolve the peers before their network status is reported
+		b = b.Watches(newIPPool(), rateLimitedHandler("multinetworkpolicy", limiter, reservationHandler(m.Client, m.Reservations, m.Selectors, podEnqueue(m.Client, m.DS))))
+	}
+
+	return b.Complete(m)
 }
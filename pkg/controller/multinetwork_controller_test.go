@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"net/netip"
 	"strings"
 
 	"github.com/go-logr/logr"
@@ -12,9 +13,14 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
 )
 
 var _ = Describe("isPolicyAffectedByNamespace Unit Tests", func() {
@@ -1644,6 +1650,20 @@ var _ = Describe("getNetworksInPolicyForAnnotation Unit Tests", func() {
 		})
 	})
 
+	Context("wildcards", func() {
+		It("should keep the wildcards of the namespace and the name", func() {
+			networks, err := getNetworksInPolicyForAnnotation("*,macvlan-*,tenant-*/bridge-net", "default")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(networks).To(Equal([]string{"default/*", "default/macvlan-*", "tenant-*/bridge-net"}))
+		})
+
+		It("should skip invalid patterns", func() {
+			networks, err := getNetworksInPolicyForAnnotation("macvlan-[,bridge-net", "default")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(networks).To(Equal([]string{"default/bridge-net"}))
+		})
+	})
+
 	Context("edge cases and potential bugs", func() {
 		It("should handle network names with multiple slashes (potential bug)", func() {
 			networks, err := getNetworksInPolicyForAnnotation("ns/name/extra", "default")
@@ -1684,6 +1704,16 @@ var _ = Describe("getNetworksInPolicyForAnnotation Unit Tests", func() {
 			Expect(networks).To(Equal([]string{"default/net-1", "default/net_2", "default/net.3"}))
 		})
 	})
+
+	Context("peer networks", func() {
+		It("should parse the peer networks with the format of the policy-for annotation", func() {
+			Expect(parseNetworks("net2, tenant-*/net3", "default")).To(Equal([]string{"default/net2", "tenant-*/net3"}))
+		})
+
+		It("should ignore the invalid peer networks", func() {
+			Expect(parseNetworks("ns/name/extra,/net2", "default")).To(BeEmpty())
+		})
+	})
 })
 
 var _ = Describe("getNetworkType Unit Tests", func() {
@@ -1876,29 +1906,52 @@ var _ = Describe("getAllowedNetworks Unit Tests", func() {
 		}
 	})
 
+	// policyNetworks fetches the network attachment definitions of the networks
+	policyNetworks := func(networks ...string) []policyNetwork {
+		policyNetworks, err := reconciler.getPolicyNetworks(ctx, networks, logger)
+		Expect(err).NotTo(HaveOccurred())
+		return policyNetworks
+	}
+
+	// getAllowedNetworkNames fetches the networks and returns the names of the allowed ones
+	getAllowedNetworkNames := func(ctx context.Context, networks []string, validPlugins []string, logger logr.Logger) ([]string, error) {
+		allowed, err := getAllowedNetworks(policyNetworks(networks...), validPlugins, logger)
+		if err != nil {
+			return nil, err
+		}
+		return networkNames(allowed), nil
+	}
+
+	// networkSettings fetches the networks and returns a policy with their settings
+	networkSettings := func(networks ...string) *datastore.Policy {
+		policy := &datastore.Policy{}
+		setNetworkSettings(policy, policyNetworks(networks...), logger)
+		return policy
+	}
+
 	Context("input validation", func() {
 		It("should return empty slice for nil networks slice", func() {
-			networks, err := reconciler.getAllowedNetworks(ctx, nil, reconciler.ValidPlugins, logger)
+			networks, err := getAllowedNetworkNames(ctx, nil, reconciler.ValidPlugins, logger)
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 			Expect(networks).To(BeEmpty())
 		})
 
 		It("should return empty slice for empty networks slice", func() {
-			networks, err := reconciler.getAllowedNetworks(ctx, []string{}, reconciler.ValidPlugins, logger)
+			networks, err := getAllowedNetworkNames(ctx, []string{}, reconciler.ValidPlugins, logger)
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 			Expect(networks).To(BeEmpty())
 		})
 
 		It("should handle nil validPlugins slice", func() {
 			networks := []string{"default/macvlan-net"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, nil, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, nil, logger)
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 			Expect(allowedNetworks).To(BeEmpty())
 		})
 
 		It("should handle empty validPlugins slice", func() {
 			networks := []string{"default/macvlan-net"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, []string{}, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, []string{}, logger)
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 			Expect(allowedNetworks).To(BeEmpty())
 		})
@@ -1907,14 +1960,14 @@ var _ = Describe("getAllowedNetworks Unit Tests", func() {
 	Context("network format validation", func() {
 		It("should skip networks with invalid format", func() {
 			networks := []string{"invalid-format"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 			Expect(allowedNetworks).To(BeEmpty()) // No valid networks found due to invalid format
 		})
 
 		It("should skip networks with too many parts", func() {
 			networks := []string{"ns/name/extra"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 			Expect(allowedNetworks).To(BeEmpty()) // No valid networks found due to invalid format
 		})
@@ -1923,7 +1976,7 @@ var _ = Describe("getAllowedNetworks Unit Tests", func() {
 	Context("network attachment definition handling", func() {
 		It("should skip networks when attachment definition is not found", func() {
 			networks := []string{"default/nonexistent-net"}
-			_, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			_, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 		})
@@ -1932,7 +1985,7 @@ var _ = Describe("getAllowedNetworks Unit Tests", func() {
 			// This test would require a more sophisticated fake client setup
 			// For now, we'll test the happy path
 			networks := []string{"default/macvlan-net"}
-			_, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			_, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 		})
@@ -2002,28 +2055,28 @@ var _ = Describe("getAllowedNetworks Unit Tests", func() {
 
 		It("should include networks with supported types", func() {
 			networks := []string{"default/macvlan-net"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(allowedNetworks).To(Equal([]string{"default/macvlan-net"}))
 		})
 
 		It("should include multiple networks with supported types", func() {
 			networks := []string{"default/macvlan-net", "default/bridge-net"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(allowedNetworks).To(Equal([]string{"default/macvlan-net", "default/bridge-net"}))
 		})
 
 		It("should exclude networks with unsupported types", func() {
 			networks := []string{"default/unsupported-net"}
-			_, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			_, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("no allowed networks found"))
 		})
 
 		It("should skip networks with invalid configuration", func() {
 			networks := []string{"default/invalid-config-net"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err).To(HaveOccurred())
 			Expect(allowedNetworks).To(BeEmpty())
 		})
@@ -2036,7 +2089,7 @@ var _ = Describe("getAllowedNetworks Unit Tests", func() {
 				"default/unsupported-net",
 				"default/bridge-net",
 			}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(allowedNetworks).To(Equal([]string{"default/macvlan-net", "default/bridge-net"}))
 		})
@@ -2059,9 +2112,431 @@ var _ = Describe("getAllowedNetworks Unit Tests", func() {
 			Expect(fakeClient.Create(ctx, otherNamespaceNet)).To(Succeed())
 
 			networks := []string{"default/macvlan-net", "other-ns/macvlan-net"}
-			allowedNetworks, err := reconciler.getAllowedNetworks(ctx, networks, reconciler.ValidPlugins, logger)
+			allowedNetworks, err := getAllowedNetworkNames(ctx, networks, reconciler.ValidPlugins, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowedNetworks).To(Equal([]string{"default/macvlan-net", "other-ns/macvlan-net"}))
+		})
+
+		It("should expand networks with wildcards to the supported matching networks", func() {
+			otherNamespaceNet := &netdefv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "macvlan-net",
+					Namespace: "other-ns",
+				},
+				Spec: netdefv1.NetworkAttachmentDefinitionSpec{
+					Config: `{"cniVersion": "0.3.1", "type": "macvlan", "master": "eth1"}`,
+				},
+			}
+			Expect(fakeClient.Create(ctx, otherNamespaceNet)).To(Succeed())
+
+			// Unsupported and invalid networks matching the wildcard are skipped
+			allowedNetworks, err := getAllowedNetworkNames(ctx, []string{"default/*"}, reconciler.ValidPlugins, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowedNetworks).To(Equal([]string{"default/bridge-net", "default/macvlan-net"}))
+
+			allowedNetworks, err = getAllowedNetworkNames(ctx, []string{"*/macvlan-*", "default/macvlan-net"}, reconciler.ValidPlugins, logger)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(allowedNetworks).To(Equal([]string{"default/macvlan-net", "other-ns/macvlan-net"}))
+
+			_, err = getAllowedNetworkNames(ctx, []string{"default/sriov-*"}, reconciler.ValidPlugins, logger)
+			Expect(err).To(MatchError(ContainSubstring("no allowed networks found")))
 		})
 	})
+
+	Context("OVN-Kubernetes networks", func() {
+		It("should only allow the secondary networks with the layer2 and localnet topologies", func() {
+			for name, config := range map[string]string{
+				"layer2-net":   `{"cniVersion": "0.4.0", "name": "tenant", "type": "ovn-k8s-cni-overlay", "topology": "layer2", "netAttachDefName": "default/layer2-net"}`,
+				"localnet-net": `{"cniVersion": "0.4.0", "name": "physnet", "type": "ovn-k8s-cni-overlay", "topology": "localnet", "netAttachDefName": "default/localnet-net"}`,
+				"layer3-net":   `{"cniVersion": "0.4.0", "name": "routed", "type": "ovn-k8s-cni-overlay", "topology": "layer3", "netAttachDefName": "default/layer3-net"}`,
+				"primary-net":  `{"cniVersion": "0.4.0", "name": "udn", "type": "ovn-k8s-cni-overlay", "topology": "layer2", "role": "primary", "netAttachDefName": "default/primary-net"}`,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+					Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: config},
+				})).To(Succeed())
+			}
+
+			_, err := getAllowedNetworkNames(ctx, []string{"default/layer2-net"}, reconciler.ValidPlugins, logger)
+			Expect(err).To(MatchError(ContainSubstring("no allowed networks found")))
+
+			allowedNetworks, err := getAllowedNetworkNames(ctx, []string{"default/*"}, []string{"ovn-k8s-cni-overlay"}, logger)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allowedNetworks).To(Equal([]string{"default/layer2-net", "default/localnet-net"}))
+		})
+	})
+
+	Context("network settings", func() {
+		It("should get each network attachment definition once for all its settings", func() {
+			gets := 0
+			reconciler.Client = interceptor.NewClient(fakeClient.(client.WithWatch), interceptor.Funcs{
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+					gets++
+					return c.Get(ctx, key, obj, opts...)
+				},
+			})
+
+			Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "secure-net", Namespace: "default", Annotations: map[string]string{
+					datastore.EgressHookAnnotation:  "postrouting",
+					datastore.FragmentsAnnotation:   "drop",
+					datastore.NAT64PrefixAnnotation: "64:ff9b::/96",
+				}},
+				Spec: netdefv1.NetworkAttachmentDefinitionSpec{Config: `{"cniVersion": "0.3.1", "type": "ipvlan", "mode": "l3"}`},
+			})).To(Succeed())
+
+			policy := networkSettings("default/secure-net")
+			Expect(gets).To(Equal(1))
+			Expect(policy.BaseChains).To(HaveKey("default/secure-net"))
+			Expect(policy.Fragments).To(HaveKey("default/secure-net"))
+			Expect(policy.NAT64Prefixes).To(HaveKey("default/secure-net"))
+			Expect(policy.L3Networks).To(Equal([]string{"default/secure-net"}))
+		})
+	})
+
+	Context("network base chains", func() {
+		It("should read the hook annotations of the networks", func() {
+			for name, annotations := range map[string]map[string]string{
+				"bridge-net":  {datastore.IngressHookAnnotation: "prerouting:mangle", datastore.EgressHookAnnotation: "postrouting"},
+				"invalid-net": {datastore.IngressHookAnnotation: "postrouting"},
+				"macvlan-net": nil,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/bridge-net", "default/invalid-net", "default/macvlan-net").BaseChains).To(Equal(map[string]datastore.NetworkBaseChains{
+				"default/bridge-net": {
+					Ingress: &datastore.BaseChain{Hook: "prerouting", Priority: -150},
+					Egress:  &datastore.BaseChain{Hook: "postrouting"},
+				},
+			}))
+		})
+	})
+
+	Context("network encapsulations", func() {
+		It("should read the encapsulation annotations of the networks", func() {
+			for name, annotations := range map[string]map[string]string{
+				"vxlan-net":   {datastore.EncapsulationAnnotation: "VXLAN"},
+				"invalid-net": {datastore.EncapsulationAnnotation: "gre"},
+				"macvlan-net": nil,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/vxlan-net", "default/invalid-net", "default/macvlan-net", "default/missing-net").Encapsulations).To(Equal(map[string]datastore.Encapsulation{
+				"default/vxlan-net": datastore.EncapsulationVXLAN,
+			}))
+		})
+	})
+
+	Context("network protocol presets", func() {
+		It("should read the protocol presets annotations of the networks", func() {
+			for name, annotations := range map[string]map[string]string{
+				"ha-net":      {datastore.ProtocolPresetsAnnotation: "vrrp, BFD"},
+				"invalid-net": {datastore.ProtocolPresetsAnnotation: "isis"},
+				"macvlan-net": nil,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/ha-net", "default/invalid-net", "default/macvlan-net", "default/missing-net").ProtocolPresets).To(Equal(map[string][]string{
+				"default/ha-net": {datastore.ProtocolPresetVRRP, datastore.ProtocolPresetBFD},
+			}))
+		})
+	})
+
+	Context("network fragments", func() {
+		It("should read the fragments annotations of the networks", func() {
+			for name, annotations := range map[string]map[string]string{
+				"secure-net":  {datastore.FragmentsAnnotation: "drop"},
+				"invalid-net": {datastore.FragmentsAnnotation: "accept"},
+				"macvlan-net": nil,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/secure-net", "default/invalid-net", "default/macvlan-net", "default/missing-net").Fragments).To(Equal(map[string]datastore.Fragments{
+				"default/secure-net": datastore.FragmentsDrop,
+			}))
+		})
+	})
+
+	Context("network conntrack timeouts", func() {
+		It("should read the conntrack timeouts annotations of the networks", func() {
+			for name, annotations := range map[string]map[string]string{
+				"sctp-net":    {datastore.ConntrackTimeoutsAnnotation: "sctp.established=24h, udp.replied=1h"},
+				"invalid-net": {datastore.ConntrackTimeoutsAnnotation: "udp.established=1h"},
+				"macvlan-net": nil,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/sctp-net", "default/invalid-net", "default/macvlan-net", "default/missing-net").ConntrackTimeouts).To(Equal(map[string]datastore.ConntrackTimeouts{
+				"default/sctp-net": {"sctp": {"established": 86400}, "udp": {"replied": 3600}},
+			}))
+		})
+	})
+
+	Context("network NAT64 prefixes", func() {
+		It("should read the NAT64 prefix annotations of the networks", func() {
+			for name, annotations := range map[string]map[string]string{
+				"v6only-net":  {datastore.NAT64PrefixAnnotation: " 64:ff9b::/96"},
+				"invalid-net": {datastore.NAT64PrefixAnnotation: "64:ff9b::/64"},
+				"macvlan-net": nil,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/v6only-net", "default/invalid-net", "default/macvlan-net", "default/missing-net").NAT64Prefixes).To(Equal(map[string]netip.Prefix{
+				"default/v6only-net": netip.MustParsePrefix("64:ff9b::/96"),
+			}))
+		})
+	})
+
+	Context("overlapping peer networks", func() {
+		It("should report the peer networks whose subnets overlap the networks of the policy", func() {
+			for name, config := range map[string]string{
+				"net1":        `{"cniVersion": "0.3.1", "type": "macvlan", "ipam": {"type": "host-local", "ranges": [[{"subnet": "10.0.0.0/24"}]]}}`,
+				"net2":        `{"cniVersion": "0.3.1", "type": "macvlan", "ipam": {"type": "whereabouts", "range": "10.0.0.10-10.0.0.20/24"}}`,
+				"peer-net":    `{"cniVersion": "0.3.1", "name": "peer-net", "plugins": [{"type": "macvlan", "ipam": {"type": "static", "addresses": [{"address": "10.0.0.5/16"}]}}]}`,
+				"other-net":   `{"cniVersion": "0.3.1", "type": "macvlan", "ipam": {"type": "host-local", "subnet": "10.1.0.0/24"}}`,
+				"dhcp-net":    `{"cniVersion": "0.3.1", "type": "macvlan", "ipam": {"type": "dhcp"}}`,
+				"invalid-net": `{"cniVersion": "0.3.1", "type": "macvlan", "ipam": {"subnet": "10.0.0.0/33"}}`,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+					Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: config},
+				})).To(Succeed())
+			}
+
+			// The networks of the policy overlapping each other are bound to their own interfaces
+			overlaps, err := reconciler.getOverlappingPeerNetworks(ctx, []string{"default/net1", "default/net2"}, []string{"default/*"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(overlaps).To(Equal([]networkOverlap{
+				{Network: "default/net1", PeerNetwork: "default/peer-net"},
+				{Network: "default/net2", PeerNetwork: "default/peer-net"},
+			}))
+
+			overlaps, err = reconciler.getOverlappingPeerNetworks(ctx, []string{"default/net1"}, []string{"default/other-net", "default/missing-net"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(overlaps).To(BeEmpty())
+		})
+	})
+
+	Context("network infrastructure addresses", func() {
+		It("should read the infrastructure addresses annotations and the IPAM gateways and DNS servers of the networks", func() {
+			for name, netAttachDef := range map[string]struct {
+				annotation string
+				config     string
+			}{
+				"host-local-net": {
+					annotation: "gateway, 192.168.1.53",
+					config:     `{"cniVersion": "0.3.1", "type": "macvlan", "ipam": {"type": "host-local", "ranges": [[{"subnet": "192.168.1.0/24", "gateway": "192.168.1.1"}]], "routes": [{"dst": "10.0.0.0/8", "gw": "192.168.1.254"}], "dns": {"nameservers": ["192.168.1.2"]}}}`,
+				},
+				"whereabouts-net": {
+					annotation: "gateway,dns",
+					config:     `{"cniVersion": "0.3.1", "type": "macvlan", "dns": {"nameservers": ["10.1.0.2", "2001:db8:1::2"]}, "ipam": {"type": "whereabouts", "range": "10.1.0.0/24", "gateway": "10.1.0.1", "dns": {"nameservers": ["10.1.0.2"]}}}`,
+				},
+				"static-net": {
+					annotation: "gateway",
+					config:     `{"cniVersion": "0.3.1", "name": "static-net", "plugins": [{"type": "macvlan", "ipam": {"type": "static", "addresses": [{"address": "2001:db8::10/64", "gateway": "2001:db8::1"}]}}]}`,
+				},
+				"no-gateway-net": {
+					annotation: "gateway",
+					config:     `{"cniVersion": "0.3.1", "type": "macvlan", "ipam": {"type": "dhcp"}}`,
+				},
+				"invalid-net": {
+					annotation: "router",
+					config:     `{"cniVersion": "0.3.1", "type": "macvlan"}`,
+				},
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{datastore.InfrastructureAddressesAnnotation: netAttachDef.annotation}},
+					Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: netAttachDef.config},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/host-local-net", "default/whereabouts-net", "default/static-net", "default/no-gateway-net", "default/invalid-net", "default/missing-net").Infrastructure).To(Equal(map[string]datastore.Infrastructure{
+				"default/host-local-net":  {Addresses: []string{"192.168.1.53/32", "192.168.1.254/32", "192.168.1.1/32"}},
+				"default/whereabouts-net": {Addresses: []string{"10.1.0.1/32"}, DNSServers: []string{"10.1.0.2/32", "2001:db8:1::2/128"}},
+				"default/static-net":      {Addresses: []string{"2001:db8::1/128"}},
+			}))
+		})
+	})
+
+	Context("spoofable networks", func() {
+		It("should find the SR-IOV networks without spoof checking or with trusted VFs", func() {
+			for name, config := range map[string]string{
+				"spoofchk-off-net": `{"cniVersion": "0.3.1", "type": "sriov", "spoofchk": "off"}`,
+				"trusted-net":      `{"cniVersion": "0.3.1", "name": "trusted-net", "plugins": [{"type": "sriov", "trust": "on"}, {"type": "tuning"}]}`,
+				"spoofchk-on-net":  `{"cniVersion": "0.3.1", "type": "sriov", "spoofchk": "on", "trust": "off"}`,
+				"macvlan-net":      `{"cniVersion": "0.3.1", "type": "macvlan", "spoofchk": "off"}`,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+					Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: config},
+				})).To(Succeed())
+			}
+
+			Expect(getSpoofableNetworks(policyNetworks("default/spoofchk-off-net", "default/trusted-net", "default/spoofchk-on-net", "default/macvlan-net", "default/missing-net"))).To(Equal([]string{"default/spoofchk-off-net", "default/trusted-net"}))
+		})
+	})
+
+	Context("userspace networks", func() {
+		It("should find the networks of the userspace plugins, the patterns expanded", func() {
+			for name, config := range map[string]string{
+				"vpp-net":     `{"cniVersion": "0.3.1", "type": "userspace", "host": {"engine": "vpp", "iftype": "memif"}}`,
+				"ovs-net":     `{"cniVersion": "0.3.1", "name": "ovs-net", "plugins": [{"type": "vhostuser"}, {"type": "tuning"}]}`,
+				"macvlan-net": `{"cniVersion": "0.3.1", "type": "macvlan"}`,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+					Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: config},
+				})).To(Succeed())
+			}
+
+			Expect(getUserspaceNetworks(policyNetworks("default/vpp-net", "default/macvlan-net", "default/missing-net"))).To(Equal([]string{"default/vpp-net"}))
+
+			Expect(getUserspaceNetworks(policyNetworks("default/*", "default/vpp-net"))).To(ConsistOf("default/vpp-net", "default/ovs-net"))
+		})
+	})
+
+	Context("layer 3 networks", func() {
+		It("should find the ipvlan networks in the l3 and l3s modes", func() {
+			for name, config := range map[string]string{
+				"l3-net":      `{"cniVersion": "0.3.1", "type": "ipvlan", "master": "eth1", "mode": "l3"}`,
+				"l3s-net":     `{"cniVersion": "0.3.1", "name": "l3s-net", "plugins": [{"type": "ipvlan", "mode": "l3s"}, {"type": "tuning"}]}`,
+				"l2-net":      `{"cniVersion": "0.3.1", "type": "ipvlan", "mode": "l2"}`,
+				"default-net": `{"cniVersion": "0.3.1", "type": "ipvlan"}`,
+				"macvlan-net": `{"cniVersion": "0.3.1", "type": "macvlan", "mode": "l3"}`,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+					Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: config},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/l3-net", "default/l3s-net", "default/l2-net", "default/default-net", "default/macvlan-net", "default/missing-net").L3Networks).To(Equal([]string{"default/l3-net", "default/l3s-net"}))
+		})
+	})
+
+	Context("network ICMP hardening", func() {
+		It("should read the ICMP hardening and trusted gateways annotations of the networks", func() {
+			for name, annotations := range map[string]map[string]string{
+				"hardened-net": {datastore.ICMPHardeningAnnotation: "true", datastore.TrustedGatewaysAnnotation: "192.168.1.1, gw"},
+				"disabled-net": {datastore.ICMPHardeningAnnotation: "false"},
+				"invalid-net":  {datastore.ICMPHardeningAnnotation: "yes please"},
+				"macvlan-net":  nil,
+			} {
+				Expect(fakeClient.Create(ctx, &netdefv1.NetworkAttachmentDefinition{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: annotations},
+				})).To(Succeed())
+			}
+
+			Expect(networkSettings("default/hardened-net", "default/disabled-net", "default/invalid-net", "default/macvlan-net", "default/missing-net").ICMPHardening).To(Equal(map[string]datastore.ICMPHardening{
+				"default/hardened-net": {Gateways: []string{"192.168.1.1"}},
+			}))
+		})
+	})
+})
+
+var _ = Describe("isPolicyAffectedByNetwork", func() {
+	newPolicy := func(policyFor string) *multiv1beta1.MultiNetworkPolicy {
+		return &multiv1beta1.MultiNetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-policy",
+				Namespace:   "default",
+				Annotations: map[string]string{"k8s.v1.cni.cncf.io/policy-for": policyFor},
+			},
+		}
+	}
+
+	It("should match the networks of the policy-for annotation", func() {
+		Expect(isPolicyAffectedByNetwork(newPolicy("macvlan-net"), "default", "macvlan-net")).To(BeTrue())
+		Expect(isPolicyAffectedByNetwork(newPolicy("macvlan-net"), "other-ns", "macvlan-net")).To(BeFalse())
+		Expect(isPolicyAffectedByNetwork(newPolicy("other-ns/macvlan-net"), "other-ns", "macvlan-net")).To(BeTrue())
+	})
+
+	It("should match the networks with wildcards", func() {
+		Expect(isPolicyAffectedByNetwork(newPolicy("macvlan-*"), "default", "macvlan-storage")).To(BeTrue())
+		Expect(isPolicyAffectedByNetwork(newPolicy("macvlan-*"), "default", "bridge-net")).To(BeFalse())
+		Expect(isPolicyAffectedByNetwork(newPolicy("*/*"), "other-ns", "bridge-net")).To(BeTrue())
+		Expect(isPolicyAffectedByNetwork(newPolicy("tenant-*/macvlan-net"), "tenant-a", "macvlan-net")).To(BeTrue())
+	})
+
+	It("should return false without a valid policy-for annotation", func() {
+		Expect(isPolicyAffectedByNetwork(nil, "default", "macvlan-net")).To(BeFalse())
+		Expect(isPolicyAffectedByNetwork(newPolicy(" "), "default", "macvlan-net")).To(BeFalse())
+	})
+})
+
+var _ = Describe("CleanUpStalePolicies", func() {
+	It("should clean up the restored policies that no longer exist", func() {
+		ctx := context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(multiv1beta1.AddToScheme(scheme)).To(Succeed())
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&multiv1beta1.MultiNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "kept", Namespace: "default"}},
+		).Build()
+
+		ds := &datastore.Datastore{Policies: map[types.NamespacedName]*datastore.Policy{}}
+		for _, name := range []string{"kept", "deleted", mirroredPolicyPrefix + "web"} {
+			ds.CreatePolicy(&datastore.Policy{Name: name, Namespace: "default"})
+		}
+
+		syncer := &fakePolicySyncer{}
+		reconciler := &MultiNetworkReconciler{Client: fakeClient, DS: ds, NFT: syncer}
+
+		// The mirrored policies are stale when the mirroring is disabled
+		Expect(reconciler.CleanUpStalePolicies(ctx, false)).To(Succeed())
+		Expect(syncer.operations).To(Equal([]nftables.SyncOperation{nftables.SyncOperationDelete, nftables.SyncOperationDelete}))
+		Expect(ds.GetPolicy(types.NamespacedName{Namespace: "default", Name: "kept"})).NotTo(BeNil())
+		Expect(ds.ListPolicies()).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("podEnqueue", func() {
+	It("should only check the policies of the reverse index", func() {
+		ctx := context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(multiv1beta1.AddToScheme(scheme)).To(Succeed())
+		newPolicy := func(name string) *multiv1beta1.MultiNetworkPolicy {
+			return &multiv1beta1.MultiNetworkPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec: multiv1beta1.MultiNetworkPolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				},
+			}
+		}
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(newPolicy("indexed"), newPolicy("not-indexed")).Build()
+
+		ds := &datastore.Datastore{Policies: map[types.NamespacedName]*datastore.Policy{}}
+		ds.IndexPolicy(types.NamespacedName{Namespace: "default", Name: "indexed"}, []string{"default/net1"}, &datastore.PolicySpec{})
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", Labels: map[string]string{"app": "web"}},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+
+		requests := podEnqueue(fakeClient, ds)(ctx, pod)
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Name).To(Equal("indexed"))
+
+		pod.Namespace = "other"
+		Expect(podEnqueue(fakeClient, ds)(ctx, pod)).To(BeEmpty())
+	})
 })
@@ -0,0 +1,379 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// mirroredPolicyPrefix prefixes the name of the mirrored NetworkPolicies in the datastore and the ruleset.
+// The colon is not valid in object names, so a mirrored NetworkPolicy never collides with a MultiNetworkPolicy.
+const mirroredPolicyPrefix = "networkpolicy:"
+
+// NetworkPolicyReconciler mirrors the NetworkPolicies opted in with the mirror-to annotation onto secondary networks
+type NetworkPolicyReconciler struct {
+	client.Client
+	// Policies applies the mirrored NetworkPolicies like MultiNetworkPolicies
+	Policies *MultiNetworkReconciler
+
+	// resync receives the NetworkPolicies to reconcile again after a configuration change
+	resync chan event.GenericEvent
+	// staleness tracks the NetworkPolicies enqueued and not reconciled yet
+	staleness *stalenessTracker
+}
+
+// Resync enqueues all the NetworkPolicies to apply a configuration change
+func (r *NetworkPolicyReconciler) Resync(ctx context.Context) error {
+	if r.resync == nil {
+		return fmt.Errorf("controller is not set up")
+	}
+
+	policies := &networkingv1.NetworkPolicyList{}
+	if err := r.Client.List(ctx, policies); err != nil {
+		return fmt.Errorf("failed to list network policies: %w", err)
+	}
+
+	for i := range policies.Items {
+		select {
+		case r.resync <- event.GenericEvent{Object: &policies.Items[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Enqueue enqueues the NetworkPolicies of the mirrored policies of the datastore, the MultiNetworkPolicies are skipped
+func (r *NetworkPolicyReconciler) Enqueue(ctx context.Context, policies []types.NamespacedName) error {
+	if r.resync == nil {
+		return fmt.Errorf("controller is not set up")
+	}
+
+	for _, key := range policies {
+		name, ok := strings.CutPrefix(key.Name, mirroredPolicyPrefix)
+		if !ok {
+			continue
+		}
+
+		policy := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: name}}
+		select {
+		case r.resync <- event.GenericEvent{Object: policy}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Reconcile applies or cleans up the mirror of a NetworkPolicy
+func (r *NetworkPolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	start := time.Now()
+	result, err := r.reconcile(ctx, req)
+	if err == nil && r.staleness != nil {
+		r.staleness.done("networkpolicy", req, start)
+	}
+
+	return result, err
+}
+
+// reconcile applies or cleans up the mirror of a NetworkPolicy
+func (r *NetworkPolicyReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	name := mirroredPolicyName(req.Name)
+
+	networkPolicy := &networkingv1.NetworkPolicy{}
+	err := r.Client.Get(ctx, req.NamespacedName, networkPolicy)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "Failed to get network policy")
+			return ctrl.Result{}, err
+		}
+
+		logger.V(1).Info("NetworkPolicy not found, it might have been deleted")
+		r.Policies.DS.UnindexPolicy(types.NamespacedName{Namespace: req.Namespace, Name: name})
+		return ctrl.Result{}, r.Policies.cleanUpPolicy(ctx, name, req.Namespace, logger)
+	}
+
+	mirrorTo, err := getMirrorTo(ctx, r.Client, networkPolicy)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if mirrorTo == "" {
+		logger.V(1).Info("NetworkPolicy is not mirrored")
+		r.Policies.DS.UnindexPolicy(types.NamespacedName{Namespace: req.Namespace, Name: name})
+		return ctrl.Result{}, r.Policies.cleanUpPolicy(ctx, name, req.Namespace, logger)
+	}
+
+	return r.Policies.processPolicy(ctx, mirrorNetworkPolicy(networkPolicy, mirrorTo), logger)
+}
+
+// mirroredPolicyName returns the name of the mirror of a NetworkPolicy
+func mirroredPolicyName(name string) string {
+	return mirroredPolicyPrefix + name
+}
+
+// getMirrorTo returns the networks a NetworkPolicy is mirrored to, from the annotation of the NetworkPolicy or else
+// of its namespace. An empty value means the NetworkPolicy is not mirrored.
+func getMirrorTo(ctx context.Context, clt client.Client, networkPolicy *networkingv1.NetworkPolicy) (string, error) {
+	if mirrorTo, ok := networkPolicy.GetAnnotations()[datastore.MirrorToAnnotation]; ok {
+		return strings.TrimSpace(mirrorTo), nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := clt.Get(ctx, types.NamespacedName{Name: networkPolicy.Namespace}, namespace); err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("failed to get namespace: %w", err)
+	}
+
+	return strings.TrimSpace(namespace.GetAnnotations()[datastore.MirrorToAnnotation]), nil
+}
+
+// mirrorNetworkPolicy converts a NetworkPolicy to a MultiNetworkPolicy for the networks of mirrorTo
+func mirrorNetworkPolicy(networkPolicy *networkingv1.NetworkPolicy, mirrorTo string) *multiv1beta1.MultiNetworkPolicy {
+	spec := networkPolicy.Spec.DeepCopy()
+
+	annotations := map[string]string{}
+	for key, value := range networkPolicy.GetAnnotations() {
+		annotations[key] = value
+	}
+	annotations[datastore.PolicyForAnnotation] = mirrorTo
+
+	policy := &multiv1beta1.MultiNetworkPolicy{}
+	policy.Name = mirroredPolicyName(networkPolicy.Name)
+	policy.Namespace = networkPolicy.Namespace
+	policy.Generation = networkPolicy.Generation
+	policy.UID = networkPolicy.UID
+	policy.Annotations = annotations
+	policy.Spec.PodSelector = spec.PodSelector
+
+	for _, policyType := range spec.PolicyTypes {
+		policy.Spec.PolicyTypes = append(policy.Spec.PolicyTypes, multiv1beta1.MultiPolicyType(policyType))
+	}
+
+	for _, rule := range spec.Ingress {
+		policy.Spec.Ingress = append(policy.Spec.Ingress, multiv1beta1.MultiNetworkPolicyIngressRule{
+			Ports: mirrorPorts(rule.Ports),
+			From:  mirrorPeers(rule.From),
+		})
+	}
+
+	for _, rule := range spec.Egress {
+		policy.Spec.Egress = append(policy.Spec.Egress, multiv1beta1.MultiNetworkPolicyEgressRule{
+			Ports: mirrorPorts(rule.Ports),
+			To:    mirrorPeers(rule.To),
+		})
+	}
+
+	return policy
+}
+
+func mirrorPorts(ports []networkingv1.NetworkPolicyPort) []multiv1beta1.MultiNetworkPolicyPort {
+	var mirrored []multiv1beta1.MultiNetworkPolicyPort
+	for _, port := range ports {
+		mirrored = append(mirrored, multiv1beta1.MultiNetworkPolicyPort{Protocol: port.Protocol, Port: port.Port, EndPort: port.EndPort})
+	}
+
+	return mirrored
+}
+
+func mirrorPeers(peers []networkingv1.NetworkPolicyPeer) []multiv1beta1.MultiNetworkPolicyPeer {
+	var mirrored []multiv1beta1.MultiNetworkPolicyPeer
+	for _, peer := range peers {
+		mirroredPeer := multiv1beta1.MultiNetworkPolicyPeer{PodSelector: peer.PodSelector, NamespaceSelector: peer.NamespaceSelector}
+		if peer.IPBlock != nil {
+			mirroredPeer.IPBlock = &multiv1beta1.IPBlock{CIDR: peer.IPBlock.CIDR, Except: peer.IPBlock.Except}
+		}
+		mirrored = append(mirrored, mirroredPeer)
+	}
+
+	return mirrored
+}
+
+// networkPolicyEnqueue returns a function that enqueues the mirrored NetworkPolicies affected by an event. Only the
+// candidates returned by the reverse index of the datastore are checked, instead of all the NetworkPolicies.
+func networkPolicyEnqueue(clt client.Client, candidates func(obj client.Object) []types.NamespacedName, isAffected func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, logger logr.Logger) bool) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		logger := log.FromContext(ctx).WithValues("object", obj.GetName(), "namespace", obj.GetNamespace())
+
+		var requests []reconcile.Request
+		for _, candidate := range candidates(obj) {
+			name, ok := strings.CutPrefix(candidate.Name, mirroredPolicyPrefix)
+			if !ok {
+				continue
+			}
+
+			namespaceName := types.NamespacedName{Namespace: candidate.Namespace, Name: name}
+			networkPolicy := &networkingv1.NetworkPolicy{}
+			if err := clt.Get(ctx, namespaceName, networkPolicy); err != nil {
+				if !errors.IsNotFound(err) {
+					logger.Error(err, "Failed to get network policy", "networkPolicy", namespaceName)
+				}
+				continue
+			}
+
+			mirrorTo, err := getMirrorTo(ctx, clt, networkPolicy)
+			if err != nil {
+				logger.Error(err, "Failed to get mirror-to annotation", "networkPolicy", networkPolicy.Name)
+				continue
+			}
+			if mirrorTo == "" {
+				continue
+			}
+
+			if isAffected(mirrorNetworkPolicy(networkPolicy, mirrorTo), obj, logger) {
+				logger.Info("NetworkPolicy is affected", "networkPolicy", namespaceName)
+				requests = append(requests, reconcile.Request{NamespacedName: namespaceName})
+			}
+		}
+
+		return requests
+	}
+}
+
+// namespaceMirrorEnqueue returns a function that enqueues all the NetworkPolicies of a namespace, when its mirror-to
+// annotation changes
+func namespaceMirrorEnqueue(clt client.Client) handler.MapFunc {
+	return func(ctx context.Context, ns client.Object) []reconcile.Request {
+		logger := log.FromContext(ctx).WithValues("namespace", ns.GetName())
+
+		var networkPolicies networkingv1.NetworkPolicyList
+		if err := clt.List(ctx, &networkPolicies, client.InNamespace(ns.GetName())); err != nil {
+			logger.Error(err, "Failed to list network policies")
+			return []reconcile.Request{}
+		}
+
+		var requests []reconcile.Request
+		for _, networkPolicy := range networkPolicies.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: networkPolicy.Namespace, Name: networkPolicy.Name}})
+		}
+
+		return requests
+	}
+}
+
+// NamespaceMirrorPredicate is a predicate that only allows updates changing the mirror-to annotation of a namespace
+var NamespaceMirrorPredicate = predicate.Funcs{
+	CreateFunc: func(_ event.CreateEvent) bool {
+		// The NetworkPolicies of a new namespace are reconciled on their own create events
+		return false
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return e.ObjectOld.GetAnnotations()[datastore.MirrorToAnnotation] != e.ObjectNew.GetAnnotations()[datastore.MirrorToAnnotation]
+	},
+	DeleteFunc: func(_ event.DeleteEvent) bool {
+		return false
+	},
+	GenericFunc: func(_ event.GenericEvent) bool {
+		return false
+	},
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NetworkPolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	maxConcurrentReconciles := r.Policies.MaxConcurrentReconciles
+	if maxConcurrentReconciles < 1 {
+		maxConcurrentReconciles = 1
+	}
+
+	r.resync = make(chan event.GenericEvent)
+	ds := r.Policies.DS
+	limiter := newEventRateLimiter(r.Policies.PolicyEventQPS, r.Policies.PolicyEventBurst)
+	// The networks of the pods are shared with the MultiNetworkPolicy controller when it is set up first
+	podNetworks := r.Policies.podNetworks
+	if podNetworks == nil {
+		podNetworks = newPodNetworkIndex()
+	}
+	// The stale changes are tracked with the MultiNetworkPolicy controller when it is set up first
+	r.staleness = r.Policies.staleness
+	if r.staleness == nil {
+		r.staleness = newStalenessTracker()
+		metrics.SetStaleEnforcementSource(r.staleness.oldest)
+	}
+
+	podEnqueue := networkPolicyEnqueue(mgr.GetClient(), func(obj client.Object) []types.NamespacedName {
+		return ds.PoliciesForPod(obj.GetNamespace())
+	}, func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, logger logr.Logger) bool {
+		pod, ok := obj.(*corev1.Pod)
+		return ok && isPolicyAffectedByPod(policy, pod, logger)
+	})
+
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named("networkpolicy").
+		For(&networkingv1.NetworkPolicy{}).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: maxConcurrentReconciles,
+			NewQueue:                r.staleness.newQueue(false, mgr.GetLogger()),
+		}).
+		Watches(
+			&corev1.Namespace{},
+			// The mirror-to annotation of the namespace applies to all its NetworkPolicies
+			handler.EnqueueRequestsFromMapFunc(namespaceMirrorEnqueue(mgr.GetClient())),
+			builder.WithPredicates(NamespaceMirrorPredicate),
+		).
+		Watches(
+			&corev1.Namespace{},
+			// We will enqueue mirrored policies with selectors that match the namespace
+			rateLimitedHandler("networkpolicy", limiter, handler.EnqueueRequestsFromMapFunc(networkPolicyEnqueue(mgr.GetClient(), func(client.Object) []types.NamespacedName {
+				return ds.PoliciesForNamespace()
+			}, func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, logger logr.Logger) bool {
+				namespace, ok := obj.(*corev1.Namespace)
+				return ok && isPolicyAffectedByNamespace(policy, namespace, logger)
+			}))),
+			builder.WithPredicates(namespaceSelectorCacheInvalidator(r.Policies.Selectors), NamespacePredicate),
+		).
+		Watches(
+			&corev1.Pod{},
+			// We will enqueue mirrored policies with selectors that match the pod
+			rateLimitedHandler("networkpolicy", limiter, handler.EnqueueRequestsFromMapFunc(podEnqueue)),
+			builder.WithPredicates(podSelectorCacheInvalidator(r.Policies.Selectors), enforceablePodPredicate("networkpolicy", podNetworks, ds), PodPredicate),
+		).
+		Watches(
+			&netdefv1.NetworkAttachmentDefinition{},
+			// We will enqueue mirrored policies with networks that match the network attachment definition
+			rateLimitedHandler("networkpolicy", limiter, handler.EnqueueRequestsFromMapFunc(networkPolicyEnqueue(mgr.GetClient(), func(obj client.Object) []types.NamespacedName {
+				return ds.PoliciesForNetwork(obj.GetNamespace(), obj.GetName())
+			}, func(policy *multiv1beta1.MultiNetworkPolicy, obj client.Object, _ logr.Logger) bool {
+				return isPolicyAffectedByNetwork(policy, obj.GetNamespace(), obj.GetName())
+			}))),
+			builder.WithPredicates(NetworkAttachmentDefinitionPredicate),
+		).
+		// Mirrored policies are resynced on configuration changes
+		WatchesRawSource(source.Channel(r.resync, &handler.EnqueueRequestForObject{}))
+
+	if r.Policies.Reservations != nil {
+		// The addresses reserved by whereabouts resolve the peers before their network status is reported
+		b = b.Watches(newIPPool(), rateLimitedHandler("networkpolicy", limiter, reservationHandler(mgr.GetClient(), r.Policies.Reservations, r.Policies.Selectors, podEnqueue)))
+	}
+
+	return b.Complete(r)
+}
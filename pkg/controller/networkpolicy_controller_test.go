@@ -0,0 +1,272 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// fakePolicySyncer records the synced policies
+type fakePolicySyncer struct {
+	operations []nftables.SyncOperation
+}
+
+func (f *fakePolicySyncer) SyncPolicy(_ context.Context, _ *datastore.Policy, operation nftables.SyncOperation, _ logr.Logger) error {
+	f.operations = append(f.operations, operation)
+	return nil
+}
+
+// fakePolicyDiffer records the synced policies and the dry-run policies
+type fakePolicyDiffer struct {
+	fakePolicySyncer
+	diffed []*datastore.Policy
+}
+
+func (f *fakePolicyDiffer) DiffPolicy(_ context.Context, policy *datastore.Policy, _ *datastore.Policy, _ logr.Logger) (*nftables.PolicyDiff, error) {
+	f.diffed = append(f.diffed, policy)
+	return &nftables.PolicyDiff{Node: "node-1", Pods: 2, RulesAdded: 3, RulesRemoved: 1}, nil
+}
+
+// fakeNetworkEnforcer records the synced policies and enforces them on the networks
+type fakeNetworkEnforcer struct {
+	fakePolicySyncer
+	networks []string
+}
+
+func (f *fakeNetworkEnforcer) EnforcedNetworks(_ context.Context, _ *datastore.Policy) ([]string, error) {
+	return f.networks, nil
+}
+
+var _ = Describe("NetworkPolicyReconciler", func() {
+	var (
+		ctx        context.Context
+		k8sClient  client.Client
+		syncer     *fakePolicySyncer
+		ds         *datastore.Datastore
+		reconciler *NetworkPolicyReconciler
+		req        ctrl.Request
+		mirrorKey  types.NamespacedName
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(networkingv1.AddToScheme(scheme)).To(Succeed())
+		Expect(netdefv1.AddToScheme(scheme)).To(Succeed())
+
+		k8sClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			&netdefv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "macvlan-net", Namespace: "default"},
+				Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: `{"cniVersion": "0.3.1", "type": "macvlan"}`},
+			},
+		).Build()
+
+		syncer = &fakePolicySyncer{}
+		ds = &datastore.Datastore{Policies: map[types.NamespacedName]*datastore.Policy{}}
+		reconciler = &NetworkPolicyReconciler{
+			Client: k8sClient,
+			Policies: &MultiNetworkReconciler{
+				Client:       k8sClient,
+				DS:           ds,
+				NFT:          syncer,
+				ValidPlugins: []string{"macvlan"},
+			},
+		}
+
+		req = ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web"}}
+		mirrorKey = types.NamespacedName{Namespace: "default", Name: "networkpolicy:web"}
+	})
+
+	newNetworkPolicy := func(annotations map[string]string) *networkingv1.NetworkPolicy {
+		return &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			},
+		}
+	}
+
+	It("should ignore the NetworkPolicies without the mirror-to annotation", func() {
+		Expect(k8sClient.Create(ctx, newNetworkPolicy(nil))).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncer.operations).To(BeEmpty())
+		Expect(ds.GetPolicy(mirrorKey)).To(BeNil())
+	})
+
+	It("should mirror the annotated NetworkPolicies and clean them up when deleted", func() {
+		networkPolicy := newNetworkPolicy(map[string]string{datastore.MirrorToAnnotation: "macvlan-*"})
+		Expect(k8sClient.Create(ctx, networkPolicy)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncer.operations).To(Equal([]nftables.SyncOperation{nftables.SyncOperationCreate}))
+
+		policy := ds.GetPolicy(mirrorKey)
+		Expect(policy).NotTo(BeNil())
+		Expect(policy.Networks).To(Equal([]string{"default/macvlan-net"}))
+		Expect(policy.Spec.PolicyTypes).To(Equal([]datastore.PolicyType{datastore.PolicyTypeIngress}))
+
+		Expect(k8sClient.Delete(ctx, networkPolicy)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncer.operations).To(Equal([]nftables.SyncOperation{nftables.SyncOperationCreate, nftables.SyncOperationDelete}))
+		Expect(ds.GetPolicy(mirrorKey)).To(BeNil())
+	})
+
+	It("should report the changes of the dry-run policies without applying them", func() {
+		differ := &fakePolicyDiffer{}
+		recorder := record.NewFakeRecorder(10)
+		reconciler.Policies.NFT = differ
+		reconciler.Policies.Recorder = recorder
+
+		networkPolicy := newNetworkPolicy(map[string]string{datastore.MirrorToAnnotation: "macvlan-net"})
+		Expect(k8sClient.Create(ctx, networkPolicy)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		enforced := ds.GetPolicy(mirrorKey)
+		Expect(enforced).NotTo(BeNil())
+
+		Expect(k8sClient.Get(ctx, req.NamespacedName, networkPolicy)).To(Succeed())
+		networkPolicy.Annotations[datastore.DryRunAnnotation] = "true"
+		networkPolicy.Spec.PolicyTypes = append(networkPolicy.Spec.PolicyTypes, networkingv1.PolicyTypeEgress)
+		Expect(k8sClient.Update(ctx, networkPolicy)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(differ.diffed).To(HaveLen(1))
+		Expect(differ.diffed[0].Spec.PolicyTypes).To(ContainElement(datastore.PolicyTypeEgress))
+		Expect(recorder.Events).To(Receive(Equal("Normal DryRun Policy not applied on node node-1: 2 pods affected, 3 rules added, 1 rules removed")))
+
+		// The enforced version is kept and synced again
+		Expect(ds.GetPolicy(mirrorKey)).To(BeIdenticalTo(enforced))
+		Expect(differ.operations).To(Equal([]nftables.SyncOperation{nftables.SyncOperationCreate, nftables.SyncOperationCreate}))
+
+		// An invalid value enforces the policy
+		Expect(k8sClient.Get(ctx, req.NamespacedName, networkPolicy)).To(Succeed())
+		networkPolicy.Annotations[datastore.DryRunAnnotation] = "maybe"
+		Expect(k8sClient.Update(ctx, networkPolicy)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(differ.diffed).To(HaveLen(1))
+		Expect(ds.GetPolicy(mirrorKey).Spec.PolicyTypes).To(ContainElement(datastore.PolicyTypeEgress))
+	})
+
+	It("should mirror the NetworkPolicies of an annotated namespace", func() {
+		namespace := &corev1.Namespace{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "default"}, namespace)).To(Succeed())
+		namespace.Annotations = map[string]string{datastore.MirrorToAnnotation: "macvlan-net"}
+		Expect(k8sClient.Update(ctx, namespace)).To(Succeed())
+
+		Expect(k8sClient.Create(ctx, newNetworkPolicy(nil))).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.GetPolicy(mirrorKey)).NotTo(BeNil())
+
+		// An empty annotation on the NetworkPolicy opts it out of the mirroring of the namespace
+		networkPolicy := &networkingv1.NetworkPolicy{}
+		Expect(k8sClient.Get(ctx, req.NamespacedName, networkPolicy)).To(Succeed())
+		networkPolicy.Annotations = map[string]string{datastore.MirrorToAnnotation: ""}
+		Expect(k8sClient.Update(ctx, networkPolicy)).To(Succeed())
+
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ds.GetPolicy(mirrorKey)).To(BeNil())
+	})
+
+	It("should report the invalid rules on the NetworkPolicy", func() {
+		recorder := record.NewFakeRecorder(10)
+		reconciler.Policies.Recorder = recorder
+
+		protocol := corev1.Protocol("TPC")
+		networkPolicy := newNetworkPolicy(map[string]string{datastore.MirrorToAnnotation: "macvlan-net"})
+		networkPolicy.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+			{},
+			{Ports: []networkingv1.NetworkPolicyPort{{Protocol: &protocol}}},
+		}
+		Expect(k8sClient.Create(ctx, networkPolicy)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(syncer.operations).To(Equal([]nftables.SyncOperation{nftables.SyncOperationCreate}))
+
+		Expect(recorder.Events).To(Receive(Equal(`Warning InvalidPolicyRule Rule not applied, ingress rule 1: port 0: unsupported protocol "TPC", expected one of TCP, UDP or SCTP`)))
+	})
+
+	It("should only report the invalid rules on the nodes enforcing the policy", func() {
+		recorder := record.NewFakeRecorder(10)
+		enforcer := &fakeNetworkEnforcer{}
+		reconciler.Policies.Recorder = recorder
+		reconciler.Policies.NFT = enforcer
+
+		protocol := corev1.Protocol("TPC")
+		networkPolicy := newNetworkPolicy(map[string]string{datastore.MirrorToAnnotation: "macvlan-net"})
+		networkPolicy.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{{Ports: []networkingv1.NetworkPolicyPort{{Protocol: &protocol}}}}
+		Expect(k8sClient.Create(ctx, networkPolicy)).To(Succeed())
+
+		_, err := reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(enforcer.operations).To(Equal([]nftables.SyncOperation{nftables.SyncOperationCreate}))
+		Expect(recorder.Events).NotTo(Receive())
+
+		enforcer.networks = []string{"default/macvlan-net"}
+		_, err = reconciler.Reconcile(ctx, req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recorder.Events).To(Receive(ContainSubstring("InvalidPolicyRule")))
+	})
+
+	It("should convert the NetworkPolicy to a MultiNetworkPolicy", func() {
+		tcp := corev1.ProtocolTCP
+		port := intstr.FromInt32(5432)
+
+		networkPolicy := newNetworkPolicy(map[string]string{datastore.DefaultVerdictAnnotation: "reject"})
+		networkPolicy.Spec.Egress = []networkingv1.NetworkPolicyEgressRule{{
+			Ports: []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+			To: []networkingv1.NetworkPolicyPeer{
+				{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.0.1.0/24"}}},
+			},
+		}}
+
+		policy := mirrorNetworkPolicy(networkPolicy, "macvlan-net")
+		Expect(policy.Name).To(Equal("networkpolicy:web"))
+		Expect(policy.Annotations).To(Equal(map[string]string{
+			datastore.DefaultVerdictAnnotation: "reject",
+			datastore.PolicyForAnnotation:      "macvlan-net",
+		}))
+		Expect(policy.Spec.Egress).To(Equal([]multiv1beta1.MultiNetworkPolicyEgressRule{{
+			Ports: []multiv1beta1.MultiNetworkPolicyPort{{Protocol: &tcp, Port: &port}},
+			To: []multiv1beta1.MultiNetworkPolicyPeer{
+				{IPBlock: &multiv1beta1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.0.1.0/24"}}},
+			},
+		}}))
+
+		// The NetworkPolicy is not modified
+		Expect(networkPolicy.Annotations).NotTo(HaveKey(datastore.PolicyForAnnotation))
+	})
+})
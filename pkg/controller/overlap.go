@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strings"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// ipamSubnetNetConf is the configuration of the subnets of the host-local, static and whereabouts IPAM plugins
+type ipamSubnetNetConf struct {
+	IPAM struct {
+		Subnet string `json:"subnet,omitempty"`
+		Ranges [][]struct {
+			Subnet string `json:"subnet,omitempty"`
+		} `json:"ranges,omitempty"`
+		Addresses []struct {
+			Address string `json:"address,omitempty"`
+		} `json:"addresses,omitempty"`
+		Range    string `json:"range,omitempty"`
+		IPRanges []struct {
+			Range string `json:"range,omitempty"`
+		} `json:"ipRanges,omitempty"`
+	} `json:"ipam"`
+}
+
+// getIPAMSubnets returns the unique subnets of the IPAM configuration of the first plugin of a network attachment
+// definition, masked. The invalid subnets are skipped, an invalid configuration has none.
+func getIPAMSubnets(netAttachDef *netdefv1.NetworkAttachmentDefinition) []netip.Prefix {
+	netconf, err := utils.ParseFirstPluginConf[ipamSubnetNetConf](netAttachDef)
+	if err != nil {
+		return nil
+	}
+
+	values := []string{netconf.IPAM.Subnet, netconf.IPAM.Range}
+	for _, rangeSet := range netconf.IPAM.Ranges {
+		for _, r := range rangeSet {
+			values = append(values, r.Subnet)
+		}
+	}
+	for _, address := range netconf.IPAM.Addresses {
+		values = append(values, address.Address)
+	}
+	for _, ipRange := range netconf.IPAM.IPRanges {
+		values = append(values, ipRange.Range)
+	}
+
+	var subnets []netip.Prefix
+	for _, value := range values {
+		// The whereabouts ranges can be written as <first>-<last>/<length>, the subnet is the one of the last address
+		if i := strings.LastIndex(value, "-"); i >= 0 {
+			value = value[i+1:]
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			continue
+		}
+
+		prefix = prefix.Masked()
+		if !slices.Contains(subnets, prefix) {
+			subnets = append(subnets, prefix)
+		}
+	}
+
+	return subnets
+}
+
+// networkOverlap is a peer network whose subnets overlap the subnets of a network of a policy
+type networkOverlap struct {
+	Network     string
+	PeerNetwork string
+}
+
+// getOverlappingPeerNetworks returns the peer networks whose subnets overlap the subnets of the networks of a policy,
+// the patterns of the peer networks expanded to the matching network attachment definitions. The peer networks which
+// are networks of the policy are not, their addresses are only allowed on their own interfaces.
+func (m *MultiNetworkReconciler) getOverlappingPeerNetworks(ctx context.Context, networks []string, peerNetworks []string) ([]networkOverlap, error) {
+	subnets := make(map[string][]netip.Prefix)
+	for _, network := range networks {
+		namespace, name, _ := strings.Cut(network, "/")
+
+		netAttachDefs, err := m.getNetworkAttachmentDefinitions(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, netAttachDef := range netAttachDefs {
+			subnets[network] = append(subnets[network], getIPAMSubnets(&netAttachDef)...)
+		}
+	}
+
+	var overlaps []networkOverlap
+	for _, peerNetwork := range peerNetworks {
+		namespace, name, found := strings.Cut(peerNetwork, "/")
+		if !found {
+			continue
+		}
+
+		netAttachDefs, err := m.getNetworkAttachmentDefinitions(ctx, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, netAttachDef := range netAttachDefs {
+			matchedNetwork := netAttachDef.Namespace + "/" + netAttachDef.Name
+			if slices.Contains(networks, matchedNetwork) {
+				continue
+			}
+
+			peerSubnets := getIPAMSubnets(&netAttachDef)
+			for _, network := range networks {
+				overlap := networkOverlap{Network: network, PeerNetwork: matchedNetwork}
+				if overlapping(subnets[network], peerSubnets) && !slices.Contains(overlaps, overlap) {
+					overlaps = append(overlaps, overlap)
+				}
+			}
+		}
+	}
+
+	return overlaps, nil
+}
+
+// overlapping returns whether a subnet of a network overlaps a subnet of another network
+func overlapping(subnets []netip.Prefix, otherSubnets []netip.Prefix) bool {
+	for _, subnet := range subnets {
+		for _, otherSubnet := range otherSubnets {
+			if subnet.Overlaps(otherSubnet) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
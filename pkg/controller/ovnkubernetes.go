@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
+)
+
+// ovnKubernetesPlugin is the type of the secondary networks of OVN-Kubernetes
+const ovnKubernetesPlugin = "ovn-k8s-cni-overlay"
+
+// ovnKubernetesNetConf is the configuration of a secondary network of OVN-Kubernetes
+type ovnKubernetesNetConf struct {
+	Type     string `json:"type"`
+	Topology string `json:"topology,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+// checkNetworkTopology checks that the topology of a network attachment definition can be enforced. The secondary
+// networks of OVN-Kubernetes are attached to the pods as an interface named by the network selection, as the other
+// plugins, with the layer2 and localnet topologies. The layer3 topology routes the traffic through the node and the
+// primary networks are not attached through the network selection, the policies cannot be bound to their interfaces.
+func checkNetworkTopology(netAttachDef *netdefv1.NetworkAttachmentDefinition, networkType string) error {
+	if networkType != ovnKubernetesPlugin {
+		return nil
+	}
+
+	confBytes, err := netdefutils.GetCNIConfigFromSpec(netAttachDef.Spec.Config, netAttachDef.Name)
+	if err != nil {
+		return err
+	}
+
+	netconf := &ovnKubernetesNetConf{}
+	if err := json.Unmarshal(confBytes, netconf); err != nil {
+		return err
+	}
+
+	if netconf.Role == "primary" {
+		return fmt.Errorf("primary networks are not supported")
+	}
+
+	switch netconf.Topology {
+	case "layer2", "localnet":
+		return nil
+	default:
+		return fmt.Errorf("topology %q is not supported", netconf.Topology)
+	}
+}
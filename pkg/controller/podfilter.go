@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"slices"
+	"sync"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// podNetworkIndex indexes the networks of the secondary interfaces of the pods, so that the network annotations of a
+// pod are parsed once per change instead of on every event of the pod. Only the pods with a network annotation are
+// indexed.
+type podNetworkIndex struct {
+	mu   sync.Mutex
+	pods map[types.NamespacedName]podNetworks
+}
+
+// podNetworks are the networks of the secondary interfaces of a pod, as <namespace>/<name>, along with the network
+// annotations they were parsed from
+type podNetworks struct {
+	annotation string
+	status     string
+	networks   []string
+}
+
+// newPodNetworkIndex returns an empty pod network index
+func newPodNetworkIndex() *podNetworkIndex {
+	return &podNetworkIndex{pods: make(map[types.NamespacedName]podNetworks)}
+}
+
+// networks returns the networks of the secondary interfaces of a pod, parsing them when its annotations changed
+func (i *podNetworkIndex) networks(pod *corev1.Pod) []string {
+	annotation := pod.Annotations[netdefv1.NetworkAttachmentAnnot]
+	status := pod.Annotations[netdefv1.NetworkStatusAnnot]
+	if annotation == "" || status == "" {
+		return nil
+	}
+
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if cached, ok := i.pods[key]; ok && cached.annotation == annotation && cached.status == status {
+		return cached.networks
+	}
+
+	var networks []string
+	for _, intf := range nftables.GetInterfaces(pod) {
+		if !slices.Contains(networks, intf.Network) {
+			networks = append(networks, intf.Network)
+		}
+	}
+
+	i.pods[key] = podNetworks{annotation: annotation, status: status, networks: networks}
+
+	return networks
+}
+
+// forget removes a deleted pod from the index
+func (i *podNetworkIndex) forget(pod client.Object) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.pods, types.NamespacedName{Namespace: pod.GetNamespace(), Name: pod.GetName()})
+}
+
+// enforceable checks if a pod has a secondary interface on a network of an indexed policy. The pods with only the
+// default network, or on networks no policy is for, can neither be selected by a policy nor be a peer of its rules.
+// A policy added for their networks lists the pods itself.
+func (i *podNetworkIndex) enforceable(obj client.Object, ds *datastore.Datastore) bool {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return false
+	}
+
+	return slices.ContainsFunc(i.networks(pod), ds.HasPoliciesForNetwork)
+}
+
+// enforceablePodPredicate is a predicate that filters out the events of the pods without an enforceable interface,
+// before the selectors of the policies are evaluated for them. It must be set after the selector cache invalidator.
+func enforceablePodPredicate(controller string, index *podNetworkIndex, ds *datastore.Datastore) predicate.Funcs {
+	filter := func(enforceable bool) bool {
+		if !enforceable {
+			metrics.FilteredPodEvents.WithLabelValues(controller).Inc()
+		}
+		return enforceable
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return filter(index.enforceable(e.Object, ds))
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			// The old pod is evaluated first, so that the index is left with the annotations of the new pod
+			oldEnforceable := index.enforceable(e.ObjectOld, ds)
+			return filter(index.enforceable(e.ObjectNew, ds) || oldEnforceable)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			enforceable := index.enforceable(e.Object, ds)
+			index.forget(e.Object)
+			return filter(enforceable)
+		},
+		GenericFunc: func(_ event.GenericEvent) bool {
+			return false
+		},
+	}
+}
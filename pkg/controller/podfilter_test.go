@@ -0,0 +1,61 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+var _ = Describe("enforceablePodPredicate", func() {
+	var (
+		ds    *datastore.Datastore
+		index *podNetworkIndex
+	)
+
+	BeforeEach(func() {
+		ds = &datastore.Datastore{Policies: make(map[types.NamespacedName]*datastore.Policy)}
+		ds.IndexPolicy(types.NamespacedName{Namespace: "default", Name: "policy"}, []string{"default/macvlan-net"}, &datastore.PolicySpec{})
+		index = newPodNetworkIndex()
+	})
+
+	It("should filter out the pods without an interface on a network of a policy", func() {
+		p := enforceablePodPredicate("test", index, ds)
+
+		enforced := newTestPod("default", "enforced", "node1", nil, "macvlan-net",
+			`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.1"]}]`)
+		other := newTestPod("default", "other", "node1", nil, "bridge-net",
+			`[{"name":"default/bridge-net","interface":"net1","ips":["10.1.0.1"]}]`)
+		defaultOnly := &corev1.Pod{}
+		defaultOnly.Name = "default-only"
+		defaultOnly.Namespace = "default"
+
+		Expect(p.Create(event.CreateEvent{Object: enforced})).To(BeTrue())
+		Expect(p.Create(event.CreateEvent{Object: other})).To(BeFalse())
+		Expect(p.Create(event.CreateEvent{Object: defaultOnly})).To(BeFalse())
+
+		// A policy added for the network makes its pods enforceable
+		ds.IndexPolicy(types.NamespacedName{Namespace: "default", Name: "wildcard"}, []string{"default/*"}, &datastore.PolicySpec{})
+		Expect(p.Create(event.CreateEvent{Object: other})).To(BeTrue())
+	})
+
+	It("should let through the updates of the pods leaving an enforceable network and forget the deleted pods", func() {
+		p := enforceablePodPredicate("test", index, ds)
+
+		oldPod := newTestPod("default", "pod", "node1", nil, "macvlan-net",
+			`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.1"]}]`)
+		newPod := newTestPod("default", "pod", "node1", nil, "bridge-net",
+			`[{"name":"default/bridge-net","interface":"net1","ips":["10.1.0.1"]}]`)
+
+		Expect(p.Update(event.UpdateEvent{ObjectOld: oldPod, ObjectNew: newPod})).To(BeTrue())
+		Expect(index.pods[types.NamespacedName{Namespace: "default", Name: "pod"}].networks).To(Equal([]string{"default/bridge-net"}))
+
+		Expect(p.Update(event.UpdateEvent{ObjectOld: newPod, ObjectNew: newPod})).To(BeFalse())
+
+		Expect(p.Delete(event.DeleteEvent{Object: oldPod})).To(BeTrue())
+		Expect(index.pods).To(BeEmpty())
+	})
+})
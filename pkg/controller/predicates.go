@@ -1,9 +1,13 @@
 package controller
 
 import (
+	"context"
+	"maps"
 	"reflect"
 
+	"github.com/go-logr/logr"
 	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
 	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
 	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -12,6 +16,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
 )
 
 // MultiNetworkPolicyPredicate is a predicate that checks if a policy is eligible for reconciliation
@@ -35,6 +40,9 @@ var MultiNetworkPolicyPredicate = predicate.Funcs{
 		if _, ok := e.ObjectNew.(*corev1.Namespace); ok {
 			return true
 		}
+		if _, ok := e.ObjectNew.(*netdefv1.NetworkAttachmentDefinition); ok {
+			return true
+		}
 
 		// Mark for deletion
 		if e.ObjectOld.GetDeletionTimestamp() == nil && e.ObjectNew.GetDeletionTimestamp() != nil {
@@ -65,6 +73,14 @@ var MultiNetworkPolicyPredicate = predicate.Funcs{
 			return true
 		}
 
+		// Interfaces, Port Presets, Connection Limit, Multicast Groups and External Peers Annotation Changes
+		for _, key := range []string{datastore.InterfacesAnnotation, datastore.PortPresetsAnnotation, datastore.ConnectionLimitAnnotation, datastore.MulticastGroupsAnnotation, datastore.ExternalPeersAnnotation} {
+			if oldAnnotations[key] != newAnnotations[key] {
+				log.Log.V(2).Info("MultiNetworkPolicyPredicate UpdateFunc", "reason", "Annotation changed", "annotation", key, "namespace", e.ObjectOld.GetNamespace(), "name", e.ObjectOld.GetName())
+				return true
+			}
+		}
+
 		return false
 	},
 	DeleteFunc: func(e event.DeleteEvent) bool {
@@ -76,8 +92,10 @@ var MultiNetworkPolicyPredicate = predicate.Funcs{
 
 		return true
 	},
-	GenericFunc: func(_ event.GenericEvent) bool {
-		return false
+	GenericFunc: func(e event.GenericEvent) bool {
+		// Generic events are only sent to resync policies after a configuration change
+		_, ok := e.Object.(*multiv1beta1.MultiNetworkPolicy)
+		return ok
 	},
 }
 
@@ -106,10 +124,64 @@ var NamespacePredicate = predicate.Funcs{
 	},
 }
 
+// NetworkAttachmentDefinitionPredicate is a predicate that allows create and delete events, and updates when the CNI config
+// or the hook, encapsulation and protocol presets annotations change.
+// The policies with a policy-for network matching the definition are re-evaluated, e.g. when a network matching a wildcard is added.
+var NetworkAttachmentDefinitionPredicate = predicate.Funcs{
+	CreateFunc: func(e event.CreateEvent) bool {
+		log.Log.V(2).Info("NetworkAttachmentDefinitionPredicate CreateFunc", "namespace", e.Object.GetNamespace(), "name", e.Object.GetName())
+		return true
+	},
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNetAttachDef, ok := e.ObjectOld.(*netdefv1.NetworkAttachmentDefinition)
+		if !ok {
+			return false
+		}
+		newNetAttachDef, ok := e.ObjectNew.(*netdefv1.NetworkAttachmentDefinition)
+		if !ok {
+			return false
+		}
+
+		// Only when the CNI config changes, the network type might have changed
+		if oldNetAttachDef.Spec.Config != newNetAttachDef.Spec.Config {
+			log.Log.V(2).Info("NetworkAttachmentDefinitionPredicate UpdateFunc", "reason", "Config changed", "namespace", e.ObjectNew.GetNamespace(), "name", e.ObjectNew.GetName())
+			return true
+		}
+
+		// The base chains of the network might have changed
+		for _, key := range []string{datastore.IngressHookAnnotation, datastore.EgressHookAnnotation} {
+			if oldNetAttachDef.Annotations[key] != newNetAttachDef.Annotations[key] {
+				log.Log.V(2).Info("NetworkAttachmentDefinitionPredicate UpdateFunc", "reason", "Hook changed", "namespace", e.ObjectNew.GetNamespace(), "name", e.ObjectNew.GetName())
+				return true
+			}
+		}
+
+		// The rules of the network match the inner or the outer headers, allow the protocol presets and the
+		// infrastructure addresses, drop the ICMP redirects, the router advertisements and the fragments, set the
+		// conntrack timeouts and match the IPv4 peers at their NAT64 addresses
+		for _, key := range []string{datastore.EncapsulationAnnotation, datastore.ProtocolPresetsAnnotation, datastore.ICMPHardeningAnnotation, datastore.TrustedGatewaysAnnotation, datastore.FragmentsAnnotation, datastore.ConntrackTimeoutsAnnotation, datastore.InfrastructureAddressesAnnotation, datastore.NAT64PrefixAnnotation} {
+			if oldNetAttachDef.Annotations[key] != newNetAttachDef.Annotations[key] {
+				log.Log.V(2).Info("NetworkAttachmentDefinitionPredicate UpdateFunc", "reason", "Annotation changed", "annotation", key, "namespace", e.ObjectNew.GetNamespace(), "name", e.ObjectNew.GetName())
+				return true
+			}
+		}
+
+		return false
+	},
+	DeleteFunc: func(e event.DeleteEvent) bool {
+		log.Log.V(2).Info("NetworkAttachmentDefinitionPredicate DeleteFunc", "namespace", e.Object.GetNamespace(), "name", e.Object.GetName())
+		return true
+	},
+	GenericFunc: func(_ event.GenericEvent) bool {
+		return false
+	},
+}
+
 // PodPredicate is a predicate that checks if a pod is eligible for reconciliation
 // All events will check if the pod is eligible, except the delete event given that the pod might not be running.
 // This pod might be matched by a peer selector, so we need to reconcile it.
-// No need to reconcile when old and new are eligible on update events. Changes on secondary interfaces need a Pod restart.
+// No need to reconcile when old and new are eligible on update events, unless the labels or the interfaces annotation
+// change. Changes on secondary interfaces need a Pod restart.
 // And containerID of first container is always parsed by demand to get the netns path.
 var PodPredicate = predicate.Funcs{
 	CreateFunc: func(e event.CreateEvent) bool {
@@ -143,6 +215,13 @@ var PodPredicate = predicate.Funcs{
 				log.Log.V(2).Info("PodPredicate UpdateFunc", "reason", "Pod labels changed", "namespace", e.ObjectNew.GetNamespace(), "name", e.ObjectNew.GetName())
 				return true
 			}
+
+			for _, key := range []string{datastore.InterfacesAnnotation, datastore.InterfaceGroupsAnnotation} {
+				if e.ObjectOld.GetAnnotations()[key] != e.ObjectNew.GetAnnotations()[key] {
+					log.Log.V(2).Info("PodPredicate UpdateFunc", "reason", "Pod interfaces annotation changed", "annotation", key, "namespace", e.ObjectNew.GetNamespace(), "name", e.ObjectNew.GetName())
+					return true
+				}
+			}
 		}
 
 		return false
@@ -161,6 +240,110 @@ var PodPredicate = predicate.Funcs{
 	},
 }
 
+// podSelectorCacheInvalidator is a predicate that invalidates the pods of the selector cache on the pod events changing
+// what a selector matches, it lets all the events through. It must be set before the other predicates of the watch, so
+// that the cache is invalidated before the event is enqueued.
+func podSelectorCacheInvalidator(cache *nftables.SelectorCache) predicate.Funcs {
+	invalidate := func(obj client.Object) bool {
+		if cache != nil {
+			cache.InvalidatePods(obj.GetNamespace())
+		}
+		return true
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return invalidate(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldPod, oldOk := e.ObjectOld.(*corev1.Pod)
+			newPod, newOk := e.ObjectNew.(*corev1.Pod)
+			// The status updates not changing the phase are the most frequent and do not change the cached pods, nor do
+			// the enforcement status annotations stamped by the controllers
+			if oldOk && newOk && oldPod.Status.Phase == newPod.Status.Phase &&
+				reflect.DeepEqual(oldPod.Labels, newPod.Labels) && equalAnnotationsExceptEnforcementStatus(oldPod.Annotations, newPod.Annotations) {
+				return true
+			}
+			return invalidate(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return invalidate(e.Object)
+		},
+	}
+}
+
+// SandboxPrefetcher resolves the network namespace paths of the running pods of the node ahead of the syncs of the
+// policies
+type SandboxPrefetcher interface {
+	PrefetchSandbox(ctx context.Context, pod *corev1.Pod, logger logr.Logger)
+}
+
+var _ SandboxPrefetcher = &nftables.NFTables{}
+
+// sandboxPrefetcher is a predicate that starts resolving the network namespace path of a pod as soon as it runs, before
+// a sync of a policy needs it, it lets all the events through. The prefetcher ignores the pods of the other nodes and
+// the pods already resolved.
+func sandboxPrefetcher(prefetcher SandboxPrefetcher) predicate.Funcs {
+	prefetch := func(obj client.Object) bool {
+		if pod, ok := obj.(*corev1.Pod); ok && prefetcher != nil && pod.Status.Phase == corev1.PodRunning {
+			prefetcher.PrefetchSandbox(context.Background(), pod, log.Log.WithName("sandbox-prefetch"))
+		}
+		return true
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return prefetch(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return prefetch(e.ObjectNew)
+		},
+	}
+}
+
+// equalAnnotationsExceptEnforcementStatus compares the annotations of two versions of a pod, the enforcement status
+// annotation aside
+func equalAnnotationsExceptEnforcementStatus(oldAnnotations map[string]string, newAnnotations map[string]string) bool {
+	return maps.Equal(withoutKey(oldAnnotations, datastore.EnforcementStatusAnnotation), withoutKey(newAnnotations, datastore.EnforcementStatusAnnotation))
+}
+
+// withoutKey returns a copy of the map without a key, or the map itself when it does not have the key
+func withoutKey(m map[string]string, key string) map[string]string {
+	if _, ok := m[key]; !ok {
+		return m
+	}
+
+	copied := maps.Clone(m)
+	delete(copied, key)
+	return copied
+}
+
+// namespaceSelectorCacheInvalidator is a predicate that invalidates the namespaces of the selector cache on the
+// namespace events, it lets all the events through. It must be set before the other predicates of the watch.
+func namespaceSelectorCacheInvalidator(cache *nftables.SelectorCache) predicate.Funcs {
+	invalidate := func(_ client.Object) bool {
+		if cache != nil {
+			cache.InvalidateNamespaces()
+		}
+		return true
+	}
+
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return invalidate(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels()) {
+				return true
+			}
+			return invalidate(e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return invalidate(e.Object)
+		},
+	}
+}
+
 // isEligible checks if the object is eligible for reconciliation
 func isEligible(obj client.Object) bool {
 	pod, ok := obj.(*corev1.Pod)
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"time"
+
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/priorityqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// revocationPriority is the priority of the policies enqueued by the events removing access, above the priority 0 of
+// the other events, so that a revoked permission is not kept while the queue drains the events adding access
+const revocationPriority = 10
+
+// priorityQueue enqueues the policies with at least its priority
+type priorityQueue struct {
+	priorityqueue.PriorityQueue[reconcile.Request]
+	priority int
+}
+
+func (q priorityQueue) Add(req reconcile.Request) {
+	q.AddWithOpts(priorityqueue.AddOpts{}, req)
+}
+
+func (q priorityQueue) AddAfter(req reconcile.Request, duration time.Duration) {
+	q.AddWithOpts(priorityqueue.AddOpts{After: duration}, req)
+}
+
+func (q priorityQueue) AddWithOpts(opts priorityqueue.AddOpts, reqs ...reconcile.Request) {
+	opts.Priority = ptr.To(max(ptr.Deref(opts.Priority, 0), q.priority))
+	q.PriorityQueue.AddWithOpts(opts, reqs...)
+}
+
+// revocationHandler returns an event handler enqueueing the policies of a handler with the revocation priority when
+// the event removes access, as classified by the predicate. The other events, and all the events of a queue without
+// priorities, are enqueued as by the handler.
+func revocationHandler(revokes predicate.Predicate, h handler.EventHandler) handler.EventHandler {
+	wrap := func(revoking bool, q workqueue.TypedRateLimitingInterface[reconcile.Request]) workqueue.TypedRateLimitingInterface[reconcile.Request] {
+		pq, ok := q.(priorityqueue.PriorityQueue[reconcile.Request])
+		if !revoking || !ok {
+			return q
+		}
+
+		return priorityQueue{PriorityQueue: pq, priority: revocationPriority}
+	}
+
+	return handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.TypedCreateEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Create(ctx, e, wrap(revokes.Create(e), q))
+		},
+		UpdateFunc: func(ctx context.Context, e event.TypedUpdateEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Update(ctx, e, wrap(revokes.Update(e), q))
+		},
+		DeleteFunc: func(ctx context.Context, e event.TypedDeleteEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Delete(ctx, e, wrap(revokes.Delete(e), q))
+		},
+		GenericFunc: func(ctx context.Context, e event.TypedGenericEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Generic(ctx, e, wrap(revokes.Generic(e), q))
+		},
+	}
+}
+
+// podRevocations classifies the pod events removing access: a deleted or terminated pod, or a pod whose labels or
+// addresses changed, drops out of the peers of the policies
+var podRevocations = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldPod, ok := e.ObjectOld.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+		newPod, ok := e.ObjectNew.(*corev1.Pod)
+		if !ok {
+			return false
+		}
+
+		return newPod.DeletionTimestamp != nil ||
+			newPod.Status.Phase != oldPod.Status.Phase && newPod.Status.Phase != corev1.PodRunning ||
+			!reflect.DeepEqual(oldPod.Labels, newPod.Labels) ||
+			oldPod.Annotations[netdefv1.NetworkStatusAnnot] != newPod.Annotations[netdefv1.NetworkStatusAnnot]
+	},
+	DeleteFunc:  func(event.DeleteEvent) bool { return true },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// namespaceRevocations classifies the namespace events removing access: the pods of a deleted namespace, or of a
+// namespace whose labels changed, drop out of the peers of the policies
+var namespaceRevocations = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return false },
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return !reflect.DeepEqual(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels())
+	},
+	DeleteFunc:  func(event.DeleteEvent) bool { return true },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// policyRevocations classifies the policy events removing access: a deleted policy when another policy of its
+// namespace on one of its networks keeps the pods isolated, or an updated policy losing a rule, gaining a policy type
+// or selecting other pods
+func policyRevocations(ds *datastore.Datastore) predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(event.CreateEvent) bool { return false },
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldPolicy, ok := e.ObjectOld.(*multiv1beta1.MultiNetworkPolicy)
+			if !ok {
+				return false
+			}
+			newPolicy, ok := e.ObjectNew.(*multiv1beta1.MultiNetworkPolicy)
+			if !ok {
+				return false
+			}
+
+			return revokesAccess(datastore.PolicySpecFromV1beta1(&oldPolicy.Spec), datastore.PolicySpecFromV1beta1(&newPolicy.Spec))
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return keepsIsolation(ds, client.ObjectKeyFromObject(e.Object))
+		},
+		GenericFunc: func(event.GenericEvent) bool { return false },
+	}
+}
+
+// revokesAccess checks if a policy update can remove access: a rule is removed or changed, a policy type is added, or
+// the pod selector changed, which isolates the newly selected pods
+func revokesAccess(oldSpec datastore.PolicySpec, newSpec datastore.PolicySpec) bool {
+	if !reflect.DeepEqual(oldSpec.PodSelector, newSpec.PodSelector) {
+		return true
+	}
+
+	if deniesAll(newSpec) && !deniesAll(oldSpec) {
+		return true
+	}
+
+	for _, policyType := range newSpec.PolicyTypes {
+		if !slices.Contains(oldSpec.PolicyTypes, policyType) {
+			return true
+		}
+	}
+
+	for _, rule := range oldSpec.Ingress {
+		if !slices.ContainsFunc(newSpec.Ingress, func(r datastore.IngressRule) bool { return reflect.DeepEqual(r, rule) }) {
+			return true
+		}
+	}
+
+	for _, rule := range oldSpec.Egress {
+		if !slices.ContainsFunc(newSpec.Egress, func(r datastore.EgressRule) bool { return reflect.DeepEqual(r, rule) }) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// keepsIsolation checks if another policy of the namespace of a deleted policy applies to one of its networks, the
+// pods it selected may stay isolated and lose the traffic it allowed
+func keepsIsolation(ds *datastore.Datastore, key types.NamespacedName) bool {
+	deleted := ds.GetPolicy(key)
+	if deleted == nil {
+		return false
+	}
+
+	return slices.ContainsFunc(ds.ListPolicies(), func(policy *datastore.Policy) bool {
+		if policy.Namespace != deleted.Namespace || policy.Name == deleted.Name {
+			return false
+		}
+
+		return slices.ContainsFunc(policy.Networks, func(network string) bool {
+			return slices.Contains(deleted.Networks, network)
+		})
+	})
+}
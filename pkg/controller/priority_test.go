@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"context"
+
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/priorityqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+var _ = Describe("revocationHandler", func() {
+	// The handler enqueues the policy named by the label of the pod
+	mapFunc := handler.EnqueueRequestsFromMapFunc(func(_ context.Context, obj client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: obj.GetLabels()["policy"]}}}
+	})
+	podFor := func(policy string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "pod-" + policy, Namespace: "default", Labels: map[string]string{"policy": policy}},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}
+	}
+
+	It("should dequeue the policies of the events removing access first", func() {
+		queue := priorityqueue.New[reconcile.Request]("test")
+		DeferCleanup(queue.ShutDown)
+
+		h := revocationHandler(podRevocations, mapFunc)
+		ctx := context.Background()
+
+		h.Create(ctx, event.CreateEvent{Object: podFor("added")}, queue)
+		h.Delete(ctx, event.DeleteEvent{Object: podFor("revoked")}, queue)
+
+		Eventually(queue.Len).Should(Equal(2))
+		item, priority, _ := queue.GetWithPriority()
+		Expect(item.Name).To(Equal("revoked"))
+		Expect(priority).To(Equal(revocationPriority))
+		queue.Done(item)
+
+		item, priority, _ = queue.GetWithPriority()
+		Expect(item.Name).To(Equal("added"))
+		Expect(priority).To(BeZero())
+		queue.Done(item)
+	})
+
+	It("should classify the pod and namespace events removing access", func() {
+		pod := podFor("policy")
+
+		Expect(podRevocations.Create(event.CreateEvent{Object: pod})).To(BeFalse())
+		Expect(podRevocations.Delete(event.DeleteEvent{Object: pod})).To(BeTrue())
+		Expect(podRevocations.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: pod.DeepCopy()})).To(BeFalse())
+
+		relabeled := pod.DeepCopy()
+		relabeled.Labels["app"] = "other"
+		Expect(podRevocations.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: relabeled})).To(BeTrue())
+
+		terminated := pod.DeepCopy()
+		terminated.Status.Phase = corev1.PodSucceeded
+		Expect(podRevocations.Update(event.UpdateEvent{ObjectOld: pod, ObjectNew: terminated})).To(BeTrue())
+		Expect(podRevocations.Update(event.UpdateEvent{ObjectOld: terminated, ObjectNew: pod})).To(BeFalse())
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{"team": "a"}}}
+		relabeledNamespace := namespace.DeepCopy()
+		relabeledNamespace.Labels["team"] = "b"
+		Expect(namespaceRevocations.Update(event.UpdateEvent{ObjectOld: namespace, ObjectNew: namespace.DeepCopy()})).To(BeFalse())
+		Expect(namespaceRevocations.Update(event.UpdateEvent{ObjectOld: namespace, ObjectNew: relabeledNamespace})).To(BeTrue())
+	})
+
+	It("should classify the policy updates removing access", func() {
+		oldSpec := datastore.PolicySpec{
+			PolicyTypes: []datastore.PolicyType{datastore.PolicyTypeIngress},
+			Ingress:     []datastore.IngressRule{{From: []datastore.Peer{{IPBlock: &datastore.IPBlock{CIDR: "10.0.0.0/8"}}}}, {}},
+		}
+
+		added := oldSpec
+		added.Ingress = append(added.Ingress, datastore.IngressRule{From: []datastore.Peer{{IPBlock: &datastore.IPBlock{CIDR: "192.168.0.0/16"}}}})
+		Expect(revokesAccess(oldSpec, added)).To(BeFalse())
+
+		removed := oldSpec
+		removed.Ingress = oldSpec.Ingress[1:]
+		Expect(revokesAccess(oldSpec, removed)).To(BeTrue())
+
+		egress := oldSpec
+		egress.PolicyTypes = []datastore.PolicyType{datastore.PolicyTypeIngress, datastore.PolicyTypeEgress}
+		Expect(revokesAccess(oldSpec, egress)).To(BeTrue())
+
+		selector := oldSpec
+		selector.PodSelector = metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}
+		Expect(revokesAccess(oldSpec, selector)).To(BeTrue())
+	})
+
+	It("should prioritize the policy deletions keeping the pods isolated", func() {
+		ds := &datastore.Datastore{Policies: map[types.NamespacedName]*datastore.Policy{}}
+		ds.CreatePolicy(&datastore.Policy{Name: "allow", Namespace: "default", Networks: []string{"default/macvlan"}})
+		ds.CreatePolicy(&datastore.Policy{Name: "other-network", Namespace: "default", Networks: []string{"default/sriov"}})
+
+		revocations := policyRevocations(ds)
+		deleted := &multiv1beta1.MultiNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "allow", Namespace: "default"}}
+		Expect(revocations.Delete(event.DeleteEvent{Object: deleted})).To(BeFalse())
+
+		ds.CreatePolicy(&datastore.Policy{Name: "deny-all", Namespace: "default", Networks: []string{"default/macvlan"}})
+		Expect(revocations.Delete(event.DeleteEvent{Object: deleted})).To(BeTrue())
+	})
+})
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// maxEventRateLimiters is the number of policies above which the limiters back to their full burst are forgotten
+const maxEventRateLimiters = 4096
+
+// eventRateLimiter limits the rate of the events enqueueing each policy, so that a flapping pod enqueueing the same
+// policies over and over does not starve the reconciliation of the other policies
+type eventRateLimiter struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[reconcile.Request]*rate.Limiter
+	// pending are the times the delayed enqueues of the policies are due, the events received before are dropped
+	pending map[reconcile.Request]time.Time
+}
+
+// newEventRateLimiter returns a limiter of qps events per second for each policy above the burst, or nil when qps is 0
+func newEventRateLimiter(qps float64, burst int) *eventRateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+
+	return &eventRateLimiter{
+		limit:    rate.Limit(qps),
+		burst:    max(burst, 1),
+		limiters: make(map[reconcile.Request]*rate.Limiter),
+		pending:  make(map[reconcile.Request]time.Time),
+	}
+}
+
+// reserve returns the delay of the enqueue of a policy, or false when a delayed enqueue of the policy is already due
+// later
+func (l *eventRateLimiter) reserve(req reconcile.Request) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if due, ok := l.pending[req]; ok {
+		if now.Before(due) {
+			return 0, false
+		}
+		delete(l.pending, req)
+	}
+
+	limiter, ok := l.limiters[req]
+	if !ok {
+		if len(l.limiters) >= maxEventRateLimiters {
+			l.prune(now)
+		}
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[req] = limiter
+	}
+
+	delay := limiter.ReserveN(now, 1).DelayFrom(now)
+	if delay > 0 {
+		l.pending[req] = now.Add(delay)
+	}
+
+	return delay, true
+}
+
+// prune forgets the limiters back to their full burst, which are the same as new ones, the lock must be held
+func (l *eventRateLimiter) prune(now time.Time) {
+	for req, limiter := range l.limiters {
+		if _, ok := l.pending[req]; !ok && limiter.TokensAt(now) >= float64(l.burst) {
+			delete(l.limiters, req)
+		}
+	}
+}
+
+// rateLimitedQueue delays the enqueues of the policies above the rate of the limiter
+type rateLimitedQueue struct {
+	workqueue.TypedRateLimitingInterface[reconcile.Request]
+	controller string
+	limiter    *eventRateLimiter
+}
+
+// Add enqueues a policy, after a delay when the events of the policy are above the rate
+func (q rateLimitedQueue) Add(req reconcile.Request) {
+	delay, ok := q.limiter.reserve(req)
+	switch {
+	case !ok:
+		metrics.RateLimitedEvents.WithLabelValues(q.controller).Inc()
+	case delay > 0:
+		metrics.RateLimitedEvents.WithLabelValues(q.controller).Inc()
+		q.AddAfter(req, delay)
+	default:
+		q.TypedRateLimitingInterface.Add(req)
+	}
+}
+
+// rateLimitedHandler returns an event handler enqueueing the policies of a handler through a limiter, or the handler
+// itself when the limiter is nil
+func rateLimitedHandler(controller string, limiter *eventRateLimiter, h handler.EventHandler) handler.EventHandler {
+	if limiter == nil {
+		return h
+	}
+
+	wrap := func(q workqueue.TypedRateLimitingInterface[reconcile.Request]) workqueue.TypedRateLimitingInterface[reconcile.Request] {
+		return rateLimitedQueue{TypedRateLimitingInterface: q, controller: controller, limiter: limiter}
+	}
+
+	return handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.TypedCreateEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Create(ctx, e, wrap(q))
+		},
+		UpdateFunc: func(ctx context.Context, e event.TypedUpdateEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Update(ctx, e, wrap(q))
+		},
+		DeleteFunc: func(ctx context.Context, e event.TypedDeleteEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Delete(ctx, e, wrap(q))
+		},
+		GenericFunc: func(ctx context.Context, e event.TypedGenericEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			h.Generic(ctx, e, wrap(q))
+		},
+	}
+}
@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("rateLimitedHandler", func() {
+	var queue workqueue.TypedRateLimitingInterface[reconcile.Request]
+
+	flapping := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "flapping"}}
+	other := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "other"}}
+
+	// The handler enqueues the policy named by the label of the pod
+	mapFunc := handler.EnqueueRequestsFromMapFunc(func(_ context.Context, obj client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: obj.GetLabels()["policy"]}}}
+	})
+	podFor := func(policy string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", Labels: map[string]string{"policy": policy}}}
+	}
+
+	BeforeEach(func() {
+		queue = workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+		DeferCleanup(queue.ShutDown)
+	})
+
+	It("should return the handler itself without a rate", func() {
+		Expect(newEventRateLimiter(0, 10)).To(BeNil())
+		Expect(rateLimitedHandler("test", nil, mapFunc)).To(BeIdenticalTo(mapFunc))
+	})
+
+	It("should delay the events of a policy above its rate without delaying the other policies", func() {
+		h := rateLimitedHandler("test", newEventRateLimiter(2, 1), mapFunc)
+		ctx := context.Background()
+
+		h.Generic(ctx, event.GenericEvent{Object: podFor("flapping")}, queue)
+		Expect(queue.Len()).To(Equal(1))
+		item, _ := queue.Get()
+		Expect(item).To(Equal(flapping))
+		queue.Done(item)
+
+		// The events above the burst are merged into a single delayed enqueue
+		for range 10 {
+			h.Generic(ctx, event.GenericEvent{Object: podFor("flapping")}, queue)
+		}
+		Expect(queue.Len()).To(BeZero())
+
+		h.Generic(ctx, event.GenericEvent{Object: podFor("other")}, queue)
+		Expect(queue.Len()).To(Equal(1))
+		item, _ = queue.Get()
+		Expect(item).To(Equal(other))
+		queue.Done(item)
+
+		Eventually(queue.Len).WithTimeout(2 * time.Second).Should(Equal(1))
+		item, _ = queue.Get()
+		Expect(item).To(Equal(flapping))
+		queue.Done(item)
+		Consistently(queue.Len).WithTimeout(time.Second).Should(BeZero())
+	})
+})
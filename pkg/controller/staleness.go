@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/controller/priorityqueue"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// stalenessKey is a policy enqueued by a controller, the controllers enqueue policies of different kinds
+type stalenessKey struct {
+	controller string
+	request    reconcile.Request
+}
+
+// pendingChange is the first and the last time a policy was enqueued since it was last reconciled
+type pendingChange struct {
+	since time.Time
+	last  time.Time
+}
+
+// stalenessTracker tracks the policies enqueued and not reconciled yet, whose desired rulesets may differ from the
+// rulesets applied to the pods of the node, to report the age of the oldest change not enforced yet
+type stalenessTracker struct {
+	mu      sync.Mutex
+	pending map[stalenessKey]pendingChange
+	now     func() time.Time
+}
+
+func newStalenessTracker() *stalenessTracker {
+	return &stalenessTracker{
+		pending: make(map[stalenessKey]pendingChange),
+		now:     time.Now,
+	}
+}
+
+// mark records that a policy was enqueued, the first time is kept until it is reconciled
+func (t *stalenessTracker) mark(controller string, req reconcile.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	key := stalenessKey{controller: controller, request: req}
+	change, ok := t.pending[key]
+	if !ok {
+		change.since = now
+	}
+	change.last = now
+	t.pending[key] = change
+}
+
+// done records that a policy was reconciled successfully by a reconcile started at start. When it was enqueued again
+// during the reconcile, the change is kept as pending since the start.
+func (t *stalenessTracker) done(controller string, req reconcile.Request, start time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := stalenessKey{controller: controller, request: req}
+	change, ok := t.pending[key]
+	if !ok {
+		return
+	}
+
+	if !change.last.After(start) {
+		delete(t.pending, key)
+		return
+	}
+
+	change.since = start
+	t.pending[key] = change
+}
+
+// oldest returns the time of the oldest change not enforced yet, or false when all the policies are enforced
+func (t *stalenessTracker) oldest() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var oldest time.Time
+	for _, change := range t.pending {
+		if oldest.IsZero() || change.since.Before(oldest) {
+			oldest = change.since
+		}
+	}
+
+	return oldest, !oldest.IsZero()
+}
+
+// newQueue returns the NewQueue option of a controller, it creates the queue controller-runtime creates by default
+// and marks the enqueued policies as stale
+func (t *stalenessTracker) newQueue(usePriorityQueue bool, logger logr.Logger) func(string, workqueue.TypedRateLimiter[reconcile.Request]) workqueue.TypedRateLimitingInterface[reconcile.Request] {
+	return func(controllerName string, rateLimiter workqueue.TypedRateLimiter[reconcile.Request]) workqueue.TypedRateLimitingInterface[reconcile.Request] {
+		if usePriorityQueue {
+			return trackedPriorityQueue{
+				PriorityQueue: priorityqueue.New(controllerName, func(o *priorityqueue.Opts[reconcile.Request]) {
+					o.Log = logger.WithValues("controller", controllerName)
+					o.RateLimiter = rateLimiter
+				}),
+				tracker:    t,
+				controller: controllerName,
+			}
+		}
+
+		return trackedQueue{
+			TypedRateLimitingInterface: workqueue.NewTypedRateLimitingQueueWithConfig(rateLimiter, workqueue.TypedRateLimitingQueueConfig[reconcile.Request]{
+				Name: controllerName,
+			}),
+			tracker:    t,
+			controller: controllerName,
+		}
+	}
+}
+
+// trackedQueue marks the policies enqueued in a queue as stale
+type trackedQueue struct {
+	workqueue.TypedRateLimitingInterface[reconcile.Request]
+	tracker    *stalenessTracker
+	controller string
+}
+
+func (q trackedQueue) Add(req reconcile.Request) {
+	q.tracker.mark(q.controller, req)
+	q.TypedRateLimitingInterface.Add(req)
+}
+
+func (q trackedQueue) AddAfter(req reconcile.Request, duration time.Duration) {
+	q.tracker.mark(q.controller, req)
+	q.TypedRateLimitingInterface.AddAfter(req, duration)
+}
+
+// trackedPriorityQueue marks the policies enqueued in a priority queue as stale
+type trackedPriorityQueue struct {
+	priorityqueue.PriorityQueue[reconcile.Request]
+	tracker    *stalenessTracker
+	controller string
+}
+
+func (q trackedPriorityQueue) Add(req reconcile.Request) {
+	q.tracker.mark(q.controller, req)
+	q.PriorityQueue.Add(req)
+}
+
+func (q trackedPriorityQueue) AddAfter(req reconcile.Request, duration time.Duration) {
+	q.tracker.mark(q.controller, req)
+	q.PriorityQueue.AddAfter(req, duration)
+}
+
+func (q trackedPriorityQueue) AddWithOpts(opts priorityqueue.AddOpts, reqs ...reconcile.Request) {
+	for _, req := range reqs {
+		q.tracker.mark(q.controller, req)
+	}
+	q.PriorityQueue.AddWithOpts(opts, reqs...)
+}
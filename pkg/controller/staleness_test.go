@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/controller/priorityqueue"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("stalenessTracker", func() {
+	var (
+		tracker *stalenessTracker
+		now     time.Time
+	)
+
+	policy := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "policy"}}
+	other := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "other"}}
+
+	BeforeEach(func() {
+		now = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		tracker = newStalenessTracker()
+		tracker.now = func() time.Time { return now }
+	})
+
+	It("should report the oldest policy enqueued and not reconciled", func() {
+		_, ok := tracker.oldest()
+		Expect(ok).To(BeFalse())
+
+		tracker.mark("multinetworkpolicy", policy)
+		first := now
+		now = now.Add(time.Second)
+		tracker.mark("multinetworkpolicy", other)
+		tracker.mark("multinetworkpolicy", policy)
+
+		oldest, ok := tracker.oldest()
+		Expect(ok).To(BeTrue())
+		Expect(oldest).To(Equal(first))
+
+		tracker.done("multinetworkpolicy", policy, now)
+		oldest, _ = tracker.oldest()
+		Expect(oldest).To(Equal(now))
+
+		// The same name of another controller is another policy
+		tracker.done("networkpolicy", other, now)
+		tracker.done("multinetworkpolicy", other, now)
+		_, ok = tracker.oldest()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should keep the policies enqueued again during their reconcile", func() {
+		tracker.mark("multinetworkpolicy", policy)
+		start := now.Add(time.Second)
+		now = start.Add(time.Second)
+		tracker.mark("multinetworkpolicy", policy)
+
+		tracker.done("multinetworkpolicy", policy, start)
+		oldest, ok := tracker.oldest()
+		Expect(ok).To(BeTrue())
+		Expect(oldest).To(Equal(start))
+	})
+
+	It("should mark the policies added to the queues", func() {
+		queue := tracker.newQueue(false, logr.Discard())("test", workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+		DeferCleanup(queue.ShutDown)
+		queue.Add(policy)
+		Expect(tracker.pending).To(HaveKey(stalenessKey{controller: "test", request: policy}))
+
+		pq := tracker.newQueue(true, logr.Discard())("test-priority", workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+		DeferCleanup(pq.ShutDown)
+		Expect(pq).To(BeAssignableToTypeOf(trackedPriorityQueue{}))
+		pq.(priorityqueue.PriorityQueue[reconcile.Request]).AddWithOpts(priorityqueue.AddOpts{After: time.Hour}, other)
+		Expect(tracker.pending).To(HaveKey(stalenessKey{controller: "test-priority", request: other}))
+	})
+})
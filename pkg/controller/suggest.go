@@ -0,0 +1,329 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// generatedLabels are the labels set by the workload controllers that differ between the pods of a workload, they
+// are left out of the suggested selectors
+var generatedLabels = []string{
+	"pod-template-hash",
+	"controller-revision-hash",
+	"pod-template-generation",
+	"statefulset.kubernetes.io/pod-name",
+	"apps.kubernetes.io/pod-index",
+	"batch.kubernetes.io/controller-uid",
+	"batch.kubernetes.io/job-name",
+	"controller-uid",
+	"job-name",
+}
+
+// LearnedFlowLister lists the flows recorded by the learn verdict in the network namespaces of pods
+type LearnedFlowLister interface {
+	LearnedFlows(ctx context.Context, pods []corev1.Pod, logger logr.Logger) ([]nftables.LearnedFlow, error)
+}
+
+// PolicySuggester serves the MultiNetworkPolicies that would allow exactly the flows recorded by the learn verdict on
+// the pods of this node, as YAML documents
+type PolicySuggester struct {
+	client.Client
+	Flows    LearnedFlowLister
+	Hostname string
+}
+
+// ServeHTTP serves the suggested policies, computed from the flows recorded when the request is received
+func (s *PolicySuggester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := log.FromContext(ctx).WithName("suggest")
+
+	if s.Client == nil || s.Flows == nil {
+		http.Error(w, "policy suggester not started yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	policies, err := s.suggest(ctx, logger)
+	if err != nil {
+		logger.Error(err, "Failed to suggest policies")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := MarshalPolicies(policies)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(out)
+}
+
+// suggest lists the flows learned on the pods of this node and resolves their peers from the pods of the cluster
+func (s *PolicySuggester) suggest(ctx context.Context, logger logr.Logger) ([]*multiv1beta1.MultiNetworkPolicy, error) {
+	pods := &corev1.PodList{}
+	err := s.Client.List(ctx, pods, client.MatchingFields{
+		nftables.PodHostnameIndex:             s.Hostname,
+		nftables.PodStatusIndex:               string(corev1.PodRunning),
+		nftables.PodHostNetworkIndex:          "false",
+		nftables.PodHasNetworkAnnotationIndex: "true",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	flows, err := s.Flows.LearnedFlows(ctx, pods.Items, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list learned flows: %w", err)
+	}
+
+	peers := &corev1.PodList{}
+	err = s.Client.List(ctx, peers, client.MatchingFields{
+		nftables.PodHasNetworkAnnotationIndex: "true",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list peer pods: %w", err)
+	}
+
+	return SuggestPolicies(pods.Items, peers.Items, flows), nil
+}
+
+// suggestedPolicy accumulates the rules of a suggested policy, by direction and peer
+type suggestedPolicy struct {
+	policy  *multiv1beta1.MultiNetworkPolicy
+	ingress map[string]*suggestedRule
+	egress  map[string]*suggestedRule
+}
+
+// suggestedRule is the peer of a suggested rule and its ports
+type suggestedRule struct {
+	peer  multiv1beta1.MultiNetworkPolicyPeer
+	ports map[string]multiv1beta1.MultiNetworkPolicyPort
+}
+
+// SuggestPolicies returns the MultiNetworkPolicies that would allow the learned flows of the pods, one per network and
+// per set of labels of the pods. The peers are selected by their namespace and labels when they are pods of the
+// network, and by their address otherwise.
+func SuggestPolicies(pods []corev1.Pod, peers []corev1.Pod, flows []nftables.LearnedFlow) []*multiv1beta1.MultiNetworkPolicy {
+	podsByKey := make(map[types.NamespacedName]*corev1.Pod, len(pods))
+	for i := range pods {
+		podsByKey[types.NamespacedName{Namespace: pods[i].Namespace, Name: pods[i].Name}] = &pods[i]
+	}
+
+	// Index the pods of the cluster by network and address to resolve the peers
+	peersByAddress := make(map[string]*corev1.Pod)
+	for i := range peers {
+		for _, intf := range nftables.GetInterfaces(&peers[i]) {
+			for _, ip := range intf.IPs {
+				if addr, err := netip.ParseAddr(ip); err == nil {
+					peersByAddress[intf.Network+"/"+addr.Unmap().String()] = &peers[i]
+				}
+			}
+		}
+	}
+
+	suggested := make(map[string]*suggestedPolicy)
+	for _, flow := range flows {
+		pod, ok := podsByKey[flow.Pod]
+		if !ok {
+			continue
+		}
+
+		network := interfaceNetwork(pod, flow.Interface)
+		if network == "" {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(flow.Peer)
+		if err != nil {
+			continue
+		}
+		addr = addr.Unmap()
+
+		selector := selectorLabels(pod.Labels)
+		key := fmt.Sprintf("%s/%s/%s", pod.Namespace, network, labels.SelectorFromSet(selector).String())
+		policy, ok := suggested[key]
+		if !ok {
+			policy = newSuggestedPolicy(pod.Namespace, network, selector)
+			suggested[key] = policy
+		}
+
+		peer, peerKey := suggestPeer(peersByAddress[network+"/"+addr.String()], addr)
+
+		rules := policy.egress
+		if flow.Ingress {
+			rules = policy.ingress
+		}
+
+		rule, ok := rules[peerKey]
+		if !ok {
+			rule = &suggestedRule{peer: peer, ports: make(map[string]multiv1beta1.MultiNetworkPolicyPort)}
+			rules[peerKey] = rule
+		}
+
+		protocol := corev1.Protocol(strings.ToUpper(flow.Protocol))
+		port := intstr.FromInt(flow.Port)
+		rule.ports[fmt.Sprintf("%s/%05d", protocol, flow.Port)] = multiv1beta1.MultiNetworkPolicyPort{Protocol: &protocol, Port: &port}
+	}
+
+	policies := make([]*multiv1beta1.MultiNetworkPolicy, 0, len(suggested))
+	for _, key := range sortedKeys(suggested) {
+		policies = append(policies, suggested[key].build())
+	}
+
+	return policies
+}
+
+// newSuggestedPolicy returns a policy of the pods of a namespace with a set of labels on a network, named after the
+// network and a hash of the labels
+func newSuggestedPolicy(namespace string, network string, selector map[string]string) *suggestedPolicy {
+	networkName := network[strings.Index(network, "/")+1:]
+	hash := utils.GetHashName(labels.SelectorFromSet(selector).String(), network)[:8]
+
+	return &suggestedPolicy{
+		policy: &multiv1beta1.MultiNetworkPolicy{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: multiv1beta1.SchemeGroupVersion.String(),
+				Kind:       "MultiNetworkPolicy",
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        fmt.Sprintf("learned-%s-%s", networkName, hash),
+				Annotations: map[string]string{datastore.PolicyForAnnotation: network},
+			},
+			Spec: multiv1beta1.MultiNetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: selector},
+			},
+		},
+		ingress: make(map[string]*suggestedRule),
+		egress:  make(map[string]*suggestedRule),
+	}
+}
+
+// build returns the policy with its rules, sorted by peer and port, and the policy types of the learned directions
+func (p *suggestedPolicy) build() *multiv1beta1.MultiNetworkPolicy {
+	policy := p.policy
+
+	for _, peerKey := range sortedKeys(p.ingress) {
+		rule := p.ingress[peerKey]
+		policy.Spec.Ingress = append(policy.Spec.Ingress, multiv1beta1.MultiNetworkPolicyIngressRule{
+			Ports: rule.sortedPorts(),
+			From:  []multiv1beta1.MultiNetworkPolicyPeer{rule.peer},
+		})
+	}
+	if len(p.ingress) > 0 {
+		policy.Spec.PolicyTypes = append(policy.Spec.PolicyTypes, multiv1beta1.PolicyTypeIngress)
+	}
+
+	for _, peerKey := range sortedKeys(p.egress) {
+		rule := p.egress[peerKey]
+		policy.Spec.Egress = append(policy.Spec.Egress, multiv1beta1.MultiNetworkPolicyEgressRule{
+			Ports: rule.sortedPorts(),
+			To:    []multiv1beta1.MultiNetworkPolicyPeer{rule.peer},
+		})
+	}
+	if len(p.egress) > 0 {
+		policy.Spec.PolicyTypes = append(policy.Spec.PolicyTypes, multiv1beta1.PolicyTypeEgress)
+	}
+
+	return policy
+}
+
+// sortedPorts returns the ports of a rule sorted by protocol and number
+func (r *suggestedRule) sortedPorts() []multiv1beta1.MultiNetworkPolicyPort {
+	ports := make([]multiv1beta1.MultiNetworkPolicyPort, 0, len(r.ports))
+	for _, key := range sortedKeys(r.ports) {
+		ports = append(ports, r.ports[key])
+	}
+
+	return ports
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// suggestPeer returns the peer of a learned address and a key identifying it. The pods of the network are selected by
+// their namespace and labels, the other addresses and the pods without labels by an IP block of the address.
+func suggestPeer(pod *corev1.Pod, addr netip.Addr) (multiv1beta1.MultiNetworkPolicyPeer, string) {
+	if pod != nil {
+		if selector := selectorLabels(pod.Labels); len(selector) > 0 {
+			return multiv1beta1.MultiNetworkPolicyPeer{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{corev1.LabelMetadataName: pod.Namespace}},
+				PodSelector:       &metav1.LabelSelector{MatchLabels: selector},
+			}, fmt.Sprintf("pod %s %s", pod.Namespace, labels.SelectorFromSet(selector).String())
+		}
+	}
+
+	cidr := netip.PrefixFrom(addr, addr.BitLen()).String()
+	return multiv1beta1.MultiNetworkPolicyPeer{IPBlock: &multiv1beta1.IPBlock{CIDR: cidr}}, "ipBlock " + cidr
+}
+
+// selectorLabels returns the labels of a pod without the labels generated by the workload controllers
+func selectorLabels(podLabels map[string]string) map[string]string {
+	selector := make(map[string]string, len(podLabels))
+	for key, value := range podLabels {
+		if !slices.Contains(generatedLabels, key) {
+			selector[key] = value
+		}
+	}
+
+	return selector
+}
+
+// interfaceNetwork returns the network of an interface of a pod, empty when the interface is not a secondary interface
+func interfaceNetwork(pod *corev1.Pod, name string) string {
+	for _, intf := range nftables.GetInterfaces(pod) {
+		if intf.Name == name {
+			return intf.Network
+		}
+	}
+
+	return ""
+}
+
+// MarshalPolicies returns the policies as YAML documents
+func MarshalPolicies(policies []*multiv1beta1.MultiNetworkPolicy) ([]byte, error) {
+	out := &bytes.Buffer{}
+	for i, policy := range policies {
+		document, err := yaml.Marshal(policy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal policy %s/%s: %w", policy.Namespace, policy.Name, err)
+		}
+
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+		out.Write(document)
+	}
+
+	return out.Bytes(), nil
+}
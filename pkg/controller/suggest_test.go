@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/go-logr/logr"
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// fakeFlowLister returns the same flows for all the pods
+type fakeFlowLister struct {
+	flows []nftables.LearnedFlow
+	pods  []corev1.Pod
+}
+
+func (f *fakeFlowLister) LearnedFlows(_ context.Context, pods []corev1.Pod, _ logr.Logger) ([]nftables.LearnedFlow, error) {
+	f.pods = pods
+	return f.flows, nil
+}
+
+var _ = Describe("PolicySuggester", func() {
+	var (
+		web, db, other corev1.Pod
+		webKey         types.NamespacedName
+	)
+
+	port := func(protocol corev1.Protocol, number int) multiv1beta1.MultiNetworkPolicyPort {
+		value := intstr.FromInt(number)
+		return multiv1beta1.MultiNetworkPolicyPort{Protocol: &protocol, Port: &value}
+	}
+
+	BeforeEach(func() {
+		web = *newTestPod("default", "web-7d9f8-abcde", "node1", map[string]string{"app": "web", "pod-template-hash": "7d9f8"}, "macvlan-net",
+			`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.1"]}]`)
+		db = *newTestPod("data", "db-0", "node2", map[string]string{"app": "db", "statefulset.kubernetes.io/pod-name": "db-0"}, "default/macvlan-net",
+			`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.2"]}]`)
+		other = *newTestPod("default", "client", "node2", nil, "macvlan-net",
+			`[{"name":"default/macvlan-net","interface":"net1","ips":["10.0.0.3"]}]`)
+		webKey = types.NamespacedName{Namespace: "default", Name: "web-7d9f8-abcde"}
+	})
+
+	It("should suggest a policy allowing the learned flows of the pods", func() {
+		flows := []nftables.LearnedFlow{
+			{Pod: webKey, Ingress: true, Interface: "net1", Peer: "10.0.0.2", Protocol: "tcp", Port: 8443},
+			{Pod: webKey, Ingress: true, Interface: "net1", Peer: "10.0.0.2", Protocol: "tcp", Port: 80},
+			{Pod: webKey, Ingress: true, Interface: "net1", Peer: "10.0.0.3", Protocol: "tcp", Port: 80},
+			{Pod: webKey, Ingress: false, Interface: "net1", Peer: "::ffff:192.168.1.1", Protocol: "udp", Port: 53},
+			// The flows of the unknown interfaces and pods are ignored
+			{Pod: webKey, Ingress: true, Interface: "eth0", Peer: "10.0.0.2", Protocol: "tcp", Port: 22},
+			{Pod: types.NamespacedName{Namespace: "default", Name: "gone"}, Ingress: true, Interface: "net1", Peer: "10.0.0.2", Protocol: "tcp", Port: 22},
+		}
+
+		policies := SuggestPolicies([]corev1.Pod{web}, []corev1.Pod{web, db, other}, flows)
+		Expect(policies).To(HaveLen(1))
+
+		policy := policies[0]
+		Expect(policy.Namespace).To(Equal("default"))
+		Expect(policy.Name).To(HavePrefix("learned-macvlan-net-"))
+		Expect(policy.Annotations).To(HaveKeyWithValue(datastore.PolicyForAnnotation, "default/macvlan-net"))
+		Expect(policy.Spec.PodSelector).To(Equal(metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}))
+		Expect(policy.Spec.PolicyTypes).To(Equal([]multiv1beta1.MultiPolicyType{multiv1beta1.PolicyTypeIngress, multiv1beta1.PolicyTypeEgress}))
+
+		Expect(policy.Spec.Ingress).To(Equal([]multiv1beta1.MultiNetworkPolicyIngressRule{
+			{
+				Ports: []multiv1beta1.MultiNetworkPolicyPort{port(corev1.ProtocolTCP, 80)},
+				From:  []multiv1beta1.MultiNetworkPolicyPeer{{IPBlock: &multiv1beta1.IPBlock{CIDR: "10.0.0.3/32"}}},
+			},
+			{
+				Ports: []multiv1beta1.MultiNetworkPolicyPort{port(corev1.ProtocolTCP, 80), port(corev1.ProtocolTCP, 8443)},
+				From: []multiv1beta1.MultiNetworkPolicyPeer{{
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{corev1.LabelMetadataName: "data"}},
+					PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+				}},
+			},
+		}))
+		Expect(policy.Spec.Egress).To(Equal([]multiv1beta1.MultiNetworkPolicyEgressRule{{
+			Ports: []multiv1beta1.MultiNetworkPolicyPort{port(corev1.ProtocolUDP, 53)},
+			To:    []multiv1beta1.MultiNetworkPolicyPeer{{IPBlock: &multiv1beta1.IPBlock{CIDR: "192.168.1.1/32"}}},
+		}}))
+	})
+
+	It("should only set the policy types of the learned directions", func() {
+		flows := []nftables.LearnedFlow{
+			{Pod: webKey, Ingress: false, Interface: "net1", Peer: "10.0.0.2", Protocol: "sctp", Port: 3868},
+		}
+
+		policies := SuggestPolicies([]corev1.Pod{web}, nil, flows)
+		Expect(policies).To(HaveLen(1))
+		Expect(policies[0].Spec.PolicyTypes).To(Equal([]multiv1beta1.MultiPolicyType{multiv1beta1.PolicyTypeEgress}))
+		Expect(policies[0].Spec.Ingress).To(BeEmpty())
+	})
+
+	It("should serve the suggested policies of the pods of the node as YAML", func() {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+
+		lister := &fakeFlowLister{flows: []nftables.LearnedFlow{
+			{Pod: webKey, Ingress: true, Interface: "net1", Peer: "10.0.0.2", Protocol: "tcp", Port: 80},
+		}}
+		suggester := &PolicySuggester{
+			Client:   newIndexedFakeClientBuilder(scheme).WithObjects(&web, &db, &other).Build(),
+			Flows:    lister,
+			Hostname: "node1",
+		}
+
+		recorder := httptest.NewRecorder()
+		suggester.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/suggested-policies", nil))
+
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/yaml"))
+		Expect(recorder.Body.String()).To(ContainSubstring("kind: MultiNetworkPolicy"))
+		Expect(recorder.Body.String()).To(ContainSubstring("k8s.v1.cni.cncf.io/policy-for: default/macvlan-net"))
+		Expect(recorder.Body.String()).To(ContainSubstring("kubernetes.io/metadata.name: data"))
+
+		Expect(lister.pods).To(HaveLen(1))
+		Expect(lister.pods[0].Name).To(Equal(web.Name))
+	})
+
+	It("should separate the suggested policies with document markers", func() {
+		out, err := MarshalPolicies([]*multiv1beta1.MultiNetworkPolicy{
+			{ObjectMeta: metav1.ObjectMeta{Name: "a"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(out)).To(MatchRegexp(`(?s)name: a\n.*---\n.*name: b\n`))
+	})
+})
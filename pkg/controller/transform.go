@@ -0,0 +1,57 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// lastAppliedConfigAnnotation is the annotation of kubectl apply holding a full copy of the object
+const lastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// TransformPod strips the pods stored in the informer cache down to the fields read by the controllers: the metadata
+// without the managed fields, the node and host network of the spec, and the phase and container IDs of the status.
+// The specs of the containers are most of the size of a pod, on clusters with 10k+ pods this is the difference between
+// hundreds of megabytes and gigabytes per daemon. The stripped pods must never be written back to the API.
+func TransformPod(obj any) (any, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return obj, nil
+	}
+
+	annotations := pod.Annotations
+	if _, ok := annotations[lastAppliedConfigAnnotation]; ok {
+		annotations = make(map[string]string, len(pod.Annotations)-1)
+		for key, value := range pod.Annotations {
+			if key != lastAppliedConfigAnnotation {
+				annotations[key] = value
+			}
+		}
+	}
+
+	var containerStatuses []corev1.ContainerStatus
+	for _, status := range pod.Status.ContainerStatuses {
+		containerStatuses = append(containerStatuses, corev1.ContainerStatus{Name: status.Name, ContainerID: status.ContainerID})
+	}
+
+	return &corev1.Pod{
+		TypeMeta: pod.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              pod.Name,
+			Namespace:         pod.Namespace,
+			UID:               pod.UID,
+			ResourceVersion:   pod.ResourceVersion,
+			CreationTimestamp: pod.CreationTimestamp,
+			DeletionTimestamp: pod.DeletionTimestamp,
+			Labels:            pod.Labels,
+			Annotations:       annotations,
+		},
+		Spec: corev1.PodSpec{
+			NodeName:    pod.Spec.NodeName,
+			HostNetwork: pod.Spec.HostNetwork,
+		},
+		Status: corev1.PodStatus{
+			Phase:             pod.Status.Phase,
+			ContainerStatuses: containerStatuses,
+		},
+	}, nil
+}
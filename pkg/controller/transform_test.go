@@ -0,0 +1,57 @@
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("TransformPod", func() {
+	It("should only keep the fields read by the controllers", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "pod",
+				Namespace: "default",
+				UID:       "uid",
+				Labels:    map[string]string{"app": "web"},
+				Annotations: map[string]string{
+					"k8s.v1.cni.cncf.io/networks": "macvlan1",
+					lastAppliedConfigAnnotation:   "{}",
+				},
+				ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+			},
+			Spec: corev1.PodSpec{
+				NodeName:   "node1",
+				Containers: []corev1.Container{{Name: "web", Image: "nginx"}},
+			},
+			Status: corev1.PodStatus{
+				Phase:             corev1.PodRunning,
+				PodIPs:            []corev1.PodIP{{IP: "10.0.0.1"}},
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "web", ContainerID: "containerd://abc", Image: "nginx"}},
+			},
+		}
+
+		obj, err := TransformPod(pod)
+		Expect(err).NotTo(HaveOccurred())
+
+		transformed, ok := obj.(*corev1.Pod)
+		Expect(ok).To(BeTrue())
+		Expect(transformed.UID).To(Equal(pod.UID))
+		Expect(transformed.Labels).To(Equal(pod.Labels))
+		Expect(transformed.Annotations).To(Equal(map[string]string{"k8s.v1.cni.cncf.io/networks": "macvlan1"}))
+		Expect(transformed.ManagedFields).To(BeEmpty())
+		Expect(transformed.Spec).To(Equal(corev1.PodSpec{NodeName: "node1"}))
+		Expect(transformed.Status.Phase).To(Equal(corev1.PodRunning))
+		Expect(transformed.Status.PodIPs).To(BeEmpty())
+		Expect(transformed.Status.ContainerStatuses).To(Equal([]corev1.ContainerStatus{{Name: "web", ContainerID: "containerd://abc"}}))
+
+		// The annotations of the cached pod are untouched
+		Expect(pod.Annotations).To(HaveKey(lastAppliedConfigAnnotation))
+	})
+
+	It("should return the other objects as is", func() {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+		Expect(TransformPod(namespace)).To(BeIdenticalTo(namespace))
+	})
+})
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"slices"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+)
+
+// userspacePlugins are the plugins attaching the pods to a userspace switch, e.g. OVS-DPDK or VPP, through a
+// vhost-user socket or a memif. The traffic of their interfaces bypasses the kernel of the pods, nftables cannot filter
+// it.
+var userspacePlugins = []string{"userspace", "vhostuser"}
+
+// isUserspaceNetwork returns whether the traffic of the interfaces of a network attachment definition bypasses the
+// kernel, an invalid configuration is not
+func isUserspaceNetwork(netAttachDef *netdefv1.NetworkAttachmentDefinition) bool {
+	networkType, err := getNetworkType(netAttachDef)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(userspacePlugins, networkType)
+}
+
+// getUserspaceNetworks returns the networks of a policy whose traffic bypasses the kernel
+func getUserspaceNetworks(networks []policyNetwork) []string {
+	var userspaceNetworks []string
+	for _, network := range networks {
+		if isUserspaceNetwork(network.netAttachDef) {
+			userspaceNetworks = append(userspaceNetworks, network.name)
+		}
+	}
+
+	return userspaceNetworks
+}
@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+// newIPPool returns an empty whereabouts IP pool to watch
+func newIPPool() *unstructured.Unstructured {
+	pool := &unstructured.Unstructured{}
+	pool.SetGroupVersionKind(nftables.IPPoolGVK)
+	return pool
+}
+
+// reservationHandler returns an event handler recording the reservations of the whereabouts IP pools, and enqueueing
+// the policies affected by the running pods whose reservations changed, as their pod events do with enqueue. The pods
+// cached by the selector cache are invalidated before they are enqueued.
+func reservationHandler(clt client.Client, reservations *nftables.Reservations, selectors *nftables.SelectorCache, enqueue handler.MapFunc) handler.EventHandler {
+	update := func(ctx context.Context, oldPool client.Object, newPool client.Object, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+		logger := log.FromContext(ctx)
+
+		var pool string
+		var oldReservations, newReservations []nftables.Reservation
+		if oldPool != nil {
+			pool = fmt.Sprintf("%s/%s", oldPool.GetNamespace(), oldPool.GetName())
+			oldReservations = parseIPPool(oldPool, logr.Discard())
+		}
+		if newPool != nil {
+			pool = fmt.Sprintf("%s/%s", newPool.GetNamespace(), newPool.GetName())
+			newReservations = parseIPPool(newPool, logger)
+			reservations.SetPool(pool, newReservations)
+		} else {
+			reservations.DeletePool(pool)
+		}
+
+		for _, key := range changedReservationPods(oldReservations, newReservations) {
+			if selectors != nil {
+				selectors.InvalidatePods(key.Namespace)
+			}
+
+			// The pods not running are not peers yet, they are enqueued by their own events
+			pod := &corev1.Pod{}
+			if err := clt.Get(ctx, key, pod); err != nil || pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+
+			logger.V(1).Info("Reservations of pod changed", "pool", pool, "pod", key)
+			for _, req := range enqueue(ctx, pod) {
+				q.Add(req)
+			}
+		}
+	}
+
+	return handler.Funcs{
+		CreateFunc: func(ctx context.Context, e event.TypedCreateEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			update(ctx, nil, e.Object, q)
+		},
+		UpdateFunc: func(ctx context.Context, e event.TypedUpdateEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			update(ctx, e.ObjectOld, e.ObjectNew, q)
+		},
+		DeleteFunc: func(ctx context.Context, e event.TypedDeleteEvent[client.Object], q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+			update(ctx, e.Object, nil, q)
+		},
+	}
+}
+
+// parseIPPool returns the reservations of an IP pool object, the invalid allocations are logged and skipped
+func parseIPPool(obj client.Object, logger logr.Logger) []nftables.Reservation {
+	pool, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+
+	reservations, err := nftables.ParseIPPool(pool)
+	if err != nil {
+		logger.Info("Invalid allocations in IP pool", "pool", pool.GetName(), "namespace", pool.GetNamespace(), "error", err.Error())
+	}
+
+	return reservations
+}
+
+// changedReservationPods returns the pods whose reservations differ between two versions of a pool
+func changedReservationPods(oldReservations []nftables.Reservation, newReservations []nftables.Reservation) []types.NamespacedName {
+	byPod := func(reservations []nftables.Reservation) map[types.NamespacedName][]string {
+		pods := make(map[types.NamespacedName][]string)
+		for _, reservation := range reservations {
+			pods[reservation.Pod] = append(pods[reservation.Pod], reservation.Interface+"="+reservation.IP)
+		}
+		for _, addresses := range pods {
+			slices.Sort(addresses)
+		}
+		return pods
+	}
+
+	oldPods := byPod(oldReservations)
+	newPods := byPod(newReservations)
+
+	var changed []types.NamespacedName
+	for pod, addresses := range newPods {
+		if !slices.Equal(oldPods[pod], addresses) {
+			changed = append(changed, pod)
+		}
+	}
+	for pod := range oldPods {
+		if _, ok := newPods[pod]; !ok {
+			changed = append(changed, pod)
+		}
+	}
+
+	return changed
+}
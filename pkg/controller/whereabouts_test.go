@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+var _ = Describe("reservationHandler", func() {
+	var (
+		ctx          context.Context
+		reservations *nftables.Reservations
+		queue        workqueue.TypedRateLimitingInterface[reconcile.Request]
+	)
+
+	web := types.NamespacedName{Namespace: "default", Name: "web"}
+
+	newPool := func(allocations map[string]interface{}) *unstructured.Unstructured {
+		pool := newIPPool()
+		pool.SetNamespace("kube-system")
+		pool.SetName("10.1.0.0-24")
+		pool.Object["spec"] = map[string]interface{}{"range": "10.1.0.0/24", "allocations": allocations}
+		return pool
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		reservations = nftables.NewReservations()
+		queue = workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[reconcile.Request]())
+		DeferCleanup(queue.ShutDown)
+	})
+
+	It("should record the reservations and enqueue the policies of the running pods they changed", func() {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}, Status: corev1.PodStatus{Phase: corev1.PodRunning}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}, Status: corev1.PodStatus{Phase: corev1.PodPending}},
+		).Build()
+
+		// The policy enqueued is named after the pod
+		enqueue := func(_ context.Context, obj client.Object) []reconcile.Request {
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: "default", Name: "policy-" + obj.GetName()}}}
+		}
+		handler := reservationHandler(k8sClient, reservations, nftables.NewSelectorCache(), enqueue)
+
+		pool := newPool(map[string]interface{}{
+			"5": map[string]interface{}{"podref": "default/web", "ifname": "net1"},
+			"6": map[string]interface{}{"podref": "default/db", "ifname": "net1"},
+		})
+		handler.Create(ctx, event.CreateEvent{Object: pool}, queue)
+		Expect(reservations.Addresses(web, "net1")).To(Equal([]string{"10.1.0.5"}))
+		Expect(queue.Len()).To(Equal(1))
+		item, _ := queue.Get()
+		Expect(item.Name).To(Equal("policy-web"))
+		queue.Done(item)
+		queue.Forget(item)
+
+		// The pods whose reservations did not change are not enqueued
+		updated := newPool(map[string]interface{}{
+			"5": map[string]interface{}{"podref": "default/web", "ifname": "net1"},
+		})
+		handler.Update(ctx, event.UpdateEvent{ObjectOld: pool, ObjectNew: updated}, queue)
+		Expect(queue.Len()).To(BeZero())
+
+		handler.Delete(ctx, event.DeleteEvent{Object: updated}, queue)
+		Expect(reservations.Addresses(web, "net1")).To(BeEmpty())
+		Expect(queue.Len()).To(Equal(1))
+	})
+
+	It("should detect the pods whose reservations changed", func() {
+		db := types.NamespacedName{Namespace: "default", Name: "db"}
+		oldReservations := []nftables.Reservation{
+			{Pod: web, Interface: "net1", IP: "10.1.0.5"},
+			{Pod: db, Interface: "net1", IP: "10.1.0.6"},
+		}
+
+		Expect(changedReservationPods(oldReservations, oldReservations)).To(BeEmpty())
+		Expect(changedReservationPods(oldReservations, oldReservations[:1])).To(ConsistOf(db))
+		Expect(changedReservationPods(nil, oldReservations)).To(ConsistOf(web, db))
+		Expect(changedReservationPods(oldReservations, []nftables.Reservation{
+			{Pod: web, Interface: "net1", IP: "10.1.0.7"},
+			{Pod: db, Interface: "net1", IP: "10.1.0.6"},
+		})).To(ConsistOf(web))
+	})
+})
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/go-logr/logr"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
@@ -20,11 +21,17 @@ import (
 
 const (
 	runtimeDialTimeout = 10 * time.Second
+
+	// podUIDLabel is the label of the pod sandboxes with the UID of their pod
+	podUIDLabel = "io.kubernetes.pod.uid"
 )
 
 type Runtime struct {
 	CriEndpoint string
 	HostPrefix  string
+	// SandboxNetNS resolves the network namespaces mounted by the runtime for the pod sandboxes, e.g.
+	// /var/run/netns/cni-<id>, instead of the /proc path of a container process. The applier only enters those.
+	SandboxNetNS bool
 
 	sync.RWMutex
 	RuntimeClient pb.RuntimeServiceClient
@@ -111,6 +118,18 @@ type containerInfoJSON struct {
 	PID int `json:"pid"`
 }
 
+// sandboxInfoJSON is the JSON structure for the verbose info of a pod sandbox, only its network namespace is read
+type sandboxInfoJSON struct {
+	RuntimeSpec struct {
+		Linux struct {
+			Namespaces []struct {
+				Type string `json:"type"`
+				Path string `json:"path"`
+			} `json:"namespaces"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
 // GetPodNetNSPath gets the network namespace path for a pod
 func (c *Runtime) GetPodNetNSPath(ctx context.Context, pod *corev1.Pod) (string, error) {
 	logger := log.FromContext(ctx).WithValues("pod", pod.Name, "namespace", pod.Namespace)
@@ -126,6 +145,10 @@ func (c *Runtime) GetPodNetNSPath(ctx context.Context, pod *corev1.Pod) (string,
 		}
 	}
 
+	if c.SandboxNetNS {
+		return c.getSandboxNetNSPath(ctx, pod, logger)
+	}
+
 	// Get the container ID from the pod status
 	if len(pod.Status.ContainerStatuses) == 0 {
 		return "", fmt.Errorf("no container statuses found for pod %s", pod.Name)
@@ -195,3 +218,45 @@ func (c *Runtime) GetPodNetNSPath(ctx context.Context, pod *corev1.Pod) (string,
 	logger.Info("Found netns path", "netnsPath", netnsPath)
 	return netnsPath, nil
 }
+
+// getSandboxNetNSPath gets the network namespace mounted for the ready sandbox of a pod, from the runtime spec of its
+// verbose status
+func (c *Runtime) getSandboxNetNSPath(ctx context.Context, pod *corev1.Pod, logger logr.Logger) (string, error) {
+	sandboxes, err := c.RuntimeClient.ListPodSandbox(ctx, &pb.ListPodSandboxRequest{
+		Filter: &pb.PodSandboxFilter{
+			State:         &pb.PodSandboxStateValue{State: pb.PodSandboxState_SANDBOX_READY},
+			LabelSelector: map[string]string{podUIDLabel: string(pod.UID)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pod sandboxes for pod %s: %w", pod.Name, err)
+	}
+	if len(sandboxes.GetItems()) == 0 {
+		return "", fmt.Errorf("no ready sandbox found for pod %s", pod.Name)
+	}
+
+	sandboxID := sandboxes.GetItems()[0].GetId()
+	resp, err := c.RuntimeClient.PodSandboxStatus(ctx, &pb.PodSandboxStatusRequest{PodSandboxId: sandboxID, Verbose: true})
+	if err != nil {
+		return "", fmt.Errorf("failed to get sandbox status for pod %s: %w", pod.Name, err)
+	}
+
+	infoJSONString, ok := resp.GetInfo()["info"]
+	if !ok {
+		return "", fmt.Errorf("key 'info' not found in sandbox status info map for %s", sandboxID)
+	}
+
+	var parsedInfo sandboxInfoJSON
+	if err := json.Unmarshal([]byte(infoJSONString), &parsedInfo); err != nil {
+		return "", fmt.Errorf("failed to unmarshal sandbox info JSON for %s: %w", sandboxID, err)
+	}
+
+	for _, namespace := range parsedInfo.RuntimeSpec.Linux.Namespaces {
+		if namespace.Type == "network" && namespace.Path != "" {
+			logger.Info("Found sandbox netns path", "netnsPath", namespace.Path)
+			return namespace.Path, nil
+		}
+	}
+
+	return "", fmt.Errorf("no network namespace path found for sandbox %s", sandboxID)
+}
@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// IngressHookAnnotation is the annotation key of a network attachment definition overriding the hook, and optionally the priority,
+// of the base chain enforcing the ingress policies on the network, as <hook>[:<priority>], e.g. "prerouting:mangle"
+const IngressHookAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/ingress-hook"
+
+// EgressHookAnnotation is the annotation key of a network attachment definition overriding the hook, and optionally the priority,
+// of the base chain enforcing the egress policies on the network, as <hook>[:<priority>], e.g. "postrouting"
+const EgressHookAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/egress-hook"
+
+// The ingress traffic is matched on the input interface and the egress traffic on the output interface,
+// so only the hooks where the interface is known are allowed
+var (
+	ingressHooks = []string{"input", "prerouting", "forward"}
+	egressHooks  = []string{"output", "postrouting", "forward"}
+)
+
+// namedPriorities are the values of the priority names of nft
+var namedPriorities = map[string]int{
+	"raw":      -300,
+	"mangle":   -150,
+	"dstnat":   -100,
+	"filter":   0,
+	"security": 50,
+	"srcnat":   100,
+}
+
+// BaseChain is the hook and the priority of a base chain
+type BaseChain struct {
+	Hook     string
+	Priority int
+}
+
+// NetworkBaseChains overrides the base chains enforcing the policies on a network, nil uses the input or output chain
+type NetworkBaseChains struct {
+	Ingress *BaseChain
+	Egress  *BaseChain
+}
+
+// ParseIngressBaseChain parses the ingress hook annotation, the hook is input, prerouting or forward
+func ParseIngressBaseChain(value string) (*BaseChain, error) {
+	return parseBaseChain(value, ingressHooks)
+}
+
+// ParseEgressBaseChain parses the egress hook annotation, the hook is output, postrouting or forward
+func ParseEgressBaseChain(value string) (*BaseChain, error) {
+	return parseBaseChain(value, egressHooks)
+}
+
+// parseBaseChain parses a base chain as <hook>[:<priority>], the priority defaults to filter
+func parseBaseChain(value string, hooks []string) (*BaseChain, error) {
+	hook, priority, hasPriority := strings.Cut(value, ":")
+
+	baseChain := &BaseChain{Hook: strings.ToLower(strings.TrimSpace(hook))}
+	if !slices.Contains(hooks, baseChain.Hook) {
+		return nil, fmt.Errorf("invalid hook %q, expected one of %s", hook, strings.Join(hooks, ", "))
+	}
+
+	if hasPriority {
+		var err error
+		if baseChain.Priority, err = parsePriority(priority); err != nil {
+			return nil, err
+		}
+	}
+
+	return baseChain, nil
+}
+
+// parsePriority parses a priority as an integer or a priority name with an optional offset, e.g. "-150" or "mangle+10"
+func parsePriority(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if priority, err := strconv.Atoi(value); err == nil {
+		return priority, nil
+	}
+
+	name, offset := value, 0
+	if i := strings.IndexAny(value, "+-"); i > 0 {
+		name = strings.TrimSpace(value[:i])
+
+		var err error
+		offset, err = strconv.Atoi(value[i:i+1] + strings.TrimSpace(value[i+1:]))
+		if err != nil {
+			return 0, fmt.Errorf("invalid priority offset %q", value)
+		}
+	}
+
+	priority, ok := namedPriorities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("invalid priority %q, expected an integer or a priority name with an optional offset", value)
+	}
+
+	return priority + offset, nil
+}
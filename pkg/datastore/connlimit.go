@@ -0,0 +1,21 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ConnectionLimitAnnotation is the annotation key of a policy limiting the number of connections each source address
+// can open to the pods of the policy, e.g. "100"
+const ConnectionLimitAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/connection-limit"
+
+// ParseConnectionLimit parses the number of connections per source address of the connection limit annotation
+func ParseConnectionLimit(value string) (int, error) {
+	limit, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid connection limit %q, expected a positive number of connections", value)
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	multiv1beta2 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta2"
+)
+
+// PolicySpecFromV1beta1 converts a v1beta1 MultiNetworkPolicy spec to the internal policy model
+func PolicySpecFromV1beta1(in *multiv1beta1.MultiNetworkPolicySpec) PolicySpec {
+	in = in.DeepCopy()
+
+	out := PolicySpec{PodSelector: in.PodSelector}
+
+	for _, policyType := range in.PolicyTypes {
+		out.PolicyTypes = append(out.PolicyTypes, PolicyType(policyType))
+	}
+
+	for _, rule := range in.Ingress {
+		out.Ingress = append(out.Ingress, IngressRule{
+			Ports: portsFromV1beta1(rule.Ports),
+			From:  peersFromV1beta1(rule.From),
+		})
+	}
+
+	for _, rule := range in.Egress {
+		out.Egress = append(out.Egress, EgressRule{
+			Ports: portsFromV1beta1(rule.Ports),
+			To:    peersFromV1beta1(rule.To),
+		})
+	}
+
+	return out
+}
+
+func portsFromV1beta1(in []multiv1beta1.MultiNetworkPolicyPort) []Port {
+	var out []Port
+	for _, port := range in {
+		out = append(out, Port{Protocol: port.Protocol, Port: port.Port, EndPort: port.EndPort})
+	}
+
+	return out
+}
+
+func peersFromV1beta1(in []multiv1beta1.MultiNetworkPolicyPeer) []Peer {
+	var out []Peer
+	for _, peer := range in {
+		converted := Peer{PodSelector: peer.PodSelector, NamespaceSelector: peer.NamespaceSelector}
+		if peer.IPBlock != nil {
+			converted.IPBlock = &IPBlock{CIDR: peer.IPBlock.CIDR, Except: peer.IPBlock.Except}
+		}
+		out = append(out, converted)
+	}
+
+	return out
+}
+
+// PolicySpecFromV1beta2 converts a v1beta2 MultiNetworkPolicy spec to the internal policy model
+func PolicySpecFromV1beta2(in *multiv1beta2.MultiNetworkPolicySpec) PolicySpec {
+	in = in.DeepCopy()
+
+	out := PolicySpec{PodSelector: in.PodSelector}
+
+	for _, policyType := range in.PolicyTypes {
+		out.PolicyTypes = append(out.PolicyTypes, PolicyType(policyType))
+	}
+
+	for _, rule := range in.Ingress {
+		out.Ingress = append(out.Ingress, IngressRule{
+			Ports: portsFromV1beta2(rule.Ports),
+			From:  peersFromV1beta2(rule.From),
+		})
+	}
+
+	for _, rule := range in.Egress {
+		out.Egress = append(out.Egress, EgressRule{
+			Ports: portsFromV1beta2(rule.Ports),
+			To:    peersFromV1beta2(rule.To),
+		})
+	}
+
+	return out
+}
+
+func portsFromV1beta2(in []multiv1beta2.MultiNetworkPolicyPort) []Port {
+	var out []Port
+	for _, port := range in {
+		out = append(out, Port{Protocol: port.Protocol, Port: port.Port, EndPort: port.EndPort})
+	}
+
+	return out
+}
+
+func peersFromV1beta2(in []multiv1beta2.MultiNetworkPolicyPeer) []Peer {
+	var out []Peer
+	for _, peer := range in {
+		converted := Peer{PodSelector: peer.PodSelector, NamespaceSelector: peer.NamespaceSelector}
+		if peer.IPBlock != nil {
+			converted.IPBlock = &IPBlock{CIDR: peer.IPBlock.CIDR, Except: peer.IPBlock.Except}
+		}
+		out = append(out, converted)
+	}
+
+	return out
+}
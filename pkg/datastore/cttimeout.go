@@ -0,0 +1,94 @@
+package datastore
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConntrackTimeoutsAnnotation is the annotation key of a network attachment definition overriding the conntrack
+// timeouts of the connections of the network, as <protocol>.<state>=<duration>, e.g. "udp.replied=1h, sctp.established=24h"
+const ConntrackTimeoutsAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/conntrack-timeouts"
+
+// conntrackTimeoutStates are the states of the conntrack timeout policies of each protocol, as named by nft
+var conntrackTimeoutStates = map[string][]string{
+	"tcp": {
+		"syn_sent", "syn_recv", "established", "fin_wait", "close_wait", "last_ack", "time_wait", "close",
+		"syn_sent2", "retrans", "unacknowledged",
+	},
+	"udp": {"unreplied", "replied"},
+	"sctp": {
+		"closed", "cookie_wait", "cookie_echoed", "established", "shutdown_sent", "shutdown_recd",
+		"shutdown_ack_sent", "heartbeat_sent",
+	},
+}
+
+// ConntrackTimeouts are the timeouts in seconds of the conntrack states of each protocol, the states without a timeout
+// keep the timeouts of the network namespace
+type ConntrackTimeouts map[string]map[string]int
+
+// ParseConntrackTimeouts parses the comma separated <protocol>.<state>=<duration> timeouts of the conntrack timeouts
+// annotation. The durations are Go durations of at least a second, or a number of seconds.
+func ParseConntrackTimeouts(value string) (ConntrackTimeouts, error) {
+	timeouts := ConntrackTimeouts{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, duration, found := strings.Cut(entry, "=")
+		protocol, state, _ := strings.Cut(strings.ToLower(strings.TrimSpace(key)), ".")
+		if !found || !slices.Contains(conntrackTimeoutStates[protocol], state) {
+			return nil, fmt.Errorf("invalid conntrack timeout %q, expected <protocol>.<state>=<duration> with a tcp, udp or sctp state", entry)
+		}
+
+		seconds, err := parseTimeoutSeconds(strings.TrimSpace(duration))
+		if err != nil {
+			return nil, fmt.Errorf("invalid conntrack timeout %q: %w", entry, err)
+		}
+
+		if timeouts[protocol] == nil {
+			timeouts[protocol] = make(map[string]int)
+		}
+		timeouts[protocol][state] = seconds
+	}
+
+	if len(timeouts) == 0 {
+		return nil, fmt.Errorf("invalid conntrack timeouts %q, expected <protocol>.<state>=<duration> timeouts", value)
+	}
+
+	return timeouts, nil
+}
+
+// parseTimeoutSeconds parses a duration, or a number of seconds, of at least a second
+func parseTimeoutSeconds(value string) (int, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		duration, durationErr := time.ParseDuration(value)
+		if durationErr != nil {
+			return 0, fmt.Errorf("expected a duration or a number of seconds")
+		}
+		seconds = int(duration / time.Second)
+	}
+
+	if seconds < 1 {
+		return 0, fmt.Errorf("expected a timeout of at least a second")
+	}
+
+	return seconds, nil
+}
+
+// States returns the states of a protocol with a timeout, in the order of nft
+func (t ConntrackTimeouts) States(protocol string) []string {
+	var states []string
+	for _, state := range conntrackTimeoutStates[protocol] {
+		if _, ok := t[protocol][state]; ok {
+			states = append(states, state)
+		}
+	}
+
+	return states
+}
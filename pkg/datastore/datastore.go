@@ -1,19 +1,87 @@
 package datastore
 
 import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 
-	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
 // PolicyForAnnotation is the policy-for annotation key that indicates which network this policy applies to
 const PolicyForAnnotation = "k8s.v1.cni.cncf.io/policy-for"
 
+// MirrorToAnnotation is the annotation key of a NetworkPolicy, or of a namespace for all its NetworkPolicies,
+// listing the networks the NetworkPolicy is mirrored to, with the format of the policy-for annotation
+const MirrorToAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/mirror-to"
+
+// DefaultVerdictAnnotation is the annotation key overriding the verdict of the traffic not allowed by the policy
+const DefaultVerdictAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/default-verdict"
+
+// InterfacesAnnotation is the annotation key of a policy or of a pod restricting the policies to the listed interfaces of
+// the pods, as a comma-separated list of interface names, e.g. when a pod has several interfaces on the same network
+const InterfacesAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/interfaces"
+
+// PeerNetworksAnnotation is the annotation key of a policy listing the other networks whose addresses of the peer pods
+// are also allowed, with the format of the policy-for annotation. By default, the peer pods only contribute their
+// addresses on the networks of the policy.
+const PeerNetworksAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/peer-networks"
+
+// ParseInterfaces parses the comma-separated interface names of the interfaces annotation, ignoring the empty names
+func ParseInterfaces(value string) []string {
+	var interfaces []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" && !slices.Contains(interfaces, name) {
+			interfaces = append(interfaces, name)
+		}
+	}
+
+	return interfaces
+}
+
+// Verdict is the verdict of the traffic not allowed by the policies
+type Verdict string
+
+const (
+	// VerdictDrop silently drops the traffic
+	VerdictDrop Verdict = "drop"
+	// VerdictReject rejects the traffic with a TCP reset or an ICMP administratively prohibited error
+	VerdictReject Verdict = "reject"
+	// VerdictLearn accepts the traffic and records its flows, to suggest the policies allowing them
+	VerdictLearn Verdict = "learn"
+)
+
+// ParseVerdict parses a verdict, drop, reject or learn
+func ParseVerdict(value string) (Verdict, error) {
+	switch verdict := Verdict(strings.ToLower(strings.TrimSpace(value))); verdict {
+	case VerdictDrop, VerdictReject, VerdictLearn:
+		return verdict, nil
+	default:
+		return "", fmt.Errorf("invalid verdict %q, expected %s, %s or %s", value, VerdictDrop, VerdictReject, VerdictLearn)
+	}
+}
+
 // Datastore is a datastore for multi-network policies
 type Datastore struct {
 	sync.RWMutex
 	Policies map[types.NamespacedName]*Policy
+	// Applied records the state of each policy applied to each pod, to skip the pods that did not change
+	Applied map[types.NamespacedName]map[types.NamespacedName]AppliedState
+	// Journal are the applies in progress, by transaction, to know the pods that may be partially applied after a crash
+	Journal map[uint64]JournalEntry
+	// Path is the file the datastore is persisted to on every change for warm restarts, empty keeps it in memory
+	Path string
+
+	// lastTransaction is the last transaction of the journal
+	lastTransaction uint64
+
+	// index is the reverse index of the desired policies, it is not persisted
+	index policyIndex
+	// log appends the changes to the log of the file of the datastore
+	log persistLog
 }
 
 // Policy represents a multi-network policy stored in the datastore
@@ -21,8 +89,51 @@ type Policy struct {
 	Name      string
 	Namespace string
 	Networks  []string
+	// Verdict overrides the default verdict of the traffic not allowed by the policy, empty uses the default
+	Verdict Verdict
+	// Interfaces restricts the policy to the interfaces of the pods with these names, nil applies it to all the
+	// interfaces on its networks
+	Interfaces []string
+	// PeerNetworks are the other networks whose addresses of the peer pods are also allowed, as <namespace>/<name> with
+	// wildcards, nil only allows the addresses of the peer pods on the networks of the policy
+	PeerNetworks []string
+	// PortPresets are the port presets whose ports are added to the ports of the rules of the spec
+	PortPresets []string
+	// BaseChains overrides the base chains of the networks, as <namespace>/<name>, nil uses the input and output chains
+	BaseChains map[string]NetworkBaseChains
+	// Encapsulations are the encapsulations of the networks carrying encapsulated traffic, as <namespace>/<name>, the
+	// rules match the inner headers of their traffic
+	Encapsulations map[string]Encapsulation
+	// ProtocolPresets are the protocol presets allowed on the networks, as <namespace>/<name>
+	ProtocolPresets map[string][]string
+	// ICMPHardening is the ICMP hardening of the hardened networks, as <namespace>/<name>
+	ICMPHardening map[string]ICMPHardening
+	// MulticastGroups are the CIDRs of the multicast groups the pods can receive UDP traffic from
+	MulticastGroups []string
+	// ExternalPeers are the external endpoints of the peer resolvers added to the peers of the rules
+	ExternalPeers []ExternalPeer
+	// ConnectionLimit is the number of connections each source address can open to the pods, 0 does not limit them
+	ConnectionLimit int
+	// Fragments is how the fragmented packets of the networks are handled, as <namespace>/<name>, the networks without
+	// it reassemble them
+	Fragments map[string]Fragments
+	// ConntrackTimeouts are the conntrack timeouts of the networks overriding them, as <namespace>/<name>
+	ConntrackTimeouts map[string]ConntrackTimeouts
+	// Infrastructure is the infrastructure of the networks always allowed, as <namespace>/<name>
+	Infrastructure map[string]Infrastructure
+	// L3Networks are the networks whose interfaces have no neighbor discovery, as <namespace>/<name>, e.g. the ipvlan
+	// networks in the l3 mode
+	L3Networks []string
+	// NAT64Prefixes are the NAT64 prefixes of the IPv6-only networks reaching the IPv4 peers through NAT64, as
+	// <namespace>/<name>, the IPv4 peers are also matched at their addresses embedded in the prefix
+	NAT64Prefixes map[string]netip.Prefix
+	// Generation is the generation of the policy the spec is converted from, 0 when it is unknown
+	Generation int64
+	// UID is the UID of the policy object the spec is converted from, empty when it is unknown. It is part of the names
+	// of the objects of the policy.
+	UID types.UID
 
-	Spec multiv1beta1.MultiNetworkPolicySpec
+	Spec PolicySpec
 }
 
 // GetPolicy gets a policy from the datastore
@@ -35,17 +146,39 @@ func (d *Datastore) GetPolicy(namespaceName types.NamespacedName) *Policy {
 
 // DeletePolicy deletes a policy from the datastore
 func (d *Datastore) DeletePolicy(key types.NamespacedName) {
+	defer d.flush()
 	d.Lock()
 	defer d.Unlock()
 
 	delete(d.Policies, key)
+	delete(d.Applied, key)
+	d.persist(persistedRecord{DeletedPolicy: &key})
 }
 
 // CreatePolicy creates a policy in the datastore
 func (d *Datastore) CreatePolicy(policy *Policy) {
+	defer d.flush()
 	d.Lock()
 	defer d.Unlock()
 
 	key := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+	if reflect.DeepEqual(d.Policies[key], policy) {
+		return
+	}
+
 	d.Policies[key] = policy
+	d.persist(persistedRecord{Policy: policy})
+}
+
+// ListPolicies returns all the policies in the datastore
+func (d *Datastore) ListPolicies() []*Policy {
+	d.RLock()
+	defer d.RUnlock()
+
+	policies := make([]*Policy, 0, len(d.Policies))
+	for _, policy := range d.Policies {
+		policies = append(policies, policy)
+	}
+
+	return policies
 }
@@ -1,13 +1,25 @@
 package datastore
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
+	multiv1beta2 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta2"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 func TestDatastore(t *testing.T) {
@@ -31,7 +43,7 @@ var _ = Describe("Datastore", func() {
 					Name:      "test-policy",
 					Namespace: "test-ns",
 					Networks:  []string{"network1"},
-					Spec: multiv1beta1.MultiNetworkPolicySpec{
+					Spec: PolicySpec{
 						PodSelector: metav1.LabelSelector{
 							MatchLabels: map[string]string{"app": "test"},
 						},
@@ -171,4 +183,607 @@ var _ = Describe("Datastore", func() {
 			}
 		})
 	})
+
+	Describe("ParseVerdict", func() {
+		It("should parse the verdicts", func() {
+			Expect(ParseVerdict("drop")).To(Equal(VerdictDrop))
+			Expect(ParseVerdict(" Reject ")).To(Equal(VerdictReject))
+			Expect(ParseVerdict("learn")).To(Equal(VerdictLearn))
+		})
+
+		It("should reject unknown verdicts", func() {
+			_, err := ParseVerdict("accept")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseInterfaces", func() {
+		It("should parse the interface names", func() {
+			Expect(ParseInterfaces(" net1, net2 ,,net1")).To(Equal([]string{"net1", "net2"}))
+			Expect(ParseInterfaces(" ")).To(BeNil())
+		})
+	})
+
+	Describe("ParseInterfaceGroups", func() {
+		It("should parse the groups of interface names", func() {
+			groups, err := ParseInterfaceGroups(" net1, net2 ;net3,net4,net3; ")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(groups).To(Equal([][]string{{"net1", "net2"}, {"net3", "net4"}}))
+		})
+
+		It("should skip the groups of a single interface and the overlapping groups", func() {
+			groups, err := ParseInterfaceGroups("net1,net2;net3;net2,net4")
+			Expect(err).To(MatchError(ContainSubstring(`invalid interface group "net3"`)))
+			Expect(err).To(MatchError(ContainSubstring(`invalid interface group "net2,net4"`)))
+			Expect(groups).To(Equal([][]string{{"net1", "net2"}}))
+		})
+	})
+
+	Describe("Persistence", func() {
+		var (
+			path      string
+			policyKey types.NamespacedName
+			podKey    types.NamespacedName
+		)
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "state", "datastore.json")
+			policyKey = types.NamespacedName{Namespace: "default", Name: "web-policy"}
+			podKey = types.NamespacedName{Namespace: "default", Name: "web"}
+		})
+
+		It("should restore the policies and the applied states persisted on every change", func() {
+			ds, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Policies).To(BeEmpty())
+
+			policy := &Policy{
+				Name:       "web-policy",
+				Namespace:  "default",
+				Networks:   []string{"default/macvlan1"},
+				BaseChains: map[string]NetworkBaseChains{"default/macvlan1": {Ingress: &BaseChain{Hook: "prerouting"}}},
+				Spec: PolicySpec{
+					PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+					PolicyTypes: []PolicyType{PolicyTypeIngress},
+				},
+			}
+			ds.CreatePolicy(policy)
+			state := AppliedState{PodUID: "uid", Sandbox: "/var/run/netns/web", Hash: "abc"}
+			ds.SetAppliedState(policyKey, podKey, state)
+
+			restored, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored.GetPolicy(policyKey)).To(Equal(policy))
+			restoredState, ok := restored.GetAppliedState(policyKey, podKey)
+			Expect(ok).To(BeTrue())
+			Expect(restoredState).To(Equal(state))
+
+			restored.DeleteAppliedStates(policyKey, nil)
+			restored.DeletePolicy(policyKey)
+
+			restored, err = Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored.Policies).To(BeEmpty())
+			Expect(restored.Applied).To(BeEmpty())
+		})
+
+		It("should append the changes to the log and compact it into the snapshot", func() {
+			ds, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The first change writes the snapshot, the next ones are appended to the log
+			ds.CreatePolicy(&Policy{Name: "web-policy", Namespace: "default"})
+			ds.SetAppliedState(policyKey, podKey, AppliedState{Hash: "abc"})
+			ds.SetAppliedState(policyKey, podKey, AppliedState{Hash: "def"})
+
+			snapshot, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(snapshot)).To(ContainSubstring("web-policy"))
+			Expect(string(snapshot)).NotTo(ContainSubstring(`"Hash":"def"`))
+			Expect(os.ReadFile(path + ".log")).To(ContainSubstring(`"Hash":"def"`))
+
+			// A record partially written by a crash is ignored
+			f, err := os.OpenFile(path+".log", os.O_WRONLY|os.O_APPEND, 0o600)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = f.WriteString(`{"Unapplied":[{"Pol`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+
+			restored, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			state, ok := restored.GetAppliedState(policyKey, podKey)
+			Expect(ok).To(BeTrue())
+			Expect(state).To(Equal(AppliedState{Hash: "def"}))
+
+			// The log is compacted into the snapshot once it grows too large
+			for i := range minCompactRecords {
+				restored.SetAppliedState(policyKey, podKey, AppliedState{Hash: fmt.Sprint(i)})
+			}
+			log, err := os.ReadFile(path + ".log")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bytes.Count(log, []byte("\n"))).To(BeNumerically("<", minCompactRecords))
+
+			restored, err = Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			state, ok = restored.GetAppliedState(policyKey, podKey)
+			Expect(ok).To(BeTrue())
+			Expect(state).To(Equal(AppliedState{Hash: fmt.Sprint(minCompactRecords - 1)}))
+			Expect(restored.GetPolicy(policyKey)).NotTo(BeNil())
+		})
+
+		It("should record the applied states of a sync with a single record", func() {
+			ds, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			otherPodKey := types.NamespacedName{Namespace: "default", Name: "other"}
+			ds.CreatePolicy(&Policy{Name: "web-policy", Namespace: "default"})
+			ds.SetAppliedState(policyKey, otherPodKey, AppliedState{Hash: "abc"})
+
+			before, err := os.ReadFile(path + ".log")
+			Expect(err).NotTo(HaveOccurred())
+
+			ds.UpdateAppliedStates([]AppliedStateChange{
+				{Policy: policyKey, Pod: podKey, State: &AppliedState{Hash: "abc"}},
+				{Policy: policyKey, Pod: otherPodKey},
+				{Policy: policyKey, Pod: podKey, State: &AppliedState{Hash: "def"}},
+				{Policy: policyKey, Pod: otherPodKey, State: &AppliedState{Hash: "ghi"}},
+				{Policy: policyKey, Pod: otherPodKey},
+			})
+
+			after, err := os.ReadFile(path + ".log")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bytes.Count(after, []byte("\n")) - bytes.Count(before, []byte("\n"))).To(Equal(1))
+
+			restored, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			state, ok := restored.GetAppliedState(policyKey, podKey)
+			Expect(ok).To(BeTrue())
+			Expect(state).To(Equal(AppliedState{Hash: "def"}))
+			_, ok = restored.GetAppliedState(policyKey, otherPodKey)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should only delete the applied states of the pods that are not kept", func() {
+			otherPodKey := types.NamespacedName{Namespace: "default", Name: "other"}
+			ds.SetAppliedState(policyKey, podKey, AppliedState{Hash: "abc"})
+			ds.SetAppliedState(policyKey, otherPodKey, AppliedState{Hash: "def"})
+
+			ds.DeleteAppliedStates(policyKey, func(pod types.NamespacedName) bool {
+				return pod == podKey
+			})
+
+			_, ok := ds.GetAppliedState(policyKey, otherPodKey)
+			Expect(ok).To(BeFalse())
+
+			state, ok := ds.GetAppliedState(policyKey, podKey)
+			Expect(ok).To(BeTrue())
+			Expect(state).To(Equal(AppliedState{Hash: "abc"}))
+		})
+
+		It("should restore the applies in progress from the journal", func() {
+			ds, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+
+			done := ds.BeginTransaction(JournalEntry{Policy: policyKey, Pod: podKey, PodUID: "uid", Sandbox: "/var/run/netns/web", Intent: IntentApply})
+			interrupted := ds.BeginTransaction(JournalEntry{Policy: policyKey, Pod: podKey, PodUID: "uid", Sandbox: "/var/run/netns/web", Intent: IntentCleanUp})
+			ds.EndTransaction(done)
+
+			restored, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored.TakeJournal()).To(Equal([]JournalEntry{
+				{Transaction: interrupted, Policy: policyKey, Pod: podKey, PodUID: "uid", Sandbox: "/var/run/netns/web", Intent: IntentCleanUp},
+			}))
+
+			// The transactions of the restored datastore follow the restored ones, and the journal is cleared once taken
+			Expect(restored.BeginTransaction(JournalEntry{Policy: policyKey, Pod: podKey, Intent: IntentApply})).To(BeNumerically(">", interrupted))
+			restored.EndTransaction(interrupted + 1)
+
+			restored, err = Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored.TakeJournal()).To(BeEmpty())
+		})
+
+		It("should ignore the datastores of another version", func() {
+			Expect(os.MkdirAll(filepath.Dir(path), 0o700)).To(Succeed())
+			Expect(os.WriteFile(path, []byte(`{"Version": 0, "Policies": [{"Name": "web-policy", "Namespace": "default"}]}`), 0o600)).To(Succeed())
+
+			ds, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Policies).To(BeEmpty())
+
+			Expect(os.WriteFile(path, []byte(`{`), 0o600)).To(Succeed())
+			_, err = Load(path)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseIngressBaseChain and ParseEgressBaseChain", func() {
+		It("should parse the hooks and the priorities", func() {
+			Expect(ParseIngressBaseChain("prerouting")).To(Equal(&BaseChain{Hook: "prerouting"}))
+			Expect(ParseIngressBaseChain(" Forward : -10 ")).To(Equal(&BaseChain{Hook: "forward", Priority: -10}))
+			Expect(ParseIngressBaseChain("prerouting:mangle")).To(Equal(&BaseChain{Hook: "prerouting", Priority: -150}))
+			Expect(ParseEgressBaseChain("postrouting:srcnat - 5")).To(Equal(&BaseChain{Hook: "postrouting", Priority: 95}))
+			Expect(ParseEgressBaseChain("output:filter+10")).To(Equal(&BaseChain{Hook: "output", Priority: 10}))
+		})
+
+		It("should reject the hooks where the interface of the direction is unknown", func() {
+			_, err := ParseIngressBaseChain("postrouting")
+			Expect(err).To(HaveOccurred())
+
+			_, err = ParseEgressBaseChain("prerouting")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should reject invalid priorities", func() {
+			_, err := ParseIngressBaseChain("prerouting:nat")
+			Expect(err).To(HaveOccurred())
+
+			_, err = ParseIngressBaseChain("prerouting:mangle+x")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseEncapsulation", func() {
+		It("should parse the encapsulations and their ports", func() {
+			Expect(ParseEncapsulation(" VXLAN ")).To(Equal(EncapsulationVXLAN))
+			Expect(ParseEncapsulation("geneve")).To(Equal(EncapsulationGeneve))
+			Expect(EncapsulationVXLAN.Port()).To(Equal(4789))
+			Expect(EncapsulationGeneve.Port()).To(Equal(6081))
+		})
+
+		It("should reject unknown encapsulations", func() {
+			_, err := ParseEncapsulation("gre")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Port presets", func() {
+		It("should parse the presets and report the unknown ones", func() {
+			Expect(ParsePortPresets(" N3, pfcp,n3")).To(Equal([]string{"n3", "pfcp"}))
+
+			presets, err := ParsePortPresets("n4,n42")
+			Expect(err).To(MatchError(ContainSubstring("unknown port presets n42")))
+			Expect(presets).To(Equal([]string{"n4"}))
+		})
+
+		It("should add the ports of the presets to the ports of every rule", func() {
+			tcp := corev1.ProtocolTCP
+			port := intstr.FromInt32(80)
+			spec := PolicySpec{
+				Ingress: []IngressRule{{Ports: []Port{{Protocol: &tcp, Port: &port}}}, {}},
+				Egress:  []EgressRule{{}},
+			}
+
+			ExpandPortPresets(&spec, []string{"n4", "diameter"})
+			Expect(spec.Ingress[0].Ports).To(HaveLen(4))
+			Expect(spec.Ingress[0].Ports[0].Port.IntVal).To(Equal(int32(80)))
+			Expect(spec.Ingress[1].Ports).To(Equal(append(portPresets["pfcp"], portPresets["diameter"]...)))
+			Expect(spec.Egress[0].Ports).To(HaveLen(3))
+			Expect(*spec.Egress[0].Ports[2].Protocol).To(Equal(corev1.ProtocolSCTP))
+		})
+	})
+
+	Describe("Protocol presets", func() {
+		It("should parse the presets and report the unknown ones", func() {
+			Expect(ParseProtocolPresets(" VRRP,bfd, vrrp")).To(Equal([]string{ProtocolPresetVRRP, ProtocolPresetBFD}))
+
+			presets, err := ParseProtocolPresets("ospf,isis")
+			Expect(err).To(MatchError(ContainSubstring("unknown protocol presets isis")))
+			Expect(presets).To(Equal([]string{ProtocolPresetOSPF}))
+		})
+
+		It("should parse the time synchronization presets", func() {
+			Expect(ParseProtocolPresets("PTP,ntp")).To(Equal([]string{ProtocolPresetPTP, ProtocolPresetNTP}))
+		})
+	})
+
+	Describe("ParseMulticastGroups", func() {
+		It("should parse and normalize the multicast groups and report the invalid ones", func() {
+			Expect(ParseMulticastGroups(" 239.1.1.1/24, FF3E::/16")).To(Equal([]string{"239.1.1.0/24", "ff3e::/16"}))
+
+			groups, err := ParseMulticastGroups("239.1.1.0/24,10.0.0.0/8,224.0.0.0/3,2001:db8::/32,group")
+			Expect(err).To(MatchError(ContainSubstring("invalid multicast groups 10.0.0.0/8, 224.0.0.0/3, 2001:db8::/32, group")))
+			Expect(groups).To(Equal([]string{"239.1.1.0/24"}))
+		})
+	})
+
+	Describe("ParseInfrastructureAddresses", func() {
+		It("should parse the addresses, the CIDRs and the gateway, and report the invalid ones", func() {
+			cidrs, derived, err := ParseInfrastructureAddresses(" Gateway, 192.168.1.53, DNS, 192.168.100.1/28, ::ffff:10.0.0.1, fe80::1%net1, 192.168.1.53, gateway")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(derived).To(Equal([]string{InfrastructureGateway, InfrastructureDNS}))
+			Expect(cidrs).To(Equal([]string{"192.168.1.53/32", "192.168.100.0/28", "10.0.0.1/32", "fe80::1/128"}))
+
+			cidrs, derived, err = ParseInfrastructureAddresses("192.168.1.1,router,10.0.0.0/33")
+			Expect(err).To(MatchError(ContainSubstring("invalid infrastructure addresses router, 10.0.0.0/33")))
+			Expect(derived).To(BeEmpty())
+			Expect(cidrs).To(Equal([]string{"192.168.1.1/32"}))
+		})
+	})
+
+	Describe("ParseExternalPeers", func() {
+		It("should parse the external peers of the rules and report the invalid ones", func() {
+			peers, err := ParseExternalPeers(" Ingress/0=cmdb:web-frontends, egress/1=bgp:65001:blue, ingress/0=cmdb:web-frontends")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(peers).To(Equal([]ExternalPeer{
+				{Direction: "ingress", Rule: 0, Resolver: "cmdb", Reference: "web-frontends"},
+				{Direction: "egress", Rule: 1, Resolver: "bgp", Reference: "65001:blue"},
+			}))
+
+			peers, err = ParseExternalPeers("egress/0=vms:db,both/0=cmdb:a,ingress/-1=cmdb:a,ingress/0=cmdb,ingress=cmdb:a")
+			Expect(err).To(MatchError(ContainSubstring("invalid external peers both/0=cmdb:a, ingress/-1=cmdb:a, ingress/0=cmdb, ingress=cmdb:a")))
+			Expect(peers).To(Equal([]ExternalPeer{{Direction: "egress", Rule: 0, Resolver: "vms", Reference: "db"}}))
+		})
+
+		It("should list the policies with external peers of a peer resolver", func() {
+			ds.CreatePolicy(&Policy{Name: "cmdb", Namespace: "default", ExternalPeers: []ExternalPeer{{Direction: "ingress", Resolver: "cmdb", Reference: "a"}}})
+			ds.CreatePolicy(&Policy{Name: "bgp", Namespace: "default", ExternalPeers: []ExternalPeer{{Direction: "egress", Resolver: "bgp", Reference: "65001"}}})
+			ds.CreatePolicy(&Policy{Name: "none", Namespace: "default"})
+
+			Expect(ds.PoliciesWithPeerResolver("cmdb")).To(Equal([]types.NamespacedName{{Namespace: "default", Name: "cmdb"}}))
+			Expect(ds.PoliciesWithPeerResolver("vms")).To(BeEmpty())
+		})
+	})
+
+	Describe("ParseConnectionLimit", func() {
+		It("should parse a positive number of connections", func() {
+			Expect(ParseConnectionLimit(" 100 ")).To(Equal(100))
+
+			for _, value := range []string{"0", "-1", "many"} {
+				_, err := ParseConnectionLimit(value)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+	})
+
+	Describe("ParseDryRun", func() {
+		It("should parse a boolean", func() {
+			Expect(ParseDryRun(" true ")).To(BeTrue())
+			Expect(ParseDryRun("false")).To(BeFalse())
+
+			_, err := ParseDryRun("maybe")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseFragments", func() {
+		It("should parse how the fragments are handled", func() {
+			Expect(ParseFragments(" Drop")).To(Equal(FragmentsDrop))
+			Expect(ParseFragments("reassemble")).To(Equal(FragmentsReassemble))
+
+			_, err := ParseFragments("accept")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseNAT64Prefix", func() {
+		It("should parse the /96 IPv6 prefixes", func() {
+			Expect(ParseNAT64Prefix(" 64:ff9b::/96")).To(Equal(netip.MustParsePrefix("64:ff9b::/96")))
+			Expect(ParseNAT64Prefix("2001:db8:64::1/96")).To(Equal(netip.MustParsePrefix("2001:db8:64::/96")))
+
+			for _, value := range []string{"", "64:ff9b::", "64:ff9b::/64", "10.0.0.0/8", "::ffff:0:0/96"} {
+				_, err := ParseNAT64Prefix(value)
+				Expect(err).To(HaveOccurred(), value)
+			}
+		})
+	})
+
+	Describe("ParseConntrackTimeouts", func() {
+		It("should parse the timeouts of the states of each protocol", func() {
+			timeouts, err := ParseConntrackTimeouts(" UDP.replied=1h, udp.unreplied=60,sctp.established=24h,")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(timeouts).To(Equal(ConntrackTimeouts{
+				"udp":  {"replied": 3600, "unreplied": 60},
+				"sctp": {"established": 86400},
+			}))
+			Expect(timeouts.States("udp")).To(Equal([]string{"unreplied", "replied"}))
+		})
+
+		It("should reject the unknown states and the invalid durations", func() {
+			for _, value := range []string{"", "udp.established=1h", "icmp.replied=1h", "udp.replied", "udp.replied=500ms", "udp.replied=-1", "udp.replied=forever"} {
+				_, err := ParseConntrackTimeouts(value)
+				Expect(err).To(HaveOccurred(), value)
+			}
+		})
+	})
+
+	Describe("ParseTrustedGateways", func() {
+		It("should parse the addresses and report the invalid ones", func() {
+			Expect(ParseTrustedGateways(" 192.168.1.1, fe80::1,,::ffff:10.0.0.1")).To(Equal([]string{"192.168.1.1", "fe80::1", "10.0.0.1"}))
+
+			gateways, err := ParseTrustedGateways("10.0.0.1,gateway")
+			Expect(err).To(MatchError(ContainSubstring("invalid trusted gateways gateway")))
+			Expect(gateways).To(Equal([]string{"10.0.0.1"}))
+		})
+	})
+
+	Describe("Policy spec conversion", func() {
+		It("should convert the v1beta1 and v1beta2 specs to the same policy spec", func() {
+			tcp := corev1.ProtocolTCP
+			port := intstr.FromInt32(8080)
+			endPort := int32(8090)
+
+			v1beta1Spec := &multiv1beta1.MultiNetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				PolicyTypes: []multiv1beta1.MultiPolicyType{multiv1beta1.PolicyTypeIngress, multiv1beta1.PolicyTypeEgress},
+				Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{{
+					Ports: []multiv1beta1.MultiNetworkPolicyPort{{Protocol: &tcp, Port: &port, EndPort: &endPort}},
+					From: []multiv1beta1.MultiNetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}}},
+						{IPBlock: &multiv1beta1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.0.1.0/24"}}},
+					},
+				}},
+				Egress: []multiv1beta1.MultiNetworkPolicyEgressRule{{
+					To: []multiv1beta1.MultiNetworkPolicyPeer{
+						{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"name": "database"}}},
+					},
+				}},
+			}
+
+			expected := PolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				PolicyTypes: []PolicyType{PolicyTypeIngress, PolicyTypeEgress},
+				Ingress: []IngressRule{{
+					Ports: []Port{{Protocol: &tcp, Port: &port, EndPort: &endPort}},
+					From: []Peer{
+						{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}}},
+						{IPBlock: &IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.0.1.0/24"}}},
+					},
+				}},
+				Egress: []EgressRule{{
+					To: []Peer{
+						{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"name": "database"}}},
+					},
+				}},
+			}
+
+			converted := PolicySpecFromV1beta1(v1beta1Spec)
+			Expect(converted).To(Equal(expected))
+
+			// The converted spec does not share memory with the API object
+			v1beta1Spec.Ingress[0].From[1].IPBlock.Except[0] = "10.0.2.0/24"
+			Expect(converted.Ingress[0].From[1].IPBlock.Except).To(Equal([]string{"10.0.1.0/24"}))
+			v1beta1Spec.Ingress[0].From[1].IPBlock.Except[0] = "10.0.1.0/24"
+
+			// v1beta2 has the same schema as v1beta1
+			v1beta2Spec := &multiv1beta2.MultiNetworkPolicySpec{}
+			data, err := json.Marshal(v1beta1Spec)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(data, v1beta2Spec)).To(Succeed())
+			Expect(PolicySpecFromV1beta2(v1beta2Spec)).To(Equal(expected))
+		})
+	})
+})
+
+var _ = Describe("Reverse index", func() {
+	var ds *Datastore
+
+	BeforeEach(func() {
+		ds = &Datastore{Policies: make(map[types.NamespacedName]*Policy)}
+	})
+
+	It("should index the policies by the pods and namespaces that may affect them", func() {
+		local := types.NamespacedName{Namespace: "ns1", Name: "local"}
+		ds.IndexPolicy(local, []string{"ns1/net1"}, &PolicySpec{
+			Ingress: []IngressRule{{From: []Peer{{PodSelector: &metav1.LabelSelector{}}}}},
+		})
+
+		allPods := types.NamespacedName{Namespace: "ns2", Name: "all-pods"}
+		ds.IndexPolicy(allPods, []string{"ns2/net1"}, &PolicySpec{
+			Egress: []EgressRule{{}},
+		})
+
+		namespaces := types.NamespacedName{Namespace: "ns3", Name: "namespaces"}
+		ds.IndexPolicy(namespaces, []string{"ns3/net1"}, &PolicySpec{
+			Ingress: []IngressRule{{From: []Peer{{NamespaceSelector: &metav1.LabelSelector{}}}}},
+		})
+
+		Expect(ds.PoliciesForPod("ns1")).To(ConsistOf(local, allPods))
+		Expect(ds.PoliciesForPod("ns3")).To(ConsistOf(allPods, namespaces))
+		Expect(ds.PoliciesForPod("other")).To(ConsistOf(allPods))
+		Expect(ds.PoliciesForNamespace()).To(ConsistOf(namespaces))
+	})
+
+	It("should index the policies by their networks and network patterns", func() {
+		exact := types.NamespacedName{Namespace: "ns1", Name: "exact"}
+		ds.IndexPolicy(exact, []string{"ns1/net1", "ns2/net2"}, &PolicySpec{})
+
+		pattern := types.NamespacedName{Namespace: "ns1", Name: "pattern"}
+		ds.IndexPolicy(pattern, []string{"*/net*"}, &PolicySpec{})
+
+		Expect(ds.PoliciesForNetwork("ns1", "net1")).To(ConsistOf(exact, pattern))
+		Expect(ds.PoliciesForNetwork("ns2", "net2")).To(ConsistOf(exact, pattern))
+		Expect(ds.PoliciesForNetwork("ns3", "net3")).To(ConsistOf(pattern))
+		Expect(ds.PoliciesForNetwork("ns1", "other")).To(BeEmpty())
+
+		Expect(ds.HasPoliciesForNetwork("ns1/net1")).To(BeTrue())
+		Expect(ds.HasPoliciesForNetwork("ns3/net3")).To(BeTrue())
+		Expect(ds.HasPoliciesForNetwork("ns1/other")).To(BeFalse())
+	})
+
+	It("should replace and remove the policies", func() {
+		key := types.NamespacedName{Namespace: "ns1", Name: "policy"}
+		ds.IndexPolicy(key, []string{"ns1/net1"}, &PolicySpec{Egress: []EgressRule{{}}})
+		ds.IndexPolicy(key, []string{"ns1/net2"}, &PolicySpec{})
+
+		Expect(ds.PoliciesForNetwork("ns1", "net1")).To(BeEmpty())
+		Expect(ds.PoliciesForNetwork("ns1", "net2")).To(ConsistOf(key))
+		Expect(ds.PoliciesForPod("other")).To(BeEmpty())
+		Expect(ds.PoliciesForPod("ns1")).To(ConsistOf(key))
+
+		ds.UnindexPolicy(key)
+		Expect(ds.PoliciesForNetwork("ns1", "net2")).To(BeEmpty())
+		Expect(ds.PoliciesForPod("ns1")).To(BeEmpty())
+		Expect(ds.index.entries).To(BeEmpty())
+		Expect(ds.index.byNamespace).To(BeEmpty())
+		Expect(ds.index.byNetwork).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Snapshot", func() {
+	var ds *Datastore
+
+	BeforeEach(func() {
+		ds = &Datastore{Policies: make(map[types.NamespacedName]*Policy)}
+		ds.CreatePolicy(&Policy{Name: "b", Namespace: "ns1", Networks: []string{"ns1/net1"}})
+		ds.CreatePolicy(&Policy{Name: "a", Namespace: "ns1", Networks: []string{"ns1/net1"}})
+		ds.SetAppliedState(types.NamespacedName{Namespace: "ns1", Name: "a"}, types.NamespacedName{Namespace: "ns1", Name: "pod1"},
+			AppliedState{PodUID: "uid1", Sandbox: "/var/run/netns/1", Hash: "hash1"})
+	})
+
+	It("should return the sorted policies with their applied states", func() {
+		snapshot := ds.Snapshot()
+		Expect(snapshot.Policies).To(HaveLen(2))
+		Expect(snapshot.Policies[0].Name).To(Equal("a"))
+		Expect(snapshot.Policies[0].Applied).To(HaveKeyWithValue("ns1/pod1", AppliedState{PodUID: "uid1", Sandbox: "/var/run/netns/1", Hash: "hash1"}))
+		Expect(snapshot.Policies[1].Name).To(Equal("b"))
+		Expect(snapshot.Policies[1].Applied).To(BeEmpty())
+	})
+
+	It("should diff two snapshots", func() {
+		from := ds.Snapshot()
+
+		ds.DeletePolicy(types.NamespacedName{Namespace: "ns1", Name: "b"})
+		ds.CreatePolicy(&Policy{Name: "c", Namespace: "ns2"})
+		ds.CreatePolicy(&Policy{Name: "a", Namespace: "ns1", Networks: []string{"ns1/net2"}})
+		ds.SetAppliedState(types.NamespacedName{Namespace: "ns1", Name: "a"}, types.NamespacedName{Namespace: "ns1", Name: "pod1"},
+			AppliedState{PodUID: "uid1", Sandbox: "/var/run/netns/1", Hash: "hash2"})
+		ds.SetAppliedState(types.NamespacedName{Namespace: "ns1", Name: "a"}, types.NamespacedName{Namespace: "ns1", Name: "pod2"},
+			AppliedState{PodUID: "uid2", Sandbox: "/var/run/netns/2", Hash: "hash2"})
+
+		diff := Diff(from, ds.Snapshot())
+		Expect(diff.Added).To(Equal([]string{"ns2/c"}))
+		Expect(diff.Removed).To(Equal([]string{"ns1/b"}))
+		Expect(diff.Changed).To(Equal([]PolicyDiff{{
+			Policy:         "ns1/a",
+			Fields:         []string{"Networks"},
+			AppliedAdded:   []string{"ns1/pod2"},
+			AppliedChanged: []string{"ns1/pod1"},
+		}}))
+
+		Expect(Diff(from, from).Changed).To(BeEmpty())
+	})
+
+	It("should serve the snapshot and the diff from a posted snapshot", func() {
+		handler := SnapshotHandler(ds)
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/datastore", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		snapshot := recorder.Body.String()
+
+		ds.DeletePolicy(types.NamespacedName{Namespace: "ns1", Name: "a"})
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader(snapshot)))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		var diff SnapshotDiff
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &diff)).To(Succeed())
+		Expect(diff.Removed).To(Equal([]string{"ns1/a"}))
+		Expect(diff.Changed).To(BeEmpty())
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader(`{"Policies":[{}]}`)))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
 })
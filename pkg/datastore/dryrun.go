@@ -0,0 +1,21 @@
+package datastore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DryRunAnnotation is the annotation key of a policy whose changes are computed and reported on each node without
+// being applied, e.g. "true"
+const DryRunAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/dry-run"
+
+// ParseDryRun parses the dry-run annotation
+func ParseDryRun(value string) (bool, error) {
+	dryRun, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return false, fmt.Errorf("invalid dry-run %q, expected true or false", value)
+	}
+
+	return dryRun, nil
+}
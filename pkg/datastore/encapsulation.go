@@ -0,0 +1,39 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncapsulationAnnotation is the annotation key of a network attachment definition carrying encapsulated traffic into
+// the pods, so that the policies match the inner headers of the traffic instead of the tunnel endpoints, e.g. "vxlan"
+const EncapsulationAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/encapsulation"
+
+// Encapsulation is the encapsulation of the traffic of a network
+type Encapsulation string
+
+const (
+	// EncapsulationVXLAN is VXLAN over UDP port 4789
+	EncapsulationVXLAN Encapsulation = "vxlan"
+	// EncapsulationGeneve is Geneve over UDP port 6081
+	EncapsulationGeneve Encapsulation = "geneve"
+)
+
+// ParseEncapsulation parses an encapsulation, vxlan or geneve
+func ParseEncapsulation(value string) (Encapsulation, error) {
+	switch encapsulation := Encapsulation(strings.ToLower(strings.TrimSpace(value))); encapsulation {
+	case EncapsulationVXLAN, EncapsulationGeneve:
+		return encapsulation, nil
+	default:
+		return "", fmt.Errorf("invalid encapsulation %q, expected %s or %s", value, EncapsulationVXLAN, EncapsulationGeneve)
+	}
+}
+
+// Port returns the IANA assigned UDP port of the encapsulation
+func (e Encapsulation) Port() int {
+	if e == EncapsulationGeneve {
+		return 6081
+	}
+
+	return 4789
+}
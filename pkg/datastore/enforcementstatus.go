@@ -0,0 +1,30 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// EnforcementStatusAnnotation is the annotation key the controllers stamp on the pods they enforce the policies on,
+// when enabled, recording the policies applied to the pod as an EnforcementStatus in JSON
+const EnforcementStatusAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/enforcement-status"
+
+// EnforcementStatus is the set of policies applied to a pod
+type EnforcementStatus struct {
+	// Hash is the hash of the policies applied to the pod and of their rulesets, it changes when any of them changes
+	Hash string `json:"hash"`
+	// Policies is the number of policies applied to the pod
+	Policies int `json:"policies"`
+	// Time is when the set of policies applied to the pod last changed, in RFC 3339
+	Time string `json:"time"`
+}
+
+// ParseEnforcementStatus parses the enforcement-status annotation
+func ParseEnforcementStatus(value string) (EnforcementStatus, error) {
+	var status EnforcementStatus
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return EnforcementStatus{}, fmt.Errorf("invalid enforcement status %q: %w", value, err)
+	}
+
+	return status, nil
+}
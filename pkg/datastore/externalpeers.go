@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ExternalPeersAnnotation is the annotation key of a policy adding external endpoints, resolved by the peer resolvers
+// registered in the controller, to the peers of its rules. It is a comma-separated list of
+// <direction>/<rule>=<resolver>:<reference>, the rule being the index of the rule in its direction and the reference
+// being passed to the resolver as is, e.g. "ingress/0=cmdb:web-frontends,egress/1=bgp:65001"
+const ExternalPeersAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/external-peers"
+
+// ExternalPeer is a reference to the external endpoints of a peer resolver, added to the peers of a rule of a policy
+type ExternalPeer struct {
+	// Direction is the direction of the rule, ingress or egress
+	Direction string
+	// Rule is the index of the rule in its direction
+	Rule int
+	// Resolver is the name of the peer resolver
+	Resolver string
+	// Reference is what the endpoints are resolved from, e.g. a group of a CMDB
+	Reference string
+}
+
+func (p ExternalPeer) String() string {
+	return fmt.Sprintf("%s/%d=%s:%s", p.Direction, p.Rule, p.Resolver, p.Reference)
+}
+
+// ParseExternalPeers parses the comma-separated entries of the external peers annotation. The invalid entries are
+// returned in the error and the valid ones are still returned.
+func ParseExternalPeers(value string) ([]ExternalPeer, error) {
+	var peers []ExternalPeer
+	var invalid []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		peer, ok := parseExternalPeer(entry)
+		if !ok {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		if !slices.Contains(peers, peer) {
+			peers = append(peers, peer)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return peers, fmt.Errorf("invalid external peers %s, expected <ingress|egress>/<rule>=<resolver>:<reference>", strings.Join(invalid, ", "))
+	}
+
+	return peers, nil
+}
+
+// parseExternalPeer parses an entry of the external peers annotation
+func parseExternalPeer(entry string) (ExternalPeer, bool) {
+	rule, endpoints, ok := strings.Cut(entry, "=")
+	if !ok {
+		return ExternalPeer{}, false
+	}
+
+	direction, index, ok := strings.Cut(strings.TrimSpace(rule), "/")
+	if !ok {
+		return ExternalPeer{}, false
+	}
+
+	direction = strings.ToLower(direction)
+	if direction != "ingress" && direction != "egress" {
+		return ExternalPeer{}, false
+	}
+
+	ruleIndex, err := strconv.Atoi(index)
+	if err != nil || ruleIndex < 0 {
+		return ExternalPeer{}, false
+	}
+
+	resolver, reference, ok := strings.Cut(strings.TrimSpace(endpoints), ":")
+	if !ok || resolver == "" || reference == "" {
+		return ExternalPeer{}, false
+	}
+
+	return ExternalPeer{Direction: direction, Rule: ruleIndex, Resolver: resolver, Reference: reference}, true
+}
+
+// PoliciesWithPeerResolver returns the policies of the datastore with external peers of a peer resolver
+func (d *Datastore) PoliciesWithPeerResolver(resolver string) []types.NamespacedName {
+	d.RLock()
+	defer d.RUnlock()
+
+	var policies []types.NamespacedName
+	for key, policy := range d.Policies {
+		if slices.ContainsFunc(policy.ExternalPeers, func(peer ExternalPeer) bool { return peer.Resolver == resolver }) {
+			policies = append(policies, key)
+		}
+	}
+
+	return policies
+}
@@ -0,0 +1,31 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FragmentsAnnotation is the annotation key of a network attachment definition setting how the fragmented packets of
+// the network are handled, e.g. "drop"
+const FragmentsAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/fragments"
+
+// Fragments is how the fragmented packets of a network are handled
+type Fragments string
+
+const (
+	// FragmentsReassemble matches the fragmented packets once reassembled by the connection tracking, the default
+	FragmentsReassemble Fragments = "reassemble"
+	// FragmentsDrop drops the non-first fragments before they are reassembled, so the fragmented packets never match
+	// the ports of the rules
+	FragmentsDrop Fragments = "drop"
+)
+
+// ParseFragments parses how the fragmented packets are handled, reassemble or drop
+func ParseFragments(value string) (Fragments, error) {
+	switch fragments := Fragments(strings.ToLower(strings.TrimSpace(value))); fragments {
+	case FragmentsReassemble, FragmentsDrop:
+		return fragments, nil
+	default:
+		return "", fmt.Errorf("invalid fragments %q, expected %s or %s", value, FragmentsReassemble, FragmentsDrop)
+	}
+}
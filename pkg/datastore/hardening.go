@@ -0,0 +1,47 @@
+package datastore
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ICMPHardeningAnnotation is the annotation key of a network attachment definition dropping the ICMP redirects and the
+// ICMPv6 router advertisements arriving on the interfaces of the network, whatever the ICMP options, e.g. "true"
+const ICMPHardeningAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/icmp-hardening"
+
+// TrustedGatewaysAnnotation is the annotation key of a network attachment definition listing the gateways still
+// allowed to send the ICMP redirects and the router advertisements on a hardened network, as a comma-separated list
+// of addresses, e.g. "192.168.1.1,fe80::1"
+const TrustedGatewaysAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/trusted-gateways"
+
+// ICMPHardening is the ICMP hardening of a network
+type ICMPHardening struct {
+	// Gateways are the addresses of the trusted gateways
+	Gateways []string
+}
+
+// ParseTrustedGateways parses the comma-separated addresses of the trusted gateways annotation. The invalid addresses
+// are returned in the error and the valid ones are still returned.
+func ParseTrustedGateways(value string) ([]string, error) {
+	var gateways, invalid []string
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			invalid = append(invalid, address)
+			continue
+		}
+		gateways = append(gateways, addr.Unmap().String())
+	}
+
+	if len(invalid) > 0 {
+		return gateways, fmt.Errorf("invalid trusted gateways %s", strings.Join(invalid, ", "))
+	}
+
+	return gateways, nil
+}
@@ -0,0 +1,242 @@
+package datastore
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// policyIndex is the reverse index from the pods, namespaces and networks to the policies that may be affected by
+// them, so that their events only check these policies instead of all of them. It holds the desired policies, indexed
+// before they are applied, so that the events received while a policy is applied are not missed.
+type policyIndex struct {
+	sync.RWMutex
+	// entries are the indexed keys of each policy, to remove them when the policy changes
+	entries map[types.NamespacedName]indexEntry
+	// byNamespace indexes the policies selecting the pods of their own namespace, by namespace
+	byNamespace map[string]map[types.NamespacedName]struct{}
+	// anyPod are the policies that may be affected by a pod of any namespace
+	anyPod map[types.NamespacedName]struct{}
+	// anyNamespace are the policies with namespace selectors
+	anyNamespace map[types.NamespacedName]struct{}
+	// byNetwork indexes the policies by the networks of their policy-for annotation, as <namespace>/<name>
+	byNetwork map[string]map[types.NamespacedName]struct{}
+	// networkPatterns indexes the policies by the networks of their policy-for annotation with wildcards
+	networkPatterns map[string]map[types.NamespacedName]struct{}
+}
+
+// indexEntry is what a policy is indexed by
+type indexEntry struct {
+	namespace    string
+	anyPod       bool
+	anyNamespace bool
+	networks     []string
+}
+
+// newIndexEntry returns what a policy is indexed by, with the conditions of the enqueues of the controllers
+func newIndexEntry(namespace string, networks []string, spec *PolicySpec) indexEntry {
+	entry := indexEntry{namespace: namespace, networks: networks}
+
+	for _, rule := range spec.Ingress {
+		entry.indexPeers(rule.From)
+	}
+	for _, rule := range spec.Egress {
+		entry.indexPeers(rule.To)
+	}
+
+	return entry
+}
+
+// indexPeers records whether the peers of a rule may select the pods or the namespaces outside of the policy namespace
+func (e *indexEntry) indexPeers(peers []Peer) {
+	// If empty, every pod is a peer
+	if len(peers) == 0 {
+		e.anyPod = true
+		return
+	}
+
+	for _, peer := range peers {
+		if peer.IPBlock != nil || peer.NamespaceSelector == nil {
+			continue
+		}
+
+		e.anyNamespace = true
+		if peer.PodSelector != nil {
+			e.anyPod = true
+		}
+	}
+}
+
+// isNetworkPattern checks if a network of the policy-for annotation has wildcards
+func isNetworkPattern(network string) bool {
+	return strings.ContainsAny(network, `*?[\`)
+}
+
+// MatchesNetwork checks if a network of the policy-for annotation, as <namespace>/<name>, matches a network attachment
+// definition. The namespace and the name can be patterns.
+func MatchesNetwork(network string, namespace string, name string) bool {
+	nsPattern, namePattern, found := strings.Cut(network, "/")
+	if !found {
+		return false
+	}
+
+	nsMatched, err := path.Match(nsPattern, namespace)
+	if err != nil || !nsMatched {
+		return false
+	}
+
+	nameMatched, err := path.Match(namePattern, name)
+	return err == nil && nameMatched
+}
+
+// IndexPolicy records a policy and the networks of its policy-for annotation in the reverse indexes, replacing the
+// previous version of the policy
+func (d *Datastore) IndexPolicy(key types.NamespacedName, networks []string, spec *PolicySpec) {
+	d.index.Lock()
+	defer d.index.Unlock()
+
+	d.index.remove(key)
+	d.index.add(key, newIndexEntry(key.Namespace, networks, spec))
+}
+
+// UnindexPolicy removes a policy from the reverse indexes
+func (d *Datastore) UnindexPolicy(key types.NamespacedName) {
+	d.index.Lock()
+	defer d.index.Unlock()
+
+	d.index.remove(key)
+}
+
+// PoliciesForPod returns the indexed policies that may be affected by a pod of a namespace
+func (d *Datastore) PoliciesForPod(namespace string) []types.NamespacedName {
+	d.index.RLock()
+	defer d.index.RUnlock()
+
+	return keys(d.index.byNamespace[namespace], d.index.anyPod)
+}
+
+// PoliciesForNamespace returns the indexed policies that may be affected by a namespace
+func (d *Datastore) PoliciesForNamespace() []types.NamespacedName {
+	d.index.RLock()
+	defer d.index.RUnlock()
+
+	return keys(d.index.anyNamespace)
+}
+
+// PoliciesForNetwork returns the indexed policies with a network of their policy-for annotation matching a network
+// attachment definition
+func (d *Datastore) PoliciesForNetwork(namespace string, name string) []types.NamespacedName {
+	d.index.RLock()
+	defer d.index.RUnlock()
+
+	sets := []map[types.NamespacedName]struct{}{d.index.byNetwork[namespace+"/"+name]}
+	for pattern, policies := range d.index.networkPatterns {
+		if MatchesNetwork(pattern, namespace, name) {
+			sets = append(sets, policies)
+		}
+	}
+
+	return keys(sets...)
+}
+
+// HasPoliciesForNetwork checks if an indexed policy has a network of its policy-for annotation matching a network
+// attachment definition, as <namespace>/<name>
+func (d *Datastore) HasPoliciesForNetwork(network string) bool {
+	d.index.RLock()
+	defer d.index.RUnlock()
+
+	if len(d.index.byNetwork[network]) > 0 {
+		return true
+	}
+
+	namespace, name, found := strings.Cut(network, "/")
+	if !found {
+		return false
+	}
+
+	for pattern := range d.index.networkPatterns {
+		if MatchesNetwork(pattern, namespace, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add adds a policy to the indexes, the lock must be held
+func (i *policyIndex) add(key types.NamespacedName, entry indexEntry) {
+	if i.entries == nil {
+		i.entries = make(map[types.NamespacedName]indexEntry)
+		i.byNamespace = make(map[string]map[types.NamespacedName]struct{})
+		i.anyPod = make(map[types.NamespacedName]struct{})
+		i.anyNamespace = make(map[types.NamespacedName]struct{})
+		i.byNetwork = make(map[string]map[types.NamespacedName]struct{})
+		i.networkPatterns = make(map[string]map[types.NamespacedName]struct{})
+	}
+
+	i.entries[key] = entry
+	addKey(i.byNamespace, entry.namespace, key)
+	if entry.anyPod {
+		i.anyPod[key] = struct{}{}
+	}
+	if entry.anyNamespace {
+		i.anyNamespace[key] = struct{}{}
+	}
+	for _, network := range entry.networks {
+		if isNetworkPattern(network) {
+			addKey(i.networkPatterns, network, key)
+		} else {
+			addKey(i.byNetwork, network, key)
+		}
+	}
+}
+
+// remove removes a policy from the indexes, the lock must be held
+func (i *policyIndex) remove(key types.NamespacedName) {
+	entry, ok := i.entries[key]
+	if !ok {
+		return
+	}
+
+	delete(i.entries, key)
+	removeKey(i.byNamespace, entry.namespace, key)
+	delete(i.anyPod, key)
+	delete(i.anyNamespace, key)
+	for _, network := range entry.networks {
+		removeKey(i.networkPatterns, network, key)
+		removeKey(i.byNetwork, network, key)
+	}
+}
+
+func addKey(index map[string]map[types.NamespacedName]struct{}, value string, key types.NamespacedName) {
+	if index[value] == nil {
+		index[value] = make(map[types.NamespacedName]struct{})
+	}
+	index[value][key] = struct{}{}
+}
+
+func removeKey(index map[string]map[types.NamespacedName]struct{}, value string, key types.NamespacedName) {
+	delete(index[value], key)
+	if len(index[value]) == 0 {
+		delete(index, value)
+	}
+}
+
+// keys returns the union of sets of policies
+func keys(sets ...map[types.NamespacedName]struct{}) []types.NamespacedName {
+	seen := make(map[types.NamespacedName]struct{})
+	var result []types.NamespacedName
+	for _, set := range sets {
+		for key := range set {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			result = append(result, key)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// InfrastructureAddressesAnnotation is the annotation key of a network attachment definition listing the addresses of
+// the infrastructure of the network, e.g. the gateway, the health check sources or the DNS servers, always allowed by
+// the policies. It is a comma-separated list of addresses and CIDRs allowed in both directions, and of the gateway and
+// dns entries deriving the gateways and the DNS servers from the IPAM configuration of the network, e.g.
+// "gateway,dns,192.168.100.0/28"
+const InfrastructureAddressesAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/infrastructure-addresses"
+
+const (
+	// InfrastructureGateway derives the gateways and the route gateways of the IPAM configuration, allowed in both
+	// directions
+	InfrastructureGateway = "gateway"
+	// InfrastructureDNS derives the DNS servers of the IPAM configuration, only allowed on the DNS port on egress
+	InfrastructureDNS = "dns"
+)
+
+// Infrastructure is the infrastructure of a network always allowed by the policies
+type Infrastructure struct {
+	// Addresses are the CIDRs allowed in both directions
+	Addresses []string
+	// DNSServers are the CIDRs of the DNS servers allowed on the DNS port on egress
+	DNSServers []string
+}
+
+// ParseInfrastructureAddresses parses the comma-separated entries of the infrastructure addresses annotation, the
+// addresses are returned as normalized CIDRs with the entries derived from the IPAM configuration. The invalid entries
+// are returned in the error and the valid ones are still returned.
+func ParseInfrastructureAddresses(value string) ([]string, []string, error) {
+	var cidrs, derived, invalid []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if entry == InfrastructureGateway || entry == InfrastructureDNS {
+			if !slices.Contains(derived, entry) {
+				derived = append(derived, entry)
+			}
+			continue
+		}
+
+		cidr, err := AddressCIDR(entry)
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+
+		if !slices.Contains(cidrs, cidr) {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+
+	if len(invalid) > 0 {
+		return cidrs, derived, fmt.Errorf("invalid infrastructure addresses %s, expected addresses, CIDRs, %s or %s", strings.Join(invalid, ", "), InfrastructureGateway, InfrastructureDNS)
+	}
+
+	return cidrs, derived, nil
+}
+
+// AddressCIDR returns the normalized CIDR of an address or a CIDR, an address is a /32 or a /128 CIDR
+func AddressCIDR(value string) (string, error) {
+	if strings.Contains(value, "/") {
+		return utils.NormalizeCIDR(value)
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return "", err
+	}
+	addr = addr.Unmap().WithZone("")
+
+	return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+}
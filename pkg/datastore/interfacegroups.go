@@ -0,0 +1,43 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// InterfaceGroupsAnnotation is the annotation key of a pod grouping its interfaces enforced as one unit, e.g. the
+// active and standby attachments of a pod to a network through different devices, as semicolon-separated groups of
+// comma-separated interface names, e.g. "net1,net2;net3,net4". The policies applied to an interface of a group are
+// applied to the whole group, and the addresses of the group are allowed as the addresses of each of its networks.
+const InterfaceGroupsAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/interface-groups"
+
+// ParseInterfaceGroups parses the groups of the interface groups annotation. The groups of less than two interfaces and
+// the groups sharing an interface with a previous group are skipped and returned as an error.
+func ParseInterfaceGroups(value string) ([][]string, error) {
+	var groups [][]string
+	var errs []error
+	for _, item := range strings.Split(value, ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+
+		group := ParseInterfaces(item)
+		if len(group) < 2 {
+			errs = append(errs, fmt.Errorf("invalid interface group %q, expected at least two interfaces", strings.TrimSpace(item)))
+			continue
+		}
+
+		if slices.ContainsFunc(groups, func(other []string) bool {
+			return slices.ContainsFunc(group, func(name string) bool { return slices.Contains(other, name) })
+		}) {
+			errs = append(errs, fmt.Errorf("invalid interface group %q, an interface is already in another group", strings.TrimSpace(item)))
+			continue
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, errors.Join(errs...)
+}
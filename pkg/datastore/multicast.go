@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// MulticastGroupsAnnotation is the annotation key of a policy listing the multicast groups the pods of the policy can
+// receive UDP traffic from on the networks of the policy, as a comma-separated list of CIDRs, e.g. "239.1.1.0/24,ff3e::/16"
+const MulticastGroupsAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/multicast-groups"
+
+var (
+	ipv4MulticastPrefix = netip.MustParsePrefix("224.0.0.0/4")
+	ipv6MulticastPrefix = netip.MustParsePrefix("ff00::/8")
+)
+
+// ParseMulticastGroups parses the comma-separated CIDRs of the multicast groups annotation, the CIDRs are normalized.
+// The invalid CIDRs and the ones outside of the multicast ranges are returned in the error and the valid ones are still
+// returned.
+func ParseMulticastGroups(value string) ([]string, error) {
+	var groups, invalid []string
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+
+		normalized, err := utils.NormalizeCIDR(cidr)
+		if err != nil {
+			invalid = append(invalid, cidr)
+			continue
+		}
+
+		if !isMulticastPrefix(netip.MustParsePrefix(normalized)) {
+			invalid = append(invalid, cidr)
+			continue
+		}
+
+		groups = append(groups, normalized)
+	}
+
+	if len(invalid) > 0 {
+		return groups, fmt.Errorf("invalid multicast groups %s, expected CIDRs in %s or %s", strings.Join(invalid, ", "), ipv4MulticastPrefix, ipv6MulticastPrefix)
+	}
+
+	return groups, nil
+}
+
+// isMulticastPrefix checks that a prefix is in the IPv4 or the IPv6 multicast range
+func isMulticastPrefix(prefix netip.Prefix) bool {
+	for _, multicast := range []netip.Prefix{ipv4MulticastPrefix, ipv6MulticastPrefix} {
+		if multicast.Contains(prefix.Addr()) && prefix.Bits() >= multicast.Bits() {
+			return true
+		}
+	}
+
+	return false
+}
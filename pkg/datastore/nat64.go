@@ -0,0 +1,31 @@
+package datastore
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// NAT64PrefixAnnotation is the annotation key of a network attachment definition of an IPv6-only network reaching the
+// IPv4 peers through NAT64, e.g. "64:ff9b::/96". The traffic of the IPv4 peers arrives from and leaves to their
+// addresses embedded in the prefix, the policies also match them there.
+const NAT64PrefixAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/nat64-prefix"
+
+// ParseNAT64Prefix parses a NAT64 prefix, an IPv6 /96 prefix. The shorter prefixes of RFC 6052 split the IPv4 addresses
+// around the u octet, the IPv4 CIDRs could not be translated to IPv6 CIDRs.
+func ParseNAT64Prefix(value string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(value))
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid NAT64 prefix %q: %w", value, err)
+	}
+
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return netip.Prefix{}, fmt.Errorf("invalid NAT64 prefix %q, expected an IPv6 prefix", value)
+	}
+
+	if prefix.Bits() != 96 {
+		return netip.Prefix{}, fmt.Errorf("invalid NAT64 prefix %q, expected a /96 prefix", value)
+	}
+
+	return prefix.Masked(), nil
+}
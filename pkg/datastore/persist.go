@@ -0,0 +1,611 @@
+package datastore
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// persistedVersion is the version of the format of the persisted datastore, other versions are ignored
+const persistedVersion = 1
+
+// AppliedState is the state of a policy applied to a pod
+type AppliedState struct {
+	// PodUID distinguishes the pods recreated with the same name
+	PodUID types.UID
+	// Sandbox is the network namespace path of the pod, it changes when the sandbox is recreated
+	Sandbox string
+	// Hash is the hash of the ruleset rendered for the pod
+	Hash string
+}
+
+// Intent is what an apply in progress does to a pod
+type Intent string
+
+const (
+	// IntentApply applies a policy to a pod
+	IntentApply Intent = "apply"
+	// IntentCleanUp cleans up a policy from a pod
+	IntentCleanUp Intent = "cleanup"
+)
+
+// JournalEntry is an apply in progress, written before the ruleset is applied to a pod and cleared once it is
+// applied and verified
+type JournalEntry struct {
+	Transaction uint64
+	Policy      types.NamespacedName
+	Pod         types.NamespacedName
+	// PodUID and Sandbox are the pod and the network namespace path the ruleset is applied to
+	PodUID  types.UID
+	Sandbox string
+	Intent  Intent
+}
+
+// persistedDatastore is the format of the snapshot of the persisted datastore
+type persistedDatastore struct {
+	Version  int
+	Policies []*Policy
+	Applied  []persistedAppliedState
+	Journal  []JournalEntry
+}
+
+// persistedAppliedState is the state of a policy applied to a pod in the persisted datastore
+type persistedAppliedState struct {
+	Policy types.NamespacedName
+	Pod    types.NamespacedName
+	AppliedState
+}
+
+// persistedRecord is a change of the datastore appended to its log. Each change sets or deletes a whole value, so
+// that replaying the records already in the snapshot leaves it unchanged.
+type persistedRecord struct {
+	// Policy is a created or updated policy
+	Policy *Policy `json:",omitempty"`
+	// DeletedPolicy is a deleted policy, deleted with its applied states
+	DeletedPolicy *types.NamespacedName `json:",omitempty"`
+	// Applied are the states of the policies applied to the pods
+	Applied []persistedAppliedState `json:",omitempty"`
+	// Unapplied are the policies and the pods whose applied states are deleted
+	Unapplied []persistedAppliedState `json:",omitempty"`
+	// Begin is an apply journaled before it is run
+	Begin *JournalEntry `json:",omitempty"`
+	// End is the transaction of an apply cleared from the journal
+	End uint64 `json:",omitempty"`
+	// ClearJournal clears all the applies of the journal
+	ClearJournal bool `json:",omitempty"`
+}
+
+// minCompactRecords is the number of records of the log above which it is compacted into the snapshot, the log is
+// also allowed to grow to twice the number of values of the datastore so that the compaction is amortized
+const minCompactRecords = 1024
+
+// persistLog appends the changes of the datastore to the log of its file, next to the snapshot the log is compacted
+// into. The changes are recorded while the datastore is locked and written once it is unlocked, so that the readers
+// and the writers of the datastore do not wait for the disk.
+type persistLog struct {
+	// pendingMu guards the pending records, it is only held to record a change
+	pendingMu sync.Mutex
+	pending   []persistedRecord
+
+	// writeMu serializes the writes of the log and of the snapshot, the records are written in the order they are
+	// recorded
+	writeMu sync.Mutex
+	file    *os.File
+	records int
+}
+
+// logPath returns the path of the log of the changes of the snapshot
+func logPath(path string) string {
+	return path + ".log"
+}
+
+// Load restores the datastore persisted to the file, its snapshot and the changes logged since, the datastore is then
+// persisted to the file on every change. A missing file or a file of another version returns an empty datastore.
+func Load(path string) (*Datastore, error) {
+	d := &Datastore{
+		Policies: make(map[types.NamespacedName]*Policy),
+		Path:     path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read datastore: %w", err)
+	}
+
+	if err == nil {
+		var persisted persistedDatastore
+		if err := json.Unmarshal(data, &persisted); err != nil {
+			return nil, fmt.Errorf("failed to decode datastore %s: %w", path, err)
+		}
+
+		if persisted.Version != persistedVersion {
+			return d, nil
+		}
+
+		for _, policy := range persisted.Policies {
+			d.Policies[types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}] = policy
+		}
+		for _, applied := range persisted.Applied {
+			d.setAppliedState(applied.Policy, applied.Pod, applied.AppliedState)
+		}
+		for _, entry := range persisted.Journal {
+			d.replay(persistedRecord{Begin: &entry})
+		}
+	}
+
+	data, err = os.ReadFile(logPath(path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return d, nil
+		}
+
+		return nil, fmt.Errorf("failed to read datastore log: %w", err)
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+
+		var record persistedRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// The last record may be partially written by a crash, it was never acknowledged
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("failed to decode datastore log %s: %w", logPath(path), err)
+		}
+
+		d.replay(record)
+	}
+
+	return d, nil
+}
+
+// replay applies a logged change to the datastore
+func (d *Datastore) replay(record persistedRecord) {
+	if record.Policy != nil {
+		d.Policies[types.NamespacedName{Namespace: record.Policy.Namespace, Name: record.Policy.Name}] = record.Policy
+	}
+	if record.DeletedPolicy != nil {
+		delete(d.Policies, *record.DeletedPolicy)
+		delete(d.Applied, *record.DeletedPolicy)
+	}
+
+	for _, applied := range record.Applied {
+		d.setAppliedState(applied.Policy, applied.Pod, applied.AppliedState)
+	}
+	for _, applied := range record.Unapplied {
+		delete(d.Applied[applied.Policy], applied.Pod)
+		if len(d.Applied[applied.Policy]) == 0 {
+			delete(d.Applied, applied.Policy)
+		}
+	}
+
+	if record.Begin != nil {
+		if d.Journal == nil {
+			d.Journal = make(map[uint64]JournalEntry)
+		}
+		d.Journal[record.Begin.Transaction] = *record.Begin
+		d.lastTransaction = max(d.lastTransaction, record.Begin.Transaction)
+	}
+	if record.End != 0 {
+		delete(d.Journal, record.End)
+	}
+	if record.ClearJournal {
+		d.Journal = nil
+	}
+}
+
+// setAppliedState sets the state of a policy applied to a pod, the lock must be held
+func (d *Datastore) setAppliedState(policy types.NamespacedName, pod types.NamespacedName, state AppliedState) {
+	if d.Applied == nil {
+		d.Applied = make(map[types.NamespacedName]map[types.NamespacedName]AppliedState)
+	}
+	if d.Applied[policy] == nil {
+		d.Applied[policy] = make(map[types.NamespacedName]AppliedState)
+	}
+
+	d.Applied[policy][pod] = state
+}
+
+// persist records a change of the datastore to append to its log, the lock must be held. The change is written by
+// flush once the lock is released.
+func (d *Datastore) persist(record persistedRecord) {
+	if d.Path == "" {
+		return
+	}
+
+	d.log.pendingMu.Lock()
+	defer d.log.pendingMu.Unlock()
+
+	d.log.pending = append(d.log.pending, record)
+}
+
+// flush appends the recorded changes to the log, the lock must not be held. The log is compacted into the snapshot
+// when it grows too large. When it fails, the files are removed so that the next start does not trust a stale state,
+// and the next flush writes the snapshot again.
+func (d *Datastore) flush() {
+	if d.Path == "" {
+		return
+	}
+
+	d.log.writeMu.Lock()
+	defer d.log.writeMu.Unlock()
+
+	err := d.writeLog()
+	if err == nil && (d.log.file == nil || d.log.records >= minCompactRecords) {
+		err = d.compact()
+	}
+	if err == nil {
+		return
+	}
+
+	log.Log.WithName("datastore").Error(err, "Failed to persist datastore, removing it", "path", d.Path)
+	if d.log.file != nil {
+		d.log.file.Close()
+		d.log.file = nil
+	}
+	for _, path := range []string{d.Path, logPath(d.Path)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Log.WithName("datastore").Error(err, "Failed to remove datastore", "path", path)
+		}
+	}
+}
+
+// writeLog appends the pending records to the log, writeMu must be held. Without a log, the records are left to the
+// compaction writing the snapshot.
+func (d *Datastore) writeLog() error {
+	if d.log.file == nil {
+		return nil
+	}
+
+	d.log.pendingMu.Lock()
+	pending := d.log.pending
+	d.log.pending = nil
+	d.log.pendingMu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range pending {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to encode datastore change: %w", err)
+		}
+	}
+
+	if _, err := d.log.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write datastore log: %w", err)
+	}
+
+	// The records of the concurrent changes are written and synced together, the changes recorded while a write is
+	// in progress wait for it and are synced by the next one
+	if err := d.log.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync datastore log: %w", err)
+	}
+	d.log.records += len(pending)
+
+	return nil
+}
+
+// compact writes the datastore to its snapshot and truncates the log, writeMu must be held. The datastore is read
+// locked so that the snapshot holds all the changes recorded, including the ones not yet written to the log. A crash
+// before the log is truncated replays the log onto the snapshot, which leaves it unchanged.
+func (d *Datastore) compact() error {
+	d.RLock()
+	defer d.RUnlock()
+
+	values := len(d.Policies) + len(d.Journal)
+	for _, pods := range d.Applied {
+		values += len(pods)
+	}
+	if d.log.file != nil && d.log.records < 2*values {
+		return nil
+	}
+
+	if err := d.writeSnapshot(); err != nil {
+		return err
+	}
+
+	// The changes recorded before the snapshot are in it
+	d.log.pendingMu.Lock()
+	d.log.pending = nil
+	d.log.pendingMu.Unlock()
+
+	if d.log.file == nil {
+		file, err := os.OpenFile(logPath(d.Path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open datastore log: %w", err)
+		}
+		d.log.file = file
+
+		// The log created in the directory is not lost by a crash
+		if err := syncDir(filepath.Dir(d.Path)); err != nil {
+			return err
+		}
+	}
+
+	if err := d.log.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate datastore log: %w", err)
+	}
+	d.log.records = 0
+
+	return nil
+}
+
+// writeSnapshot writes the datastore to a temporary file synced and renamed over its file, so that a crash never
+// leaves a partial or a lost file, the lock must be held
+func (d *Datastore) writeSnapshot() error {
+	persisted := persistedDatastore{Version: persistedVersion}
+	for _, policy := range d.Policies {
+		persisted.Policies = append(persisted.Policies, policy)
+	}
+	for policy, pods := range d.Applied {
+		for pod, state := range pods {
+			persisted.Applied = append(persisted.Applied, persistedAppliedState{Policy: policy, Pod: pod, AppliedState: state})
+		}
+	}
+	for _, entry := range d.Journal {
+		persisted.Journal = append(persisted.Journal, entry)
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return fmt.Errorf("failed to encode datastore: %w", err)
+	}
+
+	dir := filepath.Dir(d.Path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create datastore directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(d.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create datastore: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write datastore: %w", err)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync datastore: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write datastore: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), d.Path); err != nil {
+		return fmt.Errorf("failed to replace datastore: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir syncs a directory, so that the files renamed in it are not lost by a crash
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open datastore directory: %w", err)
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync datastore directory: %w", err)
+	}
+
+	return nil
+}
+
+// GetAppliedState gets the state of a policy applied to a pod
+func (d *Datastore) GetAppliedState(policy types.NamespacedName, pod types.NamespacedName) (AppliedState, bool) {
+	d.RLock()
+	defer d.RUnlock()
+
+	state, ok := d.Applied[policy][pod]
+	return state, ok
+}
+
+// SetAppliedState records the state of a policy applied to a pod
+func (d *Datastore) SetAppliedState(policy types.NamespacedName, pod types.NamespacedName, state AppliedState) {
+	defer d.flush()
+	d.Lock()
+	defer d.Unlock()
+
+	if current, ok := d.Applied[policy][pod]; ok && current == state {
+		return
+	}
+
+	d.setAppliedState(policy, pod, state)
+	d.persist(persistedRecord{Applied: []persistedAppliedState{{Policy: policy, Pod: pod, AppliedState: state}}})
+}
+
+// AppliedStateChange is a change of the state of a policy applied to a pod, a nil state deletes it
+type AppliedStateChange struct {
+	Policy types.NamespacedName
+	Pod    types.NamespacedName
+	State  *AppliedState
+}
+
+// UpdateAppliedStates records the changes of the states of the policies applied to the pods in order, e.g. all the
+// changes of a sync, with a single write of the log
+func (d *Datastore) UpdateAppliedStates(changes []AppliedStateChange) {
+	defer d.flush()
+	d.Lock()
+	defer d.Unlock()
+
+	type key struct{ policy, pod types.NamespacedName }
+	var (
+		order   []key
+		changed = make(map[key]*AppliedState)
+	)
+	for _, change := range changes {
+		k := key{policy: change.Policy, pod: change.Pod}
+		current, ok := d.Applied[change.Policy][change.Pod]
+		switch {
+		case change.State == nil && !ok, change.State != nil && ok && current == *change.State:
+			continue
+		case change.State == nil:
+			delete(d.Applied[change.Policy], change.Pod)
+			if len(d.Applied[change.Policy]) == 0 {
+				delete(d.Applied, change.Policy)
+			}
+		default:
+			d.setAppliedState(change.Policy, change.Pod, *change.State)
+		}
+
+		if _, ok := changed[k]; !ok {
+			order = append(order, k)
+		}
+		changed[k] = change.State
+	}
+
+	// The last change of each pod is recorded, a pod is never both applied and unapplied by the record
+	var record persistedRecord
+	for _, k := range order {
+		if state := changed[k]; state != nil {
+			record.Applied = append(record.Applied, persistedAppliedState{Policy: k.policy, Pod: k.pod, AppliedState: *state})
+		} else {
+			record.Unapplied = append(record.Unapplied, persistedAppliedState{Policy: k.policy, Pod: k.pod})
+		}
+	}
+	if len(order) > 0 {
+		d.persist(record)
+	}
+}
+
+// DeleteAppliedStates deletes the states of a policy applied to the pods that are not kept, nil deletes all of them
+func (d *Datastore) DeleteAppliedStates(policy types.NamespacedName, keep func(pod types.NamespacedName) bool) {
+	defer d.flush()
+	d.Lock()
+	defer d.Unlock()
+
+	var deleted []persistedAppliedState
+	for pod := range d.Applied[policy] {
+		if keep == nil || !keep(pod) {
+			delete(d.Applied[policy], pod)
+			deleted = append(deleted, persistedAppliedState{Policy: policy, Pod: pod})
+		}
+	}
+
+	if len(d.Applied[policy]) == 0 {
+		delete(d.Applied, policy)
+	}
+
+	if len(deleted) > 0 {
+		d.persist(persistedRecord{Unapplied: deleted})
+	}
+}
+
+// CollectAppliedStates deletes the states applied to the pods that are not kept by any policy, and returns the number
+// of deleted states
+func (d *Datastore) CollectAppliedStates(keep func(pod types.NamespacedName, state AppliedState) bool) int {
+	defer d.flush()
+	d.Lock()
+	defer d.Unlock()
+
+	var collected []persistedAppliedState
+	for policy, pods := range d.Applied {
+		for pod, state := range pods {
+			if !keep(pod, state) {
+				delete(pods, pod)
+				collected = append(collected, persistedAppliedState{Policy: policy, Pod: pod})
+			}
+		}
+
+		if len(pods) == 0 {
+			delete(d.Applied, policy)
+		}
+	}
+
+	if len(collected) > 0 {
+		d.persist(persistedRecord{Unapplied: collected})
+	}
+
+	return len(collected)
+}
+
+// ListAppliedStates returns a copy of the states of the policies applied to the pods, by policy and pod
+func (d *Datastore) ListAppliedStates() map[types.NamespacedName]map[types.NamespacedName]AppliedState {
+	d.RLock()
+	defer d.RUnlock()
+
+	applied := make(map[types.NamespacedName]map[types.NamespacedName]AppliedState, len(d.Applied))
+	for policy, pods := range d.Applied {
+		applied[policy] = make(map[types.NamespacedName]AppliedState, len(pods))
+		for pod, state := range pods {
+			applied[policy][pod] = state
+		}
+	}
+
+	return applied
+}
+
+// BeginTransaction journals an apply to a pod before it is run, and returns its transaction to end it with
+func (d *Datastore) BeginTransaction(entry JournalEntry) uint64 {
+	defer d.flush()
+	d.Lock()
+	defer d.Unlock()
+
+	d.lastTransaction++
+	entry.Transaction = d.lastTransaction
+
+	if d.Journal == nil {
+		d.Journal = make(map[uint64]JournalEntry)
+	}
+	d.Journal[entry.Transaction] = entry
+	d.persist(persistedRecord{Begin: &entry})
+
+	return entry.Transaction
+}
+
+// EndTransaction clears an apply from the journal once it is done, applied and verified or failed
+func (d *Datastore) EndTransaction(transaction uint64) {
+	defer d.flush()
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.Journal[transaction]; !ok {
+		return
+	}
+
+	delete(d.Journal, transaction)
+	d.persist(persistedRecord{End: transaction})
+}
+
+// TakeJournal returns the applies in progress when the previous process stopped, in the order they started, and
+// clears them from the journal
+func (d *Datastore) TakeJournal() []JournalEntry {
+	defer d.flush()
+	d.Lock()
+	defer d.Unlock()
+
+	entries := slices.SortedFunc(maps.Values(d.Journal), func(a, b JournalEntry) int {
+		return cmp.Compare(a.Transaction, b.Transaction)
+	})
+
+	if len(d.Journal) > 0 {
+		d.Journal = nil
+		d.persist(persistedRecord{ClearJournal: true})
+	}
+
+	return entries
+}
@@ -0,0 +1,25 @@
+package datastore
+
+import (
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// PodInfo is the compact representation of a pod selected as a peer by a policy. The peers are resolved from every pod
+// of the selected namespaces, so only what the rules are rendered from is retained instead of the full pod.
+type PodInfo struct {
+	UID       types.UID
+	Namespace string
+	Name      string
+	Phase     string
+	Labels    map[string]string
+	// Interfaces are the secondary interfaces of the pod with their IPs
+	Interfaces []PodInterface
+}
+
+// PodInterface is a secondary interface of a pod
+type PodInterface struct {
+	Name string
+	// Network is the network of the interface, as <namespace>/<name>
+	Network string
+	IPs     []string
+}
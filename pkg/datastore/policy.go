@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The policy model below is the internal representation of a MultiNetworkPolicy, independent of the API version.
+// Every served API version is converted to it, so that the renderer does not change when the API graduates.
+
+// PolicyType is the direction of the traffic a policy applies to
+type PolicyType string
+
+const (
+	// PolicyTypeIngress applies the policy to the ingress traffic
+	PolicyTypeIngress PolicyType = "Ingress"
+	// PolicyTypeEgress applies the policy to the egress traffic
+	PolicyTypeEgress PolicyType = "Egress"
+)
+
+// PolicySpec is the specification of a policy
+type PolicySpec struct {
+	PodSelector metav1.LabelSelector
+	Ingress     []IngressRule
+	Egress      []EgressRule
+	PolicyTypes []PolicyType
+}
+
+// IngressRule allows the traffic from the peers to the ports
+type IngressRule struct {
+	Ports []Port
+	From  []Peer
+}
+
+// EgressRule allows the traffic to the peers on the ports
+type EgressRule struct {
+	Ports []Port
+	To    []Peer
+}
+
+// Port is a port, or a range of ports with EndPort, of a protocol
+type Port struct {
+	Protocol *corev1.Protocol
+	Port     *intstr.IntOrString
+	EndPort  *int32
+}
+
+// IPBlock is a CIDR with optional excepted CIDRs
+type IPBlock struct {
+	CIDR   string
+	Except []string
+}
+
+// Peer selects pods, namespaces or an IP block
+type Peer struct {
+	PodSelector       *metav1.LabelSelector
+	NamespaceSelector *metav1.LabelSelector
+	IPBlock           *IPBlock
+}
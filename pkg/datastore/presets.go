@@ -0,0 +1,150 @@
+package datastore
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// PortPresetsAnnotation is the annotation key of a policy listing the port presets added to the ports of its rules,
+// as a comma-separated list of preset names, e.g. "n3,n4"
+const PortPresetsAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/port-presets"
+
+// presetPort returns the port of a protocol of a preset
+func presetPort(protocol corev1.Protocol, port int32) Port {
+	return Port{Protocol: &protocol, Port: &intstr.IntOrString{Type: intstr.Int, IntVal: port}}
+}
+
+var (
+	gtpUPorts     = []Port{presetPort(corev1.ProtocolUDP, 2152)}
+	gtpCPorts     = []Port{presetPort(corev1.ProtocolUDP, 2123)}
+	pfcpPorts     = []Port{presetPort(corev1.ProtocolUDP, 8805)}
+	ngapPorts     = []Port{presetPort(corev1.ProtocolSCTP, 38412)}
+	s1apPorts     = []Port{presetPort(corev1.ProtocolSCTP, 36412)}
+	diameterPorts = []Port{presetPort(corev1.ProtocolTCP, 3868), presetPort(corev1.ProtocolSCTP, 3868)}
+)
+
+// portPresets are the ports of the telco protocols, by protocol and by the 3GPP interfaces carrying them
+var portPresets = map[string][]Port{
+	"gtp-u":    gtpUPorts,
+	"gtp-c":    gtpCPorts,
+	"pfcp":     pfcpPorts,
+	"ngap":     ngapPorts,
+	"s1ap":     s1apPorts,
+	"diameter": diameterPorts,
+	"n2":       ngapPorts,
+	"n3":       gtpUPorts,
+	"n4":       pfcpPorts,
+	"n9":       gtpUPorts,
+	"s1-mme":   s1apPorts,
+	"s1-u":     gtpUPorts,
+	"s11":      gtpCPorts,
+	"s6a":      diameterPorts,
+}
+
+// PortPresets returns the names of the port presets
+func PortPresets() []string {
+	names := make([]string, 0, len(portPresets))
+	for name := range portPresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// ParsePortPresets parses the comma-separated preset names of the port presets annotation. The names are case
+// insensitive, the unknown names are returned in the error and the known ones are still returned.
+func ParsePortPresets(value string) ([]string, error) {
+	var presets, unknown []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || slices.Contains(presets, name) {
+			continue
+		}
+
+		if _, ok := portPresets[name]; !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		presets = append(presets, name)
+	}
+
+	if len(unknown) > 0 {
+		return presets, fmt.Errorf("unknown port presets %s, expected some of %s", strings.Join(unknown, ", "), strings.Join(PortPresets(), ", "))
+	}
+
+	return presets, nil
+}
+
+// ExpandPortPresets adds the ports of the presets to the ports of every rule of the spec, a rule without ports then
+// only allows the ports of the presets
+func ExpandPortPresets(spec *PolicySpec, presets []string) {
+	var ports []Port
+	for _, name := range presets {
+		ports = append(ports, portPresets[name]...)
+	}
+
+	if len(ports) == 0 {
+		return
+	}
+
+	for i := range spec.Ingress {
+		spec.Ingress[i].Ports = append(slices.Clip(spec.Ingress[i].Ports), ports...)
+	}
+	for i := range spec.Egress {
+		spec.Egress[i].Ports = append(slices.Clip(spec.Egress[i].Ports), ports...)
+	}
+}
+
+// ProtocolPresetsAnnotation is the annotation key of a network attachment definition listing the protocol presets
+// allowed on the network by every policy, as a comma-separated list of preset names, e.g. "vrrp,bfd"
+const ProtocolPresetsAnnotation = "multi-networkpolicy-nftables.k8s.cni.cncf.io/protocol-presets"
+
+const (
+	// ProtocolPresetVRRP allows VRRP to its multicast groups
+	ProtocolPresetVRRP = "vrrp"
+	// ProtocolPresetOSPF allows OSPF
+	ProtocolPresetOSPF = "ospf"
+	// ProtocolPresetBFD allows the single-hop, echo and multihop BFD sessions
+	ProtocolPresetBFD = "bfd"
+	// ProtocolPresetPTP allows the event and general messages of PTP over UDP
+	ProtocolPresetPTP = "ptp"
+	// ProtocolPresetNTP allows NTP
+	ProtocolPresetNTP = "ntp"
+)
+
+// protocolPresets are the names of the protocol presets
+var protocolPresets = []string{ProtocolPresetVRRP, ProtocolPresetOSPF, ProtocolPresetBFD, ProtocolPresetPTP, ProtocolPresetNTP}
+
+// ProtocolPresets returns the names of the protocol presets
+func ProtocolPresets() []string {
+	return slices.Clone(protocolPresets)
+}
+
+// ParseProtocolPresets parses the comma-separated preset names of the protocol presets annotation. The names are case
+// insensitive, the unknown names are returned in the error and the known ones are still returned.
+func ParseProtocolPresets(value string) ([]string, error) {
+	var presets, unknown []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || slices.Contains(presets, name) {
+			continue
+		}
+
+		if !slices.Contains(protocolPresets, name) {
+			unknown = append(unknown, name)
+			continue
+		}
+		presets = append(presets, name)
+	}
+
+	if len(unknown) > 0 {
+		return presets, fmt.Errorf("unknown protocol presets %s, expected some of %s", strings.Join(unknown, ", "), strings.Join(protocolPresets, ", "))
+	}
+
+	return presets, nil
+}
@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Snapshot is a copy of the datastore at a point in time, the policies are sorted by namespace and name
+type Snapshot struct {
+	Time     time.Time
+	Policies []SnapshotPolicy
+}
+
+// SnapshotPolicy is a policy of a snapshot with its states applied to the pods, keyed by <namespace>/<name> of the pod
+type SnapshotPolicy struct {
+	*Policy
+	Applied map[string]AppliedState `json:",omitempty"`
+}
+
+// SnapshotDiff is what changed in the datastore between two snapshots, the policies are keyed by <namespace>/<name>
+type SnapshotDiff struct {
+	From    time.Time
+	To      time.Time
+	Added   []string     `json:",omitempty"`
+	Removed []string     `json:",omitempty"`
+	Changed []PolicyDiff `json:",omitempty"`
+}
+
+// PolicyDiff is what changed in a policy between two snapshots
+type PolicyDiff struct {
+	Policy string
+	// Fields are the names of the fields of the policy that changed
+	Fields []string `json:",omitempty"`
+	// AppliedAdded, AppliedRemoved and AppliedChanged are the pods the states of the policy applied to changed
+	AppliedAdded   []string `json:",omitempty"`
+	AppliedRemoved []string `json:",omitempty"`
+	AppliedChanged []string `json:",omitempty"`
+}
+
+// Snapshot returns a snapshot of the datastore
+func (d *Datastore) Snapshot() *Snapshot {
+	d.RLock()
+	defer d.RUnlock()
+
+	snapshot := &Snapshot{Time: time.Now().UTC(), Policies: []SnapshotPolicy{}}
+	for key, policy := range d.Policies {
+		snapshotPolicy := SnapshotPolicy{Policy: policy}
+		for pod, state := range d.Applied[key] {
+			if snapshotPolicy.Applied == nil {
+				snapshotPolicy.Applied = make(map[string]AppliedState)
+			}
+			snapshotPolicy.Applied[pod.String()] = state
+		}
+		snapshot.Policies = append(snapshot.Policies, snapshotPolicy)
+	}
+
+	slices.SortFunc(snapshot.Policies, func(a, b SnapshotPolicy) int {
+		return strings.Compare(a.key(), b.key())
+	})
+
+	return snapshot
+}
+
+func (p *SnapshotPolicy) key() string {
+	return p.Namespace + "/" + p.Name
+}
+
+// Diff returns what changed from a snapshot to another
+func Diff(from *Snapshot, to *Snapshot) *SnapshotDiff {
+	diff := &SnapshotDiff{From: from.Time, To: to.Time}
+
+	fromPolicies := make(map[string]SnapshotPolicy, len(from.Policies))
+	for _, policy := range from.Policies {
+		fromPolicies[policy.key()] = policy
+	}
+
+	toPolicies := make(map[string]SnapshotPolicy, len(to.Policies))
+	for _, policy := range to.Policies {
+		key := policy.key()
+		toPolicies[key] = policy
+
+		fromPolicy, ok := fromPolicies[key]
+		if !ok {
+			diff.Added = append(diff.Added, key)
+			continue
+		}
+
+		if policyDiff := diffPolicy(&fromPolicy, &policy); policyDiff != nil {
+			diff.Changed = append(diff.Changed, *policyDiff)
+		}
+	}
+
+	for _, policy := range from.Policies {
+		if _, ok := toPolicies[policy.key()]; !ok {
+			diff.Removed = append(diff.Removed, policy.key())
+		}
+	}
+
+	return diff
+}
+
+// diffPolicy returns what changed in a policy, or nil when nothing changed
+func diffPolicy(from *SnapshotPolicy, to *SnapshotPolicy) *PolicyDiff {
+	diff := &PolicyDiff{Policy: to.key()}
+
+	fromValue := reflect.ValueOf(*from.Policy)
+	toValue := reflect.ValueOf(*to.Policy)
+	for i := range fromValue.NumField() {
+		if !reflect.DeepEqual(fromValue.Field(i).Interface(), toValue.Field(i).Interface()) {
+			diff.Fields = append(diff.Fields, fromValue.Type().Field(i).Name)
+		}
+	}
+
+	for pod, state := range to.Applied {
+		fromState, ok := from.Applied[pod]
+		switch {
+		case !ok:
+			diff.AppliedAdded = append(diff.AppliedAdded, pod)
+		case fromState != state:
+			diff.AppliedChanged = append(diff.AppliedChanged, pod)
+		}
+	}
+
+	for pod := range from.Applied {
+		if _, ok := to.Applied[pod]; !ok {
+			diff.AppliedRemoved = append(diff.AppliedRemoved, pod)
+		}
+	}
+
+	if len(diff.Fields) == 0 && len(diff.AppliedAdded) == 0 && len(diff.AppliedRemoved) == 0 && len(diff.AppliedChanged) == 0 {
+		return nil
+	}
+
+	slices.Sort(diff.AppliedAdded)
+	slices.Sort(diff.AppliedRemoved)
+	slices.Sort(diff.AppliedChanged)
+
+	return diff
+}
+
+// SnapshotHandler serves the snapshots of a datastore as JSON. A GET returns the current snapshot, a POST of a previous
+// snapshot returns the diff from it to the current snapshot.
+func SnapshotHandler(d *Datastore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response any
+		switch r.Method {
+		case http.MethodGet:
+			response = d.Snapshot()
+		case http.MethodPost:
+			var from Snapshot
+			if err := json.NewDecoder(r.Body).Decode(&from); err != nil {
+				http.Error(w, fmt.Sprintf("invalid snapshot: %v", err), http.StatusBadRequest)
+				return
+			}
+			if slices.ContainsFunc(from.Policies, func(policy SnapshotPolicy) bool { return policy.Policy == nil }) {
+				http.Error(w, "invalid snapshot: policy without name", http.StatusBadRequest)
+				return
+			}
+			response = Diff(&from, d.Snapshot())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	})
+}
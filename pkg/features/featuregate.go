@@ -0,0 +1,105 @@
+// Package features provides the feature gates of multi-network-policy-nftables, so that experimental
+// capabilities can ship disabled and be enabled per cluster with --feature-gates
+package features
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Feature is the name of a feature gate
+type Feature string
+
+// Stage is the maturity of a feature
+type Stage string
+
+const (
+	// Alpha features are disabled by default and can change or be removed
+	Alpha Stage = "ALPHA"
+	// Beta features are enabled by default and can still be disabled
+	Beta Stage = "BETA"
+	// GA features are always enabled, the gate is kept for compatibility until it is removed
+	GA Stage = "GA"
+)
+
+// FeatureSpec is the default state and the maturity of a feature
+type FeatureSpec struct {
+	Default    bool
+	PreRelease Stage
+}
+
+// FeatureGate holds the state of the known features
+type FeatureGate struct {
+	mu      sync.RWMutex
+	known   map[Feature]FeatureSpec
+	enabled map[Feature]bool
+}
+
+// NewFeatureGate returns a feature gate of the known features, in their default state
+func NewFeatureGate(known map[Feature]FeatureSpec) *FeatureGate {
+	return &FeatureGate{
+		known:   maps.Clone(known),
+		enabled: make(map[Feature]bool),
+	}
+}
+
+// SetFromMap enables or disables the features of the map, as <feature>: <enabled>
+func (f *FeatureGate) SetFromMap(features map[string]bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	enabled := maps.Clone(f.enabled)
+	for name, value := range features {
+		spec, ok := f.known[Feature(name)]
+		if !ok {
+			return fmt.Errorf("unknown feature gate %q, known features are %s", name, strings.Join(f.knownFeatures(), ", "))
+		}
+
+		if spec.PreRelease == GA && !value {
+			return fmt.Errorf("feature gate %q is GA and cannot be disabled", name)
+		}
+
+		enabled[Feature(name)] = value
+	}
+
+	f.enabled = enabled
+	return nil
+}
+
+// Enabled checks if the feature is enabled
+func (f *FeatureGate) Enabled(feature Feature) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if value, ok := f.enabled[feature]; ok {
+		return value
+	}
+
+	spec, ok := f.known[feature]
+	if !ok {
+		panic(fmt.Sprintf("feature %q is not registered", feature))
+	}
+
+	return spec.Default
+}
+
+// KnownFeatures returns the description of the known features, as <feature>=true|false (<stage> - default=<default>)
+func (f *FeatureGate) KnownFeatures() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.knownFeatures()
+}
+
+func (f *FeatureGate) knownFeatures() []string {
+	var features []string
+	for _, name := range slices.Sorted(maps.Keys(f.known)) {
+		spec := f.known[name]
+		features = append(features, fmt.Sprintf("%s=true|false (%s - default=%t)", name, spec.PreRelease, spec.Default))
+	}
+
+	return features
+}
@@ -0,0 +1,40 @@
+package features
+
+const (
+	// CustomRuleTemplates renders the variables of the custom rules, e.g. {{ .PodIP }}, for each pod.
+	// When disabled, the custom rules are applied as written.
+	CustomRuleTemplates Feature = "CustomRuleTemplates"
+
+	// NetworkPolicyMirroring applies the NetworkPolicies annotated with the mirror-to annotation, or in an annotated
+	// namespace, to the secondary networks of the annotation.
+	NetworkPolicyMirroring Feature = "NetworkPolicyMirroring"
+
+	// RevocationPriority reconciles the MultiNetworkPolicies enqueued by the events removing access, e.g. a pod
+	// dropping out of the peers of a policy, ahead of the other policies, with the priority queue of controller-runtime.
+	RevocationPriority Feature = "RevocationPriority"
+
+	// WhereaboutsReservations resolves the addresses of the peer pods whose network status is not reported yet from the
+	// IP pools of whereabouts. The whereabouts CRDs must be installed.
+	WhereaboutsReservations Feature = "WhereaboutsReservations"
+)
+
+// defaultFeatures are the features known by multi-network-policy-nftables
+var defaultFeatures = map[Feature]FeatureSpec{
+	CustomRuleTemplates:     {Default: true, PreRelease: Beta},
+	NetworkPolicyMirroring:  {Default: false, PreRelease: Alpha},
+	RevocationPriority:      {Default: false, PreRelease: Alpha},
+	WhereaboutsReservations: {Default: false, PreRelease: Alpha},
+}
+
+// DefaultFeatureGate is the feature gate set with --feature-gates
+var DefaultFeatureGate = NewFeatureGate(defaultFeatures)
+
+// Enabled checks if the feature is enabled in the DefaultFeatureGate
+func Enabled(feature Feature) bool {
+	return DefaultFeatureGate.Enabled(feature)
+}
+
+// Validate checks that the features can be set on the DefaultFeatureGate without changing it
+func Validate(features map[string]bool) error {
+	return NewFeatureGate(defaultFeatures).SetFromMap(features)
+}
@@ -0,0 +1,66 @@
+package features
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestFeatures(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Features Suite")
+}
+
+var _ = Describe("FeatureGate", func() {
+	const (
+		alphaFeature Feature = "AlphaFeature"
+		betaFeature  Feature = "BetaFeature"
+		gaFeature    Feature = "GAFeature"
+	)
+
+	var featureGate *FeatureGate
+
+	BeforeEach(func() {
+		featureGate = NewFeatureGate(map[Feature]FeatureSpec{
+			alphaFeature: {Default: false, PreRelease: Alpha},
+			betaFeature:  {Default: true, PreRelease: Beta},
+			gaFeature:    {Default: true, PreRelease: GA},
+		})
+	})
+
+	It("should return the default state of the features", func() {
+		Expect(featureGate.Enabled(alphaFeature)).To(BeFalse())
+		Expect(featureGate.Enabled(betaFeature)).To(BeTrue())
+		Expect(featureGate.Enabled(gaFeature)).To(BeTrue())
+	})
+
+	It("should enable and disable features", func() {
+		Expect(featureGate.SetFromMap(map[string]bool{"AlphaFeature": true, "BetaFeature": false})).To(Succeed())
+		Expect(featureGate.Enabled(alphaFeature)).To(BeTrue())
+		Expect(featureGate.Enabled(betaFeature)).To(BeFalse())
+	})
+
+	It("should reject unknown features without changing the gate", func() {
+		err := featureGate.SetFromMap(map[string]bool{"AlphaFeature": true, "UnknownFeature": true})
+		Expect(err).To(MatchError(ContainSubstring(`unknown feature gate "UnknownFeature"`)))
+		Expect(featureGate.Enabled(alphaFeature)).To(BeFalse())
+	})
+
+	It("should not disable GA features", func() {
+		Expect(featureGate.SetFromMap(map[string]bool{"GAFeature": false})).NotTo(Succeed())
+		Expect(featureGate.SetFromMap(map[string]bool{"GAFeature": true})).To(Succeed())
+	})
+
+	It("should panic on features that are not registered", func() {
+		Expect(func() { featureGate.Enabled("UnknownFeature") }).To(Panic())
+	})
+
+	It("should describe the known features", func() {
+		Expect(featureGate.KnownFeatures()).To(Equal([]string{
+			"AlphaFeature=true|false (ALPHA - default=false)",
+			"BetaFeature=true|false (BETA - default=true)",
+			"GAFeature=true|false (GA - default=true)",
+		}))
+	})
+})
@@ -0,0 +1,202 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"golang.org/x/sys/unix"
+)
+
+// Netlink constants of the conntrack events, from linux/netfilter/nfnetlink.h and
+// linux/netfilter/nfnetlink_conntrack.h
+const (
+	nfnlSubsysCTNetlink     = 1
+	ipctnlMsgCTDelete       = 2
+	nfnlgrpConntrackDestroy = 3
+
+	ctaTupleOrig     = 1
+	ctaCountersOrig  = 9
+	ctaCountersReply = 10
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	ctaCountersPackets = 1
+	ctaCountersBytes   = 2
+
+	// nlaTypeMask strips the nested and byte order flags of the netlink attribute types
+	nlaTypeMask = 0x3fff
+	// nfgenmsgLen is the length of the netfilter header of the conntrack messages
+	nfgenmsgLen = 4
+	// conntrackReceiveBuffer is the receive buffer of the conntrack sockets, the events are lost when it overflows
+	conntrackReceiveBuffer = 1 << 20
+)
+
+// conntrackFlow is a connection destroyed by the conntrack of a network namespace, with the addresses of its original
+// direction and the counters of both directions
+type conntrackFlow struct {
+	Protocol uint8
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+	Packets  uint64
+	Bytes    uint64
+}
+
+// conntrackSocket receives the destroy events of the conntrack of the network namespace it was opened in
+type conntrackSocket struct {
+	fd int
+}
+
+// openConntrackSocket opens a netlink socket subscribed to the destroy events of the conntrack of the current network
+// namespace. The receive calls time out after a second so that the monitor can check if it is stopped.
+func openConntrackSocket() (*conntrackSocket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1 << (nfnlgrpConntrackDestroy - 1)}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to subscribe to conntrack events: %w", err)
+	}
+
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to set receive timeout: %w", err)
+	}
+
+	_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, conntrackReceiveBuffer)
+
+	return &conntrackSocket{fd: fd}, nil
+}
+
+// errEventsLost is returned when the receive buffer overflowed and events were lost
+var errEventsLost = errors.New("conntrack events lost")
+
+// receive returns the flows of the next events, it returns no flows when the receive timed out
+func (s *conntrackSocket) receive(buf []byte) ([]conntrackFlow, error) {
+	n, _, err := unix.Recvfrom(s.fd, buf, 0)
+	if err != nil {
+		switch {
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+			return nil, nil
+		case errors.Is(err, unix.ENOBUFS):
+			return nil, errEventsLost
+		default:
+			return nil, fmt.Errorf("failed to receive conntrack events: %w", err)
+		}
+	}
+
+	return parseConntrackMessages(buf[:n])
+}
+
+// close closes the socket
+func (s *conntrackSocket) close() error {
+	return unix.Close(s.fd)
+}
+
+// parseConntrackMessages returns the flows of the destroy events of a netlink datagram
+func parseConntrackMessages(buf []byte) ([]conntrackFlow, error) {
+	var flows []conntrackFlow
+	for len(buf) >= unix.SizeofNlMsghdr {
+		length := int(binary.NativeEndian.Uint32(buf[0:4]))
+		if length < unix.SizeofNlMsghdr || length > len(buf) {
+			return flows, fmt.Errorf("invalid netlink message length %d", length)
+		}
+
+		msgType := binary.NativeEndian.Uint16(buf[4:6])
+		data := buf[unix.SizeofNlMsghdr:length]
+		if msgType == nfnlSubsysCTNetlink<<8|ipctnlMsgCTDelete && len(data) >= nfgenmsgLen {
+			if flow, ok := parseConntrackFlow(parseAttributes(data[nfgenmsgLen:])); ok {
+				flows = append(flows, flow)
+			}
+		}
+
+		aligned := (length + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+		if aligned >= len(buf) {
+			break
+		}
+		buf = buf[aligned:]
+	}
+
+	return flows, nil
+}
+
+// parseConntrackFlow returns the flow of the attributes of a conntrack message
+func parseConntrackFlow(attrs map[uint16][]byte) (conntrackFlow, bool) {
+	flow := conntrackFlow{}
+
+	tuple := parseAttributes(attrs[ctaTupleOrig])
+
+	ip := parseAttributes(tuple[ctaTupleIP])
+	for _, addr := range []struct {
+		src, dst uint16
+	}{{ctaIPv4Src, ctaIPv4Dst}, {ctaIPv6Src, ctaIPv6Dst}} {
+		src, srcOK := netip.AddrFromSlice(ip[addr.src])
+		dst, dstOK := netip.AddrFromSlice(ip[addr.dst])
+		if srcOK && dstOK {
+			flow.Src, flow.Dst = src, dst
+		}
+	}
+	if !flow.Src.IsValid() {
+		return flow, false
+	}
+
+	proto := parseAttributes(tuple[ctaTupleProto])
+	if value := proto[ctaProtoNum]; len(value) == 1 {
+		flow.Protocol = value[0]
+	}
+	if value := proto[ctaProtoSrcPort]; len(value) == 2 {
+		flow.SrcPort = binary.BigEndian.Uint16(value)
+	}
+	if value := proto[ctaProtoDstPort]; len(value) == 2 {
+		flow.DstPort = binary.BigEndian.Uint16(value)
+	}
+
+	for _, counters := range []uint16{ctaCountersOrig, ctaCountersReply} {
+		values := parseAttributes(attrs[counters])
+		if value := values[ctaCountersPackets]; len(value) == 8 {
+			flow.Packets += binary.BigEndian.Uint64(value)
+		}
+		if value := values[ctaCountersBytes]; len(value) == 8 {
+			flow.Bytes += binary.BigEndian.Uint64(value)
+		}
+	}
+
+	return flow, true
+}
+
+// parseAttributes returns the netlink attributes of a buffer by type, the malformed trailing attributes are ignored
+func parseAttributes(buf []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(buf) >= unix.SizeofNlAttr {
+		length := int(binary.NativeEndian.Uint16(buf[0:2]))
+		if length < unix.SizeofNlAttr || length > len(buf) {
+			break
+		}
+
+		attrType := binary.NativeEndian.Uint16(buf[2:4]) & nlaTypeMask
+		attrs[attrType] = buf[unix.SizeofNlAttr:length]
+
+		aligned := (length + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+		if aligned > len(buf) {
+			break
+		}
+		buf = buf[aligned:]
+	}
+
+	return attrs
+}
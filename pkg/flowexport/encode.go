@@ -0,0 +1,246 @@
+package flowexport
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Format is the format of the exported flow records
+type Format string
+
+const (
+	// FormatJSON exports a JSON object per record, one per line on TCP and one per datagram on UDP
+	FormatJSON Format = "json"
+	// FormatIPFIX exports IPFIX messages, with the templates in every message
+	FormatIPFIX Format = "ipfix"
+)
+
+// ParseFormat parses a format, json or ipfix
+func ParseFormat(value string) (Format, error) {
+	switch format := Format(strings.ToLower(strings.TrimSpace(value))); format {
+	case FormatJSON, FormatIPFIX:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid format %q, expected %s or %s", value, FormatJSON, FormatIPFIX)
+	}
+}
+
+// Encoder encodes the flow records in the messages sent to the collector
+type Encoder interface {
+	Encode(records []Record) ([][]byte, error)
+}
+
+// NewEncoder returns the encoder of a format
+func NewEncoder(format Format) Encoder {
+	if format == FormatIPFIX {
+		return &IPFIXEncoder{}
+	}
+
+	return JSONEncoder{}
+}
+
+// JSONEncoder encodes each record as a JSON object terminated by a newline
+type JSONEncoder struct{}
+
+// Encode returns a message per record
+func (JSONEncoder) Encode(records []Record) ([][]byte, error) {
+	messages := make([][]byte, 0, len(records))
+	for _, record := range records {
+		message, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal flow record: %w", err)
+		}
+		messages = append(messages, append(message, '\n'))
+	}
+
+	return messages, nil
+}
+
+// IPFIX information elements of the records, from the IANA IPFIX registry
+const (
+	ipfixVersion       = 10
+	ipfixHeaderLen     = 16
+	ipfixTemplateSetID = 2
+	ipfixVariableLen   = 65535
+
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowDirection            = 61
+	ieInterfaceName            = 82
+	ieInterfaceDescription     = 83
+	ieForwardingStatus         = 89
+	ieFlowEndMilliseconds      = 153
+	ieObservationDomainName    = 300
+
+	// forwardingStatusForwarded is the forwarding status of the accepted flows, forwarded with an unknown reason
+	forwardingStatusForwarded = 64
+)
+
+// ipfixField is a field of a template, its information element and length
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// ipfixFields returns the fields of the template of an address family. The pod is exported as the observation domain
+// name, the network as the interface description.
+func ipfixFields(ipv6 bool) []ipfixField {
+	src, dst, addrLen := uint16(ieSourceIPv4Address), uint16(ieDestinationIPv4Address), uint16(4)
+	if ipv6 {
+		src, dst, addrLen = ieSourceIPv6Address, ieDestinationIPv6Address, 16
+	}
+
+	return []ipfixField{
+		{ieFlowEndMilliseconds, 8},
+		{src, addrLen},
+		{dst, addrLen},
+		{ieSourceTransportPort, 2},
+		{ieDestinationTransportPort, 2},
+		{ieProtocolIdentifier, 1},
+		{ieFlowDirection, 1},
+		{ieForwardingStatus, 1},
+		{iePacketDeltaCount, 8},
+		{ieOctetDeltaCount, 8},
+		{ieInterfaceName, ipfixVariableLen},
+		{ieInterfaceDescription, ipfixVariableLen},
+		{ieObservationDomainName, ipfixVariableLen},
+	}
+}
+
+// IPFIXEncoder encodes the records in IPFIX messages, with a template per address family. The templates are sent in
+// every message so that the collectors listening on UDP decode the records without waiting for a template refresh.
+type IPFIXEncoder struct {
+	// ObservationDomainID is the observation domain of the messages
+	ObservationDomainID uint32
+
+	// sequence is the number of records exported before the next message
+	sequence uint32
+}
+
+// Encode returns a message with the records
+func (e *IPFIXEncoder) Encode(records []Record) ([][]byte, error) {
+	message := make([]byte, ipfixHeaderLen, 1024)
+
+	// Template set
+	message = appendSet(message, ipfixTemplateSetID, func(set []byte) []byte {
+		for _, template := range []struct {
+			id   uint16
+			ipv6 bool
+		}{{ipfixTemplateIPv4, false}, {ipfixTemplateIPv6, true}} {
+			fields := ipfixFields(template.ipv6)
+			set = binary.BigEndian.AppendUint16(set, template.id)
+			set = binary.BigEndian.AppendUint16(set, uint16(len(fields)))
+			for _, field := range fields {
+				set = binary.BigEndian.AppendUint16(set, field.id)
+				set = binary.BigEndian.AppendUint16(set, field.length)
+			}
+		}
+		return set
+	})
+
+	// Data sets, one per address family
+	for _, template := range []struct {
+		id   uint16
+		ipv6 bool
+	}{{ipfixTemplateIPv4, false}, {ipfixTemplateIPv6, true}} {
+		var family []Record
+		for _, record := range records {
+			if record.SrcAddr.Unmap().Is6() == template.ipv6 {
+				family = append(family, record)
+			}
+		}
+		if len(family) == 0 {
+			continue
+		}
+
+		message = appendSet(message, template.id, func(set []byte) []byte {
+			for _, record := range family {
+				set = appendIPFIXRecord(set, record, template.ipv6)
+			}
+			return set
+		})
+	}
+
+	if len(message) > ipfixVariableLen {
+		return nil, fmt.Errorf("IPFIX message of %d records exceeds the maximum length", len(records))
+	}
+
+	binary.BigEndian.PutUint16(message[0:2], ipfixVersion)
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)))
+	binary.BigEndian.PutUint32(message[4:8], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(message[8:12], e.sequence)
+	binary.BigEndian.PutUint32(message[12:16], e.ObservationDomainID)
+
+	e.sequence += uint32(len(records))
+
+	return [][]byte{message}, nil
+}
+
+// appendSet appends a set with its header, the content of the set is appended by fill
+func appendSet(message []byte, id uint16, fill func([]byte) []byte) []byte {
+	start := len(message)
+	message = binary.BigEndian.AppendUint16(message, id)
+	message = binary.BigEndian.AppendUint16(message, 0)
+	message = fill(message)
+	binary.BigEndian.PutUint16(message[start+2:start+4], uint16(len(message)-start))
+
+	return message
+}
+
+// appendIPFIXRecord appends a data record in the order of the fields of the template
+func appendIPFIXRecord(set []byte, record Record, ipv6 bool) []byte {
+	set = binary.BigEndian.AppendUint64(set, uint64(record.Time.UnixMilli()))
+	if ipv6 {
+		src, dst := record.SrcAddr.As16(), record.DstAddr.As16()
+		set = append(set, src[:]...)
+		set = append(set, dst[:]...)
+	} else {
+		src, dst := record.SrcAddr.Unmap().As4(), record.DstAddr.Unmap().As4()
+		set = append(set, src[:]...)
+		set = append(set, dst[:]...)
+	}
+	set = binary.BigEndian.AppendUint16(set, record.SrcPort)
+	set = binary.BigEndian.AppendUint16(set, record.DstPort)
+	set = append(set, record.Protocol)
+
+	// flowDirection is 0 for ingress and 1 for egress
+	direction := byte(0)
+	if record.Direction == DirectionEgress {
+		direction = 1
+	}
+	set = append(set, direction, forwardingStatusForwarded)
+
+	set = binary.BigEndian.AppendUint64(set, record.Packets)
+	set = binary.BigEndian.AppendUint64(set, record.Bytes)
+	set = appendVariableLength(set, record.Interface)
+	set = appendVariableLength(set, record.Network)
+	set = appendVariableLength(set, record.Namespace+"/"+record.Pod)
+
+	return set
+}
+
+// appendVariableLength appends a variable-length string, with a one byte length below 255 and a three bytes length
+// otherwise
+func appendVariableLength(set []byte, value string) []byte {
+	if len(value) < 255 {
+		set = append(set, byte(len(value)))
+	} else {
+		set = append(set, 255)
+		set = binary.BigEndian.AppendUint16(set, uint16(len(value)))
+	}
+
+	return append(set, value...)
+}
@@ -0,0 +1,439 @@
+// Package flowexport exports the flows of the secondary interfaces of the pods, from the conntrack of their network
+// namespaces, to a flow collector
+package flowexport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+const (
+	// DirectionIngress is the direction of the flows initiated by the peers of the pod
+	DirectionIngress = "ingress"
+	// DirectionEgress is the direction of the flows initiated by the pod
+	DirectionEgress = "egress"
+
+	// VerdictAllowed is the verdict of the flows accepted by the policies. The packets denied by the policies never
+	// create a conntrack entry, they are reported by the drop logging.
+	VerdictAllowed = "allowed"
+
+	// sinkQueueLength is the number of records queued for the collector, the records are dropped when it is full
+	sinkQueueLength = 4096
+	// sinkBatchSize is the maximum number of records per batch sent to the collector
+	sinkBatchSize = 64
+	// sinkFlushInterval is the maximum delay of a record before it is sent to the collector
+	sinkFlushInterval = time.Second
+	// sinkDialTimeout is the timeout of the connection to the collector
+	sinkDialTimeout = 5 * time.Second
+)
+
+// Record is the record of a flow of a secondary interface of a pod, exported when its connection ends
+type Record struct {
+	Time      time.Time  `json:"time"`
+	Namespace string     `json:"namespace"`
+	Pod       string     `json:"pod"`
+	Network   string     `json:"network"`
+	Interface string     `json:"interface"`
+	Direction string     `json:"direction"`
+	Protocol  uint8      `json:"protocol"`
+	SrcAddr   netip.Addr `json:"srcAddr"`
+	SrcPort   uint16     `json:"srcPort"`
+	DstAddr   netip.Addr `json:"dstAddr"`
+	DstPort   uint16     `json:"dstPort"`
+	Verdict   string     `json:"verdict"`
+	// Packets and Bytes are the counters of both directions of the flow, they are zero when the conntrack accounting
+	// could not be enabled in the network namespace of the pod
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Sink batches the records and sends them to the collector
+type Sink struct {
+	// Network is the network of the collector, udp or tcp
+	Network string
+	// Address is the host:port of the collector
+	Address string
+	Encoder Encoder
+
+	records chan Record
+	once    sync.Once
+}
+
+// NewSink returns a sink of a collector URL, udp://<host>:<port> or tcp://<host>:<port>, and a format
+func NewSink(collector string, format Format) (*Sink, error) {
+	network, address, err := ParseCollector(collector)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sink{Network: network, Address: address, Encoder: NewEncoder(format)}, nil
+}
+
+// ParseCollector parses a collector URL, udp://<host>:<port> or tcp://<host>:<port>
+func ParseCollector(collector string) (string, string, error) {
+	u, err := url.Parse(collector)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid collector %q: %w", collector, err)
+	}
+
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return "", "", fmt.Errorf("invalid collector %q, expected udp://<host>:<port> or tcp://<host>:<port>", collector)
+	}
+
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", "", fmt.Errorf("invalid collector %q: %w", collector, err)
+	}
+
+	return u.Scheme, u.Host, nil
+}
+
+// queue returns the queue of the records
+func (s *Sink) queue() chan Record {
+	s.once.Do(func() {
+		s.records = make(chan Record, sinkQueueLength)
+	})
+
+	return s.records
+}
+
+// Export queues a record, it is dropped when the queue is full
+func (s *Sink) Export(record Record) {
+	select {
+	case s.queue() <- record:
+	default:
+		metrics.FlowRecords.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Run sends the queued records to the collector in batches until the context is done. The connection is opened again
+// after a failure, the records of the failed batches are dropped.
+func (s *Sink) Run(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("flowexport")
+
+	ticker := time.NewTicker(sinkFlushInterval)
+	defer ticker.Stop()
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+
+	batch := make([]Record, 0, sinkBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		var err error
+		conn, err = s.send(ctx, conn, batch)
+		if err != nil {
+			logger.Error(err, "Failed to export flow records", "collector", s.Address, "records", len(batch))
+			metrics.FlowRecords.WithLabelValues("dropped").Add(float64(len(batch)))
+		} else {
+			metrics.FlowRecords.WithLabelValues("exported").Add(float64(len(batch)))
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			flush()
+			return
+		case record := <-s.queue():
+			batch = append(batch, record)
+			if len(batch) == sinkBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send encodes and writes a batch to the collector, connecting when there is no connection. It returns the connection
+// to reuse, nil after a failure.
+func (s *Sink) send(ctx context.Context, conn net.Conn, batch []Record) (net.Conn, error) {
+	messages, err := s.Encoder.Encode(batch)
+	if err != nil {
+		return conn, err
+	}
+
+	if conn == nil {
+		dialer := &net.Dialer{Timeout: sinkDialTimeout}
+		conn, err = dialer.DialContext(ctx, s.Network, s.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to collector: %w", err)
+		}
+	}
+
+	for _, message := range messages {
+		if _, err := conn.Write(message); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to write to collector: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// NetNSResolver resolves the network namespace of the pods
+type NetNSResolver interface {
+	GetPodNetNSPath(ctx context.Context, pod *corev1.Pod) (string, error)
+}
+
+// Exporter monitors the conntrack of the network namespaces of the pods of this node with secondary interfaces, and
+// exports the records of the flows of these interfaces to the sink
+type Exporter struct {
+	client.Client
+	Resolver NetNSResolver
+	Hostname string
+	Sink     *Sink
+	// ResyncInterval is the interval between the lists of the pods of the node to monitor
+	ResyncInterval time.Duration
+
+	monitors map[types.UID]*monitor
+}
+
+// Start runs the exporter until the context is done
+func (e *Exporter) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("flowexport")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		e.Sink.Run(ctx)
+	}()
+
+	e.monitors = make(map[types.UID]*monitor)
+
+	ticker := time.NewTicker(e.ResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.sync(ctx, &wg, logger); err != nil {
+			logger.Error(err, "Failed to sync the monitored pods")
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, m := range e.monitors {
+				m.cancel()
+			}
+			wg.Wait()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every node exports its own flows
+func (e *Exporter) NeedLeaderElection() bool {
+	return false
+}
+
+// sync starts the monitors of the new pods with secondary interfaces, updates their interfaces and stops the monitors
+// of the pods gone
+func (e *Exporter) sync(ctx context.Context, wg *sync.WaitGroup, logger logr.Logger) error {
+	pods := &corev1.PodList{}
+	err := e.Client.List(ctx, pods, client.MatchingFields{
+		nftables.PodHostnameIndex:             e.Hostname,
+		nftables.PodStatusIndex:               string(corev1.PodRunning),
+		nftables.PodHostNetworkIndex:          "false",
+		nftables.PodHasNetworkAnnotationIndex: "true",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	seen := make(map[types.UID]bool, len(pods.Items))
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		interfaces := nftables.GetInterfaces(pod)
+		if len(interfaces) == 0 {
+			continue
+		}
+		seen[pod.UID] = true
+
+		if m, ok := e.monitors[pod.UID]; ok {
+			m.setInterfaces(interfaces)
+			continue
+		}
+
+		m, err := e.startMonitor(ctx, wg, pod, interfaces)
+		if err != nil {
+			logger.Error(err, "Failed to monitor the flows of the pod", "pod", pod.Name, "namespace", pod.Namespace)
+			continue
+		}
+		e.monitors[pod.UID] = m
+	}
+
+	for uid, m := range e.monitors {
+		if !seen[uid] {
+			m.cancel()
+			delete(e.monitors, uid)
+		}
+	}
+
+	metrics.FlowExportMonitoredPods.Set(float64(len(e.monitors)))
+
+	return nil
+}
+
+// startMonitor opens a conntrack socket in the network namespace of a pod, enabling the conntrack accounting of the
+// network namespace, and starts receiving its events
+func (e *Exporter) startMonitor(ctx context.Context, wg *sync.WaitGroup, pod *corev1.Pod, interfaces []nftables.Interface) (*monitor, error) {
+	netnsPath, err := e.Resolver.GetPodNetNSPath(ctx, pod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network namespace path: %w", err)
+	}
+
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace: %w", err)
+	}
+	defer netns.Close()
+
+	var socket *conntrackSocket
+	err = netns.Do(func(_ ns.NetNS) error {
+		// The counters of the flows are only maintained with the accounting enabled, the flows are still exported
+		// without them when it cannot be enabled
+		_, _ = sysctl.Sysctl("net/netfilter/nf_conntrack_acct", "1")
+
+		socket, err = openConntrackSocket()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	m := &monitor{
+		pod:    types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name},
+		socket: socket,
+		cancel: cancel,
+	}
+	m.setInterfaces(interfaces)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.run(ctx, e.Sink)
+	}()
+
+	return m, nil
+}
+
+// monitor receives the conntrack events of the network namespace of a pod
+type monitor struct {
+	pod    types.NamespacedName
+	socket *conntrackSocket
+	cancel context.CancelFunc
+
+	// mu guards the interfaces, updated by the resyncs
+	mu         sync.RWMutex
+	interfaces []nftables.Interface
+}
+
+// setInterfaces replaces the secondary interfaces of the pod
+func (m *monitor) setInterfaces(interfaces []nftables.Interface) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.interfaces = interfaces
+}
+
+// run exports the flows of the secondary interfaces until the context is done
+func (m *monitor) run(ctx context.Context, sink *Sink) {
+	logger := log.FromContext(ctx).WithName("flowexport").WithValues("pod", m.pod.Name, "namespace", m.pod.Namespace)
+	defer func() {
+		_ = m.socket.close()
+	}()
+
+	buf := make([]byte, 1<<16)
+	for ctx.Err() == nil {
+		flows, err := m.socket.receive(buf)
+		if err == errEventsLost {
+			metrics.FlowRecords.WithLabelValues("lost").Inc()
+			continue
+		}
+		if err != nil {
+			logger.Error(err, "Failed to receive the conntrack events, stopping the flow export of the pod")
+			return
+		}
+
+		now := time.Now()
+		for _, flow := range flows {
+			if record, ok := m.record(flow, now); ok {
+				sink.Export(record)
+			}
+		}
+	}
+}
+
+// record returns the record of a flow of a secondary interface, the flows of the other interfaces are not exported.
+// The interface is the one with the source address of the flows initiated by the pod, and with the destination
+// address of the flows initiated by its peers.
+func (m *monitor) record(flow conntrackFlow, now time.Time) (Record, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, intf := range m.interfaces {
+		for _, ip := range intf.IPs {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				continue
+			}
+
+			var direction string
+			switch addr.Unmap() {
+			case flow.Src.Unmap():
+				direction = DirectionEgress
+			case flow.Dst.Unmap():
+				direction = DirectionIngress
+			default:
+				continue
+			}
+
+			return Record{
+				Time:      now,
+				Namespace: m.pod.Namespace,
+				Pod:       m.pod.Name,
+				Network:   intf.Network,
+				Interface: intf.Name,
+				Direction: direction,
+				Protocol:  flow.Protocol,
+				SrcAddr:   flow.Src,
+				SrcPort:   flow.SrcPort,
+				DstAddr:   flow.Dst,
+				DstPort:   flow.DstPort,
+				Verdict:   VerdictAllowed,
+				Packets:   flow.Packets,
+				Bytes:     flow.Bytes,
+			}, true
+		}
+	}
+
+	return Record{}, false
+}
@@ -0,0 +1,239 @@
+package flowexport
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftables"
+)
+
+func TestFlowExport(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Flow Export Suite")
+}
+
+// attr returns a netlink attribute with its padding
+func attr(attrType uint16, payload ...[]byte) []byte {
+	var value []byte
+	for _, p := range payload {
+		value = append(value, p...)
+	}
+
+	b := binary.NativeEndian.AppendUint16(nil, uint16(unix.SizeofNlAttr+len(value)))
+	b = binary.NativeEndian.AppendUint16(b, attrType)
+	b = append(b, value...)
+	for len(b)%unix.NLA_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+// be16 and be64 return the network byte order values of the conntrack attributes
+func be16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func be64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// conntrackMessage returns a conntrack netlink message of a type with the attributes
+func conntrackMessage(msgType uint16, attrs ...[]byte) []byte {
+	data := []byte{unix.AF_INET, 0, 0, 0}
+	for _, a := range attrs {
+		data = append(data, a...)
+	}
+
+	b := binary.NativeEndian.AppendUint32(nil, uint32(unix.SizeofNlMsghdr+len(data)))
+	b = binary.NativeEndian.AppendUint16(b, msgType)
+	b = append(b, make([]byte, 10)...)
+
+	return append(b, data...)
+}
+
+// destroyEvent returns the destroy event of a TCP connection
+func destroyEvent(src, dst netip.Addr, srcPort, dstPort uint16) []byte {
+	srcType, dstType := uint16(ctaIPv4Src), uint16(ctaIPv4Dst)
+	if src.Is6() {
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+	}
+
+	return conntrackMessage(nfnlSubsysCTNetlink<<8|ipctnlMsgCTDelete,
+		attr(ctaTupleOrig|unix.NLA_F_NESTED,
+			attr(ctaTupleIP|unix.NLA_F_NESTED, attr(srcType, src.AsSlice()), attr(dstType, dst.AsSlice())),
+			attr(ctaTupleProto|unix.NLA_F_NESTED, attr(ctaProtoNum, []byte{unix.IPPROTO_TCP}), attr(ctaProtoSrcPort, be16(srcPort)), attr(ctaProtoDstPort, be16(dstPort))),
+		),
+		attr(ctaCountersOrig|unix.NLA_F_NESTED, attr(ctaCountersPackets, be64(6)), attr(ctaCountersBytes, be64(1000))),
+		attr(ctaCountersReply|unix.NLA_F_NESTED, attr(ctaCountersPackets, be64(4)), attr(ctaCountersBytes, be64(500))),
+	)
+}
+
+var _ = Describe("Conntrack events", func() {
+	It("should parse the flows of the destroy events", func() {
+		buf := destroyEvent(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), 41834, 80)
+		buf = append(buf, conntrackMessage(nfnlSubsysCTNetlink<<8|0, attr(ctaTupleOrig|unix.NLA_F_NESTED))...)
+		buf = append(buf, destroyEvent(netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2"), 5000, 443)...)
+
+		flows, err := parseConntrackMessages(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(flows).To(Equal([]conntrackFlow{
+			{Protocol: unix.IPPROTO_TCP, Src: netip.MustParseAddr("10.0.0.2"), Dst: netip.MustParseAddr("10.0.0.1"), SrcPort: 41834, DstPort: 80, Packets: 10, Bytes: 1500},
+			{Protocol: unix.IPPROTO_TCP, Src: netip.MustParseAddr("2001:db8::1"), Dst: netip.MustParseAddr("2001:db8::2"), SrcPort: 5000, DstPort: 443, Packets: 10, Bytes: 1500},
+		}))
+	})
+
+	It("should reject the truncated messages", func() {
+		buf := destroyEvent(netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), 41834, 80)
+
+		_, err := parseConntrackMessages(buf[:len(buf)-8])
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Monitor", func() {
+	m := &monitor{pod: types.NamespacedName{Namespace: "default", Name: "web"}}
+	m.setInterfaces([]nftables.Interface{{Name: "net1", Network: "default/macvlan-net", IPs: []string{"10.0.0.1", "2001:db8::1"}}})
+	now := time.Now()
+
+	It("should record the direction of the flows of the secondary interfaces", func() {
+		record, ok := m.record(conntrackFlow{Protocol: unix.IPPROTO_TCP, Src: netip.MustParseAddr("10.0.0.2"), Dst: netip.MustParseAddr("10.0.0.1"), SrcPort: 41834, DstPort: 80}, now)
+		Expect(ok).To(BeTrue())
+		Expect(record).To(Equal(Record{
+			Time: now, Namespace: "default", Pod: "web", Network: "default/macvlan-net", Interface: "net1", Direction: DirectionIngress,
+			Protocol: unix.IPPROTO_TCP, SrcAddr: netip.MustParseAddr("10.0.0.2"), SrcPort: 41834, DstAddr: netip.MustParseAddr("10.0.0.1"), DstPort: 80,
+			Verdict: VerdictAllowed,
+		}))
+
+		record, ok = m.record(conntrackFlow{Protocol: unix.IPPROTO_UDP, Src: netip.MustParseAddr("2001:db8::1"), Dst: netip.MustParseAddr("2001:db8::53"), SrcPort: 5353, DstPort: 53}, now)
+		Expect(ok).To(BeTrue())
+		Expect(record.Direction).To(Equal(DirectionEgress))
+		Expect(record.Interface).To(Equal("net1"))
+	})
+
+	It("should not record the flows of the other interfaces", func() {
+		_, ok := m.record(conntrackFlow{Protocol: unix.IPPROTO_TCP, Src: netip.MustParseAddr("192.168.0.2"), Dst: netip.MustParseAddr("192.168.0.1")}, now)
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("Encoders", func() {
+	records := []Record{
+		{
+			Time: time.UnixMilli(1700000000123).UTC(), Namespace: "default", Pod: "web", Network: "default/macvlan-net", Interface: "net1",
+			Direction: DirectionIngress, Protocol: unix.IPPROTO_TCP, SrcAddr: netip.MustParseAddr("10.0.0.2"), SrcPort: 41834,
+			DstAddr: netip.MustParseAddr("10.0.0.1"), DstPort: 80, Verdict: VerdictAllowed, Packets: 10, Bytes: 1500,
+		},
+		{
+			Time: time.UnixMilli(1700000000456).UTC(), Namespace: "default", Pod: "web", Network: "default/macvlan-net", Interface: "net1",
+			Direction: DirectionEgress, Protocol: unix.IPPROTO_UDP, SrcAddr: netip.MustParseAddr("2001:db8::1"), SrcPort: 5353,
+			DstAddr: netip.MustParseAddr("2001:db8::53"), DstPort: 53, Verdict: VerdictAllowed, Packets: 2, Bytes: 180,
+		},
+	}
+
+	It("should encode a JSON object per record", func() {
+		messages, err := JSONEncoder{}.Encode(records)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(messages).To(HaveLen(2))
+		Expect(string(messages[0])).To(Equal(`{"time":"2023-11-14T22:13:20.123Z","namespace":"default","pod":"web","network":"default/macvlan-net","interface":"net1","direction":"ingress","protocol":6,"srcAddr":"10.0.0.2","srcPort":41834,"dstAddr":"10.0.0.1","dstPort":80,"verdict":"allowed","packets":10,"bytes":1500}` + "\n"))
+	})
+
+	It("should encode the records in an IPFIX message with the templates", func() {
+		encoder := &IPFIXEncoder{ObservationDomainID: 7}
+
+		messages, err := encoder.Encode(records)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(messages).To(HaveLen(1))
+
+		message := messages[0]
+		Expect(binary.BigEndian.Uint16(message[0:2])).To(Equal(uint16(ipfixVersion)))
+		Expect(int(binary.BigEndian.Uint16(message[2:4]))).To(Equal(len(message)))
+		Expect(binary.BigEndian.Uint32(message[8:12])).To(Equal(uint32(0)))
+		Expect(binary.BigEndian.Uint32(message[12:16])).To(Equal(uint32(7)))
+
+		// The sets are the templates and a data set per address family
+		var sets []uint16
+		for offset := ipfixHeaderLen; offset < len(message); {
+			sets = append(sets, binary.BigEndian.Uint16(message[offset:offset+2]))
+			length := int(binary.BigEndian.Uint16(message[offset+2 : offset+4]))
+			Expect(length).To(BeNumerically(">=", 4))
+			offset += length
+		}
+		Expect(sets).To(Equal([]uint16{ipfixTemplateSetID, ipfixTemplateIPv4, ipfixTemplateIPv6}))
+
+		// The first record follows the template set and the header of the IPv4 data set
+		templateSetLen := int(binary.BigEndian.Uint16(message[ipfixHeaderLen+2 : ipfixHeaderLen+4]))
+		record := message[ipfixHeaderLen+templateSetLen+4:]
+		Expect(binary.BigEndian.Uint64(record[0:8])).To(Equal(uint64(1700000000123)))
+		Expect(net.IP(record[8:12]).String()).To(Equal("10.0.0.2"))
+		Expect(net.IP(record[12:16]).String()).To(Equal("10.0.0.1"))
+		Expect(binary.BigEndian.Uint16(record[16:18])).To(Equal(uint16(41834)))
+		Expect(binary.BigEndian.Uint16(record[18:20])).To(Equal(uint16(80)))
+		Expect(record[20:23]).To(Equal([]byte{unix.IPPROTO_TCP, 0, forwardingStatusForwarded}))
+		Expect(record[39]).To(Equal(byte(len("net1"))))
+		Expect(string(record[40:44])).To(Equal("net1"))
+
+		// The sequence number counts the records exported before the message
+		messages, err = encoder.Encode(records[:1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(binary.BigEndian.Uint32(messages[0][8:12])).To(Equal(uint32(2)))
+	})
+})
+
+var _ = Describe("Sink", func() {
+	It("should parse the collectors", func() {
+		network, address, err := ParseCollector("udp://collector.monitoring:4739")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(network).To(Equal("udp"))
+		Expect(address).To(Equal("collector.monitoring:4739"))
+
+		_, _, err = ParseCollector("http://collector.monitoring:4739")
+		Expect(err).To(HaveOccurred())
+
+		_, _, err = ParseCollector("tcp://collector.monitoring")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should parse the formats", func() {
+		Expect(ParseFormat("IPFIX")).To(Equal(FormatIPFIX))
+		_, err := ParseFormat("netflow")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should send the exported records to the collector", func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+
+		sink, err := NewSink("udp://"+conn.LocalAddr().String(), FormatJSON)
+		Expect(err).NotTo(HaveOccurred())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			sink.Run(ctx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+
+		sink.Export(Record{Namespace: "default", Pod: "web", Interface: "net1", SrcAddr: netip.MustParseAddr("10.0.0.2"), DstAddr: netip.MustParseAddr("10.0.0.1")})
+
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		buf := make([]byte, 4096)
+		n, _, err := conn.ReadFrom(buf)
+		Expect(err).NotTo(HaveOccurred())
+
+		record := Record{}
+		Expect(json.Unmarshal(buf[:n], &record)).To(Succeed())
+		Expect(record.Pod).To(Equal("web"))
+		Expect(record.SrcAddr).To(Equal(netip.MustParseAddr("10.0.0.2")))
+	})
+})
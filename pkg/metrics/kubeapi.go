@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// InstrumentRESTConfig records the latency and the throttled responses of the requests made with the config
+func InstrumentRESTConfig(cfg *rest.Config) {
+	cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return &instrumentedRoundTripper{next: rt}
+	})
+}
+
+// instrumentedRoundTripper records the Kubernetes API request metrics
+type instrumentedRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (i *instrumentedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := i.next.RoundTrip(req)
+
+	code := "<error>"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			KubeAPIThrottledRequests.WithLabelValues(req.Method).Inc()
+		}
+	}
+	KubeAPIRequestDuration.WithLabelValues(req.Method, code).Observe(time.Since(start).Seconds())
+
+	return resp, err
+}
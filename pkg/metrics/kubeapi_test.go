@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/client-go/rest"
+)
+
+func TestMetrics(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Metrics Suite")
+}
+
+// counterValue returns the value of a counter
+func counterValue(counter prometheus.Counter) float64 {
+	metric := &dto.Metric{}
+	Expect(counter.Write(metric)).To(Succeed())
+	return metric.GetCounter().GetValue()
+}
+
+// histogramCount returns the number of observations of a histogram
+func histogramCount(observer prometheus.Observer) uint64 {
+	metric := &dto.Metric{}
+	Expect(observer.(prometheus.Metric).Write(metric)).To(Succeed())
+	return metric.GetHistogram().GetSampleCount()
+}
+
+var _ = Describe("InstrumentRESTConfig", func() {
+	It("should record the latency and the throttled responses of the requests", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/throttled" {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		cfg := &rest.Config{Host: server.URL}
+		InstrumentRESTConfig(cfg)
+
+		httpClient, err := rest.HTTPClientFor(cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		throttled := counterValue(KubeAPIThrottledRequests.WithLabelValues(http.MethodGet))
+		ok := histogramCount(KubeAPIRequestDuration.WithLabelValues(http.MethodGet, "200"))
+
+		for _, path := range []string{"/ok", "/throttled"} {
+			resp, err := httpClient.Get(server.URL + path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Body.Close()).To(Succeed())
+		}
+
+		Expect(counterValue(KubeAPIThrottledRequests.WithLabelValues(http.MethodGet))).To(Equal(throttled + 1))
+		Expect(histogramCount(KubeAPIRequestDuration.WithLabelValues(http.MethodGet, "200"))).To(Equal(ok + 1))
+		Expect(histogramCount(KubeAPIRequestDuration.WithLabelValues(http.MethodGet, "429"))).To(BeNumerically(">=", 1))
+	})
+})
@@ -0,0 +1,287 @@
+// Package metrics provides the Prometheus metrics exposed by multi-network-policy-nftables
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "multi_networkpolicy"
+
+var (
+	// UnprotectedPods is the number of pods on the node with enforceable secondary interfaces not selected by any policy
+	UnprotectedPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "unprotected_pods",
+		Help:      "Number of pods with enforceable secondary interfaces that are not selected by any MultiNetworkPolicy.",
+	}, []string{"node"})
+
+	// UnprotectedInterfaces is the number of enforceable secondary interfaces on the node not selected by any policy
+	UnprotectedInterfaces = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "unprotected_interfaces",
+		Help:      "Number of enforceable secondary interfaces that are not selected by any MultiNetworkPolicy.",
+	}, []string{"node", "network"})
+
+	// RulesetVerificationMismatches is the number of applied rulesets that did not match the desired state
+	RulesetVerificationMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ruleset_verification_mismatches_total",
+		Help:      "Number of applied rulesets that did not match the desired state when listed back.",
+	})
+
+	// RulesetVerificationFailures is the number of policy applies that still did not match the desired state after all retries
+	RulesetVerificationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ruleset_verification_failures_total",
+		Help:      "Number of policy applies that did not match the desired state after all retries.",
+	})
+
+	// SkippedPolicyApplies is the number of policy applies skipped because the ruleset of the pod did not change
+	SkippedPolicyApplies = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "skipped_policy_applies_total",
+		Help:      "Number of policy applies to a pod skipped because the ruleset applied to the pod did not change.",
+	})
+
+	// SelectorCacheRequests is the number of lookups of the pods and namespaces matching a selector in the selector cache
+	SelectorCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "selector_cache_requests_total",
+		Help:      "Number of lookups of the pods and namespaces matching a label selector in the selector cache, by kind and result (hit or miss).",
+	}, []string{"kind", "result"})
+
+	// FilteredPodEvents is the number of pod events filtered out because the pod has no enforceable interface
+	FilteredPodEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "filtered_pod_events_total",
+		Help:      "Number of pod events filtered out before evaluating the selectors of the policies, because the pod has no secondary interface on a network of a policy, by controller.",
+	}, []string{"controller"})
+
+	// PodSetElements is the number of elements of the sets applied to a pod by all the policies
+	PodSetElements = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pod_set_elements",
+		Help:      "Number of elements of the nftables sets applied to a pod by all the policies, including the chunks of the CIDR sets.",
+	}, []string{"namespace", "pod"})
+
+	// NetNSInFlight is the number of pods whose network namespace is looked up or entered
+	NetNSInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "netns_in_flight",
+		Help:      "Number of pods whose network namespace is being looked up in the container runtime or entered.",
+	})
+
+	// NetNSWaiting is the number of pods waiting for a slot to look up or enter their network namespace
+	NetNSWaiting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "netns_waiting",
+		Help:      "Number of pods waiting for a slot to look up or enter their network namespace.",
+	})
+
+	// NetNSQueueDuration is the time waited for a slot to look up or enter the network namespace of a pod
+	NetNSQueueDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "netns_queue_duration_seconds",
+		Help:      "Time waited for a slot to look up or enter the network namespace of a pod.",
+		Buckets:   []float64{0.001, 0.01, 0.1, 0.5, 1, 2, 5, 10, 30, 60},
+	})
+
+	// EnforcementStageDuration is the time spent in each stage of the enforcement of a policy for a pod
+	EnforcementStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "enforcement_stage_duration_seconds",
+		Help:      "Time spent in each stage of the enforcement of a policy for a pod, by stage (peer_resolution, render, netns_enter, nft_exec or verify).",
+		Buckets:   []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10, 30},
+	}, []string{"stage"})
+
+	// CompileCacheRequests is the number of lookups of the compiled policies by result
+	CompileCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "compile_cache_requests_total",
+		Help:      "Number of lookups of the compiled form of the policies, by result (hit or miss). A miss compiles a new generation of a policy.",
+	}, []string{"result"})
+
+	// SandboxCacheRequests is the number of lookups of the prefetched network namespace paths of the pods by result
+	SandboxCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sandbox_cache_requests_total",
+		Help:      "Number of lookups of the network namespace paths of the pods prefetched from the container runtime, by result (hit or miss). A miss queries the container runtime during the sync.",
+	}, []string{"result"})
+
+	// RateLimitedEvents is the number of events enqueueing a policy delayed or dropped by the per-policy rate limit
+	RateLimitedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_events_total",
+		Help:      "Number of pod, namespace and network events enqueueing a policy above the per-policy rate, delayed or merged into a pending enqueue, by controller.",
+	}, []string{"controller"})
+
+	// RulesetSizeRejections is the number of rulesets of a policy for a pod not applied because they exceed a size limit
+	RulesetSizeRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ruleset_size_rejections_total",
+		Help:      "Total number of rulesets of a policy for a pod not applied because they exceed a size limit, by limit (rules or set_elements).",
+	}, []string{"limit"})
+
+	// WarmStartVerifications is the number of persisted applied states verified on startup by result
+	WarmStartVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "warm_start_verifications_total",
+		Help:      "Number of policies recorded as applied to a pod in the persisted state verified on startup, by result (ok, stale when the policy is missing from the pod, gone when the pod network namespace is gone, or interrupted when an apply to the pod was interrupted by the restart).",
+	}, []string{"result"})
+
+	// TableLayoutMigrations is the number of tables of an older layout version migrated by result
+	TableLayoutMigrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "table_layout_migrations_total",
+		Help:      "Number of tables of another layout version upgraded, by result (migrated in place, or replaced when there is no migration path).",
+	}, []string{"result"})
+
+	// InterfaceMismatches is the number of interfaces of the network status of the pods not matching their network
+	// namespace by kind
+	InterfaceMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "interface_mismatches_total",
+		Help:      "Number of interfaces of the network status of the pods missing from their network namespace, or of the network namespace missing from the network status, by kind (missing, unknown, or unenforceable when their device bypasses the kernel).",
+	}, []string{"kind"})
+
+	// StaleEnforcement is the age of the oldest policy change not enforced yet on the node
+	StaleEnforcement = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stale_enforcement_seconds",
+		Help:      "Age in seconds of the oldest policy change enqueued and not enforced yet on the pods of the node, 0 when all the changes are enforced.",
+	}, staleEnforcementAge)
+
+	// GarbageCollected is the number of entries of the state of the deleted pods and policies collected
+	GarbageCollected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "garbage_collected_total",
+		Help:      "Number of entries of the state of the deleted pods and policies removed by the periodic garbage collection, by kind.",
+	}, []string{"kind"})
+
+	// DropLogEnabled is 1 when the packets dropped by the policies are logged
+	DropLogEnabled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drop_log_enabled",
+		Help:      "Whether the packets dropped by the policies are logged (1) or not (0).",
+	})
+
+	// DropLogRate is the configured rate of logged dropped packets per chain
+	DropLogRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drop_log_rate_per_second",
+		Help:      "Configured rate of dropped packets logged per chain, in packets per second.",
+	})
+
+	// DropLogBurst is the configured burst of logged dropped packets per chain
+	DropLogBurst = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drop_log_burst_packets",
+		Help:      "Configured burst of dropped packets logged per chain above the rate.",
+	})
+
+	// MemoryLimit is the soft memory limit of the Go runtime
+	MemoryLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "memory_limit_bytes",
+		Help:      "Soft memory limit of the Go runtime, the maximum int64 when it is not limited.",
+	})
+
+	// KubeAPIRequestDuration is the latency of the requests to the Kubernetes API
+	KubeAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "kube_api_request_duration_seconds",
+		Help:      "Latency of the requests to the Kubernetes API, by method and response code.",
+		Buckets:   []float64{0.005, 0.025, 0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+	}, []string{"method", "code"})
+
+	// KubeAPIThrottledRequests is the number of requests to the Kubernetes API rejected with 429 Too Many Requests
+	KubeAPIThrottledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kube_api_throttled_requests_total",
+		Help:      "Number of requests to the Kubernetes API rejected with 429 Too Many Requests, by method.",
+	}, []string{"method"})
+
+	// FlowRecords is the number of flow records of the secondary interfaces by result
+	FlowRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "flow_records_total",
+		Help:      "Number of flow records of the secondary interfaces by result (exported to the collector, dropped when the queue is full or the collector failed, or lost when the conntrack events overflowed the socket buffer of a pod).",
+	}, []string{"result"})
+
+	// FlowExportMonitoredPods is the number of pods whose conntrack is monitored by the flow export
+	FlowExportMonitoredPods = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "flow_export_monitored_pods",
+		Help:      "Number of pods of the node whose conntrack events are monitored by the flow export.",
+	})
+
+	// StatelessRules is 1 when the traffic of a protocol is enforced with stateless rules, because the connection
+	// tracking of the node cannot track it
+	StatelessRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stateless_rules",
+		Help:      "Whether the traffic is enforced with stateless rules (1) because the connection tracking of the node cannot track it, or not (0), by protocol (all or sctp).",
+	}, []string{"protocol"})
+)
+
+// staleEnforcementSince returns the time of the oldest policy change not enforced yet, set by the controllers
+var staleEnforcementSince atomic.Pointer[func() (time.Time, bool)]
+
+// SetStaleEnforcementSource sets the function returning the time of the oldest policy change not enforced yet on the
+// node, or false when all the changes are enforced
+func SetStaleEnforcementSource(since func() (time.Time, bool)) {
+	staleEnforcementSince.Store(&since)
+}
+
+func staleEnforcementAge() float64 {
+	since := staleEnforcementSince.Load()
+	if since == nil {
+		return 0
+	}
+
+	oldest, ok := (*since)()
+	if !ok {
+		return 0
+	}
+
+	return time.Since(oldest).Seconds()
+}
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(
+		UnprotectedPods,
+		UnprotectedInterfaces,
+		RulesetVerificationMismatches,
+		RulesetVerificationFailures,
+		SkippedPolicyApplies,
+		SelectorCacheRequests,
+		CompileCacheRequests,
+		SandboxCacheRequests,
+		RateLimitedEvents,
+		FilteredPodEvents,
+		PodSetElements,
+		NetNSInFlight,
+		NetNSWaiting,
+		NetNSQueueDuration,
+		EnforcementStageDuration,
+		RulesetSizeRejections,
+		WarmStartVerifications,
+		TableLayoutMigrations,
+		InterfaceMismatches,
+		StaleEnforcement,
+		GarbageCollected,
+		DropLogEnabled,
+		DropLogRate,
+		DropLogBurst,
+		MemoryLimit,
+		KubeAPIRequestDuration,
+		KubeAPIThrottledRequests,
+		FlowRecords,
+		FlowExportMonitoredPods,
+		StatelessRules,
+	)
+}
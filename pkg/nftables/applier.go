@@ -0,0 +1,86 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
+)
+
+// Tables are the tables of the controller in the network namespaces of the pods, the applier only runs operations on
+// them and on LocalTables
+var Tables = []string{tableName}
+
+// LocalTables are the tables of the controller in the network namespace of the node, the scratch table validating
+// the rules and detecting the connection tracking support
+var LocalTables = []string{checkTableName}
+
+type netnsContextKey struct{}
+
+// withNetNS runs fn in the network namespace, the nftables clients created with the context then run their operations
+// in it. Without the applier, the network namespace is entered by the process. It returns an error wrapping
+// applier.ErrNetNSNotFound when the network namespace cannot be opened.
+func (n *NFTables) withNetNS(ctx context.Context, netnsPath string, fn func(ctx context.Context) error) error {
+	if n.Applier != nil {
+		return fn(context.WithValue(ctx, netnsContextKey{}, netnsPath))
+	}
+
+	// The time to enter the network namespace is only observed in the process, the applier enters it on its side
+	start := time.Now()
+	netns, err := ns.GetNS(netnsPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", applier.ErrNetNSNotFound, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(_ ns.NetNS) error {
+		observeStage(stageNetNSEnter, time.Since(start))
+		return fn(ctx)
+	})
+}
+
+// newNetNSNFTables returns an nftables client of the table in the network namespace of the context, or in the current
+// one when the context has no network namespace, running nft with the execution options or in the applier when the
+// client is set
+func newNetNSNFTables(ctx context.Context, exec ExecOptions, client *applier.Client, table string) (knftables.Interface, error) {
+	netnsPath, _ := ctx.Value(netnsContextKey{}).(string)
+
+	if client == nil {
+		return newLocalNFTables(exec, table)
+	}
+
+	var nft knftables.Interface = client.NFTables(netnsPath, table)
+	if exec.Timeout > 0 {
+		nft = &timeoutNFTables{Interface: nft, timeout: exec.Timeout}
+	}
+
+	return &applierNFTables{Interface: nft, client: client, netns: netnsPath, table: table, timeout: exec.Timeout}, nil
+}
+
+// applierNFTables creates the ct timeout objects through the applier
+type applierNFTables struct {
+	knftables.Interface
+	client  *applier.Client
+	netns   string
+	table   string
+	timeout time.Duration
+}
+
+// AddConntrackTimeouts adds the ct timeout objects to the table, creating the table when it does not exist
+func (a *applierNFTables) AddConntrackTimeouts(ctx context.Context, timeouts []conntrackTimeout) error {
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+
+	if err := a.client.RunScript(ctx, a.netns, a.table, conntrackTimeoutsScript(a.table, timeouts)); err != nil {
+		return fmt.Errorf("failed to add conntrack timeouts: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package nftables
+
+import (
+	"context"
+
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
+)
+
+const (
+	// checkTableName is the table of the transactions checking the custom rules, they are never committed
+	checkTableName = "multi_networkpolicy_check"
+	checkChain     = "check"
+)
+
+// NewRuleChecker returns the nftables client checking the custom rules, running nft with the execution options or in
+// the applier when the client is set
+func NewRuleChecker(exec ExecOptions, client *applier.Client) (knftables.Interface, error) {
+	return newNFTables(exec, client, checkTableName)
+}
+
+// CheckCustomRule checks with nft --check that a custom rule is valid.
+// Templated rules are rendered with sample values of the rule family.
+func CheckCustomRule(ctx context.Context, nft knftables.Interface, rule string, ipv6 bool) error {
+	rendered, err := renderSampleRule(rule, ipv6)
+	if err != nil {
+		return err
+	}
+
+	tx := nft.NewTransaction()
+	tx.Add(&knftables.Table{})
+	tx.Add(&knftables.Chain{
+		Name: checkChain,
+	})
+	tx.Add(&knftables.Rule{
+		Chain: checkChain,
+		Rule:  rendered,
+	})
+
+	return nft.Check(ctx, tx)
+}
@@ -0,0 +1,190 @@
+package nftables
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// chunkElements splits the elements of a set in chunks of at most size elements, a size of 0 does not split them
+func chunkElements(elements []string, size int) [][]string {
+	if size <= 0 || len(elements) <= size {
+		return [][]string{elements}
+	}
+
+	var chunks [][]string
+	for start := 0; start < len(elements); start += size {
+		chunks = append(chunks, elements[start:min(start+size, len(elements))])
+	}
+
+	return chunks
+}
+
+// createAndPopulateChunkedIPSet creates and populates the sets of the chunks of the addresses, the first chunk is named
+// after the set and the next ones get a _c<index> suffix. It returns the names of the sets.
+func createAndPopulateChunkedIPSet(tx *knftables.Transaction, name string, setType string, setComment string, addresses []string, needsIntervalFlag bool, maxElements int) []string {
+	var names []string
+	for i, chunk := range chunkElements(addresses, maxElements) {
+		chunkName := name
+		if i > 0 {
+			chunkName = fmt.Sprintf("%s_c%d", name, i)
+		}
+
+		createAndPopulateIPSet(tx, chunkName, setType, setComment, chunk, needsIntervalFlag)
+		names = append(names, chunkName)
+	}
+
+	return names
+}
+
+// cidrSets are the chunked sets of the CIDRs and the excepts of a family
+type cidrSets struct {
+	family    string
+	addrField string
+	cidrs     []string
+	excepts   []string
+}
+
+// createCIDRSets creates the chunked sets of the CIDRs and the excepts of a family, it returns nil when there are no CIDRs
+func createCIDRSets(tx *knftables.Transaction, family string, addrField string, setType string, cidrsSetName string, exceptsSetName string, cidrs []string, excepts []string, comment string, maxElements int) *cidrSets {
+	if len(cidrs) == 0 {
+		return nil
+	}
+
+	sets := &cidrSets{
+		family:    family,
+		addrField: addrField,
+		cidrs:     createAndPopulateChunkedIPSet(tx, cidrsSetName, setType, "CIDRs for "+comment, cidrs, true, maxElements),
+	}
+
+	if len(excepts) > 0 {
+		sets.excepts = createAndPopulateChunkedIPSet(tx, exceptsSetName, setType, "Excepts for "+comment, excepts, true, maxElements)
+	}
+
+	return sets
+}
+
+// ruleSections returns a rule section per chunk of the CIDRs, after the match. The chunks of the CIDRs are
+// alternatives, while the chunks of the excepts are all excluded by each rule section. The inner headers of the
+// encapsulated traffic are matched when the encapsulation is set.
+func (s *cidrSets) ruleSections(match string, encapsulation datastore.Encapsulation) []string {
+	if s == nil {
+		return nil
+	}
+
+	family := innerHeader(encapsulation, s.family)
+
+	var sections []string
+	for _, cidrsSet := range s.cidrs {
+		rule := knftables.Concat(match, family, s.addrField, "@"+cidrsSet)
+		for _, exceptsSet := range s.excepts {
+			rule = knftables.Concat(rule, family, s.addrField, "!=", "@"+exceptsSet)
+		}
+
+		sections = append(sections, rule)
+	}
+
+	return sections
+}
+
+// setElementCounter counts the elements of the sets applied to each pod by each policy
+type setElementCounter struct {
+	mu     sync.Mutex
+	counts map[types.NamespacedName]map[types.NamespacedName]int
+}
+
+// set records the number of elements of the sets applied to a pod by a policy, 0 forgets it
+func (c *setElementCounter) set(pod types.NamespacedName, policy types.NamespacedName, elements int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[types.NamespacedName]map[types.NamespacedName]int)
+	}
+
+	if elements == 0 {
+		delete(c.counts[pod], policy)
+	} else {
+		if c.counts[pod] == nil {
+			c.counts[pod] = make(map[types.NamespacedName]int)
+		}
+		c.counts[pod][policy] = elements
+	}
+
+	c.update(pod)
+}
+
+// others returns the number of elements of the sets applied to a pod by the other policies
+func (c *setElementCounter) others(pod types.NamespacedName, policy types.NamespacedName) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	for other, elements := range c.counts[pod] {
+		if other != policy {
+			total += elements
+		}
+	}
+
+	return total
+}
+
+// forget forgets the pods of a policy that are not kept
+func (c *setElementCounter) forget(policy types.NamespacedName, keep func(pod types.NamespacedName) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for pod, policies := range c.counts {
+		if _, ok := policies[policy]; ok && !keep(pod) {
+			delete(policies, policy)
+			c.update(pod)
+		}
+	}
+}
+
+// collect forgets the pods that are not kept by any policy, and returns the number of forgotten pods
+func (c *setElementCounter) collect(keep func(pod types.NamespacedName) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	collected := 0
+	for pod := range c.counts {
+		if !keep(pod) {
+			delete(c.counts, pod)
+			metrics.PodSetElements.DeleteLabelValues(pod.Namespace, pod.Name)
+			collected++
+		}
+	}
+
+	return collected
+}
+
+// update updates the metric of a pod, the lock must be held
+func (c *setElementCounter) update(pod types.NamespacedName) {
+	if len(c.counts[pod]) == 0 {
+		delete(c.counts, pod)
+		metrics.PodSetElements.DeleteLabelValues(pod.Namespace, pod.Name)
+		return
+	}
+
+	total := 0
+	for _, elements := range c.counts[pod] {
+		total += elements
+	}
+	metrics.PodSetElements.WithLabelValues(pod.Namespace, pod.Name).Set(float64(total))
+}
+
+// elements returns the number of elements of the sets of a desired state
+func (d *desiredState) elements() int {
+	total := 0
+	for _, elements := range d.sets {
+		total += len(elements)
+	}
+
+	return total
+}
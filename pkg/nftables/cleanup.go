@@ -2,18 +2,161 @@ package nftables
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
 
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/knftables"
 
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
 )
 
+// CleanUpError reports the pods a deleted policy could not be cleaned up from, it was cleaned up from the other pods.
+// The applied states of the failed pods are kept, so that a retry cleans the policy up from them again.
+type CleanUpError struct {
+	// Pods are the errors of the failed pods
+	Pods map[types.NamespacedName]error
+	// Total is the number of pods the policy was cleaned up from, failed pods included
+	Total int
+}
+
+func (e *CleanUpError) Error() string {
+	failures := make([]string, 0, len(e.Pods))
+	for _, pod := range slices.SortedFunc(maps.Keys(e.Pods), func(a, b types.NamespacedName) int {
+		return strings.Compare(a.String(), b.String())
+	}) {
+		failures = append(failures, fmt.Sprintf("%s: %v", pod, e.Pods[pod]))
+	}
+
+	return fmt.Sprintf("failed to clean up policy from %d of %d pods: %s", len(e.Pods), e.Total, strings.Join(failures, "; "))
+}
+
+// cleanUpNodePolicy cleans up a deleted policy from the pods of the node: the pods of its namespace and the pods its
+// applied states record it was applied to, e.g. the pods whose networks changed since. The pods gone with their
+// network namespace, before or during the clean up, are skipped. All the pods are cleaned up before the failed ones
+// are reported in a CleanUpError, the clean up of the others is not undone and is idempotent when retried.
+func (n *NFTables) cleanUpNodePolicy(ctx context.Context, policy *datastore.Policy, pods []corev1.Pod, logger logr.Logger) error {
+	policyKey := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+	failed := make(map[types.NamespacedName]error)
+	// unresolved counts the pods of the applied states that could not be looked up
+	unresolved := 0
+
+	targets := make([]corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if len(GetInterfaces(&pod)) > 0 {
+			targets = append(targets, pod)
+		}
+	}
+
+	if n.State != nil {
+		applied := n.State.ListAppliedStates()[policyKey]
+		for _, podKey := range slices.SortedFunc(maps.Keys(applied), func(a, b types.NamespacedName) int {
+			return strings.Compare(a.String(), b.String())
+		}) {
+			if slices.ContainsFunc(targets, func(p corev1.Pod) bool { return p.Namespace == podKey.Namespace && p.Name == podKey.Name }) {
+				continue
+			}
+
+			pod := &corev1.Pod{}
+			err := n.Client.Get(ctx, podKey, pod)
+			if err != nil && !apierrors.IsNotFound(err) {
+				failed[podKey] = fmt.Errorf("failed to get pod: %w", err)
+				unresolved++
+				continue
+			}
+
+			// The network namespace the policy was applied in is gone with the pod
+			if err != nil || pod.UID != applied[podKey].PodUID || !n.runsOnNode(pod) {
+				logger.V(1).Info("Pod of applied state is gone, forgetting it", "pod", podKey.Name, "namespace", podKey.Namespace)
+				n.forgetAppliedState(policyKey, podKey)
+				continue
+			}
+
+			targets = append(targets, *pod)
+		}
+	}
+
+	logger.Info("Found pods to clean up policy from", "hostname", n.Hostname, "count", len(targets))
+
+	enforcer := n.enforcer()
+
+	// cleaned are the network namespaces the policy was cleaned up from, once for the pods sharing one
+	cleaned := make(map[string]bool)
+
+	for _, pod := range targets {
+		logger := logger.WithValues("pod", pod.Name, "namespace", pod.Namespace)
+		podKey := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+		release, err := n.acquireNetNS(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = func() error {
+			defer release()
+
+			sandbox, err := enforcer.Sandbox(ctx, &pod)
+			if err != nil {
+				return fmt.Errorf("failed to get network namespace path: %w", err)
+			}
+
+			if cleaned[sandbox] {
+				return nil
+			}
+
+			end := n.beginTransaction(policyKey, &pod, sandbox, datastore.IntentCleanUp)
+			defer end()
+
+			ctx := withPendingEarlyDeny(ctx, n.pendingEarlyDeny(&pod, GetInterfaces(&pod), policyKey))
+			if err := enforcer.CleanUp(ctx, sandbox, policyKey, logger); err != nil {
+				return err
+			}
+
+			cleaned[sandbox] = true
+			return nil
+		}()
+		if err != nil && (errors.Is(err, ErrNetNSNotFound) || n.podGone(ctx, &pod)) {
+			logger.V(1).Info("Pod gone during clean up, skipping")
+			n.forgetAppliedState(policyKey, podKey)
+			continue
+		}
+
+		if err != nil {
+			logger.Info("Failed to clean up policy from pod", "error", err.Error())
+			failed[podKey] = err
+			continue
+		}
+
+		n.setElements.set(podKey, policyKey, 0)
+		n.forgetAppliedState(policyKey, podKey)
+
+		if n.EnforcementAnnotations {
+			n.annotateEnforcement(ctx, &pod, GetInterfaces(&pod), policy, SyncOperationDelete, nil, logger)
+		}
+		if n.RecordNetworkStatistics {
+			n.recordNetworkStatistics(ctx, &pod, GetInterfaces(&pod), policy, SyncOperationDelete, -1, logger)
+		}
+	}
+
+	if len(failed) > 0 {
+		// The pods failed before they could be cleaned up are not targets
+		return &CleanUpError{Pods: failed, Total: len(targets) + unresolved}
+	}
+
+	return nil
+}
+
 // cleanUpPolicy cleans up the policy
-func cleanUpPolicy(ctx context.Context, policyName string, policyNamespace string, logger logr.Logger) error {
-	nft, err := knftables.New(knftables.InetFamily, tableName)
+func (n *NFTables) cleanUpPolicy(ctx context.Context, policyName string, policyNamespace string, logger logr.Logger) error {
+	nft, err := newNetNSNFTables(ctx, n.Exec, n.Applier, tableName)
 	if err != nil {
 		return fmt.Errorf("failed to create nftables client: %w", err)
 	}
@@ -21,13 +164,68 @@ func cleanUpPolicy(ctx context.Context, policyName string, policyNamespace strin
 	return cleanUp(ctx, nft, policyName, policyNamespace, logger)
 }
 
+// runsOnNode checks if a pod still runs on the node outside of the host network namespace
+func (n *NFTables) runsOnNode(pod *corev1.Pod) bool {
+	return pod.Spec.NodeName == n.Hostname && !pod.Spec.HostNetwork && pod.Status.Phase == corev1.PodRunning
+}
+
+// podGone checks if a pod was deleted, replaced or stopped running, its network namespace is gone with it
+func (n *NFTables) podGone(ctx context.Context, pod *corev1.Pod) bool {
+	current := &corev1.Pod{}
+	err := n.Client.Get(ctx, client.ObjectKeyFromObject(pod), current)
+	if apierrors.IsNotFound(err) {
+		return true
+	}
+
+	return err == nil && (current.UID != pod.UID || !n.runsOnNode(current))
+}
+
+// forgetAppliedState forgets the state of a policy applied to a pod
+func (n *NFTables) forgetAppliedState(policy types.NamespacedName, pod types.NamespacedName) {
+	if n.State == nil {
+		return
+	}
+
+	n.State.DeleteAppliedStates(policy, func(p types.NamespacedName) bool {
+		return p != pod
+	})
+}
+
 // cleanUp cleans up the policy chains, rules and sets
 func cleanUp(ctx context.Context, nft knftables.Interface, policyName string, policyNamespace string, logger logr.Logger) error {
-	logger.Info("Cleaning up policy")
-
 	tx := nft.NewTransaction()
 
+	err := deletePolicyObjects(ctx, nft, tx, policyName, policyNamespace, logger)
+	if err != nil {
+		return err
+	}
+
+	// A pod is never left denied by the early deny of a deleted policy, the interfaces stay denied for the other
+	// policies selecting the pod
+	pending, _ := ctx.Value(earlyDenyContextKey{}).([]string)
+	err = reconcileEarlyDeny(ctx, nft, tx, pending, logger)
+	if err != nil {
+		return err
+	}
+
+	if logger.V(1).Enabled() {
+		logger.V(1).Info("Applying nftables cleanup transaction", "transaction", tx.String())
+	}
+
+	err = nft.Run(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("failed to run transaction: %w", err)
+	}
+
+	return nil
+}
+
+// deletePolicyObjects queues the deletion of the policy chains, rules and sets in the transaction
+func deletePolicyObjects(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, policyName string, policyNamespace string, logger logr.Logger) error {
+	logger.Info("Cleaning up policy")
+
 	policyRuleComment := fmt.Sprintf("%s/%s", policyNamespace, policyName)
+	verdictRuleComment := verdictRuleCommentPrefix + policyRuleComment
 
 	// Delete rule in input chain
 	rules, err := nft.ListRules(ctx, inputChain)
@@ -59,6 +257,36 @@ func cleanUp(ctx context.Context, nft knftables.Interface, policyName string, po
 		}
 	}
 
+	// Delete rules in the dispatcher chains of the networks overriding the hook, in the notrack chains of the
+	// encapsulated networks, in the hardening, fragment and conntrack timeout chains and in the merged chains
+	chains, err := nft.List(ctx, "chains")
+	if err != nil {
+		if !knftables.IsNotFound(err) {
+			return fmt.Errorf("failed to list chains: %w", err)
+		}
+	}
+
+	for _, chain := range chains {
+		if !strings.HasPrefix(chain, prefixDispatcherChain) && chain != notrackPreroutingChain && chain != notrackOutputChain && !slices.Contains([]string{icmpHardeningChain, ipv6ExthdrChain, fragmentPreroutingChain, fragmentOutputChain, conntrackTimeoutPreroutingChain, conntrackTimeoutOutputChain, tcpFlagsChain, synLimitChain, mergedIngressChain, mergedEgressChain}, chain) {
+			continue
+		}
+
+		rules, err = nft.ListRules(ctx, chain)
+		if err != nil {
+			if !knftables.IsNotFound(err) {
+				return fmt.Errorf("failed to list rules in %s chain: %w", chain, err)
+			}
+		}
+
+		// The rules of the merged chains are commented with the UID of the policy, whatever it is
+		for _, rule := range rules {
+			if rule.Comment != nil && (*rule.Comment == policyRuleComment || strings.HasPrefix(*rule.Comment, policyRuleComment+"/")) {
+				logger.V(1).Info("Deleting rule in dispatcher chain", "chain", chain, "rule", rule.Comment)
+				tx.Delete(rule)
+			}
+		}
+	}
+
 	// Delete rule in ingress chain
 	rules, err = nft.ListRules(ctx, ingressChain)
 	if err != nil {
@@ -68,7 +296,7 @@ func cleanUp(ctx context.Context, nft knftables.Interface, policyName string, po
 	}
 
 	for _, rule := range rules {
-		if rule.Comment != nil && *rule.Comment == policyRuleComment {
+		if rule.Comment != nil && (*rule.Comment == policyRuleComment || *rule.Comment == verdictRuleComment) {
 			logger.V(1).Info("Deleting rule in ingress chain", "rule", rule.Comment)
 			tx.Delete(rule)
 		}
@@ -83,24 +311,19 @@ func cleanUp(ctx context.Context, nft knftables.Interface, policyName string, po
 	}
 
 	for _, rule := range rules {
-		if rule.Comment != nil && *rule.Comment == policyRuleComment {
+		if rule.Comment != nil && (*rule.Comment == policyRuleComment || *rule.Comment == verdictRuleComment) {
 			logger.V(1).Info("Deleting rule in egress chain", "rule", rule.Comment)
 			tx.Delete(rule)
 		}
 	}
 
+	// The names of the objects of the policy start with the hash of its namespace name, followed by the hash of the UID
+	// of the policy object, the objects of a deleted policy recreated with the same name are deleted with it
 	hashName := utils.GetHashName(policyName, policyNamespace)
 
 	// Delete policy chains
-	chains, err := nft.List(ctx, "chains")
-	if err != nil {
-		if !knftables.IsNotFound(err) {
-			return fmt.Errorf("failed to list chains: %w", err)
-		}
-	}
-
 	for _, chain := range chains {
-		if chain == fmt.Sprintf("%s%s", prefixNetworkPolicyChain, hashName) {
+		if strings.HasPrefix(chain, prefixNetworkPolicyChain+hashName) {
 			logger.V(1).Info("Deleting policy chain", "chain", chain)
 			tx.Flush(&knftables.Chain{
 				Name: chain,
@@ -137,14 +360,5 @@ func cleanUp(ctx context.Context, nft knftables.Interface, policyName string, po
 		}
 	}
 
-	if logger.V(1).Enabled() {
-		logger.V(1).Info("Applying nftables cleanup transaction", "transaction", tx.String())
-	}
-
-	err = nft.Run(ctx, tx)
-	if err != nil {
-		return fmt.Errorf("failed to run transaction: %w", err)
-	}
-
 	return nil
 }
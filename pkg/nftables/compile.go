@@ -0,0 +1,135 @@
+package nftables
+
+import (
+	"slices"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// compiledRule is the part of a rule of a policy that depends neither on the target pod nor on the cluster
+type compiledRule struct {
+	// ports are the port rule sections of the rule
+	ports []string
+	// ipBlocks is the peer set of the rule when all its peers are IP blocks, nil otherwise
+	ipBlocks *peerSet
+	// err is the validation error of the ports and the IP blocks of the rule, the invalid rules are not rendered
+	err error
+}
+
+// compiledPolicy is the compiled form of a generation of a policy
+type compiledPolicy struct {
+	generation int64
+	// uid is the UID of the policy object, a policy recreated with the same name starts over its generations
+	uid types.UID
+	// portPresets are the port presets the ports of the rules were expanded with, they can change without the generation
+	portPresets []string
+	ingress     []compiledRule
+	egress      []compiledRule
+}
+
+// compileCache caches the compiled form of the policies by generation, so that the ports and the IP blocks of the
+// rules are not parsed again for every target pod and every sync of the same generation of a policy
+type compileCache struct {
+	mu       sync.Mutex
+	policies map[types.NamespacedName]*compiledPolicy
+}
+
+// get returns the compiled form of a policy, compiling it when its generation changed. The policies without a
+// generation are compiled without being cached.
+func (c *compileCache) get(policy *datastore.Policy) *compiledPolicy {
+	if policy.Generation == 0 {
+		return compilePolicy(policy)
+	}
+
+	key := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if compiled, ok := c.policies[key]; ok && compiled.generation == policy.Generation && compiled.uid == policy.UID && slices.Equal(compiled.portPresets, policy.PortPresets) {
+		metrics.CompileCacheRequests.WithLabelValues("hit").Inc()
+		return compiled
+	}
+
+	metrics.CompileCacheRequests.WithLabelValues("miss").Inc()
+	compiled := compilePolicy(policy)
+	if c.policies == nil {
+		c.policies = make(map[types.NamespacedName]*compiledPolicy)
+	}
+	c.policies[key] = compiled
+
+	return compiled
+}
+
+// forget forgets the compiled form of a deleted policy
+func (c *compileCache) forget(policy types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.policies, policy)
+}
+
+// compilePolicy compiles the rules of a policy
+func compilePolicy(policy *datastore.Policy) *compiledPolicy {
+	compiled := &compiledPolicy{generation: policy.Generation, uid: policy.UID, portPresets: policy.PortPresets}
+
+	for _, rule := range policy.Spec.Ingress {
+		compiled.ingress = append(compiled.ingress, compileRule(rule.Ports, rule.From))
+	}
+	for _, rule := range policy.Spec.Egress {
+		compiled.egress = append(compiled.egress, compileRule(rule.Ports, rule.To))
+	}
+
+	return compiled
+}
+
+// compileRule compiles the ports and the peers of a rule
+func compileRule(ports []datastore.Port, peers []datastore.Peer) compiledRule {
+	var rule compiledRule
+	if rule.err = validateRule(ports, peers); rule.err != nil {
+		return rule
+	}
+
+	if len(ports) > 0 {
+		rule.ports = getPortRuleSections(ports)
+	}
+
+	if len(peers) == 0 {
+		return rule
+	}
+
+	var cidrs, excepts []string
+	for _, peer := range peers {
+		if peer.IPBlock == nil {
+			return rule
+		}
+
+		cidrs = append(cidrs, peer.IPBlock.CIDR)
+		excepts = append(excepts, peer.IPBlock.Except...)
+	}
+
+	rule.ipBlocks = &peerSet{cidrs: len(cidrs), excepts: len(excepts)}
+	rule.ipBlocks.ipv4CIDRs, rule.ipBlocks.ipv6CIDRs = utils.SplitCIDRs(cidrs)
+	rule.ipBlocks.ipv4Excepts, rule.ipBlocks.ipv6Excepts = utils.SplitCIDRs(excepts)
+
+	return rule
+}
+
+// rule returns the compiled form of a rule of a direction
+func (p *compiledPolicy) rule(direction string, rule int) compiledRule {
+	rules := p.ingress
+	if direction == "egress" {
+		rules = p.egress
+	}
+
+	if rule >= len(rules) {
+		return compiledRule{}
+	}
+
+	return rules[rule]
+}
@@ -0,0 +1,40 @@
+package nftables
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+)
+
+// createConnectionLimitRules drops the new ingress connections of the source addresses having more connections than
+// the limit to the matched interfaces. The connections of each source address are counted in dynamic sets, the rules
+// go before the rules accepting the traffic, so that the limit applies to the accepted ports.
+func createConnectionLimitRules(tx *knftables.Transaction, hashName string, limit int, npChain policyChain, logger logr.Logger) {
+	if limit <= 0 {
+		return
+	}
+
+	logger.V(1).Info("Creating connection limit rules", "limit", limit)
+	for _, family := range []struct {
+		name     string
+		setType  string
+		addrExpr string
+	}{
+		{name: "ipv4", setType: "ipv4_addr", addrExpr: "ip saddr"},
+		{name: "ipv6", setType: "ipv6_addr", addrExpr: "ip6 saddr"},
+	} {
+		setName := fmt.Sprintf("%s%s_connlimit_%s", prefixNetworkPolicySet, hashName, family.name)
+		tx.Add(&knftables.Set{
+			Name:    setName,
+			Type:    family.setType,
+			Flags:   []knftables.SetFlag{knftables.DynamicFlag},
+			Comment: knftables.PtrTo("Connections per source address"),
+		})
+
+		tx.Add(npChain.rule(knftables.Concat(
+			"iifname", fmt.Sprintf("@%s%s", prefixManagedInterfacesSet, hashName), "ct state new",
+			"add", "@"+setName, "{", family.addrExpr, "ct count over", limit, "}", "drop",
+		), nil))
+	}
+}
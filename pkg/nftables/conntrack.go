@@ -0,0 +1,109 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+)
+
+// ensureConntrackZones assigns a conntrack zone to each interface of the pod, so that the connections of networks
+// with overlapping IP ranges are tracked separately. The zone chains are removed when the zones are disabled.
+func ensureConntrackZones(ctx context.Context, nft knftables.Interface, interfaces []Interface, enabled bool, logger logr.Logger) error {
+	tx := nft.NewTransaction()
+
+	if err := createConntrackZones(ctx, nft, tx, interfaces, enabled, logger); err != nil {
+		return err
+	}
+
+	if tx.NumOperations() == 0 {
+		return nil
+	}
+
+	if err := nft.Run(ctx, tx); err != nil {
+		return fmt.Errorf("failed to run transaction: %w", err)
+	}
+
+	return nil
+}
+
+// createConntrackZones queues the conntrack zone chains of the interfaces in the transaction, or their deletion when
+// the zones are disabled
+func createConntrackZones(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, interfaces []Interface, enabled bool, logger logr.Logger) error {
+	if enabled {
+		zones := conntrackZones(interfaces)
+		logger.V(1).Info("Assigning conntrack zones", "zones", zones)
+
+		createConntrackZoneChain(tx, conntrackZonePreroutingChain, knftables.PreroutingHook, "iifname", zones)
+		createConntrackZoneChain(tx, conntrackZoneOutputChain, knftables.OutputHook, "oifname", zones)
+	} else {
+		chains, err := nft.List(ctx, "chains")
+		if err != nil && !knftables.IsNotFound(err) {
+			return fmt.Errorf("failed to list chains: %w", err)
+		}
+
+		for _, chain := range []string{conntrackZonePreroutingChain, conntrackZoneOutputChain} {
+			if !slices.Contains(chains, chain) {
+				continue
+			}
+
+			logger.V(1).Info("Deleting conntrack zone chain", "chain", chain)
+			tx.Flush(&knftables.Chain{
+				Name: chain,
+			})
+			tx.Delete(&knftables.Chain{
+				Name: chain,
+			})
+		}
+	}
+
+	return nil
+}
+
+// createConntrackZoneChain creates the chain setting the conntrack zone of the packets before they are tracked
+func createConntrackZoneChain(tx *knftables.Transaction, chainName string, hook knftables.BaseChainHook, interfaceMatch string, zones []string) {
+	tx.Add(&knftables.Chain{
+		Name:     chainName,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(hook),
+		Priority: knftables.PtrTo(knftables.RawPriority),
+		Comment:  knftables.PtrTo("Conntrack zones"),
+	})
+
+	// Flush the chain to apply the zones of the current interfaces
+	tx.Flush(&knftables.Chain{
+		Name: chainName,
+	})
+
+	if len(zones) == 0 {
+		return
+	}
+
+	tx.Add(&knftables.Rule{
+		Chain:   chainName,
+		Rule:    knftables.Concat("ct zone set", interfaceMatch, "map", "{", strings.Join(zones, ", "), "}"),
+		Comment: knftables.PtrTo(conntrackZoneRuleComment),
+	})
+}
+
+// conntrackZones returns the zone of each interface as `"<interface>" : <zone>`, the zones are numbered from 1
+// in the order of the interface names so that an interface keeps its zone across the applies
+func conntrackZones(interfaces []Interface) []string {
+	var names []string
+	for _, intf := range interfaces {
+		if !slices.Contains(names, intf.Name) {
+			names = append(names, intf.Name)
+		}
+	}
+	slices.Sort(names)
+
+	zones := make([]string, 0, len(names))
+	for i, name := range names {
+		zones = append(zones, fmt.Sprintf("%q : %d", name, i+1))
+	}
+
+	return zones
+}
@@ -0,0 +1,122 @@
+package nftables
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// conntrackTimeout is a ct timeout object of the timeouts of a protocol. It is named after its timeouts, so that the
+// networks with the same timeouts share it and a change of the timeouts adds a new object.
+type conntrackTimeout struct {
+	name     string
+	protocol string
+	// policy is the timeouts of the object, as nft state: seconds pairs
+	policy string
+}
+
+// newConntrackTimeout returns the ct timeout object of the timeouts of a protocol
+func newConntrackTimeout(protocol string, timeouts datastore.ConntrackTimeouts) conntrackTimeout {
+	var entries []string
+	for _, state := range timeouts.States(protocol) {
+		entries = append(entries, fmt.Sprintf("%s: %d", state, timeouts[protocol][state]))
+	}
+	policy := strings.Join(entries, ", ")
+
+	hash := sha256.Sum256([]byte(protocol + " " + policy))
+
+	return conntrackTimeout{
+		name:     fmt.Sprintf("ct-timeout-%s-%s", protocol, hex.EncodeToString(hash[:])[:8]),
+		protocol: protocol,
+		policy:   policy,
+	}
+}
+
+// conntrackTimeoutCreator is implemented by the nftables clients able to create the ct timeout objects, which are not
+// supported by the transactions
+type conntrackTimeoutCreator interface {
+	AddConntrackTimeouts(ctx context.Context, timeouts []conntrackTimeout) error
+}
+
+// createConntrackTimeoutRules assigns the ct timeout objects of the networks overriding the conntrack timeouts to the
+// new connections of their interfaces, in both directions. The chains run after the connection tracking, while the
+// connections are not confirmed yet. It returns the objects the rules refer to, which must exist before the
+// transaction runs.
+func createConntrackTimeoutRules(tx *knftables.Transaction, matchedInterfaces []Interface, policy *datastore.Policy, logger logr.Logger) []conntrackTimeout {
+	// The interfaces of each object, in the order of the interfaces
+	var timeouts []conntrackTimeout
+	names := make(map[string][]string)
+	for _, intf := range matchedInterfaces {
+		networkTimeouts := policy.ConntrackTimeouts[intf.Network]
+		for _, protocol := range []string{"tcp", "udp", "sctp"} {
+			if len(networkTimeouts[protocol]) == 0 {
+				continue
+			}
+
+			timeout := newConntrackTimeout(protocol, networkTimeouts)
+			if !slices.Contains(timeouts, timeout) {
+				timeouts = append(timeouts, timeout)
+			}
+			if !slices.Contains(names[timeout.name], intf.Name) {
+				names[timeout.name] = append(names[timeout.name], intf.Name)
+			}
+		}
+	}
+
+	if len(timeouts) == 0 {
+		return nil
+	}
+
+	logger.V(1).Info("Creating conntrack timeout rules", "timeouts", names)
+	for _, c := range []struct {
+		name      string
+		hook      knftables.BaseChainHook
+		direction string
+	}{
+		{name: conntrackTimeoutPreroutingChain, hook: knftables.PreroutingHook, direction: "iifname"},
+		{name: conntrackTimeoutOutputChain, hook: knftables.OutputHook, direction: "oifname"},
+	} {
+		tx.Add(&knftables.Chain{
+			Name:     c.name,
+			Type:     knftables.PtrTo(knftables.FilterType),
+			Hook:     knftables.PtrTo(c.hook),
+			Priority: knftables.PtrTo(knftables.ManglePriority),
+			Comment:  knftables.PtrTo("Conntrack timeouts"),
+		})
+
+		for _, timeout := range timeouts {
+			tx.Add(&knftables.Rule{
+				Chain: c.name,
+				Rule: knftables.Concat(
+					c.direction, "{", strings.Join(names[timeout.name], ", "), "}",
+					"meta l4proto", timeout.protocol, "ct state new",
+					"ct timeout set", fmt.Sprintf("%q", timeout.name),
+				),
+				Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)),
+			})
+		}
+	}
+
+	return timeouts
+}
+
+// conntrackTimeoutsScript returns the nft script adding the ct timeout objects to the table. Adding an existing object
+// leaves it unchanged, which the names derived from the timeouts make safe.
+func conntrackTimeoutsScript(table string, timeouts []conntrackTimeout) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s %s\n", knftables.InetFamily, table)
+	for _, timeout := range timeouts {
+		fmt.Fprintf(&b, "add ct timeout %s %s %s { protocol %s ; policy = { %s } ; }\n",
+			knftables.InetFamily, table, timeout.name, timeout.protocol, timeout.policy)
+	}
+
+	return b.String()
+}
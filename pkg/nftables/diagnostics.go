@@ -0,0 +1,200 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// debugVerbosity is the verbosity of the render diagnostics, the decisions of the peer resolution and the rulesets
+// rendered for each enforcement
+const debugVerbosity = 2
+
+// peerMatch is a pod matched by the selectors of a peer, with the labels of the pod and its namespace they matched
+type peerMatch struct {
+	Pod             string            `json:"pod"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"`
+}
+
+// peerAddresses are the secondary interfaces of a peer pod, with why the addresses of an interface are not allowed
+type peerAddresses struct {
+	Pod        string          `json:"pod"`
+	Interfaces []peerInterface `json:"interfaces"`
+}
+
+type peerInterface struct {
+	Name    string   `json:"name"`
+	Network string   `json:"network"`
+	IPs     []string `json:"ips,omitempty"`
+	// Ignored is why the addresses of the interface are not allowed, empty when they are
+	Ignored string `json:"ignored,omitempty"`
+}
+
+// logPeerResolution logs at debug verbosity what a peer of a rule resolved to: the namespaces and the pods its
+// selectors matched, and the pods matching the selectors that are not peers, with why
+func (n *NFTables) logPeerResolution(ctx context.Context, logger logr.Logger, index int, peer datastore.Peer, policyNamespace string, namespaces []corev1.Namespace, pods []datastore.PodInfo) {
+	debug := logger.V(debugVerbosity)
+	if !debug.Enabled() {
+		return
+	}
+
+	if peer.IPBlock != nil {
+		debug.Info("Peer resolved", "peer", index, "cidr", peer.IPBlock.CIDR, "except", peer.IPBlock.Except)
+		return
+	}
+
+	keysAndValues := []any{"peer", index}
+
+	// The labels of the namespaces are only looked up for the diagnostics, the resolved pods do not hold them
+	searched := []string{policyNamespace}
+	namespaceLabels := make(map[string]map[string]string)
+	if peer.NamespaceSelector != nil {
+		searched = nil
+		for _, ns := range namespaces {
+			searched = append(searched, ns.Name)
+			namespaceLabels[ns.Name] = ns.Labels
+		}
+		keysAndValues = append(keysAndValues, "namespaceSelector", metav1.FormatLabelSelector(peer.NamespaceSelector), "namespaces", searched)
+	} else {
+		ns := &corev1.Namespace{}
+		if err := n.Client.Get(ctx, types.NamespacedName{Name: policyNamespace}, ns); err == nil {
+			namespaceLabels[policyNamespace] = ns.Labels
+		}
+	}
+
+	podSelector := &metav1.LabelSelector{}
+	if peer.PodSelector != nil {
+		podSelector = peer.PodSelector
+		keysAndValues = append(keysAndValues, "podSelector", metav1.FormatLabelSelector(peer.PodSelector))
+	}
+
+	matches := make([]peerMatch, 0, len(pods))
+	for _, pod := range pods {
+		matches = append(matches, peerMatch{Pod: pod.Namespace + "/" + pod.Name, Labels: pod.Labels, NamespaceLabels: namespaceLabels[pod.Namespace]})
+	}
+	slices.SortFunc(matches, func(a, b peerMatch) int { return strings.Compare(a.Pod, b.Pod) })
+	keysAndValues = append(keysAndValues, "pods", matches)
+
+	if excluded := n.excludedPeerPods(ctx, podSelector, searched); len(excluded) > 0 {
+		keysAndValues = append(keysAndValues, "excluded", excluded)
+	}
+
+	debug.Info("Peer resolved", keysAndValues...)
+}
+
+// excludedPeerPods returns the pods of the namespaces matching a pod selector that cannot be peers, with why: only the
+// running pods with secondary networks outside of the host network namespace are peers
+func (n *NFTables) excludedPeerPods(ctx context.Context, selector *metav1.LabelSelector, namespaces []string) map[string]string {
+	podSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil
+	}
+
+	excluded := make(map[string]string)
+	for _, namespace := range namespaces {
+		pods := &corev1.PodList{}
+		if err := n.Client.List(ctx, pods, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: podSelector}); err != nil {
+			continue
+		}
+
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+
+			var reason string
+			switch networks, err := netdefutils.ParsePodNetworkAnnotation(pod); {
+			case pod.Status.Phase != corev1.PodRunning:
+				reason = fmt.Sprintf("pod is %s", pod.Status.Phase)
+			case pod.Spec.HostNetwork:
+				reason = "pod is in the host network namespace"
+			case err != nil || len(networks) == 0:
+				reason = "pod has no secondary networks"
+			default:
+				continue
+			}
+
+			excluded[pod.Namespace+"/"+pod.Name] = reason
+		}
+	}
+
+	return excluded
+}
+
+// logPeerAddresses logs at debug verbosity the interfaces of the peer pods of a rule whose addresses are allowed, and
+// why the addresses of the others are not
+func logPeerAddresses(logger logr.Logger, pods []datastore.PodInfo, policy *datastore.Policy) {
+	debug := logger.V(debugVerbosity)
+	if !debug.Enabled() || len(pods) == 0 {
+		return
+	}
+
+	addresses := make([]peerAddresses, 0, len(pods))
+	for _, pod := range pods {
+		peer := peerAddresses{Pod: pod.Namespace + "/" + pod.Name}
+		for _, intf := range pod.Interfaces {
+			peerIntf := peerInterface{Name: intf.Name, Network: intf.Network, IPs: intf.IPs}
+			switch {
+			case !slices.Contains(policy.Networks, intf.Network) && !matchesPeerNetworks(intf.Network, policy.PeerNetworks):
+				peerIntf.Ignored = "network is not a network nor a peer network of the policy"
+			case len(intf.IPs) == 0:
+				peerIntf.Ignored = "interface has no addresses in the network status"
+			}
+			peer.Interfaces = append(peer.Interfaces, peerIntf)
+		}
+		addresses = append(addresses, peer)
+	}
+	slices.SortFunc(addresses, func(a, b peerAddresses) int { return strings.Compare(a.Pod, b.Pod) })
+
+	debug.Info("Peer addresses", "pods", addresses)
+}
+
+// logRenderedRuleset logs at debug verbosity the rules by chain and the elements by set rendered in a transaction
+func logRenderedRuleset(logger logr.Logger, tx *knftables.Transaction) {
+	debug := logger.V(debugVerbosity)
+	if !debug.Enabled() {
+		return
+	}
+
+	chains, sets := renderedRuleset(tx)
+	debug.Info("Rendered ruleset", "chains", chains, "sets", sets)
+}
+
+// renderedRuleset returns the rules by chain and the elements by set added by a transaction
+func renderedRuleset(tx *knftables.Transaction) (map[string][]string, map[string][]string) {
+	chains := make(map[string][]string)
+	sets := make(map[string][]string)
+
+	for _, line := range strings.Split(tx.String(), "\n") {
+		// Every operation is written as "<verb> <object> <family> <table> <name> ..."
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+
+		verb, object, name, rest := fields[0], fields[1], fields[4], fields[5]
+
+		switch {
+		case (verb == "add" || verb == "insert") && object == "rule":
+			if handle, ok := strings.CutPrefix(rest, "handle "); ok {
+				_, rest, _ = strings.Cut(handle, " ")
+			}
+			chains[name] = append(chains[name], rest)
+		case verb == "add" && object == "element":
+			elements := strings.TrimSuffix(strings.TrimPrefix(rest, "{ "), " }")
+			sets[name] = append(sets[name], strings.Split(elements, ", ")...)
+		}
+	}
+
+	return chains, sets
+}
@@ -0,0 +1,133 @@
+package nftables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// PolicyDiff summarizes the changes a version of a policy would cause to the rules of the pods of the node
+type PolicyDiff struct {
+	// Node is the node of the pods
+	Node string
+	// Pods is the number of pods whose rules would change
+	Pods int
+	// RulesAdded and RulesRemoved are the numbers of rules added and removed across the pods
+	RulesAdded   int
+	RulesRemoved int
+	// Rejected is the number of pods whose ruleset would exceed the size limits and would not be applied
+	Rejected int
+}
+
+// String returns the summary of the changes
+func (d *PolicyDiff) String() string {
+	summary := fmt.Sprintf("%d pods affected, %d rules added, %d rules removed", d.Pods, d.RulesAdded, d.RulesRemoved)
+	if d.Rejected > 0 {
+		summary += fmt.Sprintf(", %d pods over the ruleset size limits", d.Rejected)
+	}
+
+	return summary
+}
+
+// DiffPolicy computes the changes a policy would cause to the rules of the pods of the node, against the previous
+// version of the policy or against no policy when it is nil, without applying them. Both versions are rendered, the
+// rules applied to the pods are not read.
+func (n *NFTables) DiffPolicy(ctx context.Context, policy *datastore.Policy, previous *datastore.Policy, logger logr.Logger) (*PolicyDiff, error) {
+	pods, err := n.listNodePods(ctx, policy.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// The excluded pods are not affected by the policies
+	targets, _, err := n.excludePods(ctx, policy.Namespace, pods.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	// The peers are resolved once for all the pods
+	ctx = withPeerSets(ctx)
+
+	diff := &PolicyDiff{Node: n.Hostname}
+	for _, pod := range targets {
+		interfaces := GetInterfaces(&pod)
+		if len(interfaces) == 0 {
+			continue
+		}
+
+		rules, err := n.renderRules(ctx, &pod, interfaces, policy)
+		var sizeError *RulesetSizeError
+		if errors.As(err, &sizeError) {
+			logger.V(1).Info("Ruleset of the pod would exceed the size limits", "pod", pod.Name, "error", err)
+			diff.Rejected++
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to render policy for pod %s/%s: %w", pod.Namespace, pod.Name, err)
+		}
+
+		var previousRules []string
+		if previous != nil {
+			// The previous version was applied, its size was checked then
+			previousRules, err = n.renderRules(ctx, &pod, interfaces, previous)
+			if err != nil && !errors.As(err, &sizeError) {
+				return nil, fmt.Errorf("failed to render previous policy for pod %s/%s: %w", pod.Namespace, pod.Name, err)
+			}
+		}
+
+		added, removed := diffRules(previousRules, rules)
+		if added > 0 || removed > 0 {
+			diff.Pods++
+			diff.RulesAdded += added
+			diff.RulesRemoved += removed
+		}
+	}
+
+	return diff, nil
+}
+
+// renderRules renders a policy for a pod in an empty table and returns its rules
+func (n *NFTables) renderRules(ctx context.Context, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy) ([]string, error) {
+	nft := knftables.NewFake(knftables.InetFamily, tableName)
+	if _, err := n.applyPolicy(ctx, nft, pod, interfaces, policy, logr.Discard()); err != nil {
+		return nil, err
+	}
+
+	var rules []string
+	for _, line := range strings.Split(nft.Dump(), "\n") {
+		if strings.HasPrefix(line, "add rule ") {
+			rules = append(rules, line)
+		}
+	}
+
+	return rules, nil
+}
+
+// diffRules returns the numbers of rules of the new rules missing from the old ones, and of the old rules missing from
+// the new ones
+func diffRules(oldRules []string, newRules []string) (added int, removed int) {
+	counts := make(map[string]int, len(oldRules))
+	for _, rule := range oldRules {
+		counts[rule]++
+	}
+
+	for _, rule := range newRules {
+		if counts[rule] > 0 {
+			counts[rule]--
+		} else {
+			added++
+		}
+	}
+
+	for _, count := range counts {
+		removed += count
+	}
+
+	return added, removed
+}
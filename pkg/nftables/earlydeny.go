@@ -0,0 +1,263 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+const (
+	// earlyDenySet holds the interfaces denied until the policies selecting them are applied
+	earlyDenySet = "early-deny"
+
+	earlyDenyInputChain  = "early-deny-input"
+	earlyDenyOutputChain = "early-deny-output"
+)
+
+// netnsLocks serialize the early default-deny of a pod, which is only installed in the network namespaces without a
+// table, with the enforcement of the policies creating the tables in the same network namespace. The locks are keyed
+// by the network namespace path and forgotten once they are released by all their holders.
+type netnsLocks struct {
+	mu    sync.Mutex
+	locks map[string]*netnsLock
+}
+
+type netnsLock struct {
+	sync.RWMutex
+	holders int
+}
+
+// lock locks the network namespace, exclusively to install the early deny or shared to enforce the policies, and
+// returns the function unlocking it
+func (l *netnsLocks) lock(netnsPath string, exclusive bool) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*netnsLock)
+	}
+	lock, ok := l.locks[netnsPath]
+	if !ok {
+		lock = &netnsLock{}
+		l.locks[netnsPath] = lock
+	}
+	lock.holders++
+	l.mu.Unlock()
+
+	if exclusive {
+		lock.Lock()
+	} else {
+		lock.RLock()
+	}
+
+	return func() {
+		if exclusive {
+			lock.Unlock()
+		} else {
+			lock.RUnlock()
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		lock.holders--
+		if lock.holders == 0 {
+			delete(l.locks, netnsPath)
+		}
+	}
+}
+
+// EnforceEarlyDeny denies the traffic of the interfaces of a pod selected by the policies as soon as the interfaces
+// exist, before the policies are computed and applied to the pod. It is only installed in the network namespaces
+// without a table, and each interface is allowed again by the first policy applied to it, or as soon as no policy
+// selecting the pod applies to it. In the network namespaces with a table, the denied interfaces are reconciled with
+// the policies. It needs the nftables enforcer, the pods are not denied with another enforcer.
+func (n *NFTables) EnforceEarlyDeny(ctx context.Context, pod *corev1.Pod, policies []*datastore.Policy, logger logr.Logger) error {
+	if n.Enforcer != nil {
+		return nil
+	}
+
+	excluded, err := n.podExclusion(ctx, pod.Namespace)
+	if err != nil {
+		return err
+	}
+	if excluded != nil && excluded(pod) {
+		logger.V(1).Info("Pod excluded from the policies, skipping early deny")
+		return nil
+	}
+
+	names := earlyDenyInterfaces(pod, GetInterfaces(pod), policies, types.NamespacedName{})
+
+	release, err := n.acquireNetNS(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	netnsPath, err := n.enforcer().Sandbox(ctx, pod)
+	if err != nil {
+		return fmt.Errorf("failed to get network namespace path: %w", err)
+	}
+
+	defer n.netnsLocks.lock(netnsPath, true)()
+
+	return n.withNetNS(ctx, netnsPath, func(ctx context.Context) error {
+		nft, err := newNetNSNFTables(ctx, n.Exec, n.Applier, tableName)
+		if err != nil {
+			return fmt.Errorf("failed to create nftables client: %w", err)
+		}
+
+		return createEarlyDeny(ctx, nft, names, logger)
+	})
+}
+
+// earlyDenyInterfaces returns the interfaces of a pod the policies selecting it apply to, but the excluded policy
+func earlyDenyInterfaces(pod *corev1.Pod, interfaces []Interface, policies []*datastore.Policy, excluded types.NamespacedName) []string {
+	var names []string
+	for _, policy := range policies {
+		if policy.Namespace != pod.Namespace || (policy.Namespace == excluded.Namespace && policy.Name == excluded.Name) ||
+			!utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels) {
+			continue
+		}
+
+		for _, intf := range getPolicyInterfaces(interfaces, policy, pod) {
+			if !slices.Contains(names, intf.Name) {
+				names = append(names, intf.Name)
+			}
+		}
+	}
+
+	return names
+}
+
+// pendingEarlyDeny returns the interfaces of a pod that stay denied when a policy is synced to it or cleaned up from
+// it: the interfaces the other policies selecting the pod apply to, which allow them when they are applied
+func (n *NFTables) pendingEarlyDeny(pod *corev1.Pod, interfaces []Interface, policy types.NamespacedName) []string {
+	if n.Policies == nil {
+		return nil
+	}
+
+	return earlyDenyInterfaces(pod, interfaces, n.Policies.ListPolicies(), policy)
+}
+
+// createEarlyDeny creates the table denying the traffic of the interfaces, unless the table already exists. The
+// interfaces denied in an existing table that are not in the interfaces are allowed again.
+func createEarlyDeny(ctx context.Context, nft knftables.Interface, names []string, logger logr.Logger) error {
+	version, err := getLayoutVersion(ctx, nft)
+	if err != nil {
+		return err
+	}
+
+	if version >= 0 {
+		tx := nft.NewTransaction()
+		if err := reconcileEarlyDeny(ctx, nft, tx, names, logger); err != nil {
+			return err
+		}
+		if tx.NumOperations() == 0 {
+			logger.V(1).Info("Table already exists, skipping early deny")
+			return nil
+		}
+
+		if err := nft.Run(ctx, tx); err != nil {
+			return fmt.Errorf("failed to run transaction: %w", err)
+		}
+		return nil
+	}
+
+	if len(names) == 0 {
+		logger.V(1).Info("No interfaces of the pod selected by the policies, skipping early deny")
+		return nil
+	}
+
+	logger.Info("Denying the traffic of the interfaces until the policies are applied", "interfaces", names)
+
+	tx := nft.NewTransaction()
+	tx.Add(&knftables.Table{
+		Comment: knftables.PtrTo("MultiNetworkPolicy"),
+	})
+	createLayoutChain(tx)
+
+	tx.Add(&knftables.Set{
+		Name:    earlyDenySet,
+		Type:    "ifname",
+		Comment: knftables.PtrTo("Interfaces denied until the policies are applied"),
+	})
+	for _, name := range names {
+		tx.Add(&knftables.Element{
+			Set: earlyDenySet,
+			Key: []string{name},
+		})
+	}
+
+	tx.Add(&knftables.Chain{
+		Name:     earlyDenyInputChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.InputHook),
+		Priority: knftables.PtrTo(knftables.FilterPriority),
+		Comment:  knftables.PtrTo("Early Deny"),
+	})
+	tx.Add(&knftables.Rule{
+		Chain:   earlyDenyInputChain,
+		Rule:    knftables.Concat("iifname", "@"+earlyDenySet, "drop"),
+		Comment: knftables.PtrTo("Early deny"),
+	})
+
+	tx.Add(&knftables.Chain{
+		Name:     earlyDenyOutputChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.OutputHook),
+		Priority: knftables.PtrTo(knftables.FilterPriority),
+		Comment:  knftables.PtrTo("Early Deny"),
+	})
+	tx.Add(&knftables.Rule{
+		Chain:   earlyDenyOutputChain,
+		Rule:    knftables.Concat("oifname", "@"+earlyDenySet, "drop"),
+		Comment: knftables.PtrTo("Early deny"),
+	})
+
+	if err := nft.Run(ctx, tx); err != nil {
+		return fmt.Errorf("failed to run transaction: %w", err)
+	}
+
+	return nil
+}
+
+type earlyDenyContextKey struct{}
+
+// withPendingEarlyDeny returns a context whose cleanups keep the interfaces denied, the cleanups of a context without
+// them allow all the interfaces
+func withPendingEarlyDeny(ctx context.Context, pending []string) context.Context {
+	return context.WithValue(ctx, earlyDenyContextKey{}, pending)
+}
+
+// reconcileEarlyDeny queues the removal of the interfaces from the early deny set, but the pending interfaces
+func reconcileEarlyDeny(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, pending []string, logger logr.Logger) error {
+	elements, err := nft.ListElements(ctx, "set", earlyDenySet)
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list early deny interfaces: %w", err)
+	}
+
+	for _, element := range elements {
+		if len(element.Key) == 1 && slices.Contains(pending, element.Key[0]) {
+			continue
+		}
+
+		logger.V(1).Info("Allowing early denied interface", "interface", element.Key)
+		tx.Delete(&knftables.Element{
+			Set: earlyDenySet,
+			Key: element.Key,
+		})
+	}
+
+	return nil
+}
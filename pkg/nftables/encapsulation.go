@@ -0,0 +1,164 @@
+package nftables
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// interfaceGroup is a group of the matched interfaces of a policy whose traffic has the same encapsulation, the rules
+// of the encapsulated traffic match the tunnel and the inner headers
+type interfaceGroup struct {
+	// encapsulation is the encapsulation of the traffic, empty for the plain traffic
+	encapsulation datastore.Encapsulation
+	interfaces    []Interface
+	// all is set when the group has all the matched interfaces, they are then matched by the managed interfaces set
+	all bool
+}
+
+// groupInterfacesByEncapsulation groups the interfaces by the encapsulation of their network, the interfaces of the
+// networks without encapsulation come first
+func groupInterfacesByEncapsulation(interfaces []Interface, encapsulations map[string]datastore.Encapsulation) []interfaceGroup {
+	groups := []interfaceGroup{{}}
+	for _, intf := range interfaces {
+		encapsulation := encapsulations[intf.Network]
+
+		i := slices.IndexFunc(groups, func(g interfaceGroup) bool {
+			return g.encapsulation == encapsulation
+		})
+		if i == -1 {
+			groups = append(groups, interfaceGroup{encapsulation: encapsulation})
+			i = len(groups) - 1
+		}
+
+		groups[i].interfaces = append(groups[i].interfaces, intf)
+	}
+
+	if len(groups[0].interfaces) == 0 {
+		groups = groups[1:]
+	}
+
+	if len(groups) == 1 {
+		groups[0].all = true
+	}
+
+	return groups
+}
+
+// interfaceMatch returns the match of the traffic of an interface of the group, as iifname or oifname
+func (g *interfaceGroup) interfaceMatch(direction string, name string) string {
+	return g.tunnelMatch(knftables.Concat(direction, name))
+}
+
+// interfacesMatch returns the match of the traffic of all the interfaces of the group, as iifname or oifname
+func (g *interfaceGroup) interfacesMatch(direction string, hashName string) string {
+	if g.all {
+		return g.tunnelMatch(knftables.Concat(direction, fmt.Sprintf("@%s%s", prefixManagedInterfacesSet, hashName)))
+	}
+
+	return g.interfaceNamesMatch(direction)
+}
+
+// tunnelMatch appends the match of the tunnel to the match of the interfaces, for the encapsulated traffic
+func (g *interfaceGroup) tunnelMatch(match string) string {
+	if g.encapsulation == "" {
+		return match
+	}
+
+	return knftables.Concat(match, "udp", "dport", g.encapsulation.Port())
+}
+
+// header returns the expression of a header, e.g. ip, of the inner headers for the encapsulated traffic
+func (g *interfaceGroup) header(header string) string {
+	return innerHeader(g.encapsulation, header)
+}
+
+// portRuleSections returns the port rule sections of a rule, the compiled ones for the plain traffic and the ones
+// matching the inner transport header for the encapsulated traffic
+func (g *interfaceGroup) portRuleSections(compiled []string, ports []datastore.Port) []string {
+	if g.encapsulation == "" {
+		return compiled
+	}
+
+	return getInnerPortRuleSections(ports, g.encapsulation)
+}
+
+// innerHeader returns the expression of a header, e.g. ip, of the inner headers of the encapsulated traffic, or of the
+// headers when the encapsulation is empty
+func innerHeader(encapsulation datastore.Encapsulation, header string) string {
+	if encapsulation == "" {
+		return header
+	}
+
+	return knftables.Concat(string(encapsulation), header)
+}
+
+// getInnerPortRuleSections gets the port rule sections matching the inner transport header of the encapsulated traffic.
+// The inner headers have no meta expression, so all the ports of a protocol are matched by the full range of ports.
+func getInnerPortRuleSections(ports []datastore.Port, encapsulation datastore.Encapsulation) []string {
+	var portRuleSections []string
+	for _, p := range normalizePorts(ports) {
+		elements := p.elements
+		if p.all {
+			elements = []string{"0-65535"}
+		}
+
+		portRuleSections = append(portRuleSections, knftables.Concat(innerHeader(encapsulation, p.protocol), "dport", "{", strings.Join(elements, ","), "}", "accept"))
+	}
+
+	return portRuleSections
+}
+
+// createNotrackRules stops tracking the tunnels of the encapsulated interfaces of the policy. An established tunnel
+// would otherwise accept all its inner traffic, the inner traffic is instead matched by the rules on every packet.
+func createNotrackRules(tx *knftables.Transaction, groups []interfaceGroup, policy *datastore.Policy, egress bool, logger logr.Logger) {
+	chainName := notrackPreroutingChain
+	hook := knftables.PreroutingHook
+	direction := "iifname"
+	if egress {
+		chainName = notrackOutputChain
+		hook = knftables.OutputHook
+		direction = "oifname"
+	}
+
+	for _, g := range groups {
+		if g.encapsulation == "" {
+			continue
+		}
+
+		logger.V(1).Info("Creating notrack rule of the encapsulated interfaces", "chain", chainName, "encapsulation", g.encapsulation)
+		tx.Add(&knftables.Chain{
+			Name:     chainName,
+			Type:     knftables.PtrTo(knftables.FilterType),
+			Hook:     knftables.PtrTo(hook),
+			Priority: knftables.PtrTo(knftables.RawPriority),
+			Comment:  knftables.PtrTo("Encapsulated traffic"),
+		})
+
+		tx.Add(&knftables.Rule{
+			Chain:   chainName,
+			Rule:    knftables.Concat(g.interfaceNamesMatch(direction), "notrack"),
+			Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)),
+		})
+	}
+}
+
+// interfaceNamesMatch returns the match of the traffic of all the interfaces of the group by name, as iifname or oifname
+func (g *interfaceGroup) interfaceNamesMatch(direction string) string {
+	return g.tunnelMatch(knftables.Concat(direction, "{", strings.Join(interfaceNames(g.interfaces), ", "), "}"))
+}
+
+// interfaceNames returns the names of the interfaces
+func interfaceNames(interfaces []Interface) []string {
+	names := make([]string, 0, len(interfaces))
+	for _, intf := range interfaces {
+		names = append(names, intf.Name)
+	}
+
+	return names
+}
@@ -1,20 +1,26 @@
 package nftables
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
-	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/knftables"
 
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
 )
 
@@ -22,27 +28,116 @@ import (
 func (n *NFTables) enforcePolicy(ctx context.Context, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy, logger logr.Logger) error {
 	logger.Info("Applying policy")
 
-	nft, err := knftables.New(knftables.InetFamily, tableName)
+	nft, err := newNetNSNFTables(ctx, n.Exec, n.Applier, tableName)
 	if err != nil {
 		return fmt.Errorf("failed to create nftables client: %w", err)
 	}
 
-	// Clean up the policy even if the pod is not matched by the policy
-	err = cleanUp(ctx, nft, policy.Name, policy.Namespace, logger)
+	attempts := 1
+	if n.VerifyRuleset {
+		attempts += n.VerifyRetries
+	}
+
+	// The peer resolution and the nft operations are timed apart from the rendering they are nested in
+	ctx, timer := withStageTimer(ctx)
+	timed := &timedNFTables{Interface: nft, timer: timer}
+
+	var desired *desiredState
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		desired, err = n.applyPolicy(ctx, timed, pod, interfaces, policy, logger)
+		total := time.Since(start)
+		exec, peers := timer.reset(stageNFTExec), timer.reset(stagePeerResolution)
+		observeStage(stageNFTExec, exec)
+		if peers > 0 {
+			observeStage(stagePeerResolution, peers)
+		}
+		observeStage(stageRender, total-exec-peers)
+		if err != nil {
+			return err
+		}
+
+		elements := 0
+		if desired != nil {
+			elements = desired.elements()
+		}
+		n.setElements.set(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}, types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, elements)
+
+		if desired == nil || !n.VerifyRuleset {
+			break
+		}
+
+		// List the applied ruleset back to catch partial applies that nft did not report
+		start = time.Now()
+		err = verifyPolicy(ctx, nft, desired)
+		observeStage(stageVerify, time.Since(start))
+		if err == nil {
+			break
+		}
+
+		var verificationError *VerificationError
+		if !errors.As(err, &verificationError) {
+			return err
+		}
+
+		metrics.RulesetVerificationMismatches.Inc()
+		logger.Info("Applied ruleset does not match desired state", "attempt", attempt, "mismatches", verificationError.Mismatches)
+
+		if attempt >= attempts {
+			metrics.RulesetVerificationFailures.Inc()
+			n.recordEvent(pod, corev1.EventTypeWarning, "RulesetVerificationFailed",
+				"Ruleset of policy %s/%s does not match desired state after %d attempts: %v", policy.Namespace, policy.Name, attempt, err)
+			return fmt.Errorf("failed to verify policy: %w", err)
+		}
+
+		n.recordEvent(pod, corev1.EventTypeWarning, "RulesetMismatch",
+			"Ruleset of policy %s/%s does not match desired state, retrying (attempt %d/%d): %v", policy.Namespace, policy.Name, attempt, attempts, err)
+	}
+
+	// The stateless rules are reported once the policy is applied, not on each attempt
+	if desired != nil {
+		n.reportStatelessRules(pod, policy)
+	}
+
+	return nil
+}
+
+// applyPolicy cleans up and applies the policy rules for a pod, it returns the desired state of the applied rules
+// or nil when no rules were applied
+func (n *NFTables) applyPolicy(ctx context.Context, nft knftables.Interface, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy, logger logr.Logger) (*desiredState, error) {
+	// The cleanup, the basic structure, the conntrack zones and the rules of all the matched interfaces of the pod are
+	// applied in a single transaction, which spawns nft once per pod and is atomic
+	tx := nft.NewTransaction()
+
+	// A table of an older layout version is migrated in the same transaction, or emptied with the objects of the policy
+	replaced, err := migrateLayout(ctx, nft, tx, logger)
 	if err != nil {
-		return fmt.Errorf("failed to clean up policy: %w", err)
+		return nil, fmt.Errorf("failed to migrate table layout: %w", err)
 	}
 
+	// Clean up the policy even if the pod is not matched by the policy
+	if !replaced {
+		err = deletePolicyObjects(ctx, nft, tx, policy.Name, policy.Namespace, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to clean up policy: %w", err)
+		}
+	}
+
+	// The interfaces denied until a policy is applied to them stay denied for the other policies selecting the pod
+	policyKey := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+	pending := n.pendingEarlyDeny(pod, interfaces, policyKey)
+
 	if !utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels) {
 		logger.Info("Pod not matched by policy pod selector, skipping")
-		return nil
+		return nil, runUnmatchedCleanUp(ctx, nft, tx, pending, replaced, logger)
 	}
 
 	// Find the interfaces on the pod that belong to the networks of the policy (Policy-for annotation)
-	matchedInterfaces := getMatchedInterfaces(interfaces, policy.Networks)
+	// and, when the interfaces annotations of the policy or the pod are set, that they name, with their groups
+	matchedInterfaces := getPolicyInterfaces(interfaces, policy, pod)
 	if len(matchedInterfaces) == 0 {
 		logger.Info("No matched interfaces found, skipping", "policyNetworks", policy.Networks, "interfaces", interfaces)
-		return nil
+		return nil, runUnmatchedCleanUp(ctx, nft, tx, pending, replaced, logger)
 	}
 
 	logger.Info("Found interfaces matched by policy", "matchedInterfaces", matchedInterfaces)
@@ -50,41 +145,97 @@ func (n *NFTables) enforcePolicy(ctx context.Context, pod *corev1.Pod, interface
 	// It creates the input, output chains and the common-ingress and common-egress chains
 	// It also ensures the policy type structure for ingress and egress which is a connection tracking rule
 	// and a jump rule to the common-ingress and common-egress chains, and a drop rule at the end of the chain
-	err = ensureBasicStructure(ctx, nft, n.CommonRules, logger)
+	commonRules, err := n.getCommonRules().Render(pod, interfaces)
 	if err != nil {
-		return fmt.Errorf("failed to ensure basic structure: %w", err)
+		return nil, fmt.Errorf("failed to render common rules: %w", err)
 	}
 
-	// Get the first 16 characters of the SHA256 hash of the namespace name of the policy to be used as nft object identifier
-	hashName := utils.GetHashName(policy.Name, policy.Namespace)
+	if extraRules, enabled := n.podExtraRules(pod, interfaces); enabled {
+		commonRules = commonRules.withExtraRules(extraRules)
+	}
 
-	// We will apply all generated rules in a single transaction
-	tx := nft.NewTransaction()
+	// The marks of the connections cannot be set or matched without the connection tracking
+	if n.Conntrack.Unavailable {
+		commonRules = commonRules.withoutConntrack()
+	}
+
+	defaultVerdictRules, err := createBasicStructure(ctx, nft, tx, commonRules, n.Conntrack.Unavailable, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure basic structure: %w", err)
+	}
+
+	err = createConntrackZones(ctx, nft, tx, interfaces, n.ConntrackZones && !n.Conntrack.Unavailable, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure conntrack zones: %w", err)
+	}
+
+	// Get the hash of the namespace name and the UID of the policy to be used as nft object identifier
+	hashName := utils.GetPolicyHashName(policy.Name, policy.Namespace, policy.UID)
 
 	// Create a set with the interfaces that are managed by the policy in the input and output chains
 	createManagedInterfacesSet(tx, matchedInterfaces, hashName, policy.Namespace, policy.Name, logger)
 
+	// The interfaces denied until a policy is applied to them are now enforced by the policy
+	if !replaced {
+		pending = slices.DeleteFunc(pending, func(name string) bool {
+			return slices.ContainsFunc(matchedInterfaces, func(intf Interface) bool { return intf.Name == name })
+		})
+		err = reconcileEarlyDeny(ctx, nft, tx, pending, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The ICMP redirects and router advertisements are dropped on the hardened networks whatever the policy types
+	createICMPHardeningRules(tx, matchedInterfaces, policy, logger)
+
+	if commonRules.dropIPv6ExtensionHeaders() {
+		createIPv6ExthdrRules(tx, hashName, policy, logger)
+	}
+
+	if commonRules.dropInvalidTCPFlags() {
+		createTCPFlagsRules(tx, hashName, policy, logger)
+	}
+
+	if synRateLimit := commonRules.synRateLimit(); synRateLimit != nil {
+		createSYNLimitRules(tx, matchedInterfaces, synRateLimit, policy, logger)
+	}
+
+	createFragmentRules(tx, matchedInterfaces, policy, logger)
+
+	var conntrackTimeouts []conntrackTimeout
+	if !n.Conntrack.Unavailable {
+		conntrackTimeouts = createConntrackTimeoutRules(tx, matchedInterfaces, policy, logger)
+	}
+
 	// Check if the policy has ingress or egress enabled
 	ingressEnabled, egressEnabled := checkPolicyTypes(policy)
 
 	logger.Info("Policy types", "ingressEnabled", ingressEnabled, "egressEnabled", egressEnabled)
 
-	mnpChainName := fmt.Sprintf("%s%s", prefixNetworkPolicyChain, hashName)
-
 	if ingressEnabled {
 		logger.V(1).Info("Enforcing ingress rules")
 
-		dispatcherRuleComment := fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)
-		createDispatcherRule(tx, hashName, inputChain, dispatcherRuleComment, logger)
+		createDispatchers(tx, matchedInterfaces, policy, hashName, inputChain, commonRules.acceptedMarks(), logger)
+		createNotrackRules(tx, groupInterfacesByEncapsulation(matchedInterfaces, policy.Encapsulations), policy, false, logger)
+
+		err = n.createLayoutPolicyChain(ctx, nft, tx, n.policyChain(hashName, policy, ingressChain), ingressChain, policy, replaced, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create policy chain: %w", err)
+		}
 
-		err = createPolicyChain(ctx, nft, tx, mnpChainName, ingressChain, policy.Namespace, policy.Name, logger)
+		err = createPolicyVerdictRule(ctx, nft, tx, hashName, ingressChain, policy, commonRules, logger)
 		if err != nil {
-			return fmt.Errorf("failed to create policy chain: %w", err)
+			return nil, fmt.Errorf("failed to create policy verdict rule: %w", err)
+		}
+
+		if commonRules.acceptSelfTraffic() {
+			createSelfTrafficRules(tx, interfaces, hashName, n.policyChain(hashName, policy, ingressChain), logger)
 		}
 
 		err = n.createIngressRules(ctx, tx, matchedInterfaces, policy, hashName, logger)
 		if err != nil {
-			return fmt.Errorf("failed to apply ingress rules: %w", err)
+			return nil, fmt.Errorf("failed to apply ingress rules: %w", err)
 		}
 
 		logger.Info("Ingress rules applied")
@@ -93,29 +244,85 @@ func (n *NFTables) enforcePolicy(ctx context.Context, pod *corev1.Pod, interface
 	if egressEnabled {
 		logger.V(1).Info("Enforcing egress rules")
 
-		dispatcherRuleComment := fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)
-		createDispatcherRule(tx, hashName, outputChain, dispatcherRuleComment, logger)
+		createDispatchers(tx, matchedInterfaces, policy, hashName, outputChain, commonRules.acceptedMarks(), logger)
+		createNotrackRules(tx, groupInterfacesByEncapsulation(matchedInterfaces, policy.Encapsulations), policy, true, logger)
 
-		err = createPolicyChain(ctx, nft, tx, mnpChainName, egressChain, policy.Namespace, policy.Name, logger)
+		err = n.createLayoutPolicyChain(ctx, nft, tx, n.policyChain(hashName, policy, egressChain), egressChain, policy, replaced, logger)
 		if err != nil {
-			return fmt.Errorf("failed to create policy chain: %w", err)
+			return nil, fmt.Errorf("failed to create policy chain: %w", err)
+		}
+
+		err = createPolicyVerdictRule(ctx, nft, tx, hashName, egressChain, policy, commonRules, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create policy verdict rule: %w", err)
 		}
 
 		err = n.createEgressRules(ctx, tx, matchedInterfaces, policy, hashName, logger)
 		if err != nil {
-			return fmt.Errorf("failed to apply egress rules: %w", err)
+			return nil, fmt.Errorf("failed to apply egress rules: %w", err)
 		}
 
 		logger.Info("Egress rules applied")
 	}
 
+	// The default verdict rules of the new policy type chains go after the policy rules
+	for _, rule := range defaultVerdictRules {
+		tx.Add(rule)
+	}
+
+	// A ruleset exceeding the limits is not applied at all rather than partially
+	desired := newDesiredState(tx, fmt.Sprintf("%s/%s", policy.Namespace, policy.Name))
+	err = n.checkRulesetSize(pod, policy, desired)
+	if err != nil {
+		return nil, err
+	}
+
 	if logger.V(1).Enabled() {
 		logger.V(1).Info("Applying nftables transaction", "transaction", tx.String())
 	}
+	logRenderedRuleset(logger, tx)
+
+	// The ct timeout objects the rules refer to are created first, outside of the transaction
+	if creator, ok := nft.(conntrackTimeoutCreator); ok && len(conntrackTimeouts) > 0 {
+		err = creator.AddConntrackTimeouts(ctx, conntrackTimeouts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create conntrack timeouts: %w", err)
+		}
+	}
 
 	err = nft.Run(ctx, tx)
 	if err != nil {
-		return fmt.Errorf("failed to run transaction: %w", err)
+		return nil, fmt.Errorf("failed to run transaction: %w", err)
+	}
+
+	return desired, nil
+}
+
+// runUnmatchedCleanUp runs the cleanup of a policy that does not apply to a pod, the interfaces of the pod denied until
+// a policy is applied to them are only kept denied for the other policies selecting the pod
+func runUnmatchedCleanUp(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, pending []string, replaced bool, logger logr.Logger) error {
+	if !replaced {
+		if err := reconcileEarlyDeny(ctx, nft, tx, pending, logger); err != nil {
+			return err
+		}
+	}
+
+	return runCleanUp(ctx, nft, tx, logger)
+}
+
+// runCleanUp runs the transaction of the cleanup of a policy, when it has anything to delete
+func runCleanUp(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, logger logr.Logger) error {
+	if tx.NumOperations() == 0 {
+		return nil
+	}
+
+	if logger.V(1).Enabled() {
+		logger.V(1).Info("Applying nftables cleanup transaction", "transaction", tx.String())
+	}
+
+	err := nft.Run(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("failed to clean up policy: failed to run transaction: %w", err)
 	}
 
 	return nil
@@ -123,13 +330,41 @@ func (n *NFTables) enforcePolicy(ctx context.Context, pod *corev1.Pod, interface
 
 // ensureBasicStructure ensures the basic NFTables structure
 func ensureBasicStructure(ctx context.Context, nft knftables.Interface, commonRules *CommonRules, logger logr.Logger) error {
-	logger.Info("Ensuring basic NFTables structure")
-
 	tx := nft.NewTransaction()
 
+	defaultVerdictRules, err := createBasicStructure(ctx, nft, tx, commonRules, false, logger)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range defaultVerdictRules {
+		tx.Add(rule)
+	}
+
+	if logger.V(1).Enabled() {
+		logger.V(1).Info("Applying nftables basic structure transaction", "transaction", tx.String())
+	}
+
+	err = nft.Run(ctx, tx)
+	if err != nil {
+		return fmt.Errorf("failed to run transaction: %w", err)
+	}
+
+	return nil
+}
+
+// createBasicStructure queues the basic NFTables structure in the transaction. It returns the default verdict rules
+// missing from the policy type chains, which must be added last so that the policy rules queued in the same
+// transaction are added before them.
+func createBasicStructure(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, commonRules *CommonRules, stateless bool, logger logr.Logger) ([]*knftables.Rule, error) {
+	logger.Info("Ensuring basic NFTables structure")
+
+	// The table is not owned (flags owner): the ownership ends with the netlink socket of the nft process applying
+	// the transaction, which exits right after it
 	tx.Add(&knftables.Table{
 		Comment: knftables.PtrTo("MultiNetworkPolicy"),
 	})
+	createLayoutChain(tx)
 
 	// Add the input chain
 	tx.Add(&knftables.Chain{
@@ -149,35 +384,40 @@ func ensureBasicStructure(ctx context.Context, nft knftables.Interface, commonRu
 		Comment:  knftables.PtrTo("Output Dispatcher"),
 	})
 
+	// The terminal chain is shared by ingress and egress, it must exist before the drop chains jump to it
+	if terminalChain := commonRules.terminalChain(); terminalChain != nil {
+		createTerminalChain(tx, terminalChain, logger)
+	}
+
+	var defaultVerdictRules []*knftables.Rule
+
 	// Ensure policy type structure for ingress
-	err := policyTypeStructure(ctx, nft, tx, ingressChain, "Ingress Policies", commonIngressChain, logger)
+	rule, err := policyTypeStructure(ctx, nft, tx, ingressChain, "Ingress Policies", commonIngressChain, ingressDropChain, ingressRejectChain, ingressLearnChain, commonRules, stateless, logger)
 	if err != nil {
-		return fmt.Errorf("failed to ensure policy type structure for ingress: %w", err)
+		return nil, fmt.Errorf("failed to ensure policy type structure for ingress: %w", err)
+	}
+	if rule != nil {
+		defaultVerdictRules = append(defaultVerdictRules, rule)
 	}
 
 	// Ensure policy type structure for egress
-	err = policyTypeStructure(ctx, nft, tx, egressChain, "Egress Policies", commonEgressChain, logger)
+	rule, err = policyTypeStructure(ctx, nft, tx, egressChain, "Egress Policies", commonEgressChain, egressDropChain, egressRejectChain, egressLearnChain, commonRules, stateless, logger)
 	if err != nil {
-		return fmt.Errorf("failed to ensure policy type structure for egress: %w", err)
+		return nil, fmt.Errorf("failed to ensure policy type structure for egress: %w", err)
+	}
+	if rule != nil {
+		defaultVerdictRules = append(defaultVerdictRules, rule)
 	}
 
 	// Create common rules
 	createCommonRules(tx, commonRules, logger)
 
-	if logger.V(1).Enabled() {
-		logger.V(1).Info("Applying nftables basic structure transaction", "transaction", tx.String())
-	}
-
-	err = nft.Run(ctx, tx)
-	if err != nil {
-		return fmt.Errorf("failed to run transaction: %w", err)
-	}
-
-	return nil
+	return defaultVerdictRules, nil
 }
 
-// policyTypeStructure ensures the basic NFTables structure for a policy type
-func policyTypeStructure(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, chainName string, chainComment string, commonChainName string, logger logr.Logger) error {
+// policyTypeStructure ensures the basic NFTables structure for a policy type, it returns the drop rule to add at the
+// end of the chain when it is missing
+func policyTypeStructure(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, chainName string, chainComment string, commonChainName string, dropChainName string, rejectChainName string, learnChainName string, commonRules *CommonRules, stateless bool, logger logr.Logger) (*knftables.Rule, error) {
 	// Add ingress objects
 	tx.Add(&knftables.Chain{
 		Name:    chainName,
@@ -189,13 +429,40 @@ func policyTypeStructure(ctx context.Context, nft knftables.Interface, tx *knfta
 		Comment: knftables.PtrTo("Common Policies"),
 	})
 
+	dropLogging := commonRules.dropLogging()
+	terminalChain := commonRules.terminalChain()
+	defaultVerdict := commonRules.defaultVerdict()
+
+	// The drop rule jumps to the drop chain when drop logging or the terminal chain is enabled,
+	// to the reject chain when rejecting and to the learn chain when learning
+	dropRuleVerdict := "drop"
+	if dropLogging != nil || terminalChain != nil {
+		createDropChain(tx, dropChainName, chainName, dropLogging, terminalChain, logger)
+		dropRuleVerdict = knftables.Concat("jump", dropChainName)
+	}
+
+	switch defaultVerdict {
+	case datastore.VerdictReject:
+		createRejectChain(tx, rejectChainName, chainName, dropLogging, terminalChain, logger)
+		dropRuleVerdict = knftables.Concat("jump", rejectChainName)
+	case datastore.VerdictLearn:
+		createLearnChain(tx, learnChainName, chainName, dropLogging, logger)
+		dropRuleVerdict = knftables.Concat("jump", learnChainName)
+	}
+
 	// Ensure connection tracking rule in chain
 	connectionTrackingRule, err := findRuleInChain(ctx, nft, chainName, connectionTrackingRuleComment)
 	if err != nil {
-		return fmt.Errorf("failed to find connection tracking rule in %s chain: %w", chainName, err)
+		return nil, fmt.Errorf("failed to find connection tracking rule in %s chain: %w", chainName, err)
 	}
 
-	if connectionTrackingRule == nil {
+	// Without the connection tracking, the rule never matches and the replies are accepted by symmetric rules
+	if stateless {
+		if connectionTrackingRule != nil {
+			logger.V(1).Info("Deleting connection tracking rule from chain", "chain", chainName)
+			tx.Delete(connectionTrackingRule)
+		}
+	} else if connectionTrackingRule == nil {
 		// First time we run, we need to add the connection tracking rule
 		logger.V(1).Info("Adding connection tracking rule to chain", "chain", chainName)
 		tx.Add(&knftables.Rule{
@@ -208,7 +475,7 @@ func policyTypeStructure(ctx context.Context, nft knftables.Interface, tx *knfta
 	// Ensure jump rule to common chain
 	jumpCommonRule, err := findRuleInChain(ctx, nft, chainName, jumpCommonRuleComment)
 	if err != nil {
-		return fmt.Errorf("failed to find jump rule to common in %s chain: %w", chainName, err)
+		return nil, fmt.Errorf("failed to find jump rule to common in %s chain: %w", chainName, err)
 	}
 
 	if jumpCommonRule == nil {
@@ -224,22 +491,231 @@ func policyTypeStructure(ctx context.Context, nft knftables.Interface, tx *knfta
 	// Ensure drop rule in chain
 	dropRule, err := findRuleInChain(ctx, nft, chainName, dropRuleComment)
 	if err != nil {
-		return fmt.Errorf("failed to find drop rule in %s chain: %w", chainName, err)
+		return nil, fmt.Errorf("failed to find drop rule in %s chain: %w", chainName, err)
 	}
 
 	if dropRule == nil {
 		// First time we run, we need to add the drop rule
 		logger.V(1).Info("Adding drop rule to chain", "chain", chainName)
-		tx.Add(&knftables.Rule{
+		return &knftables.Rule{
 			Chain:   chainName,
-			Rule:    knftables.Concat("drop"),
+			Rule:    dropRuleVerdict,
 			Comment: knftables.PtrTo(dropRuleComment),
+		}, nil
+	}
+
+	// The drop rule already exists, replace it in place when the drop, reject or learn chains are enabled or were enabled before
+	replaceDropRule := dropRuleVerdict != "drop"
+	if !replaceDropRule {
+		chains, err := nft.List(ctx, "chains")
+		if err != nil && !knftables.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to list chains: %w", err)
+		}
+
+		replaceDropRule = slices.Contains(chains, dropChainName) || slices.Contains(chains, rejectChainName) || slices.Contains(chains, learnChainName)
+	}
+
+	if replaceDropRule {
+		logger.V(1).Info("Replacing drop rule in chain", "chain", chainName, "rule", dropRuleVerdict)
+		tx.Replace(&knftables.Rule{
+			Chain:   chainName,
+			Rule:    dropRuleVerdict,
+			Comment: knftables.PtrTo(dropRuleComment),
+			Handle:  dropRule.Handle,
 		})
 	}
 
+	return nil, nil
+}
+
+// createDropChain creates the chain dropping the packets, after logging them at a limited rate when drop logging
+// is enabled and jumping to the terminal chain when it is enabled
+func createDropChain(tx *knftables.Transaction, dropChainName string, chainName string, dropLogging *DropLogging, terminalChain *TerminalChain, logger logr.Logger) {
+	logger.V(1).Info("Creating drop chain", "chain", dropChainName)
+
+	tx.Add(&knftables.Chain{
+		Name:    dropChainName,
+		Comment: knftables.PtrTo("Drop logging"),
+	})
+
+	// Flush the chain to apply a changed rate limit or terminal chain
+	tx.Flush(&knftables.Chain{
+		Name: dropChainName,
+	})
+
+	createDropLogRule(tx, dropChainName, fmt.Sprintf("%s%s drop: ", dropLogPrefix, chainName), dropLogging)
+	createJumpTerminalRule(tx, dropChainName, terminalChain)
+
+	tx.Add(&knftables.Rule{
+		Chain:   dropChainName,
+		Rule:    "drop",
+		Comment: knftables.PtrTo(dropRuleComment),
+	})
+}
+
+// createDropLogRule logs the packets at the drop logging rate, it does nothing when drop logging is disabled
+func createDropLogRule(tx *knftables.Transaction, chainName string, prefix string, dropLogging *DropLogging) {
+	if dropLogging == nil {
+		return
+	}
+
+	tx.Add(&knftables.Rule{
+		Chain: chainName,
+		Rule: knftables.Concat(
+			"limit rate", dropLogging.Rate, "burst", dropLogging.Burst, "packets",
+			"log prefix", fmt.Sprintf("%q", prefix),
+		),
+		Comment: knftables.PtrTo(dropLogRuleComment),
+	})
+}
+
+// createJumpTerminalRule jumps to the terminal chain, it does nothing when the terminal chain is disabled
+func createJumpTerminalRule(tx *knftables.Transaction, chainName string, terminalChain *TerminalChain) {
+	if terminalChain == nil {
+		return
+	}
+
+	tx.Add(&knftables.Rule{
+		Chain:   chainName,
+		Rule:    knftables.Concat("jump", terminalChain.Name),
+		Comment: knftables.PtrTo(jumpTerminalRuleComment),
+	})
+}
+
+// createTerminalChain creates the user-defined terminal chain with its rules. The denied packets returning from
+// the chain without a verdict get the default verdict.
+func createTerminalChain(tx *knftables.Transaction, terminalChain *TerminalChain, logger logr.Logger) {
+	logger.V(1).Info("Creating terminal chain", "chain", terminalChain.Name)
+
+	tx.Add(&knftables.Chain{
+		Name:    terminalChain.Name,
+		Comment: knftables.PtrTo("Terminal chain"),
+	})
+
+	// Flush the chain to ensure no stale rules
+	tx.Flush(&knftables.Chain{
+		Name: terminalChain.Name,
+	})
+
+	for _, rule := range terminalChain.Rules {
+		tx.Add(&knftables.Rule{
+			Chain:   terminalChain.Name,
+			Rule:    rule,
+			Comment: knftables.PtrTo(terminalRuleComment),
+		})
+	}
+}
+
+// createRejectChain creates the chain rejecting the packets with a TCP reset or an ICMP administratively prohibited
+// error, after logging them at a limited rate when drop logging is enabled and jumping to the terminal chain when
+// it is enabled
+func createRejectChain(tx *knftables.Transaction, rejectChainName string, chainName string, dropLogging *DropLogging, terminalChain *TerminalChain, logger logr.Logger) {
+	logger.V(1).Info("Creating reject chain", "chain", rejectChainName)
+
+	tx.Add(&knftables.Chain{
+		Name:    rejectChainName,
+		Comment: knftables.PtrTo("Reject"),
+	})
+
+	// Flush the chain to apply a changed drop logging
+	tx.Flush(&knftables.Chain{
+		Name: rejectChainName,
+	})
+
+	createDropLogRule(tx, rejectChainName, fmt.Sprintf("%s%s reject: ", dropLogPrefix, chainName), dropLogging)
+	createJumpTerminalRule(tx, rejectChainName, terminalChain)
+
+	tx.Add(&knftables.Rule{
+		Chain:   rejectChainName,
+		Rule:    "meta l4proto tcp reject with tcp reset",
+		Comment: knftables.PtrTo(rejectTCPRuleComment),
+	})
+
+	tx.Add(&knftables.Rule{
+		Chain:   rejectChainName,
+		Rule:    "reject with icmpx type admin-prohibited",
+		Comment: knftables.PtrTo(rejectRuleComment),
+	})
+}
+
+// createPolicyVerdictRule overrides the default verdict for the interfaces of the policy when the policy sets another
+// verdict. The rule is inserted with the policy rules, before the drop rule of the chain.
+func createPolicyVerdictRule(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, hashName string, policyTypeChainName string, policy *datastore.Policy, commonRules *CommonRules, logger logr.Logger) error {
+	if policy.Verdict == "" || policy.Verdict == commonRules.defaultVerdict() {
+		return nil
+	}
+
+	trafficDirection, dropChainName, rejectChainName, learnChainName := "iifname", ingressDropChain, ingressRejectChain, ingressLearnChain
+	if policyTypeChainName == egressChain {
+		trafficDirection, dropChainName, rejectChainName, learnChainName = "oifname", egressDropChain, egressRejectChain, egressLearnChain
+	}
+
+	dropLogging := commonRules.dropLogging()
+	terminalChain := commonRules.terminalChain()
+
+	verdict := "drop"
+	switch {
+	case policy.Verdict == datastore.VerdictReject:
+		createRejectChain(tx, rejectChainName, policyTypeChainName, dropLogging, terminalChain, logger)
+		verdict = knftables.Concat("jump", rejectChainName)
+	case policy.Verdict == datastore.VerdictLearn:
+		createLearnChain(tx, learnChainName, policyTypeChainName, dropLogging, logger)
+		verdict = knftables.Concat("jump", learnChainName)
+	case dropLogging != nil || terminalChain != nil:
+		createDropChain(tx, dropChainName, policyTypeChainName, dropLogging, terminalChain, logger)
+		verdict = knftables.Concat("jump", dropChainName)
+	}
+
+	logger.V(1).Info("Overriding default verdict", "chain", policyTypeChainName, "verdict", policy.Verdict)
+	return insertBeforeVerdicts(ctx, nft, tx, &knftables.Rule{
+		Chain:   policyTypeChainName,
+		Rule:    knftables.Concat(trafficDirection, fmt.Sprintf("@%s%s", prefixManagedInterfacesSet, hashName), verdict),
+		Comment: knftables.PtrTo(fmt.Sprintf("%s%s/%s", verdictRuleCommentPrefix, policy.Namespace, policy.Name)),
+	}, policy.Namespace, policy.Name)
+}
+
+// insertBeforeVerdicts inserts a rule of a policy before the verdict rules of a policy type chain. The verdict rule of
+// the policy itself is ignored since it is deleted by the cleanup queued in the same transaction, and the rule is
+// added at the end of the chain when the chain has no verdict rule yet, the drop rule being added after it.
+func insertBeforeVerdicts(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, rule *knftables.Rule, namespace string, name string) error {
+	anchor, err := findVerdictAnchor(ctx, nft, rule.Chain, fmt.Sprintf("%s%s/%s", verdictRuleCommentPrefix, namespace, name))
+	if err != nil && !knftables.IsNotFound(err) {
+		return fmt.Errorf("failed to find drop rule in %s chain: %w", rule.Chain, err)
+	}
+
+	if anchor == nil {
+		tx.Add(rule)
+		return nil
+	}
+
+	rule.Handle = anchor.Handle
+	tx.Insert(rule)
+
 	return nil
 }
 
+// findVerdictAnchor returns the first verdict rule of a policy type chain, the policy rules are inserted before it
+// so that the verdicts of the policies are only evaluated once all the policies did not accept the packet. The rule
+// with the ignored comment is skipped.
+func findVerdictAnchor(ctx context.Context, nft knftables.Interface, chain string, ignoredComment string) (*knftables.Rule, error) {
+	rules, err := nft.ListRules(ctx, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		if rule.Comment == nil || *rule.Comment == ignoredComment {
+			continue
+		}
+
+		if *rule.Comment == dropRuleComment || strings.HasPrefix(*rule.Comment, verdictRuleCommentPrefix) {
+			return rule, nil
+		}
+	}
+
+	return nil, nil
+}
+
 // createCommonRules creates the common rules in the common chains
 func createCommonRules(tx *knftables.Transaction, commonRules *CommonRules, logger logr.Logger) {
 	logger.Info("Creating common rules")
@@ -292,6 +768,46 @@ func createCommonRules(tx *knftables.Transaction, commonRules *CommonRules, logg
 		})
 	}
 
+	if commonRules.AcceptIPsec {
+		logger.Info("Adding rules to accept IPsec traffic in common ingress and egress chains")
+		for _, chain := range []string{commonIngressChain, commonEgressChain} {
+			// ESP and AH, and IKE with its NAT traversal port also carrying ESP
+			tx.Add(&knftables.Rule{
+				Chain:   chain,
+				Rule:    knftables.Concat("meta l4proto { esp, ah } accept"),
+				Comment: knftables.PtrTo("Accept IPsec"),
+			})
+			tx.Add(&knftables.Rule{
+				Chain:   chain,
+				Rule:    knftables.Concat("udp dport { 500, 4500 } accept"),
+				Comment: knftables.PtrTo("Accept IKE"),
+			})
+		}
+	}
+
+	// The marks of a trusted system are accepted before the custom rules, so that both systems compose
+	if commonRules.TrustedCTMark != nil {
+		logger.Info("Adding rules to accept the trusted ct mark in common ingress and egress chains")
+		for _, chain := range []string{commonIngressChain, commonEgressChain} {
+			tx.Add(&knftables.Rule{
+				Chain:   chain,
+				Rule:    knftables.Concat(commonRules.TrustedCTMark.match("ct mark"), "accept"),
+				Comment: knftables.PtrTo("Accept trusted ct mark"),
+			})
+		}
+	}
+
+	if commonRules.TrustedMark != nil {
+		logger.Info("Adding rules to accept the trusted mark in common ingress and egress chains")
+		for _, chain := range []string{commonIngressChain, commonEgressChain} {
+			tx.Add(&knftables.Rule{
+				Chain:   chain,
+				Rule:    knftables.Concat(commonRules.TrustedMark.match("meta mark"), "accept"),
+				Comment: knftables.PtrTo("Accept trusted mark"),
+			})
+		}
+	}
+
 	// Add custom rules to common ingress chain
 	combined := commonRules.CustomIPv4IngressRules
 	combined = append(combined, commonRules.CustomIPv6IngressRules...)
@@ -315,6 +831,12 @@ func createCommonRules(tx *knftables.Transaction, commonRules *CommonRules, logg
 			Comment: knftables.PtrTo("Custom Rule"),
 		})
 	}
+
+	// Add the extra rules of the pod after the custom rules
+	for _, rule := range commonRules.extraRules {
+		logger.V(1).Info("Adding extra rule to common chain", "chain", rule.Chain, "rule", rule.Rule)
+		tx.Add(rule)
+	}
 }
 
 // createManagedInterfacesSet creates the managed interfaces set
@@ -322,15 +844,19 @@ func createManagedInterfacesSet(tx *knftables.Transaction, matchedInterfaces []I
 	logger.Info("Creating managed interfaces set")
 
 	name := fmt.Sprintf("%s%s", prefixManagedInterfacesSet, hashName)
+	createInterfacesSet(tx, name, fmt.Sprintf("Managed interfaces set for %s/%s", policyNamespace, policyName), matchedInterfaces, logger)
+}
 
+// createInterfacesSet creates a set with the names of the interfaces
+func createInterfacesSet(tx *knftables.Transaction, name string, comment string, interfaces []Interface, logger logr.Logger) {
 	tx.Add(&knftables.Set{
 		Name:    name,
 		Type:    "ifname",
-		Comment: knftables.PtrTo(fmt.Sprintf("Managed interfaces set for %s/%s", policyNamespace, policyName)),
+		Comment: knftables.PtrTo(comment),
 	})
 
 	// Add interfaces to the managed interfaces set
-	for _, intf := range matchedInterfaces {
+	for _, intf := range interfaces {
 		logger.V(1).Info("Adding interface to managed interfaces set", "interface", intf.Name)
 		tx.Add(&knftables.Element{
 			Set: name,
@@ -339,26 +865,140 @@ func createManagedInterfacesSet(tx *knftables.Transaction, matchedInterfaces []I
 	}
 }
 
-// createDispatcherRule creates the dispatcher rule in the dispatcher chain
-func createDispatcherRule(tx *knftables.Transaction, hashName string, dispatcherChainName string, comment string, logger logr.Logger) {
+// createDispatcherRule creates the dispatcher rule in the dispatcher chain, setting the accepted marks when not empty
+func createDispatcherRule(tx *knftables.Transaction, hashName string, dispatcherChainName string, comment string, acceptedMarks string, logger logr.Logger) {
 	logger.Info("Creating dispatcher rule in dispatcher chain", "dispatcherChainName", dispatcherChainName)
 
 	managedInterfacesSetName := fmt.Sprintf("%s%s", prefixManagedInterfacesSet, hashName)
+	addDispatcherRule(tx, dispatcherChainName, managedInterfacesSetName, dispatcherChainName == outputChain, comment, acceptedMarks)
+}
 
+// addDispatcherRule adds the rule jumping from a dispatcher chain to the ingress or egress chain for the interfaces of a set.
+// The accepted marks are set before the jump, the packets dropped by the policies never carry them further.
+func addDispatcherRule(tx *knftables.Transaction, dispatcherChainName string, setName string, egress bool, comment string, acceptedMarks string) {
 	trafficDirection := "iifname"
-	policyTypeChainName := "ingress"
-	if dispatcherChainName == outputChain {
+	policyTypeChainName := ingressChain
+	if egress {
 		trafficDirection = "oifname"
-		policyTypeChainName = "egress"
+		policyTypeChainName = egressChain
+	}
+
+	rule := knftables.Concat(trafficDirection, fmt.Sprintf("@%s", setName))
+	if acceptedMarks != "" {
+		rule = knftables.Concat(rule, acceptedMarks)
 	}
 
 	tx.Add(&knftables.Rule{
 		Chain:   dispatcherChainName,
-		Rule:    knftables.Concat(trafficDirection, fmt.Sprintf("@%s", managedInterfacesSetName), "jump", policyTypeChainName),
+		Rule:    knftables.Concat(rule, "jump", policyTypeChainName),
 		Comment: knftables.PtrTo(comment),
 	})
 }
 
+// dispatcher dispatches the traffic of interfaces from a base chain, nil for the input or output chain
+type dispatcher struct {
+	baseChain  *datastore.BaseChain
+	interfaces []Interface
+}
+
+// createDispatchers creates the dispatcher rules of the policy in the input or output chain, and in the base chains
+// of the networks overriding the hook. When the interfaces are dispatched from several chains, each one matches
+// its own set of interfaces so that the traffic is only dispatched from the hook of its network.
+func createDispatchers(tx *knftables.Transaction, matchedInterfaces []Interface, policy *datastore.Policy, hashName string, dispatcherChainName string, acceptedMarks string, logger logr.Logger) {
+	comment := fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)
+	egress := dispatcherChainName == outputChain
+
+	dispatchers := getDispatchers(matchedInterfaces, policy.BaseChains, egress)
+	if len(dispatchers) == 1 && dispatchers[0].baseChain == nil {
+		createDispatcherRule(tx, hashName, dispatcherChainName, comment, acceptedMarks, logger)
+		return
+	}
+
+	for _, d := range dispatchers {
+		chainName := dispatcherChainName
+		if d.baseChain != nil {
+			chainName = createBaseDispatcherChain(tx, d.baseChain, egress, logger)
+		}
+
+		logger.Info("Creating dispatcher rule in dispatcher chain", "dispatcherChainName", chainName)
+
+		setName := fmt.Sprintf("%s%s-%s", prefixManagedInterfacesSet, hashName, chainName)
+		createInterfacesSet(tx, setName, fmt.Sprintf("Managed interfaces set for %s in %s", comment, chainName), d.interfaces, logger)
+		addDispatcherRule(tx, chainName, setName, egress, comment, acceptedMarks)
+	}
+}
+
+// getDispatchers groups the interfaces by the base chain of their network, the interfaces of the networks without
+// an override come first
+func getDispatchers(interfaces []Interface, baseChains map[string]datastore.NetworkBaseChains, egress bool) []dispatcher {
+	dispatchers := []dispatcher{{}}
+	for _, intf := range interfaces {
+		baseChain := baseChains[intf.Network].Ingress
+		if egress {
+			baseChain = baseChains[intf.Network].Egress
+		}
+
+		// The default hook and priority are dispatched by the input or output chain
+		if baseChain != nil && baseChain.Priority == 0 &&
+			((!egress && baseChain.Hook == string(knftables.InputHook)) || (egress && baseChain.Hook == string(knftables.OutputHook))) {
+			baseChain = nil
+		}
+
+		i := slices.IndexFunc(dispatchers, func(d dispatcher) bool {
+			return (d.baseChain == nil && baseChain == nil) || (d.baseChain != nil && baseChain != nil && *d.baseChain == *baseChain)
+		})
+		if i == -1 {
+			dispatchers = append(dispatchers, dispatcher{baseChain: baseChain})
+			i = len(dispatchers) - 1
+		}
+
+		dispatchers[i].interfaces = append(dispatchers[i].interfaces, intf)
+	}
+
+	if len(dispatchers[0].interfaces) == 0 {
+		dispatchers = dispatchers[1:]
+	}
+
+	return dispatchers
+}
+
+// createBaseDispatcherChain creates the base chain dispatching the traffic at a hook and priority, it returns its name
+func createBaseDispatcherChain(tx *knftables.Transaction, baseChain *datastore.BaseChain, egress bool, logger logr.Logger) string {
+	name := baseDispatcherChainName(baseChain, egress)
+
+	comment := "Input Dispatcher"
+	if egress {
+		comment = "Output Dispatcher"
+	}
+
+	logger.V(1).Info("Creating base dispatcher chain", "chain", name, "hook", baseChain.Hook, "priority", baseChain.Priority)
+	tx.Add(&knftables.Chain{
+		Name:     name,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.BaseChainHook(baseChain.Hook)),
+		Priority: knftables.PtrTo(knftables.BaseChainPriority(strconv.Itoa(baseChain.Priority))),
+		Comment:  knftables.PtrTo(fmt.Sprintf("%s (%s)", comment, baseChain.Hook)),
+	})
+
+	return name
+}
+
+// baseDispatcherChainName returns the name of the base chain dispatching the traffic at a hook and priority,
+// e.g. dispatch-ingress-prerouting-m150 for the ingress traffic at prerouting with the mangle priority
+func baseDispatcherChainName(baseChain *datastore.BaseChain, egress bool) string {
+	direction := "ingress"
+	if egress {
+		direction = "egress"
+	}
+
+	priority := strconv.Itoa(baseChain.Priority)
+	if baseChain.Priority < 0 {
+		priority = "m" + strconv.Itoa(-baseChain.Priority)
+	}
+
+	return fmt.Sprintf("%s%s-%s-%s", prefixDispatcherChain, direction, baseChain.Hook, priority)
+}
+
 // createPolicyChain creates the policy chain and jump rule from policy type chain
 func createPolicyChain(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, npChainName string, policyTypeChainName string, namespace string, name string, logger logr.Logger) error {
 	logger.Info("Creating policy chain", "npChainName", npChainName)
@@ -368,146 +1008,129 @@ func createPolicyChain(ctx context.Context, nft knftables.Interface, tx *knftabl
 		Comment: knftables.PtrTo(fmt.Sprintf("MultiNetworkPolicy %s/%s", namespace, name)),
 	})
 
-	// Find drop rule in policy chain
-	dropRule, err := findRuleInChain(ctx, nft, policyTypeChainName, dropRuleComment)
-	if err != nil || dropRule == nil {
-		// Should never happen
-		return fmt.Errorf("failed to find drop rule in %s chain: %w", policyTypeChainName, err)
-	}
-
-	// Insert jump rule before the drop rule
-	tx.Insert(&knftables.Rule{
+	// Insert jump rule before the verdict rules, the drop rule when no policy overrides the verdict
+	return insertBeforeVerdicts(ctx, nft, tx, &knftables.Rule{
 		Chain:   policyTypeChainName,
 		Rule:    knftables.Concat("jump", npChainName),
 		Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", namespace, name)),
-		Handle:  dropRule.Handle,
-	})
-
-	return nil
+	}, namespace, name)
 }
 
 // createIngressRules creates the ingress rules for a policy
 func (n *NFTables) createIngressRules(ctx context.Context, tx *knftables.Transaction, matchedInterfaces []Interface, policy *datastore.Policy, hashName string, logger logr.Logger) error {
 	logger.Info("Creating ingress rules")
 
-	npChainName := fmt.Sprintf("%s%s", prefixNetworkPolicyChain, hashName)
+	npChain := n.policyChain(hashName, policy, ingressChain)
 
 	// Reverse rules for IPv4 and IPv6 - hairpinning
-	createReverseRules(tx, matchedInterfaces, npChainName, logger)
+	createReverseRules(tx, matchedInterfaces, npChain, logger)
+
+	createProtocolPresetRules(tx, matchedInterfaces, policy.ProtocolPresets, npChain, "iifname", logger)
+
+	createInfrastructureRules(tx, matchedInterfaces, policy.Infrastructure, npChain, false, n.Conntrack.Unavailable, logger)
+
+	if !n.Conntrack.Unavailable {
+		createConnectionLimitRules(tx, hashName, policy.ConnectionLimit, npChain, logger)
+	}
+
+	createMulticastGroupRules(tx, hashName, policy.MulticastGroups, npChain, logger)
 
 	if len(policy.Spec.Ingress) == 0 {
 		logger.Info("No ingress rules specified, no rules will be created")
 		return nil
 	}
 
+	// The ports and IP blocks of the rules are compiled once per generation of the policy
+	compiled := n.compiled.get(policy)
+
+	// The rules of the interfaces carrying encapsulated traffic match the tunnel and the inner headers
+	groups := groupInterfacesByEncapsulation(matchedInterfaces, policy.Encapsulations)
+
 	for i, peer := range policy.Spec.Ingress {
 		logger.V(1).Info("Processing ingress peer", "index", i)
 
-		var portRuleSections []string
-		if len(peer.Ports) > 0 {
-			portRuleSections = getPortRuleSections(peer.Ports)
+		rule := compiled.rule("ingress", i)
+		if rule.err != nil {
+			logger.Info("Skipping invalid ingress rule", "index", i, "error", rule.err.Error())
+			continue
 		}
 
 		// Allow all traffic
 		if len(peer.From) == 0 {
 			logger.Info("No sources specified, accepting traffic from all sources")
 
-			var ipRuleSections []string
-			for _, intf := range matchedInterfaces {
-				ipRuleSections = append(ipRuleSections, knftables.Concat("iifname", intf.Name))
-			}
+			for _, group := range groups {
+				var ipRuleSections []string
+				for _, intf := range group.interfaces {
+					ipRuleSections = append(ipRuleSections, group.interfaceMatch("iifname", intf.Name))
+				}
 
-			createRules(tx, npChainName, ipRuleSections, portRuleSections, logger)
+				n.createPeerRules(tx, npChain, group, ipRuleSections, group.portRuleSections(rule.ports, peer.Ports), logger)
+			}
 			continue
 		}
 
 		logger.V(1).Info("Processing ingress peer with sources specified")
 
-		// Get the peer info which contains the pods, cidrs and excepts
-		peerInfo, err := n.parsePeers(ctx, peer.From, policy.Namespace, logger)
+		// The peer set is shared by all the target pods of the sync
+		peers, err := n.getPeerSet(ctx, "ingress", i, peer.From, rule.ipBlocks, policy, logger)
 		if err != nil {
 			return fmt.Errorf("failed to parse peers: %w", err)
 		}
 
-		var ipRuleSections []string
-
-		if len(peerInfo.pods) != 0 {
-			logger.V(1).Info("Found pods selected by peer's selectors", "count", len(peerInfo.pods))
-
-			podInterfacesMap := getPodInterfacesMap(peerInfo.pods, policy.Networks)
-
-			// We need to process each interface individually
-			for _, intf := range matchedInterfaces {
-				// Create the IP addresses set for the interface.
-				// Sets cannot be inet family, so we need to create separate sets for IPv4 and IPv6
-				// Each ingress entry will have its own set for the interface
-				ipv4SetName := fmt.Sprintf("%s%s_ingress_ipv4_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
-				ipv6SetName := fmt.Sprintf("%s%s_ingress_ipv6_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
-				setComment := fmt.Sprintf("Addresses for %s/%s", policy.Namespace, policy.Name)
-
-				ipv4Addresses, ipv6Addresses := classifyAddresses(podInterfacesMap, policy)
-
-				if len(ipv4Addresses) > 0 {
-					createAndPopulateIPSet(tx, ipv4SetName, "ipv4_addr", setComment, ipv4Addresses, false)
-					ipRuleSections = append(ipRuleSections, knftables.Concat("iifname", intf.Name, "ip", "saddr", fmt.Sprintf("@%s", ipv4SetName)))
-				}
-
-				if len(ipv6Addresses) > 0 {
-					createAndPopulateIPSet(tx, ipv6SetName, "ipv6_addr", setComment, ipv6Addresses, false)
-					ipRuleSections = append(ipRuleSections, knftables.Concat("iifname", intf.Name, "ip6", "saddr", fmt.Sprintf("@%s", ipv6SetName)))
-				}
-			}
-		}
-
-		if len(peerInfo.cidrs) > 0 {
-			logger.V(1).Info("Found IP blocks", "cidrs", len(peerInfo.cidrs), "excepts", len(peerInfo.excepts))
+		var ipv4CIDRSets, ipv6CIDRSets *cidrSets
+		if peers.cidrs > 0 {
+			logger.V(1).Info("Found IP blocks", "cidrs", peers.cidrs, "excepts", peers.excepts)
 
 			ipv4CidrsSetName := fmt.Sprintf("%s%s_ingress_ipv4_cidr_%d", prefixNetworkPolicySet, hashName, i)
 			ipv6CidrsSetName := fmt.Sprintf("%s%s_ingress_ipv6_cidr_%d", prefixNetworkPolicySet, hashName, i)
-			cidrsSetComment := fmt.Sprintf("CIDRs for %s/%s", policy.Namespace, policy.Name)
-
 			ipv4ExceptsSetName := fmt.Sprintf("%s%s_ingress_ipv4_except_%d", prefixNetworkPolicySet, hashName, i)
 			ipv6ExceptsSetName := fmt.Sprintf("%s%s_ingress_ipv6_except_%d", prefixNetworkPolicySet, hashName, i)
-			exceptsSetComment := fmt.Sprintf("Excepts for %s/%s", policy.Namespace, policy.Name)
-
-			ipv4CIDRs, ipv6CIDRs := utils.SplitCIDRs(peerInfo.cidrs)
-			ipv4Excepts, ipv6Excepts := utils.SplitCIDRs(peerInfo.excepts)
+			setComment := fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)
 
-			if len(ipv4CIDRs) > 0 {
-				createAndPopulateIPSet(tx, ipv4CidrsSetName, "ipv4_addr", cidrsSetComment, ipv4CIDRs, true)
-				if len(ipv4Excepts) > 0 {
-					createAndPopulateIPSet(tx, ipv4ExceptsSetName, "ipv4_addr", exceptsSetComment, ipv4Excepts, true)
-				}
-			}
+			// Very large CIDR lists are chunked across multiple sets
+			ipv4CIDRSets = createCIDRSets(tx, "ip", "saddr", "ipv4_addr", ipv4CidrsSetName, ipv4ExceptsSetName, peers.ipv4CIDRs, peers.ipv4Excepts, setComment, n.MaxSetElements)
+			ipv6CIDRSets = createCIDRSets(tx, "ip6", "saddr", "ipv6_addr", ipv6CidrsSetName, ipv6ExceptsSetName, peers.ipv6CIDRs, peers.ipv6Excepts, setComment, n.MaxSetElements)
+		}
 
-			if len(ipv6CIDRs) > 0 {
-				createAndPopulateIPSet(tx, ipv6CidrsSetName, "ipv6_addr", cidrsSetComment, ipv6CIDRs, true)
-				if len(ipv6Excepts) > 0 {
-					createAndPopulateIPSet(tx, ipv6ExceptsSetName, "ipv6_addr", exceptsSetComment, ipv6Excepts, true)
-				}
-			}
+		for _, group := range groups {
+			var ipRuleSections []string
 
-			managedInterfacesSetName := fmt.Sprintf("%s%s", prefixManagedInterfacesSet, hashName)
-			if len(ipv4CIDRs) > 0 {
-				rule := knftables.Concat("iifname", fmt.Sprintf("@%s", managedInterfacesSetName), "ip", "saddr", fmt.Sprintf("@%s", ipv4CidrsSetName))
-				if len(ipv4Excepts) > 0 {
-					rule = knftables.Concat(rule, "ip", "saddr", "!=", fmt.Sprintf("@%s", ipv4ExceptsSetName))
+			if peers.pods != 0 {
+				logger.V(1).Info("Found pods selected by peer's selectors", "count", peers.pods)
+
+				// We need to process each interface individually
+				for _, intf := range group.interfaces {
+					// Create the IP addresses set for the interface.
+					// Sets cannot be inet family, so we need to create separate sets for IPv4 and IPv6
+					// Each ingress entry will have its own set for the interface
+					ipv4SetName := fmt.Sprintf("%s%s_ingress_ipv4_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
+					ipv6SetName := fmt.Sprintf("%s%s_ingress_ipv6_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
+					setComment := fmt.Sprintf("Addresses for %s/%s", policy.Namespace, policy.Name)
+
+					// The addresses of the peers are bound to the network of the interface, the networks can overlap
+					ipv4Addresses, ipv6Addresses := peers.interfaceAddresses(intf, policy)
+
+					if len(ipv4Addresses) > 0 {
+						createAndPopulateIPSet(tx, ipv4SetName, "ipv4_addr", setComment, ipv4Addresses, false)
+						ipRuleSections = append(ipRuleSections, knftables.Concat(group.interfaceMatch("iifname", intf.Name), group.header("ip"), "saddr", fmt.Sprintf("@%s", ipv4SetName)))
+					}
+
+					// The IPv4 peers are also reached at their NAT64 addresses on the IPv6-only networks
+					if ipv6Addresses := nat64PeerAddresses(intf, ipv4Addresses, ipv6Addresses, policy.NAT64Prefixes); len(ipv6Addresses) > 0 {
+						createAndPopulateIPSet(tx, ipv6SetName, "ipv6_addr", setComment, ipv6Addresses, false)
+						ipRuleSections = append(ipRuleSections, knftables.Concat(group.interfaceMatch("iifname", intf.Name), group.header("ip6"), "saddr", fmt.Sprintf("@%s", ipv6SetName)))
+					}
 				}
-
-				ipRuleSections = append(ipRuleSections, rule)
 			}
 
-			if len(ipv6CIDRs) > 0 {
-				rule := knftables.Concat("iifname", fmt.Sprintf("@%s", managedInterfacesSetName), "ip6", "saddr", fmt.Sprintf("@%s", ipv6CidrsSetName))
-				if len(ipv6Excepts) > 0 {
-					rule = knftables.Concat(rule, "ip6", "saddr", "!=", fmt.Sprintf("@%s", ipv6ExceptsSetName))
-				}
+			match := group.interfacesMatch("iifname", hashName)
+			ipRuleSections = append(ipRuleSections, ipv4CIDRSets.ruleSections(match, group.encapsulation)...)
+			ipRuleSections = append(ipRuleSections, ipv6CIDRSets.ruleSections(match, group.encapsulation)...)
+			ipRuleSections = append(ipRuleSections, n.createNAT64CIDRSets(tx, &group, peers, policy, hashName, "ingress", i)...)
 
-				ipRuleSections = append(ipRuleSections, rule)
-			}
+			n.createPeerRules(tx, npChain, group, ipRuleSections, group.portRuleSections(rule.ports, peer.Ports), logger)
 		}
-
-		createRules(tx, npChainName, ipRuleSections, portRuleSections, logger)
 	}
 
 	return nil
@@ -517,150 +1140,135 @@ func (n *NFTables) createIngressRules(ctx context.Context, tx *knftables.Transac
 func (n *NFTables) createEgressRules(ctx context.Context, tx *knftables.Transaction, matchedInterfaces []Interface, policy *datastore.Policy, hashName string, logger logr.Logger) error {
 	logger.Info("Creating egress rules")
 
-	npChainName := fmt.Sprintf("%s%s", prefixNetworkPolicyChain, hashName)
+	npChain := n.policyChain(hashName, policy, egressChain)
+
+	createProtocolPresetRules(tx, matchedInterfaces, policy.ProtocolPresets, npChain, "oifname", logger)
+
+	createInfrastructureRules(tx, matchedInterfaces, policy.Infrastructure, npChain, true, n.Conntrack.Unavailable, logger)
 
 	if len(policy.Spec.Egress) == 0 {
 		logger.Info("No egress rules specified, no rules will be created")
 		return nil
 	}
 
+	// The ports and IP blocks of the rules are compiled once per generation of the policy
+	compiled := n.compiled.get(policy)
+
+	// The rules of the interfaces carrying encapsulated traffic match the tunnel and the inner headers
+	groups := groupInterfacesByEncapsulation(matchedInterfaces, policy.Encapsulations)
+
 	for i, peer := range policy.Spec.Egress {
 		logger.V(1).Info("Processing egress peer", "index", i)
 
-		var portRuleSections []string
-		if len(peer.Ports) > 0 {
-			portRuleSections = getPortRuleSections(peer.Ports)
+		rule := compiled.rule("egress", i)
+		if rule.err != nil {
+			logger.Info("Skipping invalid egress rule", "index", i, "error", rule.err.Error())
+			continue
 		}
 
 		// Allow all traffic
 		if len(peer.To) == 0 {
 			logger.Info("No destinations specified, accepting traffic to all destinations")
 
-			var ipRuleSections []string
-			for _, intf := range matchedInterfaces {
-				ipRuleSections = append(ipRuleSections, knftables.Concat("oifname", intf.Name))
-			}
+			for _, group := range groups {
+				var ipRuleSections []string
+				for _, intf := range group.interfaces {
+					ipRuleSections = append(ipRuleSections, group.interfaceMatch("oifname", intf.Name))
+				}
 
-			createRules(tx, npChainName, ipRuleSections, portRuleSections, logger)
+				n.createPeerRules(tx, npChain, group, ipRuleSections, group.portRuleSections(rule.ports, peer.Ports), logger)
+			}
 			continue
 		}
 
 		logger.V(1).Info("Processing egress peer with destinations specified")
 
-		// Get the peer info which contains the pods, cidrs and excepts
-		peerInfo, err := n.parsePeers(ctx, peer.To, policy.Namespace, logger)
+		// The peer set is shared by all the target pods of the sync
+		peers, err := n.getPeerSet(ctx, "egress", i, peer.To, rule.ipBlocks, policy, logger)
 		if err != nil {
 			return fmt.Errorf("failed to parse peers: %w", err)
 		}
 
-		var ipRuleSections []string
-
-		if len(peerInfo.pods) != 0 {
-			logger.V(1).Info("Found pods selected by peer's selectors", "count", len(peerInfo.pods))
-
-			podInterfacesMap := getPodInterfacesMap(peerInfo.pods, policy.Networks)
-
-			// We need to process each interface individually
-			for _, intf := range matchedInterfaces {
-				// Create the IP addresses set for the interface.
-				// Sets cannot be inet family, so we need to create separate sets for IPv4 and IPv6
-				// Each egress entry will have its own set for the interface
-				ipv4SetName := fmt.Sprintf("%s%s_egress_ipv4_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
-				ipv6SetName := fmt.Sprintf("%s%s_egress_ipv6_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
-				setComment := fmt.Sprintf("Addresses for %s/%s", policy.Namespace, policy.Name)
-
-				ipv4Addresses, ipv6Addresses := classifyAddresses(podInterfacesMap, policy)
-
-				if len(ipv4Addresses) > 0 {
-					createAndPopulateIPSet(tx, ipv4SetName, "ipv4_addr", setComment, ipv4Addresses, false)
-					ipRuleSections = append(ipRuleSections, knftables.Concat("oifname", intf.Name, "ip", "daddr", fmt.Sprintf("@%s", ipv4SetName)))
-				}
-
-				if len(ipv6Addresses) > 0 {
-					createAndPopulateIPSet(tx, ipv6SetName, "ipv6_addr", setComment, ipv6Addresses, false)
-					ipRuleSections = append(ipRuleSections, knftables.Concat("oifname", intf.Name, "ip6", "daddr", fmt.Sprintf("@%s", ipv6SetName)))
-				}
-			}
-		}
-
-		if len(peerInfo.cidrs) > 0 {
-			logger.V(1).Info("Found IP blocks", "cidrs", len(peerInfo.cidrs), "excepts", len(peerInfo.excepts))
+		var ipv4CIDRSets, ipv6CIDRSets *cidrSets
+		if peers.cidrs > 0 {
+			logger.V(1).Info("Found IP blocks", "cidrs", peers.cidrs, "excepts", peers.excepts)
 
 			ipv4CidrsSetName := fmt.Sprintf("%s%s_egress_ipv4_cidr_%d", prefixNetworkPolicySet, hashName, i)
 			ipv6CidrsSetName := fmt.Sprintf("%s%s_egress_ipv6_cidr_%d", prefixNetworkPolicySet, hashName, i)
-			cidrsSetComment := fmt.Sprintf("CIDRs for %s/%s", policy.Namespace, policy.Name)
-
 			ipv4ExceptsSetName := fmt.Sprintf("%s%s_egress_ipv4_except_%d", prefixNetworkPolicySet, hashName, i)
 			ipv6ExceptsSetName := fmt.Sprintf("%s%s_egress_ipv6_except_%d", prefixNetworkPolicySet, hashName, i)
-			exceptsSetComment := fmt.Sprintf("Excepts for %s/%s", policy.Namespace, policy.Name)
+			setComment := fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)
 
-			ipv4CIDRs, ipv6CIDRs := utils.SplitCIDRs(peerInfo.cidrs)
-			ipv4Excepts, ipv6Excepts := utils.SplitCIDRs(peerInfo.excepts)
-
-			if len(ipv4CIDRs) > 0 {
-				createAndPopulateIPSet(tx, ipv4CidrsSetName, "ipv4_addr", cidrsSetComment, ipv4CIDRs, true)
-				if len(ipv4Excepts) > 0 {
-					createAndPopulateIPSet(tx, ipv4ExceptsSetName, "ipv4_addr", exceptsSetComment, ipv4Excepts, true)
-				}
-			}
+			// Very large CIDR lists are chunked across multiple sets
+			ipv4CIDRSets = createCIDRSets(tx, "ip", "daddr", "ipv4_addr", ipv4CidrsSetName, ipv4ExceptsSetName, peers.ipv4CIDRs, peers.ipv4Excepts, setComment, n.MaxSetElements)
+			ipv6CIDRSets = createCIDRSets(tx, "ip6", "daddr", "ipv6_addr", ipv6CidrsSetName, ipv6ExceptsSetName, peers.ipv6CIDRs, peers.ipv6Excepts, setComment, n.MaxSetElements)
+		}
 
-			if len(ipv6CIDRs) > 0 {
-				createAndPopulateIPSet(tx, ipv6CidrsSetName, "ipv6_addr", cidrsSetComment, ipv6CIDRs, true)
-				if len(ipv6Excepts) > 0 {
-					createAndPopulateIPSet(tx, ipv6ExceptsSetName, "ipv6_addr", exceptsSetComment, ipv6Excepts, true)
-				}
-			}
+		for _, group := range groups {
+			var ipRuleSections []string
 
-			managedInterfacesSetName := fmt.Sprintf("%s%s", prefixManagedInterfacesSet, hashName)
-			if len(ipv4CIDRs) > 0 {
-				rule := knftables.Concat("oifname", fmt.Sprintf("@%s", managedInterfacesSetName), "ip", "daddr", fmt.Sprintf("@%s", ipv4CidrsSetName))
-				if len(ipv4Excepts) > 0 {
-					rule = knftables.Concat(rule, "ip", "daddr", "!=", fmt.Sprintf("@%s", ipv4ExceptsSetName))
+			if peers.pods != 0 {
+				logger.V(1).Info("Found pods selected by peer's selectors", "count", peers.pods)
+
+				// We need to process each interface individually
+				for _, intf := range group.interfaces {
+					// Create the IP addresses set for the interface.
+					// Sets cannot be inet family, so we need to create separate sets for IPv4 and IPv6
+					// Each egress entry will have its own set for the interface
+					ipv4SetName := fmt.Sprintf("%s%s_egress_ipv4_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
+					ipv6SetName := fmt.Sprintf("%s%s_egress_ipv6_%s_%d", prefixNetworkPolicySet, hashName, intf.Name, i)
+					setComment := fmt.Sprintf("Addresses for %s/%s", policy.Namespace, policy.Name)
+
+					// The addresses of the peers are bound to the network of the interface, the networks can overlap
+					ipv4Addresses, ipv6Addresses := peers.interfaceAddresses(intf, policy)
+
+					if len(ipv4Addresses) > 0 {
+						createAndPopulateIPSet(tx, ipv4SetName, "ipv4_addr", setComment, ipv4Addresses, false)
+						ipRuleSections = append(ipRuleSections, knftables.Concat(group.interfaceMatch("oifname", intf.Name), group.header("ip"), "daddr", fmt.Sprintf("@%s", ipv4SetName)))
+					}
+
+					// The IPv4 peers are also reached at their NAT64 addresses on the IPv6-only networks
+					if ipv6Addresses := nat64PeerAddresses(intf, ipv4Addresses, ipv6Addresses, policy.NAT64Prefixes); len(ipv6Addresses) > 0 {
+						createAndPopulateIPSet(tx, ipv6SetName, "ipv6_addr", setComment, ipv6Addresses, false)
+						ipRuleSections = append(ipRuleSections, knftables.Concat(group.interfaceMatch("oifname", intf.Name), group.header("ip6"), "daddr", fmt.Sprintf("@%s", ipv6SetName)))
+					}
 				}
-
-				ipRuleSections = append(ipRuleSections, rule)
 			}
 
-			if len(ipv6CIDRs) > 0 {
-				rule := knftables.Concat("oifname", fmt.Sprintf("@%s", managedInterfacesSetName), "ip6", "daddr", fmt.Sprintf("@%s", ipv6CidrsSetName))
-				if len(ipv6Excepts) > 0 {
-					rule = knftables.Concat(rule, "ip6", "daddr", "!=", fmt.Sprintf("@%s", ipv6ExceptsSetName))
-				}
+			match := group.interfacesMatch("oifname", hashName)
+			ipRuleSections = append(ipRuleSections, ipv4CIDRSets.ruleSections(match, group.encapsulation)...)
+			ipRuleSections = append(ipRuleSections, ipv6CIDRSets.ruleSections(match, group.encapsulation)...)
+			ipRuleSections = append(ipRuleSections, n.createNAT64CIDRSets(tx, &group, peers, policy, hashName, "egress", i)...)
 
-				ipRuleSections = append(ipRuleSections, rule)
-			}
+			n.createPeerRules(tx, npChain, group, ipRuleSections, group.portRuleSections(rule.ports, peer.Ports), logger)
 		}
-
-		createRules(tx, npChainName, ipRuleSections, portRuleSections, logger)
 	}
 
 	return nil
 }
 
 // createReverseRules creates the reverse rules for the policy chain
-func createReverseRules(tx *knftables.Transaction, matchedInterfaces []Interface, npChainName string, logger logr.Logger) {
+func createReverseRules(tx *knftables.Transaction, matchedInterfaces []Interface, npChain policyChain, logger logr.Logger) {
 	logger.Info("Creating reverse routes")
 
 	for _, intf := range matchedInterfaces {
 		for _, ip := range intf.IPs {
 			// Validate IP address
-			parsedIP := net.ParseIP(ip)
-			if parsedIP == nil {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
 				logger.V(1).Info("Skipping invalid IP address", "ip", ip, "interface", intf.Name)
 				continue
 			}
 
-			// Find ip version
+			// Find ip version, an IPv4-mapped IPv6 address is the IPv4 address on the wire
+			addr = addr.Unmap().WithZone("")
 			ipVersion := "ip"
-			if parsedIP.To4() == nil {
+			if !addr.Is4() {
 				ipVersion = "ip6"
 			}
 
 			// Create the reverse route
-			tx.Add(&knftables.Rule{
-				Chain: npChainName,
-				Rule:  knftables.Concat("iifname", intf.Name, ipVersion, "saddr", ip, "accept"),
-			})
+			tx.Add(npChain.rule(knftables.Concat("iifname", intf.Name, ipVersion, "saddr", addr.String(), "accept"), nil))
 		}
 	}
 }
@@ -684,9 +1292,40 @@ func findRuleInChain(ctx context.Context, nft knftables.Interface, chain string,
 	return nil, nil
 }
 
-// getPortRuleSections gets the port rule sections for a policy
-func getPortRuleSections(ports []multiv1beta1.MultiNetworkPolicyPort) []string {
-	protocolToPorts := make(map[string][]string)
+// getPortRuleSections gets the port rule sections for a policy. The ports of each protocol are normalized: the
+// duplicate ports are removed, the overlapping and adjacent ranges are merged, and a port without a number allows all
+// the ports of its protocol.
+func getPortRuleSections(ports []datastore.Port) []string {
+	var portRuleSections []string
+	for _, p := range normalizePorts(ports) {
+		if p.all {
+			portRuleSections = append(portRuleSections, knftables.Concat("meta", "l4proto", p.protocol, "accept"))
+			continue
+		}
+
+		// Anonymous set for the ports
+		joinedPorts := strings.Join(p.elements, ",")
+		portRuleSections = append(portRuleSections, knftables.Concat("meta", "l4proto", p.protocol, "th", "dport", "{", joinedPorts, "}", "accept"))
+	}
+
+	return portRuleSections
+}
+
+// protocolPorts are the normalized ports of a protocol
+type protocolPorts struct {
+	protocol string
+	// all allows all the ports of the protocol
+	all bool
+	// elements are the merged port ranges followed by the named ports
+	elements []string
+}
+
+// normalizePorts normalizes the ports of each protocol, the protocols keep the order they are first seen in
+func normalizePorts(ports []datastore.Port) []protocolPorts {
+	var protocols []string
+	allPorts := make(map[string]bool)
+	protocolToRanges := make(map[string][]portRange)
+	protocolToNames := make(map[string][]string)
 	for _, port := range ports {
 		p := corev1.ProtocolTCP
 		if port.Protocol != nil {
@@ -694,59 +1333,99 @@ func getPortRuleSections(ports []multiv1beta1.MultiNetworkPolicyPort) []string {
 		}
 
 		protocol := strings.ToLower(string(p))
-		if port.Port != nil {
-			if port.EndPort != nil {
-				protocolToPorts[protocol] = append(protocolToPorts[protocol], fmt.Sprintf("%s-%d", port.Port.String(), *port.EndPort))
-			} else {
-				// Handle both integer and string ports
-				if port.Port.Type == intstr.String {
-					// For named ports (strings), convert to lowercase
-					portStr := strings.ToLower(port.Port.StrVal)
-					protocolToPorts[protocol] = append(protocolToPorts[protocol], portStr)
-				} else {
-					protocolToPorts[protocol] = append(protocolToPorts[protocol], port.Port.String())
-				}
+		if !slices.Contains(protocols, protocol) {
+			protocols = append(protocols, protocol)
+		}
+
+		switch {
+		case port.Port == nil:
+			allPorts[protocol] = true
+		case port.Port.Type == intstr.String:
+			// For named ports (strings), convert to lowercase
+			name := strings.ToLower(port.Port.StrVal)
+			if !slices.Contains(protocolToNames[protocol], name) {
+				protocolToNames[protocol] = append(protocolToNames[protocol], name)
 			}
-		} else {
-			if _, exists := protocolToPorts[protocol]; !exists {
-				protocolToPorts[protocol] = nil
+		default:
+			r := portRange{start: port.Port.IntVal, end: port.Port.IntVal}
+			if port.EndPort != nil {
+				r.end = *port.EndPort
 			}
+			protocolToRanges[protocol] = append(protocolToRanges[protocol], r)
 		}
 	}
 
-	// Generate the rule sections for the ports
-	var portRuleSections []string
-	for protocol, ports := range protocolToPorts {
-		if ports == nil {
-			portRuleSections = append(portRuleSections, knftables.Concat("meta", "l4proto", protocol, "accept"))
-		} else {
-			// Anonymous set for the ports
-			joinedPorts := strings.Join(ports, ",")
-			portRuleSections = append(portRuleSections, knftables.Concat("meta", "l4proto", protocol, "th", "dport", "{", joinedPorts, "}", "accept"))
+	normalized := make([]protocolPorts, 0, len(protocols))
+	for _, protocol := range protocols {
+		if allPorts[protocol] {
+			normalized = append(normalized, protocolPorts{protocol: protocol, all: true})
+			continue
 		}
+
+		var elements []string
+		for _, r := range mergePortRanges(protocolToRanges[protocol]) {
+			elements = append(elements, r.String())
+		}
+		elements = append(elements, protocolToNames[protocol]...)
+
+		normalized = append(normalized, protocolPorts{protocol: protocol, elements: elements})
 	}
 
-	return portRuleSections
+	return normalized
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	start int32
+	end   int32
+}
+
+// String returns the port range as an nft set element
+func (r portRange) String() string {
+	if r.start == r.end {
+		return strconv.Itoa(int(r.start))
+	}
+
+	return fmt.Sprintf("%d-%d", r.start, r.end)
+}
+
+// mergePortRanges sorts the port ranges and merges the overlapping and adjacent ones into minimal ranges
+func mergePortRanges(ranges []portRange) []portRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b portRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	merged := []portRange{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.end+1 {
+			last.end = max(last.end, r.end)
+			continue
+		}
+
+		merged = append(merged, r)
+	}
+
+	return merged
 }
 
 // createRules creates the rules for the policy chain
-func createRules(tx *knftables.Transaction, npChainName string, ipRuleSections []string, portRuleSections []string, logger logr.Logger) {
+func createRules(tx *knftables.Transaction, npChain policyChain, ipRuleSections []string, portRuleSections []string, logger logr.Logger) {
 	if len(portRuleSections) == 0 {
 		logger.V(1).Info("No port restrictions specified, creating rules with just IP restrictions", "ipRuleSections", ipRuleSections)
 		for _, ipRuleSection := range ipRuleSections {
-			tx.Add(&knftables.Rule{
-				Chain: npChainName,
-				Rule:  knftables.Concat(ipRuleSection, "accept"),
-			})
+			tx.Add(npChain.rule(knftables.Concat(ipRuleSection, "accept"), nil))
 		}
 	} else {
 		logger.V(1).Info("Port restrictions specified, creating rules with both IP and port restrictions", "ipRuleSections", ipRuleSections, "portRuleSections", portRuleSections)
 		for _, ipRuleSection := range ipRuleSections {
 			for _, portRuleSection := range portRuleSections {
-				tx.Add(&knftables.Rule{
-					Chain: npChainName,
-					Rule:  knftables.Concat(ipRuleSection, portRuleSection),
-				})
+				tx.Add(npChain.rule(knftables.Concat(ipRuleSection, portRuleSection), nil))
 			}
 		}
 	}
@@ -754,31 +1433,36 @@ func createRules(tx *knftables.Transaction, npChainName string, ipRuleSections [
 
 // peerInfo contains the information for a peer
 type peerInfo struct {
-	pods    []corev1.Pod
+	pods    []datastore.PodInfo
 	cidrs   []string
 	excepts []string
 }
 
 // parsePeers parses the peers and returns the peer info
-func (n *NFTables) parsePeers(ctx context.Context, peers []multiv1beta1.MultiNetworkPolicyPeer, policyNamespace string, logger logr.Logger) (*peerInfo, error) {
+func (n *NFTables) parsePeers(ctx context.Context, peers []datastore.Peer, policyNamespace string, logger logr.Logger) (*peerInfo, error) {
 	logger.V(1).Info("Parsing peers", "peers", peers)
 
-	var pods []corev1.Pod
+	var pods []datastore.PodInfo
 	var cidrs []string
 	var excepts []string
 
 	// To avoid duplicates
-	podMap := make(map[string]corev1.Pod)
+	podMap := make(map[string]datastore.PodInfo)
 
-	for _, peer := range peers {
+	for i, peer := range peers {
 		if peer.IPBlock != nil {
 			cidrs = append(cidrs, peer.IPBlock.CIDR)
 			excepts = append(excepts, peer.IPBlock.Except...)
+			n.logPeerResolution(ctx, logger, i, peer, policyNamespace, nil, nil)
 
 			// When IPBlock is set, we don't need to check the other fields
 			continue
 		}
 
+		// The namespaces and the pods matched by the peer, for the render diagnostics
+		var peerNamespaces []corev1.Namespace
+		var peerPods []datastore.PodInfo
+
 		switch {
 		case peer.NamespaceSelector != nil && peer.PodSelector != nil:
 			// When both namespace selector and pod selector are set, we first need to get the namespaces by namespace selector
@@ -787,6 +1471,7 @@ func (n *NFTables) parsePeers(ctx context.Context, peers []multiv1beta1.MultiNet
 			if err != nil {
 				return nil, fmt.Errorf("failed to get namespaces by namespace selector: %w", err)
 			}
+			peerNamespaces = namespaces
 
 			for _, ns := range namespaces {
 				namespacePods, err := n.getPodsByPodSelector(ctx, peer.PodSelector, ns.Name)
@@ -794,9 +1479,7 @@ func (n *NFTables) parsePeers(ctx context.Context, peers []multiv1beta1.MultiNet
 					return nil, fmt.Errorf("failed to get pods by pod selector: %w", err)
 				}
 
-				for _, pod := range namespacePods {
-					podMap[pod.Namespace+"/"+pod.Name] = pod
-				}
+				peerPods = append(peerPods, namespacePods...)
 			}
 		case peer.NamespaceSelector != nil:
 			// When only namespace selector is set, we need to get the pods from the namespaces by namespace selector
@@ -805,6 +1488,7 @@ func (n *NFTables) parsePeers(ctx context.Context, peers []multiv1beta1.MultiNet
 			if err != nil {
 				return nil, fmt.Errorf("failed to get namespaces by namespace selector: %w", err)
 			}
+			peerNamespaces = namespaces
 
 			for _, ns := range namespaces {
 				namespacePods, err := n.getPodsByNamespace(ctx, ns.Name)
@@ -812,9 +1496,7 @@ func (n *NFTables) parsePeers(ctx context.Context, peers []multiv1beta1.MultiNet
 					return nil, fmt.Errorf("failed to get pods by namespace: %w", err)
 				}
 
-				for _, pod := range namespacePods {
-					podMap[pod.Namespace+"/"+pod.Name] = pod
-				}
+				peerPods = append(peerPods, namespacePods...)
 			}
 		case peer.PodSelector != nil:
 			// When only pod selector is set, we need to get the pods from the policy namespaces by pod selector
@@ -823,9 +1505,13 @@ func (n *NFTables) parsePeers(ctx context.Context, peers []multiv1beta1.MultiNet
 				return nil, fmt.Errorf("failed to get pods by pod selector: %w", err)
 			}
 
-			for _, pod := range filteredPods {
-				podMap[pod.Namespace+"/"+pod.Name] = pod
-			}
+			peerPods = filteredPods
+		}
+
+		n.logPeerResolution(ctx, logger, i, peer, policyNamespace, peerNamespaces, peerPods)
+
+		for _, pod := range peerPods {
+			podMap[pod.Namespace+"/"+pod.Name] = pod
 		}
 	}
 
@@ -842,7 +1528,7 @@ func (n *NFTables) parsePeers(ctx context.Context, peers []multiv1beta1.MultiNet
 }
 
 // getPodsByPodSelector gets the pods by pod selector
-func (n *NFTables) getPodsByPodSelector(ctx context.Context, selector *metav1.LabelSelector, namespace string) ([]corev1.Pod, error) {
+func (n *NFTables) getPodsByPodSelector(ctx context.Context, selector *metav1.LabelSelector, namespace string) ([]datastore.PodInfo, error) {
 	pods := &corev1.PodList{}
 
 	podSelector, err := metav1.LabelSelectorAsSelector(selector)
@@ -864,28 +1550,60 @@ func (n *NFTables) getPodsByPodSelector(ctx context.Context, selector *metav1.La
 		listOptions = append(listOptions, client.MatchingLabelsSelector{Selector: podSelector})
 	}
 
+	var generation uint64
+	if n.Selectors != nil {
+		cached, cachedGeneration, ok := n.Selectors.getPods(namespace, podSelector.String())
+		if ok {
+			return cached, nil
+		}
+		generation = cachedGeneration
+	}
+
 	err = n.Client.List(ctx, pods, listOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list pods: %w", err)
 	}
 
-	return pods.Items, nil
+	podInfos := make([]datastore.PodInfo, 0, len(pods.Items))
+	for i := range pods.Items {
+		podInfos = append(podInfos, newPodInfo(&pods.Items[i], n.Reservations))
+	}
+
+	if n.Selectors != nil {
+		n.Selectors.setPods(namespace, podSelector.String(), generation, podInfos)
+	}
+
+	return podInfos, nil
 }
 
-// getPodsByNamespace gets the pods by namespace
-func (n *NFTables) getPodsByNamespace(ctx context.Context, namespace string) ([]corev1.Pod, error) {
-	pods := &corev1.PodList{}
+// newPodInfo returns the compact representation of a peer pod. The interfaces missing from the network status take the
+// addresses reserved for them, when the reservations are not nil.
+func newPodInfo(pod *corev1.Pod, reservations *Reservations) datastore.PodInfo {
+	info := datastore.PodInfo{
+		UID:       pod.UID,
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		Phase:     string(pod.Status.Phase),
+		Labels:    pod.Labels,
+	}
 
-	err := n.Client.List(ctx, pods, client.InNamespace(namespace), client.MatchingFields{
-		PodStatusIndex:               string(corev1.PodRunning),
-		PodHostNetworkIndex:          "false",
-		PodHasNetworkAnnotationIndex: "true",
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list pods: %w", err)
+	interfaces := GetInterfaces(pod)
+	if reservations != nil {
+		interfaces = append(interfaces, reservations.reservedInterfaces(pod, interfaces)...)
+	}
+	interfaces = expandPeerInterfaceGroups(pod, interfaces)
+
+	for _, intf := range interfaces {
+		info.Interfaces = append(info.Interfaces, datastore.PodInterface{Name: intf.Name, Network: intf.Network, IPs: intf.IPs})
 	}
 
-	return pods.Items, nil
+	return info
+}
+
+// getPodsByNamespace gets the pods by namespace
+func (n *NFTables) getPodsByNamespace(ctx context.Context, namespace string) ([]datastore.PodInfo, error) {
+	// The empty selector matches all the pods
+	return n.getPodsByPodSelector(ctx, &metav1.LabelSelector{}, namespace)
 }
 
 // getNamespacesByNamespaceSelector gets the namespaces by namespace selector
@@ -904,52 +1622,114 @@ func (n *NFTables) getNamespacesByNamespaceSelector(ctx context.Context, selecto
 		listOptions = append(listOptions, client.MatchingLabelsSelector{Selector: namespaceSelector})
 	}
 
+	var generation uint64
+	if n.Selectors != nil {
+		cached, cachedGeneration, ok := n.Selectors.getNamespaces(namespaceSelector.String())
+		if ok {
+			return cached, nil
+		}
+		generation = cachedGeneration
+	}
+
 	err = n.Client.List(ctx, namespaces, listOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list namespaces: %w", err)
 	}
 
+	if n.Selectors != nil {
+		n.Selectors.setNamespaces(namespaceSelector.String(), generation, namespaces.Items)
+	}
+
 	return namespaces.Items, nil
 }
 
 // getPodInterfacesMap returns a map of valid interfaces per pod
-func getPodInterfacesMap(pods []corev1.Pod, networks []string) map[string][]Interface {
+func getPodInterfacesMap(pods []datastore.PodInfo, policy *datastore.Policy) map[string][]Interface {
 	// Create a map of valid interfaces per pod
 	podInterfacesMap := make(map[string][]Interface)
 	for _, pod := range pods {
-		podInterfacesMap[pod.Name+"/"+pod.Namespace] = getMatchedInterfaces(getInterfaces(&pod), networks)
+		interfaces := make([]Interface, 0, len(pod.Interfaces))
+		for _, intf := range pod.Interfaces {
+			interfaces = append(interfaces, Interface{Name: intf.Name, Network: intf.Network, IPs: intf.IPs})
+		}
+		podInterfacesMap[pod.Name+"/"+pod.Namespace] = getPeerInterfaces(interfaces, policy)
 	}
 
 	return podInterfacesMap
 }
 
+// getPeerInterfaces returns the interfaces of a peer pod whose addresses are allowed by a policy, the interfaces on the
+// networks of the policy and on the peer networks it includes. The addresses of the other attachments of the peer pods
+// would let them reach the pods from networks the policy is not for.
+func getPeerInterfaces(interfaces []Interface, policy *datastore.Policy) []Interface {
+	var peerInterfaces []Interface
+	for _, intf := range interfaces {
+		if slices.Contains(policy.Networks, intf.Network) || matchesPeerNetworks(intf.Network, policy.PeerNetworks) {
+			peerInterfaces = append(peerInterfaces, intf)
+		}
+	}
+
+	return peerInterfaces
+}
+
+// matchesPeerNetworks checks if a network, as <namespace>/<name>, matches one of the peer networks of a policy
+func matchesPeerNetworks(network string, peerNetworks []string) bool {
+	namespace, name, found := strings.Cut(network, "/")
+	if !found {
+		return false
+	}
+
+	return slices.ContainsFunc(peerNetworks, func(peerNetwork string) bool {
+		return datastore.MatchesNetwork(peerNetwork, namespace, name)
+	})
+}
+
 // classifyAddresses classifies the IP addresses into IPv4 and IPv6
 func classifyAddresses(interfacesPerPod map[string][]Interface, policy *datastore.Policy) ([]string, []string) {
 	var ipv4Addresses []string
 	var ipv6Addresses []string
 
+	for _, addresses := range classifyNetworkAddresses(interfacesPerPod, policy) {
+		ipv4Addresses = append(ipv4Addresses, addresses.ipv4...)
+		ipv6Addresses = append(ipv6Addresses, addresses.ipv6...)
+	}
+
+	return ipv4Addresses, ipv6Addresses
+}
+
+// classifyNetworkAddresses classifies the IP addresses into IPv4 and IPv6 by network, the networks of different
+// interfaces can use overlapping ranges
+func classifyNetworkAddresses(interfacesPerPod map[string][]Interface, policy *datastore.Policy) map[string]*networkAddresses {
+	networks := make(map[string]*networkAddresses)
+
 	for _, peerPodInterfaces := range interfacesPerPod {
-		matchedInterfaces := getMatchedInterfaces(peerPodInterfaces, policy.Networks)
-		for _, intf := range matchedInterfaces {
+		for _, intf := range getPeerInterfaces(peerPodInterfaces, policy) {
 			for _, ip := range intf.IPs {
 				// Parse the IP address to validate and classify it
-				parsedIP := net.ParseIP(ip)
-				if parsedIP == nil {
+				addr, err := netip.ParseAddr(ip)
+				if err != nil {
 					// Invalid IP address, skip it
 					continue
 				}
 
-				// Check if it's IPv4 (including IPv4-mapped IPv6)
-				if parsedIP.To4() != nil {
-					ipv4Addresses = append(ipv4Addresses, ip)
+				addresses, ok := networks[intf.Network]
+				if !ok {
+					addresses = &networkAddresses{}
+					networks[intf.Network] = addresses
+				}
+
+				// An IPv4-mapped IPv6 address is the IPv4 address on the wire
+				addr = addr.Unmap().WithZone("")
+				if addr.Is4() {
+					addresses.ipv4 = append(addresses.ipv4, addr.String())
 				} else {
-					ipv6Addresses = append(ipv6Addresses, ip)
+					addresses.ipv6 = append(addresses.ipv6, addr.String())
 				}
 			}
 		}
 	}
 
-	return ipv4Addresses, ipv6Addresses
+	return networks
 }
 
 // createAndPopulateIPSet creates and populates an IP set
@@ -0,0 +1,258 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// ErrNetNSNotFound is returned by the enforcers when the network namespace of a pod cannot be opened, e.g. when the
+// pod is gone
+var ErrNetNSNotFound = applier.ErrNetNSNotFound
+
+// Enforcer programs the policies in the network namespaces of the pods, NFTables computes the policies and the pods
+// they apply to. The errors wrap ErrNetNSNotFound when the network namespace of the pod is gone.
+type Enforcer interface {
+	// Sandbox returns the network namespace path of a pod
+	Sandbox(ctx context.Context, pod *corev1.Pod) (string, error)
+	// Enforce applies policies in order to the interfaces of a pod in a single entry of its network namespace, replacing
+	// the rules previously applied for them. It returns the number of policies applied before the first error.
+	Enforce(ctx context.Context, sandbox string, pod *corev1.Pod, interfaces []Interface, policies []*datastore.Policy, logger logr.Logger) (int, error)
+	// CleanUp removes the rules of a policy from the network namespace of a pod
+	CleanUp(ctx context.Context, sandbox string, policy types.NamespacedName, logger logr.Logger) error
+	// Enforced checks if a policy is applied in the network namespace of a pod
+	Enforced(ctx context.Context, sandbox string, policy *datastore.Policy) (bool, error)
+}
+
+var (
+	_ Enforcer = nftablesEnforcer{}
+	_ Enforcer = &FakeEnforcer{}
+)
+
+// enforcer returns the enforcer of the policies, the nftables enforcer when none is set
+func (n *NFTables) enforcer() Enforcer {
+	if n.Enforcer != nil {
+		return n.Enforcer
+	}
+
+	return nftablesEnforcer{n: n}
+}
+
+// nftablesEnforcer applies the policies with nft in the network namespaces of the pods
+type nftablesEnforcer struct {
+	n *NFTables
+}
+
+func (e nftablesEnforcer) Sandbox(ctx context.Context, pod *corev1.Pod) (string, error) {
+	return e.n.sandbox(ctx, pod)
+}
+
+func (e nftablesEnforcer) Enforce(ctx context.Context, sandbox string, pod *corev1.Pod, interfaces []Interface, policies []*datastore.Policy, logger logr.Logger) (int, error) {
+	// The early deny of another pod sharing the network namespace is not installed while the tables are created
+	defer e.n.netnsLocks.lock(sandbox, false)()
+
+	applied := 0
+	err := e.n.withNetNS(ctx, sandbox, func(ctx context.Context) error {
+		for i, policy := range policies {
+			logger := logger
+			if i > 0 {
+				logger = logger.WithValues("pendingPolicy", policy.Namespace+"/"+policy.Name)
+			}
+
+			if err := e.enforce(ctx, pod, interfaces, policy, logger); err != nil {
+				return err
+			}
+			applied++
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// enforce applies a policy to the interfaces of a pod, in its network namespace
+func (e nftablesEnforcer) enforce(ctx context.Context, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy, logger logr.Logger) error {
+	// The rules match the interfaces by name, the policy is not applied until they all exist
+	if utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels) {
+		matched := getPolicyInterfaces(interfaces, policy, pod)
+		skipped, err := e.n.checkInterfaces(ctx, pod, matched, logger)
+		if err != nil {
+			return err
+		}
+
+		if len(skipped) > 0 {
+			interfaces = slices.DeleteFunc(slices.Clone(interfaces), func(intf Interface) bool {
+				return slices.Contains(skipped, intf.Name)
+			})
+		}
+	}
+
+	return e.n.enforcePolicy(ctx, pod, interfaces, policy, logger)
+}
+
+func (e nftablesEnforcer) CleanUp(ctx context.Context, sandbox string, policy types.NamespacedName, logger logr.Logger) error {
+	return e.n.withNetNS(ctx, sandbox, func(ctx context.Context) error {
+		return e.n.cleanUpPolicy(ctx, policy.Name, policy.Namespace, logger)
+	})
+}
+
+func (e nftablesEnforcer) Enforced(ctx context.Context, sandbox string, policy *datastore.Policy) (bool, error) {
+	var present bool
+	err := e.n.withNetNS(ctx, sandbox, func(ctx context.Context) error {
+		nft, err := newNetNSNFTables(ctx, e.n.Exec, e.n.Applier, tableName)
+		if err != nil {
+			return fmt.Errorf("failed to create nftables client: %w", err)
+		}
+
+		present, err = isPolicyPresent(ctx, nft, policy)
+		return err
+	})
+
+	return present, err
+}
+
+// FakeEnforcement is a policy enforced on a pod by the fake enforcer
+type FakeEnforcement struct {
+	Pod        types.NamespacedName
+	Interfaces []Interface
+	Policy     *datastore.Policy
+}
+
+// FakeEnforcer is an in-memory enforcer recording the policies enforced in each network namespace, it tests the
+// controllers without the privileges of entering the network namespaces. The policies are recorded for all the pods
+// they are synced to, the pods not selected by their pod selector included, which the nftables enforcer cleans up.
+type FakeEnforcer struct {
+	mu sync.Mutex
+	// Err is returned by Enforce and CleanUp when it is set
+	Err error
+
+	// sandboxes are the network namespaces of the pods
+	sandboxes map[types.NamespacedName]string
+	// enforced are the policies enforced in each network namespace
+	enforced map[string]map[types.NamespacedName]FakeEnforcement
+	// gone are the network namespaces that cannot be opened anymore
+	gone map[string]bool
+	// entries counts the entries of each network namespace to enforce policies
+	entries map[string]int
+}
+
+// NewFakeEnforcer returns a fake enforcer without enforced policies
+func NewFakeEnforcer() *FakeEnforcer {
+	return &FakeEnforcer{
+		sandboxes: make(map[types.NamespacedName]string),
+		enforced:  make(map[string]map[types.NamespacedName]FakeEnforcement),
+		gone:      make(map[string]bool),
+		entries:   make(map[string]int),
+	}
+}
+
+// SetSandbox sets the network namespace of a pod, the pods without one are in /var/run/netns/cni-<uid>
+func (f *FakeEnforcer) SetSandbox(pod types.NamespacedName, sandbox string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sandboxes[pod] = sandbox
+}
+
+// DeleteSandbox deletes a network namespace with its policies, as when its pod is gone
+func (f *FakeEnforcer) DeleteSandbox(sandbox string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.enforced, sandbox)
+	f.gone[sandbox] = true
+}
+
+// Policies returns the policies enforced in a network namespace
+func (f *FakeEnforcer) Policies(sandbox string) map[types.NamespacedName]FakeEnforcement {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return maps.Clone(f.enforced[sandbox])
+}
+
+// Entries returns the number of times policies were enforced in a network namespace
+func (f *FakeEnforcer) Entries(sandbox string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.entries[sandbox]
+}
+
+func (f *FakeEnforcer) Sandbox(_ context.Context, pod *corev1.Pod) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if sandbox, ok := f.sandboxes[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]; ok {
+		return sandbox, nil
+	}
+
+	return fmt.Sprintf("/var/run/netns/cni-%s", pod.UID), nil
+}
+
+func (f *FakeEnforcer) Enforce(_ context.Context, sandbox string, pod *corev1.Pod, interfaces []Interface, policies []*datastore.Policy, _ logr.Logger) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(sandbox); err != nil {
+		return 0, err
+	}
+
+	if f.enforced[sandbox] == nil {
+		f.enforced[sandbox] = make(map[types.NamespacedName]FakeEnforcement)
+	}
+	for _, policy := range policies {
+		f.enforced[sandbox][types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}] = FakeEnforcement{
+			Pod:        types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name},
+			Interfaces: interfaces,
+			Policy:     policy,
+		}
+	}
+	f.entries[sandbox]++
+
+	return len(policies), nil
+}
+
+func (f *FakeEnforcer) CleanUp(_ context.Context, sandbox string, policy types.NamespacedName, _ logr.Logger) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(sandbox); err != nil {
+		return err
+	}
+
+	delete(f.enforced[sandbox], policy)
+	return nil
+}
+
+func (f *FakeEnforcer) Enforced(_ context.Context, sandbox string, policy *datastore.Policy) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.gone[sandbox] {
+		return false, fmt.Errorf("%w: %s", ErrNetNSNotFound, sandbox)
+	}
+
+	_, ok := f.enforced[sandbox][types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}]
+	return ok, nil
+}
+
+// check returns the error of the enforcement in a network namespace, f.mu must be held
+func (f *FakeEnforcer) check(sandbox string) error {
+	if f.gone[sandbox] {
+		return fmt.Errorf("%w: %s", ErrNetNSNotFound, sandbox)
+	}
+
+	return f.Err
+}
@@ -0,0 +1,184 @@
+package nftables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// PodExclusion selects pods the policies are never applied to, e.g. the CNI daemons or the monitoring agents with
+// secondary interfaces. The excluded pods are still peers of the rules of the policies.
+type PodExclusion struct {
+	// NamespaceSelector selects the namespaces of the pods, nil selects all the namespaces
+	NamespaceSelector *metav1.LabelSelector
+	// PodSelector selects the pods in the namespaces, nil selects all their pods
+	PodSelector *metav1.LabelSelector
+}
+
+// SetExcludedPods replaces the exclusions of the pods, they are applied on the next sync of each policy
+func (n *NFTables) SetExcludedPods(exclusions []PodExclusion) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.ExcludedPods = exclusions
+}
+
+// getExcludedPods returns the current exclusions of the pods
+func (n *NFTables) getExcludedPods() []PodExclusion {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.ExcludedPods
+}
+
+// podExclusion returns the function checking if a pod of a namespace is excluded, nil when no pod of the namespace can
+// be excluded
+func (n *NFTables) podExclusion(ctx context.Context, namespace string) (func(pod *corev1.Pod) bool, error) {
+	exclusions := n.getExcludedPods()
+	if len(exclusions) == 0 {
+		return nil, nil
+	}
+
+	var namespaceLabels map[string]string
+	var podSelectors []*metav1.LabelSelector
+	for _, exclusion := range exclusions {
+		if exclusion.NamespaceSelector != nil {
+			if namespaceLabels == nil {
+				ns := &corev1.Namespace{}
+				if err := n.Client.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+					return nil, fmt.Errorf("failed to get namespace %s of the excluded pods: %w", namespace, err)
+				}
+				namespaceLabels = ns.Labels
+			}
+
+			if !utils.MatchesSelector(*exclusion.NamespaceSelector, namespaceLabels) {
+				continue
+			}
+		}
+
+		podSelectors = append(podSelectors, exclusion.PodSelector)
+	}
+
+	if len(podSelectors) == 0 {
+		return nil, nil
+	}
+
+	return func(pod *corev1.Pod) bool {
+		for _, selector := range podSelectors {
+			if selector == nil || utils.MatchesSelector(*selector, pod.Labels) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// excludePods splits the pods of a namespace between the pods the policies can be applied to and the excluded pods
+func (n *NFTables) excludePods(ctx context.Context, namespace string, pods []corev1.Pod) ([]corev1.Pod, []corev1.Pod, error) {
+	excluded, err := n.podExclusion(ctx, namespace)
+	if err != nil || excluded == nil {
+		return pods, nil, err
+	}
+
+	var targets, excludedPods []corev1.Pod
+	for _, pod := range pods {
+		if excluded(&pod) {
+			excludedPods = append(excludedPods, pod)
+		} else {
+			targets = append(targets, pod)
+		}
+	}
+
+	return targets, excludedPods, nil
+}
+
+// releaseExcludedPods cleans up a policy from the excluded pods it was applied to before they were excluded. With the
+// applied states, only the pods with an applied state are cleaned up, otherwise the policy is looked up in the network
+// namespace of each excluded pod. The network namespaces the policy was synced to for another pod sharing them are
+// not cleaned up.
+func (n *NFTables) releaseExcludedPods(ctx context.Context, policy *datastore.Policy, pods []corev1.Pod, synced map[string]bool, logger logr.Logger) error {
+	policyKey := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+	enforcer := n.enforcer()
+
+	for _, pod := range pods {
+		logger := logger.WithValues("pod", pod.Name, "namespace", pod.Namespace)
+		podKey := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+		if len(GetInterfaces(&pod)) == 0 {
+			continue
+		}
+
+		if n.State != nil {
+			state, ok := n.State.GetAppliedState(policyKey, podKey)
+			if !ok {
+				continue
+			}
+			if state.Hash == emptyRulesetHash {
+				n.forgetAppliedState(policyKey, podKey)
+				continue
+			}
+		}
+
+		release, err := n.acquireNetNS(ctx)
+		if err != nil {
+			return err
+		}
+
+		cleaned, err := func() (bool, error) {
+			defer release()
+
+			sandbox, err := enforcer.Sandbox(ctx, &pod)
+			if err != nil {
+				return false, fmt.Errorf("failed to get network namespace path: %w", err)
+			}
+
+			if synced[sandbox] {
+				return false, nil
+			}
+
+			if n.State == nil {
+				enforced, err := enforcer.Enforced(ctx, sandbox, policy)
+				if err != nil || !enforced {
+					return false, err
+				}
+			}
+
+			end := n.beginTransaction(policyKey, &pod, sandbox, datastore.IntentCleanUp)
+			defer end()
+
+			return true, enforcer.CleanUp(ctx, sandbox, policyKey, logger)
+		}()
+		if errors.Is(err, ErrNetNSNotFound) {
+			logger.V(1).Info("Failed to open network namespace, skipping")
+			continue
+		}
+		if err != nil {
+			return NewSyncError("failed to clean up NFTables policies from excluded pod %s: %v", podKey, err)
+		}
+
+		n.forgetAppliedState(policyKey, podKey)
+		if !cleaned {
+			continue
+		}
+
+		logger.Info("Policy cleaned up from excluded pod")
+		n.setElements.set(podKey, policyKey, 0)
+
+		if n.EnforcementAnnotations {
+			n.annotateEnforcement(ctx, &pod, GetInterfaces(&pod), policy, SyncOperationDelete, nil, logger)
+		}
+		if n.RecordNetworkStatistics {
+			n.recordNetworkStatistics(ctx, &pod, GetInterfaces(&pod), policy, SyncOperationDelete, -1, logger)
+		}
+	}
+
+	return nil
+}
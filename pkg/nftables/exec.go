@@ -0,0 +1,133 @@
+package nftables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/nftexec"
+)
+
+// ExecOptions configure the execution of the nft binary
+type ExecOptions struct {
+	// Path is the nft binary, it is looked up in PATH when empty
+	Path string
+	// Env is the extra environment of the nft binary, as KEY=VALUE
+	Env []string
+	// Timeout kills the nft invocations running longer, 0 disables the timeout
+	Timeout time.Duration
+}
+
+// Validate checks that the nft binary is executable and that the extra environment is valid
+func (o ExecOptions) Validate() error {
+	return o.nftexec().Validate()
+}
+
+// nftexec returns the options of the nft invocations, the binary and the extra environment are only set on them and
+// the environment of the process is not changed
+func (o ExecOptions) nftexec() nftexec.Options {
+	return nftexec.Options{Path: o.Path, Env: o.Env}
+}
+
+// newNFTables returns an nftables client of the table in the current network namespace, or in the network namespace
+// of the applier when the client is set
+func newNFTables(exec ExecOptions, client *applier.Client, table string) (knftables.Interface, error) {
+	return newNetNSNFTables(context.Background(), exec, client, table)
+}
+
+// newLocalNFTables returns an nftables client of the table running nft, applying the execution timeout
+func newLocalNFTables(exec ExecOptions, table string) (knftables.Interface, error) {
+	nft, err := nftexec.New(knftables.InetFamily, table, exec.nftexec())
+	if err != nil {
+		return nil, err
+	}
+
+	if exec.Timeout > 0 {
+		nft = &timeoutNFTables{Interface: nft, timeout: exec.Timeout}
+	}
+
+	return &execNFTables{Interface: nft, exec: exec.nftexec(), table: table, timeout: exec.Timeout}, nil
+}
+
+// execNFTables runs nft directly to create the objects that the transactions do not support
+type execNFTables struct {
+	knftables.Interface
+	exec    nftexec.Options
+	table   string
+	timeout time.Duration
+}
+
+// AddConntrackTimeouts adds the ct timeout objects to the table, creating the table when it does not exist
+func (e *execNFTables) AddConntrackTimeouts(ctx context.Context, timeouts []conntrackTimeout) error {
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+
+	if err := e.exec.RunScript(ctx, conntrackTimeoutsScript(e.table, timeouts), false); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("nft did not complete within %s: %w", e.timeout, err)
+		}
+		return fmt.Errorf("failed to add conntrack timeouts: %w", err)
+	}
+
+	return nil
+}
+
+// timeoutNFTables kills the nft invocations running longer than the timeout
+type timeoutNFTables struct {
+	knftables.Interface
+	timeout time.Duration
+}
+
+func (t *timeoutNFTables) Run(ctx context.Context, tx *knftables.Transaction) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	return t.wrapError(ctx, t.Interface.Run(ctx, tx))
+}
+
+func (t *timeoutNFTables) Check(ctx context.Context, tx *knftables.Transaction) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	return t.wrapError(ctx, t.Interface.Check(ctx, tx))
+}
+
+func (t *timeoutNFTables) List(ctx context.Context, objectType string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	result, err := t.Interface.List(ctx, objectType)
+	return result, t.wrapError(ctx, err)
+}
+
+func (t *timeoutNFTables) ListRules(ctx context.Context, chain string) ([]*knftables.Rule, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	result, err := t.Interface.ListRules(ctx, chain)
+	return result, t.wrapError(ctx, err)
+}
+
+func (t *timeoutNFTables) ListElements(ctx context.Context, objectType, name string) ([]*knftables.Element, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	result, err := t.Interface.ListElements(ctx, objectType, name)
+	return result, t.wrapError(ctx, err)
+}
+
+// wrapError reports the nft invocations killed by the timeout
+func (t *timeoutNFTables) wrapError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("nft did not complete within %s: %w", t.timeout, err)
+	}
+
+	return err
+}
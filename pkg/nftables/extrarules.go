@@ -0,0 +1,148 @@
+package nftables
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// ExtraRules are rules requested by another controller for the pods of a namespace, added to the common chains of
+// the selected pods after the common rules
+type ExtraRules struct {
+	Namespace string
+	Name      string
+	// PodSelector selects the pods of the namespace, an empty selector selects all the pods
+	PodSelector metav1.LabelSelector
+	// Interfaces restricts the rules to the interfaces with these names, empty adds them to all the interfaces
+	Interfaces []string
+	Ingress    []string
+	Egress     []string
+}
+
+// forbiddenExtraRuleStatements are the statements the extra rules cannot use, they would leave the common chains or
+// hand the packets to another program
+var forbiddenExtraRuleStatements = []string{"jump", "goto", "queue"}
+
+// Validate checks that the extra rules are single statements that stay in the common chains
+func (e *ExtraRules) Validate() error {
+	if _, err := metav1.LabelSelectorAsSelector(&e.PodSelector); err != nil {
+		return fmt.Errorf("invalid pod selector: %w", err)
+	}
+
+	for _, rule := range slices.Concat(e.Ingress, e.Egress) {
+		if strings.TrimSpace(rule) == "" {
+			return fmt.Errorf("empty extra rule")
+		}
+		if strings.ContainsAny(rule, ";\n\r") {
+			return fmt.Errorf("invalid extra rule %q: multiple statements", rule)
+		}
+		if strings.Contains(rule, "{{") {
+			return fmt.Errorf("invalid extra rule %q: templates are not supported", rule)
+		}
+		for _, field := range strings.Fields(rule) {
+			if slices.Contains(forbiddenExtraRuleStatements, field) {
+				return fmt.Errorf("invalid extra rule %q: %s is not allowed", rule, field)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetExtraRules replaces the extra rules of an object, nil deletes them. They are applied on the next enforcement of
+// each policy.
+func (n *NFTables) SetExtraRules(key types.NamespacedName, rules *ExtraRules) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// The map is kept once the extra rules are used, the common chains are then always flushed to remove the rules of
+	// the deleted objects
+	if n.extraRules == nil {
+		n.extraRules = make(map[types.NamespacedName]*ExtraRules)
+	}
+
+	if rules == nil {
+		delete(n.extraRules, key)
+		return
+	}
+
+	n.extraRules[key] = rules
+}
+
+// podExtraRules returns the extra rules selecting the pod, restricted to their interfaces, in the order of the names
+// of their objects. enabled is false when no extra rules were ever set.
+func (n *NFTables) podExtraRules(pod *corev1.Pod, interfaces []Interface) (rules []*knftables.Rule, enabled bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.extraRules == nil {
+		return nil, false
+	}
+
+	keys := make([]types.NamespacedName, 0, len(n.extraRules))
+	for key := range n.extraRules {
+		if key.Namespace == pod.Namespace {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b types.NamespacedName) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	for _, key := range keys {
+		extra := n.extraRules[key]
+		if !utils.MatchesSelector(extra.PodSelector, pod.Labels) {
+			continue
+		}
+
+		var names []string
+		for _, iface := range interfaces {
+			if len(extra.Interfaces) == 0 || slices.Contains(extra.Interfaces, iface.Name) {
+				names = append(names, iface.Name)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		slices.Sort(names)
+		names = slices.Compact(names)
+		set := "{ " + strings.Join(names, ", ") + " }"
+
+		comment := fmt.Sprintf("extra-rules:%s/%s", key.Namespace, key.Name)
+		for _, rule := range extra.Ingress {
+			rules = append(rules, &knftables.Rule{
+				Chain:   commonIngressChain,
+				Rule:    knftables.Concat("iifname", set, rule),
+				Comment: knftables.PtrTo(comment),
+			})
+		}
+		for _, rule := range extra.Egress {
+			rules = append(rules, &knftables.Rule{
+				Chain:   commonEgressChain,
+				Rule:    knftables.Concat("oifname", set, rule),
+				Comment: knftables.PtrTo(comment),
+			})
+		}
+	}
+
+	return rules, true
+}
+
+// withExtraRules returns the common rules with the extra rules of the pod, c can be nil. The result is not nil so
+// that the common chains are flushed when the extra rules are enabled.
+func (c *CommonRules) withExtraRules(rules []*knftables.Rule) *CommonRules {
+	var extended CommonRules
+	if c != nil {
+		extended = *c
+	}
+	extended.extraRules = rules
+
+	return &extended
+}
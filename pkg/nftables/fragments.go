@@ -0,0 +1,54 @@
+package nftables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// createFragmentRules drops the non-first IPv4 and IPv6 fragments on the interfaces of the networks dropping the
+// fragments, in both directions. The chains run before the defragmentation, the first fragments are then never
+// reassembled and the fragmented packets cannot bypass the ports of the rules.
+func createFragmentRules(tx *knftables.Transaction, matchedInterfaces []Interface, policy *datastore.Policy, logger logr.Logger) {
+	var names []string
+	for _, intf := range matchedInterfaces {
+		if policy.Fragments[intf.Network] == datastore.FragmentsDrop {
+			names = append(names, intf.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	logger.V(1).Info("Creating fragment rules", "interfaces", names)
+	for _, c := range []struct {
+		name      string
+		hook      knftables.BaseChainHook
+		direction string
+	}{
+		{name: fragmentPreroutingChain, hook: knftables.PreroutingHook, direction: "iifname"},
+		{name: fragmentOutputChain, hook: knftables.OutputHook, direction: "oifname"},
+	} {
+		tx.Add(&knftables.Chain{
+			Name:     c.name,
+			Type:     knftables.PtrTo(knftables.FilterType),
+			Hook:     knftables.PtrTo(c.hook),
+			Priority: knftables.PtrTo(preDefragPriority),
+			Comment:  knftables.PtrTo("Fragments"),
+		})
+
+		interfacesMatch := knftables.Concat(c.direction, "{", strings.Join(names, ", "), "}")
+		for _, match := range []string{"ip frag-off & 0x1fff != 0", "frag frag-off != 0"} {
+			tx.Add(&knftables.Rule{
+				Chain:   c.name,
+				Rule:    knftables.Concat(interfacesMatch, match, "drop"),
+				Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)),
+			})
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package nftables
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// createICMPHardeningRules drops the ICMP redirects and the ICMPv6 redirects and router advertisements arriving on the
+// interfaces of the hardened networks, except from their trusted gateways. The chain runs before the input chain, so
+// that the related redirects are not accepted by the connection tracking rule nor by the ICMP options. The interfaces
+// of the layer 3 networks have no neighbors to be redirected to nor routers to learn, they are not hardened.
+func createICMPHardeningRules(tx *knftables.Transaction, matchedInterfaces []Interface, policy *datastore.Policy, logger logr.Logger) {
+	if len(policy.ICMPHardening) == 0 {
+		return
+	}
+
+	// The interfaces are grouped by network, the networks having their own trusted gateways
+	var networks []string
+	networkInterfaces := make(map[string][]string)
+	for _, intf := range matchedInterfaces {
+		if _, ok := policy.ICMPHardening[intf.Network]; !ok {
+			continue
+		}
+
+		if slices.Contains(policy.L3Networks, intf.Network) {
+			logger.V(1).Info("Skipping ICMP hardening of layer 3 network", "network", intf.Network, "interface", intf.Name)
+			continue
+		}
+
+		if _, ok := networkInterfaces[intf.Network]; !ok {
+			networks = append(networks, intf.Network)
+		}
+		networkInterfaces[intf.Network] = append(networkInterfaces[intf.Network], intf.Name)
+	}
+
+	if len(networks) == 0 {
+		return
+	}
+
+	tx.Add(&knftables.Chain{
+		Name:     icmpHardeningChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.InputHook),
+		Priority: knftables.PtrTo(knftables.ManglePriority),
+		Comment:  knftables.PtrTo("ICMP Hardening"),
+	})
+
+	for _, network := range networks {
+		logger.V(1).Info("Creating ICMP hardening rules", "network", network, "interfaces", networkInterfaces[network])
+
+		var ipv4Gateways, ipv6Gateways []string
+		for _, gateway := range policy.ICMPHardening[network].Gateways {
+			if netip.MustParseAddr(gateway).Is4() {
+				ipv4Gateways = append(ipv4Gateways, gateway)
+			} else {
+				ipv6Gateways = append(ipv6Gateways, gateway)
+			}
+		}
+
+		interfacesMatch := knftables.Concat("iifname", "{", strings.Join(networkInterfaces[network], ", "), "}")
+		for _, r := range []struct {
+			match    string
+			addr     string
+			gateways []string
+		}{
+			{match: "icmp type redirect", addr: "ip saddr", gateways: ipv4Gateways},
+			{match: "icmpv6 type { nd-redirect, nd-router-advert }", addr: "ip6 saddr", gateways: ipv6Gateways},
+		} {
+			rule := knftables.Concat(interfacesMatch, r.match)
+			if len(r.gateways) > 0 {
+				rule = knftables.Concat(rule, r.addr, "!=", "{", strings.Join(r.gateways, ", "), "}")
+			}
+
+			tx.Add(&knftables.Rule{
+				Chain:   icmpHardeningChain,
+				Rule:    knftables.Concat(rule, "drop"),
+				Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)),
+			})
+		}
+	}
+}
+
+// preDefragPriority is the priority of the chains matching the fragments, before the defragmentation at -400
+// reassembles them and removes the IPv6 fragment headers
+const preDefragPriority knftables.BaseChainPriority = "-450"
+
+// createIPv6ExthdrRules drops the IPv6 packets with a type 0 routing header, deprecated by RFC 5095, and the
+// fragmented neighbor discovery messages, forbidden by RFC 6980, arriving on the managed interfaces of the policy
+func createIPv6ExthdrRules(tx *knftables.Transaction, hashName string, policy *datastore.Policy, logger logr.Logger) {
+	logger.V(1).Info("Creating IPv6 extension headers rules")
+
+	tx.Add(&knftables.Chain{
+		Name:     ipv6ExthdrChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.PreroutingHook),
+		Priority: knftables.PtrTo(preDefragPriority),
+		Comment:  knftables.PtrTo("IPv6 Extension Headers"),
+	})
+
+	interfacesMatch := knftables.Concat("iifname", fmt.Sprintf("@%s%s", prefixManagedInterfacesSet, hashName))
+	for _, match := range []string{
+		"rt type 0",
+		"exthdr frag exists meta l4proto ipv6-icmp icmpv6 type { nd-router-solicit, nd-router-advert, nd-neighbor-solicit, nd-neighbor-advert, nd-redirect }",
+	} {
+		tx.Add(&knftables.Rule{
+			Chain:   ipv6ExthdrChain,
+			Rule:    knftables.Concat(interfacesMatch, match, "drop"),
+			Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)),
+		})
+	}
+}
+
+// invalidTCPFlags are the matches of the invalid TCP flag combinations, sent by the NULL, XMAS and SYN-FIN scans
+var invalidTCPFlags = []string{
+	"tcp flags & (fin|syn|rst|psh|ack|urg) == 0x0",
+	"tcp flags & (fin|psh|urg) == fin|psh|urg",
+	"tcp flags & (syn|fin) == syn|fin",
+	"tcp flags & (syn|rst) == syn|rst",
+}
+
+// createTCPFlagsRules drops the TCP packets with invalid flag combinations arriving on the managed interfaces of the
+// policy. The chain runs before the connection tracking, so that the scans do not create connection tracking entries.
+func createTCPFlagsRules(tx *knftables.Transaction, hashName string, policy *datastore.Policy, logger logr.Logger) {
+	logger.V(1).Info("Creating TCP flags rules")
+
+	tx.Add(&knftables.Chain{
+		Name:     tcpFlagsChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.PreroutingHook),
+		Priority: knftables.PtrTo(knftables.RawPriority),
+		Comment:  knftables.PtrTo("TCP Flags"),
+	})
+
+	interfacesMatch := knftables.Concat("iifname", fmt.Sprintf("@%s%s", prefixManagedInterfacesSet, hashName))
+	for _, match := range invalidTCPFlags {
+		tx.Add(&knftables.Rule{
+			Chain:   tcpFlagsChain,
+			Rule:    knftables.Concat(interfacesMatch, match, "drop"),
+			Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)),
+		})
+	}
+}
+
+// createSYNLimitRules drops the TCP SYN packets received by each matched interface above the rate limit. Each
+// interface has its own rule, so that a flood on an interface does not starve the others, and the chain runs before
+// the connection tracking, so that the flood does not fill the connection tracking table.
+func createSYNLimitRules(tx *knftables.Transaction, matchedInterfaces []Interface, synRateLimit *SYNRateLimit, policy *datastore.Policy, logger logr.Logger) {
+	logger.V(1).Info("Creating SYN limit rules", "rate", synRateLimit.Rate, "burst", synRateLimit.Burst)
+
+	tx.Add(&knftables.Chain{
+		Name:     synLimitChain,
+		Type:     knftables.PtrTo(knftables.FilterType),
+		Hook:     knftables.PtrTo(knftables.PreroutingHook),
+		Priority: knftables.PtrTo(knftables.RawPriority),
+		Comment:  knftables.PtrTo("SYN Limit"),
+	})
+
+	for _, intf := range matchedInterfaces {
+		tx.Add(&knftables.Rule{
+			Chain: synLimitChain,
+			Rule: knftables.Concat(
+				"iifname", intf.Name, "tcp flags & (fin|syn|rst|ack) == syn",
+				"limit rate over", synRateLimit.Rate, "burst", synRateLimit.Burst, "packets", "drop",
+			),
+			Comment: knftables.PtrTo(fmt.Sprintf("%s/%s", policy.Namespace, policy.Name)),
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package nftables
+
+import (
+	"context"
+	"time"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// acquireNetNS waits for a slot to query the container runtime or to enter a network namespace, so that a slow
+// container runtime or nft queues the pods instead of blocking a goroutine per pod in them. It returns the function
+// releasing the slot, or the error of the context when it is done before a slot is free.
+func (n *NFTables) acquireNetNS(ctx context.Context) (func(), error) {
+	n.inFlightOnce.Do(func() {
+		if n.MaxInFlight > 0 {
+			n.inFlight = make(chan struct{}, n.MaxInFlight)
+		}
+	})
+
+	if n.inFlight == nil {
+		return func() {}, nil
+	}
+
+	start := time.Now()
+	metrics.NetNSWaiting.Inc()
+	defer metrics.NetNSWaiting.Dec()
+
+	select {
+	case n.inFlight <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	metrics.NetNSQueueDuration.Observe(time.Since(start).Seconds())
+	metrics.NetNSInFlight.Inc()
+
+	return func() {
+		metrics.NetNSInFlight.Dec()
+		<-n.inFlight
+	}, nil
+}
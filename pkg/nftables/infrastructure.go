@@ -0,0 +1,75 @@
+package nftables
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// createInfrastructureRules creates the rules accepting the infrastructure of the networks of the matched interfaces in
+// the policy chain. The addresses are accepted from them on ingress and to them on egress, the DNS servers are only
+// accepted on the DNS port on egress, their replies are tracked. Without the connection tracking, the replies of the DNS
+// servers are accepted from their DNS port on ingress.
+func createInfrastructureRules(tx *knftables.Transaction, matchedInterfaces []Interface, infrastructure map[string]datastore.Infrastructure, npChain policyChain, egress bool, stateless bool, logger logr.Logger) {
+	if len(infrastructure) == 0 {
+		return
+	}
+
+	direction, addrField := "iifname", "saddr"
+	if egress {
+		direction, addrField = "oifname", "daddr"
+	}
+
+	// The interfaces are grouped by network, a network can have several interfaces in the pod
+	var networks []string
+	networkInterfaces := make(map[string][]string)
+	for _, intf := range matchedInterfaces {
+		if _, ok := infrastructure[intf.Network]; !ok {
+			continue
+		}
+
+		if !slices.Contains(networks, intf.Network) {
+			networks = append(networks, intf.Network)
+		}
+		networkInterfaces[intf.Network] = append(networkInterfaces[intf.Network], intf.Name)
+	}
+
+	for _, network := range networks {
+		logger.V(1).Info("Creating infrastructure rules", "network", network, "interfaces", networkInterfaces[network])
+
+		interfacesMatch := knftables.Concat(direction, "{", strings.Join(networkInterfaces[network], ", "), "}")
+		comment := knftables.PtrTo(fmt.Sprintf("Infrastructure %s", network))
+
+		addInfrastructureRules(tx, npChain, interfacesMatch, addrField, infrastructure[network].Addresses, "accept", comment)
+		if egress {
+			addInfrastructureRules(tx, npChain, interfacesMatch, addrField, infrastructure[network].DNSServers, "meta l4proto { tcp, udp } th dport 53 accept", comment)
+		} else if stateless {
+			// The DNS replies are not accepted by the connection tracking
+			addInfrastructureRules(tx, npChain, interfacesMatch, addrField, infrastructure[network].DNSServers, "meta l4proto { tcp, udp } th sport 53 accept", comment)
+		}
+	}
+}
+
+// addInfrastructureRules adds a rule per family of the CIDRs, matching them on an address field before the statement
+func addInfrastructureRules(tx *knftables.Transaction, npChain policyChain, interfacesMatch string, addrField string, cidrs []string, statement string, comment *string) {
+	ipv4CIDRs, ipv6CIDRs := utils.SplitCIDRs(cidrs)
+	for _, family := range []struct {
+		family string
+		cidrs  []string
+	}{
+		{family: "ip", cidrs: ipv4CIDRs},
+		{family: "ip6", cidrs: ipv6CIDRs},
+	} {
+		if len(family.cidrs) == 0 {
+			continue
+		}
+
+		tx.Add(npChain.rule(knftables.Concat(interfacesMatch, family.family, addrField, "{", strings.Join(family.cidrs, ", "), "}", statement), comment))
+	}
+}
@@ -0,0 +1,143 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// MissingInterfacesError is returned when interfaces of the network status of a pod a policy applies to are missing
+// from its network namespace, e.g. after a CNI failure or a rename, the policy is not applied to the pod until they
+// appear
+type MissingInterfacesError struct {
+	Interfaces []string
+}
+
+func (e *MissingInterfacesError) Error() string {
+	return fmt.Sprintf("interfaces %s of the network status are missing from the network namespace", strings.Join(e.Interfaces, ", "))
+}
+
+// listNetNSInterfaces returns the names of the interfaces of the network namespace of the context, listed by the
+// applier when the client is set
+func listNetNSInterfaces(ctx context.Context, client *applier.Client) ([]string, error) {
+	netnsPath, _ := ctx.Value(netnsContextKey{}).(string)
+
+	if client != nil {
+		return client.Interfaces(ctx, netnsPath, tableName)
+	}
+
+	links, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	names := make([]string, 0, len(links))
+	for _, link := range links {
+		names = append(names, link.Name)
+	}
+
+	return names, nil
+}
+
+// checkInterfaces checks the interfaces the policy applies to against the interfaces of the network namespace of the
+// context. It returns a MissingInterfacesError when some are missing, and reports the interfaces of the network
+// namespace missing from the network status, which are not filtered by the policies. The missing interfaces whose
+// device bypasses the kernel are recorded as unenforceable and returned instead, the policy is applied without them.
+func (n *NFTables) checkInterfaces(ctx context.Context, pod *corev1.Pod, matched []Interface, logger logr.Logger) ([]string, error) {
+	present, err := listNetNSInterfaces(ctx, n.Applier)
+	if err != nil {
+		return nil, err
+	}
+
+	missing, unknown := compareInterfaces(pod, matched, present)
+
+	unenforceable, missing := splitUnenforceable(pod, matched, missing)
+	var skipped []string
+	if len(unenforceable) > 0 {
+		metrics.InterfaceMismatches.WithLabelValues("unenforceable").Add(float64(len(unenforceable)))
+		for _, intf := range unenforceable {
+			skipped = append(skipped, intf.Interface)
+		}
+		logger.V(1).Info("Interfaces bypassing the kernel are not enforced", "interfaces", skipped)
+		n.recordUnenforceable(pod, unenforceable)
+	}
+
+	if n.unknownInterfaces.changed(pod.UID, unknown) && len(unknown) > 0 {
+		metrics.InterfaceMismatches.WithLabelValues("unknown").Add(float64(len(unknown)))
+		logger.Info("Interfaces of the network namespace missing from the network status", "interfaces", unknown)
+		n.recordEvent(pod, corev1.EventTypeWarning, "UnknownInterfaces",
+			"Interfaces %s of the network namespace are not in the network status and are not filtered by the policies", strings.Join(unknown, ", "))
+	}
+
+	if len(missing) > 0 {
+		metrics.InterfaceMismatches.WithLabelValues("missing").Add(float64(len(missing)))
+		return skipped, &MissingInterfacesError{Interfaces: missing}
+	}
+
+	return skipped, nil
+}
+
+// compareInterfaces returns the matched interfaces missing from the present interfaces, and the present interfaces
+// missing from the network status of the pod, the loopback interface aside
+func compareInterfaces(pod *corev1.Pod, matched []Interface, present []string) (missing []string, unknown []string) {
+	for _, intf := range matched {
+		if !slices.Contains(present, intf.Name) && !slices.Contains(missing, intf.Name) {
+			missing = append(missing, intf.Name)
+		}
+	}
+
+	// The network status lists the interfaces of all the networks, the default network included
+	var known []string
+	networkStatus, _ := netdefutils.GetNetworkStatus(pod)
+	for _, status := range networkStatus {
+		known = append(known, status.Interface)
+	}
+
+	for _, name := range present {
+		if name != "lo" && !slices.Contains(known, name) {
+			unknown = append(unknown, name)
+		}
+	}
+
+	return missing, unknown
+}
+
+// maxUnknownInterfaceReports bounds the pods whose last report is remembered, the reports of the pods that are gone
+// are not forgotten otherwise
+const maxUnknownInterfaceReports = 4096
+
+// unknownInterfaceReports remembers the unknown interfaces last reported for each pod, each policy applied to a pod
+// checks its interfaces but the unknown ones are only reported when they change
+type unknownInterfaceReports struct {
+	mu      sync.Mutex
+	reports map[types.UID]string
+}
+
+// changed records the unknown interfaces of a pod and returns whether they changed since the last report
+func (r *unknownInterfaceReports) changed(pod types.UID, unknown []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reports == nil || len(r.reports) >= maxUnknownInterfaceReports {
+		r.reports = make(map[types.UID]string)
+	}
+
+	report := strings.Join(unknown, ",")
+	if last, ok := r.reports[pod]; ok && last == report {
+		return false
+	}
+
+	r.reports[pod] = report
+	return true
+}
@@ -0,0 +1,55 @@
+package nftables
+
+import (
+	"slices"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// beginTransaction journals an apply of a policy to a pod in the state before it is run, it returns the function
+// clearing it once the apply is done
+func (n *NFTables) beginTransaction(policy types.NamespacedName, pod *corev1.Pod, sandbox string, intent datastore.Intent) func() {
+	if n.State == nil {
+		return func() {}
+	}
+
+	transaction := n.State.BeginTransaction(datastore.JournalEntry{
+		Policy:  policy,
+		Pod:     types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name},
+		PodUID:  pod.UID,
+		Sandbox: sandbox,
+		Intent:  intent,
+	})
+
+	return func() {
+		n.State.EndTransaction(transaction)
+	}
+}
+
+// RecoverJournal handles the applies that were in progress when the previous process stopped, taken from the journal
+// of the persisted state: the pods may be partially applied, their states are forgotten so that they are not skipped,
+// and it returns their policies to sync first. The policies cleaned up are returned too, they are cleaned up again
+// when they no longer exist.
+func (n *NFTables) RecoverJournal(entries []datastore.JournalEntry, logger logr.Logger) []types.NamespacedName {
+	if n.State == nil {
+		return nil
+	}
+
+	var interrupted []types.NamespacedName
+	for _, entry := range entries {
+		logger.Info("Apply interrupted by the restart, the pod is verified first", "policy", entry.Policy, "pod", entry.Pod, "intent", entry.Intent, "transaction", entry.Transaction)
+		metrics.WarmStartVerifications.WithLabelValues("interrupted").Inc()
+
+		n.forgetAppliedState(entry.Policy, entry.Pod)
+		if !slices.Contains(interrupted, entry.Policy) {
+			interrupted = append(interrupted, entry.Policy)
+		}
+	}
+
+	return interrupted
+}
@@ -0,0 +1,149 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// tableLayoutVersion is the version of the layout of the chains, sets and rules of the table. It must be increased
+// with a migration when a change of the layout cannot be applied over the objects of the previous version.
+const tableLayoutVersion = 1
+
+// prefixLayoutChain prefixes the empty chain recording the layout version of the table, the tables created before the
+// versioning have none and are version 0
+const prefixLayoutChain = "layout-v"
+
+// layoutMigration queues in the transaction the changes transforming the objects of a table of a layout version to
+// the next one
+type layoutMigration func(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, logger logr.Logger) error
+
+// layoutMigrations are the migrations from each layout version to the next one. The tables of a version without a
+// migration path to the current one, e.g. after a downgrade, are replaced.
+var layoutMigrations = map[int]layoutMigration{
+	// Version 1 only adds the layout chain to the layout of the tables created before the versioning
+	0: func(context.Context, knftables.Interface, *knftables.Transaction, logr.Logger) error { return nil },
+}
+
+// layoutChainName returns the name of the chain recording a layout version
+func layoutChainName(version int) string {
+	return fmt.Sprintf("%s%d", prefixLayoutChain, version)
+}
+
+// createLayoutChain queues the chain recording the current layout version of the table
+func createLayoutChain(tx *knftables.Transaction) {
+	tx.Add(&knftables.Chain{
+		Name:    layoutChainName(tableLayoutVersion),
+		Comment: knftables.PtrTo(fmt.Sprintf("Table layout version %d", tableLayoutVersion)),
+	})
+}
+
+// getLayoutVersion returns the layout version of the table, -1 when the table does not exist
+func getLayoutVersion(ctx context.Context, nft knftables.Interface) (int, error) {
+	chains, err := nft.List(ctx, "chains")
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return -1, nil
+		}
+		return 0, fmt.Errorf("failed to list chains: %w", err)
+	}
+
+	version := 0
+	for _, chain := range chains {
+		suffix, ok := strings.CutPrefix(chain, prefixLayoutChain)
+		if !ok {
+			continue
+		}
+		if v, err := strconv.Atoi(suffix); err == nil && v > version {
+			version = v
+		}
+	}
+
+	return version, nil
+}
+
+// migrateLayout queues in the transaction the migration of the table from its layout version to the current one,
+// before the objects of the policy are applied in the same transaction. The tables without a migration path are
+// emptied in the transaction and rebuilt by the policies applied after it, the ct timeout objects are kept as the
+// rules added in the same transaction refer to them. It returns true when the table was emptied.
+func migrateLayout(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, logger logr.Logger) (bool, error) {
+	version, err := getLayoutVersion(ctx, nft)
+	if err != nil {
+		return false, err
+	}
+
+	if version < 0 || version == tableLayoutVersion {
+		return false, nil
+	}
+
+	var migrations []layoutMigration
+	for v := version; v < tableLayoutVersion; v++ {
+		migration, ok := layoutMigrations[v]
+		if !ok {
+			migrations = nil
+			break
+		}
+		migrations = append(migrations, migration)
+	}
+
+	if version > tableLayoutVersion || len(migrations) == 0 {
+		logger.Info("Replacing table of another layout version", "version", version, "currentVersion", tableLayoutVersion)
+		if err := emptyTable(ctx, nft, tx); err != nil {
+			return false, fmt.Errorf("failed to replace table of layout version %d: %w", version, err)
+		}
+		metrics.TableLayoutMigrations.WithLabelValues("replaced").Inc()
+		return true, nil
+	}
+
+	logger.Info("Migrating table layout", "version", version, "currentVersion", tableLayoutVersion)
+	for i, migration := range migrations {
+		if err := migration(ctx, nft, tx, logger); err != nil {
+			return false, fmt.Errorf("failed to migrate table from layout version %d: %w", version+i, err)
+		}
+	}
+	if version > 0 {
+		tx.Delete(&knftables.Chain{Name: layoutChainName(version)})
+	}
+	metrics.TableLayoutMigrations.WithLabelValues("migrated").Inc()
+
+	return false, nil
+}
+
+// emptyTable queues the deletion of all the chains, sets and maps of the table
+func emptyTable(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction) error {
+	chains, err := nft.List(ctx, "chains")
+	if err != nil && !knftables.IsNotFound(err) {
+		return fmt.Errorf("failed to list chains: %w", err)
+	}
+
+	// The chains are flushed first, so that the jumps to the deleted chains are gone
+	for _, chain := range chains {
+		tx.Flush(&knftables.Chain{Name: chain})
+	}
+	for _, chain := range chains {
+		tx.Delete(&knftables.Chain{Name: chain})
+	}
+
+	for _, objectType := range []string{"sets", "maps"} {
+		names, err := nft.List(ctx, objectType)
+		if err != nil && !knftables.IsNotFound(err) {
+			return fmt.Errorf("failed to list %s: %w", objectType, err)
+		}
+
+		for _, name := range names {
+			if objectType == "sets" {
+				tx.Delete(&knftables.Set{Name: name})
+			} else {
+				tx.Delete(&knftables.Map{Name: name})
+			}
+		}
+	}
+
+	return nil
+}
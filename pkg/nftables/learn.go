@@ -0,0 +1,222 @@
+package nftables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+)
+
+const (
+	// learnedSetSize bounds the flows recorded per direction and family, the traffic of the flows over the bound is
+	// accepted without being recorded
+	learnedSetSize = 65536
+
+	// learnedProtocols are the protocols of the recorded flows, the flows of the other protocols have no port and are
+	// only accepted
+	learnedProtocols = "{ tcp, udp, sctp }"
+)
+
+// LearnedFlow is a flow not allowed by the policies of a pod, accepted and recorded by the learn verdict
+type LearnedFlow struct {
+	Pod types.NamespacedName
+	// Ingress is true for the flows received by the pod, false for the flows sent by the pod
+	Ingress bool
+	// Interface is the interface of the pod the flow is received or sent on
+	Interface string
+	// Peer is the source address of the ingress flows and the destination address of the egress flows
+	Peer     string
+	Protocol string
+	Port     int
+}
+
+// learnedSet is a dynamic set recording the flows of a direction and family
+type learnedSet struct {
+	name     string
+	setType  string
+	addrExpr string
+}
+
+// learnedSets returns the dynamic sets recording the flows of a learn chain
+func learnedSets(learnChainName string) []learnedSet {
+	ifnameExpr, addrField := "iifname", "saddr"
+	if learnChainName == egressLearnChain {
+		ifnameExpr, addrField = "oifname", "daddr"
+	}
+
+	return []learnedSet{
+		{
+			name:     learnChainName + "-ipv4",
+			setType:  "ifname . ipv4_addr . inet_proto . inet_service",
+			addrExpr: knftables.Concat(ifnameExpr, ". ip", addrField, ". meta l4proto . th dport"),
+		},
+		{
+			name:     learnChainName + "-ipv6",
+			setType:  "ifname . ipv6_addr . inet_proto . inet_service",
+			addrExpr: knftables.Concat(ifnameExpr, ". ip6", addrField, ". meta l4proto . th dport"),
+		},
+	}
+}
+
+// createLearnChain creates the chain accepting the packets not allowed by the policies, after recording their
+// interface, peer address, protocol and port in dynamic sets, and logging them at a limited rate when drop logging is
+// enabled. The sets are not flushed so that the flows are recorded until the learn verdict is disabled.
+func createLearnChain(tx *knftables.Transaction, learnChainName string, chainName string, dropLogging *DropLogging, logger logr.Logger) {
+	logger.V(1).Info("Creating learn chain", "chain", learnChainName)
+
+	tx.Add(&knftables.Chain{
+		Name:    learnChainName,
+		Comment: knftables.PtrTo("Learn"),
+	})
+
+	// Flush the chain to apply a changed drop logging
+	tx.Flush(&knftables.Chain{
+		Name: learnChainName,
+	})
+
+	for _, set := range learnedSets(learnChainName) {
+		tx.Add(&knftables.Set{
+			Name:    set.name,
+			Type:    set.setType,
+			Flags:   []knftables.SetFlag{knftables.DynamicFlag},
+			Size:    knftables.PtrTo(uint64(learnedSetSize)),
+			Comment: knftables.PtrTo("Learned flows"),
+		})
+
+		tx.Add(&knftables.Rule{
+			Chain:   learnChainName,
+			Rule:    knftables.Concat("meta l4proto", learnedProtocols, "add", "@"+set.name, "{", set.addrExpr, "}"),
+			Comment: knftables.PtrTo(learnRuleComment),
+		})
+	}
+
+	createDropLogRule(tx, learnChainName, fmt.Sprintf("%s%s learn: ", dropLogPrefix, chainName), dropLogging)
+
+	tx.Add(&knftables.Rule{
+		Chain:   learnChainName,
+		Rule:    "accept",
+		Comment: knftables.PtrTo(acceptLearnedRuleComment),
+	})
+}
+
+// LearnedFlows returns the flows recorded by the learn verdict in the network namespaces of the pods, sorted by pod,
+// direction, interface, peer, protocol and port. The pods whose network namespace is gone are skipped.
+func (n *NFTables) LearnedFlows(ctx context.Context, pods []corev1.Pod, logger logr.Logger) ([]LearnedFlow, error) {
+	var flows []LearnedFlow
+	for i := range pods {
+		pod := &pods[i]
+
+		podFlows, err := n.podLearnedFlows(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+		if podFlows == nil {
+			logger.V(1).Info("Network namespace of the pod is gone, skipping its learned flows", "pod", pod.Name, "namespace", pod.Namespace)
+			continue
+		}
+		flows = append(flows, podFlows...)
+	}
+
+	sort.Slice(flows, func(i, j int) bool {
+		a, b := flows[i], flows[j]
+		if a.Pod != b.Pod {
+			return a.Pod.String() < b.Pod.String()
+		}
+		if a.Ingress != b.Ingress {
+			return a.Ingress
+		}
+		if a.Interface != b.Interface {
+			return a.Interface < b.Interface
+		}
+		if a.Peer != b.Peer {
+			return a.Peer < b.Peer
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Port < b.Port
+	})
+
+	return flows, nil
+}
+
+// podLearnedFlows returns the flows recorded in the network namespace of a pod, it returns nil when the network
+// namespace is gone
+func (n *NFTables) podLearnedFlows(ctx context.Context, pod *corev1.Pod) ([]LearnedFlow, error) {
+	release, err := n.acquireNetNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	netnsPath, err := n.sandbox(ctx, pod)
+	if err != nil {
+		return nil, nil
+	}
+
+	podKey := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+	flows := []LearnedFlow{}
+	err = n.withNetNS(ctx, netnsPath, func(ctx context.Context) error {
+		nft, err := newNetNSNFTables(ctx, n.Exec, n.Applier, tableName)
+		if err != nil {
+			return fmt.Errorf("failed to create nftables client: %w", err)
+		}
+
+		flows, err = listLearnedFlows(ctx, nft, podKey)
+		return err
+	})
+	if errors.Is(err, ErrNetNSNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the learned flows of pod %s: %w", podKey, err)
+	}
+
+	return flows, nil
+}
+
+// listLearnedFlows returns the flows recorded in the learned sets of a table, the sets are missing when the learn
+// verdict was never enabled
+func listLearnedFlows(ctx context.Context, nft knftables.Interface, pod types.NamespacedName) ([]LearnedFlow, error) {
+	flows := []LearnedFlow{}
+	for _, learnChainName := range []string{ingressLearnChain, egressLearnChain} {
+		for _, set := range learnedSets(learnChainName) {
+			elements, err := nft.ListElements(ctx, "set", set.name)
+			if err != nil {
+				if knftables.IsNotFound(err) {
+					continue
+				}
+				return nil, fmt.Errorf("failed to list elements of set %s: %w", set.name, err)
+			}
+
+			for _, element := range elements {
+				if len(element.Key) != 4 {
+					continue
+				}
+
+				port, err := strconv.Atoi(element.Key[3])
+				if err != nil {
+					continue
+				}
+
+				flows = append(flows, LearnedFlow{
+					Pod:       pod,
+					Ingress:   learnChainName == ingressLearnChain,
+					Interface: element.Key[0],
+					Peer:      element.Key[1],
+					Protocol:  element.Key[2],
+					Port:      port,
+				})
+			}
+		}
+	}
+
+	return flows, nil
+}
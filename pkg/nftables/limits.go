@@ -0,0 +1,85 @@
+package nftables
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+const (
+	// RulesetLimitRules is the limit of the number of rules of a policy for a pod
+	RulesetLimitRules = "rules"
+	// RulesetLimitSetElements is the limit of the number of set elements of all the policies of a pod
+	RulesetLimitSetElements = "set_elements"
+)
+
+// RulesetSizeError is returned when the ruleset of a policy for a pod exceeds a size limit, the ruleset is not applied
+// and the rules previously applied to the pod are kept
+type RulesetSizeError struct {
+	// Limit is the exceeded limit, RulesetLimitRules or RulesetLimitSetElements
+	Limit string
+	Size  int
+	Max   int
+}
+
+func (e *RulesetSizeError) Error() string {
+	if e.Limit == RulesetLimitSetElements {
+		return fmt.Sprintf("the policies of the pod would apply %d set elements, more than the maximum of %d", e.Size, e.Max)
+	}
+
+	return fmt.Sprintf("the policy would apply %d rules to the pod, more than the maximum of %d", e.Size, e.Max)
+}
+
+// checkRulesetSize checks the desired state of a policy for a pod against the size limits
+func (n *NFTables) checkRulesetSize(pod *corev1.Pod, policy *datastore.Policy, desired *desiredState) error {
+	if n.MaxRules > 0 {
+		if rules := desired.ruleCount(); rules > n.MaxRules {
+			return &RulesetSizeError{Limit: RulesetLimitRules, Size: rules, Max: n.MaxRules}
+		}
+	}
+
+	if n.MaxPodSetElements > 0 {
+		podKey := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+		policyKey := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+
+		// The elements of the previous ruleset of the policy are replaced
+		elements := n.setElements.others(podKey, policyKey) + desired.elements()
+		if elements > n.MaxPodSetElements {
+			return &RulesetSizeError{Limit: RulesetLimitSetElements, Size: elements, Max: n.MaxPodSetElements}
+		}
+	}
+
+	return nil
+}
+
+// rejectRuleset reports the ruleset of a policy for a pod rejected by the size limits, it returns false when err is not
+// a RulesetSizeError
+func (n *NFTables) rejectRuleset(pod *corev1.Pod, policy *datastore.Policy, err error, logger logr.Logger) bool {
+	var sizeError *RulesetSizeError
+	if !errors.As(err, &sizeError) {
+		return false
+	}
+
+	metrics.RulesetSizeRejections.WithLabelValues(sizeError.Limit).Inc()
+	logger.Info("Ruleset exceeds the size limits, keeping the previous rules of the pod", "error", err)
+	n.recordEvent(pod, corev1.EventTypeWarning, "RulesetTooLarge",
+		"Ruleset of policy %s/%s is not applied: %v", policy.Namespace, policy.Name, err)
+
+	return true
+}
+
+// ruleCount returns the number of rules of a desired state
+func (d *desiredState) ruleCount() int {
+	total := 0
+	for _, rules := range d.rules {
+		total += rules
+	}
+
+	return total
+}
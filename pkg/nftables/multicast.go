@@ -0,0 +1,38 @@
+package nftables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// createMulticastGroupRules accepts the UDP traffic to the multicast groups received on the matched interfaces
+func createMulticastGroupRules(tx *knftables.Transaction, hashName string, groups []string, npChain policyChain, logger logr.Logger) {
+	if len(groups) == 0 {
+		return
+	}
+
+	logger.V(1).Info("Creating multicast group rules", "groups", groups)
+
+	ipv4Groups, ipv6Groups := utils.SplitCIDRs(groups)
+	for _, family := range []struct {
+		addrExpr string
+		groups   []string
+	}{
+		{addrExpr: "ip daddr", groups: ipv4Groups},
+		{addrExpr: "ip6 daddr", groups: ipv6Groups},
+	} {
+		if len(family.groups) == 0 {
+			continue
+		}
+
+		tx.Add(npChain.rule(knftables.Concat(
+			"iifname", fmt.Sprintf("@%s%s", prefixManagedInterfacesSet, hashName),
+			family.addrExpr, "{", strings.Join(family.groups, ", "), "}", "meta l4proto udp", "accept",
+		), knftables.PtrTo("Multicast groups")))
+	}
+}
@@ -0,0 +1,94 @@
+package nftables
+
+import (
+	"fmt"
+	"net/netip"
+
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// nat64Address returns the IPv4 address embedded in a NAT64 /96 prefix, e.g. 192.0.2.1 is 64:ff9b::c000:201 in the
+// well-known prefix
+func nat64Address(prefix netip.Prefix, addr netip.Addr) netip.Addr {
+	bytes := prefix.Addr().As16()
+	ipv4 := addr.As4()
+	copy(bytes[12:], ipv4[:])
+
+	return netip.AddrFrom16(bytes)
+}
+
+// nat64Addresses returns the IPv4 addresses embedded in a NAT64 prefix, the invalid ones are skipped
+func nat64Addresses(prefix netip.Prefix, addresses []string) []string {
+	var translated []string
+	for _, address := range addresses {
+		addr, err := netip.ParseAddr(address)
+		if err != nil || !addr.Unmap().Is4() {
+			continue
+		}
+
+		translated = append(translated, nat64Address(prefix, addr.Unmap()).String())
+	}
+
+	return translated
+}
+
+// nat64CIDRs returns the IPv4 CIDRs embedded in a NAT64 prefix, a /n CIDR is a /96+n CIDR, the invalid ones are skipped
+func nat64CIDRs(prefix netip.Prefix, cidrs []string) []string {
+	var translated []string
+	for _, cidr := range cidrs {
+		ipv4Prefix, err := netip.ParsePrefix(cidr)
+		if err != nil || !ipv4Prefix.Addr().Is4() {
+			continue
+		}
+
+		translated = append(translated, netip.PrefixFrom(nat64Address(prefix, ipv4Prefix.Addr()), prefix.Bits()+ipv4Prefix.Bits()).String())
+	}
+
+	return translated
+}
+
+// nat64PeerAddresses returns the IPv6 addresses of the peers matched on an interface, with the IPv4 addresses embedded
+// in the NAT64 prefix of its network
+func nat64PeerAddresses(intf Interface, ipv4Addresses []string, ipv6Addresses []string, nat64Prefixes map[string]netip.Prefix) []string {
+	prefix, ok := nat64Prefixes[intf.Network]
+	if !ok || len(ipv4Addresses) == 0 {
+		return ipv6Addresses
+	}
+
+	addresses := make([]string, 0, len(ipv6Addresses)+len(ipv4Addresses))
+	addresses = append(addresses, ipv6Addresses...)
+	return append(addresses, nat64Addresses(prefix, ipv4Addresses)...)
+}
+
+// createNAT64CIDRSets creates the sets of the IPv4 CIDRs of the peers embedded in the NAT64 prefixes of the networks of
+// the interfaces of a group, and returns their rule sections. The sets are per interface, the prefixes of the networks
+// differ and the CIDRs must not be matched on the other networks.
+func (n *NFTables) createNAT64CIDRSets(tx *knftables.Transaction, group *interfaceGroup, peers *peerSet, policy *datastore.Policy, hashName string, direction string, rule int) []string {
+	if len(policy.NAT64Prefixes) == 0 || len(peers.ipv4CIDRs) == 0 {
+		return nil
+	}
+
+	ifnameField, addrField := "iifname", "saddr"
+	if direction == "egress" {
+		ifnameField, addrField = "oifname", "daddr"
+	}
+
+	var sections []string
+	for _, intf := range group.interfaces {
+		prefix, ok := policy.NAT64Prefixes[intf.Network]
+		if !ok {
+			continue
+		}
+
+		cidrsSetName := fmt.Sprintf("%s%s_%s_nat64_cidr_%s_%d", prefixNetworkPolicySet, hashName, direction, intf.Name, rule)
+		exceptsSetName := fmt.Sprintf("%s%s_%s_nat64_except_%s_%d", prefixNetworkPolicySet, hashName, direction, intf.Name, rule)
+		setComment := fmt.Sprintf("NAT64 %s/%s", policy.Namespace, policy.Name)
+
+		sets := createCIDRSets(tx, "ip6", addrField, "ipv6_addr", cidrsSetName, exceptsSetName, nat64CIDRs(prefix, peers.ipv4CIDRs), nat64CIDRs(prefix, peers.ipv4Excepts), setComment, n.MaxSetElements)
+		sections = append(sections, sets.ruleSections(group.interfaceMatch(ifnameField, intf.Name), group.encapsulation)...)
+	}
+
+	return sections
+}
@@ -0,0 +1,171 @@
+package nftables
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// NetworkStatistics is the enforcement of the policies on a network for the pods of the node
+type NetworkStatistics struct {
+	// Network is the network, as <namespace>/<name>
+	Network string
+	// Pods is the number of pods with a policy applied to an interface of the network
+	Pods int
+	// Rules is the number of rules of the policies applied to the interfaces of the network, the rules of a policy
+	// applied to several networks of a pod are counted for each of them
+	Rules int
+	// LastSync is the time a policy was last synced to an interface of the network
+	LastSync time.Time
+}
+
+// networkStatistics remembers the rules applied to the networks of each pod by each policy, for the per-network
+// enforcement statistics of the node
+type networkStatistics struct {
+	mu       sync.Mutex
+	pods     map[types.NamespacedName]podNetworkRules
+	lastSync map[string]time.Time
+}
+
+// podNetworkRules is the number of rules applied to each network of a pod by each policy
+type podNetworkRules struct {
+	uid      types.UID
+	policies map[types.NamespacedName]map[string]int
+}
+
+// set records the number of rules applied by a policy to the networks of a pod, no network forgets the policy. The
+// policies of a previous pod with the same name are forgotten.
+func (s *networkStatistics) set(pod *corev1.Pod, policy types.NamespacedName, networks []string, rules int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pods == nil {
+		s.pods = make(map[types.NamespacedName]podNetworkRules)
+		s.lastSync = make(map[string]time.Time)
+	}
+
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	recorded, ok := s.pods[key]
+	if !ok || recorded.uid != pod.UID {
+		recorded = podNetworkRules{uid: pod.UID, policies: make(map[types.NamespacedName]map[string]int)}
+		s.pods[key] = recorded
+	}
+
+	if len(networks) == 0 {
+		delete(recorded.policies, policy)
+		if len(recorded.policies) == 0 {
+			delete(s.pods, key)
+		}
+		return
+	}
+
+	counts := make(map[string]int, len(networks))
+	for _, network := range networks {
+		counts[network] = rules
+		s.lastSync[network] = now
+	}
+	recorded.policies[policy] = counts
+}
+
+// list returns the statistics of the networks with a policy applied to the pods, sorted by network
+func (s *networkStatistics) list() []NetworkStatistics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statistics := make(map[string]*NetworkStatistics)
+	for _, recorded := range s.pods {
+		networks := make(map[string]bool)
+		for _, counts := range recorded.policies {
+			for network, rules := range counts {
+				stats, ok := statistics[network]
+				if !ok {
+					stats = &NetworkStatistics{Network: network, LastSync: s.lastSync[network]}
+					statistics[network] = stats
+				}
+
+				stats.Rules += rules
+				networks[network] = true
+			}
+		}
+
+		for network := range networks {
+			statistics[network].Pods++
+		}
+	}
+
+	var list []NetworkStatistics
+	for _, network := range slices.Sorted(maps.Keys(statistics)) {
+		list = append(list, *statistics[network])
+	}
+
+	return list
+}
+
+// forget forgets the pods of a policy that are not kept
+func (s *networkStatistics) forget(policy types.NamespacedName, keep func(pod types.NamespacedName) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for pod, recorded := range s.pods {
+		if _, ok := recorded.policies[policy]; ok && !keep(pod) {
+			delete(recorded.policies, policy)
+			if len(recorded.policies) == 0 {
+				delete(s.pods, pod)
+			}
+		}
+	}
+}
+
+// collect forgets the rules of the pods not kept and returns the number of pods forgotten
+func (s *networkStatistics) collect(keep func(pod types.NamespacedName) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	forgotten := 0
+	for pod := range s.pods {
+		if !keep(pod) {
+			delete(s.pods, pod)
+			forgotten++
+		}
+	}
+
+	return forgotten
+}
+
+// NetworkStatistics returns the enforcement statistics of the networks of the pods of the node
+func (n *NFTables) NetworkStatistics() []NetworkStatistics {
+	return n.networkStats.list()
+}
+
+// recordNetworkStatistics records the networks a policy was synced to on a pod with the number of its rules. The
+// ruleset of the policy is rendered again when its rules were not counted, rules is negative.
+func (n *NFTables) recordNetworkStatistics(ctx context.Context, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy, operation SyncOperation, rules int, logger logr.Logger) {
+	var networks []string
+	if operation == SyncOperationCreate && utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels) {
+		for _, intf := range getPolicyInterfaces(interfaces, policy, pod) {
+			if !slices.Contains(networks, intf.Network) {
+				networks = append(networks, intf.Network)
+			}
+		}
+	}
+
+	if len(networks) > 0 && rules < 0 {
+		var err error
+		_, rules, err = n.renderRuleset(ctx, pod, interfaces, policy)
+		if err != nil {
+			logger.Info("Failed to render the ruleset of the network statistics", "error", err.Error())
+			return
+		}
+	}
+
+	n.networkStats.set(pod, types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, networks, rules, time.Now())
+}
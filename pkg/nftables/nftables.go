@@ -2,21 +2,32 @@
 package nftables
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/go-logr/logr"
-	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
 	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/knftables"
 
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/cri"
 	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
 )
 
 const (
@@ -28,14 +39,52 @@ const (
 	egressChain        = "egress"
 	commonIngressChain = "common-ingress"
 	commonEgressChain  = "common-egress"
+	ingressDropChain   = "ingress-drop"
+	egressDropChain    = "egress-drop"
+	ingressRejectChain = "ingress-reject"
+	egressRejectChain  = "egress-reject"
+	ingressLearnChain  = "ingress-learn"
+	egressLearnChain   = "egress-learn"
+
+	conntrackZonePreroutingChain = "ct-zone-prerouting"
+	conntrackZoneOutputChain     = "ct-zone-output"
+
+	conntrackTimeoutPreroutingChain = "ct-timeout-prerouting"
+	conntrackTimeoutOutputChain     = "ct-timeout-output"
+
+	notrackPreroutingChain = "notrack-prerouting"
+	notrackOutputChain     = "notrack-output"
+
+	icmpHardeningChain = "icmp-hardening"
+	ipv6ExthdrChain    = "ipv6-exthdr"
+
+	fragmentPreroutingChain = "fragment-prerouting"
+	fragmentOutputChain     = "fragment-output"
+
+	tcpFlagsChain = "tcp-flags"
+	synLimitChain = "syn-limit"
 
 	dropRuleComment               = "Drop rule"
 	connectionTrackingRuleComment = "Connection tracking"
 	jumpCommonRuleComment         = "Jump to common"
+	dropLogRuleComment            = "Log drop"
+	conntrackZoneRuleComment      = "Conntrack zone"
+	rejectTCPRuleComment          = "Reject TCP"
+	rejectRuleComment             = "Reject"
+	terminalRuleComment           = "Terminal Rule"
+	jumpTerminalRuleComment       = "Jump to terminal"
+	learnRuleComment              = "Learn flow"
+	acceptLearnedRuleComment      = "Accept learned"
+
+	// verdictRuleCommentPrefix prefixes the comment of the rules overriding the default verdict for a policy
+	verdictRuleCommentPrefix = "Verdict "
+
+	dropLogPrefix = "mnp "
 
 	prefixManagedInterfacesSet = "smi-"
 	prefixNetworkPolicyChain   = "cnp-"
 	prefixNetworkPolicySet     = "snp-"
+	prefixDispatcherChain      = "dispatch-"
 
 	PodHostnameIndex             = "pod.spec.nodeName"
 	PodStatusIndex               = "pod.status.phase"
@@ -55,6 +104,94 @@ type NFTables struct {
 	Hostname    string
 	CriRuntime  *cri.Runtime
 	CommonRules *CommonRules
+	// Enforcer programs the policies in the network namespaces of the pods, nil applies them with nft
+	Enforcer Enforcer
+	// Exec configures the execution of the nft binary applying the policies
+	Exec ExecOptions
+	// Applier runs the nftables operations in the privileged applier instead of entering the network namespaces and
+	// running nft in the process, nil runs them in the process
+	Applier *applier.Client
+
+	// VerifyRuleset lists the applied ruleset back after each apply and compares it against the desired state
+	VerifyRuleset bool
+	// VerifyRetries is the number of times the policy is reapplied when the verification fails
+	VerifyRetries int
+	// ConntrackZones tracks the connections of each interface of the pods in a separate conntrack zone
+	ConntrackZones bool
+	// Conntrack is the support of the connection tracking on the node, the replies of the traffic it cannot track are
+	// accepted by symmetric rules
+	Conntrack ConntrackSupport
+	// Recorder records the events related to the enforcement on the pods, it can be nil
+	Recorder record.EventRecorder
+	// Policies are the policies of the controller, the interfaces of a pod denied until a policy is applied to them
+	// stay denied while another policy selecting the pod applies to them. It can be nil to allow them all as soon as a
+	// policy is synced to the pod.
+	Policies *datastore.Datastore
+	// State records the rulesets applied to the pods to skip the pods that did not change, e.g. after a restart.
+	// It can be nil to apply the policies to every pod.
+	State *datastore.Datastore
+	// Selectors memoizes the pods and namespaces matching the selectors of the peers, it can be nil to list them every time
+	Selectors *SelectorCache
+	// Reservations are the addresses allocated by whereabouts, the peer pods whose network status is not reported yet
+	// are resolved from them. It can be nil to resolve the peers from the network status only.
+	Reservations *Reservations
+	// MaxInFlight is the maximum number of pods whose network namespace is looked up or entered concurrently, 0 does
+	// not limit them
+	MaxInFlight int
+	// MaxSetElements is the maximum number of elements of the sets of the CIDRs and excepts of a rule, larger lists are
+	// chunked across multiple sets. 0 does not chunk them.
+	MaxSetElements int
+	// MaxRules is the maximum number of rules of a policy applied to a pod, 0 does not limit them
+	MaxRules int
+	// MaxPodSetElements is the maximum number of set elements applied to a pod by all the policies, 0 does not limit
+	// them
+	MaxPodSetElements int
+	// EnforcementAnnotations stamps the pods with the enforcement status annotation recording the policies applied to
+	// them
+	EnforcementAnnotations bool
+	// RecordNetworkStatistics records the rules applied to the networks of the pods, for the enforcement statistics of the
+	// networks
+	RecordNetworkStatistics bool
+	// PrefetchSandboxes resolves the network namespace paths of the pods when they start running and caches them, so
+	// that the syncs do not query the container runtime
+	PrefetchSandboxes bool
+	// InterfaceReadyTimeout is the time the syncs are retried while the network status of a pod is incomplete, 0
+	// applies the policies from the network status as it is
+	InterfaceReadyTimeout time.Duration
+	// RulesetLayout is the layout of the chains of the rules of the policies, empty renders a chain per policy
+	RulesetLayout RulesetLayout
+	// ExcludedPods are the pods the policies are never applied to, whatever their selectors
+	ExcludedPods []PodExclusion
+
+	// mu guards CommonRules, ExcludedPods, clusterCommonRules and extraRules which can be replaced at runtime
+	mu sync.RWMutex
+	// clusterCommonRules are the common rules managed through the API, merged into CommonRules
+	clusterCommonRules *CommonRules
+	// extraRules are the extra rules of the pods managed through the API, by object
+	extraRules map[types.NamespacedName]*ExtraRules
+	// setElements counts the elements of the sets applied to each pod
+	setElements setElementCounter
+	// inFlight holds a slot per pod whose network namespace is looked up or entered, up to MaxInFlight
+	inFlight     chan struct{}
+	inFlightOnce sync.Once
+	// compiled caches the compiled form of the policies by generation
+	compiled compileCache
+	// unknownInterfaces are the interfaces missing from the network status last reported for each pod
+	unknownInterfaces unknownInterfaceReports
+	// statelessReports are the protocols last reported as enforced with stateless rules for each policy applied to a pod
+	statelessReports statelessReports
+	// unenforceable are the interfaces of the pods whose traffic bypasses the kernel
+	unenforceable unenforceableInterfaces
+	// enforcements are the policies applied to each pod, for their enforcement status annotations
+	enforcements podEnforcements
+	// networkStats are the rules applied to the networks of each pod, for the enforcement statistics of the networks
+	networkStats networkStatistics
+	// sandboxes are the network namespace paths of the pods, prefetched when they start running
+	sandboxes sandboxCache
+	// readiness are the pods whose network status is incomplete, since when
+	readiness interfaceReadiness
+	// netnsLocks serialize the early deny with the enforcement of the policies in each network namespace
+	netnsLocks netnsLocks
 }
 
 type SyncError struct {
@@ -73,11 +210,288 @@ func NewSyncError(format string, args ...interface{}) *SyncError {
 type CommonRules struct {
 	AcceptICMP   bool
 	AcceptICMPv6 bool
+	// AcceptIPsec accepts ESP, AH and IKE, which pods terminating IPsec need and the ports of the policies cannot express
+	AcceptIPsec bool
+	// DropIPv6ExtensionHeaders drops the IPv6 packets with a type 0 routing header and the fragmented neighbor
+	// discovery messages, whatever the policies
+	DropIPv6ExtensionHeaders bool
+	// DropInvalidTCPFlags drops the TCP packets with invalid flag combinations before the connection tracking, whatever
+	// the policies
+	DropInvalidTCPFlags bool
+	// AcceptSelfTraffic accepts the traffic received by the pods from their own addresses on any of their interfaces
+	AcceptSelfTraffic bool
 
 	CustomIPv4IngressRules []string
 	CustomIPv6IngressRules []string
 	CustomIPv4EgressRules  []string
 	CustomIPv6EgressRules  []string
+
+	// DropLogging enables the logging of the packets dropped by the policies, nil disables it
+	DropLogging *DropLogging
+	// DefaultVerdict is the verdict of the traffic not allowed by the policies, empty drops the traffic
+	DefaultVerdict datastore.Verdict
+	// TerminalChain is jumped to by the traffic not allowed by the policies before the verdict, nil disables it
+	TerminalChain *TerminalChain
+	// SYNRateLimit caps the rate of the TCP SYN packets received by each managed interface, nil disables it
+	SYNRateLimit *SYNRateLimit
+	// TrustedCTMark accepts the connections marked by a trusted system in the pod network namespaces, nil disables it
+	TrustedCTMark *Mark
+	// TrustedMark accepts the packets marked by a trusted system in the pod network namespaces, nil disables it
+	TrustedMark *Mark
+	// AcceptedCTMark is set on the connections dispatched to the policies and not dropped, nil disables it
+	AcceptedCTMark *Mark
+	// AcceptedMark is set on the packets dispatched to the policies and not dropped, nil disables it
+	AcceptedMark *Mark
+
+	// extraRules are the extra rules of the pod, added after the custom rules
+	extraRules []*knftables.Rule
+}
+
+// TerminalChain is a user-defined chain for site-specific actions on the denied traffic, e.g. counters or logging
+type TerminalChain struct {
+	Name  string
+	Rules []string
+}
+
+var terminalChainNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// Validate checks that the terminal chain name is valid and does not collide with the managed chains
+func (t *TerminalChain) Validate() error {
+	if !terminalChainNameRegexp.MatchString(t.Name) {
+		return fmt.Errorf("invalid terminal chain name %q", t.Name)
+	}
+
+	managedChains := []string{
+		inputChain, outputChain, ingressChain, egressChain, commonIngressChain, commonEgressChain,
+		ingressDropChain, egressDropChain, ingressRejectChain, egressRejectChain, ingressLearnChain, egressLearnChain,
+		conntrackZonePreroutingChain, conntrackZoneOutputChain, conntrackTimeoutPreroutingChain, conntrackTimeoutOutputChain,
+		notrackPreroutingChain, notrackOutputChain,
+		icmpHardeningChain, ipv6ExthdrChain, fragmentPreroutingChain, fragmentOutputChain,
+		tcpFlagsChain, synLimitChain, earlyDenyInputChain, earlyDenyOutputChain, mergedIngressChain, mergedEgressChain,
+	}
+	if slices.Contains(managedChains, t.Name) || strings.HasPrefix(t.Name, prefixNetworkPolicyChain) || strings.HasPrefix(t.Name, prefixDispatcherChain) || strings.HasPrefix(t.Name, prefixLayoutChain) {
+		return fmt.Errorf("terminal chain name %q collides with a managed chain", t.Name)
+	}
+
+	return nil
+}
+
+// Merge returns the common rules with the ICMP, IPsec and hardening options and the custom rules of other added, other can be nil.
+// The terminal chain, the SYN rate limit and the trusted and accepted marks of other are only used when c has none.
+func (c *CommonRules) Merge(other *CommonRules) *CommonRules {
+	if other == nil {
+		return c
+	}
+
+	if c == nil {
+		return other
+	}
+
+	merged := *c
+	merged.AcceptICMP = c.AcceptICMP || other.AcceptICMP
+	merged.AcceptICMPv6 = c.AcceptICMPv6 || other.AcceptICMPv6
+	merged.AcceptIPsec = c.AcceptIPsec || other.AcceptIPsec
+	merged.DropIPv6ExtensionHeaders = c.DropIPv6ExtensionHeaders || other.DropIPv6ExtensionHeaders
+	merged.DropInvalidTCPFlags = c.DropInvalidTCPFlags || other.DropInvalidTCPFlags
+	merged.AcceptSelfTraffic = c.AcceptSelfTraffic || other.AcceptSelfTraffic
+	merged.CustomIPv4IngressRules = slices.Concat(c.CustomIPv4IngressRules, other.CustomIPv4IngressRules)
+	merged.CustomIPv6IngressRules = slices.Concat(c.CustomIPv6IngressRules, other.CustomIPv6IngressRules)
+	merged.CustomIPv4EgressRules = slices.Concat(c.CustomIPv4EgressRules, other.CustomIPv4EgressRules)
+	merged.CustomIPv6EgressRules = slices.Concat(c.CustomIPv6EgressRules, other.CustomIPv6EgressRules)
+	if merged.TerminalChain == nil {
+		merged.TerminalChain = other.TerminalChain
+	}
+	if merged.SYNRateLimit == nil {
+		merged.SYNRateLimit = other.SYNRateLimit
+	}
+	if merged.TrustedCTMark == nil {
+		merged.TrustedCTMark = other.TrustedCTMark
+	}
+	if merged.TrustedMark == nil {
+		merged.TrustedMark = other.TrustedMark
+	}
+	if merged.AcceptedCTMark == nil {
+		merged.AcceptedCTMark = other.AcceptedCTMark
+	}
+	if merged.AcceptedMark == nil {
+		merged.AcceptedMark = other.AcceptedMark
+	}
+
+	return &merged
+}
+
+// dropLogging returns the drop logging, c can be nil
+func (c *CommonRules) dropLogging() *DropLogging {
+	if c == nil {
+		return nil
+	}
+
+	return c.DropLogging
+}
+
+// terminalChain returns the terminal chain, c can be nil
+func (c *CommonRules) terminalChain() *TerminalChain {
+	if c == nil {
+		return nil
+	}
+
+	return c.TerminalChain
+}
+
+// defaultVerdict returns the verdict of the traffic not allowed by the policies, c can be nil
+func (c *CommonRules) defaultVerdict() datastore.Verdict {
+	if c == nil || c.DefaultVerdict == "" {
+		return datastore.VerdictDrop
+	}
+
+	return c.DefaultVerdict
+}
+
+// dropIPv6ExtensionHeaders returns whether the risky IPv6 extension headers are dropped, c can be nil
+func (c *CommonRules) dropIPv6ExtensionHeaders() bool {
+	return c != nil && c.DropIPv6ExtensionHeaders
+}
+
+// dropInvalidTCPFlags returns whether the TCP packets with invalid flag combinations are dropped, c can be nil
+func (c *CommonRules) dropInvalidTCPFlags() bool {
+	return c != nil && c.DropInvalidTCPFlags
+}
+
+// acceptSelfTraffic returns whether the traffic of the pods from their own addresses is accepted, c can be nil
+func (c *CommonRules) acceptSelfTraffic() bool {
+	return c != nil && c.AcceptSelfTraffic
+}
+
+// synRateLimit returns the SYN rate limit, c can be nil
+func (c *CommonRules) synRateLimit() *SYNRateLimit {
+	if c == nil {
+		return nil
+	}
+
+	return c.SYNRateLimit
+}
+
+// acceptedMarks returns the statements setting the accepted marks, empty when disabled, c can be nil
+func (c *CommonRules) acceptedMarks() string {
+	if c == nil {
+		return ""
+	}
+
+	var statements []string
+	if c.AcceptedCTMark != nil {
+		statements = append(statements, c.AcceptedCTMark.set("ct mark"))
+	}
+	if c.AcceptedMark != nil {
+		statements = append(statements, c.AcceptedMark.set("meta mark"))
+	}
+
+	return strings.Join(statements, " ")
+}
+
+// DropLogging represents the sampling of the dropped packets logged to the kernel log
+type DropLogging struct {
+	// Rate is the nft limit rate per chain, e.g. 10/minute
+	Rate string
+	// Burst is the number of packets that can exceed the rate
+	Burst int
+}
+
+var limitRateRegexp = regexp.MustCompile(`^([1-9][0-9]*)/(second|minute|hour|day)$`)
+
+// Validate checks the drop logging rate and burst
+func (d *DropLogging) Validate() error {
+	if !limitRateRegexp.MatchString(d.Rate) {
+		return fmt.Errorf("invalid drop log rate %q, expected <count>/<second|minute|hour|day>", d.Rate)
+	}
+
+	if d.Burst < 0 {
+		return fmt.Errorf("invalid drop log burst %d, must not be negative", d.Burst)
+	}
+
+	return nil
+}
+
+// RatePerSecond returns the drop logging rate in packets per second
+func (d *DropLogging) RatePerSecond() float64 {
+	matches := limitRateRegexp.FindStringSubmatch(d.Rate)
+	if matches == nil {
+		return 0
+	}
+
+	count, _ := strconv.ParseFloat(matches[1], 64)
+	seconds := map[string]float64{"second": 1, "minute": 60, "hour": 3600, "day": 86400}[matches[2]]
+
+	return count / seconds
+}
+
+// SYNRateLimit represents the rate limit of the TCP SYN packets received by each managed interface
+type SYNRateLimit struct {
+	// Rate is the nft limit rate per interface, e.g. 100/second
+	Rate string
+	// Burst is the number of packets that can exceed the rate
+	Burst int
+}
+
+// Validate checks the SYN rate and burst
+func (s *SYNRateLimit) Validate() error {
+	if !limitRateRegexp.MatchString(s.Rate) {
+		return fmt.Errorf("invalid SYN rate %q, expected <count>/<second|minute|hour|day>", s.Rate)
+	}
+
+	if s.Burst < 0 {
+		return fmt.Errorf("invalid SYN burst %d, must not be negative", s.Burst)
+	}
+
+	return nil
+}
+
+// Mark represents a conntrack or packet mark, the bits of the mask are compared to the value
+type Mark struct {
+	Value uint32
+	Mask  uint32
+}
+
+// ParseMark parses a mark as <value>[/<mask>], in decimal or in hexadecimal with the 0x prefix. The mask defaults to
+// all the bits and the value must be within the mask.
+func ParseMark(value string) (*Mark, error) {
+	markValue, maskValue, hasMask := strings.Cut(strings.TrimSpace(value), "/")
+
+	mark, err := strconv.ParseUint(markValue, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mark %q, expected <value>[/<mask>]", value)
+	}
+
+	mask := uint64(0xffffffff)
+	if hasMask {
+		mask, err = strconv.ParseUint(maskValue, 0, 32)
+		if err != nil || mask == 0 {
+			return nil, fmt.Errorf("invalid mark mask %q, expected a non-zero 32-bit value", maskValue)
+		}
+	}
+
+	if mark&^mask != 0 {
+		return nil, fmt.Errorf("invalid mark %q, the value has bits outside the mask", value)
+	}
+
+	return &Mark{Value: uint32(mark), Mask: uint32(mask)}, nil
+}
+
+// match returns the match of the mark on a mark expression, e.g. ct mark
+func (m *Mark) match(expression string) string {
+	if m.Mask == 0xffffffff {
+		return knftables.Concat(expression, fmt.Sprintf("0x%08x", m.Value))
+	}
+
+	return knftables.Concat(expression, "&", fmt.Sprintf("0x%08x", m.Mask), "==", fmt.Sprintf("0x%08x", m.Value))
+}
+
+// set returns the statement setting the mark on a mark expression, e.g. ct mark, the bits outside the mask are kept
+func (m *Mark) set(expression string) string {
+	if m.Mask == 0xffffffff {
+		return knftables.Concat(expression, "set", fmt.Sprintf("0x%08x", m.Value))
+	}
+
+	return knftables.Concat(expression, "set", expression, "&", fmt.Sprintf("0x%08x", ^m.Mask), "|", fmt.Sprintf("0x%08x", m.Value))
 }
 
 // Interface represents a network interface
@@ -98,17 +512,24 @@ const (
 func (n *NFTables) SyncPolicy(ctx context.Context, policy *datastore.Policy, operation SyncOperation, logger logr.Logger) error {
 	logger.Info("Syncing policy")
 
-	pods := &corev1.PodList{}
-	err := n.Client.List(ctx, pods,
-		client.InNamespace(policy.Namespace),
-		client.MatchingFields{
-			PodHostnameIndex:             n.Hostname,
-			PodStatusIndex:               string(corev1.PodRunning),
-			PodHostNetworkIndex:          "false",
-			PodHasNetworkAnnotationIndex: "true",
-		})
+	pods, err := n.listNodePods(ctx, policy.Namespace)
 	if err != nil {
-		return fmt.Errorf("failed to list pods for hostname %s: %w", n.Hostname, err)
+		return err
+	}
+
+	// Forget the set elements and the network statistics of the pods that are gone
+	isNodePod := func(pod types.NamespacedName) bool {
+		return slices.ContainsFunc(pods.Items, func(p corev1.Pod) bool {
+			return p.Namespace == pod.Namespace && p.Name == pod.Name
+		})
+	}
+	n.setElements.forget(types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, isNodePod)
+	n.networkStats.forget(types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, isNodePod)
+
+	// A deleted policy is cleaned up from all the pods of the node it was applied to, listed or not
+	if operation == SyncOperationDelete {
+		n.compiled.forget(types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name})
+		return n.cleanUpNodePolicy(ctx, policy, pods.Items, logger)
 	}
 
 	if len(pods.Items) == 0 {
@@ -118,48 +539,199 @@ func (n *NFTables) SyncPolicy(ctx context.Context, policy *datastore.Policy, ope
 
 	logger.Info("Found pods to enforce policy", "hostname", n.Hostname, "count", len(pods.Items))
 
+	policyKey := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+
+	// states are the changes of the states applied to the pods, written once at the end of the sync
+	var states []datastore.AppliedStateChange
+	if n.State != nil {
+		// Forget the pods that are gone, their network namespaces are gone with them
+		n.State.DeleteAppliedStates(policyKey, func(pod types.NamespacedName) bool {
+			return slices.ContainsFunc(pods.Items, func(p corev1.Pod) bool {
+				return p.Namespace == pod.Namespace && p.Name == pod.Name
+			})
+		})
+
+		defer func() {
+			n.State.UpdateAppliedStates(states)
+		}()
+	}
+
+	// The excluded pods are set aside before anything else, the policy is only cleaned up from them
+	targets, excluded, err := n.excludePods(ctx, policy.Namespace, pods.Items)
+	if err != nil {
+		return err
+	}
+	if len(excluded) > 0 {
+		logger.V(1).Info("Excluded pods are not targeted", "count", len(excluded))
+	}
+	pods.Items = targets
+
+	// The peers are resolved once for all the pods
+	ctx = withPeerSets(ctx)
+
+	enforcer := n.enforcer()
+
+	// The network namespaces are resolved first, the pods sharing one are enforced together
+	sandboxes := make([]string, len(pods.Items))
+	for i, pod := range pods.Items {
+		if len(GetInterfaces(&pod)) == 0 {
+			continue
+		}
+
+		release, err := n.acquireNetNS(ctx)
+		if err != nil {
+			return err
+		}
+
+		sandboxes[i], err = enforcer.Sandbox(ctx, &pod)
+		release()
+		if err != nil {
+			return fmt.Errorf("failed to get network namespace path: %w", err)
+		}
+	}
+	shared := sharedNetNS(pods.Items, sandboxes, logger)
+
+	// enforced are the network namespaces the policy was synced to, once for the pods sharing one
+	enforced := make(map[string]bool)
+
+	// missingPods counts the pods the policy is not applied to because of missing interfaces
+	missingPods := 0
+	// notReadyPods counts the pods the policy is not applied to yet because their network status is incomplete
+	notReadyPods := 0
+
 	// Generate nftables rules
-	for _, pod := range pods.Items {
+	for i, pod := range pods.Items {
 		logger := logger.WithValues("pod", pod.Name, "namespace", pod.Namespace)
 
-		interfaces := getInterfaces(&pod)
+		interfaces := GetInterfaces(&pod)
 
 		if len(interfaces) == 0 {
 			logger.V(1).Info("No interfaces found, skipping")
 			continue
 		}
 
-		netnsPath, err := n.CriRuntime.GetPodNetNSPath(ctx, &pod)
-		if err != nil {
-			return fmt.Errorf("failed to get network namespace path: %w", err)
+		// The policy is not applied from an incomplete network status, while the CNI configures the interfaces
+		if n.waitInterfaces(ctx, &pod, policy, logger) {
+			notReadyPods++
+			continue
 		}
 
-		netns, err := ns.GetNS(netnsPath)
-		if err != nil {
-			logger.V(1).Info("Failed to open network namespace, skipping")
-			continue
+		netnsPath := sandboxes[i]
+		podKey := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+		// The policy is applied to the pods sharing the network namespace as one pod
+		enforcedPod, enforcedInterfaces := &pod, interfaces
+		if coResident, ok := shared[netnsPath]; ok {
+			enforcedPod, enforcedInterfaces = mergeSharedPods(coResident, policy)
 		}
 
-		// Use anonymous function to ensure netns is always closed for this iteration
-		err = func() error {
-			defer netns.Close()
-			return netns.Do(func(_ ns.NetNS) error {
-				var err error
-				if operation == SyncOperationDelete {
-					err = cleanUpPolicy(ctx, policy.Name, policy.Namespace, logger)
-				}
+		var appliedState *datastore.AppliedState
+		// rules is the number of rules of the policy for the pod, negative until the ruleset is rendered
+		rules := -1
+		if n.State != nil {
+			hash, count, err := n.renderRuleset(ctx, enforcedPod, enforcedInterfaces, policy)
+			if n.rejectRuleset(&pod, policy, err, logger) {
+				continue
+			}
+			if err != nil {
+				return NewSyncError("failed to render NFTables policies: %v", err)
+			}
 
-				if operation == SyncOperationCreate {
-					err = n.enforcePolicy(ctx, &pod, interfaces, policy, logger)
+			appliedState = &datastore.AppliedState{PodUID: pod.UID, Sandbox: netnsPath, Hash: hash}
+			rules = count
+			if state, ok := n.State.GetAppliedState(policyKey, podKey); ok && state == *appliedState {
+				logger.V(1).Info("Policy already applied to the pod, skipping")
+				metrics.SkippedPolicyApplies.Inc()
+				if n.EnforcementAnnotations {
+					n.annotateEnforcement(ctx, &pod, interfaces, policy, operation, appliedState, logger)
 				}
+				if n.RecordNetworkStatistics {
+					n.recordNetworkStatistics(ctx, &pod, interfaces, policy, operation, rules, logger)
+				}
+				continue
+			}
+		}
 
+		// The other policies selecting the pod which are not applied to it yet, e.g. all the policies of a new pod, are
+		// applied in the same entry of its network namespace, their own syncs then skip the pod
+		var pending []pendingPolicy
+		if _, ok := shared[netnsPath]; !ok && n.State != nil && !enforced[netnsPath] {
+			pending = n.pendingPolicies(ctx, policy, &pod, interfaces, netnsPath)
+		}
+
+		release := func() {}
+		if !enforced[netnsPath] {
+			var err error
+			release, err = n.acquireNetNS(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Use anonymous function to ensure the slot is always released for this iteration
+		err := func() error {
+			defer release()
+
+			// The pods sharing the network namespace were synced together with a previous one
+			if enforced[netnsPath] {
+				return nil
+			}
+
+			// The applies are journaled until they are verified, a crash in between leaves the pod partially applied
+			policies := []*datastore.Policy{policy}
+			ends := []func(){n.beginTransaction(policyKey, &pod, netnsPath, datastore.IntentApply)}
+			for _, p := range pending {
+				policies = append(policies, p.policy)
+				ends = append(ends, n.beginTransaction(p.key(), &pod, netnsPath, datastore.IntentApply))
+			}
+
+			applied, err := enforcer.Enforce(ctx, netnsPath, enforcedPod, enforcedInterfaces, policies, logger)
+			for _, end := range ends {
+				end()
+			}
+
+			// The pending policies that were applied are skipped by their own syncs, the others are left to them
+			if applied > 0 {
+				for _, p := range pending[:applied-1] {
+					states = append(states, datastore.AppliedStateChange{Policy: p.key(), Pod: podKey, State: &p.state})
+				}
 				if err != nil {
-					return NewSyncError("failed to enforce NFTables policies: %v", err)
+					logger.Info("Failed to apply pending policy, leaving it to its sync", "pendingPolicy", pending[applied-1].key(), "error", err)
 				}
-
 				return nil
-			})
+			}
+
+			var sizeError *RulesetSizeError
+			var missingError *MissingInterfacesError
+			if errors.As(err, &sizeError) || errors.As(err, &missingError) || errors.Is(err, ErrNetNSNotFound) {
+				return err
+			}
+
+			if err != nil {
+				return NewSyncError("failed to enforce NFTables policies: %v", err)
+			}
+
+			return nil
 		}()
+		if errors.Is(err, ErrNetNSNotFound) {
+			logger.V(1).Info("Failed to open network namespace, skipping")
+			continue
+		}
+
+		if n.rejectRuleset(&pod, policy, err, logger) {
+			continue
+		}
+
+		var missingError *MissingInterfacesError
+		if errors.As(err, &missingError) {
+			// The other pods are enforced, the sync fails at the end to be retried with backoff
+			logger.Info("Interfaces missing from the network namespace, retrying later", "interfaces", missingError.Interfaces)
+			n.recordEvent(&pod, corev1.EventTypeWarning, "InterfacesMissing",
+				"Policy %s/%s is not applied: %v", policy.Namespace, policy.Name, err)
+			missingPods++
+			continue
+		}
+
 		if err != nil {
 			// Check if this is an actual nftables error vs pod lifecycle error
 			var syncError *SyncError
@@ -168,14 +740,196 @@ func (n *NFTables) SyncPolicy(ctx context.Context, policy *datastore.Policy, ope
 			}
 
 			logger.Info("Pod lifecycle error, ignoring", "error", err)
+			continue
+		}
+
+		enforced[netnsPath] = true
+
+		if n.State != nil {
+			states = append(states, datastore.AppliedStateChange{Policy: policyKey, Pod: podKey, State: appliedState})
 		}
+
+		if n.EnforcementAnnotations {
+			n.annotateEnforcement(ctx, &pod, interfaces, policy, operation, appliedState, logger)
+		}
+		if n.RecordNetworkStatistics {
+			n.recordNetworkStatistics(ctx, &pod, interfaces, policy, operation, rules, logger)
+		}
+	}
+
+	if err := n.releaseExcludedPods(ctx, policy, excluded, enforced, logger); err != nil {
+		return err
+	}
+
+	if missingPods > 0 {
+		return NewSyncError("interfaces of %d pods are missing from their network namespaces", missingPods)
+	}
+
+	if notReadyPods > 0 {
+		return NewSyncError("networks of %d pods are not configured in their network status yet", notReadyPods)
 	}
 
 	return nil
 }
 
-// getInterfaces gets the interfaces for a pod
-func getInterfaces(pod *corev1.Pod) []Interface {
+// pendingPolicy is a policy of the datastore applied with the policy being synced to a pod, with its state on the pod
+type pendingPolicy struct {
+	policy *datastore.Policy
+	state  datastore.AppliedState
+}
+
+func (p pendingPolicy) key() types.NamespacedName {
+	return types.NamespacedName{Namespace: p.policy.Namespace, Name: p.policy.Name}
+}
+
+// pendingPolicies returns the other policies of the datastore selecting a pod whose current ruleset is not applied to
+// it. The policies that cannot be rendered are left to their own syncs, which report the errors.
+func (n *NFTables) pendingPolicies(ctx context.Context, policy *datastore.Policy, pod *corev1.Pod, interfaces []Interface, sandbox string) []pendingPolicy {
+	podKey := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+	var pending []pendingPolicy
+	for _, other := range n.State.ListPolicies() {
+		if other.Namespace != policy.Namespace || other.Name == policy.Name ||
+			!utils.MatchesSelector(other.Spec.PodSelector, pod.Labels) || len(getPolicyInterfaces(interfaces, other, pod)) == 0 {
+			continue
+		}
+
+		hash, _, err := n.renderRuleset(ctx, pod, interfaces, other)
+		if err != nil {
+			continue
+		}
+
+		p := pendingPolicy{policy: other, state: datastore.AppliedState{PodUID: pod.UID, Sandbox: sandbox, Hash: hash}}
+		if state, ok := n.State.GetAppliedState(p.key(), podKey); ok && state == p.state {
+			continue
+		}
+		pending = append(pending, p)
+	}
+
+	slices.SortFunc(pending, func(a, b pendingPolicy) int {
+		return cmp.Compare(a.key().String(), b.key().String())
+	})
+
+	return pending
+}
+
+// EnforcedNetworks returns the networks of a policy with interfaces of the pods of the node selected by the policy
+func (n *NFTables) EnforcedNetworks(ctx context.Context, policy *datastore.Policy) ([]string, error) {
+	pods, err := n.listNodePods(ctx, policy.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var networks []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels) {
+			continue
+		}
+
+		for _, intf := range getPolicyInterfaces(GetInterfaces(pod), policy, pod) {
+			if !slices.Contains(networks, intf.Network) {
+				networks = append(networks, intf.Network)
+			}
+		}
+	}
+
+	return networks, nil
+}
+
+// listNodePods lists the running pods of the node in a namespace with a network annotation
+func (n *NFTables) listNodePods(ctx context.Context, namespace string) (*corev1.PodList, error) {
+	pods := &corev1.PodList{}
+	err := n.Client.List(ctx, pods,
+		client.InNamespace(namespace),
+		client.MatchingFields{
+			PodHostnameIndex:             n.Hostname,
+			PodStatusIndex:               string(corev1.PodRunning),
+			PodHostNetworkIndex:          "false",
+			PodHasNetworkAnnotationIndex: "true",
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods for hostname %s: %w", n.Hostname, err)
+	}
+
+	return pods, nil
+}
+
+// renderHash renders the policy for the pod in an empty table and returns the hash of the ruleset,
+// which changes when anything the ruleset depends on changes, e.g. the peers or the common rules
+func (n *NFTables) renderHash(ctx context.Context, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy) (string, error) {
+	hash, _, err := n.renderRuleset(ctx, pod, interfaces, policy)
+	return hash, err
+}
+
+// renderRuleset renders the policy for the pod in an empty table and returns the hash of the ruleset with the number of
+// rules of the policy
+func (n *NFTables) renderRuleset(ctx context.Context, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy) (string, int, error) {
+	nft := knftables.NewFake(knftables.InetFamily, tableName)
+	desired, err := n.applyPolicy(ctx, nft, pod, interfaces, policy, logr.Discard())
+	if err != nil {
+		return "", 0, err
+	}
+
+	rules := 0
+	if desired != nil {
+		rules = desired.ruleCount()
+	}
+
+	return hashRuleset(nft.Dump()), rules, nil
+}
+
+// hashRuleset returns the hash of a ruleset dumped by a fake
+func hashRuleset(dump string) string {
+	// The order of the set elements depends on the order of the listed peers
+	lines := strings.Split(dump, "\n")
+	slices.Sort(lines)
+
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// CollectPods forgets the state kept in memory for the pods that are not kept, and returns the number of forgotten pods
+func (n *NFTables) CollectPods(keep func(pod types.NamespacedName) bool) int {
+	return n.setElements.collect(keep) + n.unenforceable.collect(keep) + n.enforcements.collect(keep) + n.networkStats.collect(keep) + n.sandboxes.collect(keep) + n.readiness.collect(keep)
+}
+
+// SetCommonRules replaces the common rules, they are applied on the next enforcement of each policy
+func (n *NFTables) SetCommonRules(commonRules *CommonRules) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.CommonRules = commonRules
+}
+
+// SetClusterCommonRules replaces the common rules managed through the API, they are merged into the common rules
+// on the next enforcement of each policy
+func (n *NFTables) SetClusterCommonRules(commonRules *CommonRules) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.clusterCommonRules = commonRules
+}
+
+// getCommonRules returns the current common rules merged with the cluster common rules
+func (n *NFTables) getCommonRules() *CommonRules {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return n.CommonRules.Merge(n.clusterCommonRules)
+}
+
+// recordEvent records an event on the pod if a recorder is configured
+func (n *NFTables) recordEvent(pod *corev1.Pod, eventType string, reason string, messageFmt string, args ...interface{}) {
+	if n.Recorder == nil {
+		return
+	}
+
+	n.Recorder.Eventf(pod, eventType, reason, messageFmt, args...)
+}
+
+// GetInterfaces gets the interfaces for a pod
+func GetInterfaces(pod *corev1.Pod) []Interface {
 	networks, _ := netdefutils.ParsePodNetworkAnnotation(pod)
 
 	networkNames := make([]string, 0, len(networks))
@@ -229,6 +983,100 @@ func getMatchedInterfaces(interfaces []Interface, networks []string) []Interface
 	return matchedInterfaces
 }
 
+// scopeInterfaces keeps the interfaces named by the interfaces annotations of the policy and of the pod, when they are set
+func scopeInterfaces(interfaces []Interface, policy *datastore.Policy, pod *corev1.Pod) []Interface {
+	var podInterfaces []string
+	if value, ok := pod.Annotations[datastore.InterfacesAnnotation]; ok {
+		podInterfaces = datastore.ParseInterfaces(value)
+	}
+
+	if len(policy.Interfaces) == 0 && len(podInterfaces) == 0 {
+		return interfaces
+	}
+
+	var scopedInterfaces []Interface
+	for _, intf := range interfaces {
+		if len(policy.Interfaces) != 0 && !slices.Contains(policy.Interfaces, intf.Name) {
+			continue
+		}
+		if len(podInterfaces) != 0 && !slices.Contains(podInterfaces, intf.Name) {
+			continue
+		}
+		scopedInterfaces = append(scopedInterfaces, intf)
+	}
+
+	return scopedInterfaces
+}
+
+// getPolicyInterfaces returns the interfaces of a pod a policy applies to: the interfaces on the networks of the policy
+// and, when the interfaces annotations of the policy or the pod are set, that they name, with the other interfaces of
+// their groups
+func getPolicyInterfaces(interfaces []Interface, policy *datastore.Policy, pod *corev1.Pod) []Interface {
+	return expandInterfaceGroups(interfaces, scopeInterfaces(getMatchedInterfaces(interfaces, policy.Networks), policy, pod), pod)
+}
+
+// expandInterfaceGroups adds to the matched interfaces the other interfaces of their groups set by the interface groups
+// annotation of the pod, on the network of the matched interface, so that the rules of the network are applied to the
+// whole group and a failover does not change what is allowed. The invalid groups are ignored.
+func expandInterfaceGroups(interfaces []Interface, matched []Interface, pod *corev1.Pod) []Interface {
+	value, ok := pod.Annotations[datastore.InterfaceGroupsAnnotation]
+	if !ok || len(matched) == 0 {
+		return matched
+	}
+
+	groups, _ := datastore.ParseInterfaceGroups(value)
+	for _, group := range groups {
+		i := slices.IndexFunc(matched, func(intf Interface) bool { return slices.Contains(group, intf.Name) })
+		if i < 0 {
+			continue
+		}
+		network := matched[i].Network
+
+		for _, intf := range interfaces {
+			if !slices.Contains(group, intf.Name) || slices.ContainsFunc(matched, func(m Interface) bool { return m.Name == intf.Name }) {
+				continue
+			}
+
+			intf.Network = network
+			matched = append(matched, intf)
+		}
+	}
+
+	return matched
+}
+
+// expandPeerInterfaceGroups returns the interfaces of a pod with the interfaces of each group also listed on the networks of
+// the other interfaces of the group, so that the addresses of a group are allowed as peers on each of its networks
+func expandPeerInterfaceGroups(pod *corev1.Pod, interfaces []Interface) []Interface {
+	value, ok := pod.Annotations[datastore.InterfaceGroupsAnnotation]
+	if !ok {
+		return interfaces
+	}
+
+	groups, _ := datastore.ParseInterfaceGroups(value)
+	grouped := slices.Clone(interfaces)
+	for _, group := range groups {
+		for _, intf := range interfaces {
+			if !slices.Contains(group, intf.Name) {
+				continue
+			}
+
+			for _, other := range interfaces {
+				if other.Name == intf.Name || !slices.Contains(group, other.Name) || other.Network == intf.Network {
+					continue
+				}
+
+				alias := Interface{Name: intf.Name, Network: other.Network, IPs: intf.IPs}
+				if !slices.ContainsFunc(grouped, func(g Interface) bool { return g.Name == alias.Name && g.Network == alias.Network }) {
+					grouped = append(grouped, alias)
+				}
+			}
+		}
+	}
+
+	return grouped
+}
+
 // checkPolicyTypes checks if the policy has ingress or egress enabled
 func checkPolicyTypes(policy *datastore.Policy) (bool, bool) {
 	// if no policy types are specified, ingress is always set
@@ -236,5 +1084,5 @@ func checkPolicyTypes(policy *datastore.Policy) (bool, bool) {
 		return true, len(policy.Spec.Egress) > 0
 	}
 
-	return slices.Contains(policy.Spec.PolicyTypes, multiv1beta1.PolicyTypeIngress), slices.Contains(policy.Spec.PolicyTypes, multiv1beta1.PolicyTypeEgress)
+	return slices.Contains(policy.Spec.PolicyTypes, datastore.PolicyTypeIngress), slices.Contains(policy.Spec.PolicyTypes, datastore.PolicyTypeEgress)
 }
@@ -12,7 +12,6 @@ import (
 	"github.com/containernetworking/plugins/pkg/testutils"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/funcr"
-	multiv1beta1 "github.com/k8snetworkplumbingwg/multi-networkpolicy/pkg/apis/k8s.cni.cncf.io/v1beta1"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
@@ -254,7 +253,7 @@ var _ = Describe("NFTables Simple Integration Tests", func() {
 			}
 
 			// Clean up comprehensive policy
-			err = cleanUpPolicy(ctx, policy.Name, policy.Namespace, logger)
+			err = nftablesWithPods.cleanUpPolicy(ctx, policy.Name, policy.Namespace, logger)
 			if err != nil {
 				return err
 			}
@@ -277,7 +276,7 @@ var _ = Describe("NFTables Simple Integration Tests", func() {
 			defer runtime.UnlockOSThread()
 
 			// Clean up comprehensive policy
-			return cleanUpPolicy(ctx, "policy-test", "namespace", logger)
+			return (&NFTables{}).cleanUpPolicy(ctx, "policy-test", "namespace", logger)
 		})
 		Expect(err).NotTo(HaveOccurred())
 	})
@@ -374,19 +373,19 @@ var _ = Describe("Multiple NetworkAttachmentDefinitions Integration Tests", func
 				Name:      "red-policy",
 				Namespace: "test-ns",
 				Networks:  []string{"test-ns/red-net"},
-				Spec: multiv1beta1.MultiNetworkPolicySpec{
+				Spec: datastore.PolicySpec{
 					PodSelector: metav1.LabelSelector{
 						MatchLabels: map[string]string{"app": "target-pod"},
 					},
-					PolicyTypes: []multiv1beta1.MultiPolicyType{
-						multiv1beta1.PolicyTypeIngress,
-						multiv1beta1.PolicyTypeEgress,
+					PolicyTypes: []datastore.PolicyType{
+						datastore.PolicyTypeIngress,
+						datastore.PolicyTypeEgress,
 					},
-					Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{{
-						From: []multiv1beta1.MultiNetworkPolicyPeer{createPolicyPeer(map[string]string{"app": "red-pod-a"})},
+					Ingress: []datastore.IngressRule{{
+						From: []datastore.Peer{createPolicyPeer(map[string]string{"app": "red-pod-a"})},
 					}},
-					Egress: []multiv1beta1.MultiNetworkPolicyEgressRule{{
-						To: []multiv1beta1.MultiNetworkPolicyPeer{createPolicyPeer(map[string]string{"app": "red-pod-b"})},
+					Egress: []datastore.EgressRule{{
+						To: []datastore.Peer{createPolicyPeer(map[string]string{"app": "red-pod-b"})},
 					}},
 				},
 			}
@@ -395,19 +394,19 @@ var _ = Describe("Multiple NetworkAttachmentDefinitions Integration Tests", func
 				Name:      "blue-policy",
 				Namespace: "test-ns",
 				Networks:  []string{"test-ns/blue-net"},
-				Spec: multiv1beta1.MultiNetworkPolicySpec{
+				Spec: datastore.PolicySpec{
 					PodSelector: metav1.LabelSelector{
 						MatchLabels: map[string]string{"app": "target-pod"},
 					},
-					PolicyTypes: []multiv1beta1.MultiPolicyType{
-						multiv1beta1.PolicyTypeIngress,
-						multiv1beta1.PolicyTypeEgress,
+					PolicyTypes: []datastore.PolicyType{
+						datastore.PolicyTypeIngress,
+						datastore.PolicyTypeEgress,
 					},
-					Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{{
-						From: []multiv1beta1.MultiNetworkPolicyPeer{createPolicyPeer(map[string]string{"app": "blue-pod-a"})},
+					Ingress: []datastore.IngressRule{{
+						From: []datastore.Peer{createPolicyPeer(map[string]string{"app": "blue-pod-a"})},
 					}},
-					Egress: []multiv1beta1.MultiNetworkPolicyEgressRule{{
-						To: []multiv1beta1.MultiNetworkPolicyPeer{createPolicyPeer(map[string]string{"app": "blue-pod-b"})},
+					Egress: []datastore.EgressRule{{
+						To: []datastore.Peer{createPolicyPeer(map[string]string{"app": "blue-pod-b"})},
 					}},
 				},
 			}
@@ -433,8 +432,8 @@ var _ = Describe("Multiple NetworkAttachmentDefinitions Integration Tests", func
 	})
 })
 
-func createPolicyPeer(matchLabels map[string]string) multiv1beta1.MultiNetworkPolicyPeer {
-	return multiv1beta1.MultiNetworkPolicyPeer{
+func createPolicyPeer(matchLabels map[string]string) datastore.Peer {
+	return datastore.Peer{
 		PodSelector: &metav1.LabelSelector{
 			MatchLabels: matchLabels,
 		},
@@ -554,13 +553,13 @@ func createDenyAllPolicy(name, namespace string) *datastore.Policy {
 		Name:      name,
 		Namespace: namespace,
 		Networks:  []string{"test-ns/net1", "test-ns/net2"},
-		Spec: multiv1beta1.MultiNetworkPolicySpec{
+		Spec: datastore.PolicySpec{
 			PodSelector: metav1.LabelSelector{
 				MatchLabels: map[string]string{"app": "web"},
 			},
-			PolicyTypes: []multiv1beta1.MultiPolicyType{
-				multiv1beta1.PolicyTypeIngress,
-				multiv1beta1.PolicyTypeEgress,
+			PolicyTypes: []datastore.PolicyType{
+				datastore.PolicyTypeIngress,
+				datastore.PolicyTypeEgress,
 			},
 			// Empty Ingress and Egress = deny all
 		},
@@ -572,18 +571,18 @@ func createAcceptAllPolicy(name, namespace string) *datastore.Policy {
 		Name:      name,
 		Namespace: namespace,
 		Networks:  []string{"test-ns/net1", "test-ns/net2"},
-		Spec: multiv1beta1.MultiNetworkPolicySpec{
+		Spec: datastore.PolicySpec{
 			PodSelector: metav1.LabelSelector{
 				MatchLabels: map[string]string{"app": "web"},
 			},
-			PolicyTypes: []multiv1beta1.MultiPolicyType{
-				multiv1beta1.PolicyTypeIngress,
-				multiv1beta1.PolicyTypeEgress,
+			PolicyTypes: []datastore.PolicyType{
+				datastore.PolicyTypeIngress,
+				datastore.PolicyTypeEgress,
 			},
-			Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{
+			Ingress: []datastore.IngressRule{
 				{}, // Empty From = accept all
 			},
-			Egress: []multiv1beta1.MultiNetworkPolicyEgressRule{
+			Egress: []datastore.EgressRule{
 				{}, // Empty To = accept all
 			},
 		},
@@ -596,26 +595,26 @@ func createAcceptAllWithPortsPolicy(name, namespace string) *datastore.Policy {
 		Name:      name,
 		Namespace: namespace,
 		Networks:  []string{"test-ns/net1", "test-ns/net2"},
-		Spec: multiv1beta1.MultiNetworkPolicySpec{
+		Spec: datastore.PolicySpec{
 			PodSelector: metav1.LabelSelector{
 				MatchLabels: map[string]string{"app": "web"},
 			},
-			PolicyTypes: []multiv1beta1.MultiPolicyType{
-				multiv1beta1.PolicyTypeIngress,
-				multiv1beta1.PolicyTypeEgress,
+			PolicyTypes: []datastore.PolicyType{
+				datastore.PolicyTypeIngress,
+				datastore.PolicyTypeEgress,
 			},
-			Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{
+			Ingress: []datastore.IngressRule{
 				{
-					Ports: []multiv1beta1.MultiNetworkPolicyPort{
+					Ports: []datastore.Port{
 						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 80}},                      // Specific port
 						{Port: &intstr.IntOrString{Type: intstr.String, StrVal: "https"}},              // Named port
 						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 8000}, EndPort: &endPort}, // Port range
 					},
 				},
 			},
-			Egress: []multiv1beta1.MultiNetworkPolicyEgressRule{
+			Egress: []datastore.EgressRule{
 				{
-					Ports: []multiv1beta1.MultiNetworkPolicyPort{
+					Ports: []datastore.Port{
 						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 443}}, // HTTPS egress
 					},
 				},
@@ -630,25 +629,25 @@ func createComprehensivePolicy(name, namespace string) *datastore.Policy {
 		Name:      name,
 		Namespace: namespace,
 		Networks:  []string{"test-ns/net1", "test-ns/net2"},
-		Spec: multiv1beta1.MultiNetworkPolicySpec{
+		Spec: datastore.PolicySpec{
 			PodSelector: metav1.LabelSelector{
 				MatchLabels: map[string]string{"app": "web"},
 			},
-			PolicyTypes: []multiv1beta1.MultiPolicyType{
-				multiv1beta1.PolicyTypeIngress,
-				multiv1beta1.PolicyTypeEgress,
+			PolicyTypes: []datastore.PolicyType{
+				datastore.PolicyTypeIngress,
+				datastore.PolicyTypeEgress,
 			},
-			Ingress: []multiv1beta1.MultiNetworkPolicyIngressRule{
+			Ingress: []datastore.IngressRule{
 				{
 					// Rule 0: Pod selector
-					From: []multiv1beta1.MultiNetworkPolicyPeer{
+					From: []datastore.Peer{
 						{
 							PodSelector: &metav1.LabelSelector{
 								MatchLabels: map[string]string{"app": "backend"},
 							},
 						},
 					},
-					Ports: []multiv1beta1.MultiNetworkPolicyPort{
+					Ports: []datastore.Port{
 						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 80}},                      // Specific port
 						{Port: &intstr.IntOrString{Type: intstr.String, StrVal: "https"}},              // Named port
 						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 8000}, EndPort: &endPort}, // Port range
@@ -656,7 +655,7 @@ func createComprehensivePolicy(name, namespace string) *datastore.Policy {
 				},
 				{
 					// Rule 1: Namespace selector
-					From: []multiv1beta1.MultiNetworkPolicyPeer{
+					From: []datastore.Peer{
 						{
 							NamespaceSelector: &metav1.LabelSelector{
 								MatchLabels: map[string]string{"env": "prod"},
@@ -666,31 +665,31 @@ func createComprehensivePolicy(name, namespace string) *datastore.Policy {
 				},
 				{
 					// Rule 2: IPBlock with exceptions
-					From: []multiv1beta1.MultiNetworkPolicyPeer{
+					From: []datastore.Peer{
 						{
-							IPBlock: &multiv1beta1.IPBlock{
+							IPBlock: &datastore.IPBlock{
 								CIDR:   "10.0.0.0/8",
 								Except: []string{"10.1.0.0/16"},
 							},
 						},
 						{
-							IPBlock: &multiv1beta1.IPBlock{
+							IPBlock: &datastore.IPBlock{
 								CIDR:   "2001:db8::/32",
 								Except: []string{"2001:db8:1::/48"},
 							},
 						},
 					},
-					Ports: []multiv1beta1.MultiNetworkPolicyPort{
+					Ports: []datastore.Port{
 						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 80}},                      // Specific port
 						{Port: &intstr.IntOrString{Type: intstr.String, StrVal: "https"}},              // Named port
 						{Port: &intstr.IntOrString{Type: intstr.Int, IntVal: 8000}, EndPort: &endPort}, // Port range
 					},
 				},
 			},
-			Egress: []multiv1beta1.MultiNetworkPolicyEgressRule{
+			Egress: []datastore.EgressRule{
 				{
 					// Egress to database pods
-					To: []multiv1beta1.MultiNetworkPolicyPeer{
+					To: []datastore.Peer{
 						{
 							NamespaceSelector: &metav1.LabelSelector{
 								MatchLabels: map[string]string{"env": "prod"},
@@ -0,0 +1,168 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// PeerResolver resolves the addresses of endpoints outside of the cluster, e.g. the hosts of a CMDB, the routes learned
+// over BGP or the VMs of an inventory, that the policies add to the peers of their rules with the external peers
+// annotation. The endpoints are allowed like the IP blocks of the rules, on all the interfaces the policy applies to.
+type PeerResolver interface {
+	// Resolve returns the addresses and CIDRs of the endpoints of a reference of a policy. An error fails the sync of
+	// the policy, which keeps the rules previously applied and is retried.
+	Resolve(ctx context.Context, policy types.NamespacedName, reference string) ([]string, error)
+}
+
+// PeerResolverFunc is a function resolving the endpoints of a reference as a PeerResolver
+type PeerResolverFunc func(ctx context.Context, policy types.NamespacedName, reference string) ([]string, error)
+
+// Resolve calls the function
+func (f PeerResolverFunc) Resolve(ctx context.Context, policy types.NamespacedName, reference string) ([]string, error) {
+	return f(ctx, policy, reference)
+}
+
+var (
+	peerResolversMu sync.RWMutex
+	peerResolvers   = make(map[string]PeerResolver)
+	// peerResolverChange is called with the name of the peer resolvers whose endpoints changed
+	peerResolverChange func(name string)
+)
+
+// RegisterPeerResolver registers a peer resolver under a name, the resolver of the references "<name>:<reference>"
+// of the external peers annotation. It is meant to be called from the init function of the package of the resolver,
+// before the controller starts. The name must not be empty nor contain a colon, and must not be registered already.
+func RegisterPeerResolver(name string, resolver PeerResolver) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("invalid peer resolver name %q", name)
+	}
+	if resolver == nil {
+		return fmt.Errorf("peer resolver %s is nil", name)
+	}
+
+	peerResolversMu.Lock()
+	defer peerResolversMu.Unlock()
+
+	if _, ok := peerResolvers[name]; ok {
+		return fmt.Errorf("peer resolver %s is already registered", name)
+	}
+	peerResolvers[name] = resolver
+
+	return nil
+}
+
+// PeerResolvers returns the names of the registered peer resolvers
+func PeerResolvers() []string {
+	peerResolversMu.RLock()
+	defer peerResolversMu.RUnlock()
+
+	names := make([]string, 0, len(peerResolvers))
+	for name := range peerResolvers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// getPeerResolver returns a registered peer resolver
+func getPeerResolver(name string) (PeerResolver, bool) {
+	peerResolversMu.RLock()
+	defer peerResolversMu.RUnlock()
+
+	resolver, ok := peerResolvers[name]
+	return resolver, ok
+}
+
+// OnPeerResolverChange sets the function called when a peer resolver reports that its endpoints changed, the
+// controller resyncs the policies with external peers of the resolver
+func OnPeerResolverChange(fn func(name string)) {
+	peerResolversMu.Lock()
+	defer peerResolversMu.Unlock()
+
+	peerResolverChange = fn
+}
+
+// PeerResolverChanged is called by a peer resolver when its endpoints changed, to resolve them again for the policies
+// referencing it. The resolvers are not polled, the endpoints are otherwise only resolved again when the policies are
+// synced for another reason.
+func PeerResolverChanged(name string) {
+	peerResolversMu.RLock()
+	fn := peerResolverChange
+	peerResolversMu.RUnlock()
+
+	if fn != nil {
+		fn(name)
+	}
+}
+
+// hasExternalPeers checks if a rule of a policy has external peers
+func hasExternalPeers(policy *datastore.Policy, direction string, rule int) bool {
+	return slices.ContainsFunc(policy.ExternalPeers, func(peer datastore.ExternalPeer) bool {
+		return peer.Direction == direction && peer.Rule == rule
+	})
+}
+
+// withExternalPeers returns the peer set of a rule of a policy with the endpoints of its external peers added to the
+// CIDRs. The peer set is not modified, it can be shared with the compiled policy.
+func withExternalPeers(ctx context.Context, set *peerSet, direction string, rule int, policy *datastore.Policy, logger logr.Logger) (*peerSet, error) {
+	if !hasExternalPeers(policy, direction, rule) {
+		return set, nil
+	}
+
+	key := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+
+	var cidrs []string
+	for _, peer := range policy.ExternalPeers {
+		if peer.Direction != direction || peer.Rule != rule {
+			continue
+		}
+
+		resolver, ok := getPeerResolver(peer.Resolver)
+		if !ok {
+			return nil, fmt.Errorf("peer resolver %s of external peer %s is not registered", peer.Resolver, peer)
+		}
+
+		endpoints, err := resolver.Resolve(ctx, key, peer.Reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve external peer %s: %w", peer, err)
+		}
+
+		var resolved []string
+		for _, endpoint := range endpoints {
+			cidr, err := datastore.AddressCIDR(strings.TrimSpace(endpoint))
+			if err != nil {
+				logger.Info("Ignoring invalid address of external peer", "peer", peer.String(), "address", endpoint)
+				continue
+			}
+
+			if !slices.Contains(cidrs, cidr) {
+				resolved = append(resolved, cidr)
+				cidrs = append(cidrs, cidr)
+			}
+		}
+
+		logger.V(debugVerbosity).Info("External peer resolved", "peer", peer.String(), "cidrs", resolved)
+	}
+
+	merged := &peerSet{}
+	if set != nil {
+		*merged = *set
+	}
+
+	ipv4CIDRs, ipv6CIDRs := utils.SplitCIDRs(cidrs)
+	merged.ipv4CIDRs = append(slices.Clone(merged.ipv4CIDRs), ipv4CIDRs...)
+	merged.ipv6CIDRs = append(slices.Clone(merged.ipv6CIDRs), ipv6CIDRs...)
+	merged.cidrs += len(cidrs)
+
+	return merged, nil
+}
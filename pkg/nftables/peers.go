@@ -0,0 +1,182 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// peerSet is the addresses of the peers of a rule of a policy, by family
+type peerSet struct {
+	// pods is the number of pods selected by the peers
+	pods          int
+	ipv4Addresses []string
+	ipv6Addresses []string
+	// networks are the addresses of the pods selected by the peers by network, nil for the peer sets provided by the
+	// caller whose addresses are allowed on all the interfaces
+	networks map[string]*networkAddresses
+
+	cidrs       int
+	excepts     int
+	ipv4CIDRs   []string
+	ipv6CIDRs   []string
+	ipv4Excepts []string
+	ipv6Excepts []string
+}
+
+// networkAddresses are the addresses of the peer pods on a network, by family
+type networkAddresses struct {
+	ipv4 []string
+	ipv6 []string
+}
+
+// interfaceAddresses returns the addresses of the peer pods allowed on an interface of the target pod, by family: their
+// addresses on the network of the interface, and on the peer networks of the policy which are not networks of the
+// policy. The networks of the policy can use overlapping ranges, the address of a peer on one of them must not allow
+// another pod with the same address on another one.
+func (p *peerSet) interfaceAddresses(intf Interface, policy *datastore.Policy) ([]string, []string) {
+	if p.networks == nil {
+		return p.ipv4Addresses, p.ipv6Addresses
+	}
+
+	var ipv4Addresses, ipv6Addresses []string
+	for _, network := range slices.Sorted(maps.Keys(p.networks)) {
+		if network != intf.Network && slices.Contains(policy.Networks, network) {
+			continue
+		}
+
+		addresses := p.networks[network]
+		ipv4Addresses = append(ipv4Addresses, addresses.ipv4...)
+		ipv6Addresses = append(ipv6Addresses, addresses.ipv6...)
+	}
+
+	return ipv4Addresses, ipv6Addresses
+}
+
+// peerSetKey identifies a rule of a policy, the networks of the policy are the same for every rule. The policy is
+// empty in the peer sets provided by the caller, which are the ones of a single policy.
+type peerSetKey struct {
+	policy    types.NamespacedName
+	direction string
+	rule      int
+}
+
+// peerSets caches the peer sets of the rules of the policies during a sync. The peers do not depend on the target pod, so
+// they are resolved once and shared by all the target pods, only the chains and sets of each pod are rendered for it.
+type peerSets struct {
+	mu   sync.Mutex
+	sets map[peerSetKey]*peerSet
+	// static peer sets are provided by the caller, the missing ones selecting pods or namespaces are not resolved
+	static bool
+}
+
+// peerSetsContextKey is the context key of the peer sets of a sync
+type peerSetsContextKey struct{}
+
+// withPeerSets returns a context sharing the peer sets of the policies, between the pods of a sync
+func withPeerSets(ctx context.Context) context.Context {
+	return context.WithValue(ctx, peerSetsContextKey{}, &peerSets{sets: make(map[peerSetKey]*peerSet)})
+}
+
+// withStaticPeerSets returns a context with the peer sets provided by the caller, instead of resolving them
+func withStaticPeerSets(ctx context.Context, sets map[PeerSetKey]PeerSet) context.Context {
+	cache := &peerSets{sets: make(map[peerSetKey]*peerSet, len(sets)), static: true}
+	for key, set := range sets {
+		cache.sets[peerSetKey{direction: key.Direction, rule: key.Rule}] = set.toPeerSet()
+	}
+
+	return context.WithValue(ctx, peerSetsContextKey{}, cache)
+}
+
+// getPeerSet returns the peer set of a rule of a policy, from the peer sets of the context when it has them. The peer
+// set compiled from the IP blocks of the rule is used when the rule has only IP blocks, it can be nil. The endpoints of
+// the external peers of the rule are added to the peer sets resolved here, not to the ones provided by the caller.
+func (n *NFTables) getPeerSet(ctx context.Context, direction string, rule int, peers []datastore.Peer, ipBlocks *peerSet, policy *datastore.Policy, logger logr.Logger) (*peerSet, error) {
+	cache, ok := ctx.Value(peerSetsContextKey{}).(*peerSets)
+	if !ok {
+		set := ipBlocks
+		if set == nil {
+			var err error
+			if set, err = n.resolvePeerSet(ctx, peers, policy, logger); err != nil {
+				return nil, err
+			}
+		}
+		return withExternalPeers(ctx, set, direction, rule, policy, logger)
+	}
+
+	// The lock is held while the peers are resolved, so that concurrent pods wait for them instead of resolving them again
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := peerSetKey{direction: direction, rule: rule}
+	if !cache.static {
+		key.policy = types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+	}
+	if set, ok := cache.sets[key]; ok {
+		logger.V(1).Info("Using shared peer set", "direction", direction, "rule", rule)
+		return set, nil
+	}
+
+	// Only the IP blocks can be resolved without the cluster and the peer resolvers
+	if cache.static && (hasExternalPeers(policy, direction, rule) || slices.ContainsFunc(peers, func(peer datastore.Peer) bool { return peer.IPBlock == nil })) {
+		return nil, fmt.Errorf("missing peer set of %s rule %d", direction, rule)
+	}
+
+	set := ipBlocks
+	if set == nil {
+		var err error
+		if set, err = n.resolvePeerSet(ctx, peers, policy, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	set, err := withExternalPeers(ctx, set, direction, rule, policy, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.sets[key] = set
+	return set, nil
+}
+
+// resolvePeerSet resolves the addresses of the peers of a rule of a policy
+func (n *NFTables) resolvePeerSet(ctx context.Context, peers []datastore.Peer, policy *datastore.Policy, logger logr.Logger) (*peerSet, error) {
+	defer addStageDuration(ctx, stagePeerResolution, time.Now())
+
+	// Get the peer info which contains the pods, cidrs and excepts
+	peerInfo, err := n.parsePeers(ctx, peers, policy.Namespace, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &peerSet{
+		pods:    len(peerInfo.pods),
+		cidrs:   len(peerInfo.cidrs),
+		excepts: len(peerInfo.excepts),
+	}
+
+	logPeerAddresses(logger, peerInfo.pods, policy)
+
+	if len(peerInfo.pods) != 0 {
+		set.networks = classifyNetworkAddresses(getPodInterfacesMap(peerInfo.pods, policy), policy)
+		for _, network := range slices.Sorted(maps.Keys(set.networks)) {
+			addresses := set.networks[network]
+			set.ipv4Addresses = append(set.ipv4Addresses, addresses.ipv4...)
+			set.ipv6Addresses = append(set.ipv6Addresses, addresses.ipv6...)
+		}
+	}
+
+	set.ipv4CIDRs, set.ipv6CIDRs = utils.SplitCIDRs(peerInfo.cidrs)
+	set.ipv4Excepts, set.ipv6Excepts = utils.SplitCIDRs(peerInfo.excepts)
+
+	return set, nil
+}
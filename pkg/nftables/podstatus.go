@@ -0,0 +1,134 @@
+package nftables
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// podEnforcements remembers the policies applied to each pod with the hash of their ruleset, for the enforcement
+// status annotations of the pods
+type podEnforcements struct {
+	mu   sync.Mutex
+	pods map[types.NamespacedName]podEnforcement
+}
+
+// podEnforcement is the policies applied to a pod
+type podEnforcement struct {
+	uid      types.UID
+	policies map[types.NamespacedName]string
+}
+
+// set records the hash of the ruleset of a policy applied to a pod, or forgets the policy when the hash is empty, and
+// returns the hash of the policies applied to the pod with their number. The policies of a previous pod with the same
+// name are forgotten.
+func (p *podEnforcements) set(pod *corev1.Pod, policy types.NamespacedName, hash string) (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pods == nil {
+		p.pods = make(map[types.NamespacedName]podEnforcement)
+	}
+
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	enforcement, ok := p.pods[key]
+	if !ok || enforcement.uid != pod.UID {
+		enforcement = podEnforcement{uid: pod.UID, policies: make(map[types.NamespacedName]string)}
+		p.pods[key] = enforcement
+	}
+
+	if hash == "" {
+		delete(enforcement.policies, policy)
+	} else {
+		enforcement.policies[policy] = hash
+	}
+
+	sum := sha256.New()
+	for _, policy := range slices.SortedFunc(maps.Keys(enforcement.policies), func(a, b types.NamespacedName) int {
+		return strings.Compare(a.String(), b.String())
+	}) {
+		sum.Write([]byte(policy.String() + "=" + enforcement.policies[policy] + "\n"))
+	}
+
+	return hex.EncodeToString(sum.Sum(nil))[:16], len(enforcement.policies)
+}
+
+// collect forgets the policies of the pods not kept and returns the number of pods forgotten
+func (p *podEnforcements) collect(keep func(pod types.NamespacedName) bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	forgotten := 0
+	for pod := range p.pods {
+		if !keep(pod) {
+			delete(p.pods, pod)
+			forgotten++
+		}
+	}
+
+	return forgotten
+}
+
+// updateEnforcementStatus records the ruleset of a policy applied to a pod, an empty hash when the policy is not
+// applied to it, and stamps the enforcement status annotation of the pod when the policies applied to it changed. The
+// failures to stamp the pod are logged, they do not fail the enforcement.
+func (n *NFTables) updateEnforcementStatus(ctx context.Context, pod *corev1.Pod, policy types.NamespacedName, hash string, logger logr.Logger) {
+	setHash, count := n.enforcements.set(pod, policy, hash)
+
+	if value, ok := pod.Annotations[datastore.EnforcementStatusAnnotation]; ok {
+		if status, err := datastore.ParseEnforcementStatus(value); err == nil && status.Hash == setHash && status.Policies == count {
+			return
+		}
+	}
+
+	value, err := json.Marshal(datastore.EnforcementStatus{Hash: setHash, Policies: count, Time: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		logger.Error(err, "Failed to marshal enforcement status")
+		return
+	}
+
+	patch := client.MergeFrom(pod.DeepCopy())
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[datastore.EnforcementStatusAnnotation] = string(value)
+
+	if err := n.Client.Patch(ctx, pod, patch); err != nil && !apierrors.IsNotFound(err) {
+		logger.Info("Failed to update the enforcement status of the pod", "error", err.Error())
+	}
+}
+
+// annotateEnforcement updates the enforcement status of a pod after a policy was synced to it. The ruleset of the
+// policy is rendered again when the applied states are not recorded.
+func (n *NFTables) annotateEnforcement(ctx context.Context, pod *corev1.Pod, interfaces []Interface, policy *datastore.Policy, operation SyncOperation, state *datastore.AppliedState, logger logr.Logger) {
+	var hash string
+	if operation == SyncOperationCreate && utils.MatchesSelector(policy.Spec.PodSelector, pod.Labels) && len(getPolicyInterfaces(interfaces, policy, pod)) > 0 {
+		if state != nil {
+			hash = state.Hash
+		} else {
+			var err error
+			hash, err = n.renderHash(ctx, pod, interfaces, policy)
+			if err != nil {
+				logger.Info("Failed to render the ruleset of the enforcement status", "error", err.Error())
+				return
+			}
+		}
+	}
+
+	n.updateEnforcementStatus(ctx, pod, types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, hash, logger)
+}
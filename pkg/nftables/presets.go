@@ -0,0 +1,65 @@
+package nftables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// protocolPresetMatches are the matches of the traffic of the protocol presets, in both directions. The protocols
+// without ports are matched by number, the protocol names depend on the /etc/protocols of the pod.
+var protocolPresetMatches = map[string][]string{
+	// VRRP advertisements are only sent to the VRRP multicast groups
+	datastore.ProtocolPresetVRRP: {
+		"ip daddr 224.0.0.18 meta l4proto 112",
+		"ip6 daddr ff02::12 meta l4proto 112",
+	},
+	// OSPF hellos and floods are sent to the AllSPFRouters and AllDRouters groups, but the database exchange of an
+	// adjacency is unicast
+	datastore.ProtocolPresetOSPF: {
+		"meta l4proto 89",
+	},
+	// Single-hop control, echo and multihop control
+	datastore.ProtocolPresetBFD: {
+		"udp dport { 3784, 3785, 4784 }",
+	},
+	// Event and general messages, PTP over Ethernet is not IP traffic and is never filtered
+	datastore.ProtocolPresetPTP: {
+		"udp dport { 319, 320 }",
+	},
+	// Symmetric and server modes use port 123 on both sides, the replies of the client mode are tracked
+	datastore.ProtocolPresetNTP: {
+		"udp dport 123",
+	},
+}
+
+// createProtocolPresetRules creates the rules accepting the protocol presets of the networks of the matched interfaces
+// in the policy chain, as iifname or oifname
+func createProtocolPresetRules(tx *knftables.Transaction, matchedInterfaces []Interface, protocolPresets map[string][]string, npChain policyChain, direction string, logger logr.Logger) {
+	if len(protocolPresets) == 0 {
+		return
+	}
+
+	// The interfaces are grouped by preset, so that a preset allowed on several networks is rendered once
+	var presets []string
+	presetInterfaces := make(map[string][]string)
+	for _, intf := range matchedInterfaces {
+		for _, preset := range protocolPresets[intf.Network] {
+			if _, ok := presetInterfaces[preset]; !ok {
+				presets = append(presets, preset)
+			}
+			presetInterfaces[preset] = append(presetInterfaces[preset], intf.Name)
+		}
+	}
+
+	for _, preset := range presets {
+		logger.V(1).Info("Creating protocol preset rules", "preset", preset, "interfaces", presetInterfaces[preset])
+		for _, match := range protocolPresetMatches[preset] {
+			tx.Add(npChain.rule(knftables.Concat(direction, "{", strings.Join(presetInterfaces[preset], ", "), "}", match, "accept"), knftables.PtrTo(fmt.Sprintf("Preset %s", preset))))
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package nftables
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// pendingNetworks returns the networks of a policy in the network annotation of a pod that the CNI has not finished
+// configuring: missing from the network status, or reported without addresses while addresses are requested for them
+// or their IPAM assigns some. The policy rendered from such a network status would miss the interfaces or their
+// addresses, the other networks of the pod are not matched by the policy.
+func (n *NFTables) pendingNetworks(ctx context.Context, pod *corev1.Pod, policy *datastore.Policy) []string {
+	networks, err := netdefutils.ParsePodNetworkAnnotation(pod)
+	if err != nil {
+		return nil
+	}
+
+	networkStatus, _ := netdefutils.GetNetworkStatus(pod)
+
+	var pending []string
+	for _, network := range networks {
+		key := network.Namespace + "/" + network.Name
+		if !slices.Contains(policy.Networks, key) {
+			continue
+		}
+
+		reported, addressed := false, false
+		for _, status := range networkStatus {
+			name := status.Name
+			if !strings.Contains(name, "/") {
+				name = pod.Namespace + "/" + name
+			}
+
+			if name != key || (network.InterfaceRequest != "" && status.Interface != network.InterfaceRequest) {
+				continue
+			}
+
+			reported = true
+			addressed = addressed || len(status.IPs) > 0
+		}
+
+		if !reported || (!addressed && (len(network.IPRequest) > 0 || n.assignsAddresses(ctx, network.Namespace, network.Name))) {
+			pending = append(pending, key)
+		}
+	}
+
+	return pending
+}
+
+// assignsAddresses checks if the IPAM of the network attachment definition of a network assigns addresses to the
+// interfaces, a network without IPAM or that cannot be read is considered without addresses
+func (n *NFTables) assignsAddresses(ctx context.Context, namespace string, name string) bool {
+	netAttachDef := &netdefv1.NetworkAttachmentDefinition{}
+	if err := n.Client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, netAttachDef); err != nil {
+		return false
+	}
+
+	type ipamNetConf struct {
+		IPAM struct {
+			Type string `json:"type,omitempty"`
+		} `json:"ipam"`
+	}
+
+	netconf, err := utils.ParseFirstPluginConf[ipamNetConf](netAttachDef)
+	if err != nil {
+		return false
+	}
+
+	return netconf.IPAM.Type != ""
+}
+
+// interfaceReadiness remembers since when the networks of the pods are not configured by the CNI, the policies of
+// these networks are not applied to the pods until the network status is complete or the timeout elapsed
+type interfaceReadiness struct {
+	mu   sync.Mutex
+	pods map[types.NamespacedName]pendingPod
+}
+
+// pendingPod are the networks of a pod the CNI has not finished configuring
+type pendingPod struct {
+	uid      types.UID
+	networks map[string]pendingNetwork
+}
+
+// pendingNetwork is a network of a pod not configured since a time, reported once the timeout elapsed
+type pendingNetwork struct {
+	since    time.Time
+	reported bool
+}
+
+// update records the pending networks among the networks of a pod checked for a policy, and forgets the checked ones
+// that are not pending anymore. It returns since when the first of the pending networks is pending and those that
+// were not reported yet.
+func (r *interfaceReadiness) update(pod *corev1.Pod, checked []string, pending []string, now time.Time) (time.Time, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pods == nil {
+		r.pods = make(map[types.NamespacedName]pendingPod)
+	}
+
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	entry, ok := r.pods[key]
+	if !ok || entry.uid != pod.UID {
+		entry = pendingPod{uid: pod.UID, networks: make(map[string]pendingNetwork)}
+	}
+
+	for _, network := range checked {
+		if !slices.Contains(pending, network) {
+			delete(entry.networks, network)
+		}
+	}
+
+	var since time.Time
+	var unreported []string
+	for _, network := range pending {
+		state, ok := entry.networks[network]
+		if !ok {
+			state = pendingNetwork{since: now}
+			entry.networks[network] = state
+		}
+		if since.IsZero() || state.since.Before(since) {
+			since = state.since
+		}
+		if !state.reported {
+			unreported = append(unreported, network)
+		}
+	}
+
+	if len(entry.networks) == 0 {
+		delete(r.pods, key)
+	} else {
+		r.pods[key] = entry
+	}
+
+	return since, unreported
+}
+
+// report marks pending networks of a pod as reported
+func (r *interfaceReadiness) report(pod *corev1.Pod, networks []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+	entry, ok := r.pods[key]
+	if !ok {
+		return
+	}
+
+	for _, network := range networks {
+		if state, ok := entry.networks[network]; ok {
+			state.reported = true
+			entry.networks[network] = state
+		}
+	}
+}
+
+// collect forgets the pods not kept and returns the number of pods forgotten
+func (r *interfaceReadiness) collect(keep func(pod types.NamespacedName) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	forgotten := 0
+	for pod := range r.pods {
+		if !keep(pod) {
+			delete(r.pods, pod)
+			forgotten++
+		}
+	}
+
+	return forgotten
+}
+
+// waitInterfaces checks the network status of a pod before a policy is applied to it, and returns whether the sync
+// is retried because the CNI has not finished configuring the networks of the policy: until InterfaceReadyTimeout
+// elapsed since they were first found pending. Past the timeout, an InterfacesNotReady warning event is recorded on
+// the pod, the policy is applied to the interfaces of the network status and the next update of the network status
+// syncs the pod again.
+func (n *NFTables) waitInterfaces(ctx context.Context, pod *corev1.Pod, policy *datastore.Policy, logger logr.Logger) bool {
+	if n.InterfaceReadyTimeout <= 0 {
+		return false
+	}
+
+	pending := n.pendingNetworks(ctx, pod, policy)
+	since, unreported := n.readiness.update(pod, policy.Networks, pending, time.Now())
+	if len(pending) == 0 {
+		return false
+	}
+
+	if time.Since(since) < n.InterfaceReadyTimeout {
+		logger.Info("Networks not configured in the network status yet, retrying later", "networks", pending)
+		return true
+	}
+
+	if len(unreported) > 0 {
+		n.readiness.report(pod, unreported)
+		metrics.InterfaceMismatches.WithLabelValues("not_ready").Add(float64(len(unreported)))
+		logger.Info("Networks not configured in the network status in time, policies are applied to the configured interfaces", "networks", unreported, "timeout", n.InterfaceReadyTimeout)
+		n.recordEvent(pod, corev1.EventTypeWarning, "InterfacesNotReady",
+			"Networks %s are not configured in the network status after %s, the policies are applied to the configured interfaces until they are", strings.Join(unreported, ", "), n.InterfaceReadyTimeout)
+	}
+
+	return false
+}
@@ -0,0 +1,162 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// PeerSetKey identifies a rule of a policy, by direction ("ingress" or "egress") and index of the rule in the policy
+type PeerSetKey struct {
+	Direction string
+	Rule      int
+}
+
+// PeerSet is the resolved peers of a rule of a policy
+type PeerSet struct {
+	// IPv4Addresses and IPv6Addresses are the addresses of the pods selected by the peers, on the networks of the policy.
+	// They are not bound to a network, they are allowed on all the interfaces of the pod.
+	IPv4Addresses []string
+	IPv6Addresses []string
+	// IPv4CIDRs, IPv6CIDRs, IPv4Excepts and IPv6Excepts are the CIDRs of the IP blocks of the peers, the CIDRs include
+	// the endpoints of the external peers of the rule
+	IPv4CIDRs   []string
+	IPv6CIDRs   []string
+	IPv4Excepts []string
+	IPv6Excepts []string
+}
+
+// RenderInput is what the ruleset of a policy for a pod is rendered from
+type RenderInput struct {
+	Policy *datastore.Policy
+	// Pod is the target pod, only its metadata is read, to match the pod selector of the policy and to render the
+	// custom rules of the common rules
+	Pod *corev1.Pod
+	// Interfaces are the secondary interfaces of the pod
+	Interfaces []Interface
+	// PeerSets are the resolved peers of the rules of the policy selecting pods or namespaces or with external peers.
+	// The rules with only IP blocks are resolved from the policy when they are missing, the peer resolvers are not
+	// called.
+	PeerSets map[PeerSetKey]PeerSet
+	// CommonRules are the common rules of the pod, nil renders the defaults
+	CommonRules *CommonRules
+	// ConntrackZones tracks the connections of each interface of the pod in a separate conntrack zone
+	ConntrackZones bool
+	// MaxSetElements is the maximum number of elements of the sets of the CIDRs, 0 does not chunk them
+	MaxSetElements int
+	// RulesetLayout is the layout of the chains of the rules of the policy, empty renders a chain per policy
+	RulesetLayout RulesetLayout
+}
+
+// Ruleset is the rendered table of a policy for a pod
+type Ruleset struct {
+	// Chains are the rules of the chains of the table, by chain
+	Chains map[string][]string
+	// Sets are the elements of the sets of the table, by set
+	Sets map[string][]string
+
+	dump string
+}
+
+// String returns the ruleset as nft commands recreating it
+func (r *Ruleset) String() string {
+	return r.dump
+}
+
+// Render renders the ruleset of a policy for a pod, as the controller applies it in the network namespace of the pod.
+// It has no side effects, it does not read the cluster nor the pod network namespace, so it can be used by external
+// tools and tests. It returns nil when the policy does not apply to the pod.
+func Render(ctx context.Context, input RenderInput) (*Ruleset, error) {
+	if input.Policy == nil || input.Pod == nil {
+		return nil, fmt.Errorf("a policy and a pod are required")
+	}
+
+	commonRules := input.CommonRules
+	if commonRules == nil {
+		commonRules = &CommonRules{}
+	}
+
+	n := &NFTables{
+		CommonRules:    commonRules,
+		ConntrackZones: input.ConntrackZones,
+		MaxSetElements: input.MaxSetElements,
+		RulesetLayout:  input.RulesetLayout,
+	}
+
+	ctx = withStaticPeerSets(ctx, input.PeerSets)
+
+	nft := knftables.NewFake(knftables.InetFamily, tableName)
+	desired, err := n.applyPolicy(ctx, nft, input.Pod, input.Interfaces, input.Policy, logr.FromContextOrDiscard(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	if desired == nil {
+		return nil, nil
+	}
+
+	return newRuleset(nft), nil
+}
+
+// newRuleset returns the ruleset of the table of a fake
+func newRuleset(nft *knftables.Fake) *Ruleset {
+	nft.RLock()
+	defer nft.RUnlock()
+
+	ruleset := &Ruleset{
+		Chains: make(map[string][]string),
+		Sets:   make(map[string][]string),
+		dump:   nft.Dump(),
+	}
+
+	if nft.Table == nil {
+		return ruleset
+	}
+
+	for name, chain := range nft.Table.Chains {
+		rules := make([]string, 0, len(chain.Rules))
+		for _, rule := range chain.Rules {
+			rules = append(rules, rule.Rule)
+		}
+		ruleset.Chains[name] = rules
+	}
+
+	for name, set := range nft.Table.Sets {
+		elements := make([]string, 0, len(set.Elements))
+		for _, element := range set.Elements {
+			elements = append(elements, strings.Join(element.Key, " . "))
+		}
+		slices.Sort(elements)
+		ruleset.Sets[name] = elements
+	}
+
+	return ruleset
+}
+
+// toPeerSet converts the peer set to the peer set of the rendering
+func (p *PeerSet) toPeerSet() *peerSet {
+	set := &peerSet{
+		ipv4Addresses: p.IPv4Addresses,
+		ipv6Addresses: p.IPv6Addresses,
+		cidrs:         len(p.IPv4CIDRs) + len(p.IPv6CIDRs),
+		excepts:       len(p.IPv4Excepts) + len(p.IPv6Excepts),
+		ipv4CIDRs:     p.IPv4CIDRs,
+		ipv6CIDRs:     p.IPv6CIDRs,
+		ipv4Excepts:   p.IPv4Excepts,
+		ipv6Excepts:   p.IPv6Excepts,
+	}
+
+	// The addresses are only rendered when the peers select pods
+	if len(p.IPv4Addresses) != 0 || len(p.IPv6Addresses) != 0 {
+		set.pods = 1
+	}
+
+	return set
+}
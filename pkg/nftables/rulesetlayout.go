@@ -0,0 +1,122 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+)
+
+// RulesetLayout is the layout of the chains the rules of the policies are rendered in
+type RulesetLayout string
+
+const (
+	// RulesetLayoutPerPolicy renders the rules of each policy in a chain of its own, jumped to from the policy type
+	// chains, the rules keep their own comments
+	RulesetLayoutPerPolicy RulesetLayout = "per-policy"
+	// RulesetLayoutMerged renders the rules of all the policies in a chain per policy type, each rule commented with
+	// its policy
+	RulesetLayoutMerged RulesetLayout = "merged"
+)
+
+// ParseRulesetLayout parses a ruleset layout, per-policy or merged
+func ParseRulesetLayout(value string) (RulesetLayout, error) {
+	switch layout := RulesetLayout(strings.ToLower(strings.TrimSpace(value))); layout {
+	case RulesetLayoutPerPolicy, RulesetLayoutMerged:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("invalid ruleset layout %q, expected %s or %s", value, RulesetLayoutPerPolicy, RulesetLayoutMerged)
+	}
+}
+
+const (
+	// The chains of the rules of all the policies in the merged layout
+	mergedIngressChain = "merged-ingress"
+	mergedEgressChain  = "merged-egress"
+
+	// mergedJumpRuleComment is the comment of the jump rule to a merged chain, shared by all the policies
+	mergedJumpRuleComment = "Merged policies"
+)
+
+// policyChain is the chain the rules of a policy are added to for a policy type. The rules added to a chain shared by
+// the policies are commented with the policy, which deletes them with its other rules of the shared chains.
+type policyChain struct {
+	name    string
+	comment *string
+}
+
+// rule returns a rule of the chain, commented with the policy instead of the comment when the chain is shared
+func (c policyChain) rule(rule string, comment *string) *knftables.Rule {
+	if c.comment != nil {
+		comment = c.comment
+	}
+
+	return &knftables.Rule{
+		Chain:   c.name,
+		Rule:    rule,
+		Comment: comment,
+	}
+}
+
+// policyChain returns the chain of the rules of a policy for a policy type chain in the ruleset layout
+func (n *NFTables) policyChain(hashName string, policy *datastore.Policy, policyTypeChainName string) policyChain {
+	if n.RulesetLayout != RulesetLayoutMerged {
+		return policyChain{name: prefixNetworkPolicyChain + hashName}
+	}
+
+	name := mergedIngressChain
+	if policyTypeChainName == egressChain {
+		name = mergedEgressChain
+	}
+
+	return policyChain{
+		name:    name,
+		comment: knftables.PtrTo(mergedRuleComment(policy.Namespace, policy.Name, policy.UID)),
+	}
+}
+
+// mergedRuleComment is the comment of the rules of a policy in the merged chains, namespace/name/uid or namespace/name
+// when the UID of the policy is unknown, so that the rules of a policy recreated with the same name are told apart
+func mergedRuleComment(namespace, name string, uid types.UID) string {
+	if uid == "" {
+		return fmt.Sprintf("%s/%s", namespace, name)
+	}
+
+	return fmt.Sprintf("%s/%s/%s", namespace, name, uid)
+}
+
+// createLayoutPolicyChain creates the chain of the rules of a policy for a policy type chain and the jump rule to it.
+// A merged chain is jumped to once for all the policies, before their verdict rules, the jump rule is kept when the
+// policies are deleted. The table emptied in the transaction has no jump rule whatever the listed rules.
+func (n *NFTables) createLayoutPolicyChain(ctx context.Context, nft knftables.Interface, tx *knftables.Transaction, chain policyChain, policyTypeChainName string, policy *datastore.Policy, replaced bool, logger logr.Logger) error {
+	if chain.comment == nil {
+		return createPolicyChain(ctx, nft, tx, chain.name, policyTypeChainName, policy.Namespace, policy.Name, logger)
+	}
+
+	tx.Add(&knftables.Chain{
+		Name:    chain.name,
+		Comment: knftables.PtrTo("MultiNetworkPolicies"),
+	})
+
+	if !replaced {
+		jump, err := findRuleInChain(ctx, nft, policyTypeChainName, mergedJumpRuleComment)
+		if err != nil {
+			return err
+		}
+		if jump != nil {
+			return nil
+		}
+	}
+
+	logger.Info("Creating merged chain", "chain", chain.name)
+	return insertBeforeVerdicts(ctx, nft, tx, &knftables.Rule{
+		Chain:   policyTypeChainName,
+		Rule:    knftables.Concat("jump", chain.name),
+		Comment: knftables.PtrTo(mergedJumpRuleComment),
+	}, policy.Namespace, policy.Name)
+}
@@ -0,0 +1,177 @@
+package nftables
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// sandboxPrefetchTimeout bounds the lookup of the network namespace path of a pod in the background, no sync waits for
+// it to cancel it
+const sandboxPrefetchTimeout = 30 * time.Second
+
+// sandboxCache caches the network namespace paths of the pods of the node, resolved from the container runtime when
+// the pods start running, ahead of the syncs of the policies
+type sandboxCache struct {
+	mu   sync.Mutex
+	pods map[types.NamespacedName]cachedSandbox
+	// pending are the pods whose network namespace path is being resolved in the background
+	pending map[types.UID]bool
+}
+
+// cachedSandbox is the network namespace path of a pod, valid while the container it was resolved from is the first
+// container of the pod. The path is derived from the PID of the container, a restarted container has a new one.
+type cachedSandbox struct {
+	uid       types.UID
+	container string
+	path      string
+}
+
+// sandboxContainer returns the container the network namespace path of a pod is resolved from, empty until it runs
+func sandboxContainer(pod *corev1.Pod) string {
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return ""
+	}
+
+	return pod.Status.ContainerStatuses[0].ContainerID
+}
+
+// get returns the network namespace path of a pod when it is cached for its current container
+func (s *sandboxCache) get(pod *corev1.Pod) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached, ok := s.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]
+	if !ok || cached.uid != pod.UID || cached.container != sandboxContainer(pod) {
+		return "", false
+	}
+
+	return cached.path, true
+}
+
+// set caches the network namespace path of a pod, replacing the path of a previous pod with the same name
+func (s *sandboxCache) set(pod *corev1.Pod, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pods == nil {
+		s.pods = make(map[types.NamespacedName]cachedSandbox)
+	}
+
+	s.pods[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}] = cachedSandbox{
+		uid:       pod.UID,
+		container: sandboxContainer(pod),
+		path:      path,
+	}
+}
+
+// start marks a pod as being resolved, it returns false when it already is
+func (s *sandboxCache) start(pod *corev1.Pod) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil {
+		s.pending = make(map[types.UID]bool)
+	}
+
+	if s.pending[pod.UID] {
+		return false
+	}
+
+	s.pending[pod.UID] = true
+	return true
+}
+
+// done marks a pod as resolved
+func (s *sandboxCache) done(pod *corev1.Pod) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, pod.UID)
+}
+
+// collect forgets the paths of the pods not kept and returns the number of pods forgotten
+func (s *sandboxCache) collect(keep func(pod types.NamespacedName) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	forgotten := 0
+	for pod := range s.pods {
+		if !keep(pod) {
+			delete(s.pods, pod)
+			forgotten++
+		}
+	}
+
+	return forgotten
+}
+
+// sandbox returns the network namespace path of a pod, from the cache when it was prefetched. The paths resolved
+// from the container runtime are cached when the prefetch is enabled.
+func (n *NFTables) sandbox(ctx context.Context, pod *corev1.Pod) (string, error) {
+	if path, ok := n.sandboxes.get(pod); ok {
+		metrics.SandboxCacheRequests.WithLabelValues("hit").Inc()
+		return path, nil
+	}
+
+	if n.PrefetchSandboxes {
+		metrics.SandboxCacheRequests.WithLabelValues("miss").Inc()
+	}
+
+	path, err := n.CriRuntime.GetPodNetNSPath(ctx, pod)
+	if err != nil {
+		return "", err
+	}
+
+	if n.PrefetchSandboxes && sandboxContainer(pod) != "" {
+		n.sandboxes.set(pod, path)
+	}
+
+	return path, nil
+}
+
+// PrefetchSandbox resolves the network namespace path of a running pod of the node in the background, so that the
+// syncs of the policies find it in the cache and only render and apply the rules. It does nothing when the prefetch
+// is disabled, when the path is cached or when it is already being resolved. The lookups share the slots of
+// MaxInFlight with the syncs.
+func (n *NFTables) PrefetchSandbox(ctx context.Context, pod *corev1.Pod, logger logr.Logger) {
+	if !n.PrefetchSandboxes || n.Enforcer != nil || n.CriRuntime == nil {
+		return
+	}
+
+	if pod.Spec.NodeName != n.Hostname || pod.Spec.HostNetwork || pod.Status.Phase != corev1.PodRunning || sandboxContainer(pod) == "" {
+		return
+	}
+
+	if _, ok := n.sandboxes.get(pod); ok || !n.sandboxes.start(pod) {
+		return
+	}
+
+	pod = pod.DeepCopy()
+	go func() {
+		defer n.sandboxes.done(pod)
+
+		ctx, cancel := context.WithTimeout(ctx, sandboxPrefetchTimeout)
+		defer cancel()
+
+		release, err := n.acquireNetNS(ctx)
+		if err != nil {
+			return
+		}
+		defer release()
+
+		path, err := n.CriRuntime.GetPodNetNSPath(ctx, pod)
+		if err != nil {
+			logger.V(1).Info("Failed to prefetch network namespace path", "pod", pod.Name, "namespace", pod.Namespace, "error", err.Error())
+			return
+		}
+
+		n.sandboxes.set(pod, path)
+	}()
+}
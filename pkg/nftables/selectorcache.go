@@ -0,0 +1,108 @@
+package nftables
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// SelectorCache memoizes the pods and the namespaces matching the label selectors of the peers, which are evaluated
+// for every pod of every policy during churn. The pods of a namespace are invalidated by the pod events of the namespace,
+// and the namespaces by the namespace events. The cached objects must not be modified.
+type SelectorCache struct {
+	mu sync.Mutex
+	// pods are the compact pods matching a selector, by namespace and selector
+	pods map[string]map[string][]datastore.PodInfo
+	// podGenerations are increased when the pods of a namespace are invalidated, so that a result listed before the
+	// invalidation is not cached after it
+	podGenerations map[string]uint64
+	// namespaces are the namespaces matching a selector, by selector
+	namespaces          map[string][]corev1.Namespace
+	namespaceGeneration uint64
+}
+
+// NewSelectorCache returns an empty selector cache
+func NewSelectorCache() *SelectorCache {
+	return &SelectorCache{
+		pods:           make(map[string]map[string][]datastore.PodInfo),
+		podGenerations: make(map[string]uint64),
+		namespaces:     make(map[string][]corev1.Namespace),
+	}
+}
+
+// InvalidatePods forgets the pods matched in a namespace
+func (c *SelectorCache) InvalidatePods(namespace string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pods, namespace)
+	c.podGenerations[namespace]++
+}
+
+// InvalidateNamespaces forgets the matched namespaces
+func (c *SelectorCache) InvalidateNamespaces() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.namespaces)
+	c.namespaceGeneration++
+}
+
+// getPods returns the pods of a namespace matching a selector, along with the generation to store them with on a miss
+func (c *SelectorCache) getPods(namespace string, selector string) ([]datastore.PodInfo, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pods, ok := c.pods[namespace][selector]
+	recordSelectorCacheRequest("pod", ok)
+	return pods, c.podGenerations[namespace], ok
+}
+
+// setPods caches the pods of a namespace matching a selector, unless they were invalidated since the generation
+func (c *SelectorCache) setPods(namespace string, selector string, generation uint64, pods []datastore.PodInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.podGenerations[namespace] != generation {
+		return
+	}
+
+	if c.pods[namespace] == nil {
+		c.pods[namespace] = make(map[string][]datastore.PodInfo)
+	}
+	c.pods[namespace][selector] = pods
+}
+
+// getNamespaces returns the namespaces matching a selector, along with the generation to store them with on a miss
+func (c *SelectorCache) getNamespaces(selector string) ([]corev1.Namespace, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	namespaces, ok := c.namespaces[selector]
+	recordSelectorCacheRequest("namespace", ok)
+	return namespaces, c.namespaceGeneration, ok
+}
+
+// setNamespaces caches the namespaces matching a selector, unless they were invalidated since the generation
+func (c *SelectorCache) setNamespaces(selector string, generation uint64, namespaces []corev1.Namespace) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.namespaceGeneration != generation {
+		return
+	}
+
+	c.namespaces[selector] = namespaces
+}
+
+func recordSelectorCacheRequest(kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	metrics.SelectorCacheRequests.WithLabelValues(kind, result).Inc()
+}
@@ -0,0 +1,54 @@
+package nftables
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/knftables"
+)
+
+// createSelfTrafficRules accepts the traffic received on the matched interfaces from the addresses of all the interfaces
+// of the pod. The reverse rules only accept the addresses of the receiving interface, while the traffic hairpinned by
+// an external switch can be sent from another interface of the pod.
+func createSelfTrafficRules(tx *knftables.Transaction, interfaces []Interface, hashName string, npChain policyChain, logger logr.Logger) {
+	var ipv4Addresses, ipv6Addresses []string
+	for _, intf := range interfaces {
+		for _, ip := range intf.IPs {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				logger.V(1).Info("Skipping invalid IP address", "ip", ip, "interface", intf.Name)
+				continue
+			}
+
+			addr = addr.Unmap().WithZone("")
+			if addr.Is4() {
+				ipv4Addresses = append(ipv4Addresses, addr.String())
+			} else {
+				ipv6Addresses = append(ipv6Addresses, addr.String())
+			}
+		}
+	}
+
+	logger.V(1).Info("Creating self traffic rules", "ipv4", ipv4Addresses, "ipv6", ipv6Addresses)
+
+	for _, family := range []struct {
+		addrExpr  string
+		addresses []string
+	}{
+		{addrExpr: "ip saddr", addresses: ipv4Addresses},
+		{addrExpr: "ip6 saddr", addresses: ipv6Addresses},
+	} {
+		if len(family.addresses) == 0 {
+			continue
+		}
+
+		slices.Sort(family.addresses)
+		tx.Add(npChain.rule(knftables.Concat(
+			"iifname", fmt.Sprintf("@%s%s", prefixManagedInterfacesSet, hashName),
+			family.addrExpr, "{", strings.Join(slices.Compact(family.addresses), ", "), "}", "accept",
+		), knftables.PtrTo("Self traffic")))
+	}
+}
@@ -0,0 +1,107 @@
+package nftables
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// sharedNetNS returns the pods of each network namespace shared by several pods of a sync, e.g. the pods of a VM
+// wrapper or of composable pods. The table of the network namespace is shared by the pods, a policy is applied once for
+// all of them rather than each pod replacing the rules of the others.
+func sharedNetNS(pods []corev1.Pod, sandboxes []string, logger logr.Logger) map[string][]corev1.Pod {
+	byNetNS := make(map[string][]corev1.Pod)
+	for i, pod := range pods {
+		if sandboxes[i] != "" {
+			byNetNS[sandboxes[i]] = append(byNetNS[sandboxes[i]], pod)
+		}
+	}
+
+	shared := make(map[string][]corev1.Pod)
+	for netnsPath, coResident := range byNetNS {
+		if len(coResident) < 2 {
+			continue
+		}
+
+		// The pods are merged in the order of their names for a stable ruleset
+		slices.SortFunc(coResident, func(a, b corev1.Pod) int {
+			return strings.Compare(a.Namespace+"/"+a.Name, b.Namespace+"/"+b.Name)
+		})
+		shared[netnsPath] = coResident
+
+		names := make([]string, 0, len(coResident))
+		for _, pod := range coResident {
+			names = append(names, pod.Namespace+"/"+pod.Name)
+		}
+		logger.V(1).Info("Network namespace shared by several pods, enforcing them together", "sandbox", netnsPath, "pods", names)
+	}
+
+	return shared
+}
+
+// mergeSharedPods returns the pod and the interfaces a policy is applied with in a network namespace shared by several
+// pods: the first pod selected by the policy with interfaces it applies to, scoped to the interfaces the policy
+// applies to on all the selected pods, and the interfaces of all the pods. When the policy applies to none of them, the
+// first pod is returned with its interfaces, so that the policy is cleaned up.
+func mergeSharedPods(pods []corev1.Pod, policy *datastore.Policy) (*corev1.Pod, []Interface) {
+	var interfaces []Interface
+	var matched []Interface
+	var selected *corev1.Pod
+	for i := range pods {
+		podInterfaces := GetInterfaces(&pods[i])
+		for _, intf := range podInterfaces {
+			if !slices.ContainsFunc(interfaces, func(m Interface) bool { return m.Name == intf.Name }) {
+				interfaces = append(interfaces, intf)
+			}
+		}
+
+		if !utils.MatchesSelector(policy.Spec.PodSelector, pods[i].Labels) {
+			continue
+		}
+
+		podMatched := getPolicyInterfaces(podInterfaces, policy, &pods[i])
+		if len(podMatched) == 0 {
+			continue
+		}
+
+		if selected == nil {
+			selected = &pods[i]
+		}
+		for _, intf := range podMatched {
+			if !slices.ContainsFunc(matched, func(m Interface) bool { return m.Name == intf.Name }) {
+				matched = append(matched, intf)
+			}
+		}
+	}
+
+	if selected == nil {
+		return &pods[0], GetInterfaces(&pods[0])
+	}
+
+	// The interfaces of the groups are on the network of the interface of the group the policy applies to
+	for i, intf := range interfaces {
+		if j := slices.IndexFunc(matched, func(m Interface) bool { return m.Name == intf.Name }); j >= 0 {
+			interfaces[i] = matched[j]
+		}
+	}
+
+	// The interfaces of the selected pods are already scoped and expanded to their groups, the merged pod names them
+	names := make([]string, 0, len(matched))
+	for _, intf := range matched {
+		names = append(names, intf.Name)
+	}
+
+	pod := selected.DeepCopy()
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	delete(pod.Annotations, datastore.InterfaceGroupsAnnotation)
+	pod.Annotations[datastore.InterfacesAnnotation] = strings.Join(names, ",")
+
+	return pod, interfaces
+}
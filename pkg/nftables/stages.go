@@ -0,0 +1,112 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// The stages of the enforcement of a policy for a pod, observed by metrics.EnforcementStageDuration
+const (
+	stagePeerResolution = "peer_resolution"
+	stageRender         = "render"
+	stageNetNSEnter     = "netns_enter"
+	stageNFTExec        = "nft_exec"
+	stageVerify         = "verify"
+)
+
+type stageTimerContextKey struct{}
+
+// stageTimer accumulates the time spent in the stages nested in the rendering of a policy for a pod, the peer
+// resolution and the nft operations, so that the rendering is observed without them
+type stageTimer struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+// withStageTimer returns a context accumulating the time spent in the nested stages in the returned timer
+func withStageTimer(ctx context.Context) (context.Context, *stageTimer) {
+	timer := &stageTimer{durations: make(map[string]time.Duration)}
+	return context.WithValue(ctx, stageTimerContextKey{}, timer), timer
+}
+
+// addStageDuration adds the time elapsed since start to a stage of the timer of the context, if any
+func addStageDuration(ctx context.Context, stage string, start time.Time) {
+	if timer, ok := ctx.Value(stageTimerContextKey{}).(*stageTimer); ok {
+		timer.add(stage, time.Since(start))
+	}
+}
+
+func (t *stageTimer) add(stage string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.durations[stage] += d
+}
+
+// reset returns the time accumulated in a stage and starts it over
+func (t *stageTimer) reset(stage string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	d := t.durations[stage]
+	delete(t.durations, stage)
+	return d
+}
+
+// observeStage observes the duration of a stage
+func observeStage(stage string, d time.Duration) {
+	metrics.EnforcementStageDuration.WithLabelValues(stage).Observe(d.Seconds())
+}
+
+// timedNFTables accumulates the time spent running the nft operations in the nft_exec stage of a timer
+type timedNFTables struct {
+	knftables.Interface
+	timer *stageTimer
+}
+
+func (t *timedNFTables) Run(ctx context.Context, tx *knftables.Transaction) error {
+	defer t.observe(time.Now())
+	return t.Interface.Run(ctx, tx)
+}
+
+func (t *timedNFTables) Check(ctx context.Context, tx *knftables.Transaction) error {
+	defer t.observe(time.Now())
+	return t.Interface.Check(ctx, tx)
+}
+
+func (t *timedNFTables) List(ctx context.Context, objectType string) ([]string, error) {
+	defer t.observe(time.Now())
+	return t.Interface.List(ctx, objectType)
+}
+
+func (t *timedNFTables) ListRules(ctx context.Context, chain string) ([]*knftables.Rule, error) {
+	defer t.observe(time.Now())
+	return t.Interface.ListRules(ctx, chain)
+}
+
+func (t *timedNFTables) ListElements(ctx context.Context, objectType, name string) ([]*knftables.Element, error) {
+	defer t.observe(time.Now())
+	return t.Interface.ListElements(ctx, objectType, name)
+}
+
+// AddConntrackTimeouts creates the ct timeout objects with the nftables client, which creates them outside of the
+// transactions
+func (t *timedNFTables) AddConntrackTimeouts(ctx context.Context, timeouts []conntrackTimeout) error {
+	creator, ok := t.Interface.(conntrackTimeoutCreator)
+	if !ok {
+		return fmt.Errorf("nftables client cannot create ct timeout objects")
+	}
+
+	defer t.observe(time.Now())
+	return creator.AddConntrackTimeouts(ctx, timeouts)
+}
+
+func (t *timedNFTables) observe(start time.Time) {
+	t.timer.add(stageNFTExec, time.Since(start))
+}
@@ -0,0 +1,217 @@
+package nftables
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/applier"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+)
+
+// ConntrackSupport is the support of the connection tracking on the node. The rules matching the connection state
+// never match the traffic it cannot track, so the replies of this traffic are accepted by symmetric rules instead.
+type ConntrackSupport struct {
+	// Unavailable is set when nf_conntrack cannot be loaded, all the rules are then stateless
+	Unavailable bool
+	// SCTPUnavailable is set when the SCTP connection tracking is missing, the SCTP rules are then stateless
+	SCTPUnavailable bool
+}
+
+// procSysNetfilter is the directory of the sysctls of the connection tracking, present once nf_conntrack is loaded
+const procSysNetfilter = "/proc/sys/net/netfilter"
+
+// DetectConntrack detects the support of the connection tracking on the node, loading nf_conntrack when it is
+// loadable, and reports the protocols enforced with stateless rules. nft is run with the execution options, or in the
+// applier when the client is set.
+func DetectConntrack(ctx context.Context, exec ExecOptions, client *applier.Client, logger logr.Logger) ConntrackSupport {
+	nft, err := newNFTables(exec, client, checkTableName)
+	if err != nil {
+		logger.Error(err, "Unable to create nftables client, assuming the connection tracking is available")
+		return ConntrackSupport{}
+	}
+
+	support := detectConntrack(ctx, nft, procSysNetfilter, logger)
+
+	all, sctp := 0.0, 0.0
+	if support.Unavailable {
+		all, sctp = 1, 1
+	}
+	if support.SCTPUnavailable {
+		sctp = 1
+	}
+	metrics.StatelessRules.WithLabelValues("all").Set(all)
+	metrics.StatelessRules.WithLabelValues("sctp").Set(sctp)
+
+	return support
+}
+
+// detectConntrack checks a rule matching the connection state, which makes the kernel load nf_conntrack, and then
+// looks up the sysctls of the connection tracking and of its SCTP support
+func detectConntrack(ctx context.Context, nft knftables.Interface, procSys string, logger logr.Logger) ConntrackSupport {
+	tx := nft.NewTransaction()
+	tx.Add(&knftables.Table{})
+	tx.Add(&knftables.Chain{
+		Name: checkChain,
+	})
+	tx.Add(&knftables.Rule{
+		Chain: checkChain,
+		Rule:  "ct state established,related accept",
+	})
+
+	if err := nft.Check(ctx, tx); err != nil {
+		logger.Info("Connection tracking is unavailable, enforcing the policies with stateless rules", "error", err.Error())
+		return ConntrackSupport{Unavailable: true}
+	}
+
+	if _, err := os.Stat(filepath.Join(procSys, "nf_conntrack_max")); err != nil {
+		logger.Info("Connection tracking is unavailable, enforcing the policies with stateless rules", "error", err.Error())
+		return ConntrackSupport{Unavailable: true}
+	}
+
+	if _, err := os.Stat(filepath.Join(procSys, "nf_conntrack_sctp_timeout_established")); err != nil {
+		logger.Info("SCTP connection tracking is unavailable, enforcing the SCTP rules with stateless rules", "error", err.Error())
+		return ConntrackSupport{SCTPUnavailable: true}
+	}
+
+	return ConntrackSupport{}
+}
+
+// maxStatelessReports bounds the policies applied to the pods whose last report is remembered, the reports of the pods
+// that are gone are not forgotten otherwise
+const maxStatelessReports = 4096
+
+// statelessReportKey identifies a policy applied to a pod
+type statelessReportKey struct {
+	pod    types.UID
+	policy types.NamespacedName
+}
+
+// statelessReports remembers the protocols last reported as enforced with stateless rules for each policy applied to a
+// pod, each apply of the policy enforces them but they are only reported when they change
+type statelessReports struct {
+	mu      sync.Mutex
+	reports map[statelessReportKey]string
+}
+
+// changed records the protocols of a policy applied to a pod and returns whether they changed since the last report
+func (r *statelessReports) changed(pod types.UID, policy types.NamespacedName, protocols string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.reports == nil || len(r.reports) >= maxStatelessReports {
+		r.reports = make(map[statelessReportKey]string)
+	}
+
+	key := statelessReportKey{pod: pod, policy: policy}
+	if last, ok := r.reports[key]; ok && last == protocols {
+		return false
+	}
+
+	r.reports[key] = protocols
+	return true
+}
+
+// reportStatelessRules reports the traffic the connection tracking cannot track on a pod a policy was applied to, when
+// it changed since the last apply of the policy
+func (n *NFTables) reportStatelessRules(pod *corev1.Pod, policy *datastore.Policy) {
+	if !n.Conntrack.Unavailable && !n.Conntrack.SCTPUnavailable {
+		return
+	}
+
+	protocols := "all the"
+	if !n.Conntrack.Unavailable {
+		protocols = "the SCTP"
+	}
+
+	if !n.statelessReports.changed(pod.UID, types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}, protocols) {
+		return
+	}
+
+	n.recordEvent(pod, corev1.EventTypeWarning, "StatelessRules",
+		"Connection tracking cannot track %s traffic of node %s, policy %s/%s is enforced with stateless rules", protocols, n.Hostname, policy.Namespace, policy.Name)
+}
+
+// createPeerRules creates the rules accepting the traffic of the interfaces of a group, and when the connection
+// tracking cannot track the traffic, the symmetric rules accepting its replies. The encapsulated traffic is never
+// tracked and the source ports of the tunnels are not the destination ports of their replies, its replies are
+// accepted by the rules of the other direction.
+func (n *NFTables) createPeerRules(tx *knftables.Transaction, npChain policyChain, group interfaceGroup, ipRuleSections []string, portRuleSections []string, logger logr.Logger) {
+	createRules(tx, npChain, ipRuleSections, portRuleSections, logger)
+
+	if group.encapsulation != "" {
+		return
+	}
+
+	// Without the SCTP connection tracking, only the rules of the SCTP ports are symmetric, the SCTP traffic of the
+	// rules without ports is tracked as generic traffic
+	symmetricPorts := portRuleSections
+	switch {
+	case n.Conntrack.Unavailable:
+	case n.Conntrack.SCTPUnavailable:
+		symmetricPorts = nil
+		for _, section := range portRuleSections {
+			if strings.Contains(section, "sctp") {
+				symmetricPorts = append(symmetricPorts, section)
+			}
+		}
+		if len(symmetricPorts) == 0 {
+			return
+		}
+	default:
+		return
+	}
+
+	logger.V(1).Info("Creating symmetric rules of the untracked traffic", "ipRuleSections", ipRuleSections, "portRuleSections", symmetricPorts)
+	createRules(tx, npChain, symmetricRuleSections(ipRuleSections), symmetricRuleSections(symmetricPorts), logger)
+}
+
+// symmetricRuleSections returns the rule sections matching the replies of the traffic matched by the rule sections,
+// with the interfaces, the addresses and the ports of the other direction
+func symmetricRuleSections(sections []string) []string {
+	symmetric := make([]string, 0, len(sections))
+	for _, section := range sections {
+		fields := strings.Fields(section)
+		for i, field := range fields {
+			switch field {
+			case "iifname":
+				fields[i] = "oifname"
+			case "oifname":
+				fields[i] = "iifname"
+			case "saddr":
+				fields[i] = "daddr"
+			case "daddr":
+				fields[i] = "saddr"
+			case "sport":
+				fields[i] = "dport"
+			case "dport":
+				fields[i] = "sport"
+			}
+		}
+		symmetric = append(symmetric, strings.Join(fields, " "))
+	}
+
+	return symmetric
+}
+
+// withoutConntrack returns the common rules without the marks of the connections, which need the connection
+// tracking, c can be nil
+func (c *CommonRules) withoutConntrack() *CommonRules {
+	if c == nil || (c.TrustedCTMark == nil && c.AcceptedCTMark == nil) {
+		return c
+	}
+
+	stateless := *c
+	stateless.TrustedCTMark = nil
+	stateless.AcceptedCTMark = nil
+
+	return &stateless
+}
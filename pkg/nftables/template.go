@@ -0,0 +1,197 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/features"
+)
+
+// RuleTemplateData holds the variables that custom rules can reference, e.g. {{ .PodIP }}
+type RuleTemplateData struct {
+	// PodIP is an IP of the interface, of the family of the rule
+	PodIP string
+	// Interface is the name of the interface in the pod
+	Interface string
+	// Namespace is the namespace of the pod
+	Namespace string
+	// PodName is the name of the pod
+	PodName string
+	// NetworkName is the network of the interface, as <namespace>/<name>
+	NetworkName string
+}
+
+// isRuleTemplate checks if the rule references variables
+func isRuleTemplate(rule string) bool {
+	return features.Enabled(features.CustomRuleTemplates) && strings.Contains(rule, "{{")
+}
+
+// parseRuleTemplate parses a custom rule as a template
+func parseRuleTemplate(rule string) (*template.Template, error) {
+	return template.New("rule").Option("missingkey=error").Parse(rule)
+}
+
+// Validate checks that the templated custom rules can be rendered and that the terminal chain is valid
+func (c *CommonRules) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if c.TerminalChain != nil {
+		if err := c.TerminalChain.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range slices.Concat(c.CustomIPv4IngressRules, c.CustomIPv4EgressRules) {
+		if _, err := renderSampleRule(rule, false); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range slices.Concat(c.CustomIPv6IngressRules, c.CustomIPv6EgressRules) {
+		if _, err := renderSampleRule(rule, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renderSampleRule renders a custom rule with sample values of the rule family
+func renderSampleRule(rule string, ipv6 bool) (string, error) {
+	if !isRuleTemplate(rule) {
+		return rule, nil
+	}
+
+	sample := RuleTemplateData{
+		PodIP:       "192.0.2.1",
+		Interface:   "net1",
+		Namespace:   "default",
+		PodName:     "pod",
+		NetworkName: "default/network",
+	}
+	if ipv6 {
+		sample.PodIP = "2001:db8::1"
+	}
+
+	tmpl, err := parseRuleTemplate(rule)
+	if err != nil {
+		return "", fmt.Errorf("invalid custom rule %q: %w", rule, err)
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, sample); err != nil {
+		return "", fmt.Errorf("invalid custom rule %q: %w", rule, err)
+	}
+
+	return sb.String(), nil
+}
+
+// Render returns the common rules with the templated custom rules expanded for the interfaces of the pod
+func (c *CommonRules) Render(pod *corev1.Pod, interfaces []Interface) (*CommonRules, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	rendered := *c
+
+	var err error
+	if rendered.CustomIPv4IngressRules, err = renderCustomRules(c.CustomIPv4IngressRules, pod, interfaces, false); err != nil {
+		return nil, err
+	}
+	if rendered.CustomIPv4EgressRules, err = renderCustomRules(c.CustomIPv4EgressRules, pod, interfaces, false); err != nil {
+		return nil, err
+	}
+	if rendered.CustomIPv6IngressRules, err = renderCustomRules(c.CustomIPv6IngressRules, pod, interfaces, true); err != nil {
+		return nil, err
+	}
+	if rendered.CustomIPv6EgressRules, err = renderCustomRules(c.CustomIPv6EgressRules, pod, interfaces, true); err != nil {
+		return nil, err
+	}
+
+	return &rendered, nil
+}
+
+// renderCustomRules expands each templated rule once per interface and IP of the rule family, static rules are kept as is.
+// Interfaces without an IP of the rule family are skipped, and identical expansions are only kept once.
+func renderCustomRules(rules []string, pod *corev1.Pod, interfaces []Interface, ipv6 bool) ([]string, error) {
+	if !slices.ContainsFunc(rules, isRuleTemplate) {
+		return rules, nil
+	}
+
+	var rendered []string
+	for _, rule := range rules {
+		if !isRuleTemplate(rule) {
+			rendered = append(rendered, rule)
+			continue
+		}
+
+		tmpl, err := parseRuleTemplate(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid custom rule %q: %w", rule, err)
+		}
+
+		for _, intf := range interfaces {
+			if err := validateTemplateInterface(intf); err != nil {
+				return nil, fmt.Errorf("failed to render custom rule %q: %w", rule, err)
+			}
+
+			for _, ip := range intf.IPs {
+				parsed := net.ParseIP(ip)
+				if parsed == nil || (parsed.To4() == nil) != ipv6 {
+					continue
+				}
+
+				var sb strings.Builder
+				err := tmpl.Execute(&sb, RuleTemplateData{
+					PodIP:       ip,
+					Interface:   intf.Name,
+					Namespace:   pod.Namespace,
+					PodName:     pod.Name,
+					NetworkName: intf.Network,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to render custom rule %q: %w", rule, err)
+				}
+
+				if !slices.Contains(rendered, sb.String()) {
+					rendered = append(rendered, sb.String())
+				}
+			}
+		}
+	}
+
+	return rendered, nil
+}
+
+// interfaceNameRegexp matches the names of the interfaces that can be rendered in the rules, at most IFNAMSIZ-1
+// characters of a set without quotes, spaces or nft syntax
+var interfaceNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// validateTemplateInterface checks the name and the network of an interface before they are rendered in the rules.
+// They come from the network-status annotation of the pod, which the pod can write, and are rendered as is.
+func validateTemplateInterface(intf Interface) error {
+	if !interfaceNameRegexp.MatchString(intf.Name) {
+		return fmt.Errorf("invalid interface name %q", intf.Name)
+	}
+
+	parts := strings.Split(intf.Network, "/")
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid network name %q", intf.Network)
+	}
+	for _, part := range parts {
+		if errs := validation.IsDNS1123Subdomain(part); len(errs) != 0 {
+			return fmt.Errorf("invalid network name %q: %s", intf.Network, strings.Join(errs, ", "))
+		}
+	}
+
+	return nil
+}
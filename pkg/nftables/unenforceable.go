@@ -0,0 +1,183 @@
+package nftables
+
+import (
+	"slices"
+	"strings"
+	"sync"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// UnenforceableReasonVhostUser is the reason of the vhost-user interfaces, the traffic goes through a socket
+	// shared with a userspace switch
+	UnenforceableReasonVhostUser = "VhostUser"
+	// UnenforceableReasonMemif is the reason of the memif interfaces, the traffic goes through a shared memory
+	UnenforceableReasonMemif = "Memif"
+	// UnenforceableReasonUserspaceDriver is the reason of the devices bound to a userspace driver, e.g. vfio-pci for
+	// DPDK, or a vDPA device bound to the vhost-vdpa driver
+	UnenforceableReasonUserspaceDriver = "UserspaceDriver"
+)
+
+// UnenforceableInterface is an interface of a pod selected by a policy whose traffic bypasses the kernel, the policy
+// cannot be applied to it
+type UnenforceableInterface struct {
+	Pod       types.NamespacedName
+	UID       types.UID
+	Interface string
+	Network   string
+	Reason    string
+}
+
+// unenforceableReason returns why the traffic of a device bypasses the kernel, or an empty string when it does not or
+// when it is unknown. Only the devices missing from the network namespace are classified, a PCI device bound to its
+// kernel driver is a netdev of the network namespace.
+func unenforceableReason(deviceInfo *netdefv1.DeviceInfo) string {
+	if deviceInfo == nil {
+		return ""
+	}
+
+	switch deviceInfo.Type {
+	case netdefv1.DeviceInfoTypeVHostUser:
+		return UnenforceableReasonVhostUser
+	case netdefv1.DeviceInfoTypeMemif:
+		return UnenforceableReasonMemif
+	case netdefv1.DeviceInfoTypePCI:
+		return UnenforceableReasonUserspaceDriver
+	case netdefv1.DeviceInfoTypeVDPA:
+		if deviceInfo.Vdpa != nil && deviceInfo.Vdpa.Driver == "vhost" {
+			return UnenforceableReasonUserspaceDriver
+		}
+	}
+
+	return ""
+}
+
+// splitUnenforceable splits the interfaces missing from the network namespace of a pod between the interfaces whose
+// device info reports a device bypassing the kernel, and the interfaces that are actually missing
+func splitUnenforceable(pod *corev1.Pod, matched []Interface, missing []string) ([]UnenforceableInterface, []string) {
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	reasons := make(map[string]string)
+	networkStatus, _ := netdefutils.GetNetworkStatus(pod)
+	for _, status := range networkStatus {
+		if reason := unenforceableReason(status.DeviceInfo); reason != "" {
+			reasons[status.Interface] = reason
+		}
+	}
+
+	var unenforceable []UnenforceableInterface
+	var remaining []string
+	for _, name := range missing {
+		reason, ok := reasons[name]
+		if !ok {
+			remaining = append(remaining, name)
+			continue
+		}
+
+		var network string
+		if i := slices.IndexFunc(matched, func(intf Interface) bool { return intf.Name == name }); i >= 0 {
+			network = matched[i].Network
+		}
+
+		unenforceable = append(unenforceable, UnenforceableInterface{
+			Pod:       types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name},
+			UID:       pod.UID,
+			Interface: name,
+			Network:   network,
+			Reason:    reason,
+		})
+	}
+
+	return unenforceable, remaining
+}
+
+// unenforceableInterfaces remembers the unenforceable interfaces of the pods of the node, each policy applied to a
+// pod checks its interfaces but each interface is only reported once
+type unenforceableInterfaces struct {
+	mu   sync.Mutex
+	pods map[types.NamespacedName][]UnenforceableInterface
+}
+
+// add records unenforceable interfaces and returns the ones not recorded yet. The interfaces of a previous pod with
+// the same name are replaced.
+func (u *unenforceableInterfaces) add(interfaces []UnenforceableInterface) []UnenforceableInterface {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.pods == nil {
+		u.pods = make(map[types.NamespacedName][]UnenforceableInterface)
+	}
+
+	var added []UnenforceableInterface
+	for _, intf := range interfaces {
+		recorded := u.pods[intf.Pod]
+		if len(recorded) > 0 && recorded[0].UID != intf.UID {
+			recorded = nil
+		}
+
+		if slices.ContainsFunc(recorded, func(r UnenforceableInterface) bool { return r.Interface == intf.Interface }) {
+			continue
+		}
+
+		u.pods[intf.Pod] = append(recorded, intf)
+		added = append(added, intf)
+	}
+
+	return added
+}
+
+// list returns the recorded interfaces sorted by pod and interface
+func (u *unenforceableInterfaces) list() []UnenforceableInterface {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var interfaces []UnenforceableInterface
+	for _, recorded := range u.pods {
+		interfaces = append(interfaces, recorded...)
+	}
+
+	slices.SortFunc(interfaces, func(a, b UnenforceableInterface) int {
+		if c := strings.Compare(a.Pod.String(), b.Pod.String()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Interface, b.Interface)
+	})
+
+	return interfaces
+}
+
+// collect forgets the interfaces of the pods not kept and returns the number of pods forgotten
+func (u *unenforceableInterfaces) collect(keep func(pod types.NamespacedName) bool) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	forgotten := 0
+	for pod := range u.pods {
+		if !keep(pod) {
+			delete(u.pods, pod)
+			forgotten++
+		}
+	}
+
+	return forgotten
+}
+
+// UnenforceableInterfaces returns the interfaces of the pods of the node whose traffic bypasses the kernel, found while
+// applying the policies selecting them
+func (n *NFTables) UnenforceableInterfaces() []UnenforceableInterface {
+	return n.unenforceable.list()
+}
+
+// recordUnenforceable records the unenforceable interfaces of a pod and reports the new ones with an event
+func (n *NFTables) recordUnenforceable(pod *corev1.Pod, interfaces []UnenforceableInterface) {
+	for _, intf := range n.unenforceable.add(interfaces) {
+		n.recordEvent(pod, corev1.EventTypeWarning, "InterfaceNotEnforceable",
+			"Policies are not applied to interface %s of network %s, its traffic bypasses the kernel: %s", intf.Interface, intf.Network, intf.Reason)
+	}
+}
@@ -0,0 +1,164 @@
+package nftables
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// supportedProtocols are the protocols of the ports of the rules, matched case-insensitively
+var supportedProtocols = []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP}
+
+// RuleError is an invalid rule of a policy. The invalid rules are not rendered, so that they do not allow any traffic
+// rather than being rendered as something else than what they say.
+type RuleError struct {
+	// Direction is "ingress" or "egress"
+	Direction string
+	// Rule is the index of the rule in the rules of the direction
+	Rule int
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("%s rule %d: %v", e.Direction, e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// ValidatePolicySpec checks the ports and the IP blocks of the rules of a policy, it returns an error per invalid rule
+func ValidatePolicySpec(spec *datastore.PolicySpec) []*RuleError {
+	var errs []*RuleError
+	for i, rule := range spec.Ingress {
+		if err := validateRule(rule.Ports, rule.From); err != nil {
+			errs = append(errs, &RuleError{Direction: "ingress", Rule: i, Err: err})
+		}
+	}
+
+	for i, rule := range spec.Egress {
+		if err := validateRule(rule.Ports, rule.To); err != nil {
+			errs = append(errs, &RuleError{Direction: "egress", Rule: i, Err: err})
+		}
+	}
+
+	return errs
+}
+
+// validateRule checks the ports and the IP blocks of the peers of a rule
+func validateRule(ports []datastore.Port, peers []datastore.Peer) error {
+	if err := validatePorts(ports); err != nil {
+		return err
+	}
+
+	return validatePeers(peers)
+}
+
+// validatePeers checks the selectors and the IP blocks of the peers of a rule, the valid CIDRs and excepts are normalized
+// when they are rendered
+func validatePeers(peers []datastore.Peer) error {
+	for i, peer := range peers {
+		if peer.IPBlock == nil {
+			if err := validateSelector(peer.NamespaceSelector); err != nil {
+				return fmt.Errorf("peer %d: namespaceSelector: %w", i, err)
+			}
+			if err := validateSelector(peer.PodSelector); err != nil {
+				return fmt.Errorf("peer %d: podSelector: %w", i, err)
+			}
+			continue
+		}
+
+		if _, err := utils.NormalizeCIDR(peer.IPBlock.CIDR); err != nil {
+			return fmt.Errorf("peer %d: ipBlock: %w", i, err)
+		}
+
+		for _, except := range peer.IPBlock.Except {
+			if _, err := utils.NormalizeCIDR(except); err != nil {
+				return fmt.Errorf("peer %d: ipBlock except: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateSelector checks the labels and the expressions of a selector, an invalid selector would select nothing
+func validateSelector(selector *metav1.LabelSelector) error {
+	if selector == nil {
+		return nil
+	}
+
+	_, err := metav1.LabelSelectorAsSelector(selector)
+	return err
+}
+
+// validatePorts checks the protocols, the ports and the port ranges of the ports of a rule
+func validatePorts(ports []datastore.Port) error {
+	for i, port := range ports {
+		if err := validatePort(port); err != nil {
+			return fmt.Errorf("port %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validatePort checks a port of a rule
+func validatePort(port datastore.Port) error {
+	if port.Protocol != nil && !isSupportedProtocol(*port.Protocol) {
+		return fmt.Errorf("unsupported protocol %q, expected one of TCP, UDP or SCTP", *port.Protocol)
+	}
+
+	if port.Port == nil {
+		if port.EndPort != nil {
+			return fmt.Errorf("endPort %d requires a port", *port.EndPort)
+		}
+		return nil
+	}
+
+	if port.Port.Type == intstr.String {
+		// The named ports are rendered lowercase
+		if errs := validation.IsValidPortName(strings.ToLower(port.Port.StrVal)); len(errs) != 0 {
+			return fmt.Errorf("invalid port name %q: %s", port.Port.StrVal, strings.Join(errs, ", "))
+		}
+
+		if port.EndPort != nil {
+			return fmt.Errorf("endPort %d requires a numeric port, not the named port %q", *port.EndPort, port.Port.StrVal)
+		}
+		return nil
+	}
+
+	if errs := validation.IsValidPortNum(int(port.Port.IntVal)); len(errs) != 0 {
+		return fmt.Errorf("invalid port %d: %s", port.Port.IntVal, strings.Join(errs, ", "))
+	}
+
+	if port.EndPort != nil {
+		if errs := validation.IsValidPortNum(int(*port.EndPort)); len(errs) != 0 {
+			return fmt.Errorf("invalid endPort %d: %s", *port.EndPort, strings.Join(errs, ", "))
+		}
+
+		if *port.EndPort < port.Port.IntVal {
+			return fmt.Errorf("endPort %d is lower than port %d", *port.EndPort, port.Port.IntVal)
+		}
+	}
+
+	return nil
+}
+
+// isSupportedProtocol checks if a protocol is supported
+func isSupportedProtocol(protocol corev1.Protocol) bool {
+	for _, supported := range supportedProtocols {
+		if strings.EqualFold(string(protocol), string(supported)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,164 @@
+package nftables
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/knftables"
+)
+
+// desiredState holds the objects that a policy transaction is expected to leave in the table
+type desiredState struct {
+	// policyComment is the comment carried by the policy rules in the shared chains
+	policyComment string
+	chains        []string
+	// sets maps each set to its distinct elements
+	sets map[string]map[string]struct{}
+	// rules maps each chain to the number of policy rules expected in it
+	rules map[string]int
+}
+
+// newDesiredState renders the desired state from the operations queued in a policy transaction
+func newDesiredState(tx *knftables.Transaction, policyComment string) *desiredState {
+	desired := &desiredState{
+		policyComment: policyComment,
+		sets:          make(map[string]map[string]struct{}),
+		rules:         make(map[string]int),
+	}
+
+	ruleCommentSuffix := fmt.Sprintf(" comment %q", policyComment)
+
+	for _, line := range strings.Split(tx.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		// Every operation is written as "<verb> <object> <family> <table> <name> ..."
+		verb, object, name := fields[0], fields[1], fields[4]
+
+		switch {
+		case verb == "add" && object == "chain":
+			if !slices.Contains(desired.chains, name) {
+				desired.chains = append(desired.chains, name)
+			}
+		case verb == "add" && object == "set":
+			// The elements of the dynamic sets are added by the packets
+			if strings.Contains(line, "flags dynamic") {
+				continue
+			}
+
+			if _, ok := desired.sets[name]; !ok {
+				desired.sets[name] = make(map[string]struct{})
+			}
+		case (verb == "add" || verb == "insert") && object == "rule":
+			// Policy chains are owned by the policy, shared chains are matched by the policy comment
+			if strings.HasPrefix(name, prefixNetworkPolicyChain) || strings.HasSuffix(line, ruleCommentSuffix) {
+				desired.rules[name]++
+			}
+		case verb == "add" && object == "element":
+			start := strings.Index(line, "{ ")
+			end := strings.LastIndex(line, " }")
+			if start == -1 || end <= start {
+				continue
+			}
+
+			if _, ok := desired.sets[name]; !ok {
+				desired.sets[name] = make(map[string]struct{})
+			}
+			desired.sets[name][line[start+2:end]] = struct{}{}
+		}
+	}
+
+	return desired
+}
+
+// verifyPolicy lists the applied objects back and compares them against the desired state
+func verifyPolicy(ctx context.Context, nft knftables.Interface, desired *desiredState) error {
+	var mismatches []string
+
+	chains, err := nft.List(ctx, "chains")
+	if err != nil && !knftables.IsNotFound(err) {
+		return fmt.Errorf("failed to list chains: %w", err)
+	}
+
+	for _, chain := range desired.chains {
+		if !slices.Contains(chains, chain) {
+			mismatches = append(mismatches, fmt.Sprintf("chain %s is missing", chain))
+		}
+	}
+
+	sets, err := nft.List(ctx, "sets")
+	if err != nil && !knftables.IsNotFound(err) {
+		return fmt.Errorf("failed to list sets: %w", err)
+	}
+
+	for _, set := range sortedKeys(desired.sets) {
+		if !slices.Contains(sets, set) {
+			mismatches = append(mismatches, fmt.Sprintf("set %s is missing", set))
+			continue
+		}
+
+		elements, err := nft.ListElements(ctx, "set", set)
+		if err != nil {
+			return fmt.Errorf("failed to list elements of set %s: %w", set, err)
+		}
+
+		if len(elements) != len(desired.sets[set]) {
+			mismatches = append(mismatches, fmt.Sprintf("set %s has %d elements, expected %d", set, len(elements), len(desired.sets[set])))
+		}
+	}
+
+	for _, chain := range sortedKeys(desired.rules) {
+		if !slices.Contains(chains, chain) {
+			continue
+		}
+
+		rules, err := nft.ListRules(ctx, chain)
+		if err != nil {
+			return fmt.Errorf("failed to list rules in %s chain: %w", chain, err)
+		}
+
+		count := len(rules)
+		if !strings.HasPrefix(chain, prefixNetworkPolicyChain) {
+			count = 0
+			for _, rule := range rules {
+				if rule.Comment != nil && *rule.Comment == desired.policyComment {
+					count++
+				}
+			}
+		}
+
+		if count != desired.rules[chain] {
+			mismatches = append(mismatches, fmt.Sprintf("chain %s has %d policy rules, expected %d", chain, count, desired.rules[chain]))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return &VerificationError{Mismatches: mismatches}
+	}
+
+	return nil
+}
+
+// VerificationError is returned when the applied ruleset does not match the desired state
+type VerificationError struct {
+	Mismatches []string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("applied ruleset does not match desired state: %s", strings.Join(e.Mismatches, "; "))
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
@@ -0,0 +1,146 @@
+package nftables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/knftables"
+
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/datastore"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/metrics"
+	"github.com/k8snetworkplumbingwg/multi-network-policy-nftables/pkg/utils"
+)
+
+// emptyRulesetHash is the hash of the ruleset of a pod not selected by a policy, nothing is applied for it
+var emptyRulesetHash = hashRuleset(knftables.NewFake(knftables.InetFamily, tableName).Dump())
+
+// VerifyAppliedStates verifies the policies recorded as applied to the pods in the persisted state, entering the
+// network namespaces of the pods from their recorded paths. It needs neither the container runtime nor the cluster,
+// so it runs on startup before the cache is synced. The states of the pods whose network namespace is gone are
+// forgotten, and so are the states of the policies whose chain or managed interfaces set is missing from the table of
+// a pod, so that they are applied again instead of being skipped. It returns the policies missing from a pod.
+func (n *NFTables) VerifyAppliedStates(ctx context.Context, logger logr.Logger) ([]types.NamespacedName, error) {
+	if n.State == nil {
+		return nil, nil
+	}
+
+	var stale []types.NamespacedName
+	for policy, pods := range n.State.ListAppliedStates() {
+		for pod, state := range pods {
+			if state.Hash == emptyRulesetHash {
+				continue
+			}
+
+			logger := logger.WithValues("policy", policy, "pod", pod)
+
+			present, err := n.verifyAppliedState(ctx, policy, state)
+			if err != nil {
+				return stale, err
+			}
+
+			switch {
+			case present == nil:
+				logger.V(1).Info("Network namespace of the pod is gone, forgetting its state")
+				metrics.WarmStartVerifications.WithLabelValues("gone").Inc()
+			case !*present:
+				logger.Info("Policy is missing from the pod, it is applied again")
+				metrics.WarmStartVerifications.WithLabelValues("stale").Inc()
+				if !slices.Contains(stale, policy) {
+					stale = append(stale, policy)
+				}
+			default:
+				metrics.WarmStartVerifications.WithLabelValues("ok").Inc()
+				continue
+			}
+
+			n.State.DeleteAppliedStates(policy, func(p types.NamespacedName) bool {
+				return p != pod
+			})
+		}
+	}
+
+	return stale, nil
+}
+
+// verifyAppliedState checks if a policy is still enforced in the network namespace of a pod, it returns nil when the
+// network namespace is gone
+func (n *NFTables) verifyAppliedState(ctx context.Context, policy types.NamespacedName, state datastore.AppliedState) (*bool, error) {
+	release, err := n.acquireNetNS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// The objects of the policy are named with the UID it was applied with
+	var applied *datastore.Policy
+	if n.State != nil {
+		applied = n.State.GetPolicy(policy)
+	}
+	if applied == nil {
+		applied = &datastore.Policy{Name: policy.Name, Namespace: policy.Namespace}
+	}
+
+	present, err := n.enforcer().Enforced(ctx, state.Sandbox, applied)
+	if errors.Is(err, ErrNetNSNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify policy %s: %w", policy, err)
+	}
+
+	return &present, nil
+}
+
+// isPolicyPresent checks if the managed interfaces set of a policy is in the table with its chain, or its rules in the
+// merged chains. The objects are named after the policy and its UID, so that the objects of a policy recreated with the
+// same name are not mistaken for it.
+func isPolicyPresent(ctx context.Context, nft knftables.Interface, policy *datastore.Policy) (bool, error) {
+	hashName := utils.GetPolicyHashName(policy.Name, policy.Namespace, policy.UID)
+	named := func(prefix string) func(name string) bool {
+		return func(name string) bool {
+			return strings.HasPrefix(name, prefix+hashName)
+		}
+	}
+
+	chains, err := nft.List(ctx, "chains")
+	if err != nil {
+		if knftables.IsNotFound(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to list chains: %w", err)
+	}
+
+	sets, err := nft.List(ctx, "sets")
+	if err != nil && !knftables.IsNotFound(err) {
+		return false, fmt.Errorf("failed to list sets: %w", err)
+	}
+
+	if !slices.ContainsFunc(sets, named(prefixManagedInterfacesSet)) {
+		return false, nil
+	}
+
+	if slices.ContainsFunc(chains, named(prefixNetworkPolicyChain)) {
+		return true, nil
+	}
+
+	for _, chain := range []string{mergedIngressChain, mergedEgressChain} {
+		if !slices.Contains(chains, chain) {
+			continue
+		}
+
+		rule, err := findRuleInChain(ctx, nft, chain, mergedRuleComment(policy.Namespace, policy.Name, policy.UID))
+		if err != nil {
+			return false, err
+		}
+		if rule != nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
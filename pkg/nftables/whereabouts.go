@@ -0,0 +1,215 @@
+package nftables
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// IPPoolGVK is the kind of the whereabouts IP pools
+var IPPoolGVK = schema.GroupVersionKind{Group: "whereabouts.cni.cncf.io", Version: "v1alpha1", Kind: "IPPool"}
+
+// Reservation is an address whereabouts allocated to an interface of a pod
+type Reservation struct {
+	Pod       types.NamespacedName
+	Interface string
+	IP        string
+}
+
+// Reservations are the addresses allocated by whereabouts to the interfaces of the pods, learned from its IP pools.
+// The allocation is recorded in the pool during the CNI ADD, before the network status of the pod is reported, and the
+// addresses of the interfaces missing from the network status of the peer pods are taken from the reservations.
+type Reservations struct {
+	mu sync.RWMutex
+	// pools are the reservations of each pool, by pool as <namespace>/<name>
+	pools map[string][]Reservation
+	// pods are the reservations of each pod, by pod and pool
+	pods map[types.NamespacedName]map[string][]Reservation
+}
+
+// NewReservations returns empty reservations
+func NewReservations() *Reservations {
+	return &Reservations{
+		pools: make(map[string][]Reservation),
+		pods:  make(map[types.NamespacedName]map[string][]Reservation),
+	}
+}
+
+// SetPool replaces the reservations of a pool
+func (r *Reservations) SetPool(pool string, reservations []Reservation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deletePool(pool)
+
+	r.pools[pool] = reservations
+	for _, reservation := range reservations {
+		if r.pods[reservation.Pod] == nil {
+			r.pods[reservation.Pod] = make(map[string][]Reservation)
+		}
+		r.pods[reservation.Pod][pool] = append(r.pods[reservation.Pod][pool], reservation)
+	}
+}
+
+// DeletePool forgets the reservations of a pool
+func (r *Reservations) DeletePool(pool string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deletePool(pool)
+}
+
+// deletePool forgets the reservations of a pool, r.mu must be held
+func (r *Reservations) deletePool(pool string) {
+	for _, reservation := range r.pools[pool] {
+		delete(r.pods[reservation.Pod], pool)
+		if len(r.pods[reservation.Pod]) == 0 {
+			delete(r.pods, reservation.Pod)
+		}
+	}
+
+	delete(r.pools, pool)
+}
+
+// Addresses returns the addresses reserved for an interface of a pod, across the pools
+func (r *Reservations) Addresses(pod types.NamespacedName, intf string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var addresses []string
+	for _, reservations := range r.pods[pod] {
+		for _, reservation := range reservations {
+			if reservation.Interface == intf && !slices.Contains(addresses, reservation.IP) {
+				addresses = append(addresses, reservation.IP)
+			}
+		}
+	}
+
+	slices.Sort(addresses)
+	return addresses
+}
+
+// reservedInterfaces returns the interfaces of the networks of a pod missing from its reported interfaces, with the
+// addresses reserved for them. The interfaces not named by the network selection are named as by Multus, net<index>.
+func (r *Reservations) reservedInterfaces(pod *corev1.Pod, reported []Interface) []Interface {
+	networks, err := netdefutils.ParsePodNetworkAnnotation(pod)
+	if err != nil {
+		return nil
+	}
+
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}
+
+	var interfaces []Interface
+	for i, network := range networks {
+		name := network.InterfaceRequest
+		if name == "" {
+			name = fmt.Sprintf("net%d", i+1)
+		}
+
+		if slices.ContainsFunc(reported, func(intf Interface) bool { return intf.Name == name }) {
+			continue
+		}
+
+		addresses := r.Addresses(key, name)
+		if len(addresses) == 0 {
+			continue
+		}
+
+		namespace := network.Namespace
+		if namespace == "" {
+			namespace = pod.Namespace
+		}
+
+		interfaces = append(interfaces, Interface{
+			Name:    name,
+			Network: fmt.Sprintf("%s/%s", namespace, network.Name),
+			IPs:     addresses,
+		})
+	}
+
+	return interfaces
+}
+
+// ParseIPPool returns the reservations of a whereabouts IP pool. The allocations of the pool are offsets from the
+// network address of its range, by the pod reference as <namespace>/<name> and the interface name. The allocations
+// without them, recorded by the releases of whereabouts before the interface name, are skipped, the invalid ones are
+// skipped and returned as an error.
+func ParseIPPool(pool *unstructured.Unstructured) ([]Reservation, error) {
+	ipRange, _, err := unstructured.NestedString(pool.Object, "spec", "range")
+	if err != nil {
+		return nil, fmt.Errorf("invalid range: %w", err)
+	}
+
+	prefix, err := netip.ParsePrefix(ipRange)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range %q: %w", ipRange, err)
+	}
+	prefix = prefix.Masked()
+
+	allocations, _, err := unstructured.NestedMap(pool.Object, "spec", "allocations")
+	if err != nil {
+		return nil, fmt.Errorf("invalid allocations: %w", err)
+	}
+
+	var reservations []Reservation
+	var errs []error
+	for offset, value := range allocations {
+		allocation, ok := value.(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("invalid allocation %s", offset))
+			continue
+		}
+
+		podRef, _ := allocation["podref"].(string)
+		ifName, _ := allocation["ifname"].(string)
+		namespace, name, found := strings.Cut(podRef, "/")
+		if !found || ifName == "" {
+			continue
+		}
+
+		address, err := offsetAddress(prefix, offset)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid allocation %s: %w", offset, err))
+			continue
+		}
+
+		reservations = append(reservations, Reservation{
+			Pod:       types.NamespacedName{Namespace: namespace, Name: name},
+			Interface: ifName,
+			IP:        address.String(),
+		})
+	}
+
+	return reservations, errors.Join(errs...)
+}
+
+// offsetAddress returns the address at a decimal offset from the network address of a prefix
+func offsetAddress(prefix netip.Prefix, offset string) (netip.Addr, error) {
+	value, ok := new(big.Int).SetString(offset, 10)
+	if !ok || value.Sign() < 0 {
+		return netip.Addr{}, fmt.Errorf("invalid offset")
+	}
+
+	base := prefix.Addr().AsSlice()
+	value.Add(value, new(big.Int).SetBytes(base))
+	if value.BitLen() > len(base)*8 {
+		return netip.Addr{}, fmt.Errorf("offset out of range %s", prefix)
+	}
+
+	address, _ := netip.AddrFromSlice(value.FillBytes(make([]byte, len(base))))
+	if !prefix.Contains(address) {
+		return netip.Addr{}, fmt.Errorf("offset out of range %s", prefix)
+	}
+
+	return address, nil
+}
@@ -0,0 +1,382 @@
+// Package nftexec runs the nft binary with its own path and environment, without changing the environment of the
+// process. knftables always runs the nft binary found in PATH with the environment of the process.
+package nftexec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"sigs.k8s.io/knftables"
+)
+
+// Options configure the execution of the nft binary
+type Options struct {
+	// Path is the nft binary, it is looked up in PATH when empty
+	Path string
+	// Env is the extra environment of the nft binary, as KEY=VALUE
+	Env []string
+}
+
+// Validate checks that the binary is executable and that the environment is valid
+func (o Options) Validate() error {
+	if o.Path != "" {
+		info, err := os.Stat(o.Path)
+		if err != nil {
+			return fmt.Errorf("failed to find nft binary: %w", err)
+		}
+		if info.IsDir() || info.Mode().Perm()&0o111 == 0 {
+			return fmt.Errorf("nft binary %s is not executable", o.Path)
+		}
+	}
+
+	for _, env := range o.Env {
+		if key, _, found := strings.Cut(env, "="); !found || key == "" {
+			return fmt.Errorf("invalid nft environment variable %q, expected KEY=VALUE", env)
+		}
+	}
+
+	return nil
+}
+
+// binary returns the absolute path of the nft binary
+func (o Options) binary() (string, error) {
+	if o.Path != "" {
+		return o.Path, nil
+	}
+
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return "", fmt.Errorf("could not find nftables binary: %w", err)
+	}
+
+	return path, nil
+}
+
+// Command returns the command running the nft binary with the arguments, the extra environment is only set on it
+func (o Options) Command(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	path, err := o.binary()
+	if err != nil {
+		return nil, err
+	}
+
+	return o.command(ctx, path, args...), nil
+}
+
+func (o Options) command(ctx context.Context, path string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path, args...)
+	if len(o.Env) > 0 {
+		cmd.Env = append(os.Environ(), o.Env...)
+	}
+
+	return cmd
+}
+
+// RunScript runs an nft script, or only checks it as with nft --check. The missing objects are reported with an
+// error for which knftables.IsNotFound is true.
+func (o Options) RunScript(ctx context.Context, script string, check bool) error {
+	args := []string{"-f", "-"}
+	if check {
+		args = append([]string{"--check"}, args...)
+	}
+
+	cmd, err := o.Command(ctx, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = strings.NewReader(script)
+
+	_, err = run(cmd)
+	return err
+}
+
+// run runs an nft command and returns its output, the error has the message of nft
+func run(cmd *exec.Cmd) (string, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", err
+		}
+
+		// nft reports the missing objects on the first line of its output, as knftables does
+		if first, _, _ := strings.Cut(msg, "\n"); strings.Contains(first, "No such file or directory") {
+			return "", NotFoundError(msg)
+		}
+		return "", fmt.Errorf("%w: %s", err, msg)
+	}
+
+	return string(out), nil
+}
+
+// notFound is an error for which knftables.IsNotFound is true, knftables does not export its errors so it wraps the
+// error of a fake listing a missing table
+type notFound struct {
+	msg     string
+	wrapped error
+}
+
+func (e *notFound) Error() string {
+	return e.msg
+}
+
+func (e *notFound) Unwrap() error {
+	return e.wrapped
+}
+
+// NotFoundError returns an error with the message for which knftables.IsNotFound is true
+func NotFoundError(msg string) error {
+	_, err := knftables.NewFake(knftables.InetFamily, "").List(context.Background(), "chains")
+	return &notFound{msg: msg, wrapped: err}
+}
+
+// nftables is an nftables client of a table running the nft binary of the options. The transactions are created by
+// a fake, and rendered with the comments of the objects, which need a kernel supporting them.
+type nftables struct {
+	opts   Options
+	path   string
+	family knftables.Family
+	table  string
+	fake   *knftables.Fake
+}
+
+var _ knftables.Interface = &nftables{}
+
+// New returns an nftables client of the table running the nft binary of the options
+func New(family knftables.Family, table string, opts Options) (knftables.Interface, error) {
+	path, err := opts.binary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nftables{
+		opts:   opts,
+		path:   path,
+		family: family,
+		table:  table,
+		fake:   knftables.NewFake(family, table),
+	}, nil
+}
+
+func (n *nftables) NewTransaction() *knftables.Transaction {
+	return n.fake.NewTransaction()
+}
+
+func (n *nftables) Run(ctx context.Context, tx *knftables.Transaction) error {
+	return n.runTransaction(ctx, tx, false)
+}
+
+func (n *nftables) Check(ctx context.Context, tx *knftables.Transaction) error {
+	return n.runTransaction(ctx, tx, true)
+}
+
+// transactionErrorPrefix prefixes the pending error of a transaction, rendered as a comment at its end
+const transactionErrorPrefix = "# ERROR: "
+
+func (n *nftables) runTransaction(ctx context.Context, tx *knftables.Transaction, check bool) error {
+	script := tx.String()
+	if _, txErr, found := strings.Cut(script, transactionErrorPrefix); found {
+		return errors.New(strings.TrimSpace(txErr))
+	}
+
+	args := []string{"-f", "-"}
+	if check {
+		args = append([]string{"--check"}, args...)
+	}
+
+	cmd := n.opts.command(ctx, n.path, args...)
+	cmd.Stdin = strings.NewReader(script)
+
+	_, err := run(cmd)
+	return err
+}
+
+// list runs an nft list command and returns the objects of a type of its JSON output
+func (n *nftables) list(ctx context.Context, objectType string, args ...string) ([]map[string]interface{}, error) {
+	out, err := run(n.opts.command(ctx, n.path, append([]string{"--json", "list"}, args...)...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to run nft: %w", err)
+	}
+
+	var result struct {
+		NFTables []map[string]map[string]interface{} `json:"nftables"`
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return nil, fmt.Errorf("could not parse nft output: %w", err)
+	}
+
+	if len(result.NFTables) == 0 || result.NFTables[0]["metainfo"] == nil {
+		return nil, fmt.Errorf("could not find metadata in nft output %q", out)
+	}
+	if version, ok := result.NFTables[0]["metainfo"]["json_schema_version"].(float64); !ok || version != 1 {
+		return nil, fmt.Errorf("could not find supported json_schema_version in nft output %q", out)
+	}
+
+	var objects []map[string]interface{}
+	for _, container := range result.NFTables {
+		if object := container[objectType]; object != nil {
+			objects = append(objects, object)
+		}
+	}
+
+	return objects, nil
+}
+
+func (n *nftables) List(ctx context.Context, objectType string) ([]string, error) {
+	singular := strings.TrimSuffix(objectType, "s")
+
+	objects, err := n.list(ctx, singular, singular+"s", string(n.family))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, object := range objects {
+		if table, _ := object["table"].(string); table != n.table {
+			continue
+		}
+		if name, ok := object["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func (n *nftables) ListRules(ctx context.Context, chain string) ([]*knftables.Rule, error) {
+	args := []string{"table", string(n.family), n.table}
+	if chain != "" {
+		args = []string{"chain", string(n.family), n.table, chain}
+	}
+
+	objects, err := n.list(ctx, "rule", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*knftables.Rule, 0, len(objects))
+	for _, object := range objects {
+		parent, ok := object["chain"].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected JSON output from nft (rule with no chain)")
+		}
+
+		rule := &knftables.Rule{Chain: parent}
+		if handle, ok := object["handle"].(float64); ok {
+			rule.Handle = knftables.PtrTo(int(handle))
+		}
+		if comment, ok := object["comment"].(string); ok {
+			rule.Comment = &comment
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (n *nftables) ListElements(ctx context.Context, objectType, name string) ([]*knftables.Element, error) {
+	objects, err := n.list(ctx, objectType, objectType, string(n.family), n.table, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) != 1 {
+		return nil, fmt.Errorf("unexpected JSON output from nft (multiple results)")
+	}
+
+	jsonElements, _ := objects[0]["elem"].([]interface{})
+	elements := make([]*knftables.Element, 0, len(jsonElements))
+	for _, jsonElement := range jsonElements {
+		element := &knftables.Element{}
+
+		var key, value interface{}
+		if objectType == "set" {
+			element.Set = name
+			key = jsonElement
+		} else {
+			element.Map = name
+			tuple, ok := jsonElement.([]interface{})
+			if !ok || len(tuple) != 2 {
+				return nil, fmt.Errorf("unexpected JSON output from nft (elem is not [key,val]: %q)", jsonElement)
+			}
+			key, value = tuple[0], tuple[1]
+		}
+
+		// The elements with a comment are {"elem": {"val": <key>, "comment": <comment>}}
+		if object, ok := key.(map[string]interface{}); ok {
+			if compound, ok := object["elem"].(map[string]interface{}); ok {
+				if key, ok = compound["val"]; !ok {
+					return nil, fmt.Errorf("unexpected JSON output from nft (elem with no val: %q)", jsonElement)
+				}
+				if comment, ok := compound["comment"].(string); ok {
+					element.Comment = &comment
+				}
+			}
+		}
+
+		if element.Key, err = parseElementValue(key); err != nil {
+			return nil, err
+		}
+		if value != nil {
+			if element.Value, err = parseElementValue(value); err != nil {
+				return nil, err
+			}
+		}
+
+		elements = append(elements, element)
+	}
+
+	return elements, nil
+}
+
+// parseElementValue parses a key or a value of an element: a string, a number, a prefix, a concatenation or a verdict
+func parseElementValue(value interface{}) ([]string, error) {
+	switch val := value.(type) {
+	case string:
+		return []string{val}, nil
+	case float64:
+		return []string{fmt.Sprintf("%d", int(val))}, nil
+	case map[string]interface{}:
+		if concat, ok := val["concat"].([]interface{}); ok {
+			values := make([]string, 0, len(concat))
+			for _, part := range concat {
+				parsed, err := parseElementValue(part)
+				if err != nil || len(parsed) != 1 {
+					return nil, fmt.Errorf("could not parse element value %q", part)
+				}
+				values = append(values, parsed[0])
+			}
+			return values, nil
+		}
+
+		if prefix, ok := val["prefix"].(map[string]interface{}); ok {
+			addr, ok := prefix["addr"].(string)
+			if !ok {
+				return nil, fmt.Errorf("could not parse 'addr' value as string: %q", prefix)
+			}
+			length, ok := prefix["len"].(float64)
+			if !ok {
+				return nil, fmt.Errorf("could not parse 'len' value as number: %q", prefix)
+			}
+			return []string{fmt.Sprintf("%s/%d", addr, int(length))}, nil
+		}
+
+		if len(val) == 1 {
+			for verdict, target := range val {
+				if target, ok := target.(map[string]interface{}); ok {
+					return []string{fmt.Sprintf("%s %s", verdict, target["target"])}, nil
+				}
+				return []string{verdict}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("could not parse element value %q", value)
+}
@@ -0,0 +1,123 @@
+package nftexec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/knftables"
+)
+
+func TestNFTExec(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "nft Execution Suite")
+}
+
+var _ = Describe("nft execution", func() {
+	const table = "multi_networkpolicy"
+
+	var (
+		ctx  context.Context
+		dir  string
+		opts Options
+	)
+
+	// writeNFT writes an nft binary printing the output and exiting with the status
+	writeNFT := func(output string, status int) {
+		script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat > " + filepath.Join(dir, "stdin") +
+			"\ncat <<'EOF'\n" + output + "\nEOF\n"
+		if status != 0 {
+			script = "#!/bin/sh\necho '" + output + "' >&2\nexit " + strconv.Itoa(status) + "\n"
+		}
+		Expect(os.WriteFile(opts.Path, []byte(script), 0o755)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		dir = GinkgoT().TempDir()
+		opts = Options{Path: filepath.Join(dir, "nft"), Env: []string{"NFT_TEST_ENV=value"}}
+	})
+
+	It("should set the environment on the nft invocations only", func() {
+		cmd, err := opts.Command(ctx, "--version")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cmd.Path).To(Equal(opts.Path))
+		Expect(cmd.Env).To(ContainElement("NFT_TEST_ENV=value"))
+		Expect(os.LookupEnv("NFT_TEST_ENV")).Error().To(BeFalse())
+	})
+
+	It("should run and check the transactions", func() {
+		writeNFT("", 0)
+
+		nft, err := New(knftables.InetFamily, table, opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		tx := nft.NewTransaction()
+		tx.Add(&knftables.Table{})
+		Expect(nft.Check(ctx, tx)).To(Succeed())
+		Expect(os.ReadFile(filepath.Join(dir, "args"))).To(Equal([]byte("--check -f -\n")))
+
+		Expect(nft.Run(ctx, tx)).To(Succeed())
+		Expect(os.ReadFile(filepath.Join(dir, "args"))).To(Equal([]byte("-f -\n")))
+		Expect(os.ReadFile(filepath.Join(dir, "stdin"))).To(Equal([]byte(tx.String())))
+
+		tx = nft.NewTransaction()
+		tx.Add(&knftables.Chain{})
+		Expect(nft.Run(ctx, tx)).NotTo(Succeed())
+	})
+
+	It("should report the missing objects as not found", func() {
+		writeNFT("Error: No such file or directory; did you mean table 'filter'?", 1)
+
+		nft, err := New(knftables.InetFamily, table, opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = nft.ListRules(ctx, "input")
+		Expect(knftables.IsNotFound(err)).To(BeTrue())
+		Expect(knftables.IsNotFound(opts.RunScript(ctx, "delete table inet "+table+"\n", false))).To(BeTrue())
+	})
+
+	It("should parse the listed objects", func() {
+		nft, err := New(knftables.InetFamily, table, opts)
+		Expect(err).NotTo(HaveOccurred())
+
+		writeNFT(`{"nftables": [{"metainfo": {"json_schema_version": 1}},
+			{"chain": {"family": "inet", "table": "`+table+`", "name": "input"}},
+			{"chain": {"family": "inet", "table": "filter", "name": "forward"}}]}`, 0)
+		chains, err := nft.List(ctx, "chains")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chains).To(Equal([]string{"input"}))
+		Expect(os.ReadFile(filepath.Join(dir, "args"))).To(Equal([]byte("--json list chains inet\n")))
+
+		writeNFT(`{"nftables": [{"metainfo": {"json_schema_version": 1}},
+			{"rule": {"family": "inet", "table": "`+table+`", "chain": "input", "handle": 4, "comment": "ns/policy"}}]}`, 0)
+		rules, err := nft.ListRules(ctx, "input")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rules).To(Equal([]*knftables.Rule{{Chain: "input", Handle: knftables.PtrTo(4), Comment: knftables.PtrTo("ns/policy")}}))
+
+		writeNFT(`{"nftables": [{"metainfo": {"json_schema_version": 1}},
+			{"map": {"family": "inet", "table": "`+table+`", "name": "peers", "elem": [
+				[{"concat": ["10.0.0.1", "tcp", 80]}, {"goto": {"target": "ingress"}}],
+				[{"elem": {"val": {"prefix": {"addr": "10.1.0.0", "len": 16}}, "comment": "net1"}}, {"drop": null}]
+			]}}]}`, 0)
+		elements, err := nft.ListElements(ctx, "map", "peers")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(elements).To(Equal([]*knftables.Element{
+			{Map: "peers", Key: []string{"10.0.0.1", "tcp", "80"}, Value: []string{"goto ingress"}},
+			{Map: "peers", Key: []string{"10.1.0.0/16"}, Value: []string{"drop"}, Comment: knftables.PtrTo("net1")},
+		}))
+	})
+
+	It("should reject invalid options", func() {
+		Expect(os.WriteFile(filepath.Join(dir, "nftables"), []byte("#!/bin/sh\n"), 0o644)).To(Succeed())
+
+		Expect(Options{Path: filepath.Join(dir, "nftables")}.Validate()).NotTo(Succeed())
+		Expect(Options{Path: filepath.Join(dir, "missing")}.Validate()).NotTo(Succeed())
+		Expect(Options{Env: []string{"=value"}}.Validate()).NotTo(Succeed())
+		Expect(Options{Env: []string{"KEY=value"}}.Validate()).To(Succeed())
+	})
+})
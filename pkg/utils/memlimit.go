@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cgroupMemoryLimitFiles are the files with the memory limit of the container, with cgroup v2 and v1
+var cgroupMemoryLimitFiles = []string{
+	"/sys/fs/cgroup/memory.max",
+	"/sys/fs/cgroup/memory/memory.limit_in_bytes",
+}
+
+// unlimitedCgroupV1Memory is the threshold above which a cgroup v1 memory limit is the page aligned maximum int64,
+// meaning that the memory is not limited
+const unlimitedCgroupV1Memory = 1 << 62
+
+// CgroupMemoryLimit returns the memory limit of the container in bytes, 0 when the memory is not limited or when the
+// cgroup filesystem is not mounted
+func CgroupMemoryLimit() (int64, error) {
+	return cgroupMemoryLimit(cgroupMemoryLimitFiles)
+}
+
+// cgroupMemoryLimit returns the memory limit read from the first existing file of files
+func cgroupMemoryLimit(files []string) (int64, error) {
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the memory limit: %w", err)
+		}
+
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, nil
+		}
+
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid memory limit %q in %s: %w", value, file, err)
+		}
+
+		if limit <= 0 || limit >= unlimitedCgroupV1Memory {
+			return 0, nil
+		}
+
+		return limit, nil
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"encoding/json"
+
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	netdefutils "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/utils"
+)
+
+// ParseFirstPluginConf parses the configuration of the first plugin of a network attachment definition into T, or the
+// configuration of the network itself when it is not a list of plugins
+func ParseFirstPluginConf[T any](netAttachDef *netdefv1.NetworkAttachmentDefinition) (*T, error) {
+	confBytes, err := netdefutils.GetCNIConfigFromSpec(netAttachDef.Spec.Config, netAttachDef.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	netconfList := &struct {
+		Plugins []T `json:"plugins"`
+	}{}
+	if err := json.Unmarshal(confBytes, netconfList); err != nil {
+		return nil, err
+	}
+
+	if len(netconfList.Plugins) > 0 {
+		return &netconfList.Plugins[0], nil
+	}
+
+	netconf := new(T)
+	if err := json.Unmarshal(confBytes, netconf); err != nil {
+		return nil, err
+	}
+
+	return netconf, nil
+}
@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"crypto/sha256"
 	"fmt"
-	"net"
+	"io"
+	"net/netip"
 	"os"
 	"strings"
+	"sync"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // ParseCommaSeparatedList parses a comma-separated string into a slice of non-empty strings.
@@ -43,10 +46,32 @@ func GetHashName(name, namespace string) string {
 	return fmt.Sprintf("%x", hash[:16])
 }
 
+// GetPolicyHashName returns the hash name of a policy object, the hash of its namespace name followed by the first 8
+// characters of the SHA256 hash of its UID, so that a policy recreated with the same name names its objects apart from
+// the objects of the deleted one. The names of a policy without a UID are the hash of its namespace name.
+func GetPolicyHashName(name, namespace string, uid types.UID) string {
+	hashName := GetHashName(name, namespace)
+	if uid == "" {
+		return hashName
+	}
+
+	hash := sha256.Sum256([]byte(uid))
+	return fmt.Sprintf("%s%x", hashName, hash[:4])
+}
+
+// maxCachedSelectors bounds the selector cache, it is cleared when it is full
+const maxCachedSelectors = 4096
+
+// selectorCache caches the label selectors converted by MatchesSelector, keyed by their string representation, the
+// same selectors of the policies are matched against every pod and namespace event
+var selectorCache = struct {
+	sync.RWMutex
+	selectors map[string]labels.Selector
+}{selectors: make(map[string]labels.Selector)}
+
 // MatchesSelector checks if the pod labels match the given label selector
 func MatchesSelector(selector metav1.LabelSelector, podLabels map[string]string) bool {
-	// Convert the metav1.LabelSelector to a labels.Selector
-	labelSelector, err := metav1.LabelSelectorAsSelector(&selector)
+	labelSelector, err := cachedSelector(&selector)
 	if err != nil {
 		// If the selector is invalid, we don't match
 		return false
@@ -61,33 +86,92 @@ func MatchesSelector(selector metav1.LabelSelector, podLabels map[string]string)
 	return labelSelector.Matches(podLabelSet)
 }
 
-// SplitCIDRs splits the CIDRs into IPv4 and IPv6 CIDRs
+// cachedSelector converts a metav1.LabelSelector to a labels.Selector, once per distinct selector
+func cachedSelector(selector *metav1.LabelSelector) (labels.Selector, error) {
+	key := selector.String()
+
+	selectorCache.RLock()
+	labelSelector, ok := selectorCache.selectors[key]
+	selectorCache.RUnlock()
+	if ok {
+		return labelSelector, nil
+	}
+
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	selectorCache.Lock()
+	defer selectorCache.Unlock()
+
+	if len(selectorCache.selectors) >= maxCachedSelectors {
+		clear(selectorCache.selectors)
+	}
+	selectorCache.selectors[key] = labelSelector
+
+	return labelSelector, nil
+}
+
+// SplitCIDRs splits the CIDRs into normalized IPv4 and IPv6 CIDRs, skipping the invalid ones
 func SplitCIDRs(cidrs []string) ([]string, []string) {
 	var ipv4CIDRs []string
 	var ipv6CIDRs []string
 
 	for _, cidr := range cidrs {
-		// Parse the CIDR to validate and classify it
-		parsedIP, _, err := net.ParseCIDR(cidr)
+		prefix, err := normalizePrefix(cidr)
 		if err != nil {
 			continue
 		}
 
-		// Check if it's IPv4 (including IPv4-mapped IPv6)
-		if parsedIP.To4() != nil {
-			ipv4CIDRs = append(ipv4CIDRs, cidr)
+		if prefix.Addr().Is4() {
+			ipv4CIDRs = append(ipv4CIDRs, prefix.String())
 		} else {
-			ipv6CIDRs = append(ipv6CIDRs, cidr)
+			ipv6CIDRs = append(ipv6CIDRs, prefix.String())
 		}
 	}
 
 	return ipv4CIDRs, ipv6CIDRs
 }
 
+// NormalizeCIDR normalizes a CIDR: the zone identifier is removed, an IPv4-mapped IPv6 CIDR is converted to the IPv4
+// CIDR and the host bits are cleared, e.g. "::ffff:10.0.0.1/104" is normalized to "10.0.0.0/8"
+func NormalizeCIDR(cidr string) (string, error) {
+	prefix, err := normalizePrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix.String(), nil
+}
+
+// normalizePrefix parses and normalizes a CIDR
+func normalizePrefix(cidr string) (netip.Prefix, error) {
+	address, bits, found := strings.Cut(strings.TrimSpace(cidr), "/")
+	if !found {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q, missing the prefix length", cidr)
+	}
+
+	// The zone identifiers of the link-local addresses do not apply to the addresses of the other interfaces
+	address, _, _ = strings.Cut(address, "%")
+
+	prefix, err := netip.ParsePrefix(address + "/" + bits)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+	}
+
+	if prefix.Addr().Is4In6() {
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q, an IPv4-mapped CIDR must be at least /96", cidr)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix.Masked(), nil
+}
+
 // ReadRulesFromFile reads rules from a file
 func ReadRulesFromFile(filePath string) ([]string, error) {
-	var rules []string
-
 	if filePath == "" {
 		return nil, fmt.Errorf("file path cannot be empty")
 	}
@@ -98,17 +182,46 @@ func ReadRulesFromFile(filePath string) ([]string, error) {
 	}
 	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
+	return ReadRules(f)
+}
+
+// Rule is an nftables rule read from a rules file
+type Rule struct {
+	// Line is the line number of the rule in the file, starting at 1
+	Line int
+	Text string
+}
+
+// ReadRules reads nftables rules, one per line, skipping empty lines and comments
+func ReadRules(r io.Reader) ([]string, error) {
+	ruleLines, err := ReadRuleLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []string
+	for _, rule := range ruleLines {
+		rules = append(rules, rule.Text)
+	}
+
+	return rules, nil
+}
+
+// ReadRuleLines reads nftables rules with their line numbers, skipping empty lines and comments
+func ReadRuleLines(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
 		rule := scanner.Text()
 		if rule == "" || strings.HasPrefix(rule, "#") {
 			continue
 		}
 
-		rules = append(rules, rule)
+		rules = append(rules, Rule{Line: line, Text: rule})
 	}
 
-	if err = scanner.Err(); err != nil {
+	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 
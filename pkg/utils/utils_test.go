@@ -1,11 +1,16 @@
 package utils
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	netdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 func TestUtils(t *testing.T) {
@@ -116,6 +121,54 @@ var _ = Describe("ParseCommaSeparatedList", func() {
 		})
 	})
 
+	Describe("GetPolicyHashName", func() {
+		It("should append the hash of the UID to the hash of the namespace name", func() {
+			hashName := GetHashName("test-policy", "test-namespace")
+
+			hash := GetPolicyHashName("test-policy", "test-namespace", types.UID("2c9a5ef4-1f9d-4d4a-9b43-6d2e5b0f7a10"))
+			Expect(hash).To(HavePrefix(hashName))
+			Expect(hash).To(MatchRegexp("^[a-f0-9]{40}$"))
+
+			recreated := GetPolicyHashName("test-policy", "test-namespace", types.UID("8f0c7b1e-5a3d-4e2f-a1b6-0d9e8c7f6a5b"))
+			Expect(recreated).To(HavePrefix(hashName))
+			Expect(recreated).NotTo(Equal(hash))
+		})
+
+		It("should return the hash of the namespace name without a UID", func() {
+			Expect(GetPolicyHashName("test-policy", "test-namespace", "")).To(Equal(GetHashName("test-policy", "test-namespace")))
+		})
+	})
+
+	Describe("ParseFirstPluginConf", func() {
+		type netConf struct {
+			Type string `json:"type"`
+		}
+
+		netAttachDef := func(config string) *netdefv1.NetworkAttachmentDefinition {
+			return &netdefv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "net1", Namespace: "default"},
+				Spec:       netdefv1.NetworkAttachmentDefinitionSpec{Config: config},
+			}
+		}
+
+		It("should parse the first plugin of a list of plugins", func() {
+			netconf, err := ParseFirstPluginConf[netConf](netAttachDef(`{"cniVersion": "0.4.0", "plugins": [{"type": "sriov"}, {"type": "tuning"}]}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netconf.Type).To(Equal("sriov"))
+		})
+
+		It("should parse the configuration of a single plugin", func() {
+			netconf, err := ParseFirstPluginConf[netConf](netAttachDef(`{"cniVersion": "0.4.0", "type": "macvlan"}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netconf.Type).To(Equal("macvlan"))
+		})
+
+		It("should return an error for an invalid configuration", func() {
+			_, err := ParseFirstPluginConf[netConf](netAttachDef(`{"type": `))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Describe("MatchesPodSelector", func() {
 		Context("when selector is empty", func() {
 			It("should match any pod", func() {
@@ -150,6 +203,62 @@ var _ = Describe("ParseCommaSeparatedList", func() {
 				Expect(result).To(BeFalse())
 			})
 		})
+
+		DescribeTable("should match the expressions of the selector",
+			func(operator metav1.LabelSelectorOperator, values []string, podLabels map[string]string, expected bool) {
+				selector := metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: operator, Values: values}},
+				}
+
+				Expect(MatchesSelector(selector, podLabels)).To(Equal(expected))
+			},
+			Entry("In with a listed value", metav1.LabelSelectorOpIn, []string{"web", "api"}, map[string]string{"app": "api"}, true),
+			Entry("In with another value", metav1.LabelSelectorOpIn, []string{"web", "api"}, map[string]string{"app": "db"}, false),
+			Entry("In without the label", metav1.LabelSelectorOpIn, []string{"web"}, map[string]string{}, false),
+			Entry("NotIn with a listed value", metav1.LabelSelectorOpNotIn, []string{"web"}, map[string]string{"app": "web"}, false),
+			Entry("NotIn with another value", metav1.LabelSelectorOpNotIn, []string{"web"}, map[string]string{"app": "db"}, true),
+			Entry("NotIn without the label", metav1.LabelSelectorOpNotIn, []string{"web"}, map[string]string{}, true),
+			Entry("Exists with the label", metav1.LabelSelectorOpExists, nil, map[string]string{"app": ""}, true),
+			Entry("Exists without the label", metav1.LabelSelectorOpExists, nil, map[string]string{"tier": "web"}, false),
+			Entry("DoesNotExist with the label", metav1.LabelSelectorOpDoesNotExist, nil, map[string]string{"app": "web"}, false),
+			Entry("DoesNotExist without the label", metav1.LabelSelectorOpDoesNotExist, nil, map[string]string{}, true),
+		)
+
+		Context("when the selector has labels and expressions", func() {
+			It("should match the pods matching both", func() {
+				selector := metav1.LabelSelector{
+					MatchLabels:      map[string]string{"tier": "frontend"},
+					MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"legacy"}}},
+				}
+
+				Expect(MatchesSelector(selector, map[string]string{"tier": "frontend", "app": "web"})).To(BeTrue())
+				Expect(MatchesSelector(selector, map[string]string{"tier": "frontend", "app": "legacy"})).To(BeFalse())
+				Expect(MatchesSelector(selector, map[string]string{"tier": "backend", "app": "web"})).To(BeFalse())
+			})
+		})
+
+		Context("when the same selector is matched again", func() {
+			It("should reuse the converted selector", func() {
+				selector := metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"cached"}}},
+				}
+
+				Expect(MatchesSelector(selector, map[string]string{"app": "cached"})).To(BeTrue())
+				Expect(selectorCache.selectors).To(HaveKey(selector.String()))
+				Expect(MatchesSelector(selector, map[string]string{"app": "other"})).To(BeFalse())
+			})
+		})
+
+		Context("when selector is invalid", func() {
+			It("should return false and not cache it", func() {
+				selector := metav1.LabelSelector{
+					MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Invalid"}},
+				}
+
+				Expect(MatchesSelector(selector, map[string]string{"app": "test"})).To(BeFalse())
+				Expect(selectorCache.selectors).NotTo(HaveKey(selector.String()))
+			})
+		})
 	})
 
 	Context("splitCIDRs", func() {
@@ -242,14 +351,30 @@ var _ = Describe("ParseCommaSeparatedList", func() {
 
 			ipv4, ipv6 := SplitCIDRs(cidrs)
 
-			// IPv4-mapped IPv6 should be classified as IPv4
+			// IPv4-mapped IPv6 should be converted to IPv4
 			Expect(ipv4).To(HaveLen(3))
-			Expect(ipv4).To(ContainElements("::ffff:192.168.1.0/120", "::ffff:10.0.0.0/120", "192.168.1.0/24"))
+			Expect(ipv4).To(ContainElements("192.168.1.0/24", "10.0.0.0/24", "192.168.1.0/24"))
 
 			Expect(ipv6).To(HaveLen(1))
 			Expect(ipv6).To(ContainElement("2001:db8::/32"))
 		})
 
+		It("should normalize the CIDRs", func() {
+			ipv4, ipv6 := SplitCIDRs([]string{"10.1.2.3/8", " 192.168.1.1/32", "fe80::1%eth0/64", "2001:DB8::1/32"})
+
+			Expect(ipv4).To(Equal([]string{"10.0.0.0/8", "192.168.1.1/32"}))
+			Expect(ipv6).To(Equal([]string{"fe80::/64", "2001:db8::/32"}))
+		})
+
+		It("should reject the invalid CIDRs", func() {
+			Expect(NormalizeCIDR("::ffff:10.0.0.1/104")).To(Equal("10.0.0.0/8"))
+
+			for _, cidr := range []string{"10.0.0.1", "10.0.0.0/33", "::ffff:10.0.0.0/64", "host/24"} {
+				_, err := NormalizeCIDR(cidr)
+				Expect(err).To(HaveOccurred(), cidr)
+			}
+		})
+
 		It("should handle single host addresses with /32 and /128", func() {
 			cidrs := []string{
 				"192.168.1.1/32",  // Single IPv4 host
@@ -314,4 +439,47 @@ var _ = Describe("ParseCommaSeparatedList", func() {
 			Expect(ipv6).To(BeEmpty())
 		})
 	})
+
+	Context("ReadRuleLines", func() {
+		It("should return the rules with their line numbers", func() {
+			rules, err := ReadRuleLines(strings.NewReader("# Allow SSH\ntcp dport 22 accept\n\nudp dport 53 accept\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).To(Equal([]Rule{
+				{Line: 2, Text: "tcp dport 22 accept"},
+				{Line: 4, Text: "udp dport 53 accept"},
+			}))
+		})
+	})
+
+	Context("cgroupMemoryLimit", func() {
+		var dir string
+
+		BeforeEach(func() {
+			dir = GinkgoT().TempDir()
+		})
+
+		limit := func(content string) (int64, error) {
+			file := filepath.Join(dir, "memory.max")
+			Expect(os.WriteFile(file, []byte(content), 0o600)).To(Succeed())
+			return cgroupMemoryLimit([]string{filepath.Join(dir, "missing"), file})
+		}
+
+		It("should read the limit of the first existing file", func() {
+			Expect(limit("536870912\n")).To(Equal(int64(536870912)))
+		})
+
+		It("should return 0 when the memory is not limited", func() {
+			Expect(limit("max\n")).To(BeZero())
+			Expect(limit("9223372036854771712\n")).To(BeZero())
+		})
+
+		It("should return 0 without cgroup files", func() {
+			Expect(cgroupMemoryLimit([]string{filepath.Join(dir, "missing")})).To(BeZero())
+		})
+
+		It("should fail on an invalid limit", func() {
+			_, err := limit("unknown")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })